@@ -0,0 +1,103 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/yolo"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// runCommand runs a subcommand, for tasks which should work without the API running.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "seed":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: seed <file>")
+		}
+		if err := yolo.Seed(args[1]); err != nil {
+			return err
+		}
+		log.WithField("file", args[1]).Info("Loaded fixture")
+		return nil
+	case "token":
+		return runTokenCommand(args[1:])
+	case "encrypt-credentials":
+		// Encrypts plaintext values and re-encrypts values using previous keys
+		count, err := db.EncryptColumn("stations", "id", "credentials")
+		if err != nil {
+			return err
+		}
+		log.WithField("count", count).Info("Encrypted station credentials")
+		return nil
+	default:
+		return fmt.Errorf("unknown command: %v", args[0])
+	}
+}
+
+// runTokenCommand creates or revokes non-user access tokens directly in the DB, e.g. while the API is down.
+func runTokenCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: token create|revoke")
+	}
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("token create", flag.ContinueOnError)
+		role := flags.String("role", "", "role (tester, runner, operator or admin)")
+		comment := flags.String("comment", "", "what the token is for")
+		days := flags.Int("days", 365, "days until the token expires")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		token, err := rest.CreateNonUserAccessToken(rest.Role(*role), *comment, time.Duration(*days)*24*time.Hour)
+		if err != nil {
+			return err
+		}
+		// The key is only shown here
+		fmt.Printf("id: %v\nkey: %v\nexpires: %v\n", token.ID, token.Key, token.ExpirationTime.Format(time.RFC3339))
+		return nil
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: token revoke <id>")
+		}
+		id, uuidErr := uuid.Parse(args[1])
+		if uuidErr != nil {
+			return fmt.Errorf("invalid ID: %v", args[1])
+		}
+		revoked, err := rest.RevokeAccessToken(id)
+		if err != nil {
+			return err
+		}
+		if !revoked {
+			return fmt.Errorf("no non-static token with ID %v", id)
+		}
+		log.WithField("id", id).Info("Revoked access token")
+		return nil
+	default:
+		return fmt.Errorf("unknown token command: %v", args[0])
+	}
+}
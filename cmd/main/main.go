@@ -21,16 +21,25 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package main
 
 import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
 	_ "github.com/gathering/tech-online-backend/doc"
 	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/worker"
 	_ "github.com/gathering/tech-online-backend/yolo"
 	log "github.com/sirupsen/logrus"
 )
 
 func main() {
-	if err := config.ParseConfig("config.json"); err != nil {
+	configFile := flag.String("config", "config.json", "config file (empty to only use "+config.EnvPrefix+"_* environment variables)")
+	flag.Parse()
+
+	if err := config.ParseConfig(*configFile); err != nil {
 		log.WithError(err).Fatal("Failed to read config file")
 		return
 	}
@@ -42,11 +51,33 @@ func main() {
 	}
 	log.Info("Connected to database")
 
+	// Run subcommand instead of the server, if any
+	if args := flag.Args(); len(args) > 0 && args[0] != "" {
+		if err := runCommand(args); err != nil {
+			log.WithError(err).Fatal("Command failed")
+		}
+		return
+	}
+
 	if err := rest.UpdateStaticAccessTokens(); err != nil {
 		log.WithError(err).Fatal("Failed to update static access tokens")
 		return
 	}
 	log.Info("Updated static access tokens")
 
+	worker.Start()
+	log.Info("Started background workers")
+
+	// Reload the config on SIGHUP
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go func() {
+		for range reloadSignals {
+			if err := rest.ReloadConfig(); err != nil {
+				log.WithError(err).Error("Failed to reload config, keeping the current config")
+			}
+		}
+	}()
+
 	rest.StartReceiver()
 }
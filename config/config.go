@@ -23,22 +23,70 @@ package config
 import (
 	"encoding/json"
 	"io/ioutil"
+	"reflect"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
-// Config covers global configuration, and if need be it will provide
-// mechanisms for local overrides (similar to Skogul).
-var Config struct {
-	ListenAddress  string                               `json:"listen_address"`  // Defaults to :8080
-	DatabaseString string                               `json:"database_string"` // For database connections
-	SitePrefix     string                               `json:"site_prefix"`     // URL prefix, e.g. "/api"
-	Debug          bool                                 `json:"debug"`           // Enables trace-debugging
-	OAuth2         OAuth2Config                         `json:"oauth2"`          // OAuth2 section
-	Unicorn        UnicornConfig                        `json:"unicorn"`         // Unicorn IdP section
-	ServerTracks   map[string]ServerTrackConfig         `json:"server_tracks"`   // Static config for server tracks
-	AccessTokens   map[uuid.UUID]AccessTokenEntryConfig `json:"access_tokens"`   // Static config for server tracks
+// current holds the *Settings covering global configuration, see Get.
+var current atomic.Value
+
+func init() {
+	current.Store(&Settings{})
+}
+
+// Get returns the current global configuration.
+// It's replaced as a whole when reloaded (never modified in place), so get it
+// again instead of keeping references to it or its contents for longer than
+// necessary.
+func Get() *Settings {
+	return current.Load().(*Settings)
+}
+
+// Set replaces the global configuration, e.g. for tests.
+// The settings must not be modified afterwards.
+func Set(settings *Settings) {
+	current.Store(settings)
+}
+
+// configFile is the file the config was parsed from, for reloading.
+var configFile string
+
+// Settings contains all configuration.
+type Settings struct {
+	ListenAddress         string                               `json:"listen_address"`           // Defaults to :8080
+	DatabaseString        string                               `json:"database_string"`          // For database connections
+	SitePrefix            string                               `json:"site_prefix"`              // URL prefix, e.g. "/api"
+	Debug                 bool                                 `json:"debug"`                    // Enables trace-debugging
+	OAuth2                OAuth2Config                         `json:"oauth2"`                   // OAuth2 section
+	Unicorn               UnicornConfig                        `json:"unicorn"`                  // Unicorn IdP section
+	ServerTracks          map[string]ServerTrackConfig         `json:"server_tracks"`            // Static config for server tracks
+	AccessTokens          map[uuid.UUID]AccessTokenEntryConfig `json:"access_tokens"`            // Static config for server tracks
+	AccessTokenUnusedDays int                                  `json:"access_token_unused_days"` // Purge non-static access tokens unused for this many days (0 to disable)
+	AuthLockout           AuthLockoutConfig                    `json:"auth_lockout"`             // Brute-force protection section, for invalid access token keys
+	TrackTypes            map[string]TrackTypeConfig           `json:"track_types"`              // Behavior for custom track types (or overrides for the built-in net and server types)
+	Attachments           AttachmentsConfig                    `json:"attachments"`              // Attachment storage section
+	DefaultLocale         string                               `json:"default_locale"`           // Locale for documents without a requested variant, defaults to "en"
+	TLS                   TLSConfig                            `json:"tls"`                      // HTTPS section, for serving without a reverse proxy
+	HTTPServer            HTTPServerConfig                     `json:"http_server"`              // Request size limits and timeouts section
+	CORS                  CORSConfig                           `json:"cors"`                     // CORS policy section
+	Compression           CompressionConfig                    `json:"compression"`              // Response compression section
+	ResponseCacheDisabled bool                                 `json:"response_cache_disabled"`  // Disable the in-memory cache for GETs of e.g. documents, tracks and tasks
+	PublicMode            bool                                 `json:"public_mode"`              // Serve aggregated stats to guests too, for the public event site (guest responses are always anonymized)
+	TimeslotOverlapCheck  bool                                 `json:"timeslot_overlap_check"`   // Reject timeslots overlapping the user's timeslots on other tracks
+	Encryption            EncryptionConfig                     `json:"encryption"`               // Encryption at rest section, e.g. for station credentials
+	Notifier              NotifierConfig                       `json:"notifier"`                 // Operator alerts section, for Discord/Slack
+	Gondul                GondulConfig                         `json:"gondul"`                   // Gondul section, for net track switch state
+	CheckScripts          CheckScriptsConfig                   `json:"check_scripts"`            // Sandbox section, for task checks running operator-uploaded scripts
+	RequestLog            RequestLogConfig                     `json:"request_log"`              // Access log section, for debugging client issues after the fact
+	QueryLog              QueryLogConfig                       `json:"query_log"`                // Slow database query logging section
+	Replicas              ReplicasConfig                       `json:"replicas"`                 // Read-only database replicas section, for offloading reads
+	DBRetry               DBRetryConfig                        `json:"db_retry"`                 // Transient database error retry section
+	Exports               ExportsConfig                        `json:"exports"`                  // Nightly telemetry export section, for keeping analytics data after wiping the event database
+	DefaultEvent          string                               `json:"default_event"`            // Event for requests without an event param or known hostname, all events if empty
+	EventHostnames        map[string]string                    `json:"event_hostnames"`          // Event by request hostname, e.g. "test.techo.gathering.org" to "test-2023"
 }
 
 // OAuth2Config contains the OAuth2 config
@@ -57,33 +105,248 @@ type UnicornConfig struct {
 
 // ServerTrackConfig contains the static config for a single server track.
 type ServerTrackConfig struct {
-	BaseURL          string `json:"base_url"`
-	TaskType         string `json:"task_type"`
-	MaxInstancesSoft int    `json:"max_instances_soft"` // Number of instances where participants are allowed to spin up their own
-	MaxInstancesHard int    `json:"max_instances_hard"` // Number of instances where operators/admins may spin up another one
-	AuthUsername     string `json:"auth_username"`
-	AuthPassword     string `json:"auth_password"`
+	BaseURL           string `json:"base_url"`
+	TaskType          string `json:"task_type"`
+	MaxInstancesSoft  int    `json:"max_instances_soft"` // Number of instances where participants are allowed to spin up their own
+	MaxInstancesHard  int    `json:"max_instances_hard"` // Number of instances where operators/admins may spin up another one
+	AuthUsername      string `json:"auth_username"`
+	AuthPassword      string `json:"auth_password"`
+	ProvisionAttempts int    `json:"provision_attempts"` // Attempts to create a VM before marking the station as failed, for transient errors (defaults to 3)
+	// Per-user limits for participants, 0 for unlimited (may be overridden per user by admins)
+	MaxUserStations         int `json:"max_user_stations"`           // Concurrent (non-terminated) stations provisioned for the user
+	MaxUserProvisionsPerDay int `json:"max_user_provisions_per_day"` // Stations provisioned for the user within the last 24 hours
+	// Optional URL notified (POST, with the same auth) when all tests for a station pass, e.g. to snapshot the VM for grading.
+	// "{station}", "{shortname}", "{track}" and "{timeslot}" are replaced by the URL-escaped values of the station.
+	TestsPassedURL string `json:"tests_passed_url"`
+}
+
+// TrackTypeConfig contains the behavior for a track type.
+type TrackTypeConfig struct {
+	CleanupMode      string `json:"cleanup_mode"`      // What happens to stations when timeslots end: "dirty", "terminate" or "default-status"
+	ProvisioningMode string `json:"provisioning_mode"` // How stations are created: "static" or "dynamic" (requires the track in server_tracks)
+	CredentialPolicy string `json:"credential_policy"` // Who may see station credentials: "assigned" (and operators) or "operators"
+}
+
+// AuthLockoutConfig contains the config for locking out clients repeatedly presenting invalid access token keys.
+// Clients are tracked by IP address.
+type AuthLockoutConfig struct {
+	Disabled           bool     `json:"disabled"`             // Disable brute-force protection, e.g. if handled by the reverse proxy
+	MaxFailures        int      `json:"max_failures"`         // Failures allowed before locking out, defaults to 10
+	LockoutSeconds     int      `json:"lockout_seconds"`      // First lockout, doubled for every further failure, defaults to 30
+	MaxLockoutMinutes  int      `json:"max_lockout_minutes"`  // Longest lockout, defaults to 15
+	ForgetAfterMinutes int      `json:"forget_after_minutes"` // Failures are forgotten this long after the last one, defaults to 60
+	TrustForwardedFor  bool     `json:"trust_forwarded_for"`  // Use the client IP address from X-Forwarded-For, only if behind a reverse proxy setting it
+	TrustedProxies     []string `json:"trusted_proxies"`      // IP addresses or CIDR ranges of the reverse proxies, for X-Forwarded-For through multiple proxies
+}
+
+// TLSConfig contains the config for serving HTTPS directly.
+type TLSConfig struct {
+	CertFile        string `json:"cert_file"`        // PEM certificate (chain), enables HTTPS together with the key file
+	KeyFile         string `json:"key_file"`         // PEM private key
+	RedirectAddress string `json:"redirect_address"` // Optional address for a plain HTTP listener redirecting to HTTPS, e.g. ":80"
+}
+
+// HTTPServerConfig contains the request size limits and timeouts, to protect against huge and slow clients.
+type HTTPServerConfig struct {
+	MaxBodyKB                int `json:"max_body_kb"`                 // Max request body size, unless the endpoint has its own limit, defaults to 1024
+	ReadHeaderTimeoutSeconds int `json:"read_header_timeout_seconds"` // Time to read the request headers, defaults to 10
+	ReadTimeoutSeconds       int `json:"read_timeout_seconds"`        // Time to read the whole request, defaults to 300
+	WriteTimeoutSeconds      int `json:"write_timeout_seconds"`       // Time from the end of the request headers to the end of the response, defaults to 300
+	IdleTimeoutSeconds       int `json:"idle_timeout_seconds"`        // Time to keep idle keep-alive connections open, defaults to 120
+	// How API paths without a trailing slash (or with uppercase letters, if lowercase_paths) are handled:
+	// "rewrite" to handle them as the canonical path, "redirect" to redirect to it with a 308, or empty to leave them alone
+	PathNormalization string `json:"path_normalization"`
+	LowercasePaths    bool   `json:"lowercase_paths"` // Treat uppercase letters in API paths as lowercase, only if all IDs in paths are lowercase
+}
+
+// CORSConfig contains the CORS policy.
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"`   // E.g. "https://techo.gathering.org" or "*", any origin (without credentials) if empty
+	AllowedMethods   []string `json:"allowed_methods"`   // Defaults to the methods implemented for the path
+	AllowedHeaders   []string `json:"allowed_headers"`   // Defaults to "Authorization", "Content-Type" and "Accept-Language"
+	MaxAgeSeconds    int      `json:"max_age_seconds"`   // How long browsers may cache preflight responses, defaults to 300
+	AllowCredentials bool     `json:"allow_credentials"` // Allow credentialed requests, requires allowed origins
+}
+
+// CompressionConfig contains the config for compressing responses.
+type CompressionConfig struct {
+	Disabled     bool     `json:"disabled"`       // Disable compression, e.g. if the reverse proxy handles it
+	MinSizeBytes int      `json:"min_size_bytes"` // Smaller responses are not compressed, defaults to 1024
+	ContentTypes []string `json:"content_types"`  // Content types to compress, with "type/*" wildcards, defaults to "application/json" and "text/*"
+}
+
+// EncryptionConfig contains the keys for encrypting sensitive columns at rest.
+// Keys are base64-encoded 32-byte AES-256 keys.
+type EncryptionConfig struct {
+	Key          string   `json:"key"`           // Key for encrypting new values, values are stored as plaintext if empty
+	PreviousKeys []string `json:"previous_keys"` // Old keys still accepted for decrypting, during key rotation
+}
+
+// NotifierConfig contains the config for posting operator alerts to a Discord or Slack webhook.
+type NotifierConfig struct {
+	WebhookURL            string `json:"webhook_url"`             // Discord or Slack incoming webhook URL, alerts are disabled if empty
+	Format                string `json:"format"`                  // "discord" or "slack", guessed from the URL if empty
+	CooldownMinutes       int    `json:"cooldown_minutes"`        // Minimum time between repeated alerts for the same thing, defaults to 15
+	ProvisioningFailures  bool   `json:"provisioning_failures"`   // Alert when provisioning a station fails
+	StationsUnhealthy     bool   `json:"stations_unhealthy"`      // Alert when stations are stuck dirty, provisioning or in maintenance
+	UnhealthyAfterMinutes int    `json:"unhealthy_after_minutes"` // How long stations may be stuck before they're unhealthy, defaults to 30
+	QueueLength           bool   `json:"queue_length"`            // Alert when a track queue gets too long
+	QueueLengthThreshold  int    `json:"queue_length_threshold"`  // Queue length to alert at, defaults to 10
+	SoftLimitReached      bool   `json:"soft_limit_reached"`      // Alert when participants are denied dynamic stations due to the soft limit
+	AuthLockouts          bool   `json:"auth_lockouts"`           // Alert when clients are locked out for presenting invalid access token keys
+}
+
+// GondulConfig contains the config for pulling switch state for net track stations from Gondul.
+type GondulConfig struct {
+	BaseURL      string `json:"base_url"`      // E.g. "https://gondul.tg.no", disabled if empty
+	Username     string `json:"username"`      // For the authenticated read API
+	Password     string `json:"password"`      // For the authenticated read API
+	SwitchPrefix string `json:"switch_prefix"` // Prepended to station shortnames to get the switch names, e.g. "techo-"
+	AutoReady    bool   `json:"auto_ready"`    // Set dirty net track stations ready when Gondul reports their config gone
+}
+
+// CheckScriptsConfig contains the config for running task check scripts.
+// Scripts are uploaded by admins, but should still run in a sandbox without access to the backend or its secrets.
+type CheckScriptsConfig struct {
+	Enabled        bool     `json:"enabled"`         // Script checks fail without running unless enabled
+	Command        []string `json:"command"`         // Sandbox command getting the script on stdin, e.g. a container runtime, required if enabled
+	TimeoutSeconds int      `json:"timeout_seconds"` // Per script run, defaults to 10
+}
+
+// RequestLogConfig contains the config for the access log, in addition to the regular log lines.
+type RequestLogConfig struct {
+	Sink          string `json:"sink"`           // "file" (JSON lines) or "db" (request_log table), disabled if empty
+	FilePath      string `json:"file_path"`      // For the file sink, defaults to "requests.log"
+	MaxSizeMB     int    `json:"max_size_mb"`    // For the file sink, rotate when larger, defaults to 100
+	MaxFiles      int    `json:"max_files"`      // For the file sink, rotated files to keep, defaults to 5
+	RetentionDays int    `json:"retention_days"` // For the DB sink, defaults to 7
+	SamplePercent int    `json:"sample_percent"` // Percentage of requests to log (1-100), defaults to 100
+}
+
+// QueryLogConfig contains the config for slow database query logging. All queries are timed for the stats anyway.
+type QueryLogConfig struct {
+	SlowThresholdMS int  `json:"slow_threshold_ms"` // Log queries taking at least this long, with sanitized args (0 to disable)
+	Explain         bool `json:"explain"`           // Also log the EXPLAIN output of slow queries
+}
+
+// ReplicasConfig contains the config for read-only database replicas. Writes always go to the primary.
+type ReplicasConfig struct {
+	DatabaseStrings []string `json:"database_strings"` // Connection strings of the replicas
+	MaxLagMS        int      `json:"max_lag_ms"`       // Skip replicas lagging further behind, and read tables written more recently from the primary, defaults to 5000
+}
+
+// DBRetryConfig contains the config for retrying transient database errors, e.g. during failovers.
+type DBRetryConfig struct {
+	MaxAttempts int `json:"max_attempts"`  // Attempts including the first one, defaults to 4 (1 to disable retries)
+	BaseDelayMS int `json:"base_delay_ms"` // Max delay before the first retry, doubled for every retry, defaults to 50
+	MaxDelayMS  int `json:"max_delay_ms"`  // Max delay between retries, defaults to 2000
+}
+
+// ExportsConfig contains the config for the nightly telemetry exports.
+type ExportsConfig struct {
+	Enabled bool     `json:"enabled"`
+	Hour    int      `json:"hour"` // Local hour of the day to export the previous days, 0-23
+	S3      S3Config `json:"s3"`   // S3-compatible storage section
+}
+
+// AttachmentsConfig contains the config for attachment storage.
+type AttachmentsConfig struct {
+	Storage   string   `json:"storage"`     // "local" (default) or "s3"
+	LocalPath string   `json:"local_path"`  // Directory for local storage, defaults to "attachments"
+	MaxSizeMB int      `json:"max_size_mb"` // Max upload size, defaults to 10
+	S3        S3Config `json:"s3"`          // S3-compatible storage section
+}
+
+// S3Config contains the config for S3-compatible storage.
+type S3Config struct {
+	Endpoint   string `json:"endpoint"` // E.g. "https://s3.example.net", buckets are addressed path-style
+	Region     string `json:"region"`
+	Bucket     string `json:"bucket"`
+	PathPrefix string `json:"path_prefix"` // Optional prefix for object keys
+	AccessKey  string `json:"access_key"`
+	SecretKey  string `json:"secret_key"`
 }
 
 // AccessTokenEntryConfig contains the static config for a single non-user access token.
 type AccessTokenEntryConfig struct {
-	Key     string `json:"key"`
-	Role    string `json:"role"`
-	Comment string `json:"comment"`
+	Key               string   `json:"key"`                 // Either the key, the hash, the HMAC secret or the client certificate is required
+	KeyHash           string   `json:"key_hash"`            // Hex-encoded SHA-256 of the key, to keep the key itself out of the config
+	PreviousKeys      []string `json:"previous_keys"`       // Old keys still accepted, for rotating the key without downtime
+	PreviousKeyHashes []string `json:"previous_key_hashes"` // Hashes of old keys still accepted
+	HMACSecret        string   `json:"hmac_secret"`         // Shared secret for HMAC-signed requests, as an alternative to sending the key
+	ClientCertSHA256  string   `json:"client_cert_sha256"`  // Hex-encoded SHA-256 fingerprint of the client certificate (DER), as an alternative to the key (requires TLS)
+	Role              string   `json:"role"`
+	Comment           string   `json:"comment"`
 }
 
 // ParseConfig reads a file and parses it as JSON, assuming it will be a
-// valid configuration file.
+// valid configuration file. Environment variables override the file, see
+// applyEnvOverrides. An empty file name means only environment variables.
 func ParseConfig(file string) error {
-	dat, err := ioutil.ReadFile(file)
+	newConfig, err := readConfig(file)
 	if err != nil {
 		return err
 	}
-	if err := json.Unmarshal(dat, &Config); err != nil {
+	configFile = file
+	Set(newConfig)
+	applyLogLevel()
+	return nil
+}
+
+// ReloadConfig re-reads the config file and replaces the current config.
+// Settings which only apply at startup (listen address and database strings)
+// keep their current values.
+// If apply is not nil, it's called with the new config before it replaces the
+// current one, and if it fails the current config is kept. This allows applying
+// the config elsewhere too (e.g. to the DB) without ending up half-applied.
+func ReloadConfig(apply func(newConfig *Settings) error) error {
+	newConfig, err := readConfig(configFile)
+	if err != nil {
 		return err
 	}
-	if Config.Debug {
-		log.SetLevel(log.TraceLevel)
+	oldConfig := Get()
+	if newConfig.ListenAddress != oldConfig.ListenAddress || newConfig.DatabaseString != oldConfig.DatabaseString ||
+		!reflect.DeepEqual(newConfig.Replicas.DatabaseStrings, oldConfig.Replicas.DatabaseStrings) {
+		log.Warn("Listen address and database string changes require a restart, ignoring them")
+		newConfig.ListenAddress = oldConfig.ListenAddress
+		newConfig.DatabaseString = oldConfig.DatabaseString
+		newConfig.Replicas.DatabaseStrings = oldConfig.Replicas.DatabaseStrings
 	}
+	if apply != nil {
+		if err := apply(newConfig); err != nil {
+			return err
+		}
+	}
+	Set(newConfig)
+	applyLogLevel()
 	return nil
 }
+
+// readConfig reads the config file (unless empty), applies environment variable overrides and validates it.
+func readConfig(file string) (*Settings, error) {
+	var newConfig Settings
+	if file != "" {
+		dat, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(dat, &newConfig); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyEnvOverrides(&newConfig); err != nil {
+		return nil, err
+	}
+	if err := newConfig.validate(); err != nil {
+		return nil, err
+	}
+	return &newConfig, nil
+}
+
+func applyLogLevel() {
+	if Get().Debug {
+		log.SetLevel(log.TraceLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+}
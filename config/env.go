@@ -0,0 +1,88 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix for environment variables overriding config settings.
+const EnvPrefix = "TECHO"
+
+// applyEnvOverrides overrides settings with environment variables, named by
+// the prefix and the uppercased JSON names of the setting and its sections,
+// e.g. TECHO_DATABASE_STRING or TECHO_OAUTH2_CLIENT_SECRET. Maps and lists
+// (e.g. TECHO_ACCESS_TOKENS) are specified as JSON.
+func applyEnvOverrides(settings *Settings) error {
+	return applyEnvOverridesToStruct(reflect.ValueOf(settings).Elem(), EnvPrefix)
+}
+
+func applyEnvOverridesToStruct(value reflect.Value, prefix string) error {
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+		if jsonName == "" || jsonName == "-" {
+			continue
+		}
+		envName := prefix + "_" + strings.ToUpper(jsonName)
+		fieldValue := value.Field(i)
+
+		// Sections
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnvOverridesToStruct(fieldValue, envName); err != nil {
+				return err
+			}
+			continue
+		}
+
+		rawValue, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.String:
+			fieldValue.SetString(rawValue)
+		case reflect.Bool:
+			parsed, err := strconv.ParseBool(rawValue)
+			if err != nil {
+				return fmt.Errorf("%v: invalid boolean: %v", envName, rawValue)
+			}
+			fieldValue.SetBool(parsed)
+		case reflect.Int:
+			parsed, err := strconv.Atoi(rawValue)
+			if err != nil {
+				return fmt.Errorf("%v: invalid integer: %v", envName, rawValue)
+			}
+			fieldValue.SetInt(int64(parsed))
+		default:
+			if err := json.Unmarshal([]byte(rawValue), fieldValue.Addr().Interface()); err != nil {
+				return fmt.Errorf("%v: invalid JSON: %v", envName, err)
+			}
+		}
+	}
+	return nil
+}
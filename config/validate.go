@@ -0,0 +1,214 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ValidationError lists all problems found in the config.
+type ValidationError struct {
+	Problems []string
+}
+
+func (err *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config:\n- %v", strings.Join(err.Problems, "\n- "))
+}
+
+// validate checks that required settings are present and that settings have valid values.
+func (settings *Settings) validate() error {
+	var problems []string
+	require := func(value string, name string) {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("missing required setting %v (or %v)", name, envName(name)))
+		}
+	}
+
+	require(settings.DatabaseString, "database_string")
+	require(settings.OAuth2.ClientID, "oauth2.client_id")
+	require(settings.OAuth2.ClientSecret, "oauth2.client_secret")
+	require(settings.OAuth2.AuthURL, "oauth2.auth_url")
+	require(settings.OAuth2.TokenURL, "oauth2.token_url")
+	require(settings.OAuth2.RedirectURL, "oauth2.redirect_url")
+	require(settings.Unicorn.ProfileURL, "unicorn.profile_url")
+
+	for trackID, serverTrack := range settings.ServerTracks {
+		require(serverTrack.BaseURL, fmt.Sprintf("server_tracks.%v.base_url", trackID))
+		if serverTrack.ProvisionAttempts < 0 {
+			problems = append(problems, fmt.Sprintf("server_tracks.%v.provision_attempts can't be negative", trackID))
+		}
+		if serverTrack.MaxUserStations < 0 || serverTrack.MaxUserProvisionsPerDay < 0 {
+			problems = append(problems, fmt.Sprintf("server_tracks.%v.max_user_stations and max_user_provisions_per_day can't be negative", trackID))
+		}
+		if serverTrack.TestsPassedURL != "" && !strings.HasPrefix(serverTrack.TestsPassedURL, "http://") && !strings.HasPrefix(serverTrack.TestsPassedURL, "https://") {
+			problems = append(problems, fmt.Sprintf("server_tracks.%v.tests_passed_url must be HTTP(S)", trackID))
+		}
+	}
+	for tokenID, token := range settings.AccessTokens {
+		if token.Key == "" && token.KeyHash == "" && token.HMACSecret == "" && token.ClientCertSHA256 == "" {
+			require(token.Key, fmt.Sprintf("access_tokens.%v.key", tokenID))
+		}
+		if token.ClientCertSHA256 != "" {
+			fingerprint := strings.ReplaceAll(token.ClientCertSHA256, ":", "")
+			if decoded, err := hex.DecodeString(fingerprint); err != nil || len(decoded) != sha256.Size {
+				problems = append(problems, fmt.Sprintf("access_tokens.%v.client_cert_sha256 must be a hex-encoded SHA-256 fingerprint", tokenID))
+			}
+			if settings.TLS.CertFile == "" {
+				problems = append(problems, fmt.Sprintf("access_tokens.%v.client_cert_sha256 requires tls.cert_file and tls.key_file", tokenID))
+			}
+		}
+		for _, keyHash := range append([]string{token.KeyHash}, token.PreviousKeyHashes...) {
+			if decoded, err := hex.DecodeString(keyHash); keyHash != "" && (err != nil || len(decoded) != sha256.Size) {
+				problems = append(problems, fmt.Sprintf("access_tokens.%v.key_hash and previous_key_hashes must be hex-encoded SHA-256 hashes", tokenID))
+				break
+			}
+		}
+		require(token.Role, fmt.Sprintf("access_tokens.%v.role", tokenID))
+	}
+	if (settings.TLS.CertFile == "") != (settings.TLS.KeyFile == "") {
+		problems = append(problems, "tls.cert_file and tls.key_file must be set together")
+	}
+	if settings.TLS.RedirectAddress != "" && settings.TLS.CertFile == "" {
+		problems = append(problems, "tls.redirect_address requires tls.cert_file and tls.key_file")
+	}
+	if settings.HTTPServer.MaxBodyKB < 0 || settings.HTTPServer.ReadHeaderTimeoutSeconds < 0 || settings.HTTPServer.ReadTimeoutSeconds < 0 ||
+		settings.HTTPServer.WriteTimeoutSeconds < 0 || settings.HTTPServer.IdleTimeoutSeconds < 0 {
+		problems = append(problems, "http_server.max_body_kb and timeouts can't be negative")
+	}
+	switch settings.HTTPServer.PathNormalization {
+	case "", "rewrite", "redirect":
+	default:
+		problems = append(problems, "http_server.path_normalization must be \"rewrite\" or \"redirect\"")
+	}
+	if settings.HTTPServer.LowercasePaths && settings.HTTPServer.PathNormalization == "" {
+		problems = append(problems, "http_server.lowercase_paths requires http_server.path_normalization")
+	}
+	if settings.CORS.AllowCredentials && len(settings.CORS.AllowedOrigins) == 0 {
+		problems = append(problems, "cors.allow_credentials requires cors.allowed_origins")
+	}
+	if settings.Compression.MinSizeBytes < 0 {
+		problems = append(problems, "compression.min_size_bytes can't be negative")
+	}
+	switch settings.Notifier.Format {
+	case "", "discord", "slack":
+	default:
+		problems = append(problems, "notifier.format must be \"discord\" or \"slack\"")
+	}
+	if settings.Notifier.CooldownMinutes < 0 || settings.Notifier.UnhealthyAfterMinutes < 0 || settings.Notifier.QueueLengthThreshold < 0 {
+		problems = append(problems, "notifier.cooldown_minutes, unhealthy_after_minutes and queue_length_threshold can't be negative")
+	}
+	if settings.CheckScripts.Enabled && len(settings.CheckScripts.Command) == 0 {
+		problems = append(problems, "check_scripts.command is required when check scripts are enabled (e.g. a container runtime, since the scripts must not run as the backend user)")
+	}
+	if settings.CheckScripts.TimeoutSeconds < 0 {
+		problems = append(problems, "check_scripts.timeout_seconds can't be negative")
+	}
+	switch settings.RequestLog.Sink {
+	case "", "file", "db":
+	default:
+		problems = append(problems, "request_log.sink must be \"file\" or \"db\"")
+	}
+	if settings.RequestLog.SamplePercent < 0 || settings.RequestLog.SamplePercent > 100 {
+		problems = append(problems, "request_log.sample_percent must be between 0 and 100")
+	}
+	if settings.RequestLog.MaxSizeMB < 0 || settings.RequestLog.MaxFiles < 0 || settings.RequestLog.RetentionDays < 0 {
+		problems = append(problems, "request_log.max_size_mb, max_files and retention_days can't be negative")
+	}
+	if settings.QueryLog.SlowThresholdMS < 0 {
+		problems = append(problems, "query_log.slow_threshold_ms can't be negative")
+	}
+	if settings.Replicas.MaxLagMS < 0 {
+		problems = append(problems, "replicas.max_lag_ms can't be negative")
+	}
+	for i, connectionString := range settings.Replicas.DatabaseStrings {
+		if connectionString == "" {
+			problems = append(problems, fmt.Sprintf("replicas.database_strings[%d] is empty", i))
+		}
+	}
+	if settings.DBRetry.MaxAttempts < 0 || settings.DBRetry.BaseDelayMS < 0 || settings.DBRetry.MaxDelayMS < 0 {
+		problems = append(problems, "db_retry settings can't be negative")
+	}
+	if settings.CORS.MaxAgeSeconds < 0 {
+		problems = append(problems, "cors.max_age_seconds can't be negative")
+	}
+	for i, key := range append([]string{settings.Encryption.Key}, settings.Encryption.PreviousKeys...) {
+		if key == "" && i == 0 {
+			continue
+		}
+		if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 32 {
+			problems = append(problems, "encryption keys must be base64-encoded 32-byte keys")
+			break
+		}
+	}
+	if settings.AuthLockout.MaxFailures < 0 || settings.AuthLockout.LockoutSeconds < 0 || settings.AuthLockout.MaxLockoutMinutes < 0 || settings.AuthLockout.ForgetAfterMinutes < 0 {
+		problems = append(problems, "auth_lockout.max_failures, lockout_seconds, max_lockout_minutes and forget_after_minutes can't be negative")
+	}
+	for _, proxy := range settings.AuthLockout.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			problems = append(problems, fmt.Sprintf("auth_lockout.trusted_proxies must be IP addresses or CIDR ranges, got %q", proxy))
+		}
+	}
+	if settings.AccessTokenUnusedDays < 0 {
+		problems = append(problems, "access_token_unused_days can't be negative")
+	}
+
+	switch settings.Attachments.Storage {
+	case "", "local":
+	case "s3":
+		require(settings.Attachments.S3.Endpoint, "attachments.s3.endpoint")
+		require(settings.Attachments.S3.Bucket, "attachments.s3.bucket")
+		require(settings.Attachments.S3.AccessKey, "attachments.s3.access_key")
+		require(settings.Attachments.S3.SecretKey, "attachments.s3.secret_key")
+	default:
+		problems = append(problems, fmt.Sprintf("attachments.storage must be \"local\" or \"s3\", got %q", settings.Attachments.Storage))
+	}
+
+	if settings.Exports.Hour < 0 || settings.Exports.Hour > 23 {
+		problems = append(problems, "exports.hour must be 0-23")
+	}
+	if settings.Exports.Enabled {
+		require(settings.Exports.S3.Endpoint, "exports.s3.endpoint")
+		require(settings.Exports.S3.Bucket, "exports.s3.bucket")
+		require(settings.Exports.S3.AccessKey, "exports.s3.access_key")
+		require(settings.Exports.S3.SecretKey, "exports.s3.secret_key")
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// envName gets the environment variable overriding the setting, e.g. "oauth2.client_id" to "TECHO_OAUTH2_CLIENT_ID".
+// Settings within maps are overridden by the whole map.
+func envName(name string) string {
+	parts := strings.Split(name, ".")
+	switch parts[0] {
+	case "server_tracks", "access_tokens", "track_types":
+		parts = parts[:1]
+	}
+	return EnvPrefix + "_" + strings.ToUpper(strings.Join(parts, "_"))
+}
@@ -29,12 +29,20 @@ import (
 	"fmt"
 
 	"github.com/gathering/tech-online-backend/config"
-	_ "github.com/lib/pq" // For postgres support
+	"github.com/lib/pq"
 )
 
 // DB is the main database handle used throughout the API
 var DB *sql.DB
 
+// Executor is implemented by both *sql.DB and *sql.Tx, for code which may
+// run both inside and outside transactions.
+type Executor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 // Error - General database error.
 type Error error
 
@@ -100,15 +108,19 @@ func Connect() error {
 		return Ping()
 	}
 
-	connectionString := config.Config.DatabaseString
+	connectionString := config.Get().DatabaseString
 	if connectionString == "" {
 		return newError("Missing database credentials")
 	}
 
-	DB, err = sql.Open("postgres", connectionString)
+	connector, err := pq.NewConnector(connectionString)
 	if err != nil {
 		return newError("Failed to connect to database: %v", err)
 	}
+	DB = sql.OpenDB(timedConnector{Connector: connector})
+	if err := Ping(); err != nil {
+		return err
+	}
 
-	return Ping()
+	return connectReplicas()
 }
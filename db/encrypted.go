@@ -0,0 +1,235 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+// encryptedStringPrefix marks encrypted values, so plaintext values (from before encryption was enabled) can still be read.
+const encryptedStringPrefix = "enc:v1:"
+
+// EncryptedString is a string column which is encrypted at rest (AES-256-GCM) when an encryption key is configured.
+// It's decrypted transparently when selected, trying the previous keys too.
+// Values stored before encryption was enabled are read as plaintext, see EncryptColumn for migrating them.
+// Empty strings are stored as-is.
+type EncryptedString string
+
+// Value encrypts the string for the database.
+func (s EncryptedString) Value() (driver.Value, error) {
+	if s == "" {
+		return "", nil
+	}
+	keys, err := encryptionKeys()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 || keys[0] == nil {
+		return string(s), nil
+	}
+	return encryptString(keys[0], string(s))
+}
+
+// Scan decrypts the string from the database.
+func (s *EncryptedString) Scan(src interface{}) error {
+	var raw string
+	switch value := src.(type) {
+	case nil:
+		raw = ""
+	case string:
+		raw = value
+	case []byte:
+		raw = string(value)
+	default:
+		return fmt.Errorf("cannot scan %T into EncryptedString", src)
+	}
+	plaintext, err := decryptString(raw)
+	if err != nil {
+		return err
+	}
+	*s = EncryptedString(plaintext)
+	return nil
+}
+
+// EncryptColumn (re)encrypts all values in the column using the current key,
+// i.e. plaintext values and values encrypted using previous keys.
+// It returns the number of updated rows.
+func EncryptColumn(table string, idColumn string, column string) (int, error) {
+	quotedTable, tableErr := quoteTable(table)
+	if tableErr != nil {
+		return 0, tableErr
+	}
+	quotedColumns := make([]string, 2)
+	for i, name := range []string{idColumn, column} {
+		normalized, err := normalizeIdentifier(name)
+		if err != nil {
+			return 0, err
+		}
+		quotedColumns[i] = quoteIdentifier(normalized)
+	}
+	quotedIDColumn, quotedColumn := quotedColumns[0], quotedColumns[1]
+
+	keys, keysErr := encryptionKeys()
+	if keysErr != nil {
+		return 0, keysErr
+	}
+	if len(keys) == 0 || keys[0] == nil {
+		return 0, newError("no encryption key configured")
+	}
+
+	tx, txErr := DB.Begin()
+	if txErr != nil {
+		return 0, txErr
+	}
+	defer tx.Rollback()
+	rows, rowsErr := tx.Query(fmt.Sprintf("SELECT %v, %v FROM %v FOR UPDATE", quotedIDColumn, quotedColumn, quotedTable))
+	if rowsErr != nil {
+		return 0, rowsErr
+	}
+	updates := make(map[string]string)
+	for rows.Next() {
+		var id, raw string
+		if err := rows.Scan(&id, &raw); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if raw == "" || isEncryptedWith(keys[0], raw) {
+			continue
+		}
+		plaintext, err := decryptString(raw)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("%v %v: %v", table, id, err)
+		}
+		ciphertext, err := encryptString(keys[0], plaintext)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		updates[id] = ciphertext
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, ciphertext := range updates {
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %v SET %v = $1 WHERE %v = $2", quotedTable, quotedColumn, quotedIDColumn), ciphertext, id); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	NotifyWrite(table)
+	return len(updates), nil
+}
+
+// encryptionKeys gets the current key (nil if not configured) followed by the previous keys.
+func encryptionKeys() ([][]byte, error) {
+	encryptionConfig := config.Get().Encryption
+	keys := make([][]byte, 0, 1+len(encryptionConfig.PreviousKeys))
+	for i, rawKey := range append([]string{encryptionConfig.Key}, encryptionConfig.PreviousKeys...) {
+		if rawKey == "" && i == 0 {
+			keys = append(keys, nil)
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(rawKey)
+		if err != nil || len(key) != 32 {
+			return nil, newError("invalid encryption key")
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func encryptString(key []byte, plaintext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedStringPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptString decrypts the value using the first key which works, or returns it as-is if it's not encrypted.
+func decryptString(raw string) (string, error) {
+	if !strings.HasPrefix(raw, encryptedStringPrefix) {
+		return raw, nil
+	}
+	keys, err := encryptionKeys()
+	if err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		if plaintext, ok := openString(key, raw); ok {
+			return plaintext, nil
+		}
+	}
+	return "", newError("failed to decrypt value, no matching encryption key")
+}
+
+func isEncryptedWith(key []byte, raw string) bool {
+	_, ok := openString(key, raw)
+	return ok
+}
+
+func openString(key []byte, raw string) (string, bool) {
+	if !strings.HasPrefix(raw, encryptedStringPrefix) {
+		return "", false
+	}
+	sealed, err := base64.StdEncoding.DecodeString(raw[len(encryptedStringPrefix):])
+	if err != nil {
+		return "", false
+	}
+	gcm, err := newGCM(key)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", false
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", false
+	}
+	return string(plaintext), true
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
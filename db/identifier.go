@@ -0,0 +1,141 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+import (
+	"strings"
+)
+
+// whereOperators are the operators allowed in where args.
+var whereOperators = map[string]bool{
+	"=":         true,
+	"!=":        true,
+	"<>":        true,
+	"<":         true,
+	"<=":        true,
+	">":         true,
+	">=":        true,
+	"IN":        true,
+	"LIKE":      true,
+	"NOT LIKE":  true,
+	"ILIKE":     true,
+	"NOT ILIKE": true,
+	"IS":        true,
+	"IS NOT":    true,
+}
+
+// isIdentifierPart checks if the name is a plain identifier, i.e. a letter
+// or underscore followed by letters, digits and underscores.
+func isIdentifierPart(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, char := range name {
+		switch {
+		case char == '_', char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z':
+		case char >= '0' && char <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeIdentifier checks that the table or column name is a plain
+// identifier, optionally qualified (e.g. "stations.track") and with quoted
+// parts (e.g. `"user"`), returning it without quotes. Unquoted parts are
+// lowercased, like Postgres does.
+func normalizeIdentifier(name string) (string, error) {
+	parts := strings.Split(name, ".")
+	if len(parts) > 2 {
+		return "", newError("Invalid identifier: %q", name)
+	}
+	for i, part := range parts {
+		quoted := len(part) >= 2 && strings.HasPrefix(part, "\"") && strings.HasSuffix(part, "\"")
+		if quoted {
+			part = part[1 : len(part)-1]
+		}
+		if !isIdentifierPart(part) {
+			return "", newError("Invalid identifier: %q", name)
+		}
+		if !quoted {
+			part = strings.ToLower(part)
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// quoteIdentifier quotes the parts of a normalized identifier.
+func quoteIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = "\"" + part + "\""
+	}
+	return strings.Join(parts, ".")
+}
+
+// quoteTable validates and quotes the table name for queries.
+func quoteTable(table string) (string, error) {
+	normalized, err := normalizeIdentifier(table)
+	if err != nil {
+		return "", err
+	}
+	return quoteIdentifier(normalized), nil
+}
+
+// quoteOrderBy validates and quotes the columns of the ordering, e.g.
+// "track, shortname DESC". Each column may be followed by ASC or DESC and
+// NULLS FIRST or NULLS LAST, but expressions are not allowed.
+func quoteOrderBy(orderBy string) (string, error) {
+	if strings.TrimSpace(orderBy) == "" {
+		return "", nil
+	}
+	var quoted []string
+	for _, item := range strings.Split(orderBy, ",") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			return "", newError("Invalid ordering: %q", orderBy)
+		}
+		column, err := normalizeIdentifier(fields[0])
+		if err != nil {
+			return "", newError("Invalid ordering: %q", orderBy)
+		}
+		modifiers := fields[1:]
+		direction := ""
+		if len(modifiers) > 0 {
+			switch strings.ToUpper(modifiers[0]) {
+			case "ASC", "DESC":
+				direction = " " + strings.ToUpper(modifiers[0])
+				modifiers = modifiers[1:]
+			}
+		}
+		switch nulls := strings.ToUpper(strings.Join(modifiers, " ")); nulls {
+		case "":
+		case "NULLS FIRST", "NULLS LAST":
+			direction += " " + nulls
+		default:
+			return "", newError("Invalid ordering: %q", orderBy)
+		}
+		quoted = append(quoted, quoteIdentifier(column)+direction)
+	}
+	return strings.Join(quoted, ", "), nil
+}
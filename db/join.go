@@ -0,0 +1,193 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// joinedTable is a table selected by SelectJoined, mapped to a struct field.
+type joinedTable struct {
+	name     string
+	clause   string // Empty for the base table
+	left     bool
+	fieldIdx int
+	kvs      keyvals
+}
+
+// SelectJoined selects rows of joined tables, populating the slice pointed
+// to by d. The slice elements are structs (or pointers to structs) with one
+// pointer-to-struct field per table, tagged with "join". The first one is
+// the base table and the rest are joined in order, e.g.:
+//
+//	type stationTimeslot struct {
+//		Station  *Station  `join:"stations"`
+//		Timeslot *Timeslot `join:"timeslots ON timeslots.id = stations.timeslot,left"`
+//	}
+//
+// Tables with the "left" option are LEFT JOINed and their fields are nil if
+// no row matched. The search haystacks and orderBy (e.g. "stations.shortname
+// ASC", may be empty) must qualify columns with the table name. Like the
+// haystacks, the join tags and orderBy are NOT safe from injection.
+func SelectJoined(d interface{}, orderBy string, searcher ...interface{}) Result {
+	if DB == nil {
+		return Result{Error: newError("Tried to issue SelectJoined() without a DB object")}
+	}
+	dval := reflect.ValueOf(d)
+	if dval.Kind() != reflect.Ptr || reflect.Indirect(dval).Kind() != reflect.Slice {
+		return Result{Error: newError("SelectJoined() must be called with pointer-to-slice, got: %T", d)}
+	}
+	dval = reflect.Indirect(dval)
+	search, err := buildSearch(searcher...)
+	if err != nil {
+		return Result{Error: err}
+	}
+
+	// Find the tables and their columns
+	st := dval.Type().Elem()
+	rowType := st
+	if rowType.Kind() == reflect.Ptr {
+		rowType = rowType.Elem()
+	}
+	if rowType.Kind() != reflect.Struct {
+		return Result{Error: newError("SelectJoined() must be called with a slice of structs, got: %T", d)}
+	}
+	var tables []joinedTable
+	for i := 0; i < rowType.NumField(); i++ {
+		field := rowType.Field(i)
+		tag, ok := field.Tag.Lookup("join")
+		if !ok {
+			continue
+		}
+		if field.Type.Kind() != reflect.Ptr || field.Type.Elem().Kind() != reflect.Struct {
+			return Result{Error: newError("SelectJoined(): join field %v must be a pointer to a struct", field.Name)}
+		}
+		table := joinedTable{fieldIdx: i}
+		if strings.HasSuffix(tag, ",left") {
+			table.left = true
+			tag = strings.TrimSuffix(tag, ",left")
+		}
+		table.name = strings.Fields(tag)[0]
+		table.clause = strings.TrimSpace(strings.TrimPrefix(tag, table.name))
+		if table.name, err = normalizeIdentifier(table.name); err != nil {
+			return Result{Error: err}
+		}
+		sample := reflect.New(field.Type.Elem()).Interface()
+		table.kvs, err = enumerate(make(map[string]bool), true, &sample)
+		if err != nil {
+			return Result{Error: newErrorWithCause("enumerate() failed during query. This is bad.", err)}
+		}
+		tables = append(tables, table)
+	}
+	if len(tables) == 0 {
+		return Result{Error: newError("SelectJoined(): no join fields in %v", rowType)}
+	}
+
+	// Build the query
+	var columns []string
+	from := quoteIdentifier(tables[0].name)
+	for tableIdx, table := range tables {
+		for _, key := range table.kvs.keys {
+			columns = append(columns, fmt.Sprintf("%s.\"%s\"", quoteIdentifier(table.name), key))
+		}
+		if tableIdx == 0 {
+			continue
+		}
+		joinType := "JOIN"
+		if table.left {
+			joinType = "LEFT JOIN"
+		}
+		from = fmt.Sprintf("%s %s %s %s", from, joinType, quoteIdentifier(table.name), table.clause)
+	}
+	quotedOrderBy, err := quoteOrderBy(orderBy)
+	if err != nil {
+		return Result{Error: err}
+	}
+	strsearch, searcharr := buildWhere(0, search)
+	q := fmt.Sprintf("SELECT %s FROM %s%s", strings.Join(columns, ", "), from, strsearch)
+	if quotedOrderBy != "" {
+		q = fmt.Sprintf("%s ORDER BY %s", q, quotedOrderBy)
+	}
+	log.WithField("query", q).Trace("SelectJoined()")
+	tableNames := make([]string, len(tables))
+	for i, table := range tables {
+		tableNames[i] = table.name
+	}
+	rows, err := queryWithRetry(ReadExecutor(tableNames...), q, searcharr...)
+	if err != nil {
+		return Result{Error: newErrorWithCause("SelectJoined(): SELECT failed on DB.Query", err)}
+	}
+	defer func() {
+		rows.Close()
+	}()
+
+	// Scan into pointers to the column types, so LEFT JOINs without matches give NULLs instead of failing
+	var scanvals []interface{}
+	for _, table := range tables {
+		for _, newval := range table.kvs.newvals {
+			scanvals = append(scanvals, reflect.New(reflect.TypeOf(newval)).Interface())
+		}
+	}
+
+	retv := reflect.MakeSlice(reflect.SliceOf(st), 0, 0)
+	numElements := 0
+	for rows.Next() {
+		if err := rows.Scan(scanvals...); err != nil {
+			return Result{Error: newErrorWithCause("SelectJoined(): SELECT failed to scan", err)}
+		}
+
+		newidx := reflect.Indirect(reflect.New(st))
+		newrow := newidx
+		if newidx.Kind() == reflect.Ptr {
+			newrow = reflect.New(st.Elem())
+			newidx.Set(newrow)
+			newrow = reflect.Indirect(newrow)
+		}
+
+		scanIdx := 0
+		for _, table := range tables {
+			tableValue := reflect.New(rowType.Field(table.fieldIdx).Type.Elem())
+			matched := false
+			for idx := range table.kvs.keys {
+				scanned := reflect.Indirect(reflect.ValueOf(scanvals[scanIdx]))
+				scanIdx++
+				if scanned.IsNil() {
+					continue
+				}
+				matched = true
+				reflect.Indirect(tableValue).FieldByIndex(table.kvs.keyidx[idx]).Set(reflect.Indirect(scanned))
+			}
+			if matched || !table.left {
+				newrow.Field(table.fieldIdx).Set(tableValue)
+			}
+		}
+
+		retv = reflect.Append(retv, newidx)
+		numElements++
+	}
+
+	dval.Set(retv)
+	return Result{Ok: numElements}
+}
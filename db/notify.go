@@ -0,0 +1,85 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+import "sync"
+
+var writeListenersMutex sync.RWMutex
+var writeListeners []func(table string)
+var changeListeners []func(change Change)
+
+// Change describes a write to a table, for change listeners.
+type Change struct {
+	Table string
+	// Known column values for the written rows, i.e. the written values for inserts and updates and the
+	// "=" conditions for updates and deletes. Nil if unknown, e.g. for writes bypassing Insert, Update and Delete.
+	Columns map[string]interface{}
+}
+
+// AddWriteListener registers a function to be called with the table name
+// after every successful write through Insert, Update and Delete (and their
+// executor variants). Inside transactions, listeners are called before the
+// commit (or rollback).
+func AddWriteListener(listener func(table string)) {
+	writeListenersMutex.Lock()
+	defer writeListenersMutex.Unlock()
+	writeListeners = append(writeListeners, listener)
+}
+
+// AddChangeListener registers a function to be called like write listeners,
+// but with the known column values of the written rows, e.g. to find which
+// track a write belongs to.
+func AddChangeListener(listener func(change Change)) {
+	writeListenersMutex.Lock()
+	defer writeListenersMutex.Unlock()
+	changeListeners = append(changeListeners, listener)
+}
+
+// NotifyWrite calls the write listeners for the table. Writes bypassing
+// Insert, Update and Delete must call it themselves.
+func NotifyWrite(table string) {
+	notifyChange(Change{Table: table})
+}
+
+func notifyChange(change Change) {
+	writeListenersMutex.RLock()
+	defer writeListenersMutex.RUnlock()
+	for _, listener := range writeListeners {
+		listener(change.Table)
+	}
+	for _, listener := range changeListeners {
+		listener(change)
+	}
+}
+
+// changedColumns collects the written values and the "=" conditions, for change listeners.
+func changedColumns(kvs keyvals, search []Selector) map[string]interface{} {
+	columns := make(map[string]interface{}, len(kvs.keys)+len(search))
+	for i, key := range kvs.keys {
+		columns[key] = kvs.values[i]
+	}
+	for _, selector := range search {
+		if selector.Operator == "=" {
+			columns[selector.Haystack] = selector.Needle
+		}
+	}
+	return columns
+}
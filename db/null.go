@@ -0,0 +1,82 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+)
+
+// Nullable is implemented by nullable column types. NULL needles in where
+// args (nil or a Nullable which is null) are matched with "IS NULL" for "="
+// and "IS NOT NULL" for "!=".
+type Nullable interface {
+	IsNull() bool
+}
+
+// NullString is a nullable text column, for columns where NULL means
+// "none" instead of the empty string. It's NULL in JSON too, and both
+// JSON null and the empty string unmarshal to NULL.
+type NullString struct {
+	sql.NullString
+}
+
+// StringOrNull gets a NullString which is NULL if the value is empty.
+func StringOrNull(value string) NullString {
+	return NullString{sql.NullString{String: value, Valid: value != ""}}
+}
+
+// IsNull checks if it's NULL.
+func (s NullString) IsNull() bool {
+	return !s.Valid
+}
+
+// MarshalJSON marshals it as the string or null.
+func (s NullString) MarshalJSON() ([]byte, error) {
+	if !s.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(s.String)
+}
+
+// UnmarshalJSON unmarshals null or the empty string as NULL.
+func (s *NullString) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*s = NullString{}
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*s = StringOrNull(value)
+	return nil
+}
+
+// isNullNeedle checks if the where arg needle is NULL.
+func isNullNeedle(needle interface{}) bool {
+	if needle == nil {
+		return true
+	}
+	nullable, ok := needle.(Nullable)
+	return ok && nullable.IsNull()
+}
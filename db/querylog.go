@@ -0,0 +1,285 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxQueryShapes limits the distinct query shapes with stats, later ones are counted as otherQueryShape.
+const maxQueryShapes = 1000
+
+const otherQueryShape = "(other)"
+
+// QueryStat is the aggregated timing of all queries with the same shape (the query with literals removed).
+// Query times are until the first results are available, not until all rows are read.
+type QueryStat struct {
+	Query        string     `json:"query"`
+	Count        int        `json:"count"`
+	Errors       int        `json:"errors"`
+	TotalMS      float64    `json:"total_ms"`
+	AverageMS    float64    `json:"average_ms"`
+	MaxMS        float64    `json:"max_ms"`
+	SlowCount    int        `json:"slow_count"`     // Queries exceeding the slow query threshold
+	LastSlowTime *time.Time `json:"last_slow_time"` // When the last slow one ended
+	LastExplain  string     `json:"last_explain"`   // EXPLAIN output of the last slow one, if enabled
+}
+
+var queryStats = struct {
+	sync.Mutex
+	shapes map[string]*QueryStat
+}{
+	shapes: make(map[string]*QueryStat),
+}
+
+// explainBusy allows a single EXPLAIN at a time, so a burst of slow queries doesn't add even more load.
+var explainBusy = make(chan struct{}, 1)
+
+var queryLiteralPattern = regexp.MustCompile(`\$\d+|'(?:[^']|'')*'|\b\d+(?:\.\d+)?\b`)
+var queryWhitespacePattern = regexp.MustCompile(`\s+`)
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// QueryStats gets the stats for all query shapes since starting or the last reset, by total time descending.
+func QueryStats() []QueryStat {
+	queryStats.Lock()
+	defer queryStats.Unlock()
+	stats := make([]QueryStat, 0, len(queryStats.shapes))
+	for _, stat := range queryStats.shapes {
+		statCopy := *stat
+		if statCopy.Count > 0 {
+			statCopy.AverageMS = statCopy.TotalMS / float64(statCopy.Count)
+		}
+		stats = append(stats, statCopy)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].TotalMS > stats[j].TotalMS
+	})
+	return stats
+}
+
+// ResetQueryStats forgets all query stats.
+func ResetQueryStats() {
+	queryStats.Lock()
+	defer queryStats.Unlock()
+	queryStats.shapes = make(map[string]*QueryStat)
+}
+
+// timedConnector wraps the driver connector so every query is timed, including ones not going through this package.
+type timedConnector struct {
+	driver.Connector
+}
+
+func (connector timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := connector.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{Conn: conn}, nil
+}
+
+// timedConn times queries and execs, passing everything else through to the driver connection.
+type timedConn struct {
+	driver.Conn
+}
+
+func (conn *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := conn.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	begin := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	recordQuery(query, args, time.Since(begin), err)
+	return rows, err
+}
+
+func (conn *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := conn.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	begin := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	recordQuery(query, args, time.Since(begin), err)
+	return result, err
+}
+
+func (conn *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := conn.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return conn.Conn.Prepare(query)
+}
+
+func (conn *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := conn.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return conn.Conn.Begin()
+}
+
+func (conn *timedConn) Ping(ctx context.Context) error {
+	if pinger, ok := conn.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// recordQuery adds the query to the stats, and logs it (with the EXPLAIN output, if enabled) if slow.
+func recordQuery(query string, args []driver.NamedValue, duration time.Duration, err error) {
+	// Don't count the EXPLAINs of slow queries
+	if strings.HasPrefix(query, "EXPLAIN ") {
+		return
+	}
+	durationMS := float64(duration) / float64(time.Millisecond)
+	thresholdMS := config.Get().QueryLog.SlowThresholdMS
+	slow := thresholdMS > 0 && durationMS >= float64(thresholdMS)
+	shape := queryShape(query)
+
+	queryStats.Lock()
+	stat, ok := queryStats.shapes[shape]
+	if !ok {
+		if len(queryStats.shapes) >= maxQueryShapes {
+			shape = otherQueryShape
+			stat = queryStats.shapes[shape]
+		}
+		if stat == nil {
+			stat = &QueryStat{Query: shape}
+			queryStats.shapes[shape] = stat
+		}
+	}
+	stat.Count++
+	stat.TotalMS += durationMS
+	if durationMS > stat.MaxMS {
+		stat.MaxMS = durationMS
+	}
+	if err != nil && err != driver.ErrSkip {
+		stat.Errors++
+	}
+	if slow {
+		now := time.Now()
+		stat.SlowCount++
+		stat.LastSlowTime = &now
+	}
+	queryStats.Unlock()
+
+	if !slow {
+		return
+	}
+	queryLog := log.WithFields(log.Fields{
+		"query":       queryWhitespacePattern.ReplaceAllString(strings.TrimSpace(query), " "),
+		"args":        sanitizeQueryArgs(args),
+		"duration_ms": int64(durationMS),
+	})
+	if err != nil {
+		queryLog = queryLog.WithError(err)
+	}
+	queryLog.Warn("Slow database query")
+	if config.Get().QueryLog.Explain {
+		select {
+		case explainBusy <- struct{}{}:
+			go func() {
+				defer func() { <-explainBusy }()
+				explainQuery(shape, query, args)
+			}()
+		default:
+		}
+	}
+}
+
+// explainQuery logs the plan for the query and saves it in the stats for the shape.
+// Plain EXPLAIN doesn't run the query, so it's safe for writes too.
+func explainQuery(shape string, query string, args []driver.NamedValue) {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	rows, err := DB.Query("EXPLAIN "+query, values...)
+	if err != nil {
+		log.WithError(err).Debug("Failed to explain slow database query")
+		return
+	}
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			log.WithError(err).Debug("Failed to explain slow database query")
+			return
+		}
+		lines = append(lines, line)
+	}
+	plan := strings.Join(lines, "\n")
+	log.WithField("plan", plan).Warn("Slow database query plan")
+
+	queryStats.Lock()
+	defer queryStats.Unlock()
+	if stat, ok := queryStats.shapes[shape]; ok {
+		stat.LastExplain = plan
+	}
+}
+
+// queryShape normalizes the whitespace and replaces literals with "?", so queries only differing by literals are grouped.
+// Args ($1 etc.) are kept as-is.
+func queryShape(query string) string {
+	shape := queryWhitespacePattern.ReplaceAllString(strings.TrimSpace(query), " ")
+	return queryLiteralPattern.ReplaceAllStringFunc(shape, func(literal string) string {
+		if strings.HasPrefix(literal, "$") {
+			return literal
+		}
+		return "?"
+	})
+}
+
+// sanitizeQueryArgs formats the args for logging, replacing strings and bytes with their length,
+// since they may contain e.g. credentials, content or key hashes. UUIDs are kept, for finding the rows.
+func sanitizeQueryArgs(args []driver.NamedValue) []string {
+	sanitized := make([]string, len(args))
+	for i, arg := range args {
+		switch value := arg.Value.(type) {
+		case nil:
+			sanitized[i] = "NULL"
+		case string:
+			if uuidPattern.MatchString(value) {
+				sanitized[i] = value
+			} else {
+				sanitized[i] = fmt.Sprintf("<string, %v bytes>", len(value))
+			}
+		case []byte:
+			sanitized[i] = fmt.Sprintf("<bytes, %v bytes>", len(value))
+		case time.Time:
+			sanitized[i] = value.Format(time.RFC3339Nano)
+		default:
+			sanitized[i] = fmt.Sprint(value)
+		}
+	}
+	return sanitized
+}
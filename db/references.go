@@ -0,0 +1,45 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+// Reference is a column referring to rows of some table, e.g. the "track"
+// column of "tasks" referring to the "tracks" table. The schema doesn't
+// use foreign keys, so references are declared by the users of the tables.
+type Reference struct {
+	Table  string
+	Column string
+}
+
+// CountReferences counts the rows matching the value for each of the
+// references, per table. Tables without any matching rows are omitted.
+func CountReferences(value interface{}, references ...Reference) (map[string]int, error) {
+	counts := make(map[string]int)
+	for _, reference := range references {
+		countResult := Count(reference.Table, reference.Column, "=", value)
+		if countResult.IsFailed() {
+			return nil, countResult.Error
+		}
+		if countResult.Ok > 0 {
+			counts[reference.Table] += countResult.Ok
+		}
+	}
+	return counts, nil
+}
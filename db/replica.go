@@ -0,0 +1,175 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+import (
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/worker"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultReplicaMaxLag is the replication lag after which a replica is skipped, if not configured.
+const defaultReplicaMaxLag = 5 * time.Second
+
+// replicaLagQuery gets the replication lag in seconds, 0 if caught up (the replay timestamp grows while the primary is idle).
+const replicaLagQuery = `SELECT CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END`
+
+// replica is a read-only database, used for reads while healthy.
+type replica struct {
+	db      *sql.DB
+	index   int
+	healthy int32 // Atomic bool, set by the lag check
+}
+
+var replicas []*replica
+var replicaCounter uint32
+
+// recentWrites contains the last write time by table, so reads of recently written tables go to the primary.
+var recentWrites = struct {
+	sync.Mutex
+	tables map[string]time.Time
+}{tables: make(map[string]time.Time)}
+
+func init() {
+	AddWriteListener(func(table string) {
+		recentWrites.Lock()
+		recentWrites.tables[table] = time.Now()
+		recentWrites.Unlock()
+	})
+	worker.AddTask("replica-lag-check", 5*time.Second, checkReplicas)
+}
+
+// connectReplicas opens the configured replicas. They start out unhealthy until checked.
+func connectReplicas() error {
+	for index, connectionString := range config.Get().Replicas.DatabaseStrings {
+		connector, err := pq.NewConnector(connectionString)
+		if err != nil {
+			return newError("Failed to connect to replica database %d: %v", index, err)
+		}
+		replicas = append(replicas, &replica{db: sql.OpenDB(timedConnector{Connector: connector}), index: index})
+	}
+	checkReplicas()
+	return nil
+}
+
+// replicaMaxLag gets the configured max replication lag.
+func replicaMaxLag() time.Duration {
+	if config.Get().Replicas.MaxLagMS > 0 {
+		return time.Duration(config.Get().Replicas.MaxLagMS) * time.Millisecond
+	}
+	return defaultReplicaMaxLag
+}
+
+// checkReplicas marks the replicas which respond and aren't lagging too far behind as healthy.
+func checkReplicas() {
+	maxLag := replicaMaxLag()
+	for _, replica := range replicas {
+		var lagSeconds float64
+		err := replica.db.QueryRow(replicaLagQuery).Scan(&lagSeconds)
+		lag := time.Duration(lagSeconds * float64(time.Second))
+		healthy := err == nil && lag <= maxLag
+		previouslyHealthy := atomic.SwapInt32(&replica.healthy, boolToInt32(healthy)) == 1
+		if healthy == previouslyHealthy {
+			continue
+		}
+		replicaLog := log.WithFields(log.Fields{
+			"replica": replica.index,
+			"lag":     lag,
+		})
+		if err != nil {
+			replicaLog = replicaLog.WithError(err)
+		}
+		if healthy {
+			replicaLog.Info("Database replica is healthy, using it for reads")
+		} else {
+			replicaLog.Warn("Database replica is unavailable or lagging, reading from the primary")
+		}
+	}
+}
+
+func boolToInt32(value bool) int32 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// ReadExecutor gets an executor for read-only queries of the tables, using a healthy replica if any.
+// Tables written within the max replication lag are read from the primary, so writers see their own writes.
+// Writes through the executor always go to the primary.
+func ReadExecutor(tables ...string) Executor {
+	if len(replicas) == 0 {
+		return DB
+	}
+	cutoff := time.Now().Add(-replicaMaxLag())
+	recentWrites.Lock()
+	for _, table := range tables {
+		if recentWrites.tables[table].After(cutoff) {
+			recentWrites.Unlock()
+			return DB
+		}
+	}
+	recentWrites.Unlock()
+
+	// Round-robin between the healthy replicas
+	start := atomic.AddUint32(&replicaCounter, 1)
+	for i := 0; i < len(replicas); i++ {
+		replica := replicas[(int(start)+i)%len(replicas)]
+		if atomic.LoadInt32(&replica.healthy) == 1 {
+			return replicaExecutor{replica: replica}
+		}
+	}
+	return DB
+}
+
+// replicaExecutor runs queries on the replica, falling back to the primary if it fails.
+type replicaExecutor struct {
+	replica *replica
+}
+
+func (executor replicaExecutor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return DB.Exec(query, args...)
+}
+
+func (executor replicaExecutor) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	rows, err := executor.replica.db.Query(query, args...)
+	if err == nil {
+		return rows, nil
+	}
+	// Errors which would also happen on the primary don't make the replica unhealthy
+	if _, isQueryError := err.(*pq.Error); !isQueryError {
+		atomic.StoreInt32(&executor.replica.healthy, 0)
+		log.WithError(err).WithField("replica", executor.replica.index).Warn("Database replica query failed, retrying on the primary")
+	}
+	return DB.Query(query, args...)
+}
+
+// QueryRow runs the query on the replica without fallback, since errors only show when scanning.
+func (executor replicaExecutor) QueryRow(query string, args ...interface{}) *sql.Row {
+	return executor.replica.db.QueryRow(query, args...)
+}
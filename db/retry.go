@@ -0,0 +1,162 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// Retry defaults, if not configured.
+const (
+	defaultRetryMaxAttempts = 4
+	defaultRetryBaseDelay   = 50 * time.Millisecond
+	defaultRetryMaxDelay    = 2 * time.Second
+)
+
+// IsRetryable checks if the error is transient, e.g. a serialization failure or a connection reset during a failover.
+// If not idempotent, only errors where the server reported that the statement wasn't applied count, since the statement
+// may have been applied if the connection was lost while waiting for the response.
+func IsRetryable(err error, idempotent bool) bool {
+	if err == nil {
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code == "40001", // serialization_failure
+			pqErr.Code == "40P01",      // deadlock_detected
+			pqErr.Code == "25006",      // read_only_sql_transaction, e.g. connected to a demoted primary
+			pqErr.Code == "57P01",      // admin_shutdown
+			pqErr.Code == "57P02",      // crash_shutdown
+			pqErr.Code == "57P03",      // cannot_connect_now
+			pqErr.Code.Class() == "08": // connection_exception
+			return true
+		}
+		return false
+	}
+	if !idempotent {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// lib/pq doesn't wrap some connection errors
+	return strings.Contains(err.Error(), "connection reset by peer") || strings.Contains(err.Error(), "broken pipe")
+}
+
+// Retry runs the operation until it succeeds, fails with a non-retryable error (see IsRetryable) or runs out of
+// attempts, sleeping with exponential backoff and jitter in between. The operation must not run inside a
+// transaction, since the transaction is aborted after the first error.
+func Retry(idempotent bool, operation func() error) error {
+	maxAttempts := config.Get().DBRetry.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultRetryMaxAttempts
+	}
+	baseDelay := defaultRetryBaseDelay
+	if config.Get().DBRetry.BaseDelayMS > 0 {
+		baseDelay = time.Duration(config.Get().DBRetry.BaseDelayMS) * time.Millisecond
+	}
+	maxDelay := defaultRetryMaxDelay
+	if config.Get().DBRetry.MaxDelayMS > 0 {
+		maxDelay = time.Duration(config.Get().DBRetry.MaxDelayMS) * time.Millisecond
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = operation()
+		if err == nil || attempt >= maxAttempts || !IsRetryable(err, idempotent) {
+			break
+		}
+		// Full jitter, so clients failing together don't retry together
+		delay := baseDelay << (attempt - 1)
+		if delay > maxDelay || delay <= 0 {
+			delay = maxDelay
+		}
+		delay = time.Duration(rand.Int63n(int64(delay) + 1))
+		log.WithError(err).WithFields(log.Fields{
+			"attempt": attempt,
+			"delay":   delay,
+		}).Warn("Transient database error, retrying")
+		time.Sleep(delay)
+	}
+	return err
+}
+
+// retryable checks if operations on the executor may be retried, i.e. it's not a transaction.
+func retryable(executor Executor) bool {
+	_, isTx := executor.(*sql.Tx)
+	return !isTx
+}
+
+// queryWithRetry runs the query, retrying transient errors outside transactions.
+func queryWithRetry(executor Executor, query string, args ...interface{}) (*sql.Rows, error) {
+	if !retryable(executor) {
+		return executor.Query(query, args...)
+	}
+	var rows *sql.Rows
+	err := Retry(true, func() error {
+		var err error
+		rows, err = executor.Query(query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// execWithRetry runs the statement, retrying transient errors where the statement wasn't applied outside transactions.
+func execWithRetry(executor Executor, query string, args ...interface{}) (sql.Result, error) {
+	if !retryable(executor) {
+		return executor.Exec(query, args...)
+	}
+	var result sql.Result
+	err := Retry(false, func() error {
+		var err error
+		result, err = executor.Exec(query, args...)
+		return err
+	})
+	return result, err
+}
+
+// scanWithRetry runs the single-row query and scans it, retrying transient errors outside transactions.
+func scanWithRetry(executor Executor, query string, args []interface{}, dest ...interface{}) error {
+	if !retryable(executor) {
+		return executor.QueryRow(query, args...).Scan(dest...)
+	}
+	return Retry(true, func() error {
+		return executor.QueryRow(query, args...).Scan(dest...)
+	})
+}
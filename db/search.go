@@ -0,0 +1,69 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// searchVector is a tsvector column maintained from text columns of the same table.
+type searchVector struct {
+	column  string
+	sources []string
+}
+
+var searchVectors = make(map[string]searchVector)
+
+// RegisterSearchVector makes Insert and Update maintain a full-text search
+// (tsvector) column of the table from the provided text columns. The
+// "simple" text search config is used, since content may be in any
+// language. Writes bypassing Insert and Update must maintain it themselves.
+func RegisterSearchVector(table string, column string, sources ...string) {
+	searchVectors[table] = searchVector{column: column, sources: sources}
+}
+
+// searchVectorExpression builds the expression for the search vector of the
+// table, if any, using the params for the written keys. Sources which aren't
+// written use the existing column value for updates and are ignored for
+// inserts.
+func searchVectorExpression(table string, keys []string, insert bool) (column string, expression string, ok bool) {
+	vector, ok := searchVectors[table]
+	if !ok {
+		return "", "", false
+	}
+	parts := make([]string, len(vector.sources))
+	for i, source := range vector.sources {
+		if insert {
+			parts[i] = "NULL"
+		} else {
+			parts[i] = fmt.Sprintf("\"%s\"", source)
+		}
+		for idx, key := range keys {
+			if key == source {
+				parts[i] = fmt.Sprintf("$%d::text", idx+1)
+				break
+			}
+		}
+	}
+	expression = fmt.Sprintf("to_tsvector('simple', concat_ws(' ', %s))", strings.Join(parts, ", "))
+	return vector.column, expression, true
+}
@@ -21,9 +21,12 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package db
 
 import (
+	"database/sql"
 	"fmt"
 	"reflect"
+	"strings"
 
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -60,7 +63,15 @@ func Get(item interface{}, table string, searcher ...interface{}) Result {
 // iterates over the fields of d, preparing both the query and allocating
 // zero-values of the relevant objects. After this, the query is executed
 // and the values are stored on the temporary values. The last pass stores
+//
+// Like the other reads without an executor, it uses a replica if configured
+// and healthy, see ReadExecutor.
 func Select(d interface{}, table string, searcher ...interface{}) Result {
+	return SelectWith(ReadExecutor(table), d, table, searcher...)
+}
+
+// SelectWith is like Select, but uses the provided executor, e.g. a transaction.
+func SelectWith(executor Executor, d interface{}, table string, searcher ...interface{}) Result {
 	st := reflect.ValueOf(d)
 	if st.Kind() != reflect.Ptr {
 		return Result{Error: newError("Select() called with non-pointer interface. This wouldn't really work.")}
@@ -72,7 +83,7 @@ func Select(d interface{}, table string, searcher ...interface{}) Result {
 	retvi := retv.Interface()
 
 	// Do the actual work :D
-	selectResult := SelectMany(&retvi, table, searcher...)
+	selectResult := SelectManyWith(executor, &retvi, table, searcher...)
 	if selectResult.Error != nil {
 		return selectResult
 	}
@@ -90,7 +101,8 @@ func Select(d interface{}, table string, searcher ...interface{}) Result {
 	return Result{Ok: 1}
 }
 
-// Selector TODO desc
+// Selector is a single where condition. The haystack (column) is
+// normalized without quotes and the operator is uppercase.
 type Selector struct {
 	Haystack string
 	Operator string
@@ -108,10 +120,22 @@ func buildWhere(offset int, search []Selector) (string, []interface{}) {
 		} else {
 			whereand = "AND"
 		}
-		if item.Needle == nil {
-			strsearch = fmt.Sprintf("%s %s %s %s NULL", strsearch, whereand, item.Haystack, item.Operator)
+		if isNullNeedle(item.Needle) {
+			operator := item.Operator
+			switch operator {
+			case "=":
+				operator = "IS"
+			case "!=", "<>":
+				operator = "IS NOT"
+			}
+			strsearch = fmt.Sprintf("%s %s %s %s NULL", strsearch, whereand, quoteIdentifier(item.Haystack), operator)
+		} else if item.Operator == "IN" {
+			// The needle is a slice, matched as an array to keep it a single param
+			strsearch = fmt.Sprintf("%s %s %s = ANY($%d)", strsearch, whereand, quoteIdentifier(item.Haystack), offset+nextidx)
+			nextidx++
+			searcharr = append(searcharr, pq.Array(item.Needle))
 		} else {
-			strsearch = fmt.Sprintf("%s %s %s %s $%d", strsearch, whereand, item.Haystack, item.Operator, offset+nextidx)
+			strsearch = fmt.Sprintf("%s %s %s %s $%d", strsearch, whereand, quoteIdentifier(item.Haystack), item.Operator, offset+nextidx)
 			nextidx++
 			searcharr = append(searcharr, item.Needle)
 		}
@@ -129,11 +153,17 @@ func buildWhere(offset int, search []Selector) (string, []interface{}) {
 // 1. It handles the needle safely, e.g., it lets the sql driver do the
 // escaping.
 //
-// 2. The haystack and table is NOT safe.
+// 2. The haystack and table must be plain (optionally schema-qualified)
+// identifiers and the operator one of the allowed ones, else an error is
+// returned. They are quoted in the query, so they're not injectable, but
+// should still not be taken from user input without checking.
 //
 // 3. It uses database/sql.Scan, so as long as your elements implement
 // that, it will Just Work.
 //
+// 4. The "IN" operator takes a slice needle, e.g. ("id", "IN", ids), to
+// fetch many rows by key in one query instead of one query per key.
+//
 // It works by first determining the base object/type to fetch by digging
 // into d with reflection. Once that is established, it iterates over the
 // discovered base-structure and does two things: creates the list of
@@ -142,7 +172,25 @@ func buildWhere(offset int, search []Selector) (string, []interface{}) {
 // over the replies, storing them in new base elements. At the very end,
 // the *d is overwritten with the new slice.
 func SelectMany(d interface{}, table string, searcher ...interface{}) Result {
-	if DB == nil {
+	return SelectManyOrdered(d, table, "", searcher...)
+}
+
+// SelectManyWith is like SelectMany, but uses the provided executor, e.g. a transaction.
+func SelectManyWith(executor Executor, d interface{}, table string, searcher ...interface{}) Result {
+	return SelectManyOrderedWith(executor, d, table, "", searcher...)
+}
+
+// SelectManyOrdered is like SelectMany, but orders the rows, e.g. by
+// "sequence ASC, name". Like the haystack, the columns of orderBy are
+// validated and quoted, and only ASC/DESC and NULLS FIRST/LAST are allowed
+// after them, not expressions.
+func SelectManyOrdered(d interface{}, table string, orderBy string, searcher ...interface{}) Result {
+	return SelectManyOrderedWith(ReadExecutor(table), d, table, orderBy, searcher...)
+}
+
+// SelectManyOrderedWith is like SelectManyOrdered, but uses the provided executor, e.g. a transaction.
+func SelectManyOrderedWith(executor Executor, d interface{}, table string, orderBy string, searcher ...interface{}) Result {
+	if sqlDB, ok := executor.(*sql.DB); executor == nil || (ok && sqlDB == nil) {
 		return Result{Error: newError("Tried to issue SelectMany() without a DB object")}
 	}
 	dval := reflect.ValueOf(d)
@@ -194,9 +242,20 @@ func SelectMany(d interface{}, table string, searcher ...interface{}) Result {
 		comma = ","
 	}
 	strsearch, searcharr := buildWhere(0, search)
-	q := fmt.Sprintf("SELECT %s FROM %s%s", keys, table, strsearch)
+	quotedTable, err := quoteTable(table)
+	if err != nil {
+		return Result{Error: err}
+	}
+	quotedOrderBy, err := quoteOrderBy(orderBy)
+	if err != nil {
+		return Result{Error: err}
+	}
+	q := fmt.Sprintf("SELECT %s FROM %s%s", keys, quotedTable, strsearch)
+	if quotedOrderBy != "" {
+		q = fmt.Sprintf("%s ORDER BY %s", q, quotedOrderBy)
+	}
 	log.WithField("query", q).Trace("Select()")
-	rows, err := DB.Query(q, searcharr...)
+	rows, err := queryWithRetry(executor, q, searcharr...)
 	if err != nil {
 		return Result{Error: newErrorWithCause("Select(): SELECT failed on DB.Query", err)}
 	}
@@ -232,7 +291,7 @@ func SelectMany(d interface{}, table string, searcher ...interface{}) Result {
 
 		for idx := range kvs.newvals {
 			newv := reflect.Indirect(reflect.ValueOf(kvs.newvals[idx]))
-			value := newval.Field(kvs.keyidx[idx])
+			value := newval.FieldByIndex(kvs.keyidx[idx])
 			value.Set(newv)
 		}
 
@@ -251,14 +310,23 @@ func SelectMany(d interface{}, table string, searcher ...interface{}) Result {
 // it doesn't find it - including if an error occurs (which will also be
 // returned).
 func Exists(table string, searcher ...interface{}) Result {
+	return ExistsWith(DB, table, searcher...)
+}
+
+// ExistsWith is like Exists, but uses the provided executor, e.g. a transaction.
+func ExistsWith(executor Executor, table string, searcher ...interface{}) Result {
 	search, err := buildSearch(searcher...)
 	if err != nil {
 		return Result{Error: newErrorWithCause("Exists(): failed, unable to build search", err)}
 	}
+	quotedTable, err := quoteTable(table)
+	if err != nil {
+		return Result{Error: err}
+	}
 	searchstr, searcharr := buildWhere(0, search)
-	q := fmt.Sprintf("SELECT * FROM %s %s LIMIT 1", table, searchstr)
+	q := fmt.Sprintf("SELECT * FROM %s %s LIMIT 1", quotedTable, searchstr)
 	log.WithField("query", q).Trace("Exists()")
-	rows, err := DB.Query(q, searcharr...)
+	rows, err := queryWithRetry(executor, q, searcharr...)
 	if err != nil {
 		return Result{Error: newErrorWithCause("Exists(): SELECT failed", err)}
 	}
@@ -272,6 +340,32 @@ func Exists(table string, searcher ...interface{}) Result {
 	return Result{Ok: 1}
 }
 
+// Count counts the rows where haystack matches the needle on the given
+// table, returned as Ok.
+func Count(table string, searcher ...interface{}) Result {
+	return CountWith(DB, table, searcher...)
+}
+
+// CountWith is like Count, but uses the provided executor, e.g. a transaction.
+func CountWith(executor Executor, table string, searcher ...interface{}) Result {
+	search, err := buildSearch(searcher...)
+	if err != nil {
+		return Result{Error: newErrorWithCause("Count(): failed, unable to build search", err)}
+	}
+	quotedTable, err := quoteTable(table)
+	if err != nil {
+		return Result{Error: err}
+	}
+	searchstr, searcharr := buildWhere(0, search)
+	q := fmt.Sprintf("SELECT COUNT(*) FROM %s %s", quotedTable, searchstr)
+	log.WithField("query", q).Trace("Count()")
+	var count int
+	if err := scanWithRetry(executor, q, searcharr, &count); err != nil {
+		return Result{Error: newErrorWithCause("Count(): SELECT failed", err)}
+	}
+	return Result{Ok: count}
+}
+
 // Get is a convenience-wrapper for Select that return suitable
 // gondulapi-errors if the needle is the Zero-value, if the database-query
 // fails or if the item isn't found.
@@ -302,7 +396,21 @@ func buildSearch(searcher ...interface{}) ([]Selector, error) {
 	} else {
 		search = make([]Selector, 0)
 		for i := 0; i < len(searcher); i += 3 {
-			search = append(search, Selector{searcher[i].(string), searcher[i+1].(string), searcher[i+2]})
+			haystack, haystackOk := searcher[i].(string)
+			operator, operatorOk := searcher[i+1].(string)
+			if !haystackOk || !operatorOk {
+				return nil, newError("Search column and operator must be strings, got %T and %T", searcher[i], searcher[i+1])
+			}
+			// The column and operator are put into the query as is, so only allow safe ones
+			haystack, err := normalizeIdentifier(haystack)
+			if err != nil {
+				return nil, err
+			}
+			operator = strings.ToUpper(strings.Join(strings.Fields(operator), " "))
+			if !whereOperators[operator] {
+				return nil, newError("Invalid search operator: %q", searcher[i+1])
+			}
+			search = append(search, Selector{haystack, operator, searcher[i+2]})
 		}
 	}
 	return search, nil
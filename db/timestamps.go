@@ -0,0 +1,71 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+import (
+	"reflect"
+	"time"
+)
+
+// Timestamp columns maintained for structs embedding Timestamps.
+const (
+	CreatedColumn = "created_at"
+	UpdatedColumn = "updated_at"
+)
+
+// Timestamps may be embedded in structs to have Insert set the creation and
+// update times and Update set the update time (never changing the creation
+// time). Writes bypassing Insert and Update must set them themselves.
+type Timestamps struct {
+	CreatedAt *time.Time `column:"created_at" json:"created_at"` // Automatic
+	UpdatedAt *time.Time `column:"updated_at" json:"updated_at"` // Automatic
+}
+
+// timestampsField finds the embedded Timestamps in the struct, if any and settable.
+func timestampsField(d interface{}) (*Timestamps, bool) {
+	v := reflect.Indirect(reflect.ValueOf(d))
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = reflect.Indirect(v.Elem())
+	}
+	if v.Kind() != reflect.Struct || !v.CanAddr() {
+		return nil, false
+	}
+	st := v.Type()
+	for i := 0; i < st.NumField(); i++ {
+		if field := st.Field(i); field.Anonymous && field.Type == reflect.TypeOf(Timestamps{}) {
+			return v.Field(i).Addr().Interface().(*Timestamps), true
+		}
+	}
+	return nil, false
+}
+
+// touchTimestamps sets the update time (and the creation time if created) of structs embedding Timestamps.
+func touchTimestamps(d interface{}, created bool) {
+	timestamps, ok := timestampsField(d)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	timestamps.UpdatedAt = &now
+	if created {
+		timestamps.CreatedAt = &now
+	}
+}
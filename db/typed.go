@@ -0,0 +1,70 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+// Typed variants of Select and SelectMany, so the result type is checked
+// when compiling instead of passing interface{} pointers around. T is the
+// row struct or a pointer to it, e.g.:
+//
+//	station, found, err := db.SelectOne[Station]("stations", "id", "=", id)
+//	stations, err := db.SelectAllOrdered[*Station]("stations", "shortname", "track", "=", trackID)
+//
+// The where args and ordering work like for Select and SelectMany.
+
+// SelectOne selects the first row matching the where args. Found is false
+// if there is none.
+func SelectOne[T any](table string, searcher ...interface{}) (item T, found bool, err error) {
+	return SelectOneWith[T](ReadExecutor(table), table, searcher...)
+}
+
+// SelectOneWith is like SelectOne, but uses the provided executor, e.g. a transaction.
+func SelectOneWith[T any](executor Executor, table string, searcher ...interface{}) (item T, found bool, err error) {
+	result := SelectWith(executor, &item, table, searcher...)
+	if result.IsFailed() {
+		return item, false, result.Error
+	}
+	return item, result.IsSuccess(), nil
+}
+
+// SelectAll selects all rows matching the where args, empty (not nil) if none.
+func SelectAll[T any](table string, searcher ...interface{}) ([]T, error) {
+	return SelectAllOrderedWith[T](ReadExecutor(table), table, "", searcher...)
+}
+
+// SelectAllWith is like SelectAll, but uses the provided executor, e.g. a transaction.
+func SelectAllWith[T any](executor Executor, table string, searcher ...interface{}) ([]T, error) {
+	return SelectAllOrderedWith[T](executor, table, "", searcher...)
+}
+
+// SelectAllOrdered is like SelectAll, but orders the rows like SelectManyOrdered.
+func SelectAllOrdered[T any](table string, orderBy string, searcher ...interface{}) ([]T, error) {
+	return SelectAllOrderedWith[T](ReadExecutor(table), table, orderBy, searcher...)
+}
+
+// SelectAllOrderedWith is like SelectAllOrdered, but uses the provided executor, e.g. a transaction.
+func SelectAllOrderedWith[T any](executor Executor, table string, orderBy string, searcher ...interface{}) ([]T, error) {
+	items := make([]T, 0)
+	result := SelectManyOrderedWith(executor, &items, table, orderBy, searcher...)
+	if result.IsFailed() {
+		return nil, result.Error
+	}
+	return items, nil
+}
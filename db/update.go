@@ -45,11 +45,14 @@ fields that map to a database table. If your field names don't match
 the column name, you can tag the struct fields with
 `column:"alternatename"`. If you wish to have this package ignore the
 field entirely (e.g.: it's exported, but doesn't exist at all in the
-database), tag it with `column:"-"`.
+database), tag it with `column:"-"`. The fields of embedded structs
+without a column tag (e.g. Timestamps) are mapped as if they were fields
+of the outer struct.
 */
 package db
 
 import (
+	"database/sql"
 	"fmt"
 	"reflect"
 	"unicode"
@@ -59,7 +62,7 @@ import (
 
 type keyvals struct {
 	keys    []string // name
-	keyidx  []int    // mapping from our index to struct-index (in case of skipping)
+	keyidx  [][]int  // mapping from our index to struct-index (in case of skipping), with embedded structs flattened
 	values  []interface{}
 	newvals []interface{}
 }
@@ -80,13 +83,29 @@ func enumerate(haystacks map[string]bool, populate bool, d interface{}) (keyvals
 
 	kvs.keys = make([]string, 0)
 	kvs.values = make([]interface{}, 0)
+	err := enumerateFields(&kvs, haystacks, populate, v, nil)
+	return kvs, err
+}
+
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
 
+// enumerateFields adds the fields of the struct value to the keyvals, recursing into embedded structs without a column tag.
+func enumerateFields(kvs *keyvals, haystacks map[string]bool, populate bool, v reflect.Value, parentIndex []int) error {
+	st := v.Type()
 	for i := 0; i < st.NumField(); i++ {
 		field := st.Field(i)
 		value := v.Field(i)
 		if !unicode.IsUpper(rune(field.Name[0])) {
 			continue
 		}
+		index := append(append([]int{}, parentIndex...), i)
+		_, tagged := field.Tag.Lookup("column")
+		if field.Anonymous && !tagged && field.Type.Kind() == reflect.Struct && !reflect.PtrTo(field.Type).Implements(scannerType) {
+			if err := enumerateFields(kvs, haystacks, populate, value, index); err != nil {
+				return err
+			}
+			continue
+		}
 		col := field.Name
 		if ncol, ok := field.Tag.Lookup("column"); ok {
 			col = ncol
@@ -94,6 +113,9 @@ func enumerate(haystacks map[string]bool, populate bool, d interface{}) (keyvals
 		if haystacks[col] || col == "-" {
 			continue
 		}
+		if !isIdentifierPart(col) {
+			return newError("Invalid column name %q for field %v", col, field.Name)
+		}
 
 		if field.Type.Kind() == reflect.Ptr && value.IsNil() {
 			if !populate {
@@ -106,15 +128,20 @@ func enumerate(haystacks map[string]bool, populate bool, d interface{}) (keyvals
 		kvs.keys = append(kvs.keys, col)
 		kvs.values = append(kvs.values, value.Interface())
 		kvs.newvals = append(kvs.newvals, reflect.New(value.Type()).Interface())
-		kvs.keyidx = append(kvs.keyidx, i)
+		kvs.keyidx = append(kvs.keyidx, index)
 	}
-	return kvs, nil
+	return nil
 }
 
 // Update attempts to update the object in the database, using the provided
 // string and matching the haystack with the needle. It skips fields that
 // are nil-pointers.
 func Update(table string, d interface{}, searcher ...interface{}) Result {
+	return UpdateWith(DB, table, d, searcher...)
+}
+
+// UpdateWith is like Update, but uses the provided executor, e.g. a transaction.
+func UpdateWith(executor Executor, table string, d interface{}, searcher ...interface{}) Result {
 	report := Result{}
 	search, err := buildSearch(searcher...)
 	if err != nil {
@@ -126,13 +153,27 @@ func Update(table string, d interface{}, searcher ...interface{}) Result {
 	for _, item := range search {
 		haystacks[item.Haystack] = true
 	}
+	version, versioned := versionField(d)
+	if versioned {
+		haystacks[VersionColumn] = true
+	}
+	if _, ok := timestampsField(d); ok {
+		haystacks[CreatedColumn] = true
+		touchTimestamps(d, false)
+	}
 	kvs, err := enumerate(haystacks, false, d)
 	if err != nil {
 		report.Failed++
 		report.Error = newErrorWithCause("Update(): enumerate() failed", err)
 		return report
 	}
-	lead := fmt.Sprintf("UPDATE %s SET ", table)
+	quotedTable, err := quoteTable(table)
+	if err != nil {
+		report.Failed++
+		report.Error = err
+		return report
+	}
+	lead := fmt.Sprintf("UPDATE %s SET ", quotedTable)
 	comma := ""
 	last := 0
 	for idx := range kvs.keys {
@@ -140,10 +181,23 @@ func Update(table string, d interface{}, searcher ...interface{}) Result {
 		comma = ", "
 		last = idx
 	}
+	if vectorColumn, vectorExpression, ok := searchVectorExpression(table, kvs.keys, false); ok {
+		lead = fmt.Sprintf("%s%s\"%s\" = %s", lead, comma, vectorColumn, vectorExpression)
+	}
+	// Bump the version and only update the version which was loaded
+	versionChecked := false
+	if versioned {
+		lead = fmt.Sprintf("%s%s\"%s\" = \"%s\" + 1", lead, comma, VersionColumn, VersionColumn)
+		if needle := versionValue(version); needle != nil {
+			search = append(search, Selector{Haystack: VersionColumn, Operator: "=", Needle: needle})
+			versionChecked = true
+		}
+	}
+	columns := changedColumns(kvs, search)
 	strsearch, searcharr := buildWhere(last+1, search)
 	lead = fmt.Sprintf("%s%s", lead, strsearch)
 	kvs.values = append(kvs.values, searcharr...)
-	res, err := DB.Exec(lead, kvs.values...)
+	res, err := execWithRetry(executor, lead, kvs.values...)
 	log.WithField("query", lead).Trace("Update()")
 	if err != nil {
 		report.Failed++
@@ -151,8 +205,17 @@ func Update(table string, d interface{}, searcher ...interface{}) Result {
 		return report
 	}
 	rowsaf, _ := res.RowsAffected()
+	if versionChecked {
+		if rowsaf == 0 {
+			report.Failed++
+			report.Error = ErrVersionConflict
+			return report
+		}
+		bumpVersion(version)
+	}
 	report.Ok++
 	report.Affected += int(rowsaf)
+	notifyChange(Change{Table: table, Columns: columns})
 	return report
 }
 
@@ -163,15 +226,27 @@ func Update(table string, d interface{}, searcher ...interface{}) Result {
 // your database schema should prevent that, and calling code should
 // check if that is not the desired behavior.
 func Insert(table string, d interface{}) Result {
+	return InsertWith(DB, table, d)
+}
+
+// InsertWith is like Insert, but uses the provided executor, e.g. a transaction.
+func InsertWith(executor Executor, table string, d interface{}) Result {
 	report := Result{}
 	haystacks := make(map[string]bool, 0)
+	touchTimestamps(d, true)
 	kvs, err := enumerate(haystacks, false, d)
 	if err != nil {
 		report.Failed++
 		report.Error = newErrorWithCause("Insert(): Enumerate failed", err)
 		return report
 	}
-	lead := fmt.Sprintf("INSERT INTO %s (", table)
+	quotedTable, err := quoteTable(table)
+	if err != nil {
+		report.Failed++
+		report.Error = err
+		return report
+	}
+	lead := fmt.Sprintf("INSERT INTO %s (", quotedTable)
 	middle := ""
 	comma := ""
 	for idx := range kvs.keys {
@@ -179,8 +254,12 @@ func Insert(table string, d interface{}) Result {
 		middle = fmt.Sprintf("%s%s$%d ", middle, comma, idx+1)
 		comma = ", "
 	}
+	if vectorColumn, vectorExpression, ok := searchVectorExpression(table, kvs.keys, true); ok {
+		lead = fmt.Sprintf("%s%s\"%s\" ", lead, comma, vectorColumn)
+		middle = fmt.Sprintf("%s%s%s ", middle, comma, vectorExpression)
+	}
 	lead = fmt.Sprintf("%s) VALUES(%s)", lead, middle)
-	res, err := DB.Exec(lead, kvs.values...)
+	res, err := execWithRetry(executor, lead, kvs.values...)
 	log.WithField("query", lead).Trace("Insert()")
 	if err != nil {
 		report.Error = newErrorWithCause("Insert(): EXEC failed", err)
@@ -189,6 +268,7 @@ func Insert(table string, d interface{}) Result {
 	rowsaf, _ := res.RowsAffected()
 	report.Ok++
 	report.Affected += int(rowsaf)
+	notifyChange(Change{Table: table, Columns: changedColumns(kvs, nil)})
 	return report
 }
 
@@ -206,18 +286,29 @@ func Insert(table string, d interface{}) Result {
 // handled by a front-end doing a double-check, or by just assuming it
 // doesn't happen often enough to be worth fixing.
 func Upsert(table string, d interface{}, searcher ...interface{}) Result {
-	existsResult := Exists(table, searcher...)
+	return UpsertWith(DB, table, d, searcher...)
+}
+
+// UpsertWith is like Upsert, but uses the provided executor. Inside a
+// transaction, it's as safe as the transaction isolation level makes it.
+func UpsertWith(executor Executor, table string, d interface{}, searcher ...interface{}) Result {
+	existsResult := ExistsWith(executor, table, searcher...)
 	if existsResult.Error != nil {
 		return existsResult
 	}
 	if existsResult.IsSuccess() {
-		return Update(table, d, searcher...)
+		return UpdateWith(executor, table, d, searcher...)
 	}
-	return Insert(table, d)
+	return InsertWith(executor, table, d)
 }
 
 // Delete will delete the element, and will also delete duplicates.
 func Delete(table string, searcher ...interface{}) Result {
+	return DeleteWith(DB, table, searcher...)
+}
+
+// DeleteWith is like Delete, but uses the provided executor, e.g. a transaction.
+func DeleteWith(executor Executor, table string, searcher ...interface{}) Result {
 	report := Result{}
 	search, err := buildSearch(searcher...)
 	if err != nil {
@@ -225,9 +316,15 @@ func Delete(table string, searcher ...interface{}) Result {
 		report.Error = err
 		return report
 	}
+	quotedTable, err := quoteTable(table)
+	if err != nil {
+		report.Failed++
+		report.Error = err
+		return report
+	}
 	strsearch, searcharr := buildWhere(0, search)
-	q := fmt.Sprintf("DELETE FROM %s%s", table, strsearch)
-	res, err := DB.Exec(q, searcharr...)
+	q := fmt.Sprintf("DELETE FROM %s%s", quotedTable, strsearch)
+	res, err := execWithRetry(executor, q, searcharr...)
 	log.WithField("query", q).Trace("Delete()")
 	if err != nil {
 		report.Failed++
@@ -237,5 +334,6 @@ func Delete(table string, searcher ...interface{}) Result {
 	rowsaf, _ := res.RowsAffected()
 	report.Ok++
 	report.Affected += int(rowsaf)
+	notifyChange(Change{Table: table, Columns: changedColumns(keyvals{}, search)})
 	return report
 }
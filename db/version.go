@@ -0,0 +1,84 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+import (
+	"reflect"
+)
+
+// VersionColumn is the column used for optimistic locking. If a struct has
+// an integer field (or pointer to one) tagged with it, Update increments it
+// and only updates the row if the version still matches the one in the
+// struct. A nil pointer skips the check, but still increments it.
+const VersionColumn = "version"
+
+// ErrVersionConflict is reported by Update when the version of the row no
+// longer matches the one in the struct (or the row is gone), meaning it was
+// changed by someone else after being loaded.
+var ErrVersionConflict = newError("the row was changed concurrently, reload it and try again")
+
+// versionField finds the field for VersionColumn in the struct, if any.
+func versionField(d interface{}) (reflect.Value, bool) {
+	v := reflect.Indirect(reflect.ValueOf(d))
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = reflect.Indirect(v.Elem())
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	st := v.Type()
+	for i := 0; i < st.NumField(); i++ {
+		if column, ok := st.Field(i).Tag.Lookup("column"); ok && column == VersionColumn {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// versionValue returns the version to check against, or nil if unset.
+func versionValue(field reflect.Value) interface{} {
+	if field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			return nil
+		}
+		field = field.Elem()
+	}
+	return field.Interface()
+}
+
+// bumpVersion increments the version in the struct after a successful update, if it can.
+func bumpVersion(field reflect.Value) {
+	if field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			return
+		}
+		field = field.Elem()
+	}
+	if !field.CanSet() {
+		return
+	}
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		field.SetInt(field.Int() + 1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		field.SetUint(field.Uint() + 1)
+	}
+}
@@ -0,0 +1,439 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package content
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+const defaultAttachmentMaxSizeMB = 10
+
+// attachmentMultipartOverhead is allowed in addition to the max attachment size, for the other parts and headers.
+const attachmentMultipartOverhead = 1024 * 1024
+
+// Attachment is a file bound to either a document or a task, e.g. an image for a task description.
+type Attachment struct {
+	ID                *uuid.UUID `column:"id" json:"id"`                                 // Generated, required, unique
+	DocumentFamilyID  *string    `column:"document_family" json:"document_family"`       // Required with document shortname if not task
+	DocumentShortname *string    `column:"document_shortname" json:"document_shortname"` // Required with document family if not task
+	TaskID            *uuid.UUID `column:"task" json:"task"`                             // Required if not document
+	Filename          string     `column:"filename" json:"filename"`
+	ContentType       string     `column:"content_type" json:"content_type"`
+	Size              int64      `column:"size" json:"size"`
+	UploadTime        *time.Time `column:"upload_time" json:"upload_time"`
+	URL               string     `column:"-" json:"url"` // Where to get the content
+}
+
+// Attachments is a list of attachments.
+type Attachments []*Attachment
+
+// AttachmentUpload is for uploading a new attachment as a multipart form,
+// with the "file" part and either the "document_family" and "document_shortname" parts or the "task" part.
+type AttachmentUpload struct {
+	Attachment
+}
+
+// AttachmentContent is the content of an attachment.
+type AttachmentContent struct {
+	contentType string
+	filename    string
+	content     []byte
+}
+
+// inlineAttachmentMediaTypes are the media types browsers may show inline, as they can't run scripts.
+// Everything else is sent as a download.
+var inlineAttachmentMediaTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+func init() {
+	rest.AddHandler("/attachments/", "^$", func() interface{} { return &Attachments{} })
+	rest.AddHandler("/attachments/", "^$", func() interface{} { return &AttachmentUpload{} })
+	rest.AddHandler("/attachment/", "^(?P<id>[^/]+)/$", func() interface{} { return &AttachmentContent{} })
+	rest.AddHandler("/attachment/", "^(?P<id>[^/]+)/$", func() interface{} { return &Attachment{} })
+}
+
+// Get gets multiple attachments.
+func (attachments *Attachments) Get(request *rest.Request) rest.Result {
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if familyID, ok := request.QueryArgs["document_family"]; ok {
+		whereArgs = append(whereArgs, "document_family", "=", familyID)
+	}
+	if shortname, ok := request.QueryArgs["document_shortname"]; ok {
+		whereArgs = append(whereArgs, "document_shortname", "=", shortname)
+	}
+	if taskID, ok := request.QueryArgs["task"]; ok {
+		whereArgs = append(whereArgs, "task", "=", taskID)
+	}
+
+	// Get
+	var allAttachments Attachments
+	dbResult := db.SelectMany(&allAttachments, "attachments", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+
+	// Only keep the ones bound to documents and tasks the requester may see
+	*attachments = make(Attachments, 0, len(allAttachments))
+	for _, attachment := range allAttachments {
+		visible, err := attachment.isVisibleTo(request)
+		if err != nil {
+			return rest.InternalError(err)
+		}
+		if visible {
+			attachment.setURL()
+			*attachments = append(*attachments, attachment)
+		}
+	}
+	return rest.Result{}
+}
+
+// attachmentMaxSize gets the configured max attachment size in bytes.
+func attachmentMaxSize() int64 {
+	maxSizeMB := config.Get().Attachments.MaxSizeMB
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultAttachmentMaxSizeMB
+	}
+	return int64(maxSizeMB) * 1024 * 1024
+}
+
+// MaxBodyBytes allows bodies up to the max attachment size.
+func (upload *AttachmentUpload) MaxBodyBytes() int64 {
+	return attachmentMaxSize() + attachmentMultipartOverhead
+}
+
+// PostStream uploads a new attachment.
+func (upload *AttachmentUpload) PostStream(request *rest.Request, body io.Reader) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	mediaType, mediaParams, mediaErr := mime.ParseMediaType(request.ContentType)
+	if mediaErr != nil || mediaType != "multipart/form-data" || mediaParams["boundary"] == "" {
+		return rest.BadRequest("expected multipart form data")
+	}
+	maxSize := attachmentMaxSize()
+
+	// Read parts
+	attachment := &upload.Attachment
+	var content []byte
+	var declaredContentType string
+	reader := multipart.NewReader(body, mediaParams["boundary"])
+	for {
+		part, partErr := reader.NextPart()
+		if partErr == io.EOF {
+			break
+		}
+		if partErr != nil {
+			return rest.BadRequest("malformed multipart form data")
+		}
+		switch part.FormName() {
+		case "file":
+			partContent, readErr := io.ReadAll(io.LimitReader(part, maxSize+1))
+			if readErr != nil {
+				return rest.BadRequest("failed to read file")
+			}
+			if int64(len(partContent)) > maxSize {
+				return rest.Result{Code: 413, Message: fmt.Sprintf("file exceeds the max size of %v MB", maxSize/1024/1024)}
+			}
+			content = partContent
+			attachment.Filename = filepath.Base(part.FileName())
+			declaredContentType = part.Header.Get("Content-Type")
+		case "document_family", "document_shortname", "task":
+			value, readErr := io.ReadAll(io.LimitReader(part, 1024))
+			if readErr != nil {
+				return rest.BadRequest("malformed multipart form data")
+			}
+			if result := attachment.setBinding(part.FormName(), string(value)); !result.IsOk() {
+				return result
+			}
+		}
+	}
+	if content == nil {
+		return rest.BadRequest("missing file")
+	}
+
+	// Prepare and validate
+	newID := uuid.New()
+	now := time.Now()
+	attachment.ID = &newID
+	attachment.UploadTime = &now
+	attachment.Size = int64(len(content))
+	attachment.ContentType = attachmentContentType(declaredContentType, content)
+	if result := attachment.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Store content before metadata, to never have dangling attachments
+	storage, storageErr := getAttachmentStorage()
+	if storageErr != nil {
+		return rest.InternalError(storageErr)
+	}
+	if err := storage.store(attachment.ID.String(), content, attachment.ContentType); err != nil {
+		return rest.InternalError(err)
+	}
+	dbResult := db.Insert("attachments", attachment)
+	if dbResult.IsFailed() {
+		storage.remove(attachment.ID.String())
+		return rest.InternalError(dbResult.Error)
+	}
+
+	attachment.setURL()
+	return rest.Created(attachment.URL)
+}
+
+// Get gets the content of an attachment.
+func (attachmentContent *AttachmentContent) Get(request *rest.Request) rest.Result {
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.BadRequest("missing ID")
+	}
+	id, uuidErr := uuid.Parse(rawID)
+	if uuidErr != nil {
+		return rest.BadRequest("invalid ID")
+	}
+
+	// Get metadata and content
+	var attachment Attachment
+	dbResult := db.Select(&attachment, "attachments", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+	visible, visibleErr := attachment.isVisibleTo(request)
+	if visibleErr != nil {
+		return rest.InternalError(visibleErr)
+	}
+	if !visible {
+		return rest.NotFound("not found")
+	}
+	storage, storageErr := getAttachmentStorage()
+	if storageErr != nil {
+		return rest.InternalError(storageErr)
+	}
+	content, loadErr := storage.load(id.String())
+	if errors.Is(loadErr, errAttachmentContentNotFound) {
+		return rest.NotFound("content not found")
+	}
+	if loadErr != nil {
+		return rest.InternalError(loadErr)
+	}
+
+	attachmentContent.contentType = attachment.ContentType
+	attachmentContent.filename = attachment.Filename
+	attachmentContent.content = content
+	return rest.Result{}
+}
+
+// RawResponse returns the content as-is.
+func (attachmentContent *AttachmentContent) RawResponse() (string, []byte, error) {
+	return attachmentContent.contentType, attachmentContent.content, nil
+}
+
+// ContentDisposition only lets browsers show allowlisted content types inline,
+// the rest (e.g. HTML, SVG and XML, which may run scripts) are downloaded.
+func (attachmentContent *AttachmentContent) ContentDisposition() string {
+	mediaType, _, _ := mime.ParseMediaType(attachmentContent.contentType)
+	disposition := "attachment"
+	if inlineAttachmentMediaTypes[mediaType] {
+		disposition = "inline"
+	}
+	if attachmentContent.filename == "" {
+		return disposition
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": attachmentContent.filename})
+}
+
+// Delete deletes an attachment and its content.
+func (attachment *Attachment) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.BadRequest("missing ID")
+	}
+	id, uuidErr := uuid.Parse(rawID)
+	if uuidErr != nil {
+		return rest.BadRequest("invalid ID")
+	}
+
+	// Check if it exists
+	attachment.ID = &id
+	exists, err := attachment.exists()
+	if err != nil {
+		return rest.InternalError(err)
+	}
+	if !exists {
+		return rest.NotFound("not found")
+	}
+
+	// Delete metadata first, then content
+	dbResult := db.Delete("attachments", "id", "=", attachment.ID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	storage, storageErr := getAttachmentStorage()
+	if storageErr != nil {
+		return rest.InternalError(storageErr)
+	}
+	if err := storage.remove(attachment.ID.String()); err != nil {
+		return rest.InternalError(err)
+	}
+	return rest.Result{}
+}
+
+// isVisibleTo checks if the requester may see the attachment, i.e. the document or task it's bound to.
+// Document attachments are visible if any locale variant of the document is (see Document.isVisibleTo),
+// task attachments if the task's track isn't a draft.
+func (attachment *Attachment) isVisibleTo(request *rest.Request) (bool, error) {
+	if request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin {
+		return true, nil
+	}
+
+	if attachment.TaskID != nil {
+		var trackStatus string
+		row := db.DB.QueryRow("SELECT tracks.status FROM tasks JOIN tracks ON tracks.id = tasks.track WHERE tasks.id = $1", attachment.TaskID)
+		if err := row.Scan(&trackStatus); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return false, nil
+			}
+			return false, err
+		}
+		return trackStatus != "draft", nil
+	}
+
+	if attachment.DocumentFamilyID != nil && attachment.DocumentShortname != nil {
+		var variants Documents
+		dbResult := db.SelectMany(&variants, "documents", "family", "=", *attachment.DocumentFamilyID, "shortname", "=", *attachment.DocumentShortname)
+		if dbResult.IsFailed() {
+			return false, dbResult.Error
+		}
+		return len(variants.visibleTo(request)) > 0, nil
+	}
+
+	return false, nil
+}
+
+func (attachment *Attachment) setBinding(name string, value string) rest.Result {
+	switch name {
+	case "document_family":
+		attachment.DocumentFamilyID = &value
+	case "document_shortname":
+		attachment.DocumentShortname = &value
+	case "task":
+		taskID, uuidErr := uuid.Parse(value)
+		if uuidErr != nil {
+			return rest.BadRequest("invalid task ID")
+		}
+		attachment.TaskID = &taskID
+	}
+	return rest.Result{}
+}
+
+func (attachment *Attachment) setURL() {
+	attachment.URL = fmt.Sprintf("%v/attachment/%v/", config.Get().SitePrefix, attachment.ID)
+}
+
+func (attachment *Attachment) exists() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM attachments WHERE id = $1", attachment.ID)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+func (attachment *Attachment) validate() rest.Result {
+	boundToDocument := attachment.DocumentFamilyID != nil || attachment.DocumentShortname != nil
+	boundToTask := attachment.TaskID != nil
+	switch {
+	case attachment.ID == nil:
+		return rest.BadRequest("missing ID")
+	case boundToDocument == boundToTask:
+		return rest.BadRequest("must be bound to either a document or a task")
+	case boundToDocument && (attachment.DocumentFamilyID == nil || attachment.DocumentShortname == nil):
+		return rest.BadRequest("missing document family or shortname")
+	case attachment.Filename == "" || attachment.Filename == "." || attachment.Filename == "/":
+		return rest.BadRequest("missing filename")
+	}
+
+	// Check if the document or task exists
+	var count int
+	var row *sql.Row
+	if boundToDocument {
+		row = db.DB.QueryRow("SELECT COUNT(*) FROM documents WHERE family = $1 AND shortname = $2", attachment.DocumentFamilyID, attachment.DocumentShortname)
+	} else {
+		row = db.DB.QueryRow("SELECT COUNT(*) FROM tasks WHERE id = $1", attachment.TaskID)
+	}
+	if err := row.Scan(&count); err != nil {
+		return rest.InternalError(err)
+	}
+	if count == 0 {
+		return rest.BadRequest("referenced document or task does not exist")
+	}
+
+	return rest.Result{}
+}
+
+// attachmentContentType returns the declared content type if any, otherwise the detected one.
+// Types which browsers would execute when served from the API origin are served as plaintext instead.
+func attachmentContentType(declaredContentType string, content []byte) string {
+	contentType := declaredContentType
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = http.DetectContentType(content)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "text/html", mediaType == "application/xhtml+xml", mediaType == "image/svg+xml", strings.Contains(mediaType, "javascript"):
+		return "text/plain; charset=utf-8"
+	}
+	return contentType
+}
@@ -31,8 +31,9 @@ import (
 
 // DocumentFamily is a category of documents.
 type DocumentFamily struct {
-	ID   string `column:"id" json:"id"` // Required, unique
-	Name string `column:"name" json:"name"`
+	ID      string `column:"id" json:"id"`       // Required, unique
+	EventID string `column:"event" json:"event"` // Optional, defaults to the request event
+	Name    string `column:"name" json:"name"`
 }
 
 // DocumentFamilies is a list of families.
@@ -40,31 +41,63 @@ type DocumentFamilies []*DocumentFamily
 
 // Document is a document.
 type Document struct {
-	FamilyID      string     `column:"family" json:"family"`       // Required
-	Shortname     string     `column:"shortname" json:"shortname"` // Required, unique with family ID
+	FamilyID      string     `column:"family" json:"family" validate:"required"`       // Required
+	Shortname     string     `column:"shortname" json:"shortname" validate:"required"` // Required, unique with family ID and locale
+	Locale        string     `column:"locale" json:"locale"`                           // Defaults to the default locale, e.g. "en" or "nb"
 	Name          string     `column:"name" json:"name"`
 	Content       string     `column:"content" json:"content"`
 	ContentFormat string     `column:"content_format" json:"content_format"` // E.g. "plaintext" or "markdown"
-	Sequence      *int       `column:"sequence" json:"sequence"`             // For sorting
+	Sequence      *int       `column:"sequence" json:"sequence"`             // For sorting, appended to the end of the family if omitted when created
 	LastChange    *time.Time `column:"last_change" json:"last_change"`
+	ContentHTML   *string    `column:"-" json:"content_html,omitempty"` // Rendered content, only if requested
+	// Optional, the document is hidden from non-operators outside the window (either end may be omitted)
+	PublishFrom  *time.Time `column:"publish_from" json:"publish_from"`
+	PublishUntil *time.Time `column:"publish_until" json:"publish_until"`
 }
 
 // Documents is a list of documents.
 type Documents []*Document
 
+// DocumentGroup is the locale variants of a document.
+type DocumentGroup struct {
+	FamilyID  string    `json:"family"`
+	Shortname string    `json:"shortname"`
+	Locales   []string  `json:"locales"`
+	Variants  Documents `json:"variants"`
+}
+
+// DocumentGroups is a list of document groups.
+type DocumentGroups []*DocumentGroup
+
+// DocumentReorderRequest is for rewriting the sequences of all documents in a family, in the given order.
+// All locale variants of a document get the same sequence.
+type DocumentReorderRequest struct {
+	FamilyID   string   `json:"family" validate:"required"` // Required
+	Shortnames []string `json:"documents"`                  // Required, all document shortnames in the family, in the new order
+}
+
+var documentCachePolicy = rest.CachePolicy{TTL: 30 * time.Second, Tables: []string{"documents", "document_families"}}
+
 func init() {
+	db.RegisterSearchVector("documents", "search", "name", "content")
 	rest.AddHandler("/document-families/", "^$", func() interface{} { return &DocumentFamilies{} })
 	rest.AddHandler("/document-family/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &DocumentFamily{} })
-	rest.AddHandler("/documents/", "^$", func() interface{} { return &Documents{} })
-	rest.AddHandler("/document/", "^(?:(?P<family_id>[^/]+)/(?P<shortname>[^/]+)/)?$", func() interface{} { return &Document{} })
+	rest.AddCachedHandler("/documents/", "^$", documentCachePolicy, func() interface{} { return &Documents{} })
+	rest.AddCachedHandler("/document-groups/", "^$", documentCachePolicy, func() interface{} { return &DocumentGroups{} })
+	rest.AddHandler("/documents/", "^reorder/$", func() interface{} { return &DocumentReorderRequest{} })
+	rest.AddCachedHandler("/document/", "^(?:(?P<family_id>[^/]+)/(?P<shortname>[^/]+)/(?:(?P<locale>[^/]+)/)?)?$", documentCachePolicy, func() interface{} { return &Document{} })
 }
 
 // Get gets multiple families.
 func (families *DocumentFamilies) Get(request *rest.Request) rest.Result {
 	// TODO order by sequence
-	dbResult := db.SelectMany(families, "document_families")
+	var whereArgs []interface{}
+	if request.EventID != "" {
+		whereArgs = append(whereArgs, "event", "=", request.EventID)
+	}
+	dbResult := db.SelectMany(families, "document_families", whereArgs...)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
 
 	return rest.Result{}
@@ -75,16 +108,16 @@ func (family *DocumentFamily) Get(request *rest.Request) rest.Result {
 	// Check params
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 
 	// Get
 	dbResult := db.Select(family, "document_families", "id", "=", id)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
 	if !dbResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "not found"}
+		return rest.NotFound("not found")
 	}
 	return rest.Result{}
 }
@@ -98,14 +131,17 @@ func (family *DocumentFamily) Post(request *rest.Request) rest.Result {
 
 	// Check params
 	if family.ID == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
+	}
+	if family.EventID == "" {
+		family.EventID = request.EventID
 	}
 
 	// Check if duplicate
 	if exists, err := family.exists(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if exists {
-		return rest.Result{Code: 409, Message: "duplicate ID"}
+		return rest.Conflict("duplicate ID")
 	}
 
 	// Create and redirect
@@ -114,7 +150,7 @@ func (family *DocumentFamily) Post(request *rest.Request) rest.Result {
 		return result
 	}
 	result.Code = 201
-	result.Location = fmt.Sprintf("%v/document-family/%v/", config.Config.SitePrefix, family.ID)
+	result.Location = fmt.Sprintf("%v/document-family/%v/", config.Get().SitePrefix, family.ID)
 	return result
 }
 
@@ -128,12 +164,15 @@ func (family *DocumentFamily) Put(request *rest.Request) rest.Result {
 	// Check params
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 
 	// Validate
 	if family.ID != id {
-		return rest.Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
+		return rest.BadRequest("mismatch between URL and JSON IDs")
+	}
+	if family.EventID == "" {
+		family.EventID = request.EventID
 	}
 
 	// Create or update
@@ -142,6 +181,36 @@ func (family *DocumentFamily) Put(request *rest.Request) rest.Result {
 
 // Delete deletes a family.
 func (family *DocumentFamily) Delete(request *rest.Request) rest.Result {
+	if result := family.checkDelete(request); !result.IsOk() {
+		return result
+	}
+
+	// Delete
+	dbResult := db.Delete("document_families", "id", "=", family.ID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// PreviewDelete counts the documents and attachments a delete would leave dangling.
+func (family *DocumentFamily) PreviewDelete(request *rest.Request) (map[string]int, rest.Result) {
+	if result := family.checkDelete(request); !result.IsOk() {
+		return nil, result
+	}
+	affected, err := db.CountReferences(family.ID,
+		db.Reference{Table: "document_families", Column: "id"},
+		db.Reference{Table: "documents", Column: "family"},
+		db.Reference{Table: "attachments", Column: "document_family"},
+	)
+	if err != nil {
+		return nil, rest.InternalError(err)
+	}
+	return affected, rest.Result{}
+}
+
+// checkDelete checks the perms and that the family exists, for Delete and PreviewDelete.
+func (family *DocumentFamily) checkDelete(request *rest.Request) rest.Result {
 	// Check perms
 	if request.AccessToken.GetRole() != rest.RoleAdmin {
 		return rest.UnauthorizedResult(request.AccessToken)
@@ -150,37 +219,31 @@ func (family *DocumentFamily) Delete(request *rest.Request) rest.Result {
 	// Check params
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 
 	// Check if exists
 	family.ID = id
 	exists, err := family.exists()
 	if err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	}
 	if !exists {
-		return rest.Result{Code: 404, Message: "not found"}
-	}
-
-	// Delete
-	dbResult := db.Delete("document_families", "id", "=", family.ID)
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.NotFound("not found")
 	}
 	return rest.Result{}
 }
 
 func (family *DocumentFamily) create() rest.Result {
 	if exists, err := family.exists(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if exists {
-		return rest.Result{Code: 409, Message: "duplicate"}
+		return rest.Conflict("duplicate")
 	}
 
 	dbResult := db.Insert("document_families", family)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
 
 	return rest.Result{}
@@ -189,25 +252,42 @@ func (family *DocumentFamily) create() rest.Result {
 func (family *DocumentFamily) createOrUpdate() rest.Result {
 	exists, existsErr := family.exists()
 	if existsErr != nil {
-		return rest.Result{Code: 500, Error: existsErr}
+		return rest.InternalError(existsErr)
 	}
 
 	if exists {
 		dbResult := db.Update("document_families", family, "id", "=", family.ID)
 		if dbResult.IsFailed() {
-			return rest.Result{Code: 500, Error: dbResult.Error}
+			return rest.InternalError(dbResult.Error)
 		}
 		return rest.Result{}
 	}
 
 	dbResult := db.Insert("document_families", family)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
 
 	return rest.Result{}
 }
 
+// scopeToRequestEvent adds a filter on the family column for the families in the request event, if any.
+func scopeToRequestEvent(request *rest.Request, whereArgs []interface{}) ([]interface{}, error) {
+	if request.EventID == "" {
+		return whereArgs, nil
+	}
+	var families DocumentFamilies
+	dbResult := db.SelectMany(&families, "document_families", "event", "=", request.EventID)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	familyIDs := make([]string, 0, len(families))
+	for _, family := range families {
+		familyIDs = append(familyIDs, family.ID)
+	}
+	return append(whereArgs, "family", "IN", familyIDs), nil
+}
+
 func (family *DocumentFamily) exists() (bool, error) {
 	var count int
 	row := db.DB.QueryRow("SELECT COUNT(*) FROM document_families WHERE id = $1", family.ID)
@@ -228,11 +308,38 @@ func (documents *Documents) Get(request *rest.Request) rest.Result {
 	if familyID, ok := request.QueryArgs["family"]; ok {
 		whereArgs = append(whereArgs, "family", "=", familyID)
 	}
+	whereArgs, scopeErr := scopeToRequestEvent(request, whereArgs)
+	if scopeErr != nil {
+		return rest.InternalError(scopeErr)
+	}
+	_, negotiateLocale := request.QueryArgs["lang"]
+	render, renderResult := checkRenderFormat(request)
+	if !renderResult.IsOk() {
+		return renderResult
+	}
 
 	// Get
-	dbResult := db.SelectMany(documents, "documents", whereArgs...)
+	dbResult := db.SelectManyOrdered(documents, "documents", "family, sequence, shortname", whereArgs...)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
+	}
+	*documents = documents.visibleTo(request)
+
+	// Only keep the best variant of each document if a language was requested
+	if negotiateLocale {
+		locales := requestedLocales(request)
+		groups := groupDocumentVariants(*documents)
+		*documents = make(Documents, 0, len(groups))
+		for _, group := range groups {
+			*documents = append(*documents, chooseDocumentVariant(group, locales))
+		}
+	}
+
+	// Render
+	if render {
+		for _, document := range *documents {
+			document.render()
+		}
 	}
 	return rest.Result{}
 }
@@ -244,17 +351,54 @@ func (documents *Documents) Put(request *rest.Request) rest.Result {
 		return rest.UnauthorizedResult(request.AccessToken)
 	}
 
-	// Feed individual tests to the individual post endpoint, stop on first error
-	totalResult := rest.Result{}
-	for _, document := range *documents {
-		request.PathArgs["family_id"] = document.FamilyID
-		request.PathArgs["shortname"] = document.Shortname
-		result := document.Put(request)
-		if !result.IsOk() {
-			return result
+	// Feed individual documents to the individual put endpoint in a single transaction, all or nothing
+	return rest.InTransaction(request, func() rest.Result {
+		for i, document := range *documents {
+			request.PathArgs["family_id"] = document.FamilyID
+			request.PathArgs["shortname"] = document.Shortname
+			request.PathArgs["locale"] = document.Locale
+			result := document.Put(request)
+			if !result.IsOk() {
+				return rest.ElementFailedResult(result, fmt.Sprintf("document %v (%v/%v/%v)", i, document.FamilyID, document.Shortname, document.Locale))
+			}
+		}
+		return rest.Result{}
+	})
+}
+
+// Get gets documents grouped by family and shortname, with all locale variants.
+func (groups *DocumentGroups) Get(request *rest.Request) rest.Result {
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if familyID, ok := request.QueryArgs["family"]; ok {
+		whereArgs = append(whereArgs, "family", "=", familyID)
+	}
+	whereArgs, scopeErr := scopeToRequestEvent(request, whereArgs)
+	if scopeErr != nil {
+		return rest.InternalError(scopeErr)
+	}
+
+	// Get
+	var documents Documents
+	dbResult := db.SelectManyOrdered(&documents, "documents", "family, sequence, shortname", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+
+	// Group
+	*groups = make(DocumentGroups, 0)
+	for _, variants := range groupDocumentVariants(documents.visibleTo(request)) {
+		group := DocumentGroup{
+			FamilyID:  variants[0].FamilyID,
+			Shortname: variants[0].Shortname,
+			Variants:  variants,
+		}
+		for _, variant := range variants {
+			group.Locales = append(group.Locales, variant.Locale)
 		}
+		*groups = append(*groups, &group)
 	}
-	return totalResult
+	return rest.Result{}
 }
 
 // Get gets a single document.
@@ -262,21 +406,45 @@ func (document *Document) Get(request *rest.Request) rest.Result {
 	// Check params
 	familyID, familyIDExists := request.PathArgs["family_id"]
 	if !familyIDExists || familyID == "" {
-		return rest.Result{Code: 400, Message: "missing family ID"}
+		return rest.BadRequest("missing family ID")
 	}
 	shortname, shortnameExists := request.PathArgs["shortname"]
 	if !shortnameExists || shortname == "" {
-		return rest.Result{Code: 400, Message: "missing shortname"}
+		return rest.BadRequest("missing shortname")
+	}
+	locale := request.PathArgs["locale"]
+	render, renderResult := checkRenderFormat(request)
+	if !renderResult.IsOk() {
+		return renderResult
 	}
 
-	// Get
-	dbResult := db.Select(document, "documents", "family", "=", familyID, "shortname", "=", shortname)
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+	// Get the specified variant, or the best one for the requested languages
+	if locale != "" {
+		dbResult := db.Select(document, "documents", "family", "=", familyID, "shortname", "=", shortname, "locale", "=", locale)
+		if dbResult.IsFailed() {
+			return rest.InternalError(dbResult.Error)
+		}
+		if !dbResult.IsSuccess() || !document.isVisibleTo(request) {
+			return rest.NotFound("not found")
+		}
+	} else {
+		var variants Documents
+		dbResult := db.SelectMany(&variants, "documents", "family", "=", familyID, "shortname", "=", shortname)
+		if dbResult.IsFailed() {
+			return rest.InternalError(dbResult.Error)
+		}
+		groups := groupDocumentVariants(variants.visibleTo(request))
+		if len(groups) == 0 {
+			return rest.NotFound("not found")
+		}
+		*document = *chooseDocumentVariant(groups[0], requestedLocales(request))
 	}
-	if !dbResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "not found"}
+
+	// Render
+	if render {
+		document.render()
 	}
+	recordDocumentRead(document, request.AccessToken)
 	return rest.Result{}
 }
 
@@ -290,6 +458,9 @@ func (document *Document) Post(request *rest.Request) rest.Result {
 	// Overwrite stuff
 	now := time.Now()
 	document.LastChange = &now
+	if document.Locale == "" {
+		document.Locale = defaultLocale()
+	}
 
 	// Validate
 	if result := document.validate(); !result.IsOk() {
@@ -297,15 +468,20 @@ func (document *Document) Post(request *rest.Request) rest.Result {
 	}
 
 	// Create and redirect
-	result := document.create()
+	result := document.create(request.Executor())
 	if !result.IsOk() {
 		return result
 	}
 	result.Code = 201
-	result.Location = fmt.Sprintf("%v/document/%v/%v/", config.Config.SitePrefix, document.FamilyID, document.Shortname)
+	result.Location = fmt.Sprintf("%v/document/%v/%v/%v/", config.Get().SitePrefix, document.FamilyID, document.Shortname, document.Locale)
 	return result
 }
 
+// IfMatchRequired makes If-Match optional for PUTs, but honored if present.
+func (document *Document) IfMatchRequired() bool {
+	return false
+}
+
 // Put creates or updates a document.
 func (document *Document) Put(request *rest.Request) rest.Result {
 	// Check perms
@@ -316,27 +492,35 @@ func (document *Document) Put(request *rest.Request) rest.Result {
 	// Check params
 	familyID, familyIDExists := request.PathArgs["family_id"]
 	if !familyIDExists || familyID == "" {
-		return rest.Result{Code: 400, Message: "missing family ID"}
+		return rest.BadRequest("missing family ID")
 	}
 	shortname, shortnameExists := request.PathArgs["shortname"]
 	if !shortnameExists || shortname == "" {
-		return rest.Result{Code: 400, Message: "missing shortname"}
+		return rest.BadRequest("missing shortname")
+	}
+
+	locale := request.PathArgs["locale"]
+	if locale == "" {
+		locale = defaultLocale()
 	}
 
 	// Overwrite stuff
 	now := time.Now()
 	document.LastChange = &now
+	if document.Locale == "" {
+		document.Locale = defaultLocale()
+	}
 
 	// Validate
-	if document.FamilyID != familyID || document.Shortname != shortname {
-		return rest.Result{Code: 400, Message: "mismatch for family ID or shortname between URL and JSON"}
+	if document.FamilyID != familyID || document.Shortname != shortname || document.Locale != locale {
+		return rest.BadRequest("mismatch for family ID, shortname or locale between URL and JSON")
 	}
 	if result := document.validate(); !result.IsOk() {
 		return result
 	}
 
 	// Create or update
-	return document.createOrUpdate()
+	return document.createOrUpdate(request.Executor())
 }
 
 // Delete deletes a document.
@@ -349,72 +533,158 @@ func (document *Document) Delete(request *rest.Request) rest.Result {
 	// Check params
 	familyID, familyIDExists := request.PathArgs["family_id"]
 	if !familyIDExists || familyID == "" {
-		return rest.Result{Code: 400, Message: "missing family ID"}
+		return rest.BadRequest("missing family ID")
 	}
 	shortname, shortnameExists := request.PathArgs["shortname"]
 	if !shortnameExists || shortname == "" {
-		return rest.Result{Code: 400, Message: "missing shortname"}
+		return rest.BadRequest("missing shortname")
+	}
+
+	locale := request.PathArgs["locale"]
+	if locale == "" {
+		locale = defaultLocale()
 	}
 
 	// Check if it exists
 	document.FamilyID = familyID
 	document.Shortname = shortname
-	exists, err := document.exists()
+	document.Locale = locale
+	exists, err := document.exists(request.Executor())
 	if err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	}
 	if !exists {
-		return rest.Result{Code: 404, Message: "not found"}
+		return rest.NotFound("not found")
 	}
 
 	// Delete it
-	dbResult := db.Delete("documents", "family", "=", document.FamilyID, "shortname", "=", document.Shortname)
+	dbResult := db.Delete("documents", "family", "=", document.FamilyID, "shortname", "=", document.Shortname, "locale", "=", document.Locale)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
+	document.forgetRendering()
 	return rest.Result{}
 }
 
-func (document *Document) create() rest.Result {
-	if exists, err := document.exists(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+func (document *Document) create(executor db.Executor) rest.Result {
+	if exists, err := document.exists(executor); err != nil {
+		return rest.InternalError(err)
 	} else if exists {
-		return rest.Result{Code: 409, Message: "duplicate"}
+		return rest.Conflict("duplicate")
 	}
 
-	dbResult := db.Insert("documents", document)
+	if err := document.assignSequence(executor); err != nil {
+		return rest.InternalError(err)
+	}
+	dbResult := db.InsertWith(executor, "documents", document)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
 
 	return rest.Result{}
 }
 
-func (document *Document) createOrUpdate() rest.Result {
-	exists, existsErr := document.exists()
+func (document *Document) createOrUpdate(executor db.Executor) rest.Result {
+	exists, existsErr := document.exists(executor)
 	if existsErr != nil {
-		return rest.Result{Code: 500, Error: existsErr}
+		return rest.InternalError(existsErr)
 	}
 
 	if exists {
-		dbResult := db.Update("documents", document, "family", "=", document.FamilyID, "shortname", "=", document.Shortname)
+		if document.Sequence == nil {
+			// Keep the current position
+			var current Document
+			if currentResult := db.SelectWith(executor, &current, "documents", "family", "=", document.FamilyID, "shortname", "=", document.Shortname, "locale", "=", document.Locale); currentResult.IsFailed() {
+				return rest.InternalError(currentResult.Error)
+			}
+			document.Sequence = current.Sequence
+		}
+		dbResult := db.UpdateWith(executor, "documents", document, "family", "=", document.FamilyID, "shortname", "=", document.Shortname, "locale", "=", document.Locale)
 		if dbResult.IsFailed() {
-			return rest.Result{Code: 500, Error: dbResult.Error}
+			return rest.InternalError(dbResult.Error)
 		}
 		return rest.Result{}
 	}
 
-	dbResult := db.Insert("documents", document)
+	if err := document.assignSequence(executor); err != nil {
+		return rest.InternalError(err)
+	}
+	dbResult := db.InsertWith(executor, "documents", document)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+
+	return rest.Result{}
+}
+
+// assignSequence gives the document the sequence of its other locale variants, or puts it at the end of
+// its family, if it has no sequence.
+func (document *Document) assignSequence(executor db.Executor) error {
+	if document.Sequence != nil {
+		return nil
+	}
+	var sequence int
+	row := executor.QueryRow("SELECT COALESCE((SELECT MAX(sequence) FROM documents WHERE family = $1 AND shortname = $2), (SELECT MAX(sequence) FROM documents WHERE family = $1) + 1, 1)",
+		document.FamilyID, document.Shortname)
+	if err := row.Scan(&sequence); err != nil {
+		return err
+	}
+	document.Sequence = &sequence
+	return nil
+}
+
+// Post rewrites the sequences of the documents in the family to match the given order, in a single transaction.
+func (reorderRequest *DocumentReorderRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check that exactly all documents in the family are listed
+	var documents Documents
+	dbResult := db.SelectMany(&documents, "documents", "family", "=", reorderRequest.FamilyID)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
+	}
+	if len(documents) == 0 {
+		return rest.NotFound("family not found or has no documents")
+	}
+	remaining := make(map[string]bool)
+	for _, document := range documents {
+		remaining[document.Shortname] = true
+	}
+	total := len(remaining)
+	for _, shortname := range reorderRequest.Shortnames {
+		if !remaining[shortname] {
+			return rest.BadRequest(fmt.Sprintf("document %v is not in the family or listed multiple times", shortname))
+		}
+		delete(remaining, shortname)
+	}
+	if len(remaining) > 0 {
+		return rest.BadRequest(fmt.Sprintf("all %v documents in the family must be listed", total))
 	}
 
+	// Rewrite
+	tx, txErr := db.DB.Begin()
+	if txErr != nil {
+		return rest.InternalError(txErr)
+	}
+	defer tx.Rollback()
+	for i, shortname := range reorderRequest.Shortnames {
+		if _, err := tx.Exec("UPDATE documents SET sequence = $1 WHERE family = $2 AND shortname = $3", i+1, reorderRequest.FamilyID, shortname); err != nil {
+			return rest.InternalError(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return rest.InternalError(err)
+	}
+	db.NotifyWrite("documents")
 	return rest.Result{}
 }
 
-func (document *Document) exists() (bool, error) {
+func (document *Document) exists(executor db.Executor) (bool, error) {
 	var count int
-	row := db.DB.QueryRow("SELECT COUNT(*) FROM documents WHERE family = $1 AND shortname = $2", document.FamilyID, document.Shortname)
+	row := executor.QueryRow("SELECT COUNT(*) FROM documents WHERE family = $1 AND shortname = $2 AND locale = $3", document.FamilyID, document.Shortname, document.Locale)
 	rowErr := row.Scan(&count)
 	if rowErr != nil {
 		return false, rowErr
@@ -423,14 +693,48 @@ func (document *Document) exists() (bool, error) {
 }
 
 func (document *Document) validate() rest.Result {
+	if problems := rest.Validate(document); len(problems) > 0 {
+		return rest.ValidationFailedResult(problems)
+	}
+
 	switch {
-	case document.FamilyID == "":
-		return rest.Result{Code: 400, Message: "missing family ID"}
-	case document.Shortname == "":
-		return rest.Result{Code: 400, Message: "missing shortname"}
+	case document.Locale == "":
+		return rest.BadRequest("missing locale")
 	case document.LastChange == nil:
-		return rest.Result{Code: 400, Message: "missing last update time"}
+		return rest.BadRequest("missing last update time")
+	case document.PublishFrom != nil && document.PublishUntil != nil && !document.PublishUntil.After(*document.PublishFrom):
+		return rest.BadRequest("unpublished before it is published")
 	}
 
 	return rest.Result{}
 }
+
+// isPublished checks if the document is within its publishing window at the time.
+func (document *Document) isPublished(now time.Time) bool {
+	if document.PublishFrom != nil && now.Before(*document.PublishFrom) {
+		return false
+	}
+	if document.PublishUntil != nil && !now.Before(*document.PublishUntil) {
+		return false
+	}
+	return true
+}
+
+// isVisibleTo checks if the requester may see the document, i.e. it's published or the requester is an operator/admin.
+func (document *Document) isVisibleTo(request *rest.Request) bool {
+	if request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin {
+		return true
+	}
+	return document.isPublished(time.Now())
+}
+
+// visibleTo returns the documents the requester may see (see isVisibleTo).
+func (documents Documents) visibleTo(request *rest.Request) Documents {
+	visible := make(Documents, 0, len(documents))
+	for _, document := range documents {
+		if document.isVisibleTo(request) {
+			visible = append(visible, document)
+		}
+	}
+	return visible
+}
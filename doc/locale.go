@@ -0,0 +1,122 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package content
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+// defaultLocale gets the configured default locale for documents.
+func defaultLocale() string {
+	if config.Get().DefaultLocale == "" {
+		return "en"
+	}
+	return config.Get().DefaultLocale
+}
+
+// requestedLocales gets the locales requested through the "lang" query arg or the Accept-Language header, best first.
+// Region-specific locales are followed by their base language, e.g. "nb-NO" by "nb".
+func requestedLocales(request *rest.Request) []string {
+	type weightedLocale struct {
+		locale string
+		weight float64
+	}
+	var weightedLocales []weightedLocale
+	if lang, ok := request.QueryArgs["lang"]; ok && lang != "" {
+		weightedLocales = append(weightedLocales, weightedLocale{locale: lang, weight: 2})
+	}
+	for _, entry := range strings.Split(request.AcceptLanguage, ",") {
+		fields := strings.Split(entry, ";")
+		locale := strings.TrimSpace(fields[0])
+		if locale == "" || locale == "*" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					weight = q
+				}
+			}
+		}
+		if weight > 0 {
+			weightedLocales = append(weightedLocales, weightedLocale{locale: locale, weight: weight})
+		}
+	}
+	sort.SliceStable(weightedLocales, func(i, j int) bool {
+		return weightedLocales[i].weight > weightedLocales[j].weight
+	})
+
+	var locales []string
+	for _, weightedLocale := range weightedLocales {
+		locale := strings.ToLower(weightedLocale.locale)
+		locales = append(locales, locale)
+		if dash := strings.IndexByte(locale, '-'); dash > 0 {
+			locales = append(locales, locale[:dash])
+		}
+	}
+	return locales
+}
+
+// chooseDocumentVariant chooses the variant best matching the locales, falling back to the default locale and then any variant.
+// The variants must all be for the same document and sorted by locale. Returns nil if no variants.
+func chooseDocumentVariant(variants []*Document, locales []string) *Document {
+	for _, locale := range append(locales, defaultLocale()) {
+		for _, variant := range variants {
+			if strings.EqualFold(variant.Locale, locale) {
+				return variant
+			}
+		}
+	}
+	if len(variants) > 0 {
+		return variants[0]
+	}
+	return nil
+}
+
+// groupDocumentVariants groups the documents by family and shortname, keeping the order of first appearance.
+// Variants within each group are sorted by locale.
+func groupDocumentVariants(documents Documents) []Documents {
+	var groups []Documents
+	groupIndexes := make(map[string]int)
+	for _, document := range documents {
+		key := document.FamilyID + "/" + document.Shortname
+		index, ok := groupIndexes[key]
+		if !ok {
+			index = len(groups)
+			groupIndexes[key] = index
+			groups = append(groups, nil)
+		}
+		groups[index] = append(groups[index], document)
+	}
+	for _, group := range groups {
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Locale < group[j].Locale
+		})
+	}
+	return groups
+}
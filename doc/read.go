@@ -0,0 +1,130 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package content
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/worker"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const documentReadFlushInterval = 30 * time.Second // How often to save the batched reads
+
+// DocumentRead is when a user has fetched a document (any locale variant), for operators to see who has read e.g. the rules.
+type DocumentRead struct {
+	FamilyID      string     `column:"family" json:"family"`
+	Shortname     string     `column:"shortname" json:"shortname"`
+	UserID        *uuid.UUID `column:"user" json:"user"`
+	FirstReadTime *time.Time `column:"first_read_time" json:"first_read_time"`
+	LastReadTime  *time.Time `column:"last_read_time" json:"last_read_time"`
+	ReadCount     int        `column:"read_count" json:"read_count"`
+}
+
+// DocumentReads is a list of document reads.
+type DocumentReads []*DocumentRead
+
+type documentReadKey struct {
+	familyID  string
+	shortname string
+	userID    uuid.UUID
+}
+
+// Reads waiting to be saved, to avoid a DB write for every fetch.
+var pendingDocumentReads = make(map[documentReadKey]*DocumentRead)
+var pendingDocumentReadsMutex sync.Mutex
+
+func init() {
+	rest.AddHandler("/admin/", "^document-reads/$", func() interface{} { return &DocumentReads{} })
+	worker.AddTask("document-read-flush", documentReadFlushInterval, flushDocumentReads)
+}
+
+// Get gets document reads, most recently read first.
+func (reads *DocumentReads) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if familyID, ok := request.QueryArgs["family"]; ok {
+		whereArgs = append(whereArgs, "family", "=", familyID)
+	}
+	if shortname, ok := request.QueryArgs["shortname"]; ok {
+		whereArgs = append(whereArgs, "shortname", "=", shortname)
+	}
+	if userID, ok := request.QueryArgs["user"]; ok {
+		whereArgs = append(whereArgs, "\"user\"", "=", userID)
+	}
+
+	// Get, including the ones not saved yet
+	flushDocumentReads()
+	dbResult := db.SelectManyOrdered(reads, "document_reads", "last_read_time DESC", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// recordDocumentRead adds a read of the document by the requester (if a user) to the pending reads.
+// The reads are saved later by flushDocumentReads.
+func recordDocumentRead(document *Document, token rest.AccessTokenEntry) {
+	if token.OwnerUserID == nil {
+		return
+	}
+	now := time.Now()
+	key := documentReadKey{familyID: document.FamilyID, shortname: document.Shortname, userID: *token.OwnerUserID}
+	pendingDocumentReadsMutex.Lock()
+	defer pendingDocumentReadsMutex.Unlock()
+	read, ok := pendingDocumentReads[key]
+	if !ok {
+		userID := key.userID
+		read = &DocumentRead{FamilyID: key.familyID, Shortname: key.shortname, UserID: &userID, FirstReadTime: &now}
+		pendingDocumentReads[key] = read
+	}
+	read.LastReadTime = &now
+	read.ReadCount++
+}
+
+// flushDocumentReads saves all pending reads to the DB, keeping the first read time of earlier reads.
+func flushDocumentReads() {
+	pendingDocumentReadsMutex.Lock()
+	reads := pendingDocumentReads
+	pendingDocumentReads = make(map[documentReadKey]*DocumentRead)
+	pendingDocumentReadsMutex.Unlock()
+
+	for _, read := range reads {
+		_, err := db.DB.Exec("INSERT INTO document_reads (family, shortname, \"user\", first_read_time, last_read_time, read_count) VALUES ($1, $2, $3, $4, $5, $6) "+
+			"ON CONFLICT (family, shortname, \"user\") DO UPDATE SET last_read_time = EXCLUDED.last_read_time, read_count = document_reads.read_count + EXCLUDED.read_count",
+			read.FamilyID, read.Shortname, read.UserID, read.FirstReadTime, read.LastReadTime, read.ReadCount)
+		if err != nil {
+			log.WithError(err).WithField("document", read.FamilyID+"/"+read.Shortname).Warn("Failed to save document read")
+		}
+	}
+	if len(reads) > 0 {
+		db.NotifyWrite("document_reads")
+	}
+}
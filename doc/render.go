@@ -0,0 +1,102 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package content
+
+import (
+	"html"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/markdown"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+const renderFormatHTML = "html"
+
+// maxRenderCacheEntries limits the memory used by cached renderings.
+const maxRenderCacheEntries = 1000
+
+// renderedDocument is a cached rendering, valid as long as the document hasn't changed.
+type renderedDocument struct {
+	lastChange time.Time
+	html       string
+}
+
+var renderCache = make(map[string]renderedDocument)
+var renderCacheLock sync.Mutex
+
+// checkRenderFormat checks the render format requested in the query args, if any.
+func checkRenderFormat(request *rest.Request) (render bool, result rest.Result) {
+	format, formatExists := request.QueryArgs["render"]
+	if !formatExists {
+		return false, rest.Result{}
+	}
+	if format != renderFormatHTML {
+		return false, rest.BadRequest("unsupported render format")
+	}
+	return true, rest.Result{}
+}
+
+// render renders the content to HTML, reusing the cached rendering if the document hasn't changed since.
+func (document *Document) render() {
+	key := document.renderCacheKey()
+	var lastChange time.Time
+	if document.LastChange != nil {
+		lastChange = *document.LastChange
+	}
+
+	renderCacheLock.Lock()
+	cached, cachedExists := renderCache[key]
+	renderCacheLock.Unlock()
+	if cachedExists && cached.lastChange.Equal(lastChange) {
+		document.ContentHTML = &cached.html
+		return
+	}
+
+	var rendered string
+	switch document.ContentFormat {
+	case "markdown":
+		rendered = markdown.ToHTML(document.Content)
+	default:
+		rendered = "<p>" + strings.ReplaceAll(html.EscapeString(document.Content), "\n", "<br>\n") + "</p>\n"
+	}
+
+	renderCacheLock.Lock()
+	if _, exists := renderCache[key]; !exists && len(renderCache) >= maxRenderCacheEntries {
+		// Start over, the documents in use are soon rendered again
+		renderCache = make(map[string]renderedDocument)
+	}
+	renderCache[key] = renderedDocument{lastChange: lastChange, html: rendered}
+	renderCacheLock.Unlock()
+	document.ContentHTML = &rendered
+}
+
+// forgetRendering removes the cached rendering for the document.
+func (document *Document) forgetRendering() {
+	renderCacheLock.Lock()
+	delete(renderCache, document.renderCacheKey())
+	renderCacheLock.Unlock()
+}
+
+func (document *Document) renderCacheKey() string {
+	return document.FamilyID + "/" + document.Shortname + "/" + document.Locale
+}
@@ -0,0 +1,209 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package content
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+// errAttachmentContentNotFound is returned by storages if the content doesn't exist.
+var errAttachmentContentNotFound = errors.New("attachment content not found")
+
+// attachmentStorage stores attachment content by key.
+type attachmentStorage interface {
+	store(key string, content []byte, contentType string) error
+	load(key string) ([]byte, error)
+	remove(key string) error
+}
+
+// getAttachmentStorage gets the configured storage.
+func getAttachmentStorage() (attachmentStorage, error) {
+	switch config.Get().Attachments.Storage {
+	case "", "local":
+		path := config.Get().Attachments.LocalPath
+		if path == "" {
+			path = "attachments"
+		}
+		return &localAttachmentStorage{path: path}, nil
+	case "s3":
+		return &s3AttachmentStorage{config: config.Get().Attachments.S3}, nil
+	default:
+		return nil, fmt.Errorf("unknown attachment storage: %v", config.Get().Attachments.Storage)
+	}
+}
+
+// localAttachmentStorage stores attachments as files in a local directory.
+type localAttachmentStorage struct {
+	path string
+}
+
+func (storage *localAttachmentStorage) store(key string, content []byte, contentType string) error {
+	if err := os.MkdirAll(storage.path, 0750); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(storage.path, key), content, 0640)
+}
+
+func (storage *localAttachmentStorage) load(key string) ([]byte, error) {
+	content, err := os.ReadFile(filepath.Join(storage.path, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errAttachmentContentNotFound
+	}
+	return content, err
+}
+
+func (storage *localAttachmentStorage) remove(key string) error {
+	err := os.Remove(filepath.Join(storage.path, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// s3AttachmentStorage stores attachments as objects in an S3-compatible bucket, using signature V4 requests.
+type s3AttachmentStorage struct {
+	config config.S3Config
+}
+
+func (storage *s3AttachmentStorage) store(key string, content []byte, contentType string) error {
+	_, err := storage.do("PUT", key, content, contentType)
+	return err
+}
+
+func (storage *s3AttachmentStorage) load(key string) ([]byte, error) {
+	return storage.do("GET", key, nil, "")
+}
+
+func (storage *s3AttachmentStorage) remove(key string) error {
+	_, err := storage.do("DELETE", key, nil, "")
+	if errors.Is(err, errAttachmentContentNotFound) {
+		return nil
+	}
+	return err
+}
+
+// do sends a signed request for the object and returns the response body.
+func (storage *s3AttachmentStorage) do(method string, key string, content []byte, contentType string) ([]byte, error) {
+	objectURL, urlErr := url.Parse(storage.config.Endpoint)
+	if urlErr != nil {
+		return nil, urlErr
+	}
+	objectURL.Path = "/" + storage.config.Bucket + "/" + storage.config.PathPrefix + key
+
+	httpRequest, requestErr := http.NewRequest(method, objectURL.String(), bytes.NewReader(content))
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	if contentType != "" {
+		httpRequest.Header.Set("Content-Type", contentType)
+	}
+	storage.sign(httpRequest, content, time.Now().UTC())
+
+	httpResponse, responseErr := http.DefaultClient.Do(httpRequest)
+	if responseErr != nil {
+		return nil, responseErr
+	}
+	defer httpResponse.Body.Close()
+	body, readErr := io.ReadAll(httpResponse.Body)
+	if readErr != nil {
+		return nil, readErr
+	}
+	if httpResponse.StatusCode == 404 {
+		return nil, errAttachmentContentNotFound
+	}
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		return nil, fmt.Errorf("S3 request failed with status %v: %s", httpResponse.StatusCode, body)
+	}
+	return body, nil
+}
+
+// sign adds AWS signature V4 headers to the request.
+func (storage *s3AttachmentStorage) sign(httpRequest *http.Request, content []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(content)
+	httpRequest.Header.Set("X-Amz-Date", amzDate)
+	httpRequest.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + httpRequest.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		httpRequest.Method,
+		httpRequest.URL.EscapedPath(),
+		httpRequest.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + storage.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signingKey := hmacSHA256([]byte("AWS4"+storage.config.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, storage.config.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	httpRequest.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		storage.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// ObjectStorage stores objects in an S3-compatible bucket, for other packages than attachments (e.g. exports).
+type ObjectStorage struct {
+	storage s3AttachmentStorage
+}
+
+// NewObjectStorage creates an object storage for the bucket.
+func NewObjectStorage(s3Config config.S3Config) *ObjectStorage {
+	return &ObjectStorage{storage: s3AttachmentStorage{config: s3Config}}
+}
+
+// Store creates or replaces the object.
+func (storage *ObjectStorage) Store(key string, content []byte, contentType string) error {
+	return storage.storage.store(key, content, contentType)
+}
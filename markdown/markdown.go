@@ -0,0 +1,177 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package markdown renders markdown to sanitized HTML.
+//
+// Markdown is rendered with goldmark (CommonMark, plus GFM tables and
+// strikethrough), with raw HTML omitted. The result is then sanitized with an
+// allowlist of elements and attributes, where only safe link schemes are kept,
+// so the output may be embedded directly in pages.
+package markdown
+
+import (
+	"bytes"
+	"html"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	htmlparser "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var renderer = goldmark.New(goldmark.WithExtensions(
+	extension.NewTable(extension.WithTableCellAlignMethod(extension.TableCellAlignAttribute)),
+	extension.Strikethrough,
+))
+
+// allowedElements are the elements kept by the sanitizer, with their allowed attributes.
+// Other elements are replaced by their content, except for droppedElements.
+var allowedElements = map[string][]string{
+	"p": nil, "br": nil, "hr": nil, "blockquote": nil, "pre": nil, "code": nil,
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"ul": nil, "ol": {"start"}, "li": nil,
+	"em": nil, "strong": nil, "del": nil,
+	"a": {"href", "title"}, "img": {"src", "alt", "title"},
+	"table": nil, "thead": nil, "tbody": nil, "tr": nil, "th": {"align"}, "td": {"align"},
+}
+
+// droppedElements are removed with their content.
+var droppedElements = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true, "embed": true, "template": true, "noscript": true,
+}
+
+// voidElements have no end tag.
+var voidElements = map[string]bool{"br": true, "hr": true, "img": true}
+
+// ToHTML renders markdown source to sanitized HTML.
+func ToHTML(source string) string {
+	var rendered bytes.Buffer
+	if err := renderer.Convert([]byte(source), &rendered); err != nil {
+		// Rendering only fails on writer errors, which a buffer doesn't have, but never show unsanitized content
+		return "<p>" + html.EscapeString(source) + "</p>\n"
+	}
+	return Sanitize(rendered.String())
+}
+
+// Sanitize removes everything but the allowed elements, attributes and link schemes from an HTML fragment.
+func Sanitize(fragment string) string {
+	nodes, err := htmlparser.ParseFragment(strings.NewReader(fragment), &htmlparser.Node{Type: htmlparser.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		return html.EscapeString(fragment)
+	}
+	var builder strings.Builder
+	for _, node := range nodes {
+		writeSanitized(&builder, node)
+	}
+	return builder.String()
+}
+
+func writeSanitized(builder *strings.Builder, node *htmlparser.Node) {
+	switch node.Type {
+	case htmlparser.TextNode:
+		builder.WriteString(html.EscapeString(node.Data))
+		return
+	case htmlparser.ElementNode:
+	default:
+		// Comments, doctypes etc.
+		return
+	}
+
+	if droppedElements[node.Data] {
+		return
+	}
+	allowedAttributes, allowed := allowedElements[node.Data]
+	attributes := sanitizeAttributes(node, allowedAttributes)
+
+	// Links and images need a safe URL, else only the text is kept
+	switch node.Data {
+	case "a":
+		if _, ok := attributes["href"]; !ok {
+			allowed = false
+		}
+	case "img":
+		if _, ok := attributes["src"]; !ok {
+			builder.WriteString(html.EscapeString(attributes["alt"]))
+			return
+		}
+	}
+
+	if allowed {
+		builder.WriteString("<" + node.Data)
+		for _, name := range allowedAttributes {
+			if value, ok := attributes[name]; ok {
+				builder.WriteString(" " + name + "=\"" + html.EscapeString(value) + "\"")
+			}
+		}
+		builder.WriteString(">")
+		if voidElements[node.Data] {
+			return
+		}
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		writeSanitized(builder, child)
+	}
+	if allowed {
+		builder.WriteString("</" + node.Data + ">")
+	}
+}
+
+// sanitizeAttributes gets the allowed attributes of the node, leaving out unsafe URLs.
+func sanitizeAttributes(node *htmlparser.Node, allowedAttributes []string) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range node.Attr {
+		if attribute.Namespace != "" {
+			continue
+		}
+		for _, name := range allowedAttributes {
+			if attribute.Key != name {
+				continue
+			}
+			if (name == "href" || name == "src") && !isSafeURL(attribute.Val) {
+				continue
+			}
+			attributes[name] = attribute.Val
+		}
+	}
+	return attributes
+}
+
+// isSafeURL checks if the URL is relative or has a safe scheme.
+// Whitespace and control characters are ignored, like browsers do.
+func isSafeURL(rawURL string) bool {
+	cleaned := strings.Map(func(char rune) rune {
+		if char <= ' ' {
+			return -1
+		}
+		return char
+	}, rawURL)
+	if cleaned == "" {
+		return false
+	}
+	if colon := strings.IndexByte(cleaned, ':'); colon >= 0 && !strings.ContainsAny(cleaned[:colon], "/?#") {
+		switch strings.ToLower(cleaned[:colon]) {
+		case "http", "https", "mailto":
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package markdown_test
+
+import (
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/gathering/tech-online-backend/markdown"
+)
+
+func TestToHTML(t *testing.T) {
+	cases := []struct {
+		source   string
+		expected string
+	}{
+		{"# Title", "<h1>Title</h1>\n"},
+		{"Some *emphasis* and **strong** text.", "<p>Some <em>emphasis</em> and <strong>strong</strong> text.</p>\n"},
+		{"snake_case_name", "<p>snake_case_name</p>\n"},
+		{"- one\n- two", "<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n"},
+		{"1. one\n2. two", "<ol>\n<li>one</li>\n<li>two</li>\n</ol>\n"},
+		{"```\n<b>code</b>\n```", "<pre><code>&lt;b&gt;code&lt;/b&gt;\n</code></pre>\n"},
+		{"Use `ping`.", "<p>Use <code>ping</code>.</p>\n"},
+		{"> quoted", "<blockquote>\n<p>quoted</p>\n</blockquote>\n"},
+		{"[site](https://example.com/)", "<p><a href=\"https://example.com/\">site</a></p>\n"},
+		{"![topology](/api/attachment/1/)", "<p><img src=\"/api/attachment/1/\" alt=\"topology\"></p>\n"},
+		{"| a | b |\n|---|--:|\n| 1 | 2 |", "<table>\n<thead>\n<tr>\n<th>a</th>\n<th align=\"right\">b</th>\n</tr>\n</thead>\n<tbody>\n<tr>\n<td>1</td>\n<td align=\"right\">2</td>\n</tr>\n</tbody>\n</table>\n"},
+	}
+	for _, c := range cases {
+		helper.CheckEqual(t, markdown.ToHTML(c.source), c.expected)
+	}
+}
+
+func TestToHTMLSanitizes(t *testing.T) {
+	cases := []struct {
+		source   string
+		expected string
+	}{
+		{"<script>alert(1)</script>", "\n"},
+		{"Raw <b onclick=\"alert(1)\">HTML</b>", "<p>Raw HTML</p>\n"},
+		{"[click](javascript:alert(1))", "<p>click</p>\n"},
+		{"[click](JavaScript:alert)", "<p>click</p>\n"},
+		{"![x](data:text/html,hi)", "<p>x</p>\n"},
+		{"[q](https://example.com/?a=\"b\")", "<p><a href=\"https://example.com/?a=%22b%22\">q</a></p>\n"},
+	}
+	for _, c := range cases {
+		helper.CheckEqual(t, markdown.ToHTML(c.source), c.expected)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	cases := []struct {
+		source   string
+		expected string
+	}{
+		{"<a href=\"java\tscript:alert(1)\">x</a>", "x"},
+		{"<img src=\"x.png\" onerror=\"alert(1)\">", "<img src=\"x.png\">"},
+		{"<p style=\"color: red\">a<style>p {}</style><iframe src=\"https://example.com/\"></iframe></p>", "<p>a</p>"},
+		{"<div><span>text</span> &amp; more</div>", "text &amp; more"},
+		{"<a href=\"mailto:a@example.com\" target=\"_blank\">mail</a>", "<a href=\"mailto:a@example.com\">mail</a>"},
+	}
+	for _, c := range cases {
+		helper.CheckEqual(t, markdown.Sanitize(c.source), c.expected)
+	}
+}
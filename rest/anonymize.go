@@ -0,0 +1,109 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+// guestHiddenFields are JSON fields which are removed (at any depth) from responses to guests,
+// so user IDs, tokens, credentials and notes never leak to unauthenticated clients, regardless of the handler.
+var guestHiddenFields = map[string]bool{
+	"user":            true,
+	"users":           true,
+	"owner_user":      true,
+	"author_user":     true,
+	"author_token":    true,
+	"token":           true,
+	"key":             true,
+	"secret":          true,
+	"username":        true,
+	"password":        true,
+	"credentials":     true,
+	"orc_vm_username": true,
+	"orc_vm_password": true,
+	"notes":           true,
+	"email":           true,
+	"email_address":   true,
+	"client":          true,
+}
+
+// IsPublicMode checks if guests may read aggregated data (e.g. stats) for the public event site, in addition to
+// what's always public. Guest responses are anonymized either way.
+func IsPublicMode() bool {
+	return config.Get().PublicMode
+}
+
+// anonymizeGuestOutput anonymizes the data of GET and HEAD responses, for guests.
+// Fails closed with a 500 if the data can't be anonymized. CSV exports (which contain the raw columns) are refused.
+func anonymizeGuestOutput(input input, output output) output {
+	if output.data == nil || (input.method != "GET" && input.method != "HEAD") {
+		return output
+	}
+	if _, csv := output.data.(csvResponse); csv {
+		return processOutput(input, Result{Code: 401, Message: "CSV export requires authentication"}, nil)
+	}
+	if _, raw := output.data.(RawResponder); raw {
+		return output
+	}
+	data, err := anonymizeForGuest(output.data)
+	if err != nil {
+		return processOutput(input, InternalError(err), nil)
+	}
+	output.data = data
+	return output
+}
+
+// anonymizeForGuest removes the hidden fields from the data, at any depth.
+func anonymizeForGuest(data interface{}) (interface{}, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(body)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	removeGuestHiddenFields(generic)
+	return generic, nil
+}
+
+func removeGuestHiddenFields(value interface{}) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, element := range typed {
+			if guestHiddenFields[key] {
+				delete(typed, key)
+				continue
+			}
+			removeGuestHiddenFields(element)
+		}
+	case []interface{}:
+		for _, element := range typed {
+			removeGuestHiddenFields(element)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gathering/tech-online-backend/db"
+)
+
+// maxBatchOperations is the maximum number of operations in a batch.
+const maxBatchOperations = 200
+
+// Batch is a list of operations handled in order, like separate requests with the same access token.
+// The request fields are posted and the same object is returned with the outcomes.
+// A bare list of operations may also be posted, for a batch without a transaction.
+type Batch struct {
+	Operations  []*BatchOperation `json:"operations"`  // Required
+	Transaction bool              `json:"transaction"` // Handle all operations in a single transaction, stopping at the first failure
+	RolledBack  bool              `json:"rolled_back"` // Output, if an operation in the transaction failed
+}
+
+// BatchOperation is a single request in a batch, with its outcome.
+type BatchOperation struct {
+	Method   string          `json:"method"` // Required, GET, POST, PUT or DELETE
+	Path     string          `json:"path"`   // Required, below the API root, e.g. "/task/<id>/", with an optional query
+	Body     json.RawMessage `json:"body,omitempty"`
+	Status   int             `json:"status"`             // Output, HTTP status, 0 if not handled
+	Location string          `json:"location,omitempty"` // Output, for created entities
+	Response json.RawMessage `json:"response,omitempty"` // Output, the response body
+}
+
+func init() {
+	AddHandler("/batch/", "^$", func() interface{} { return &Batch{} })
+}
+
+// UnmarshalJSON accepts both the full batch object and a bare list of operations.
+func (batch *Batch) UnmarshalJSON(data []byte) error {
+	var operations []*BatchOperation
+	if err := json.Unmarshal(data, &operations); err == nil {
+		batch.Operations = operations
+		return nil
+	}
+	type plainBatch Batch
+	return json.Unmarshal(data, (*plainBatch)(batch))
+}
+
+// Post handles the operations in order.
+func (batch *Batch) Post(request *Request) Result {
+	// Check params
+	if len(batch.Operations) == 0 {
+		return BadRequest("no operations")
+	}
+	if len(batch.Operations) > maxBatchOperations {
+		return BadRequest(fmt.Sprintf("too many operations, the limit is %v", maxBatchOperations))
+	}
+	for _, operation := range batch.Operations {
+		if operation == nil || operation.Path == "" {
+			return BadRequest("operations require a path")
+		}
+		operation.Method = strings.ToUpper(operation.Method)
+		switch operation.Method {
+		case "GET", "POST", "PUT", "DELETE":
+		default:
+			return BadRequest(fmt.Sprintf("unsupported method for operation: %v", operation.Method))
+		}
+	}
+
+	// Handle them, optionally in a transaction
+	if batch.Transaction {
+		tx, txErr := db.DB.Begin()
+		if txErr != nil {
+			return InternalError(txErr)
+		}
+		defer tx.Rollback()
+		for i, operation := range batch.Operations {
+			if !batch.handleOperation(request, i, operation, tx) {
+				batch.RolledBack = true
+				return Result{}
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return InternalError(err)
+		}
+		return Result{}
+	}
+	for i, operation := range batch.Operations {
+		batch.handleOperation(request, i, operation, nil)
+	}
+	return Result{}
+}
+
+// handleOperation handles the operation like a separate request, returning false if it failed.
+func (batch *Batch) handleOperation(request *Request, index int, operation *BatchOperation, tx *sql.Tx) bool {
+	operationInput, operationReceiver, result := batchOperationInput(request, index, operation, tx)
+	if result.IsOk() {
+		var data interface{}
+		result, data = handleRequest(operationReceiver, operationInput, request.AccessToken)
+		output := processOutput(operationInput, result, data)
+		if !request.AccessToken.IsAuthenticated() {
+			output = anonymizeGuestOutput(operationInput, output)
+		}
+		return batch.setOutcome(operation, output)
+	}
+	return batch.setOutcome(operation, processOutput(operationInput, result, nil))
+}
+
+// setOutcome sets the output of the operation, returning false if it failed.
+func (batch *Batch) setOutcome(operation *BatchOperation, output output) bool {
+	operation.Status = output.code
+	operation.Location = output.location
+	if output.data != nil {
+		response, err := json.Marshal(output.data)
+		if err != nil {
+			operation.Status = 500
+			response, _ = json.Marshal(message("internal server error"))
+		}
+		operation.Response = response
+	}
+	return operation.Status < 400
+}
+
+// batchOperationInput prepares the input for the operation and finds its receiver.
+func batchOperationInput(request *Request, index int, operation *BatchOperation, tx *sql.Tx) (input, *receiver, Result) {
+	var operationInput input
+	operationInput.requestID = request.ID
+	operationInput.log = request.Log.WithField("batch_operation", index)
+	operationInput.method = operation.Method
+	operationInput.data = operation.Body
+	operationInput.contentType = "application/json"
+	operationInput.acceptLanguage = request.AcceptLanguage
+	operationInput.eventID = request.EventID
+	operationInput.apiVersion = request.APIVersion
+	operationInput.tx = tx
+	operationInput.httpRequest = request.HTTPRequest
+	operationInput.clientIP = request.ClientIP
+	operationInput.query = make(map[string][]string)
+
+	// Split the path into the API version, handler prefix and the rest, like the mux and receiver set would
+	operationURL, urlErr := url.Parse(operation.Path)
+	if urlErr != nil || !strings.HasPrefix(operationURL.Path, "/") {
+		return operationInput, nil, BadRequest("invalid path")
+	}
+	operationInput.url = operationURL
+	operationInput.query = operationURL.Query()
+	path := operationURL.Path
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	if parts := strings.SplitN(path[1:], "/", 2); len(parts) == 2 && apiVersionPattern.MatchString(parts[0]) {
+		operationInput.apiVersion = parts[0]
+		path = "/" + parts[1]
+	}
+	var set *receiverSet
+	for pathPrefix, candidate := range receiverSets {
+		if strings.HasPrefix(path, pathPrefix) && (set == nil || len(pathPrefix) > len(set.pathPrefix)) {
+			set = candidate
+		}
+	}
+	if set == nil || set.pathPrefix == "/batch/" {
+		return operationInput, nil, NotFound("endpoint not found")
+	}
+	operationInput.pathPrefix = set.pathPrefix
+	operationInput.pathSuffix = path[len(set.pathPrefix):]
+
+	// Find the receiver, which must handle plain JSON requests (and writes in the transaction)
+	versionedSet := *set
+	versionedSet.version = operationInput.apiVersion
+	operationReceiver := versionedSet.findReceiver(operationInput)
+	if operationReceiver == nil {
+		return operationInput, nil, NotFound("endpoint not found")
+	}
+	item := operationReceiver.allocator()
+	if operationReceiver.streamsInput(operation.Method) {
+		return operationInput, nil, BadRequest("streaming endpoints are not supported in batches")
+	}
+	if _, ok := item.(Upgrader); ok && operation.Method == "GET" {
+		return operationInput, nil, BadRequest("upgrading endpoints are not supported in batches")
+	}
+	if tx != nil && operation.Method != "GET" {
+		if transactor, ok := item.(Transactor); !ok || !transactor.Transactional() {
+			return operationInput, nil, BadRequest("endpoint does not support transactions")
+		}
+	}
+	return operationInput, operationReceiver, Result{}
+}
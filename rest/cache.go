@@ -0,0 +1,119 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+)
+
+// maxResponseCacheEntries limits the entries per cache, mostly in case of many distinct users or query params.
+const maxResponseCacheEntries = 1000
+
+// CachePolicy describes how GET responses for a handler may be cached.
+type CachePolicy struct {
+	TTL    time.Duration // How long responses may be reused
+	Tables []string      // Tables the responses depend on, writes to any of them (through the db package) clear the cache
+}
+
+// responseCache is an in-memory cache of successful GET outputs for a receiver.
+// Outputs are cached per URL, access token and Accept-Language, since responses may depend on them.
+type responseCache struct {
+	ttl     time.Duration
+	mutex   sync.Mutex
+	entries map[string]responseCacheEntry
+}
+
+type responseCacheEntry struct {
+	output         output
+	expirationTime time.Time
+}
+
+// Caches to clear on writes, by table
+var responseCachesByTable = make(map[string][]*responseCache)
+
+func init() {
+	db.AddWriteListener(clearResponseCaches)
+}
+
+// AddCachedHandler is like AddHandler, but caches successful GET (and HEAD)
+// responses for the handler according to the policy.
+func AddCachedHandler(pathPrefix string, pathPattern string, policy CachePolicy, allocator Allocator) error {
+	cache := &responseCache{ttl: policy.TTL, entries: make(map[string]responseCacheEntry)}
+	if err := addReceiver("", pathPrefix, pathPattern, allocator, cache, false); err != nil {
+		return err
+	}
+	for _, table := range policy.Tables {
+		responseCachesByTable[table] = append(responseCachesByTable[table], cache)
+	}
+	return nil
+}
+
+// clearResponseCaches clears all caches depending on the table.
+func clearResponseCaches(table string) {
+	for _, cache := range responseCachesByTable[table] {
+		cache.mutex.Lock()
+		cache.entries = make(map[string]responseCacheEntry)
+		cache.mutex.Unlock()
+	}
+}
+
+func responseCacheKey(input input, token AccessTokenEntry) string {
+	return input.url.String() + "|" + input.eventID + "|" + token.ID.String() + "|" + input.acceptLanguage + "|" + input.accept
+}
+
+// get returns the cached output for the request, if any.
+func (cache *responseCache) get(input input, token AccessTokenEntry) (output, bool) {
+	if cache == nil || config.Get().ResponseCacheDisabled || (input.method != "GET" && input.method != "HEAD") {
+		return output{}, false
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, ok := cache.entries[responseCacheKey(input, token)]
+	if !ok || time.Now().After(entry.expirationTime) {
+		return output{}, false
+	}
+	return entry.output, true
+}
+
+// put caches the output for the request, if it's a successful GET.
+func (cache *responseCache) put(input input, token AccessTokenEntry, output output) {
+	if cache == nil || config.Get().ResponseCacheDisabled || (input.method != "GET" && input.method != "HEAD") || output.code != 200 {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := time.Now()
+	if len(cache.entries) >= maxResponseCacheEntries {
+		for key, entry := range cache.entries {
+			if now.After(entry.expirationTime) {
+				delete(cache.entries, key)
+			}
+		}
+		if len(cache.entries) >= maxResponseCacheEntries {
+			cache.entries = make(map[string]responseCacheEntry)
+		}
+	}
+	cache.entries[responseCacheKey(input, token)] = responseCacheEntry{output: output, expirationTime: now.Add(cache.ttl)}
+}
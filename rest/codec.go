@@ -0,0 +1,228 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// Codec converts request and response bodies between JSON and another format, so handlers only deal
+// with JSON. Codecs are chosen by the Content-Type of requests and the Accept header (or "?format=<name>")
+// of responses.
+type Codec interface {
+	// ToJSON converts a request body to JSON.
+	ToJSON(data []byte) ([]byte, error)
+	// FromJSON converts a JSON response body.
+	FromJSON(data []byte) ([]byte, error)
+}
+
+type codecEntry struct {
+	name       string
+	mediaTypes []string // The first is used for responses
+	codec      Codec
+}
+
+// codecs are the non-JSON codecs
+var codecs []codecEntry
+
+func init() {
+	AddCodec("yaml", []string{"application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml"}, yamlCodec{})
+	AddCodec("msgpack", []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"}, messagePackCodec{})
+}
+
+// AddCodec registers a codec for the media types, with a short name for "?format=<name>".
+// The first media type is used for responses.
+func AddCodec(name string, mediaTypes []string, codec Codec) {
+	codecs = append(codecs, codecEntry{name: name, mediaTypes: mediaTypes, codec: codec})
+}
+
+// requestCodec finds the codec for the content type, or nil for JSON and unknown types.
+func requestCodec(contentType string) Codec {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range codecs {
+		for _, codecMediaType := range entry.mediaTypes {
+			if mediaType == codecMediaType {
+				return entry.codec
+			}
+		}
+	}
+	return nil
+}
+
+// responseCodec finds the codec the client asked for and its media type, or nil for JSON.
+func responseCodec(input input) (Codec, string) {
+	if values, ok := input.query["format"]; ok && len(values) > 0 {
+		for _, entry := range codecs {
+			if values[0] == entry.name {
+				return entry.codec, entry.mediaTypes[0]
+			}
+		}
+		return nil, ""
+	}
+	for _, entry := range codecs {
+		for _, mediaType := range entry.mediaTypes {
+			if strings.Contains(input.accept, mediaType) {
+				return entry.codec, entry.mediaTypes[0]
+			}
+		}
+	}
+	return nil, ""
+}
+
+// IsMessagePack checks if the content type is MessagePack, e.g. for stream handlers.
+func IsMessagePack(contentType string) bool {
+	_, ok := requestCodec(contentType).(messagePackCodec)
+	return ok
+}
+
+// decodeInputData converts the request body to JSON, if sent in another format.
+func decodeInputData(input *input) error {
+	if len(input.data) == 0 {
+		return nil
+	}
+	codec := requestCodec(input.contentType)
+	if codec == nil {
+		return nil
+	}
+	data, err := codec.ToJSON(input.data)
+	if err != nil {
+		return err
+	}
+	input.data = data
+	return nil
+}
+
+// jsonObject is a JSON object with the member order kept, for converting between formats.
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	key   string
+	value interface{}
+}
+
+// parseJSONTree parses JSON into nil, bool, json.Number, string, []interface{} and jsonObject values.
+func parseJSONTree(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	value, err := parseJSONValue(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("trailing data after JSON value")
+	}
+	return value, nil
+}
+
+func parseJSONValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, isDelim := token.(json.Delim)
+	if !isDelim {
+		return token, nil
+	}
+	switch delim {
+	case '[':
+		array := make([]interface{}, 0)
+		for decoder.More() {
+			value, err := parseJSONValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err := decoder.Token()
+		return array, err
+	case '{':
+		object := make(jsonObject, 0)
+		for decoder.More() {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := parseJSONValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, jsonMember{key: keyToken.(string), value: value})
+		}
+		_, err := decoder.Token()
+		return object, err
+	}
+	return nil, fmt.Errorf("unexpected JSON delimiter: %v", delim)
+}
+
+// writeJSONTree writes a value from parseJSONTree (or another decoder using the same types) as JSON.
+func writeJSONTree(buffer *bytes.Buffer, value interface{}) error {
+	switch typed := value.(type) {
+	case []interface{}:
+		buffer.WriteByte('[')
+		for i, element := range typed {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			if err := writeJSONTree(buffer, element); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte(']')
+	case jsonObject:
+		buffer.WriteByte('{')
+		for i, member := range typed {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			key, _ := json.Marshal(member.key)
+			buffer.Write(key)
+			buffer.WriteByte(':')
+			if err := writeJSONTree(buffer, member.value); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte('}')
+	default:
+		encoded, err := json.Marshal(typed)
+		if err != nil {
+			return err
+		}
+		buffer.Write(encoded)
+	}
+	return nil
+}
+
+// treeToJSON converts a value tree to JSON.
+func treeToJSON(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := writeJSONTree(&buffer, value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,154 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestYAMLToJSON(t *testing.T) {
+	cases := []struct {
+		source   string
+		expected string
+	}{
+		{"a: 1\nb: text # comment\nc: 'it''s'\nd: \"tab\\there\"", `{"a":1,"b":"text","c":"it's","d":"tab\there"}`},
+		{"---\nlist:\n- one\n- two: 2\n  three: 3\nempty:\n", `{"list":["one",{"two":2,"three":3}],"empty":null}`},
+		{"- - a\n  - b\n-   [x, {y: true}]", `[["a","b"],["x",{"y":true}]]`},
+		{"text: |\n  line 1\n\n  line 2\nfolded: >-\n  one\n  two\n\n  three\n", `{"text":"line 1\n\nline 2\n","folded":"one two\nthree"}`},
+		{"keep: |+\n  x\n\nnext: ~", `{"keep":"x\n\n","next":null}`},
+		{"version: 1.10\nid: \"1.10\"\nurl: http://example.com/#x", `{"version":1.1,"id":"1.10","url":"http://example.com/#x"}`},
+		{"a: [1,\n  2]\nhex: 0x1f\ndate: 2022-04-01\nbig: 18446744073709551615", `{"a":[1,2],"hex":31,"date":"2022-04-01","big":18446744073709551615}`},
+		{"", `null`},
+	}
+	for _, c := range cases {
+		json, err := yamlCodec{}.ToJSON([]byte(c.source))
+		helper.CheckEqual(t, err, nil)
+		helper.CheckEqual(t, string(json), c.expected)
+	}
+}
+
+func TestYAMLRejectsUnsupported(t *testing.T) {
+	for _, source := range []string{"a: &x 1\nb: *x", "a: 1\n---\nb: 2", "a:\n\tb: 1", "a: 1\na: 2", "a:\n    b: 1\n  c: 2", "<<: {a: 1}", "a: !foo x", "a: .nan", "? [a]\n: 1"} {
+		_, err := yamlCodec{}.ToJSON([]byte(source))
+		helper.CheckNotEqual(t, err, nil)
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	source := `{"name":"Net","tags":["a b","true","- x",""],"nested":{"empty":{},"list":[],"n":-0.25,"big":18446744073709551615},"text":"line 1\nline 2\n","quoted":"a: b # c","nil":null}`
+	for _, codec := range []Codec{yamlCodec{}, messagePackCodec{}} {
+		encoded, err := codec.FromJSON([]byte(source))
+		helper.CheckEqual(t, err, nil)
+		decoded, err := codec.ToJSON(encoded)
+		helper.CheckEqual(t, err, nil)
+		helper.CheckEqual(t, string(decoded), source)
+	}
+}
+
+func TestMessagePackDecoder(t *testing.T) {
+	// Two concatenated values: {"a":[1,-1,"x"]} and a 4-byte timestamp extension
+	stream := []byte{0x81, 0xa1, 'a', 0x93, 0x01, 0xff, 0xa1, 'x', 0xd6, 0xff, 0x00, 0x00, 0x00, 0x01}
+	decoder := NewMessagePackDecoder(bytes.NewReader(stream), 16)
+	first, err := decoder.NextJSON()
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, string(first), `{"a":[1,-1,"x"]}`)
+	second, err := decoder.NextJSON()
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, string(second), `"1970-01-01T00:00:01Z"`)
+	_, err = decoder.NextJSON()
+	helper.CheckEqual(t, err, io.EOF)
+}
+
+func TestMessagePackRejectsInvalid(t *testing.T) {
+	cases := [][]byte{
+		{},                                   // Empty
+		{0x01, 0x02},                         // Trailing data
+		{0x92, 0x01},                         // Truncated
+		{0xc1},                               // Never used type
+		{0x81, 0x01, 0x01},                   // Non-string key
+		{0xa1, 0xff},                         // Invalid UTF-8
+		{0xd4, 0x01, 0x00},                   // Unsupported extension
+		{0xcb, 0x7f, 0xf0, 0, 0, 0, 0, 0, 0}, // Infinity
+		{0xdb, 0xff, 0xff, 0xff, 0xff},       // Length beyond the body
+		bytes.Repeat([]byte{0x91}, messagePackMaxDepth+2),
+	}
+	for _, data := range cases {
+		_, err := messagePackCodec{}.ToJSON(data)
+		helper.CheckNotEqual(t, err, nil)
+	}
+
+	// Each value in a stream is limited on its own
+	decoder := NewMessagePackDecoder(bytes.NewReader([]byte{0xa3, 'a', 'b', 'c', 0xa4, 'a', 'b', 'c', 'd'}), 4)
+	_, err := decoder.Next()
+	helper.CheckEqual(t, err, nil)
+	_, err = decoder.Next()
+	helper.CheckNotEqual(t, err, nil)
+}
+
+// checkCodecFuzzOutput checks that whatever the codec accepts converts to valid JSON with the same value after a round trip.
+func checkCodecFuzzOutput(t *testing.T, codec Codec, data []byte) {
+	converted, err := codec.ToJSON(data)
+	if err != nil {
+		return
+	}
+	if !json.Valid(converted) {
+		t.Fatalf("invalid JSON %q from %q", converted, data)
+	}
+	encoded, err := codec.FromJSON(converted)
+	if err != nil {
+		t.Fatalf("failed to encode %q: %v", converted, err)
+	}
+	decoded, err := codec.ToJSON(encoded)
+	if err != nil {
+		t.Fatalf("failed to decode %q: %v", encoded, err)
+	}
+	// Compare the values, as e.g. "-0" may become "0"
+	var convertedValue, decodedValue interface{}
+	json.Unmarshal(converted, &convertedValue)
+	json.Unmarshal(decoded, &decodedValue)
+	if !reflect.DeepEqual(decodedValue, convertedValue) {
+		t.Fatalf("round trip changed %q to %q", converted, decoded)
+	}
+}
+
+func FuzzYAMLToJSON(f *testing.F) {
+	for _, seed := range []string{"a: 1\nb: [x, {y: true}]", "- |\n  text\n- 1.5e3", "a: &x 1\nb: *x", "{a: [1,\n  2]}"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkCodecFuzzOutput(t, yamlCodec{}, data)
+	})
+}
+
+func FuzzMessagePackToJSON(f *testing.F) {
+	f.Add([]byte{0x81, 0xa1, 'a', 0x93, 0x01, 0xff, 0xa1, 'x'})
+	f.Add([]byte{0xd6, 0xff, 0x00, 0x00, 0x00, 0x01})
+	f.Add([]byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkCodecFuzzOutput(t, messagePackCodec{}, data)
+	})
+}
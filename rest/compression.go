@@ -0,0 +1,116 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+const defaultCompressionMinSizeBytes = 1024
+
+var defaultCompressionContentTypes = []string{"application/json", "text/*"}
+
+// compressResponseBody gzips the response body if the client accepts it and it's large and compressible enough.
+// It sets the relevant headers and returns the body to send.
+// Brotli is not supported, since it would require a new dependency.
+func compressResponseBody(w http.ResponseWriter, acceptEncoding string, body []byte) []byte {
+	compressionConfig := config.Get().Compression
+	if compressionConfig.Disabled || !compressibleContentType(w.Header().Get("Content-Type")) {
+		return body
+	}
+
+	// The response depends on the accepted encodings, so caches must keep them apart
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	minSize := compressionConfig.MinSizeBytes
+	if minSize == 0 {
+		minSize = defaultCompressionMinSizeBytes
+	}
+	if len(body) < minSize || !acceptsEncoding(acceptEncoding, "gzip") {
+		return body
+	}
+
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	if _, err := gzipWriter.Write(body); err != nil {
+		return body
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return body
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	// The representation changed, so the ETag must too
+	if etag := w.Header().Get("ETag"); etag != "" {
+		w.Header().Set("ETag", etag+"-gzip")
+	}
+	return compressed.Bytes()
+}
+
+func compressibleContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	contentTypes := config.Get().Compression.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = defaultCompressionContentTypes
+	}
+	for _, allowedType := range contentTypes {
+		if allowedType == mediaType || (strings.HasSuffix(allowedType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowedType, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding checks if the Accept-Encoding header allows the encoding, respecting "q=0".
+func acceptsEncoding(acceptEncoding string, encoding string) bool {
+	accepted := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != encoding && name != "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					quality = parsed
+				}
+			}
+		}
+		// An explicit entry for the encoding overrides the wildcard
+		if name == encoding {
+			return quality > 0
+		}
+		accepted = quality > 0
+	}
+	return accepted
+}
@@ -0,0 +1,64 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+// checkIfMatch checks the If-Match header of PUTs for data structures implementing IfMatcher, against the
+// ETag a GET of the same path would currently get. Returns a 412 on mismatch and a 428 if missing but required.
+func checkIfMatch(receiver *receiver, input input, token AccessTokenEntry, item interface{}) Result {
+	matcher, ok := item.(IfMatcher)
+	if !ok {
+		return Result{}
+	}
+	if input.ifMatch == "" {
+		if matcher.IfMatchRequired() {
+			return Result{Code: 428, Message: "missing If-Match header, get the current ETag first"}
+		}
+		return Result{}
+	}
+
+	// Get the current version like a plain GET would
+	getInput := input
+	getInput.method = "GET"
+	getInput.data = nil
+	getInput.query = make(map[string][]string)
+	getInput.pretty = false
+	currentETag := receiver.cheapETag(getInput, token)
+	if currentETag == "" {
+		getResult, getData := handleRequest(receiver, getInput, token)
+		getOutput := processOutput(getInput, getResult, getData)
+		if getOutput.code == 404 {
+			return Result{Code: 412, Message: "precondition failed, the entity does not exist"}
+		}
+		if getOutput.code != 200 {
+			return getResult
+		}
+		etag, _, err := digestJSON(getOutput.data, false)
+		if err != nil {
+			return InternalError(err)
+		}
+		currentETag = etag
+	}
+
+	if !etagMatches(input.ifMatch, currentETag) {
+		return Result{Code: 412, Message: "precondition failed, the entity was changed by someone else"}
+	}
+	return Result{}
+}
@@ -0,0 +1,100 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+var defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"}
+var defaultCORSHeaders = []string{"Authorization", "Content-Type", "Accept-Language", requestIDHeader, idempotencyKeyHeader, "Prefer"}
+
+const defaultCORSMaxAgeSeconds = 300
+
+// isPreflightRequest checks if the request is a CORS preflight request.
+func isPreflightRequest(httpRequest *http.Request) bool {
+	return httpRequest.Method == "OPTIONS" && httpRequest.Header.Get("Origin") != "" && httpRequest.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// handlePreflightRequest answers a CORS preflight request according to the CORS config.
+// The allowed methods default to the ones implemented for the path (if any).
+func handlePreflightRequest(httpWriter http.ResponseWriter, httpRequest *http.Request, routeMethods []string) {
+	corsConfig := config.Get().CORS
+	if setCORSOriginHeaders(httpWriter, httpRequest.Header.Get("Origin")) {
+		methods := corsConfig.AllowedMethods
+		if len(methods) == 0 {
+			methods = routeMethods
+		}
+		if len(methods) == 0 {
+			methods = defaultCORSMethods
+		}
+		headers := corsConfig.AllowedHeaders
+		if len(headers) == 0 {
+			headers = defaultCORSHeaders
+		}
+		maxAge := corsConfig.MaxAgeSeconds
+		if maxAge == 0 {
+			maxAge = defaultCORSMaxAgeSeconds
+		}
+		httpWriter.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		httpWriter.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		httpWriter.Header().Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+	}
+	httpWriter.WriteHeader(http.StatusNoContent)
+}
+
+// setCORSOriginHeaders sets the CORS origin headers for the response, if the origin is allowed.
+// Without configured origins, any origin is allowed (without credentials).
+func setCORSOriginHeaders(httpWriter http.ResponseWriter, origin string) bool {
+	corsConfig := config.Get().CORS
+	if len(corsConfig.AllowedOrigins) == 0 {
+		httpWriter.Header().Set("Access-Control-Allow-Origin", "*")
+		httpWriter.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
+		return true
+	}
+
+	// The response depends on the origin, so caches must keep them apart
+	httpWriter.Header().Add("Vary", "Origin")
+	if origin == "" || !CORSOriginAllowed(origin) {
+		return false
+	}
+	httpWriter.Header().Set("Access-Control-Allow-Origin", origin)
+	httpWriter.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
+	if corsConfig.AllowCredentials {
+		httpWriter.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	return true
+}
+
+// CORSOriginAllowed checks if the origin is one of the allowed CORS origins (any if "*" is allowed).
+// Also for checking the origin of WebSocket handshakes.
+func CORSOriginAllowed(origin string) bool {
+	for _, allowedOrigin := range config.Get().CORS.AllowedOrigins {
+		if allowedOrigin == "*" || strings.EqualFold(allowedOrigin, origin) {
+			return true
+		}
+	}
+	return false
+}
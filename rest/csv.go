@@ -0,0 +1,132 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+)
+
+// csvMediaType is the media type for CSV responses.
+const csvMediaType = "text/csv"
+
+// csvResponse is an encoded CSV listing, sent as is.
+type csvResponse []byte
+
+// RawResponse sends the CSV.
+func (response csvResponse) RawResponse() (string, []byte, error) {
+	return csvMediaType + "; charset=utf-8", response, nil
+}
+
+// wantsCSV checks if the client asked for CSV, with "?format=csv" or "Accept: text/csv".
+func wantsCSV(input input) bool {
+	if values, ok := input.query["format"]; ok && len(values) > 0 {
+		return values[0] == "csv"
+	}
+	return strings.Contains(input.accept, csvMediaType)
+}
+
+// encodeCSV encodes a listing (slice of structs or struct pointers) as CSV, with a header row.
+// The columns are the fields with "column" tags, except those hidden from JSON.
+func encodeCSV(data interface{}) ([]byte, error) {
+	list := reflect.Indirect(reflect.ValueOf(data))
+	if list.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("CSV requires a list, got %T", data)
+	}
+	elementType := list.Type().Elem()
+	if elementType.Kind() == reflect.Ptr {
+		elementType = elementType.Elem()
+	}
+	if elementType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("CSV requires a list of structs, got %T", data)
+	}
+
+	// Find the columns
+	var header []string
+	var fieldIndices [][]int
+	for _, field := range reflect.VisibleFields(elementType) { // Including embedded ones like db.Timestamps
+		column, ok := field.Tag.Lookup("column")
+		if !ok || column == "-" || field.Tag.Get("json") == "-" || field.PkgPath != "" {
+			continue
+		}
+		header = append(header, column)
+		fieldIndices = append(fieldIndices, field.Index)
+	}
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	if err := writer.Write(header); err != nil {
+		return nil, err
+	}
+	record := make([]string, len(fieldIndices))
+	for i := 0; i < list.Len(); i++ {
+		element := reflect.Indirect(list.Index(i))
+		if !element.IsValid() {
+			continue
+		}
+		for j, fieldIndex := range fieldIndices {
+			record[j] = csvValue(element.FieldByIndex(fieldIndex))
+		}
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	writer.Flush()
+	return buffer.Bytes(), writer.Error()
+}
+
+// csvValue formats a field for CSV, with empty values for nil pointers and NULLs and RFC 3339 times.
+// Text starting with a formula character is prefixed with an apostrophe, so spreadsheets don't evaluate it.
+func csvValue(value reflect.Value) string {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return ""
+		}
+		value = value.Elem()
+	}
+	switch typed := value.Interface().(type) {
+	case time.Time:
+		return typed.Format(time.RFC3339)
+	case db.NullString:
+		return csvValue(reflect.ValueOf(typed.String))
+	case fmt.Stringer:
+		return typed.String()
+	}
+	switch value.Kind() {
+	case reflect.String:
+		text := value.String()
+		if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+			return "'" + text
+		}
+		return text
+	case reflect.Slice, reflect.Map, reflect.Struct:
+		encoded, _ := json.Marshal(value.Interface())
+		return string(encoded)
+	}
+	return fmt.Sprint(value.Interface())
+}
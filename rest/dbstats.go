@@ -0,0 +1,63 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"github.com/gathering/tech-online-backend/db"
+)
+
+// DBStats is the connection pool state and the timing of all queries by shape, for finding slow queries.
+type DBStats struct {
+	OpenConnections int            `json:"open_connections"`
+	InUse           int            `json:"in_use"`
+	Idle            int            `json:"idle"`
+	WaitCount       int64          `json:"wait_count"`       // Times a query had to wait for a connection
+	WaitDurationMS  int64          `json:"wait_duration_ms"` // Total time waited for connections
+	Queries         []db.QueryStat `json:"queries"`          // By total time descending
+}
+
+func init() {
+	AddHandler("/admin/", "^db-stats/$", func() interface{} { return &DBStats{} })
+}
+
+// Get gets the connection pool state and the query stats since starting or the last reset.
+func (stats *DBStats) Get(request *Request) Result {
+	if request.AccessToken.GetRole() != RoleAdmin {
+		return UnauthorizedResult(request.AccessToken)
+	}
+	poolStats := db.DB.Stats()
+	stats.OpenConnections = poolStats.OpenConnections
+	stats.InUse = poolStats.InUse
+	stats.Idle = poolStats.Idle
+	stats.WaitCount = poolStats.WaitCount
+	stats.WaitDurationMS = poolStats.WaitDuration.Milliseconds()
+	stats.Queries = db.QueryStats()
+	return Result{}
+}
+
+// Delete resets the query stats.
+func (stats *DBStats) Delete(request *Request) Result {
+	if request.AccessToken.GetRole() != RoleAdmin {
+		return UnauthorizedResult(request.AccessToken)
+	}
+	db.ResetQueryStats()
+	return Result{}
+}
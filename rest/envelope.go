@@ -0,0 +1,91 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envelopeMediaType may be accepted instead of using ?envelope to get listings in an envelope.
+const envelopeMediaType = "application/vnd.techo.collection+json"
+
+// collectionEnvelope wraps a page of a listing with metadata.
+type collectionEnvelope struct {
+	Items       interface{} `json:"items"`
+	Total       int         `json:"total"`           // Number of elements in the full listing
+	Limit       int         `json:"limit,omitempty"` // Max elements per page, if limited
+	Offset      int         `json:"offset"`
+	GeneratedAt time.Time   `json:"generated_at"`
+}
+
+// wantsEnvelope checks if the client asked for listings in an envelope.
+func wantsEnvelope(input input) bool {
+	if values, ok := input.query["envelope"]; ok {
+		return len(values) == 0 || (values[0] != "0" && values[0] != "false")
+	}
+	return strings.Contains(input.accept, envelopeMediaType)
+}
+
+// listPaging gets the limit and offset query params, with 0 for unset or invalid ones.
+func listPaging(input input) (limit int, offset int) {
+	if values, ok := input.query["limit"]; ok && len(values) > 0 {
+		if value, err := strconv.Atoi(values[0]); err == nil && value > 0 {
+			limit = value
+		}
+	}
+	if values, ok := input.query["offset"]; ok && len(values) > 0 {
+		if value, err := strconv.Atoi(values[0]); err == nil && value > 0 {
+			offset = value
+		}
+	}
+	return
+}
+
+// paginate gets the page of the listing (slice) according to the limit (0 for unlimited) and offset,
+// and the total number of elements. Data which isn't a listing is returned as-is.
+func paginate(data interface{}, limit int, offset int) (page interface{}, total int, isList bool) {
+	value := reflect.ValueOf(data)
+	for value.Kind() == reflect.Ptr && !value.IsNil() {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Slice {
+		return data, 0, false
+	}
+
+	total = value.Len()
+	begin := offset
+	if begin > total {
+		begin = total
+	}
+	end := total
+	if limit > 0 && begin+limit < end {
+		end = begin + limit
+	}
+	pageValue := value.Slice(begin, end)
+	if pageValue.IsNil() {
+		// Always give an empty list instead of null
+		pageValue = reflect.MakeSlice(value.Type(), 0, 0)
+	}
+	return pageValue.Interface(), total, true
+}
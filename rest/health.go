@@ -0,0 +1,132 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+)
+
+// ReadinessCheck checks that a component the API depends on is usable.
+type ReadinessCheck func() error
+
+// readinessChecks contains the registered readiness checks, by component name.
+var readinessChecks = struct {
+	sync.Mutex
+	checks map[string]ReadinessCheck
+}{checks: make(map[string]ReadinessCheck)}
+
+// staticAccessTokensLoaded is set once the static access tokens have been loaded from the config.
+var staticAccessTokensLoaded atomic.Value
+
+// healthStatus is the response for the health endpoints.
+type healthStatus struct {
+	Status     string                      `json:"status"` // "ok" or "unavailable"
+	Time       time.Time                   `json:"time"`
+	Components map[string]*componentStatus `json:"components,omitempty"`
+}
+
+// componentStatus is the readiness of a single component.
+type componentStatus struct {
+	Status    string `json:"status"` // "ok" or "unavailable"
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+func init() {
+	AddReadinessCheck("database", db.Ping)
+	AddReadinessCheck("static_access_tokens", func() error {
+		if loaded, _ := staticAccessTokensLoaded.Load().(bool); !loaded {
+			return errors.New("static access tokens not loaded")
+		}
+		return nil
+	})
+}
+
+// AddReadinessCheck registers a check for /readyz, replacing any existing check for the component.
+// Checks run concurrently for every request, so they should be quick.
+func AddReadinessCheck(component string, check ReadinessCheck) {
+	readinessChecks.Lock()
+	defer readinessChecks.Unlock()
+	readinessChecks.checks[component] = check
+}
+
+// handleLiveness answers /healthz, which only shows that the process is up and serving.
+func handleLiveness(httpWriter http.ResponseWriter, httpRequest *http.Request) {
+	sendHealthStatus(httpWriter, httpRequest, healthStatus{Status: "ok", Time: time.Now()})
+}
+
+// handleReadiness answers /readyz with the status of all components, with 503 if any of them are unavailable.
+func handleReadiness(httpWriter http.ResponseWriter, httpRequest *http.Request) {
+	readinessChecks.Lock()
+	checks := make(map[string]ReadinessCheck, len(readinessChecks.checks))
+	for component, check := range readinessChecks.checks {
+		checks[component] = check
+	}
+	readinessChecks.Unlock()
+
+	status := healthStatus{Status: "ok", Time: time.Now(), Components: make(map[string]*componentStatus, len(checks))}
+	var statusLock sync.Mutex
+	var wg sync.WaitGroup
+	for component, check := range checks {
+		wg.Add(1)
+		go func(component string, check ReadinessCheck) {
+			defer wg.Done()
+			begin := time.Now()
+			err := check()
+			result := componentStatus{Status: "ok", LatencyMS: time.Since(begin).Milliseconds()}
+			if err != nil {
+				result.Status = "unavailable"
+				result.Error = err.Error()
+			}
+			statusLock.Lock()
+			status.Components[component] = &result
+			if err != nil {
+				status.Status = "unavailable"
+			}
+			statusLock.Unlock()
+		}(component, check)
+	}
+	wg.Wait()
+	sendHealthStatus(httpWriter, httpRequest, status)
+}
+
+func sendHealthStatus(httpWriter http.ResponseWriter, httpRequest *http.Request, status healthStatus) {
+	body, jsonErr := json.Marshal(status)
+	if jsonErr != nil {
+		http.Error(httpWriter, jsonErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	httpWriter.Header().Set("Content-Type", "application/json; charset=utf-8")
+	httpWriter.Header().Set("Cache-Control", "no-store")
+	if status.Status != "ok" {
+		httpWriter.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if httpRequest.Method != "HEAD" {
+		httpWriter.Write(append(body, '\n'))
+	}
+}
@@ -20,11 +20,92 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 
 package rest
 
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/gathering/tech-online-backend/db"
+)
+
 // UnauthorizedResult returns a 401 if the token is not authenticated
 // or 403 if it is.
 func UnauthorizedResult(token AccessTokenEntry) Result {
 	if token.IsAuthenticated() {
-		return Result{Code: 403, Message: "Permission denied"}
+		return Forbidden("Permission denied")
 	}
 	return Result{Code: 401, Message: "Not logged in"}
 }
+
+// InTransaction calls the handler function with a new transaction as the
+// request transaction (see Request.Executor), committing it if the result is
+// ok and rolling it back otherwise. If the request already has a transaction
+// (e.g. in a batch), the function is just called in that one.
+func InTransaction(request *Request, handle func() Result) Result {
+	if request.Tx != nil {
+		return handle()
+	}
+	// Only beginning is retried, since handlers may have side effects
+	var tx *sql.Tx
+	txErr := db.Retry(true, func() error {
+		var err error
+		tx, err = db.DB.Begin()
+		return err
+	})
+	if txErr != nil {
+		return InternalError(txErr)
+	}
+	defer tx.Rollback()
+	request.Tx = tx
+	defer func() {
+		request.Tx = nil
+	}()
+
+	result := handle()
+	if !result.IsOk() {
+		return result
+	}
+	if err := tx.Commit(); err != nil {
+		return InternalError(err)
+	}
+	return result
+}
+
+// ElementFailedResult tells which element of a bulk request failed, when
+// none of the elements were saved.
+func ElementFailedResult(result Result, element string) Result {
+	if result.Error != nil {
+		result.Error = fmt.Errorf("%v: %w", element, result.Error)
+	}
+	result.Message = fmt.Sprintf("%v: %v (nothing was saved)", element, result.Message)
+	return result
+}
+
+// BadRequest returns a 400 with the message for the client.
+func BadRequest(message string) Result {
+	return Result{Code: 400, Message: message}
+}
+
+// Forbidden returns a 403 with the message for the client, for denials other than missing permissions (see UnauthorizedResult).
+func Forbidden(message string) Result {
+	return Result{Code: 403, Message: message}
+}
+
+// NotFound returns a 404 with the message for the client.
+func NotFound(message string) Result {
+	return Result{Code: 404, Message: message}
+}
+
+// Conflict returns a 409 with the message for the client.
+func Conflict(message string) Result {
+	return Result{Code: 409, Message: message}
+}
+
+// InternalError returns a 500 with the error, which is logged but hidden from the client.
+func InternalError(err error) Result {
+	return Result{Code: 500, Error: err}
+}
+
+// Created returns a 201 with the location of the created entity.
+func Created(location string) Result {
+	return Result{Code: 201, Location: location}
+}
@@ -0,0 +1,128 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+)
+
+// idempotencyKeyHeader is the request header clients use to make POSTs safe to retry.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyKeyMaxLength limits the length of client-provided idempotency keys.
+const idempotencyKeyMaxLength = 255
+
+// idempotencyKeyLifetime is how long responses are kept for replaying.
+const idempotencyKeyLifetime = 24 * time.Hour
+
+// AddIdempotentHandler is like AddHandler, but POSTs with an Idempotency-Key header are only handled once
+// per key and access token. Retries get the original response replayed instead, e.g. so double-clicking
+// "get me a station" doesn't provision two VMs. Internal server errors are not kept, so they may be retried.
+func AddIdempotentHandler(pathPrefix string, pathPattern string, allocator Allocator) error {
+	return addReceiver("", pathPrefix, pathPattern, allocator, nil, true)
+}
+
+// handleIdempotentRequest handles the request once per idempotency key, or replays the original output.
+// Returns false if the request doesn't use an idempotency key (or the receiver doesn't support it).
+func handleIdempotentRequest(receiver *receiver, input input, token AccessTokenEntry) (output, bool) {
+	if receiver == nil || !receiver.idempotent || input.method != "POST" || input.idempotencyKey == "" {
+		return output{}, false
+	}
+	if len(input.idempotencyKey) > idempotencyKeyMaxLength {
+		return processOutput(input, BadRequest("idempotency key too long"), nil), true
+	}
+	requestHashBytes := sha256.Sum256(input.data)
+	requestHash := hex.EncodeToString(requestHashBytes[:])
+	path := input.url.String()
+	now := time.Now()
+
+	// Claim the key, unless another request already did
+	if _, err := db.DB.Exec("DELETE FROM idempotency_keys WHERE creation_time < $1", now.Add(-idempotencyKeyLifetime)); err != nil {
+		return processOutput(input, InternalError(err), nil), true
+	}
+	claimResult, claimErr := db.DB.Exec("INSERT INTO idempotency_keys (key, token, method, path, request_hash, creation_time) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING",
+		input.idempotencyKey, token.ID.String(), input.method, path, requestHash, now)
+	if claimErr != nil {
+		return processOutput(input, InternalError(claimErr), nil), true
+	}
+	claimed, claimedErr := claimResult.RowsAffected()
+	if claimedErr != nil {
+		return processOutput(input, InternalError(claimedErr), nil), true
+	}
+	if claimed == 0 {
+		return replayIdempotentRequest(input, token, path, requestHash), true
+	}
+
+	// Handle and keep the output, or release the key if it failed internally
+	result, data := handleRequest(receiver, input, token)
+	handledOutput := processOutput(input, result, data)
+	if handledOutput.code >= 500 {
+		if _, err := db.DB.Exec("DELETE FROM idempotency_keys WHERE key = $1 AND token = $2", input.idempotencyKey, token.ID.String()); err != nil {
+			input.log.WithError(err).Warn("Failed to release idempotency key")
+		}
+		return handledOutput, true
+	}
+	var rawData []byte
+	if handledOutput.data != nil {
+		var jsonErr error
+		if rawData, jsonErr = json.Marshal(handledOutput.data); jsonErr != nil {
+			input.log.WithError(jsonErr).Warn("Failed to marshal output for idempotency key")
+		}
+	}
+	if _, err := db.DB.Exec("UPDATE idempotency_keys SET code = $1, location = $2, data = $3 WHERE key = $4 AND token = $5",
+		handledOutput.code, handledOutput.location, string(rawData), input.idempotencyKey, token.ID.String()); err != nil {
+		input.log.WithError(err).Warn("Failed to save output for idempotency key")
+	}
+	return handledOutput, true
+}
+
+// replayIdempotentRequest replays the output of the request which claimed the idempotency key.
+func replayIdempotentRequest(input input, token AccessTokenEntry, path string, requestHash string) output {
+	var method, originalPath, originalRequestHash, location, data string
+	var code sql.NullInt64
+	row := db.DB.QueryRow("SELECT method, path, request_hash, code, location, data FROM idempotency_keys WHERE key = $1 AND token = $2",
+		input.idempotencyKey, token.ID.String())
+	if err := row.Scan(&method, &originalPath, &originalRequestHash, &code, &location, &data); err != nil {
+		if err == sql.ErrNoRows {
+			// Released after failing in the meantime
+			return processOutput(input, Conflict("request with this idempotency key failed, please try again"), nil)
+		}
+		return processOutput(input, InternalError(err), nil)
+	}
+	if method != input.method || originalPath != path || originalRequestHash != requestHash {
+		return processOutput(input, Result{Code: 422, Message: "idempotency key was used for a different request"}, nil)
+	}
+	if !code.Valid {
+		return processOutput(input, Conflict("request with this idempotency key is still in progress"), nil)
+	}
+	input.log.WithField("idempotency_key", input.idempotencyKey).Info("Replaying response for idempotency key")
+	replayed := output{code: int(code.Int64), location: location}
+	if data != "" {
+		replayed.data = json.RawMessage(data)
+	}
+	return replayed
+}
@@ -0,0 +1,127 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+const defaultMaxBodyKB = 1024
+const defaultReadHeaderTimeout = 10 * time.Second
+const defaultReadTimeout = 300 * time.Second
+const defaultWriteTimeout = 300 * time.Second
+const defaultIdleTimeout = 120 * time.Second
+
+// errRequestBodyTooLarge is returned when reading more of the request body than the limit allows.
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// limitedBody is a request body which fails when reading more than the limit, like http.MaxBytesReader,
+// but remembers it so stream handlers' results can be replaced with a 413.
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (body *limitedBody) Read(data []byte) (int, error) {
+	if body.exceeded {
+		return 0, errRequestBodyTooLarge
+	}
+	if int64(len(data)) > body.remaining+1 {
+		data = data[:body.remaining+1]
+	}
+	n, err := body.body.Read(data)
+	if int64(n) > body.remaining {
+		body.exceeded = true
+		return int(body.remaining), errRequestBodyTooLarge
+	}
+	body.remaining -= int64(n)
+	return n, err
+}
+
+func (body *limitedBody) Close() error {
+	return body.body.Close()
+}
+
+// DefaultMaxBodyBytes gets the configured request body limit for endpoints without their own limit.
+func DefaultMaxBodyBytes() int64 {
+	maxBodyKB := config.Get().HTTPServer.MaxBodyKB
+	if maxBodyKB <= 0 {
+		maxBodyKB = defaultMaxBodyKB
+	}
+	return int64(maxBodyKB) * 1024
+}
+
+// maxBodyBytes gets the request body limit for the receiver, or a negative value for no limit.
+func (receiver *receiver) maxBodyBytes() int64 {
+	if receiver != nil {
+		if limiter, ok := receiver.allocator().(BodyLimiter); ok {
+			return limiter.MaxBodyBytes()
+		}
+	}
+	return DefaultMaxBodyBytes()
+}
+
+// limitRequestBody wraps the request body in the limit for the receiver. Returns false if the declared
+// content length is already too large, so the request can be rejected without reading anything.
+func limitRequestBody(receiver *receiver, httpRequest *http.Request) bool {
+	limit := receiver.maxBodyBytes()
+	if limit < 0 {
+		return true
+	}
+	if httpRequest.ContentLength > limit {
+		return false
+	}
+	httpRequest.Body = &limitedBody{body: httpRequest.Body, remaining: limit}
+	return true
+}
+
+// isBodyTooLarge checks if the request body was cut off by the limit.
+func isBodyTooLarge(body io.Reader) bool {
+	limited, ok := body.(*limitedBody)
+	return ok && limited.exceeded
+}
+
+// tooLargeResult is the result for request bodies exceeding the limit.
+func tooLargeResult() Result {
+	return Result{Code: 413, Message: "request body too large"}
+}
+
+// applyServerTimeouts sets the configured timeouts for the server, to keep slow clients from tying up connections.
+func applyServerTimeouts(server *http.Server) {
+	serverConfig := config.Get().HTTPServer
+	server.ReadHeaderTimeout = secondsOrDefault(serverConfig.ReadHeaderTimeoutSeconds, defaultReadHeaderTimeout)
+	server.ReadTimeout = secondsOrDefault(serverConfig.ReadTimeoutSeconds, defaultReadTimeout)
+	server.WriteTimeout = secondsOrDefault(serverConfig.WriteTimeoutSeconds, defaultWriteTimeout)
+	server.IdleTimeout = secondsOrDefault(serverConfig.IdleTimeoutSeconds, defaultIdleTimeout)
+}
+
+func secondsOrDefault(seconds int, defaultDuration time.Duration) time.Duration {
+	if seconds <= 0 {
+		return defaultDuration
+	}
+	return time.Duration(seconds) * time.Second
+}
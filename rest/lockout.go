@@ -0,0 +1,211 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/worker"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultAuthLockoutMaxFailures = 10
+const defaultAuthLockoutDuration = 30 * time.Second
+const defaultAuthLockoutMaxDuration = 15 * time.Minute
+const defaultAuthLockoutForgetAfter = 60 * time.Minute
+
+// authLockoutPurgeInterval is how often forgotten failures are removed.
+const authLockoutPurgeInterval = 5 * time.Minute
+
+// authFailure is the failed authentications for a client IP address.
+type authFailure struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// authFailures are tracked in memory only, so they're reset on restart.
+var authFailures = struct {
+	sync.Mutex
+	byKey map[string]*authFailure
+}{
+	byKey: make(map[string]*authFailure),
+}
+
+var authLockoutListeners []func(key string, failures int, until time.Time)
+
+func init() {
+	worker.AddTask("auth-failure-purge", authLockoutPurgeInterval, purgeAuthFailures)
+}
+
+// AddAuthLockoutListener registers a function to be called when a client (IP address) gets
+// locked out for presenting invalid access token keys, e.g. for alerting. Must be called during init.
+func AddAuthLockoutListener(listener func(key string, failures int, until time.Time)) {
+	authLockoutListeners = append(authLockoutListeners, listener)
+}
+
+// authLockoutKeys gets the keys failures are tracked by for the request.
+// Only the client IP address is used, so nobody can lock out a valid key by presenting similar ones.
+func authLockoutKeys(httpRequest *http.Request) []string {
+	return []string{"ip:" + clientIP(httpRequest)}
+}
+
+// failAuth handles a failed authentication (after the presented credentials were checked), returning how long
+// the client is locked out. Failures while locked out aren't counted.
+func failAuth(keys []string, requestLog *log.Entry) time.Duration {
+	if remaining := authLockoutRemaining(keys); remaining > 0 {
+		return remaining
+	}
+	recordAuthFailure(keys, requestLog)
+	return 0
+}
+
+// clientIP gets the IP address of the client, from X-Forwarded-For if trusted.
+// Clients may put anything in the header, so the entries are checked from the right (the ones added by our proxies)
+// and the first one not from a trusted proxy is used. Without trusted proxies, only the rightmost entry is trusted.
+func clientIP(httpRequest *http.Request) string {
+	remoteIP := httpRequest.RemoteAddr
+	if host, _, err := net.SplitHostPort(remoteIP); err == nil {
+		remoteIP = host
+	}
+	lockoutConfig := config.Get().AuthLockout
+	if !lockoutConfig.TrustForwardedFor {
+		return remoteIP
+	}
+	trustedProxies := lockoutConfig.TrustedProxies
+	if len(trustedProxies) > 0 && !isTrustedProxy(remoteIP, trustedProxies) {
+		return remoteIP
+	}
+	hops := strings.Split(strings.Join(httpRequest.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if len(trustedProxies) == 0 || !isTrustedProxy(hop, trustedProxies) {
+			return hop
+		}
+	}
+	return remoteIP
+}
+
+// isTrustedProxy checks if the IP address matches any of the trusted proxies (IP addresses or CIDR ranges).
+func isTrustedProxy(address string, trustedProxies []string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, trusted := range trustedProxies {
+		if _, network, err := net.ParseCIDR(trusted); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if trustedIP := net.ParseIP(trusted); trustedIP != nil && trustedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authLockoutRemaining gets how long any of the keys are still locked out, or 0 if none are.
+func authLockoutRemaining(keys []string) time.Duration {
+	if config.Get().AuthLockout.Disabled {
+		return 0
+	}
+	now := time.Now()
+	var remaining time.Duration
+	authFailures.Lock()
+	defer authFailures.Unlock()
+	for _, key := range keys {
+		if failure, ok := authFailures.byKey[key]; ok && failure.lockedUntil.After(now) && failure.lockedUntil.Sub(now) > remaining {
+			remaining = failure.lockedUntil.Sub(now)
+		}
+	}
+	return remaining
+}
+
+// recordAuthFailure counts a failed authentication for the keys, locking them out when exceeding the max failures.
+// Every further failure doubles the lockout, up to the max.
+func recordAuthFailure(keys []string, requestLog *log.Entry) {
+	lockoutConfig := config.Get().AuthLockout
+	if lockoutConfig.Disabled {
+		return
+	}
+	maxFailures := lockoutConfig.MaxFailures
+	if maxFailures <= 0 {
+		maxFailures = defaultAuthLockoutMaxFailures
+	}
+	baseDuration := secondsOrDefault(lockoutConfig.LockoutSeconds, defaultAuthLockoutDuration)
+	maxDuration := defaultAuthLockoutMaxDuration
+	if lockoutConfig.MaxLockoutMinutes > 0 {
+		maxDuration = time.Duration(lockoutConfig.MaxLockoutMinutes) * time.Minute
+	}
+
+	now := time.Now()
+	authFailures.Lock()
+	defer authFailures.Unlock()
+	for _, key := range keys {
+		failure, ok := authFailures.byKey[key]
+		if !ok {
+			failure = &authFailure{}
+			authFailures.byKey[key] = failure
+		}
+		failure.count++
+		failure.lastFailure = now
+		if failure.count < maxFailures {
+			continue
+		}
+		lockout := maxDuration
+		if exponent := failure.count - maxFailures; exponent < 32 && baseDuration<<exponent < maxDuration {
+			lockout = baseDuration << exponent
+		}
+		failure.lockedUntil = now.Add(lockout)
+		requestLog.WithFields(log.Fields{
+			"lockout_key": key,
+			"failures":    failure.count,
+			"until":       failure.lockedUntil,
+		}).Warn("Locked out client after failed authentications")
+		for _, listener := range authLockoutListeners {
+			listener(key, failure.count, failure.lockedUntil)
+		}
+	}
+}
+
+// purgeAuthFailures forgets failures which are no longer locked out and old enough.
+func purgeAuthFailures() {
+	forgetAfter := defaultAuthLockoutForgetAfter
+	if config.Get().AuthLockout.ForgetAfterMinutes > 0 {
+		forgetAfter = time.Duration(config.Get().AuthLockout.ForgetAfterMinutes) * time.Minute
+	}
+	now := time.Now()
+	authFailures.Lock()
+	defer authFailures.Unlock()
+	for key, failure := range authFailures.byKey {
+		if now.After(failure.lockedUntil) && now.Sub(failure.lastFailure) > forgetAfter {
+			delete(authFailures.byKey, key)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// messagePackMaxDepth limits nesting, to avoid stack exhaustion on hostile input.
+const messagePackMaxDepth = 100
+
+type messagePackCodec struct{}
+
+func (messagePackCodec) ToJSON(data []byte) ([]byte, error) {
+	decoder := NewMessagePackDecoder(bytes.NewReader(data), len(data))
+	value, err := decoder.Next()
+	if err == io.EOF {
+		return nil, fmt.Errorf("empty MessagePack body")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.reader.Peek(1); err != io.EOF {
+		return nil, fmt.Errorf("trailing data after MessagePack value")
+	}
+	return treeToJSON(value)
+}
+
+func (messagePackCodec) FromJSON(data []byte) ([]byte, error) {
+	value, err := parseJSONTree(data)
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	if err := writeMessagePack(msgpack.NewEncoder(&buffer), value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// MessagePackDecoder reads a stream of concatenated MessagePack values, e.g. for streamed ingestion.
+// Binary values are decoded as strings and timestamps as RFC 3339 strings, other extension types are not supported.
+type MessagePackDecoder struct {
+	reader  *messagePackReader
+	decoder *msgpack.Decoder
+}
+
+// messagePackReader counts the bytes read for the current value, to limit its size.
+// It's a byte scanner, so the decoder doesn't add its own buffering and read past the current value.
+type messagePackReader struct {
+	*bufio.Reader
+	maxBytes int
+	read     int
+}
+
+// NewMessagePackDecoder creates a decoder, where maxBytes limits the encoded size of each value.
+func NewMessagePackDecoder(reader io.Reader, maxBytes int) *MessagePackDecoder {
+	limitedReader := &messagePackReader{Reader: bufio.NewReader(reader), maxBytes: maxBytes}
+	return &MessagePackDecoder{reader: limitedReader, decoder: msgpack.NewDecoder(limitedReader)}
+}
+
+// Next decodes the next value, returning io.EOF at the end of the stream.
+func (decoder *MessagePackDecoder) Next() (interface{}, error) {
+	if _, err := decoder.reader.Peek(1); err != nil {
+		return nil, err
+	}
+	decoder.reader.read = 0
+	value, err := decoder.readValue(0)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return value, err
+}
+
+// NextJSON decodes the next value as JSON, returning io.EOF at the end of the stream.
+func (decoder *MessagePackDecoder) NextJSON() ([]byte, error) {
+	value, err := decoder.Next()
+	if err != nil {
+		return nil, err
+	}
+	return treeToJSON(value)
+}
+
+func (reader *messagePackReader) tooLarge() error {
+	return fmt.Errorf("MessagePack value too large (max %d bytes)", reader.maxBytes)
+}
+
+func (reader *messagePackReader) Read(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if reader.read >= reader.maxBytes {
+		return 0, reader.tooLarge()
+	}
+	if len(data) > reader.maxBytes-reader.read {
+		data = data[:reader.maxBytes-reader.read]
+	}
+	count, err := reader.Reader.Read(data)
+	reader.read += count
+	return count, err
+}
+
+func (reader *messagePackReader) ReadByte() (byte, error) {
+	if reader.read >= reader.maxBytes {
+		return 0, reader.tooLarge()
+	}
+	b, err := reader.Reader.ReadByte()
+	if err == nil {
+		reader.read++
+	}
+	return b, err
+}
+
+func (reader *messagePackReader) UnreadByte() error {
+	err := reader.Reader.UnreadByte()
+	if err == nil {
+		reader.read--
+	}
+	return err
+}
+
+// readValue decodes a value into the same value types as parseJSONTree, keeping the map member order.
+func (decoder *MessagePackDecoder) readValue(depth int) (interface{}, error) {
+	if depth > messagePackMaxDepth {
+		return nil, fmt.Errorf("MessagePack value nested too deeply")
+	}
+	code, err := decoder.decoder.PeekCode()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case code == msgpcode.Nil:
+		return nil, decoder.decoder.DecodeNil()
+	case code == msgpcode.False, code == msgpcode.True:
+		return decoder.decoder.DecodeBool()
+	case msgpcode.IsFixedMap(code), code == msgpcode.Map16, code == msgpcode.Map32:
+		return decoder.readMap(depth)
+	case msgpcode.IsFixedArray(code), code == msgpcode.Array16, code == msgpcode.Array32:
+		return decoder.readArray(depth)
+	case msgpcode.IsString(code), msgpcode.IsBin(code):
+		value, err := decoder.decoder.DecodeString()
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.ValidString(value) {
+			return nil, fmt.Errorf("MessagePack string is not valid UTF-8")
+		}
+		return value, nil
+	case code == msgpcode.Float, code == msgpcode.Double:
+		value, err := decoder.decoder.DecodeFloat64()
+		if err != nil {
+			return nil, err
+		}
+		return messagePackFloat(value)
+	case code >= msgpcode.Uint8 && code <= msgpcode.Uint64:
+		value, err := decoder.decoder.DecodeUint64()
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(strconv.FormatUint(value, 10)), nil
+	case msgpcode.IsFixedNum(code), code >= msgpcode.Int8 && code <= msgpcode.Int64:
+		value, err := decoder.decoder.DecodeInt64()
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(strconv.FormatInt(value, 10)), nil
+	case msgpcode.IsExt(code):
+		// Only the timestamp type (-1) is supported
+		value, err := decoder.decoder.DecodeTime()
+		if err != nil {
+			return nil, err
+		}
+		return value.UTC().Format(time.RFC3339Nano), nil
+	}
+	return nil, fmt.Errorf("invalid MessagePack type: 0x%02x", code)
+}
+
+func (decoder *MessagePackDecoder) readArray(depth int) (interface{}, error) {
+	length, err := decoder.decoder.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	array := make([]interface{}, 0)
+	for i := 0; i < length; i++ {
+		value, err := decoder.readValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+	}
+	return array, nil
+}
+
+func (decoder *MessagePackDecoder) readMap(depth int) (interface{}, error) {
+	length, err := decoder.decoder.DecodeMapLen()
+	if err != nil {
+		return nil, err
+	}
+	object := make(jsonObject, 0)
+	for i := 0; i < length; i++ {
+		key, err := decoder.readValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		keyString, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("MessagePack map keys must be strings")
+		}
+		value, err := decoder.readValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		object = append(object, jsonMember{key: keyString, value: value})
+	}
+	return object, nil
+}
+
+func messagePackFloat(value float64) (interface{}, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("MessagePack float is not representable in JSON")
+	}
+	return json.Number(strconv.FormatFloat(value, 'g', -1, 64)), nil
+}
+
+// writeMessagePack encodes a value from parseJSONTree, keeping the object member order.
+func writeMessagePack(encoder *msgpack.Encoder, value interface{}) error {
+	switch typed := value.(type) {
+	case nil:
+		return encoder.EncodeNil()
+	case bool:
+		return encoder.EncodeBool(typed)
+	case json.Number:
+		if integer, err := typed.Int64(); err == nil {
+			return encoder.EncodeInt(integer)
+		}
+		if unsigned, err := strconv.ParseUint(string(typed), 10, 64); err == nil {
+			return encoder.EncodeUint(unsigned)
+		}
+		float, err := typed.Float64()
+		if err != nil {
+			return err
+		}
+		return encoder.EncodeFloat64(float)
+	case string:
+		return encoder.EncodeString(typed)
+	case []interface{}:
+		if err := encoder.EncodeArrayLen(len(typed)); err != nil {
+			return err
+		}
+		for _, element := range typed {
+			if err := writeMessagePack(encoder, element); err != nil {
+				return err
+			}
+		}
+	case jsonObject:
+		if err := encoder.EncodeMapLen(len(typed)); err != nil {
+			return err
+		}
+		for _, member := range typed {
+			if err := encoder.EncodeString(member.key); err != nil {
+				return err
+			}
+			if err := writeMessagePack(encoder, member.value); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported value type for MessagePack: %T", value)
+	}
+	return nil
+}
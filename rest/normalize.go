@@ -0,0 +1,69 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+// normalizePaths handles API paths which are not in the canonical form (with a trailing slash and optionally lowercase)
+// according to the path normalization config, before the handler is found. Paths outside the site prefix are left alone.
+func normalizePaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(httpWriter http.ResponseWriter, httpRequest *http.Request) {
+		serverConfig := config.Get().HTTPServer
+		path := httpRequest.URL.Path
+		canonicalPath := canonicalAPIPath(path, serverConfig.LowercasePaths)
+		if serverConfig.PathNormalization == "" || canonicalPath == path {
+			next.ServeHTTP(httpWriter, httpRequest)
+			return
+		}
+
+		// Preflight requests can't follow redirects, so they're always rewritten
+		if serverConfig.PathNormalization == "redirect" && !isPreflightRequest(httpRequest) {
+			location := *httpRequest.URL
+			location.Path = canonicalPath
+			location.RawPath = ""
+			http.Redirect(httpWriter, httpRequest, location.RequestURI(), http.StatusPermanentRedirect)
+			return
+		}
+		rewrittenRequest := httpRequest.Clone(httpRequest.Context())
+		rewrittenRequest.URL.Path = canonicalPath
+		rewrittenRequest.URL.RawPath = ""
+		next.ServeHTTP(httpWriter, rewrittenRequest)
+	})
+}
+
+// canonicalAPIPath adds the trailing slash to paths below the site prefix, optionally lowercasing them too.
+func canonicalAPIPath(path string, lowercase bool) string {
+	if !strings.HasPrefix(path, config.Get().SitePrefix+"/") || path == "/healthz" || path == "/readyz" {
+		return path
+	}
+	if lowercase {
+		path = strings.ToLower(path)
+	}
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return path
+}
@@ -65,9 +65,9 @@ func init() {
 
 // Get gets OAuth2 info.
 func (response *Oauth2InfoData) Get(request *Request) Result {
-	response.ClientID = config.Config.OAuth2.ClientID
-	response.AuthURL = config.Config.OAuth2.AuthURL
-	response.RedirectURL = config.Config.OAuth2.RedirectURL
+	response.ClientID = config.Get().OAuth2.ClientID
+	response.AuthURL = config.Get().OAuth2.AuthURL
+	response.RedirectURL = config.Get().OAuth2.RedirectURL
 	return Result{}
 }
 
@@ -78,7 +78,7 @@ func (response *Oauth2LoginData) Post(request *Request) Result {
 	// Check for provided code
 	oauth2Code, oauth2CodeFound := request.QueryArgs["code"]
 	if !oauth2CodeFound {
-		return Result{Code: 400, Message: "No code provided"}
+		return BadRequest("No code provided")
 	}
 
 	// Check for alternative redirect URL (only allows variations with host=localhost for testing purposes)
@@ -86,10 +86,10 @@ func (response *Oauth2LoginData) Post(request *Request) Result {
 	if redirectURLFound {
 		newRedirectURL, newRedirectURLErr := url.Parse(rawNewRedirectURL)
 		if newRedirectURLErr != nil {
-			return Result{Code: 400, Message: "Invalid redirect URL provided"}
+			return BadRequest("Invalid redirect URL provided")
 		}
 		if rawNewRedirectURL != oauth2Config.RedirectURL && newRedirectURL.Hostname() != "localhost" {
-			return Result{Code: 400, Message: "Illegal redirect URL provided"}
+			return BadRequest("Illegal redirect URL provided")
 		}
 		oauth2Config.RedirectURL = newRedirectURL.String()
 	}
@@ -98,13 +98,13 @@ func (response *Oauth2LoginData) Post(request *Request) Result {
 	oauth2Token, oauth2TokenExchangeErr := oauth2Config.Exchange(context.TODO(), oauth2Code)
 	if oauth2TokenExchangeErr != nil {
 		log.WithError(oauth2TokenExchangeErr).Trace("OAuth2: Token exchange failed")
-		return Result{Code: 400, Message: "IdP didn't accept the provided code"}
+		return BadRequest("IdP didn't accept the provided code")
 	}
 
 	// Get profile from Unicorn
-	httpRequest, httpRequestErr := http.NewRequest("GET", config.Config.Unicorn.ProfileURL, nil)
+	httpRequest, httpRequestErr := http.NewRequest("GET", config.Get().Unicorn.ProfileURL, nil)
 	if httpRequestErr != nil {
-		return Result{Code: 500, Error: httpRequestErr}
+		return InternalError(httpRequestErr)
 	}
 	httpRequest.Header.Set("Authorization", "Bearer "+oauth2Token.AccessToken)
 	client := &http.Client{}
@@ -168,7 +168,7 @@ func (response *Oauth2LogoutData) Post(request *Request) Result {
 		}
 		request.AccessToken = makeGuestAccessToken()
 	} else {
-		return Result{Code: 400, Message: "This access token type doesn't support logouts"}
+		return BadRequest("This access token type doesn't support logouts")
 	}
 	return Result{}
 }
@@ -176,12 +176,12 @@ func (response *Oauth2LogoutData) Post(request *Request) Result {
 // makeOAuth2Config creates/loads the OAuth2 config from the main config.
 func makeOAuth2Config() oauth2.Config {
 	return oauth2.Config{
-		ClientID:     config.Config.OAuth2.ClientID,
-		ClientSecret: config.Config.OAuth2.ClientSecret,
+		ClientID:     config.Get().OAuth2.ClientID,
+		ClientSecret: config.Get().OAuth2.ClientSecret,
 		Endpoint: oauth2.Endpoint{
-			TokenURL: config.Config.OAuth2.TokenURL,
+			TokenURL: config.Get().OAuth2.TokenURL,
 		},
-		RedirectURL: config.Config.OAuth2.RedirectURL,
+		RedirectURL: config.Get().OAuth2.RedirectURL,
 		// Scopes: []string{"all"},
 	}
 }
@@ -0,0 +1,55 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"strings"
+)
+
+// Values of the "return" preference of the Prefer header (RFC 7240).
+const (
+	preferMinimal        = "minimal"        // No body for successful writes
+	preferRepresentation = "representation" // The written entity as the body, also for updates
+)
+
+// parsePreferReturn gets the supported "return" preference from the Prefer headers, or empty if none.
+func parsePreferReturn(headers []string) string {
+	for _, header := range headers {
+		for _, preference := range strings.Split(header, ",") {
+			// Ignore params, e.g. "return=minimal; foo=bar"
+			preference = strings.TrimSpace(strings.SplitN(preference, ";", 2)[0])
+			name, value, found := strings.Cut(preference, "=")
+			if !found || !strings.EqualFold(strings.TrimSpace(name), "return") {
+				continue
+			}
+			value = strings.ToLower(strings.Trim(strings.TrimSpace(value), "\""))
+			if value == preferMinimal || value == preferRepresentation {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// isWriteMethod checks if the method is POST, PUT or DELETE, which the "return" preference applies to.
+func isWriteMethod(method string) bool {
+	return method == "POST" || method == "PUT" || method == "DELETE"
+}
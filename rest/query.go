@@ -0,0 +1,139 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ListQueryer may be implemented by list handler types to support the generic
+// ?filter[<field>]=<value> and ?sort=<field>,-<field> query params (and
+// ?modified-since=<time> if updated_at is one of the fields). The receiver
+// checks them against the allowed fields and provides them as ListFilterArgs
+// and ListOrderBy in the request, ready for the db package.
+type ListQueryer interface {
+	// ListQueryFields maps the JSON field names which may be filtered and sorted on to DB columns.
+	ListQueryFields() map[string]string
+}
+
+// parseListQuery parses the generic filter and sort query params into the request.
+func parseListQuery(request *Request, fields map[string]string) Result {
+	var problems []string
+
+	// Sort keys to keep the query stable
+	var keys []string
+	for key := range request.QueryArgs {
+		if strings.HasPrefix(key, "filter[") && strings.HasSuffix(key, "]") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		field := strings.TrimSuffix(strings.TrimPrefix(key, "filter["), "]")
+		column, ok := fields[field]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("can't filter on %v", field))
+			continue
+		}
+		request.ListFilterArgs = append(request.ListFilterArgs, fmt.Sprintf("\"%s\"", column), "=", request.QueryArgs[key])
+	}
+
+	// "updated-since" is the old name
+	for _, param := range []string{"modified-since", "updated-since"} {
+		sinceValue, ok := request.QueryArgs[param]
+		if !ok {
+			continue
+		}
+		column, ok := fields["updated_at"]
+		since, err := time.Parse(time.RFC3339, sinceValue)
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("can't filter on %v", param))
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%v must be an RFC 3339 time", param))
+		default:
+			request.ListFilterArgs = append(request.ListFilterArgs, fmt.Sprintf("\"%s\"", column), ">", since)
+		}
+	}
+
+	if sortValue, ok := request.QueryArgs["sort"]; ok && sortValue != "" {
+		var orderParts []string
+		for _, field := range strings.Split(sortValue, ",") {
+			direction := "ASC"
+			if strings.HasPrefix(field, "-") {
+				direction = "DESC"
+				field = strings.TrimPrefix(field, "-")
+			}
+			column, ok := fields[field]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("can't sort on %v", field))
+				continue
+			}
+			orderParts = append(orderParts, fmt.Sprintf("\"%s\" %s", column, direction))
+		}
+		request.ListOrderBy = strings.Join(orderParts, ", ")
+	}
+
+	if len(problems) > 0 {
+		return ValidationFailedResult(problems)
+	}
+	return Result{}
+}
+
+// sparseFields keeps only the provided top-level JSON fields of the data (or of each element, for lists).
+func sparseFields(data interface{}, fields []string) (interface{}, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(body)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	keep := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		keep[strings.TrimSpace(field)] = true
+	}
+	prune := func(value interface{}) {
+		if object, ok := value.(map[string]interface{}); ok {
+			for key := range object {
+				if !keep[key] {
+					delete(object, key)
+				}
+			}
+		}
+	}
+	if list, ok := generic.([]interface{}); ok {
+		for _, element := range list {
+			prune(element)
+		}
+	} else {
+		prune(generic)
+	}
+	return generic, nil
+}
@@ -39,29 +39,49 @@ don't have to.
 package rest
 
 import (
+	"context"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gathering/tech-online-backend/config"
-	"github.com/google/uuid"
+	"github.com/gathering/tech-online-backend/db"
 	log "github.com/sirupsen/logrus"
 )
 
+// redactedQueryParams are query params with secrets, hidden when logging URLs (see RedactQueryParam).
+var redactedQueryParams []string
+
+// DefaultAPIVersion is the API version served by the legacy unversioned paths.
+const DefaultAPIVersion = "v1"
+
+// apiVersionPattern is the format of API versions, used as the first path element after the site prefix.
+var apiVersionPattern = regexp.MustCompile(`^v[0-9]+$`)
+
 type receiver struct {
 	pathPattern regexp.Regexp
 	allocator   Allocator
+	cache       *responseCache // Only for cached handlers
+	idempotent  bool           // Honors idempotency keys for POSTs
+	version     string         // Only for this API version, or empty for all versions
 }
 
 type receiverSet struct {
 	pathPrefix string
+	version    string // The API version served, set when served
 	receivers  []receiver
 }
 
@@ -69,14 +89,30 @@ type receiverSet struct {
 var receiverSets map[string]*receiverSet
 
 type input struct {
-	requestID  uuid.UUID
-	url        *url.URL
-	pathPrefix string
-	pathSuffix string
-	method     string
-	data       []byte
-	query      map[string][]string
-	pretty     bool
+	requestID      string
+	log            *log.Entry // Logger with the request ID attached
+	url            *url.URL
+	pathPrefix     string
+	pathSuffix     string
+	method         string
+	data           []byte
+	body           io.Reader // Unread body, only for stream handlers
+	contentType    string
+	acceptLanguage string
+	origin         string
+	acceptEncoding string
+	accept         string
+	query          map[string][]string
+	pretty         bool
+	idempotencyKey string
+	ifNoneMatch    string
+	ifMatch        string
+	eventID        string
+	apiVersion     string
+	tx             *sql.Tx // Only for batches in a transaction
+	httpRequest    *http.Request
+	clientIP       string
+	prefer         string // The "return" preference from the Prefer header, if any
 }
 
 type output struct {
@@ -84,12 +120,31 @@ type output struct {
 	data         interface{}
 	location     string
 	cachecontrol string
+	etag         string // Overrides the ETag computed from the body
+	headerOnly   bool   // For HEAD answered without the data (see HeadGetter), so the length is unknown
 }
 
 // AddHandler registeres an allocator/data structure with a url. The
 // allocator should be a function returning an empty datastrcuture which
 // implements one or more of gondulapi.Getter, Putter, Poster and Deleter
 func AddHandler(pathPrefix string, pathPattern string, allocator Allocator) error {
+	return addReceiver("", pathPrefix, pathPattern, allocator, nil, false)
+}
+
+// AddVersionedHandler is like AddHandler, but only for a single API version (e.g. "v2"). Handlers are
+// served under "/<version>" after the site prefix, and the default version also at the unversioned path.
+// Versioned handlers take precedence over unversioned handlers (served for all versions) for the same path,
+// so a version may replace the data structure for an endpoint while the rest stays shared.
+func AddVersionedHandler(version string, pathPrefix string, pathPattern string, allocator Allocator) error {
+	if !apiVersionPattern.MatchString(version) {
+		err := fmt.Errorf("invalid API version: %v", version)
+		log.WithError(err).Error("failed to add versioned handler")
+		return err
+	}
+	return addReceiver(version, pathPrefix, pathPattern, allocator, nil, false)
+}
+
+func addReceiver(version string, pathPrefix string, pathPattern string, allocator Allocator, cache *responseCache, idempotent bool) error {
 	if receiverSets == nil {
 		receiverSets = make(map[string]*receiverSet)
 	}
@@ -112,7 +167,7 @@ func AddHandler(pathPrefix string, pathPattern string, allocator Allocator) erro
 		return err
 	}
 
-	receiver := receiver{*compiledPathPattern, allocator}
+	receiver := receiver{*compiledPathPattern, allocator, cache, idempotent, version}
 	set.receivers = append(set.receivers, receiver)
 	return nil
 }
@@ -125,49 +180,90 @@ type Allocator func() interface{}
 // returns.
 func StartReceiver() {
 	var server http.Server
-	serveMux := http.NewServeMux()
-	server.Handler = serveMux
+	server.Handler = NewHandler()
+	applyServerTimeouts(&server)
 	server.Addr = ":8080"
-	if config.Config.ListenAddress != "" {
-		server.Addr = config.Config.ListenAddress
+	if config.Get().ListenAddress != "" {
+		server.Addr = config.Get().ListenAddress
+	}
+
+	// Serve HTTPS directly if configured
+	useTLS := tlsEnabled()
+	if useTLS {
+		server.TLSConfig = newTLSConfig(&certificateLoader{})
+		if config.Get().TLS.RedirectAddress != "" {
+			startRedirectListener(config.Get().TLS.RedirectAddress, server.Addr)
+		}
 	}
 
+	log.WithFields(log.Fields{
+		"listen_address": server.Addr,
+		"path_prefix":    config.Get().SitePrefix,
+		"api_versions":   apiVersions(),
+		"tls":            useTLS,
+	}).Info("Server is listening")
+	if useTLS {
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(server.ListenAndServe())
+}
+
+// NewHandler creates the HTTP handler for all registered handlers (below the site prefix) and the
+// health endpoints. StartReceiver serves it, but it may also be used directly, e.g. with httptest.
+func NewHandler() http.Handler {
+	serveMux := http.NewServeMux()
+
 	// Default handler, for consistent 404s
 	defaultReceiverSet := receiverSet{pathPrefix: "/"}
 	serveMux.Handle("/", defaultReceiverSet)
 
-	// Receiver handlers
+	// Health endpoints, outside the site prefix for load balancers and watchdogs
+	serveMux.HandleFunc("/healthz", handleLiveness)
+	serveMux.HandleFunc("/readyz", handleReadiness)
+
+	// Receiver handlers, for every API version and at the legacy unversioned paths for the default version
+	versions := apiVersions()
 	for _, set := range receiverSets {
-		set.pathPrefix = config.Config.SitePrefix + set.pathPrefix
-		serveMux.Handle(set.pathPrefix, set)
+		legacySet := *set
+		legacySet.pathPrefix = config.Get().SitePrefix + set.pathPrefix
+		legacySet.version = DefaultAPIVersion
+		serveMux.Handle(legacySet.pathPrefix, legacySet)
+		for _, version := range versions {
+			versionedSet := *set
+			versionedSet.pathPrefix = config.Get().SitePrefix + "/" + version + set.pathPrefix
+			versionedSet.version = version
+			serveMux.Handle(versionedSet.pathPrefix, versionedSet)
+		}
 		for _, receiver := range set.receivers {
-			log.Infof("Added receiver [%v][%v]' for [%T].", set.pathPrefix, receiver.pathPattern.String(), receiver.allocator())
+			version := receiver.version
+			if version == "" {
+				version = "all"
+			}
+			log.Infof("Added receiver [%v][%v] (version %v) for [%T].", set.pathPrefix, receiver.pathPattern.String(), version, receiver.allocator())
 		}
 	}
-
-	log.WithFields(log.Fields{
-		"listen_address": server.Addr,
-		"path_prefix":    config.Config.SitePrefix,
-	}).Info("Server is listening")
-	log.Fatal(server.ListenAndServe())
+	return normalizePaths(serveMux)
 }
 
 func (set receiverSet) ServeHTTP(httpWriter http.ResponseWriter, httpRequest *http.Request) {
-	requestID := uuid.New()
-	log.WithFields(log.Fields{
-		"id":     requestID,
-		"url":    httpRequest.URL,
+	begin := time.Now()
+	requestID := getRequestID(httpRequest)
+	requestLog := log.WithField("request_id", requestID)
+	requestLog.WithFields(log.Fields{
+		"url":    redactedURL(httpRequest.URL),
 		"method": httpRequest.Method,
 		"client": httpRequest.RemoteAddr,
 	}).Infof("Request")
+	httpWriter.Header().Set(requestIDHeader, requestID)
 
-	// Process request content
-	input, err := processInput(httpRequest, set.pathPrefix, requestID)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"data": string(input.data),
-			"err":  err,
-		}).Warn("Failed to process request input")
+	// Process request metadata
+	input := processInput(httpRequest, set.pathPrefix, requestID)
+	input.log = requestLog
+	input.apiVersion = set.version
+
+	// Answer CORS preflight requests without involving handlers
+	if isPreflightRequest(httpRequest) {
+		handlePreflightRequest(httpWriter, httpRequest, set.allowedMethods(input))
 		return
 	}
 
@@ -177,39 +273,231 @@ func (set receiverSet) ServeHTTP(httpWriter http.ResponseWriter, httpRequest *ht
 	purgeExpiredAccessTokens()
 
 	// Load access token entry (if any valid) and user (if any associated)
-	token := getRequestAccessToken(httpRequest)
+	token, lockout := getRequestAccessToken(httpRequest, input.log)
+	if lockout > 0 {
+		httpWriter.Header().Set("Retry-After", strconv.Itoa(int(lockout.Seconds())+1))
+		output := processOutput(input, Result{Code: 429, Message: "too many failed authentication attempts, try again later"}, nil)
+		responseBytes := sendResponse(httpWriter, input, output)
+		recordRequest(input, token, output.code, begin, responseBytes)
+		return
+	}
 
 	// Find matching receiver
-	var foundReceiver *receiver
-	for _, receiver := range set.receivers {
-		if receiver.pathPattern.MatchString(input.pathSuffix) {
-			log.WithFields(log.Fields{
-				"prefix":  set.pathPrefix,
-				"pattern": receiver.pathPattern.String(),
-			}).Trace("Found receiver")
-			foundReceiver = &receiver
-			break
+	foundReceiver := set.findReceiver(input)
+	if foundReceiver != nil {
+		input.log.WithFields(log.Fields{
+			"prefix":  set.pathPrefix,
+			"pattern": foundReceiver.pathPattern.String(),
+			"version": set.version,
+		}).Trace("Found receiver")
+	}
+
+	// Limit the request body, rejecting bodies declared too large without reading them
+	if !limitRequestBody(foundReceiver, httpRequest) {
+		sendTooLarge(httpWriter, input, token, begin)
+		return
+	}
+	input.body = httpRequest.Body
+
+	// Read request content, unless the handler wants to stream it
+	if foundReceiver == nil || !foundReceiver.streamsInput(input.method) {
+		if err := readInputData(httpRequest, &input); err != nil {
+			if errors.Is(err, errRequestBodyTooLarge) {
+				sendTooLarge(httpWriter, input, token, begin)
+				return
+			}
+			input.log.WithFields(log.Fields{
+				"data": string(input.data),
+				"err":  err,
+			}).Warn("Failed to process request input")
+			return
+		}
+		if err := decodeInputData(&input); err != nil {
+			output := processOutput(input, BadRequest(fmt.Sprintf("failed to decode request body: %v", err)), nil)
+			responseBytes := sendResponse(httpWriter, input, output)
+			recordRequest(input, token, output.code, begin, responseBytes)
+			return
 		}
 	}
 
-	// Handle request at appropriate endpoints
-	result, data := handleRequest(foundReceiver, input, token)
+	// Let upgrading handlers (e.g. WebSockets) take over the connection
+	if foundReceiver != nil && input.method == "GET" {
+		if upgrader, ok := foundReceiver.allocator().(Upgrader); ok {
+			request := makeRequest(foundReceiver, input, token)
+			upgrader.Upgrade(&request, httpWriter, httpRequest)
+			return
+		}
+	}
+
+	// Answer unchanged responses without handling the request, if the handler can tell cheaply
+	var cheapETag string
+	if foundReceiver != nil {
+		cheapETag = foundReceiver.cheapETag(input, token)
+		if cheapETag != "" && etagMatches(input.ifNoneMatch, cheapETag) {
+			responseBytes := sendResponse(httpWriter, input, output{code: 304, etag: cheapETag})
+			recordRequest(input, token, 304, begin, responseBytes)
+			return
+		}
+	}
 
-	// Process output
-	output := processOutput(input, result, data)
+	// Use cached output if possible, or handle request at appropriate endpoints and process output
+	var output output
+	var cached bool
+	if foundReceiver != nil {
+		output, cached = foundReceiver.cache.get(input, token)
+	}
+	// Answer HEADs without loading the data, if the handler can (see HeadGetter)
+	headerOnly := false
+	if !cached && cheapETag != "" && input.method == "HEAD" {
+		output, headerOnly = foundReceiver.handleHeaderOnly(input, token)
+	}
+	if !cached && !headerOnly {
+		var idempotent bool
+		if output, idempotent = handleIdempotentRequest(foundReceiver, input, token); !idempotent {
+			result, data := handleRequest(foundReceiver, input, token)
+			output = processOutput(input, result, data)
+			if !token.IsAuthenticated() {
+				output = anonymizeGuestOutput(input, output)
+			}
+		}
+		if foundReceiver != nil {
+			foundReceiver.cache.put(input, token, output)
+		}
+	}
 
 	// Create response
-	sendResponse(httpWriter, input, output)
+	if cheapETag != "" && output.code == 200 {
+		output.etag = cheapETag
+	}
+	if input.prefer != "" && isWriteMethod(input.method) {
+		httpWriter.Header().Set("Preference-Applied", "return="+input.prefer)
+	}
+	if output.code == 405 || input.method == "OPTIONS" {
+		if methods := set.allowedMethods(input); len(methods) > 0 {
+			httpWriter.Header().Set("Allow", strings.Join(methods, ", "))
+		}
+	}
+	responseBytes := sendResponse(httpWriter, input, output)
+	recordRequest(input, token, output.code, begin, responseBytes)
 }
 
-func getRequestAccessToken(httpRequest *http.Request) AccessTokenEntry {
+// sendTooLarge responds with a 413 and closes the connection, so the rest of the body isn't read.
+func sendTooLarge(httpWriter http.ResponseWriter, input input, token AccessTokenEntry, begin time.Time) {
+	httpWriter.Header().Set("Connection", "close")
+	output := processOutput(input, tooLargeResult(), nil)
+	responseBytes := sendResponse(httpWriter, input, output)
+	recordRequest(input, token, output.code, begin, responseBytes)
+}
+
+// findReceiver finds the receiver for the request path and method, for the API version of the set.
+// Receivers for the specific version are preferred over receivers for all versions. If multiple receivers
+// match the path, the first one implementing the method is preferred.
+func (set receiverSet) findReceiver(input input) *receiver {
+	var foundReceiver *receiver
+	for _, versionSpecific := range []bool{true, false} {
+		for i := range set.receivers {
+			receiver := &set.receivers[i]
+			if (receiver.version != "") != versionSpecific || (versionSpecific && receiver.version != set.version) {
+				continue
+			}
+			if !receiver.pathPattern.MatchString(input.pathSuffix) {
+				continue
+			}
+			if foundReceiver == nil {
+				foundReceiver = receiver
+			}
+			if receiver.supportsMethod(input.method) {
+				return receiver
+			}
+		}
+	}
+	return foundReceiver
+}
+
+// allowedMethods finds the methods implemented by any receiver matching the path (plus OPTIONS), for the Allow header.
+// Returns nil if no receiver matches.
+func (set receiverSet) allowedMethods(input input) []string {
+	implemented := make(map[string]bool)
+	for _, receiver := range set.receivers {
+		if receiver.version != "" && receiver.version != set.version {
+			continue
+		}
+		if !receiver.pathPattern.MatchString(input.pathSuffix) {
+			continue
+		}
+		for _, method := range implementedMethods(receiver.allocator()) {
+			implemented[method] = true
+		}
+		implemented["OPTIONS"] = true
+	}
+	if len(implemented) == 0 {
+		return nil
+	}
+	var methods []string
+	for _, method := range []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"} {
+		if implemented[method] {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// apiVersions returns all API versions with handlers, sorted, always including the default version.
+func apiVersions() []string {
+	versionSet := map[string]bool{DefaultAPIVersion: true}
+	for _, set := range receiverSets {
+		for _, receiver := range set.receivers {
+			if receiver.version != "" {
+				versionSet[receiver.version] = true
+			}
+		}
+	}
+	versions := make([]string, 0, len(versionSet))
+	for version := range versionSet {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		iNumber, _ := strconv.Atoi(versions[i][1:])
+		jNumber, _ := strconv.Atoi(versions[j][1:])
+		return iNumber < jNumber
+	})
+	return versions
+}
+
+// getRequestAccessToken gets the access token for the request, or a guest token if none or invalid.
+// If the client is locked out for presenting too many invalid keys, the remaining lockout is returned instead.
+func getRequestAccessToken(httpRequest *http.Request, requestLog *log.Entry) (AccessTokenEntry, time.Duration) {
 	var token *AccessTokenEntry
+	var tokenKeys []string
 	authHeader, authHeaderFound := httpRequest.Header["Authorization"]
 	if authHeaderFound {
 		authHeaderFields := strings.Fields(authHeader[0])
 		if len(authHeaderFields) == 2 && strings.ToLower(authHeaderFields[0]) == "bearer" {
-			tokenKey := authHeaderFields[1]
-			token = loadAccessTokenByKey(tokenKey)
+			tokenKeys = append(tokenKeys, authHeaderFields[1])
+		}
+	}
+	// Services may sign requests or use client certificates instead
+	if serviceToken, lockout := getServiceAccessToken(httpRequest, requestLog); lockout > 0 {
+		return makeGuestAccessToken(), lockout
+	} else if serviceToken != nil {
+		token = serviceToken
+		recordAccessTokenUsage(token)
+	}
+	for _, tokenKey := range tokenKeys {
+		if token != nil {
+			break
+		}
+		var tokenErr error
+		token, tokenErr = loadAccessTokenByKey(tokenKey)
+		if token != nil {
+			recordAccessTokenUsage(token)
+			break
+		}
+		// Only invalid keys are counted and blocked, so valid clients behind the same address aren't locked out
+		if tokenErr == nil {
+			if lockout := failAuth(authLockoutKeys(httpRequest), requestLog); lockout > 0 {
+				return makeGuestAccessToken(), lockout
+			}
 		}
 	}
 	// Ignore illegal or malformed token, just give them a guest token instead of complaining
@@ -217,19 +505,59 @@ func getRequestAccessToken(httpRequest *http.Request) AccessTokenEntry {
 		guestToken := makeGuestAccessToken()
 		token = &guestToken
 	}
-	log.WithFields(log.Fields{
+	requestLog.WithFields(log.Fields{
 		"token":   token.ID,
 		"role":    token.GetRole(),
 		"comment": token.Comment,
 	}).Trace("Using access token")
 
-	return *token
+	return *token, 0
+}
+
+// requestEventID resolves the event the request is scoped to, from the "event" query param,
+// the hostname or the default event. Empty means all events.
+func requestEventID(httpRequest *http.Request) string {
+	if eventID := httpRequest.URL.Query().Get("event"); eventID != "" {
+		return eventID
+	}
+	host := httpRequest.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if eventID, ok := config.Get().EventHostnames[strings.ToLower(host)]; ok {
+		return eventID
+	}
+	return config.Get().DefaultEvent
+}
+
+// RedactQueryParam hides the query param when logging URLs, for handlers accepting secrets in the URL
+// (like calendar feed tokens). Must be called before serving, e.g. from init().
+func RedactQueryParam(name string) {
+	redactedQueryParams = append(redactedQueryParams, name)
+}
+
+// redactedURL returns the URL with any secret query params hidden, for logging.
+func redactedURL(requestURL *url.URL) string {
+	query := requestURL.Query()
+	redact := false
+	for _, name := range redactedQueryParams {
+		if query.Get(name) != "" {
+			query.Set(name, "redacted")
+			redact = true
+		}
+	}
+	if !redact {
+		return requestURL.String()
+	}
+	redacted := *requestURL
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
 }
 
 // get is a badly named function in the context of HTTP since what it
 // really does is just read the body of a HTTP request. In my defence, it
 // used to do more. But what has it done for me lately?!
-func processInput(httpRequest *http.Request, pathPrefix string, requestID uuid.UUID) (input, error) {
+func processInput(httpRequest *http.Request, pathPrefix string, requestID string) input {
 	var input input
 	input.requestID = requestID
 	fullPath := httpRequest.URL.Path
@@ -243,40 +571,91 @@ func processInput(httpRequest *http.Request, pathPrefix string, requestID uuid.U
 	input.query = httpRequest.URL.Query()
 	input.method = httpRequest.Method
 	input.pretty = len(httpRequest.URL.Query()["pretty"]) > 0
+	input.body = httpRequest.Body
+	input.contentType = httpRequest.Header.Get("Content-Type")
+	input.acceptLanguage = httpRequest.Header.Get("Accept-Language")
+	input.origin = httpRequest.Header.Get("Origin")
+	input.acceptEncoding = httpRequest.Header.Get("Accept-Encoding")
+	input.accept = httpRequest.Header.Get("Accept")
+	input.idempotencyKey = httpRequest.Header.Get(idempotencyKeyHeader)
+	input.ifNoneMatch = httpRequest.Header.Get("If-None-Match")
+	input.ifMatch = httpRequest.Header.Get("If-Match")
+	input.eventID = requestEventID(httpRequest)
+	input.httpRequest = httpRequest
+	input.clientIP = clientIP(httpRequest)
+	input.prefer = parsePreferReturn(httpRequest.Header.Values("Prefer"))
 
-	// Process body
-	if httpRequest.ContentLength != 0 {
-		input.data = make([]byte, httpRequest.ContentLength)
+	return input
+}
 
-		if n, err := io.ReadFull(httpRequest.Body, input.data); err != nil {
-			log.WithFields(log.Fields{
-				"address":  httpRequest.RemoteAddr,
-				"error":    err,
-				"numbytes": n,
-			}).Error("Read error from client")
-			return input, fmt.Errorf("read failed: %v", err)
-		}
+// readInputData reads the full request body into the input data.
+func readInputData(httpRequest *http.Request, input *input) error {
+	if httpRequest.ContentLength == 0 {
+		return nil
+	}
+
+	var n int
+	var err error
+	if httpRequest.ContentLength > 0 {
+		input.data = make([]byte, httpRequest.ContentLength)
+		n, err = io.ReadFull(httpRequest.Body, input.data)
+	} else {
+		// Unknown length, e.g. chunked
+		input.data, err = io.ReadAll(httpRequest.Body)
+		n = len(input.data)
+	}
+	if err != nil {
+		input.log.WithFields(log.Fields{
+			"address":  httpRequest.RemoteAddr,
+			"error":    err,
+			"numbytes": n,
+		}).Error("Read error from client")
+		return fmt.Errorf("read failed: %w", err)
 	}
 
-	return input, nil
+	return nil
 }
 
-// handle figures out what Method the input has, casts item to the correct
-// interface and calls the relevant function, if any, for that data. For
-// PUT and POST it also parses the input data.
-func handleRequest(receiver *receiver, input input, accessToken AccessTokenEntry) (result Result, data interface{}) {
-	// No handler
-	if receiver == nil {
-		result.Code = 404
-		result.Message = "endpoint not found"
-		return
+// streamsInput checks if the data structure allocated by the receiver wants the raw request body for the HTTP method.
+func (receiver *receiver) streamsInput(method string) bool {
+	if method != "POST" {
+		return false
 	}
+	_, ok := receiver.allocator().(StreamPoster)
+	return ok
+}
 
-	// Prepare request object
+// supportsMethod checks if the data structure allocated by the receiver implements the HTTP method.
+func (receiver *receiver) supportsMethod(method string) bool {
+	if method == "OPTIONS" {
+		return true
+	}
+	for _, implemented := range implementedMethods(receiver.allocator()) {
+		if implemented == method {
+			return true
+		}
+	}
+	return false
+}
+
+// makeRequest prepares the request object for the handler.
+func makeRequest(receiver *receiver, input input, token AccessTokenEntry) Request {
 	var request Request
 	request.ID = input.requestID
+	request.Log = input.log
 	request.Method = input.method
-	request.AccessToken = accessToken
+	request.AccessToken = token
+	request.ContentType = input.contentType
+	request.AcceptLanguage = input.acceptLanguage
+	request.EventID = input.eventID
+	request.APIVersion = input.apiVersion
+	request.Tx = input.tx
+	request.ClientIP = input.clientIP
+	request.HTTPRequest = input.httpRequest
+	request.Context = context.Background()
+	if input.httpRequest != nil {
+		request.Context = input.httpRequest.Context()
+	}
 	request.PathArgs = make(map[string]string)
 	argCaptures := receiver.pathPattern.FindStringSubmatch(input.pathSuffix)
 	argCaptureNames := receiver.pathPattern.SubexpNames()
@@ -305,32 +684,59 @@ func handleRequest(receiver *receiver, input input, accessToken AccessTokenEntry
 		request.ListBrief = true
 	}
 
+	return request
+}
+
+// handle figures out what Method the input has, casts item to the correct
+// interface and calls the relevant function, if any, for that data. For
+// PUT and POST it also parses the input data.
+func handleRequest(receiver *receiver, input input, accessToken AccessTokenEntry) (result Result, data interface{}) {
+	// No handler
+	if receiver == nil {
+		result.Code = 404
+		result.Message = "endpoint not found"
+		return
+	}
+
+	// Prepare request object
+	request := makeRequest(receiver, input, accessToken)
+
+	// Hide fields not visible to the requester from the returned data
+	defer func() {
+		redactData(data, &accessToken)
+	}()
+
 	// Find handler and handle
 	item := receiver.allocator()
 	switch input.method {
 	case "OPTIONS":
-	case "HEAD":
+	case "GET", "HEAD":
+		// HEAD needs the data too, for the ETag and length, but the body is never built or sent
 		get, ok := item.(Getter)
 		if !ok {
 			result.Code = 405
 			result.Message = "method not allowed for endpoint"
 			return
 		}
-		result = get.Get(&request)
-		data = nil
-	case "GET":
-		get, ok := item.(Getter)
-		if !ok {
-			result.Code = 405
-			result.Message = "method not allowed for endpoint"
-			return
+		if queryer, ok := item.(ListQueryer); ok {
+			if result = parseListQuery(&request, queryer.ListQueryFields()); !result.IsOk() {
+				return
+			}
 		}
 		result = get.Get(&request)
 		data = get
 	case "POST":
+		if streamPost, ok := item.(StreamPoster); ok {
+			result = streamPost.PostStream(&request, input.body)
+			data = streamPost
+			if isBodyTooLarge(input.body) {
+				result = tooLargeResult()
+			}
+			return
+		}
 		if len(input.data) > 0 {
 			if err := json.Unmarshal(input.data, &item); err != nil {
-				log.WithError(err).Trace("Failed to unmarshal JSON for endpoint")
+				input.log.WithError(err).Trace("Failed to unmarshal JSON for endpoint")
 				result.Code = 400
 				result.Message = "malformed data for endpoint"
 				return
@@ -342,12 +748,19 @@ func handleRequest(receiver *receiver, input input, accessToken AccessTokenEntry
 			result.Message = "method not allowed for endpoint"
 			return
 		}
+		if problems := Validate(item); len(problems) > 0 {
+			result = ValidationFailedResult(problems)
+			return
+		}
 		result = post.Post(&request)
 		data = post
+		if entity, ok := loadCreatedEntity(&request, result); ok {
+			data = entity
+		}
 	case "PUT":
 		if len(input.data) > 0 {
 			if err := json.Unmarshal(input.data, &item); err != nil {
-				log.WithError(err).Trace("Failed to unmarshal JSON for endpoint")
+				input.log.WithError(err).Trace("Failed to unmarshal JSON for endpoint")
 				result.Code = 400
 				result.Message = "malformed data for endpoint"
 				return
@@ -359,7 +772,22 @@ func handleRequest(receiver *receiver, input input, accessToken AccessTokenEntry
 			result.Message = "method not allowed for endpoint"
 			return
 		}
+		if problems := Validate(item); len(problems) > 0 {
+			result = ValidationFailedResult(problems)
+			return
+		}
+		if result = checkIfMatch(receiver, input, accessToken, item); !result.IsOk() {
+			return
+		}
 		result = put.Put(&request)
+		if entity, ok := loadCreatedEntity(&request, result); ok {
+			data = entity
+		} else if input.prefer == preferRepresentation && result.IsOk() && result.Code != 204 {
+			// Get the updated entity from the same path
+			if entity, ok := loadEntity(&request, input.pathPrefix+input.pathSuffix); ok {
+				data = entity
+			}
+		}
 	case "DELETE":
 		del, ok := item.(Deleter)
 		if !ok {
@@ -367,6 +795,20 @@ func handleRequest(receiver *receiver, input input, accessToken AccessTokenEntry
 			result.Message = "method not allowed for endpoint"
 			return
 		}
+		if isDryRun(input) {
+			previewer, ok := item.(DeletePreviewer)
+			if !ok {
+				result.Code = 400
+				result.Message = "dry-run not supported for endpoint"
+				return
+			}
+			var affected map[string]int
+			affected, result = previewer.PreviewDelete(&request)
+			if result.IsOk() {
+				data = DeletePreview{DryRun: true, Affected: affected}
+			}
+			return
+		}
 		result = del.Delete(&request)
 	default:
 		result.Code = 405
@@ -377,9 +819,57 @@ func handleRequest(receiver *receiver, input input, accessToken AccessTokenEntry
 	return
 }
 
+// loadCreatedEntity gets the entity created by a POST or PUT with a 201 and a location within the API (see loadEntity).
+// Returns false if not created or if it can't be loaded.
+func loadCreatedEntity(request *Request, result Result) (interface{}, bool) {
+	if result.Code != 201 || result.Location == "" {
+		return nil, false
+	}
+	return loadEntity(request, result.Location)
+}
+
+// loadEntity gets the entity at the location within the API (including the site prefix), like a GET of it with the
+// same access token, so the response contains it as stored (with e.g. the generated ID and defaults).
+// Returns false if the GET fails, e.g. if the entity isn't visible to the requester.
+func loadEntity(request *Request, location string) (interface{}, bool) {
+	locationURL, err := url.Parse(location)
+	if err != nil || locationURL.IsAbs() || !strings.HasPrefix(locationURL.Path, config.Get().SitePrefix+"/") {
+		return nil, false
+	}
+	locationURL.Path = strings.TrimPrefix(locationURL.Path, config.Get().SitePrefix)
+	operation := BatchOperation{Method: "GET", Path: locationURL.String()}
+	getInput, getReceiver, getResult := batchOperationInput(request, 0, &operation, nil)
+	if !getResult.IsOk() {
+		return nil, false
+	}
+	getInput.log = request.Log
+	getResult, entity := handleRequest(getReceiver, getInput, request.AccessToken)
+	if !getResult.IsOk() || (getResult.Code != 0 && getResult.Code != 200) {
+		return nil, false
+	}
+	return entity, true
+}
+
+// isDryRun checks if the "dry-run" query param is set and not false.
+func isDryRun(input input) bool {
+	values, ok := input.query["dry-run"]
+	if !ok {
+		return false
+	}
+	for _, value := range values {
+		if value == "0" || strings.EqualFold(value, "false") {
+			return false
+		}
+	}
+	return true
+}
+
 func processOutput(input input, result Result, handlerData interface{}) (output output) {
+	if errors.Is(result.Error, db.ErrVersionConflict) {
+		result = Conflict("changed by someone else in the meantime, reload and try again")
+	}
 	if result.Error != nil {
-		log.WithError(result.Error).Warn("internal server error")
+		input.log.WithError(result.Error).Warn("internal server error")
 		result.Code = 500
 	}
 
@@ -420,8 +910,44 @@ func processOutput(input input, result Result, handlerData interface{}) (output
 		output.data = message("internal server error")
 	}
 
-	// OPTIONS and HEAD must never return data
-	if input.method == "OPTIONS" || input.method == "HEAD" {
+	// Paginate listings, only include the requested fields (if any) and wrap listings in an envelope (if requested)
+	if _, raw := output.data.(RawResponder); !raw && output.code == 200 && (input.method == "GET" || input.method == "HEAD") {
+		limit, offset := listPaging(input)
+		page, total, isList := paginate(output.data, limit, offset)
+		output.data = page
+		if exporter, ok := handlerData.(CSVExporter); ok && isList && exporter.CSVExport() && wantsCSV(input) {
+			encoded, err := encodeCSV(page)
+			if err == nil {
+				output.data = csvResponse(encoded)
+				return
+			}
+			input.log.WithError(err).Warn("Failed to encode CSV")
+		}
+		if fields, ok := input.query["fields"]; ok && len(fields) > 0 && fields[0] != "" {
+			if sparseData, err := sparseFields(output.data, strings.Split(fields[0], ",")); err == nil {
+				output.data = sparseData
+			} else {
+				input.log.WithError(err).Warn("Failed to apply sparse fieldset")
+			}
+		}
+		if isList && wantsEnvelope(input) {
+			output.data = collectionEnvelope{
+				Items:       output.data,
+				Total:       total,
+				Limit:       limit,
+				Offset:      offset,
+				GeneratedAt: time.Now(),
+			}
+		}
+	}
+
+	// Leave out the body of successful writes if the client prefers it
+	if input.prefer == preferMinimal && isWriteMethod(input.method) && output.code >= 200 && output.code <= 299 {
+		output.data = nil
+	}
+
+	// OPTIONS must never return data (HEAD data is used for headers only)
+	if input.method == "OPTIONS" {
 		output.data = nil
 	}
 
@@ -430,52 +956,205 @@ func processOutput(input input, result Result, handlerData interface{}) (output
 
 // answer replies to a HTTP request with the provided output, optionally
 // formatting the output prettily. It also calculates an ETag.
-func sendResponse(w http.ResponseWriter, input input, output output) {
-	log.WithFields(log.Fields{
+// Returns the number of body bytes sent.
+func sendResponse(w http.ResponseWriter, input input, output output) int {
+	input.log.WithFields(log.Fields{
 		"code":     output.code,
 		"location": output.location,
 	}).Trace("Request done")
 
 	code := output.code
+	head := input.method == "HEAD"
 
 	// Content
 	body := make([]byte, 0)
-	if output.data != nil {
+	etag := ""
+	bodyLength := 0
+	codec, codecContentType := responseCodec(input)
+	if rawData, ok := output.data.(RawResponder); ok {
+		contentType, rawBody, rawErr := rawData.RawResponse()
+		if rawErr != nil {
+			input.log.WithError(rawErr).Error("Failed to create raw response data")
+			code = 500
+		} else {
+			body = rawBody
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			if dispositioner, ok := rawData.(RawDispositioner); ok {
+				if disposition := dispositioner.ContentDisposition(); disposition != "" {
+					w.Header().Set("Content-Disposition", disposition)
+				}
+			}
+		}
+	} else if output.headerOnly {
+		// Only the status and cheap ETag are known, but the type is the same as for GET
+		if codec != nil {
+			w.Header().Set("Content-Type", codecContentType)
+		} else {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		}
+	} else if output.data != nil && head && codec == nil {
+		// Only the ETag and length are needed, so avoid building the body
+		var jsonErr error
+		etag, bodyLength, jsonErr = digestJSON(output.data, input.pretty)
+		if jsonErr != nil {
+			input.log.WithError(jsonErr).Error("Failed to marshal response data to JSON")
+			code = 500
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	} else if output.data != nil {
 		var jsonErr error
 		if input.pretty {
 			body, jsonErr = json.MarshalIndent(output.data, "", "  ")
 		} else {
 			body, jsonErr = json.Marshal(output.data)
 		}
+		contentType := "application/json; charset=utf-8"
+		if jsonErr == nil && codec != nil {
+			body, jsonErr = codec.FromJSON(body)
+			contentType = codecContentType
+		}
 		if jsonErr != nil {
-			log.WithError(jsonErr).Error("Failed to marshal response data to JSON")
+			input.log.WithError(jsonErr).Error("Failed to marshal response data")
 			code = 500
 			body = make([]byte, 0)
+		} else if codec == nil {
+			body = append(body, '\n')
 		}
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Type", contentType)
 	}
 
-	// CORS
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "*")
-	w.Header().Set("Access-Control-Max-Age", "300") // 5 minutes
+	// CORS (preflight requests are handled separately)
+	setCORSOriginHeaders(w, input.origin)
 
 	// Caching header
-	etagraw := sha256.Sum256(body)
-	etagstr := hex.EncodeToString(etagraw[:])
-	w.Header().Set("ETag", etagstr)
+	if etag == "" {
+		etagraw := sha256.Sum256(body)
+		etag = hex.EncodeToString(etagraw[:])
+		bodyLength = len(body)
+	}
+	if output.etag != "" {
+		etag = output.etag
+	}
+	w.Header().Set("ETag", etag)
+
+	// Unchanged
+	if code == 200 && (input.method == "GET" || head) && etagMatches(input.ifNoneMatch, etag) {
+		code = 304
+	}
+	if code == 304 {
+		w.WriteHeader(code)
+		return 0
+	}
 
 	// Redirect
 	if output.location != "" {
 		w.Header().Set("Location", output.location)
 	}
 
+	// Compression (not for HEAD, where the body is never sent)
+	if code != 204 && !head && len(body) > 0 {
+		body = compressResponseBody(w, input.acceptEncoding, body)
+	}
+
 	// Finalize head and add body
+	if head && code != 204 && !output.headerOnly {
+		w.Header().Set("Content-Length", strconv.Itoa(bodyLength))
+	}
 	w.WriteHeader(code)
-	if code != 204 {
-		fmt.Fprintf(w, "%s\n", body)
+	if code != 204 && !head {
+		written, _ := w.Write(body)
+		return written
+	}
+	return 0
+}
+
+// handleHeaderOnly answers HEAD requests to handlers implementing HeadGetter, without loading the data.
+// Only used when the cheap ETag is available, since the ETag would otherwise be that of the body.
+// The output is never cached, since the cache is shared with GET.
+func (receiver *receiver) handleHeaderOnly(input input, token AccessTokenEntry) (output, bool) {
+	headGetter, ok := receiver.allocator().(HeadGetter)
+	if !ok {
+		return output{}, false
+	}
+	request := makeRequest(receiver, input, token)
+	headOutput := processOutput(input, headGetter.Head(&request), nil)
+	if headOutput.code == 200 {
+		headOutput.data = nil
+		headOutput.headerOnly = true
+	}
+	return headOutput, true
+}
+
+// cheapETag gets the ETag for GET and HEAD requests to handlers implementing ETagger, or empty if not available.
+// The tag is combined with everything else the response depends on, like for the response cache.
+func (receiver *receiver) cheapETag(input input, token AccessTokenEntry) string {
+	if input.method != "GET" && input.method != "HEAD" {
+		return ""
+	}
+	tagger, ok := receiver.allocator().(ETagger)
+	if !ok {
+		return ""
+	}
+	request := makeRequest(receiver, input, token)
+	tag, ok := tagger.ETag(&request)
+	if !ok {
+		return ""
+	}
+	raw := sha256.Sum256([]byte(strings.Join([]string{tag, input.url.String(), input.eventID, token.ID.String(), input.acceptLanguage, input.accept}, "|")))
+	return hex.EncodeToString(raw[:])
+}
+
+// etagMatches checks if the If-None-Match header value contains the ETag (or "*").
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.Trim(strings.TrimPrefix(strings.TrimSpace(candidate), "W/"), `"`)
+		if candidate != "" && (candidate == "*" || candidate == etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// digestJSON computes the ETag and length of the JSON body for the data, without building the body.
+func digestJSON(data interface{}, pretty bool) (etag string, length int, err error) {
+	digest := digestWriter{hash: sha256.New()}
+	encoder := json.NewEncoder(&digest)
+	if pretty {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(data); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(digest.hash.Sum(nil)), digest.length, nil
+}
+
+// digestWriter hashes and counts everything written to it.
+type digestWriter struct {
+	hash   hash.Hash
+	length int
+}
+
+func (writer *digestWriter) Write(data []byte) (int, error) {
+	writer.hash.Write(data)
+	writer.length += len(data)
+	return len(data), nil
+}
+
+// WriteResult writes the result as a JSON response, for handlers writing
+// their own responses (like Upgrader) but failing before doing so.
+func WriteResult(httpWriter http.ResponseWriter, result Result) {
+	if result.Error != nil {
+		log.WithError(result.Error).Warn("internal server error")
+		result = Result{Code: 500, Message: "internal server error"}
+	}
+	if result.Code == 0 {
+		result.Code = 200
 	}
+	body, _ := json.Marshal(result)
+	httpWriter.Header().Set("Content-Type", "application/json; charset=utf-8")
+	httpWriter.WriteHeader(result.Code)
+	httpWriter.Write(append(body, '\n'))
 }
 
 // message is a convenience function
@@ -0,0 +1,60 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"github.com/gathering/tech-online-backend/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigReload is for reloading the config without restarting.
+type ConfigReload struct{}
+
+func init() {
+	AddHandler("/admin/", "^reload/$", func() interface{} { return &ConfigReload{} })
+}
+
+// ReloadConfig re-reads the config file and applies it, including static access tokens.
+// Settings which only apply at startup are kept, see config.ReloadConfig.
+// The static tokens are updated before the new config replaces the current one,
+// so if either fails, neither is applied.
+func ReloadConfig() error {
+	if err := config.ReloadConfig(updateStaticAccessTokens); err != nil {
+		return err
+	}
+	log.Info("Reloaded config")
+	return nil
+}
+
+// Post reloads the config.
+func (reload *ConfigReload) Post(request *Request) Result {
+	// Check perms
+	if request.AccessToken.GetRole() != RoleAdmin {
+		return UnauthorizedResult(request.AccessToken)
+	}
+
+	// Failing to parse the file is the admin's fault, the old config is kept
+	if err := ReloadConfig(); err != nil {
+		log.WithError(err).Warn("Failed to reload config")
+		return BadRequest("failed to reload config, keeping the current config")
+	}
+	return Result{}
+}
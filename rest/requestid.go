@@ -0,0 +1,47 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// requestIDHeader is used both for accepting request IDs from clients or proxies and for returning them.
+const requestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+// getRequestID returns the request ID from the request header if present and sane, or a new random one.
+func getRequestID(httpRequest *http.Request) string {
+	requestID := httpRequest.Header.Get(requestIDHeader)
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return uuid.New().String()
+	}
+	// Only allow printable ASCII, to avoid forging log lines and headers
+	for _, char := range requestID {
+		if char < 0x21 || char > 0x7e {
+			return uuid.New().String()
+		}
+	}
+	return requestID
+}
@@ -0,0 +1,349 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/worker"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	requestLogSinkFile = "file"
+	requestLogSinkDB   = "db"
+)
+
+const defaultRequestLogFilePath = "requests.log"
+const defaultRequestLogMaxSizeMB = 100
+const defaultRequestLogMaxFiles = 5
+const defaultRequestLogRetentionDays = 7
+
+// requestLogBufferSize is how many entries may wait for the DB before new ones are dropped.
+const requestLogBufferSize = 1000
+
+// requestLogPurgeInterval is how often old entries are purged from the DB.
+const requestLogPurgeInterval = 1 * time.Hour
+
+// RequestLogEntry is a single request in the access log.
+type RequestLogEntry struct {
+	ID            *uuid.UUID `column:"id" json:"id"`
+	Time          time.Time  `column:"time" json:"time"`
+	RequestID     string     `column:"request_id" json:"request_id"`
+	Method        string     `column:"method" json:"method"`
+	Path          string     `column:"path" json:"path"`   // With the query, access tokens redacted
+	TokenID       *uuid.UUID `column:"token" json:"token"` // Empty for guests
+	Role          Role       `column:"role" json:"role"`
+	Status        int        `column:"status" json:"status"`
+	LatencyMS     int64      `column:"latency_ms" json:"latency_ms"`
+	RequestBytes  int        `column:"request_bytes" json:"request_bytes"`
+	ResponseBytes int        `column:"response_bytes" json:"response_bytes"`
+}
+
+// RequestLog is a list of access log entries, newest first.
+type RequestLog []*RequestLogEntry
+
+// requestLogQueue feeds the DB sink, so requests never wait for the insert.
+var requestLogQueue = make(chan *RequestLogEntry, requestLogBufferSize)
+var requestLogWriterOnce sync.Once
+
+// requestLogFile is the open file for the file sink.
+var requestLogFile = struct {
+	sync.Mutex
+	path string
+	file *os.File
+	size int64
+}{}
+
+func init() {
+	AddHandler("/admin/", "^request-log/$", func() interface{} { return &RequestLog{} })
+	worker.AddTask("request-log-purge", requestLogPurgeInterval, purgeRequestLog)
+}
+
+// recordRequest adds the request to the access log, if enabled and sampled.
+func recordRequest(input input, token AccessTokenEntry, code int, begin time.Time, responseBytes int) {
+	logConfig := config.Get().RequestLog
+	if logConfig.Sink == "" {
+		return
+	}
+	if logConfig.SamplePercent > 0 && logConfig.SamplePercent < 100 && rand.Intn(100) >= logConfig.SamplePercent {
+		return
+	}
+
+	entryID := uuid.New()
+	entry := RequestLogEntry{
+		ID:            &entryID,
+		Time:          begin,
+		RequestID:     input.requestID,
+		Method:        input.method,
+		Path:          redactedURL(input.url),
+		Role:          token.GetRole(),
+		Status:        code,
+		LatencyMS:     time.Since(begin).Milliseconds(),
+		RequestBytes:  len(input.data),
+		ResponseBytes: responseBytes,
+	}
+	if token.ID != uuid.Nil {
+		tokenID := token.ID
+		entry.TokenID = &tokenID
+	}
+
+	switch logConfig.Sink {
+	case requestLogSinkFile:
+		if err := writeRequestLogFile(logConfig, &entry); err != nil {
+			input.log.WithError(err).Warn("Failed to write request log")
+		}
+	case requestLogSinkDB:
+		requestLogWriterOnce.Do(func() { go insertRequestLogEntries() })
+		select {
+		case requestLogQueue <- &entry:
+		default:
+			input.log.Warn("Request log queue full, dropping entry")
+		}
+	}
+}
+
+// insertRequestLogEntries saves queued entries to the DB, forever.
+func insertRequestLogEntries() {
+	for entry := range requestLogQueue {
+		if dbResult := db.Insert("request_log", entry); dbResult.IsFailed() {
+			log.WithError(dbResult.Error).Warn("Failed to save request log entry")
+		}
+	}
+}
+
+// writeRequestLogFile appends the entry as a JSON line, rotating the file when it gets too large.
+func writeRequestLogFile(logConfig config.RequestLogConfig, entry *RequestLogEntry) error {
+	line, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	line = append(line, '\n')
+	path := requestLogFilePath(logConfig)
+	maxSizeMB := logConfig.MaxSizeMB
+	if maxSizeMB == 0 {
+		maxSizeMB = defaultRequestLogMaxSizeMB
+	}
+
+	requestLogFile.Lock()
+	defer requestLogFile.Unlock()
+	if requestLogFile.file != nil && (requestLogFile.path != path || requestLogFile.size+int64(len(line)) > int64(maxSizeMB)*1024*1024) {
+		requestLogFile.file.Close()
+		requestLogFile.file = nil
+		if requestLogFile.path == path {
+			if err := rotateRequestLogFiles(logConfig, path); err != nil {
+				return err
+			}
+		}
+	}
+	if requestLogFile.file == nil {
+		file, openErr := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if openErr != nil {
+			return openErr
+		}
+		info, statErr := file.Stat()
+		if statErr != nil {
+			file.Close()
+			return statErr
+		}
+		requestLogFile.path = path
+		requestLogFile.file = file
+		requestLogFile.size = info.Size()
+	}
+	written, writeErr := requestLogFile.file.Write(line)
+	requestLogFile.size += int64(written)
+	return writeErr
+}
+
+// rotateRequestLogFiles renames the file to "<path>.1", shifting older ones up and removing the oldest.
+func rotateRequestLogFiles(logConfig config.RequestLogConfig, path string) error {
+	maxFiles := logConfig.MaxFiles
+	if maxFiles == 0 {
+		maxFiles = defaultRequestLogMaxFiles
+	}
+	os.Remove(fmt.Sprintf("%v.%v", path, maxFiles))
+	for i := maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%v.%v", path, i), fmt.Sprintf("%v.%v", path, i+1))
+	}
+	return os.Rename(path, path+".1")
+}
+
+func requestLogFilePath(logConfig config.RequestLogConfig) string {
+	if logConfig.FilePath == "" {
+		return defaultRequestLogFilePath
+	}
+	return logConfig.FilePath
+}
+
+// purgeRequestLog deletes DB entries older than the retention.
+func purgeRequestLog() {
+	logConfig := config.Get().RequestLog
+	if logConfig.Sink != requestLogSinkDB {
+		return
+	}
+	retentionDays := logConfig.RetentionDays
+	if retentionDays == 0 {
+		retentionDays = defaultRequestLogRetentionDays
+	}
+	if dbResult := db.Delete("request_log", "time", "<", time.Now().AddDate(0, 0, -retentionDays)); dbResult.IsFailed() {
+		log.WithError(dbResult.Error).Error("Failed to purge request log")
+	}
+}
+
+// CSVExport allows the access log entries to be listed as CSV.
+func (requestLog *RequestLog) CSVExport() bool {
+	return true
+}
+
+// Get gets access log entries, newest first, filtered by "method", "path" (prefix), "token", "status" and
+// "since" (RFC 3339, defaults to the last hour). With the file sink, only the current file is searched.
+func (requestLog *RequestLog) Get(request *Request) Result {
+	// Check perms
+	if request.AccessToken.GetRole() != RoleAdmin {
+		return UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	filter := requestLogFilter{since: time.Now().Add(-1 * time.Hour)}
+	filter.method = strings.ToUpper(request.QueryArgs["method"])
+	filter.path = request.QueryArgs["path"]
+	if rawTokenID, ok := request.QueryArgs["token"]; ok {
+		tokenID, err := uuid.Parse(rawTokenID)
+		if err != nil {
+			return BadRequest("invalid token ID")
+		}
+		filter.tokenID = &tokenID
+	}
+	if rawStatus, ok := request.QueryArgs["status"]; ok {
+		status, err := strconv.Atoi(rawStatus)
+		if err != nil {
+			return BadRequest("invalid status")
+		}
+		filter.status = status
+	}
+	if rawSince, ok := request.QueryArgs["since"]; ok {
+		since, err := time.Parse(time.RFC3339, rawSince)
+		if err != nil {
+			return BadRequest("invalid since time, must be RFC 3339")
+		}
+		filter.since = since
+	}
+
+	logConfig := config.Get().RequestLog
+	switch logConfig.Sink {
+	case requestLogSinkDB:
+		return requestLog.loadFromDB(filter)
+	case requestLogSinkFile:
+		return requestLog.loadFromFile(logConfig, filter)
+	default:
+		return NotFound("request log not enabled")
+	}
+}
+
+// requestLogFilter is the filter for request log queries. Empty fields match everything.
+type requestLogFilter struct {
+	method  string
+	path    string
+	tokenID *uuid.UUID
+	status  int
+	since   time.Time
+}
+
+func (filter *requestLogFilter) matches(entry *RequestLogEntry) bool {
+	switch {
+	case filter.method != "" && entry.Method != filter.method:
+		return false
+	case filter.path != "" && !strings.HasPrefix(entry.Path, filter.path):
+		return false
+	case filter.tokenID != nil && (entry.TokenID == nil || *entry.TokenID != *filter.tokenID):
+		return false
+	case filter.status != 0 && entry.Status != filter.status:
+		return false
+	case entry.Time.Before(filter.since):
+		return false
+	}
+	return true
+}
+
+func (requestLog *RequestLog) loadFromDB(filter requestLogFilter) Result {
+	whereArgs := []interface{}{"time", ">=", filter.since}
+	if filter.method != "" {
+		whereArgs = append(whereArgs, "method", "=", filter.method)
+	}
+	if filter.path != "" {
+		whereArgs = append(whereArgs, "path", "LIKE", strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(filter.path)+"%")
+	}
+	if filter.tokenID != nil {
+		whereArgs = append(whereArgs, "token", "=", filter.tokenID)
+	}
+	if filter.status != 0 {
+		whereArgs = append(whereArgs, "status", "=", filter.status)
+	}
+	dbResult := db.SelectManyOrdered(requestLog, "request_log", "time DESC", whereArgs...)
+	if dbResult.IsFailed() {
+		return InternalError(dbResult.Error)
+	}
+	return Result{}
+}
+
+func (requestLog *RequestLog) loadFromFile(logConfig config.RequestLogConfig, filter requestLogFilter) Result {
+	*requestLog = make(RequestLog, 0)
+	file, openErr := os.Open(requestLogFilePath(logConfig))
+	if os.IsNotExist(openErr) {
+		return Result{}
+	}
+	if openErr != nil {
+		return InternalError(openErr)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry RequestLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Probably a partially written line
+			continue
+		}
+		if filter.matches(&entry) {
+			*requestLog = append(*requestLog, &entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return InternalError(err)
+	}
+
+	// Newest first
+	for i, j := 0, len(*requestLog)-1; i < j; i, j = i+1, j-1 {
+		(*requestLog)[i], (*requestLog)[j] = (*requestLog)[j], (*requestLog)[i]
+	}
+	return Result{}
+}
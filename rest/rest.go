@@ -20,27 +20,58 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 
 package rest
 
-import "github.com/google/uuid"
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+
+	"github.com/gathering/tech-online-backend/db"
+	log "github.com/sirupsen/logrus"
+)
 
 // Request contains the last part of the URL (without the handler prefix), certain query args,
 // and a limit on how many elements to get.
 type Request struct {
-	ID          uuid.UUID
-	Method      string
-	AccessToken AccessTokenEntry
-	PathArgs    map[string]string
-	QueryArgs   map[string]string
-	ListLimit   int  // How many elements to return in listings (convenience)
-	ListBrief   bool // If only the most relevant fields should be included listings (convenience)
+	ID             string     // From the X-Request-ID header or random
+	Log            *log.Entry // Logger with the request ID attached, for logging in handlers
+	Method         string
+	AccessToken    AccessTokenEntry
+	PathArgs       map[string]string
+	QueryArgs      map[string]string
+	ContentType    string        // Content type of the request body, e.g. for multipart stream handlers
+	AcceptLanguage string        // Accept-Language header, for localized content
+	EventID        string        // The event to scope listings and new entities to, empty for all events
+	APIVersion     string        // The API version requested, e.g. "v1" (also for the unversioned paths)
+	ListLimit      int           // How many elements to return in listings (convenience)
+	ListBrief      bool          // If only the most relevant fields should be included listings (convenience)
+	ListFilterArgs []interface{} // DB search args from ?filter[<field>]=<value>, for ListQueryer handlers
+	ListOrderBy    string        // DB order from ?sort=<field>,-<field>, for ListQueryer handlers
+	Tx             *sql.Tx       // Transaction for batches, only for Transactor handlers (use Executor)
+	// Context of the HTTP request, cancelled if the client goes away (or the write timeout is reached), for passing on to slow calls
+	Context context.Context
+	// IP address of the client, from X-Forwarded-For if trusted (auth_lockout.trust_forwarded_for)
+	ClientIP string
+	// The underlying HTTP request, for advanced handlers needing e.g. other headers (don't read the body)
+	HTTPRequest *http.Request
+}
+
+// Executor returns the transaction of the request if any, else the DB.
+func (request *Request) Executor() db.Executor {
+	if request.Tx != nil {
+		return request.Tx
+	}
+	return db.DB
 }
 
 // Result is an update report on write-requests. The precise meaning might
 // vary, but the gist should be the same.
 type Result struct {
-	Message  string `json:"message,omitempty"` // Message for client
-	Code     int    `json:"-"`                 // HTTP status
-	Location string `json:"-"`                 // For location header if code 3xx
-	Error    error  `json:"-"`                 // Internal error, forces code 500, hidden from client to avoid leak
+	Message  string   `json:"message,omitempty"`  // Message for client
+	Problems []string `json:"problems,omitempty"` // Validation problems for client, if any
+	Code     int      `json:"-"`                  // HTTP status
+	Location string   `json:"-"`                  // For location header if code 3xx
+	Error    error    `json:"-"`                  // Internal error, forces code 500, hidden from client to avoid leak
 }
 
 // IsOk checks if error free and either not set code or a non-error code.
@@ -68,9 +99,103 @@ type Poster interface {
 	Post(request *Request) Result
 }
 
+// StreamPoster is like Poster, but gets the unread request body instead of
+// having it unmarshalled into the data structure first. Used for large or
+// non-JSON input which should be processed incrementally. Takes precedence
+// over Poster.
+type StreamPoster interface {
+	PostStream(request *Request, body io.Reader) Result
+}
+
+// Upgrader takes over the connection for GET requests instead of Getter,
+// e.g. for WebSockets. The access token is resolved as usual from the
+// headers, but the handler is responsible for the whole response. Browsers
+// can't set headers for WebSockets, so handlers used by browsers must accept
+// some short-lived token of their own in the URL (like the station console).
+type Upgrader interface {
+	Upgrade(request *Request, httpWriter http.ResponseWriter, httpRequest *http.Request)
+}
+
 // Deleter should delete the object identified by the element. It should be
 // idempotent, in that it should be safe to call it on already-deleted
 // items.
 type Deleter interface {
 	Delete(request *Request) Result
 }
+
+// CSVExporter may be implemented by listings (slices of structs) to also
+// support CSV responses, with "Accept: text/csv" or "?format=csv". The
+// columns are the fields with "column" tags, which are also the headers.
+type CSVExporter interface {
+	CSVExport() bool
+}
+
+// Transactor may be implemented by data structures whose POST, PUT and
+// DELETE handlers do all DB access through Request.Executor, so they may be
+// part of batches handled in a single transaction.
+type Transactor interface {
+	Transactional() bool
+}
+
+// DeletePreviewer may be implemented by Deleters to support DELETE with
+// "?dry-run=1", which reports the number of rows per table the delete would
+// remove or leave dangling, without deleting anything. The counts include
+// the row itself.
+type DeletePreviewer interface {
+	PreviewDelete(request *Request) (map[string]int, Result)
+}
+
+// DeletePreview is the response for DELETEs with "?dry-run=1".
+type DeletePreview struct {
+	DryRun   bool           `json:"dry_run"`
+	Affected map[string]int `json:"affected"` // Number of rows per table
+}
+
+// BodyLimiter may be implemented by data structures accepting request bodies
+// larger (or smaller) than the configured default, e.g. uploads. Larger
+// bodies get a 413. A negative limit disables the limit, for streams which
+// are processed incrementally.
+type BodyLimiter interface {
+	MaxBodyBytes() int64
+}
+
+// IfMatcher may be implemented by data structures implementing both Getter
+// and Putter, to protect against lost updates when multiple clients edit the
+// same entity. PUTs with an If-Match header are only handled if it matches
+// the ETag a GET of the same path currently gets, else they get a 412. If
+// IfMatchRequired returns true, PUTs without If-Match get a 428.
+type IfMatcher interface {
+	IfMatchRequired() bool
+}
+
+// ETagger may be implemented by Getters which can tell cheaply (without
+// loading the data) which version of the data they would return, e.g. using
+// change counters. A matching If-None-Match then gets a 304 without calling
+// Get. The tag must change whenever the data may have changed, and ok must be
+// false if no tag can be given (e.g. for invalid path args).
+type ETagger interface {
+	ETag(request *Request) (tag string, ok bool)
+}
+
+// HeadGetter may be implemented by ETaggers to answer HEAD requests without
+// loading the data, when the ETag is available. Head must give the same
+// status as Get would (e.g. a 404 for missing entities), but no data. The
+// response then has the cheap ETag but no Content-Length. Other HEAD
+// requests are handled by Get, like GET, only without sending the body.
+type HeadGetter interface {
+	Head(request *Request) Result
+}
+
+// RawResponder may be implemented by handler data which shouldn't be
+// JSON-encoded, e.g. files in other formats. The returned body is sent
+// as-is with the returned content type, which browsers are told not to sniff.
+type RawResponder interface {
+	RawResponse() (contentType string, body []byte, err error)
+}
+
+// RawDispositioner may be implemented by RawResponders to send a
+// Content-Disposition header, e.g. to make browsers download files instead
+// of showing them. An empty disposition sends no header.
+type RawDispositioner interface {
+	ContentDisposition() string
+}
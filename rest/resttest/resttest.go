@@ -0,0 +1,364 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+/*
+Package resttest is a harness for handler integration tests, running requests
+through the real receiver against a throwaway Postgres database.
+
+The database server is taken from TECHO_TEST_DATABASE_STRING if set, or
+else started as a Docker container (if Docker is available). Each harness
+gets a fresh database with schema.sql applied, which is dropped when the test
+ends. Tests are skipped if no database server is available.
+
+Typical use, in a package registering handlers (e.g. yolo):
+
+	func TestMain(m *testing.M) {
+		resttest.Main(m)
+	}
+
+	func TestSomething(t *testing.T) {
+		harness := resttest.New(t)
+		response := harness.Do("GET", "/api/tracks/", harness.Token(rest.RoleAdmin), nil)
+		...
+	}
+
+The harness replaces the global config and DB connection, so tests using it
+must not run in parallel.
+*/
+package resttest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq" // Imported for the driver
+)
+
+// DatabaseStringEnv is the env var with the connection string for an existing Postgres server to create
+// test databases on. The user must be allowed to create databases.
+const DatabaseStringEnv = "TECHO_TEST_DATABASE_STRING"
+
+// DockerImageEnv is the env var with the Postgres image to use if no database string is provided.
+const DockerImageEnv = "TECHO_TEST_DOCKER_IMAGE"
+
+// SitePrefix is the site prefix used by the harness.
+const SitePrefix = "/api"
+
+const defaultDockerImage = "postgres:13"
+const dockerStartTimeout = 60 * time.Second
+
+// server is the database server shared by all harnesses in the test binary.
+var server = struct {
+	sync.Mutex
+	started          bool
+	databaseString   string
+	dockerContainer  string
+	unavailableError error
+}{}
+
+var databaseNamePattern = regexp.MustCompile(`dbname=\S*`)
+
+// Harness runs requests through the real receiver against a fresh database.
+type Harness struct {
+	t       *testing.T
+	handler http.Handler
+}
+
+// Main runs the tests and stops the database container afterwards (if one was started). Call it from TestMain.
+func Main(m *testing.M) {
+	code := m.Run()
+	server.Lock()
+	if server.dockerContainer != "" {
+		exec.Command("docker", "rm", "-f", server.dockerContainer).Run()
+	}
+	server.Unlock()
+	os.Exit(code)
+}
+
+// New creates a fresh database with the schema and sets up the config and DB connection to use it.
+// The test is skipped if no database server is available.
+func New(t *testing.T) *Harness {
+	t.Helper()
+	serverDatabaseString, serverErr := startServer()
+	if serverErr != nil {
+		t.Skipf("no database server for integration tests: %v", serverErr)
+	}
+
+	// Create the database and apply the schema, on separate connections since the schema clears the search path
+	databaseName := "techo_test_" + randomHex(8)
+	adminDB, adminErr := sql.Open("postgres", serverDatabaseString)
+	if adminErr != nil {
+		t.Fatalf("failed to connect to database server: %v", adminErr)
+	}
+	defer adminDB.Close()
+	if _, err := adminDB.Exec("CREATE DATABASE " + databaseName); err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	databaseString, databaseStringErr := withDatabaseName(serverDatabaseString, databaseName)
+	if databaseStringErr != nil {
+		t.Fatal(databaseStringErr)
+	}
+	if err := applySchema(databaseString); err != nil {
+		t.Fatalf("failed to apply schema: %v", err)
+	}
+
+	previousConfig := config.Get()
+	config.Set(&config.Settings{DatabaseString: databaseString, SitePrefix: SitePrefix})
+	db.DB = nil
+	if err := db.Connect(); err != nil {
+		t.Fatalf("failed to connect to test database: %v", err)
+	}
+	if err := rest.UpdateStaticAccessTokens(); err != nil {
+		t.Fatalf("failed to update static access tokens: %v", err)
+	}
+
+	t.Cleanup(func() {
+		db.DB.Close()
+		db.DB = nil
+		config.Set(previousConfig)
+		if cleanupDB, err := sql.Open("postgres", serverDatabaseString); err == nil {
+			cleanupDB.Exec("DROP DATABASE IF EXISTS " + databaseName)
+			cleanupDB.Close()
+		}
+	})
+	return &Harness{t: t, handler: rest.NewHandler()}
+}
+
+// Token creates a non-user access token with the role (tester, runner, operator or admin) and returns the key.
+func (harness *Harness) Token(role rest.Role) string {
+	harness.t.Helper()
+	token, err := rest.CreateNonUserAccessToken(role, "Test", time.Hour)
+	if err != nil {
+		harness.t.Fatalf("failed to create access token: %v", err)
+	}
+	return token.Key
+}
+
+// User creates a user with the role (e.g. participant) and an access token for it.
+// Returns the user ID and token key.
+func (harness *Harness) User(role rest.Role) (uuid.UUID, string) {
+	harness.t.Helper()
+	userID := uuid.New()
+	user := rest.User{
+		ID:           &userID,
+		Username:     "test-" + userID.String(),
+		DisplayName:  "Test User",
+		EmailAddress: userID.String() + "@example.com",
+		Role:         role,
+	}
+	if dbResult := db.Insert("users", &user); dbResult.IsFailed() {
+		harness.t.Fatalf("failed to create user: %v", dbResult.Error)
+	}
+	now := time.Now()
+	key := randomHex(32)
+	keyHash := sha256.Sum256([]byte(key))
+	token := rest.AccessTokenEntry{
+		ID:             uuid.New(),
+		Key:            key,
+		KeyHash:        hex.EncodeToString(keyHash[:]), // Only the hash is stored, like for created tokens
+		OwnerUserID:    &userID,
+		CreationTime:   now,
+		ExpirationTime: now.Add(time.Hour),
+		Comment:        "Test",
+	}
+	if dbResult := db.Insert("access_tokens", &token); dbResult.IsFailed() {
+		harness.t.Fatalf("failed to create access token: %v", dbResult.Error)
+	}
+	return userID, token.Key
+}
+
+// Do sends the request through the receiver and returns the recorded response.
+// The path includes the site prefix. The body (if not nil) is sent as JSON and the token key (if not empty) as a bearer token.
+func (harness *Harness) Do(method string, path string, tokenKey string, body interface{}) *httptest.ResponseRecorder {
+	harness.t.Helper()
+	var bodyReader *bytes.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			harness.t.Fatalf("failed to marshal request body: %v", err)
+		}
+		bodyReader = bytes.NewReader(bodyBytes)
+	} else {
+		bodyReader = bytes.NewReader(nil)
+	}
+	request := httptest.NewRequest(method, path, bodyReader)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if tokenKey != "" {
+		request.Header.Set("Authorization", "Bearer "+tokenKey)
+	}
+	recorder := httptest.NewRecorder()
+	harness.handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// DecodeJSON decodes the JSON response body into the data, failing the test if the status is not as expected.
+func DecodeJSON(t *testing.T, response *httptest.ResponseRecorder, expectedCode int, data interface{}) {
+	t.Helper()
+	if response.Code != expectedCode {
+		t.Fatalf("unexpected status %v (expected %v): %v", response.Code, expectedCode, response.Body.String())
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), data); err != nil {
+		t.Fatalf("failed to decode response body: %v: %v", err, response.Body.String())
+	}
+}
+
+// startServer finds or starts the database server, once for the test binary.
+func startServer() (string, error) {
+	server.Lock()
+	defer server.Unlock()
+	if server.started {
+		return server.databaseString, server.unavailableError
+	}
+	server.started = true
+
+	if databaseString := os.Getenv(DatabaseStringEnv); databaseString != "" {
+		server.databaseString = databaseString
+		return server.databaseString, nil
+	}
+	server.databaseString, server.dockerContainer, server.unavailableError = startDockerServer()
+	return server.databaseString, server.unavailableError
+}
+
+// startDockerServer starts a Postgres container on a random local port and waits until it accepts connections.
+func startDockerServer() (string, string, error) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return "", "", fmt.Errorf("%v not set and docker not found", DatabaseStringEnv)
+	}
+	image := os.Getenv(DockerImageEnv)
+	if image == "" {
+		image = defaultDockerImage
+	}
+	runOutput, runErr := exec.Command("docker", "run", "-d", "--rm", "-e", "POSTGRES_USER=techo", "-e", "POSTGRES_PASSWORD=techo",
+		"-p", "127.0.0.1::5432", image).Output()
+	if runErr != nil {
+		return "", "", fmt.Errorf("failed to start database container: %v", runErr)
+	}
+	container := strings.TrimSpace(string(runOutput))
+	portOutput, portErr := exec.Command("docker", "port", container, "5432/tcp").Output()
+	if portErr != nil {
+		return "", container, fmt.Errorf("failed to get database container port: %v", portErr)
+	}
+	address := strings.TrimSpace(strings.Split(string(portOutput), "\n")[0])
+	host, port := address, "5432"
+	if i := strings.LastIndex(address, ":"); i >= 0 {
+		host, port = address[:i], address[i+1:]
+	}
+	databaseString := fmt.Sprintf("host=%v port=%v user=techo password=techo dbname=postgres sslmode=disable", host, port)
+
+	// Wait for it to accept connections
+	deadline := time.Now().Add(dockerStartTimeout)
+	for {
+		testDB, err := sql.Open("postgres", databaseString)
+		if err == nil {
+			err = testDB.Ping()
+			testDB.Close()
+		}
+		if err == nil {
+			return databaseString, container, nil
+		}
+		if time.Now().After(deadline) {
+			return "", container, fmt.Errorf("database container not ready: %v", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// withDatabaseName replaces the database name in the connection string (key/value or URL format).
+func withDatabaseName(databaseString string, databaseName string) (string, error) {
+	if strings.HasPrefix(databaseString, "postgres://") || strings.HasPrefix(databaseString, "postgresql://") {
+		databaseURL, err := url.Parse(databaseString)
+		if err != nil {
+			return "", fmt.Errorf("invalid database URL: %v", err)
+		}
+		databaseURL.Path = "/" + databaseName
+		return databaseURL.String(), nil
+	}
+	if databaseNamePattern.MatchString(databaseString) {
+		return databaseNamePattern.ReplaceAllString(databaseString, "dbname="+databaseName), nil
+	}
+	return databaseString + " dbname=" + databaseName, nil
+}
+
+// applySchema runs schema.sql from the repository root.
+func applySchema(databaseString string) error {
+	schemaPath, pathErr := findSchema()
+	if pathErr != nil {
+		return pathErr
+	}
+	schema, readErr := os.ReadFile(schemaPath)
+	if readErr != nil {
+		return readErr
+	}
+	schemaDB, openErr := sql.Open("postgres", databaseString)
+	if openErr != nil {
+		return openErr
+	}
+	defer schemaDB.Close()
+	_, execErr := schemaDB.Exec(string(schema))
+	return execErr
+}
+
+// findSchema finds schema.sql next to go.mod, searching upwards from the working directory (the package being tested).
+func findSchema() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return filepath.Join(dir, "schema.sql"), nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("schema.sql not found, no go.mod above the working directory")
+		}
+		dir = parent
+	}
+}
+
+func randomHex(length int) string {
+	data := make([]byte, length)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(data)
+}
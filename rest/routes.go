@@ -0,0 +1,98 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Route is a registered receiver, for debugging what's actually served.
+type Route struct {
+	Prefix     string   `json:"prefix"`     // Handler prefix, below the site prefix and API version
+	Pattern    string   `json:"pattern"`    // Regexp for the rest of the path
+	Version    string   `json:"version"`    // API version, empty for all versions
+	Type       string   `json:"type"`       // Go type of the allocated data structure
+	Methods    []string `json:"methods"`    // HTTP methods implemented by the type
+	Cached     bool     `json:"cached"`     // If GETs are cached
+	Idempotent bool     `json:"idempotent"` // If POSTs honor idempotency keys
+}
+
+// Routes is all registered receivers.
+type Routes []*Route
+
+func init() {
+	AddHandler("/admin/", "^routes/$", func() interface{} { return &Routes{} })
+}
+
+// Get gets all registered receivers, sorted by prefix, with the receivers of each prefix in the order they're matched.
+func (routes *Routes) Get(request *Request) Result {
+	// Check perms
+	if request.AccessToken.GetRole() != RoleAdmin {
+		return UnauthorizedResult(request.AccessToken)
+	}
+
+	var prefixes []string
+	for prefix := range receiverSets {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	*routes = make(Routes, 0)
+	for _, prefix := range prefixes {
+		for _, receiver := range receiverSets[prefix].receivers {
+			*routes = append(*routes, &Route{
+				Prefix:     prefix,
+				Pattern:    receiver.pathPattern.String(),
+				Version:    receiver.version,
+				Type:       fmt.Sprintf("%T", receiver.allocator()),
+				Methods:    implementedMethods(receiver.allocator()),
+				Cached:     receiver.cache != nil,
+				Idempotent: receiver.idempotent,
+			})
+		}
+	}
+	return Result{}
+}
+
+// implementedMethods finds the HTTP methods the data structure implements handlers for.
+func implementedMethods(item interface{}) []string {
+	var methods []string
+	_, isGetter := item.(Getter)
+	_, isUpgrader := item.(Upgrader)
+	if isGetter || isUpgrader {
+		methods = append(methods, "GET")
+	}
+	if isGetter {
+		methods = append(methods, "HEAD")
+	}
+	_, isPoster := item.(Poster)
+	_, isStreamPoster := item.(StreamPoster)
+	if isPoster || isStreamPoster {
+		methods = append(methods, "POST")
+	}
+	if _, ok := item.(Putter); ok {
+		methods = append(methods, "PUT")
+	}
+	if _, ok := item.(Deleter); ok {
+		methods = append(methods, "DELETE")
+	}
+	return methods
+}
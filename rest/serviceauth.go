@@ -0,0 +1,222 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/worker"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// hmacAuthScheme is the Authorization scheme for HMAC-signed requests from services using static tokens, as an
+// alternative to the bearer key: "TECHO-HMAC-SHA256 id=<token ID>, ts=<unix time>, nonce=<random>, sig=<hex HMAC>".
+// The signature is the HMAC-SHA256 with the shared secret of "<method>\n<path and query>\n<ts>\n<nonce>\n<body hash>",
+// where the body hash is the hex-encoded SHA-256 of the body (of the empty string if none).
+// The nonces are only remembered in memory, so with multiple backend replicas, each replica may accept a request once.
+const hmacAuthScheme = "TECHO-HMAC-SHA256"
+
+// hmacMaxClockSkew is how far the signature timestamp may be from the current time.
+// Nonces are remembered for twice this long, so a signed request can't be replayed.
+const hmacMaxClockSkew = 5 * time.Minute
+
+// hmacMaxNonceLength limits the remembered nonces.
+const hmacMaxNonceLength = 64
+
+// noKeyHashPrefix is prefixed to the ID of static tokens without a key (only HMAC or client certificate),
+// as a unique key hash which never matches a hashed key.
+const noKeyHashPrefix = "none:"
+
+// hmacNonces are the nonces of recent signed requests by token ID and nonce, with their expiry time.
+var hmacNonces = struct {
+	sync.Mutex
+	expiry map[string]time.Time
+}{
+	expiry: make(map[string]time.Time),
+}
+
+func init() {
+	worker.AddTask("hmac-nonce-purge", hmacMaxClockSkew, purgeHMACNonces)
+}
+
+// getServiceAccessToken authenticates a static token by a HMAC-signed request or a client certificate.
+// Returns nil if neither was presented or if invalid, with the remaining lockout if the client is locked out.
+func getServiceAccessToken(httpRequest *http.Request, requestLog *log.Entry) (*AccessTokenEntry, time.Duration) {
+	if authHeader := httpRequest.Header.Get("Authorization"); authHeader != "" {
+		fields := strings.SplitN(strings.TrimSpace(authHeader), " ", 2)
+		if len(fields) == 2 && strings.EqualFold(fields[0], hmacAuthScheme) {
+			return getHMACAccessToken(httpRequest, fields[1], requestLog)
+		}
+	}
+	if tokenID, ok := clientCertificateTokenID(httpRequest); ok {
+		return loadStaticAccessToken(tokenID), 0
+	}
+	return nil, 0
+}
+
+// getHMACAccessToken checks the signature and replay protection of a HMAC-signed request.
+func getHMACAccessToken(httpRequest *http.Request, params string, requestLog *log.Entry) (*AccessTokenEntry, time.Duration) {
+	values := make(map[string]string)
+	for _, param := range strings.Split(params, ",") {
+		if name, value, found := strings.Cut(strings.TrimSpace(param), "="); found {
+			values[strings.ToLower(name)] = strings.Trim(value, "\"")
+		}
+	}
+	fail := func(reason string) (*AccessTokenEntry, time.Duration) {
+		requestLog.WithField("token", values["id"]).Debugf("Rejected HMAC-signed request: %v", reason)
+		return nil, failAuth(authLockoutKeys(httpRequest), requestLog)
+	}
+
+	tokenID, idErr := uuid.Parse(values["id"])
+	tokenConfig, tokenConfigOk := config.Get().AccessTokens[tokenID]
+	if idErr != nil || !tokenConfigOk || tokenConfig.HMACSecret == "" {
+		return fail("unknown token")
+	}
+	timestamp, timestampErr := strconv.ParseInt(values["ts"], 10, 64)
+	if timestampErr != nil {
+		return fail("invalid timestamp")
+	}
+	if skew := time.Since(time.Unix(timestamp, 0)); skew > hmacMaxClockSkew || skew < -hmacMaxClockSkew {
+		return fail("timestamp outside the allowed clock skew")
+	}
+	nonce := values["nonce"]
+	if nonce == "" || len(nonce) > hmacMaxNonceLength {
+		return fail("invalid nonce")
+	}
+	// The body is signed too, so it's read here (within the default body limit) and replaced for the handler
+	body, bodyErr := io.ReadAll(io.LimitReader(httpRequest.Body, DefaultMaxBodyBytes()+1))
+	httpRequest.Body.Close()
+	httpRequest.Body = io.NopCloser(bytes.NewReader(body))
+	if bodyErr != nil {
+		return fail("failed to read body")
+	}
+	if int64(len(body)) > DefaultMaxBodyBytes() {
+		return fail("body too large to sign")
+	}
+	signature, signatureErr := hex.DecodeString(values["sig"])
+	expectedSignature := signHMACRequest(tokenConfig.HMACSecret, httpRequest.Method, httpRequest.URL.RequestURI(), values["ts"], nonce, body)
+	if signatureErr != nil || !hmac.Equal(signature, expectedSignature) {
+		return fail("invalid signature")
+	}
+	if !useHMACNonce(tokenID.String() + ":" + nonce) {
+		return fail("replayed nonce")
+	}
+	return loadStaticAccessToken(tokenID), 0
+}
+
+// signHMACRequest computes the signature of a request (see hmacAuthScheme).
+func signHMACRequest(secret string, method string, requestURI string, timestamp string, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash[:])))
+	return mac.Sum(nil)
+}
+
+// useHMACNonce remembers the nonce, returning false if it was already used.
+func useHMACNonce(key string) bool {
+	now := time.Now()
+	hmacNonces.Lock()
+	defer hmacNonces.Unlock()
+	if expiry, ok := hmacNonces.expiry[key]; ok && now.Before(expiry) {
+		return false
+	}
+	hmacNonces.expiry[key] = now.Add(2 * hmacMaxClockSkew)
+	return true
+}
+
+// purgeHMACNonces forgets nonces which are too old to be accepted anyway.
+func purgeHMACNonces() {
+	now := time.Now()
+	hmacNonces.Lock()
+	defer hmacNonces.Unlock()
+	for key, expiry := range hmacNonces.expiry {
+		if now.After(expiry) {
+			delete(hmacNonces.expiry, key)
+		}
+	}
+}
+
+// clientCertificateTokenID finds the static token with the fingerprint of the client certificate, if any.
+// The TLS handshake proves the client has the private key, so the certificate is pinned instead of checked against a CA.
+func clientCertificateTokenID(httpRequest *http.Request) (uuid.UUID, bool) {
+	if httpRequest.TLS == nil || len(httpRequest.TLS.PeerCertificates) == 0 {
+		return uuid.UUID{}, false
+	}
+	certificate := httpRequest.TLS.PeerCertificates[0]
+	if now := time.Now(); now.Before(certificate.NotBefore) || now.After(certificate.NotAfter) {
+		return uuid.UUID{}, false
+	}
+	fingerprint := sha256.Sum256(certificate.Raw)
+	fingerprintHex := hex.EncodeToString(fingerprint[:])
+	for tokenID, tokenConfig := range config.Get().AccessTokens {
+		if tokenConfig.ClientCertSHA256 == "" {
+			continue
+		}
+		configured := strings.ToLower(strings.ReplaceAll(tokenConfig.ClientCertSHA256, ":", ""))
+		if subtle.ConstantTimeCompare([]byte(configured), []byte(fingerprintHex)) == 1 {
+			return tokenID, true
+		}
+	}
+	return uuid.UUID{}, false
+}
+
+// clientCertificatesConfigured checks if any static token uses a client certificate, so the server should ask for them.
+func clientCertificatesConfigured() bool {
+	for _, tokenConfig := range config.Get().AccessTokens {
+		if tokenConfig.ClientCertSHA256 != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// loadStaticAccessToken loads a valid static token by ID, or nil if not found (e.g. not synced from the config yet).
+func loadStaticAccessToken(tokenID uuid.UUID) *AccessTokenEntry {
+	var token AccessTokenEntry
+	now := time.Now()
+	dbResult := db.Select(&token, "access_tokens",
+		"id", "=", tokenID,
+		"static", "=", true,
+		"creation_time", "<=", now,
+		"expiration_time", ">=", now,
+	)
+	if dbResult.IsFailed() {
+		log.WithError(dbResult.Error).Error("Failed to select access token from DB")
+		return nil
+	}
+	if !dbResult.IsSuccess() {
+		return nil
+	}
+	return &token
+}
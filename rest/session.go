@@ -0,0 +1,107 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// UserSessions is the list of active (non-static, non-expired) access tokens for a user.
+type UserSessions AccessTokenEntries
+
+// UserSessionsRevokeRequest is a request to revoke all access tokens for a user ("log out everywhere").
+type UserSessionsRevokeRequest struct {
+	Revoked int `json:"revoked"` // Number of revoked tokens
+}
+
+func init() {
+	AddHandler("/user/", "^(?P<id>[^/]+)/sessions/$", func() interface{} { return &UserSessions{} })
+	AddHandler("/user/", "^(?P<id>[^/]+)/sessions/revoke-all/$", func() interface{} { return &UserSessionsRevokeRequest{} })
+}
+
+// Get gets the active sessions for a user.
+func (sessions *UserSessions) Get(request *Request) Result {
+	userID, result := parseSessionUserID(request)
+	if !result.IsOk() {
+		return result
+	}
+
+	now := time.Now()
+	dbResult := db.SelectMany(sessions, "access_tokens",
+		"owner_user", "=", userID,
+		"static", "=", false,
+		"expiration_time", ">=", now,
+	)
+	if dbResult.IsFailed() {
+		return InternalError(dbResult.Error)
+	}
+
+	return Result{}
+}
+
+// Post deletes all access tokens for a user, including the one used for the request if it belongs to the user.
+func (revokeRequest *UserSessionsRevokeRequest) Post(request *Request) Result {
+	userID, result := parseSessionUserID(request)
+	if !result.IsOk() {
+		return result
+	}
+
+	dbResult := db.Delete("access_tokens",
+		"owner_user", "=", userID,
+		"static", "=", false,
+	)
+	if dbResult.IsFailed() {
+		return InternalError(dbResult.Error)
+	}
+	revokeRequest.Revoked = dbResult.Affected
+
+	log.WithFields(log.Fields{
+		"user":    userID,
+		"token":   request.AccessToken.ID,
+		"revoked": revokeRequest.Revoked,
+	}).Info("Revoked all access tokens for user")
+
+	return Result{}
+}
+
+// parseSessionUserID gets the user ID from the path and checks that the requestor is the same user or an admin.
+func parseSessionUserID(request *Request) (uuid.UUID, Result) {
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return uuid.UUID{}, BadRequest("missing user ID")
+	}
+	id, idErr := uuid.Parse(rawID)
+	if idErr != nil {
+		return uuid.UUID{}, BadRequest("invalid user ID")
+	}
+
+	// Check if self or admin
+	isSelf := request.AccessToken.OwnerUserID != nil && *request.AccessToken.OwnerUserID == id
+	if !isSelf && request.AccessToken.GetRole() != RoleAdmin {
+		return uuid.UUID{}, UnauthorizedResult(request.AccessToken)
+	}
+
+	return id, Result{}
+}
@@ -0,0 +1,133 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// certificateLoader loads the configured certificate, reloading it when the files change (e.g. after renewal) or the config is reloaded.
+type certificateLoader struct {
+	lock        sync.Mutex
+	certFile    string
+	keyFile     string
+	modTime     time.Time
+	certificate *tls.Certificate
+}
+
+// tlsEnabled checks if HTTPS is configured.
+func tlsEnabled() bool {
+	return config.Get().TLS.CertFile != "" && config.Get().TLS.KeyFile != ""
+}
+
+// newTLSConfig creates a TLS config with modern defaults. HTTP/2 is enabled automatically by the server.
+func newTLSConfig(loader *certificateLoader) *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		// Only forward secret AEAD suites for TLS 1.2, TLS 1.3 suites aren't configurable
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		GetCertificate: loader.getCertificate,
+		ClientAuth:     clientAuthType(),
+	}
+}
+
+// clientAuthType asks clients for a certificate if any static token uses one (see clientCertificateTokenID).
+// The certificates are pinned by fingerprint instead of verified against a CA, and not required, so other clients still work.
+func clientAuthType() tls.ClientAuthType {
+	if clientCertificatesConfigured() {
+		return tls.RequestClientCert
+	}
+	return tls.NoClientCert
+}
+
+func (loader *certificateLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	loader.lock.Lock()
+	defer loader.lock.Unlock()
+
+	certFile := config.Get().TLS.CertFile
+	keyFile := config.Get().TLS.KeyFile
+	certInfo, statErr := os.Stat(certFile)
+	if statErr != nil {
+		// Keep serving the loaded one if the file is temporarily gone, e.g. during renewal
+		if loader.certificate != nil {
+			return loader.certificate, nil
+		}
+		return nil, statErr
+	}
+	if loader.certificate != nil && certFile == loader.certFile && keyFile == loader.keyFile && certInfo.ModTime().Equal(loader.modTime) {
+		return loader.certificate, nil
+	}
+
+	certificate, loadErr := tls.LoadX509KeyPair(certFile, keyFile)
+	if loadErr != nil {
+		if loader.certificate != nil {
+			log.WithError(loadErr).Error("Failed to reload TLS certificate, keeping the old one")
+			return loader.certificate, nil
+		}
+		return nil, loadErr
+	}
+	log.WithField("cert_file", certFile).Info("Loaded TLS certificate")
+	loader.certificate = &certificate
+	loader.certFile = certFile
+	loader.keyFile = keyFile
+	loader.modTime = certInfo.ModTime()
+	return loader.certificate, nil
+}
+
+// startRedirectListener starts a plain HTTP listener in the background, redirecting all requests to HTTPS.
+func startRedirectListener(redirectAddress string, httpsAddress string) {
+	_, httpsPort, _ := net.SplitHostPort(httpsAddress)
+	redirectServer := http.Server{
+		Addr:              redirectAddress,
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(httpWriter http.ResponseWriter, httpRequest *http.Request) {
+			host := httpRequest.Host
+			if splitHost, _, err := net.SplitHostPort(host); err == nil {
+				host = splitHost
+			}
+			if httpsPort != "" && httpsPort != "443" {
+				host = net.JoinHostPort(host, httpsPort)
+			}
+			http.Redirect(httpWriter, httpRequest, fmt.Sprintf("https://%v%v", host, httpRequest.URL.RequestURI()), http.StatusMovedPermanently)
+		}),
+	}
+	go func() {
+		log.WithField("listen_address", redirectAddress).Info("HTTP to HTTPS redirect server is listening")
+		log.Fatal(redirectServer.ListenAndServe())
+	}()
+}
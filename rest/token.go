@@ -22,20 +22,28 @@ package rest
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/worker"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
 const tokenLengthBytes = 32
-const encodedTokenLengthBytes = 44              // Depends on tokenLengthBytes
-const tokenExpirationSeconds = 7 * 24 * 60 * 60 // A week
+const encodedTokenLengthBytes = 44               // Depends on tokenLengthBytes
+const tokenExpirationSeconds = 7 * 24 * 60 * 60  // A week
+const tokenUsageFlushInterval = 30 * time.Second // How often to save the batched usage stats
 
 // Role defines a role for users and tokens.
 type Role string
@@ -59,8 +67,9 @@ const (
 
 // AccessTokenEntry is a collections of access things used for the client to authenticate itself and for the backend to know more about the client.
 type AccessTokenEntry struct {
-	ID  uuid.UUID `column:"id" json:"id"`
-	Key string    `column:"key" json:"key,omitempty"`
+	ID      uuid.UUID `column:"id" json:"id"`
+	Key     string    `column:"-" json:"key,omitempty" visibility:"owner"` // Only known when created, only the hash is stored.
+	KeyHash string    `column:"key_hash" json:"-"`                         // Hex-encoded SHA-256 of the key, for looking up tokens without storing the keys.
 	// TODO rename to just "user" since the DB is fixed now
 	OwnerUserID    *uuid.UUID `column:"owner_user" json:"owner_user,omitempty"`       // Optional, not used for e.g. test status scripts.
 	NonUserRole    *Role      `column:"non_user_role" json:"non_user_role,omitempty"` // Role if not a user token. Call .GetRole() to get the effective role.
@@ -68,32 +77,65 @@ type AccessTokenEntry struct {
 	ExpirationTime time.Time  `column:"expiration_time" json:"expiration_time"`
 	IsStatic       bool       `column:"static" json:"static"` // If the token is static, i.e. defined by the config instead of DB and can't be created or deleted through the API.
 	Comment        string     `column:"comment" json:"comment"`
-	OwnerUser      *User      `column:"-" json:"-"` // The linked user (if any). Do not modify this object. Call .LoadUser() again if the underlying user is modified.
+	LastUsedTime   *time.Time `column:"last_used_time" json:"last_used_time"` // Updated in batches, so it may lag slightly behind.
+	UsageCount     int        `column:"usage_count" json:"usage_count"`       // Number of requests using this token. Updated in batches.
+	OwnerUser      *User      `column:"-" json:"-"`                           // The linked user (if any). Do not modify this object. Call .LoadUser() again if the underlying user is modified.
+	created        bool       // Created for the current request, so the key is shown to the requester
 }
 
 // AccessTokenEntries is multiple AccessTokenEntry.
 type AccessTokenEntries []*AccessTokenEntry
 
+// accessTokenUsage is the not yet saved usage stats for a single token.
+type accessTokenUsage struct {
+	lastUsedTime time.Time
+	count        int
+}
+
+// Usage stats waiting to be saved, to avoid a DB write for every request.
+var pendingTokenUsages = make(map[uuid.UUID]*accessTokenUsage)
+var pendingTokenUsagesMutex sync.Mutex
+
 func init() {
 	AddHandler("/access_tokens/", "^$", func() interface{} { return &AccessTokenEntries{} })
 	AddHandler("/access_token/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &AccessTokenEntry{} })
+	worker.AddTask("access-token-usage-flush", tokenUsageFlushInterval, flushAccessTokenUsages)
 }
 
-// UpdateStaticAccessTokens deletes the previous static tokens and load new ones from the config.
-// To be called at least when starting the program.
+// UpdateStaticAccessTokens applies the static tokens from the config to the DB, adding new ones, updating
+// changed ones and removing missing ones, so unchanged tokens keep working (and keep their usage stats).
+// To be called at least when starting the program and when reloading the config.
+// Runs in a transaction, so requests never see a partial set of static tokens.
 func UpdateStaticAccessTokens() error {
-	// Delete all old static tokens
-	dbResult := db.Delete("access_tokens", "static", "=", true)
+	return updateStaticAccessTokens(config.Get())
+}
+
+// updateStaticAccessTokens applies the static tokens from the given config, see UpdateStaticAccessTokens.
+func updateStaticAccessTokens(settings *config.Settings) error {
+	tx, txErr := db.DB.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+
+	// Get the current static tokens
+	var existingTokens AccessTokenEntries
+	dbResult := db.SelectMany(&existingTokens, "access_tokens", "static", "=", true)
 	if dbResult.IsFailed() {
 		return dbResult.Error
 	}
+	existingTokensByID := make(map[uuid.UUID]*AccessTokenEntry, len(existingTokens))
+	for _, token := range existingTokens {
+		existingTokensByID[token.ID] = token
+	}
 
-	// Create new ones
-	for tokenID, tokenConfig := range config.Config.AccessTokens {
+	// Add new ones and update changed ones
+	keptTokenIDs := make(map[uuid.UUID]bool)
+	for tokenID, tokenConfig := range settings.AccessTokens {
 		role := (Role)(tokenConfig.Role)
 		token := AccessTokenEntry{
 			ID:             tokenID,
-			Key:            tokenConfig.Key,
+			KeyHash:        staticKeyHash(tokenConfig.Key, tokenConfig.KeyHash),
 			NonUserRole:    &role,
 			CreationTime:   time.Now(),
 			ExpirationTime: time.Now().AddDate(1000, 0, 0), // + 1000 years
@@ -101,6 +143,11 @@ func UpdateStaticAccessTokens() error {
 			Comment:        tokenConfig.Comment,
 		}
 
+		// Tokens without a key (only HMAC or client certificate) still need a unique key hash
+		if token.KeyHash == "" {
+			token.KeyHash = noKeyHashPrefix + tokenID.String()
+		}
+
 		// Validate
 		if valRes := token.validateInternal(); valRes != "" {
 			log.Warnf("Failed to validate static access token, it will not be added: %v", valRes)
@@ -108,15 +155,68 @@ func UpdateStaticAccessTokens() error {
 		}
 
 		// Save
-		dbResult := db.Insert("access_tokens", token)
-		if dbResult.IsFailed() {
+		if existingToken, ok := existingTokensByID[tokenID]; ok {
+			if existingToken.KeyHash != token.KeyHash || existingToken.GetRole() != role || existingToken.Comment != token.Comment {
+				if _, err := tx.Exec("UPDATE access_tokens SET key_hash = $2, non_user_role = $3, comment = $4 WHERE id = $1",
+					tokenID, token.KeyHash, role, token.Comment); err != nil {
+					return err
+				}
+			}
+		} else {
+			dbResult := db.InsertWith(tx, "access_tokens", token)
+			if dbResult.IsFailed() {
+				return dbResult.Error
+			}
+		}
+		keptTokenIDs[tokenID] = true
+
+		// Replace the previous keys, still accepted during rotation
+		if _, err := tx.Exec("DELETE FROM access_token_keys WHERE token = $1", tokenID); err != nil {
+			return err
+		}
+		previousKeyHashes := make([]string, 0, len(tokenConfig.PreviousKeys)+len(tokenConfig.PreviousKeyHashes))
+		for _, previousKey := range tokenConfig.PreviousKeys {
+			previousKeyHashes = append(previousKeyHashes, staticKeyHash(previousKey, ""))
+		}
+		for _, previousKeyHash := range tokenConfig.PreviousKeyHashes {
+			previousKeyHashes = append(previousKeyHashes, staticKeyHash("", previousKeyHash))
+		}
+		for _, previousKeyHash := range previousKeyHashes {
+			if _, err := tx.Exec("INSERT INTO access_token_keys (token, key_hash) VALUES ($1, $2) ON CONFLICT DO NOTHING", tokenID, previousKeyHash); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Remove missing ones
+	for _, existingToken := range existingTokens {
+		if keptTokenIDs[existingToken.ID] {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM access_token_keys WHERE token = $1", existingToken.ID); err != nil {
+			return err
+		}
+		if dbResult := db.DeleteWith(tx, "access_tokens", "id", "=", existingToken.ID); dbResult.IsFailed() {
 			return dbResult.Error
 		}
 	}
 
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	db.NotifyWrite("access_tokens")
+	staticAccessTokensLoaded.Store(true)
 	return nil
 }
 
+// staticKeyHash gets the key hash for a static token configured with either the key or the hash.
+func staticKeyHash(key string, keyHash string) string {
+	if keyHash == "" && key != "" {
+		return hashAccessTokenKey(key)
+	}
+	return strings.ToLower(keyHash)
+}
+
 // createUserAccessToken creates and saves an access token with a generated ID and key, starting now.
 func createUserAccessToken(user *User) (*AccessTokenEntry, error) {
 	newKey, newKeyErr := generateAccessTokenKey()
@@ -127,6 +227,7 @@ func createUserAccessToken(user *User) (*AccessTokenEntry, error) {
 	token := AccessTokenEntry{
 		ID:             uuid.New(),
 		Key:            newKey,
+		KeyHash:        hashAccessTokenKey(newKey),
 		OwnerUserID:    user.ID,
 		NonUserRole:    nil,
 		CreationTime:   time.Now(),
@@ -134,6 +235,47 @@ func createUserAccessToken(user *User) (*AccessTokenEntry, error) {
 		IsStatic:       false,
 		Comment:        fmt.Sprintf("OAuth2: %v", user.Username),
 		OwnerUser:      user,
+		created:        true,
+	}
+
+	if valRes := token.validateInternal(); valRes != "" {
+		return nil, fmt.Errorf("failed to validate access token: %v", valRes)
+	}
+
+	dbResult := db.Insert("access_tokens", token)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+
+	return &token, nil
+}
+
+// CreateNonUserAccessToken creates and saves a non-static access token for scripts etc. with a generated ID and key, starting now.
+func CreateNonUserAccessToken(role Role, comment string, validity time.Duration) (*AccessTokenEntry, error) {
+	switch role {
+	case RoleTester, RoleRunner, RoleOperator, RoleAdmin:
+	default:
+		return nil, fmt.Errorf("invalid role for non-user access token: %v", role)
+	}
+	if validity <= 0 {
+		return nil, fmt.Errorf("validity must be positive")
+	}
+
+	newKey, newKeyErr := generateAccessTokenKey()
+	if newKeyErr != nil {
+		return nil, newKeyErr
+	}
+	now := time.Now()
+	token := AccessTokenEntry{
+		ID:             uuid.New(),
+		Key:            newKey,
+		KeyHash:        hashAccessTokenKey(newKey),
+		NonUserRole:    &role,
+		CreationTime:   now,
+		ExpirationTime: now.Add(validity),
+		IsStatic:       false,
+		Comment:        comment,
+		created:        true,
 	}
 
 	if valRes := token.validateInternal(); valRes != "" {
@@ -148,28 +290,59 @@ func createUserAccessToken(user *User) (*AccessTokenEntry, error) {
 	return &token, nil
 }
 
+// RevokeAccessToken deletes a non-static access token.
+// Returns false if no such token exists. Static tokens must be removed from the config instead.
+func RevokeAccessToken(id uuid.UUID) (bool, error) {
+	dbResult := db.Delete("access_tokens", "id", "=", id, "static", "=", false)
+	if dbResult.IsFailed() {
+		return false, dbResult.Error
+	}
+	return dbResult.Affected > 0, nil
+}
+
 // loadAccessTokenByKey returns a valid token for the provided key or nil if none exists.
 // If a token key header was specified but no valid token could be found for it,
-// the request should probably be denied.
-func loadAccessTokenByKey(key string) *AccessTokenEntry {
+// the request should probably be denied. Errors are only returned for internal failures.
+func loadAccessTokenByKey(key string) (*AccessTokenEntry, error) {
 	if key == "" {
-		return nil
+		return nil, nil
+	}
+
+	// Find the token by key hash, or by previous key hash for static tokens being rotated
+	keyHash := hashAccessTokenKey(key)
+	tokenSearch := []interface{}{"key_hash", "=", keyHash}
+	storedKeyHash := ""
+	row := db.DB.QueryRow("SELECT token, key_hash FROM access_token_keys WHERE key_hash = $1", keyHash)
+	var previousKeyTokenID string
+	switch err := row.Scan(&previousKeyTokenID, &storedKeyHash); err {
+	case nil:
+		tokenSearch = []interface{}{"id", "=", previousKeyTokenID}
+	case sql.ErrNoRows:
+	default:
+		log.WithError(err).Error("Failed to select previous access token key from DB")
+		return nil, err
 	}
 
 	// Get from DB, if created and not expired
 	var token AccessTokenEntry
 	now := time.Now()
-	var whereArgs []interface{}
-	whereArgs = append(whereArgs, "key", "=", key)
+	whereArgs := tokenSearch
 	whereArgs = append(whereArgs, "creation_time", "<=", now)
 	whereArgs = append(whereArgs, "expiration_time", ">=", now)
 	dbResult := db.Select(&token, "access_tokens", whereArgs...)
 	if dbResult.IsFailed() {
 		log.WithError(dbResult.Error).Error("Failed to select access token from DB")
-		return nil
+		return nil, dbResult.Error
 	}
 	if !dbResult.IsSuccess() {
-		return nil
+		return nil, nil
+	}
+	// The DB lookup is by hash, so it doesn't leak the key through timing, but compare properly anyway
+	if storedKeyHash == "" {
+		storedKeyHash = token.KeyHash
+	}
+	if subtle.ConstantTimeCompare([]byte(storedKeyHash), []byte(keyHash)) != 1 {
+		return nil, nil
 	}
 
 	// Load user (if any)
@@ -181,11 +354,11 @@ func loadAccessTokenByKey(key string) *AccessTokenEntry {
 				"token": token.ID,
 				"user":  token.OwnerUserID,
 			}).WithError(userErr).Warning("Failed to referenced user from token")
-			return nil
+			return nil, userErr
 		}
 	}
 
-	return &token
+	return &token, nil
 }
 
 // makeGuestAccessToken creates an empty-ish guest access token, such that all requests (authenticated or not) have a role.
@@ -206,12 +379,58 @@ func makeGuestAccessToken() AccessTokenEntry {
 }
 
 // purgeExpiredAccessTokens deletes all expired tokens. Should be called periodically.
+// If configured, it also deletes non-static tokens which haven't been used for a number of days.
 func purgeExpiredAccessTokens() {
 	now := time.Now()
 	dbResult := db.Delete("access_tokens", "expiration_time", "<=", now)
 	if dbResult.IsFailed() {
 		log.WithError(dbResult.Error).Error("Failed to purge old access tokens")
 	}
+
+	if config.Get().AccessTokenUnusedDays > 0 {
+		cutoff := now.AddDate(0, 0, -config.Get().AccessTokenUnusedDays)
+		_, err := db.DB.Exec("DELETE FROM access_tokens WHERE static = false AND COALESCE(last_used_time, creation_time) <= $1", cutoff)
+		if err != nil {
+			log.WithError(err).Error("Failed to purge unused access tokens")
+		}
+	}
+}
+
+// recordAccessTokenUsage adds a usage of the token to the pending usage stats.
+// The stats are saved later by flushAccessTokenUsages.
+func recordAccessTokenUsage(token *AccessTokenEntry) {
+	pendingTokenUsagesMutex.Lock()
+	defer pendingTokenUsagesMutex.Unlock()
+	usage, ok := pendingTokenUsages[token.ID]
+	if !ok {
+		usage = &accessTokenUsage{}
+		pendingTokenUsages[token.ID] = usage
+	}
+	usage.lastUsedTime = time.Now()
+	usage.count++
+}
+
+// flushAccessTokenUsages saves all pending usage stats to the DB.
+func flushAccessTokenUsages() {
+	pendingTokenUsagesMutex.Lock()
+	usages := pendingTokenUsages
+	pendingTokenUsages = make(map[uuid.UUID]*accessTokenUsage)
+	pendingTokenUsagesMutex.Unlock()
+
+	for tokenID, usage := range usages {
+		_, err := db.DB.Exec("UPDATE access_tokens SET last_used_time = $2, usage_count = usage_count + $3 WHERE id = $1",
+			tokenID, usage.lastUsedTime, usage.count)
+		if err != nil {
+			log.WithError(err).WithField("token", tokenID).Warn("Failed to save access token usage")
+		}
+	}
+}
+
+// hashAccessTokenKey gets the hex-encoded SHA-256 of the key, which is what's stored.
+// The keys are long and random, so a plain hash is sufficient (unlike for passwords).
+func hashAccessTokenKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
 }
 
 // Generate a Base64-encoded token key using a secure amount of random bytes.
@@ -230,7 +449,7 @@ func generateAccessTokenKey() (string, error) {
 // It does not care if the token is "not created yet" or expired.
 func (token *AccessTokenEntry) validateInternal() string {
 	switch {
-	case token.Key == "":
+	case token.KeyHash == "":
 		return "missing key"
 	case token.OwnerUserID != nil && token.NonUserRole != nil || token.OwnerUserID == nil && token.NonUserRole == nil:
 		return "exactly one of user ID and non-user role must be set"
@@ -252,6 +471,14 @@ func (token *AccessTokenEntry) GetRole() Role {
 	return RoleInvalid
 }
 
+// IsOwnedBy checks if the token was just created for the requester or belongs to the same user, for the key visibility.
+func (token *AccessTokenEntry) IsOwnedBy(requester *AccessTokenEntry) bool {
+	if token.created {
+		return true
+	}
+	return token.OwnerUserID != nil && requester.OwnerUserID != nil && *token.OwnerUserID == *requester.OwnerUserID
+}
+
 // IsAuthenticated checks if the requestor is authenticated.
 func (token *AccessTokenEntry) IsAuthenticated() bool {
 	role := token.GetRole()
@@ -262,10 +489,10 @@ func (token *AccessTokenEntry) IsAuthenticated() bool {
 func (tokens *AccessTokenEntries) Get(request *Request) Result {
 	var whereArgs []interface{}
 	if userID, ok := request.QueryArgs["user"]; ok {
-		whereArgs = append(whereArgs, "user", "=", userID)
+		whereArgs = append(whereArgs, "owner_user", "=", userID)
 	}
 	if role, ok := request.QueryArgs["role"]; ok {
-		whereArgs = append(whereArgs, "role", "=", role)
+		whereArgs = append(whereArgs, "non_user_role", "=", role)
 	}
 	if rawStatic, ok := request.QueryArgs["static"]; ok {
 		static, err := strconv.ParseBool(rawStatic)
@@ -278,7 +505,7 @@ func (tokens *AccessTokenEntries) Get(request *Request) Result {
 	role := request.AccessToken.GetRole()
 	if role != RoleAdmin {
 		if request.AccessToken.OwnerUser != nil {
-			whereArgs = append(whereArgs, "user", "=", *request.AccessToken.OwnerUserID)
+			whereArgs = append(whereArgs, "owner_user", "=", *request.AccessToken.OwnerUserID)
 		} else {
 			// No access, just leave
 			return Result{}
@@ -287,12 +514,7 @@ func (tokens *AccessTokenEntries) Get(request *Request) Result {
 
 	dbResult := db.SelectMany(tokens, "access_tokens", whereArgs...)
 	if dbResult.IsFailed() {
-		return Result{Code: 500, Error: dbResult.Error}
-	}
-
-	// Hide key
-	for _, token := range *tokens {
-		token.Key = ""
+		return InternalError(dbResult.Error)
 	}
 
 	return Result{}
@@ -302,7 +524,7 @@ func (tokens *AccessTokenEntries) Get(request *Request) Result {
 func (token *AccessTokenEntry) Get(request *Request) Result {
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return Result{Code: 400, Message: "missing ID"}
+		return BadRequest("missing ID")
 	}
 
 	// Check if self or admin
@@ -312,14 +534,11 @@ func (token *AccessTokenEntry) Get(request *Request) Result {
 
 	dbResult := db.Select(token, "access_tokens", "id", "=", id)
 	if dbResult.IsFailed() {
-		return Result{Code: 500, Error: dbResult.Error}
+		return InternalError(dbResult.Error)
 	}
 	if !dbResult.IsSuccess() {
-		return Result{Code: 404, Message: "not found"}
+		return NotFound("not found")
 	}
 
-	// Hide key
-	token.Key = ""
-
 	return Result{}
 }
@@ -0,0 +1,57 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest_test
+
+import (
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/rest/resttest"
+)
+
+func TestMain(m *testing.M) {
+	resttest.Main(m)
+}
+
+func TestAccessTokensGet(t *testing.T) {
+	harness := resttest.New(t)
+	userID, participantKey := harness.User(rest.RoleParticipant)
+	otherUserID, _ := harness.User(rest.RoleParticipant)
+	adminKey := harness.Token(rest.RoleAdmin)
+	harness.Token(rest.RoleTester)
+
+	// Participants only see their own tokens
+	var tokens rest.AccessTokenEntries
+	resttest.DecodeJSON(t, harness.Do("GET", "/api/access_tokens/", participantKey, nil), 200, &tokens)
+	helper.CheckEqual(t, len(tokens), 1)
+	helper.CheckEqual(t, *tokens[0].OwnerUserID, userID)
+
+	// Admins may filter by user and role
+	tokens = nil
+	resttest.DecodeJSON(t, harness.Do("GET", "/api/access_tokens/?user="+otherUserID.String(), adminKey, nil), 200, &tokens)
+	helper.CheckEqual(t, len(tokens), 1)
+	helper.CheckEqual(t, *tokens[0].OwnerUserID, otherUserID)
+	tokens = nil
+	resttest.DecodeJSON(t, harness.Do("GET", "/api/access_tokens/?role=tester", adminKey, nil), 200, &tokens)
+	helper.CheckEqual(t, len(tokens), 1)
+	helper.CheckEqual(t, *tokens[0].NonUserRole, rest.RoleTester)
+}
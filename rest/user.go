@@ -69,7 +69,7 @@ func (users *Users) Get(request *Request) Result {
 
 	dbResult := db.SelectMany(users, "users", whereArgs...)
 	if dbResult.IsFailed() {
-		return Result{Code: 500, Error: dbResult.Error}
+		return InternalError(dbResult.Error)
 	}
 	return Result{}
 }
@@ -78,11 +78,11 @@ func (users *Users) Get(request *Request) Result {
 func (user *User) Get(request *Request) Result {
 	strID, strIDExists := request.PathArgs["id"]
 	if !strIDExists || strID == "" {
-		return Result{Code: 400, Message: "missing ID"}
+		return BadRequest("missing ID")
 	}
 	id, idParseErr := uuid.Parse(strID)
 	if idParseErr != nil {
-		return Result{Code: 400, Message: "invalid user ID"}
+		return BadRequest("invalid user ID")
 	}
 
 	// Check if self or operator/admin
@@ -93,10 +93,10 @@ func (user *User) Get(request *Request) Result {
 
 	dbResult := db.Select(user, "users", "id", "=", id)
 	if dbResult.IsFailed() {
-		return Result{Code: 500, Error: dbResult.Error}
+		return InternalError(dbResult.Error)
 	}
 	if !dbResult.IsSuccess() {
-		return Result{Code: 404, Message: "not found"}
+		return NotFound("not found")
 	}
 	return Result{}
 }
@@ -128,17 +128,17 @@ func (user *User) save() error {
 // func (user *User) Put(request *Request) Result {
 // 	strID, strIDExists := request.PathArgs["id"]
 // 	if !strIDExists || strID == "" {
-// 		return Result{Code: 400, Message: "missing ID"}
+// 		return BadRequest("missing ID")
 // 	}
 // 	id, idParseErr := uuid.Parse(strID)
 // 	if idParseErr != nil {
-// 		return Result{Code: 400, Message: "invalid ID"}
+// 		return BadRequest("invalid ID")
 // 	}
 // 	if result := user.validate(); !result.IsOk() {
 // 		return result
 // 	}
 // 	if *user.ID != id {
-// 		return Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
+// 		return BadRequest("mismatch between URL and JSON IDs")
 // 	}
 
 // 	return user.createOrUpdate()
@@ -146,14 +146,14 @@ func (user *User) save() error {
 
 // func (user *User) create() Result {
 // 	if exists, err := user.ExistsWithID(); err != nil {
-// 		return Result{Code: 500, Error: err}
+// 		return InternalError(err)
 // 	} else if exists {
-// 		return Result{Code: 409, Message: "duplicate"}
+// 		return Conflict("duplicate")
 // 	}
 
 // 	dbResult := db.Insert("users", user)
 // 	if dbResult.IsFailed() {
-// 		return Result{Code: 500, Error: dbResult.Error}
+// 		return InternalError(dbResult.Error)
 // 	}
 // 	return Result{}
 // }
@@ -170,7 +170,7 @@ func loadUser(id uuid.UUID) (*User, error) {
 func (user *User) createOrUpdate() Result {
 	exists, existsErr := user.ExistsWithID()
 	if existsErr != nil {
-		return Result{Code: 500, Error: existsErr}
+		return InternalError(existsErr)
 	}
 
 	var dbResult db.Result
@@ -180,7 +180,7 @@ func (user *User) createOrUpdate() Result {
 		dbResult = db.Insert("users", user)
 	}
 	if dbResult.IsFailed() {
-		return Result{Code: 500, Error: dbResult.Error}
+		return InternalError(dbResult.Error)
 	}
 	return Result{}
 }
@@ -188,19 +188,19 @@ func (user *User) createOrUpdate() Result {
 func (user *User) validate() Result {
 	switch {
 	case user.ID == nil:
-		return Result{Code: 400, Message: "missing ID"}
+		return BadRequest("missing ID")
 	case user.Username == "":
-		return Result{Code: 400, Message: "missing username"}
+		return BadRequest("missing username")
 	case user.DisplayName == "":
-		return Result{Code: 400, Message: "missing display name"}
+		return BadRequest("missing display name")
 	case user.EmailAddress == "":
-		return Result{Code: 400, Message: "missing email address"}
+		return BadRequest("missing email address")
 	}
 
 	if exists, err := user.ExistsWithUsername(); err != nil {
-		return Result{Code: 500, Error: err}
+		return InternalError(err)
 	} else if exists {
-		return Result{Code: 409, Message: "username already exists"}
+		return Conflict("username already exists")
 	}
 
 	return Result{}
@@ -0,0 +1,167 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Validator may be implemented by handler types to add custom checks to the struct tag rules.
+// It returns a list of problems, which is empty if valid.
+type Validator interface {
+	ValidationProblems() []string
+}
+
+// Validate checks a struct (or list of structs) against the rules in its "validate" struct tags,
+// e.g. `validate:"required,uuid,maxlen=64"`, and any custom Validator hook.
+// Supported rules are required, uuid, maxlen=<n>, min=<n>, max=<n> and oneof=<a>|<b>.
+// Rules other than required are skipped for zero values.
+// It returns all problems found, using the JSON field names.
+func Validate(item interface{}) []string {
+	return validateValue(reflect.ValueOf(item), "")
+}
+
+// ValidationFailedResult creates a 400 result with all the validation problems.
+func ValidationFailedResult(problems []string) Result {
+	return Result{Code: 400, Message: "validation failed: " + strings.Join(problems, "; "), Problems: problems}
+}
+
+func validateValue(value reflect.Value, prefix string) []string {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+
+	var problems []string
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			problems = append(problems, validateValue(value.Index(i), fmt.Sprintf("%v[%v].", prefix, i))...)
+		}
+		return problems
+	case reflect.Struct:
+	default:
+		return nil
+	}
+
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		tag, ok := field.Tag.Lookup("validate")
+		if !ok || !field.IsExported() {
+			continue
+		}
+		fieldName := prefix + jsonFieldName(field)
+		for _, rule := range strings.Split(tag, ",") {
+			if problem := checkRule(value.Field(i), rule); problem != "" {
+				problems = append(problems, fieldName+" "+problem)
+			}
+		}
+	}
+
+	if value.CanAddr() {
+		if validator, ok := value.Addr().Interface().(Validator); ok {
+			for _, problem := range validator.ValidationProblems() {
+				problems = append(problems, prefix+problem)
+			}
+		}
+	}
+	return problems
+}
+
+func jsonFieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+// checkRule checks a single rule for a field value, returning a problem description or an empty string.
+func checkRule(value reflect.Value, rule string) string {
+	ruleName, ruleArg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+	if ruleName == "required" {
+		if value.IsZero() || (value.Kind() == reflect.Slice && value.Len() == 0) {
+			return "is required"
+		}
+		return ""
+	}
+	if value.IsZero() {
+		return ""
+	}
+	for value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+
+	switch ruleName {
+	case "uuid":
+		if value.Kind() == reflect.String {
+			if _, err := uuid.Parse(value.String()); err != nil {
+				return "must be a UUID"
+			}
+		}
+	case "maxlen":
+		maxLength, _ := strconv.Atoi(ruleArg)
+		switch value.Kind() {
+		case reflect.String:
+			if len([]rune(value.String())) > maxLength {
+				return fmt.Sprintf("can't be longer than %v characters", maxLength)
+			}
+		case reflect.Slice, reflect.Array, reflect.Map:
+			if value.Len() > maxLength {
+				return fmt.Sprintf("can't have more than %v elements", maxLength)
+			}
+		}
+	case "min", "max":
+		limit, _ := strconv.ParseInt(ruleArg, 10, 64)
+		var number int64
+		switch value.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			number = value.Int()
+		default:
+			return ""
+		}
+		if ruleName == "min" && number < limit {
+			return fmt.Sprintf("can't be less than %v", limit)
+		}
+		if ruleName == "max" && number > limit {
+			return fmt.Sprintf("can't be more than %v", limit)
+		}
+	case "oneof":
+		if value.Kind() == reflect.String {
+			options := strings.Split(ruleArg, "|")
+			for _, option := range options {
+				if value.String() == option {
+					return ""
+				}
+			}
+			return fmt.Sprintf("must be one of %v", strings.Join(options, ", "))
+		}
+	}
+	return ""
+}
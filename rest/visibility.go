@@ -0,0 +1,172 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Values for the "visibility" struct tag, for fields only included in responses to some requesters.
+// Hidden fields are zeroed by the receiver after the handler, so they should be "omitempty" or have a harmless zero value.
+// Handlers must return data they own, since it's modified in place.
+const (
+	// VisibilityAdmin fields are only visible to operators and admins.
+	VisibilityAdmin = "admin"
+	// VisibilityOwner fields are only visible to operators, admins and the owner (see Owned).
+	VisibilityOwner = "owner"
+)
+
+// Owned may be implemented by types with VisibilityOwner fields, to tell if the requester owns the value.
+// Types not implementing it are never owned.
+type Owned interface {
+	IsOwnedBy(token *AccessTokenEntry) bool
+}
+
+// maxRedactDepth limits how deep into the data redaction goes, in case of cycles.
+const maxRedactDepth = 32
+
+// visibilityTypes caches if types (or anything they contain) have visibility tags.
+var visibilityTypes sync.Map // reflect.Type to bool
+
+// redactData zeroes the fields of the data which are not visible to the requester.
+func redactData(data interface{}, token *AccessTokenEntry) {
+	if data == nil {
+		return
+	}
+	role := token.GetRole()
+	privileged := role == RoleOperator || role == RoleAdmin
+	if privileged || !hasVisibilityTags(reflect.TypeOf(data)) {
+		return
+	}
+	redactValue(reflect.ValueOf(data), token, 0)
+}
+
+func redactValue(value reflect.Value, token *AccessTokenEntry, depth int) {
+	if depth > maxRedactDepth || !value.IsValid() {
+		return
+	}
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !value.IsNil() {
+			redactValue(value.Elem(), token, depth+1)
+		}
+	case reflect.Slice, reflect.Array:
+		if !hasVisibilityTags(value.Type().Elem()) {
+			return
+		}
+		for i := 0; i < value.Len(); i++ {
+			redactValue(value.Index(i), token, depth+1)
+		}
+	case reflect.Map:
+		if !hasVisibilityTags(value.Type().Elem()) {
+			return
+		}
+		// Map elements aren't addressable, so redact copies and put them back
+		iterator := value.MapRange()
+		for iterator.Next() {
+			element := reflect.New(value.Type().Elem()).Elem()
+			element.Set(iterator.Value())
+			redactValue(element, token, depth+1)
+			value.SetMapIndex(iterator.Key(), element)
+		}
+	case reflect.Struct:
+		redactStruct(value, token, depth)
+	}
+}
+
+func redactStruct(value reflect.Value, token *AccessTokenEntry, depth int) {
+	valueType := value.Type()
+	if !hasVisibilityTags(valueType) {
+		return
+	}
+	var owned *bool
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if (field.PkgPath != "" && !field.Anonymous) || field.Tag.Get("json") == "-" {
+			continue
+		}
+		visibility := field.Tag.Get("visibility")
+		if visibility == "" {
+			redactValue(value.Field(i), token, depth+1)
+			continue
+		}
+		if visibility == VisibilityOwner {
+			if owned == nil {
+				isOwned := isOwnedBy(value, token)
+				owned = &isOwned
+			}
+			if *owned {
+				continue
+			}
+		}
+		if value.Field(i).CanSet() {
+			value.Field(i).Set(reflect.Zero(field.Type))
+		}
+	}
+}
+
+// isOwnedBy checks if the struct value (or a pointer to it) implements Owned and is owned by the requester.
+func isOwnedBy(value reflect.Value, token *AccessTokenEntry) bool {
+	if value.CanAddr() {
+		if owner, ok := value.Addr().Interface().(Owned); ok {
+			return owner.IsOwnedBy(token)
+		}
+	}
+	if value.CanInterface() {
+		if owner, ok := value.Interface().(Owned); ok {
+			return owner.IsOwnedBy(token)
+		}
+	}
+	return false
+}
+
+// hasVisibilityTags checks if the type has any fields with visibility tags, including nested types.
+func hasVisibilityTags(valueType reflect.Type) bool {
+	if cached, ok := visibilityTypes.Load(valueType); ok {
+		return cached.(bool)
+	}
+	has := findVisibilityTags(valueType, make(map[reflect.Type]bool))
+	visibilityTypes.Store(valueType, has)
+	return has
+}
+
+func findVisibilityTags(valueType reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[valueType] {
+		return false
+	}
+	seen[valueType] = true
+	switch valueType.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return findVisibilityTags(valueType.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < valueType.NumField(); i++ {
+			field := valueType.Field(i)
+			if (field.PkgPath != "" && !field.Anonymous) || field.Tag.Get("json") == "-" {
+				continue
+			}
+			if field.Tag.Get("visibility") != "" || findVisibilityTags(field.Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/google/uuid"
+)
+
+func TestRedactData(t *testing.T) {
+	userID := uuid.New()
+	otherUserID := uuid.New()
+	participant := AccessTokenEntry{OwnerUserID: &userID, OwnerUser: &User{ID: &userID, Role: RoleParticipant}}
+	admin := AccessTokenEntry{OwnerUserID: &otherUserID, OwnerUser: &User{ID: &otherUserID, Role: RoleAdmin}}
+	makeTokens := func() AccessTokenEntries {
+		return AccessTokenEntries{
+			{Key: "own", OwnerUserID: &userID},
+			{Key: "other", OwnerUserID: &otherUserID},
+			{Key: "created", created: true},
+		}
+	}
+
+	tokens := makeTokens()
+	redactData(&tokens, &participant)
+	helper.CheckEqual(t, tokens[0].Key, "own")
+	helper.CheckEqual(t, tokens[1].Key, "")
+	helper.CheckEqual(t, tokens[2].Key, "created")
+
+	tokens = makeTokens()
+	redactData(&tokens, &admin)
+	helper.CheckEqual(t, tokens[1].Key, "other")
+
+	nested := map[string]AccessTokenEntry{"a": {Key: "other", OwnerUserID: &otherUserID}}
+	redactData(&nested, &participant)
+	helper.CheckEqual(t, nested["a"].Key, "")
+}
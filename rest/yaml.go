@@ -0,0 +1,201 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlCodec converts single YAML documents. Anchors, aliases, merge keys, custom tags and duplicate keys are
+// rejected, as they can't be converted to JSON as-is (or, for aliases, may expand to huge documents).
+type yamlCodec struct{}
+
+func (yamlCodec) ToJSON(data []byte) ([]byte, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	var document yaml.Node
+	if err := decoder.Decode(&document); err == io.EOF {
+		return treeToJSON(nil)
+	} else if err != nil {
+		return nil, err
+	}
+	var next yaml.Node
+	if err := decoder.Decode(&next); err != io.EOF {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("multiple YAML documents are not supported")
+	}
+	value, err := yamlNodeToTree(&document)
+	if err != nil {
+		return nil, err
+	}
+	return treeToJSON(value)
+}
+
+func (yamlCodec) FromJSON(data []byte) ([]byte, error) {
+	value, err := parseJSONTree(data)
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(treeToYAMLNode(value)); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// yamlNodeToTree converts a YAML node into the same value types as parseJSONTree, keeping the mapping key order.
+func yamlNodeToTree(node *yaml.Node) (interface{}, error) {
+	if node.Anchor != "" {
+		return nil, fmt.Errorf("line %d: YAML anchors are not supported", node.Line)
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return yamlNodeToTree(node.Content[0])
+	case yaml.SequenceNode:
+		array := make([]interface{}, 0, len(node.Content))
+		for _, element := range node.Content {
+			value, err := yamlNodeToTree(element)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		return array, nil
+	case yaml.MappingNode:
+		object := make(jsonObject, 0, len(node.Content)/2)
+		seenKeys := make(map[string]bool)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode := node.Content[i]
+			if keyNode.Kind == yaml.ScalarNode && keyNode.ShortTag() == "!!merge" {
+				return nil, fmt.Errorf("line %d: YAML merge keys are not supported", keyNode.Line)
+			}
+			if keyNode.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: only scalar YAML mapping keys are supported", keyNode.Line)
+			}
+			if seenKeys[keyNode.Value] {
+				return nil, fmt.Errorf("line %d: duplicate YAML mapping key %q", keyNode.Line, keyNode.Value)
+			}
+			seenKeys[keyNode.Value] = true
+			value, err := yamlNodeToTree(node.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, jsonMember{key: keyNode.Value, value: value})
+		}
+		return object, nil
+	case yaml.ScalarNode:
+		return yamlScalarToTree(node)
+	case yaml.AliasNode:
+		return nil, fmt.Errorf("line %d: YAML aliases are not supported", node.Line)
+	}
+	return nil, fmt.Errorf("line %d: unsupported YAML node", node.Line)
+}
+
+// yamlScalarToTree converts a scalar by its resolved tag, where timestamps are kept as strings.
+func yamlScalarToTree(node *yaml.Node) (interface{}, error) {
+	switch node.ShortTag() {
+	case "!!null":
+		return nil, nil
+	case "!!bool":
+		var value bool
+		err := node.Decode(&value)
+		return value, err
+	case "!!int":
+		var value interface{}
+		if err := node.Decode(&value); err != nil {
+			return nil, err
+		}
+		if float, isFloat := value.(float64); isFloat {
+			return yamlFloat(node, float)
+		}
+		return json.Number(fmt.Sprint(value)), nil
+	case "!!float":
+		var value float64
+		if err := node.Decode(&value); err != nil {
+			return nil, err
+		}
+		return yamlFloat(node, value)
+	case "!!str", "!!timestamp":
+		return node.Value, nil
+	}
+	return nil, fmt.Errorf("line %d: YAML tag %v is not supported", node.Line, node.Tag)
+}
+
+func yamlFloat(node *yaml.Node, value float64) (interface{}, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("line %d: YAML float is not representable in JSON", node.Line)
+	}
+	return json.Number(strconv.FormatFloat(value, 'g', -1, 64)), nil
+}
+
+// treeToYAMLNode converts a value from parseJSONTree into a YAML node, keeping the object member order.
+// Empty collections are written in flow style ("[]" and "{}").
+func treeToYAMLNode(value interface{}) *yaml.Node {
+	switch typed := value.(type) {
+	case nil:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(typed)}
+	case json.Number:
+		if _, err := strconv.ParseInt(string(typed), 10, 64); err == nil {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: string(typed)}
+		}
+		if _, err := strconv.ParseUint(string(typed), 10, 64); err == nil {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: string(typed)}
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: string(typed)}
+	case []interface{}:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		if len(typed) == 0 {
+			node.Style = yaml.FlowStyle
+		}
+		for _, element := range typed {
+			node.Content = append(node.Content, treeToYAMLNode(element))
+		}
+		return node
+	case jsonObject:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		if len(typed) == 0 {
+			node.Style = yaml.FlowStyle
+		}
+		for _, member := range typed {
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: member.key}, treeToYAMLNode(member.value))
+		}
+		return node
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: fmt.Sprint(value)}
+}
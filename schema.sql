@@ -25,18 +25,57 @@ CREATE UNIQUE INDEX public_users_username_index ON public.users (username);
 -- Access token table
 CREATE TABLE public.access_tokens (
     "id" text NOT NULL UNIQUE,
-    "key" text NOT NULL UNIQUE,
+    "key_hash" text NOT NULL UNIQUE,
     "owner_user" text,
     "non_user_role" text,
     "creation_time" timestamp with time zone NOT NULL,
     "expiration_time" timestamp with time zone NOT NULL,
     "static" boolean NOT NULL,
-    "comment" text NOT NULL
+    "comment" text NOT NULL,
+    "last_used_time" timestamp with time zone,
+    "usage_count" bigint NOT NULL DEFAULT 0
 );
 
+-- Access token keys table (previous keys still accepted for static tokens, during rotation)
+CREATE TABLE public.access_token_keys (
+    "token" text NOT NULL,
+    "key_hash" text NOT NULL UNIQUE
+);
+
+-- Calendar tokens table (read-only keys for the user's calendar feed, at most one per user)
+CREATE TABLE public.calendar_tokens (
+    "user" text NOT NULL UNIQUE,
+    "key_hash" text NOT NULL UNIQUE,
+    "creation_time" timestamp with time zone NOT NULL
+);
+
+-- Idempotency keys table (responses to replay for retried POSTs)
+CREATE TABLE public.idempotency_keys (
+    "key" text NOT NULL,
+    "token" text NOT NULL,
+    "method" text NOT NULL,
+    "path" text NOT NULL,
+    "request_hash" text NOT NULL,
+    "code" int,
+    "location" text NOT NULL DEFAULT '',
+    "data" text NOT NULL DEFAULT '',
+    "creation_time" timestamp with time zone NOT NULL,
+    PRIMARY KEY (key, token)
+);
+CREATE INDEX public_idempotency_keys_creation_time_index ON public.idempotency_keys (creation_time);
+
+-- Events table
+CREATE TABLE public.events (
+    "id" text NOT NULL UNIQUE,
+    "name" text NOT NULL,
+    "status" text NOT NULL DEFAULT 'active'
+);
+CREATE UNIQUE INDEX public_events_id_index ON public.events (id);
+
 -- Document families table
 CREATE TABLE public.document_families (
     "id" text NOT NULL UNIQUE,
+    "event" text NOT NULL DEFAULT '',
     "name" text NOT NULL
 );
 CREATE UNIQUE INDEX public_document_families_id_index ON public.document_families (id);
@@ -45,22 +84,64 @@ CREATE UNIQUE INDEX public_document_families_id_index ON public.document_familie
 CREATE TABLE public.documents (
     "family" text NOT NULL,
     "shortname" text NOT NULL,
+    "locale" text NOT NULL DEFAULT 'en',
     "sequence" integer,
     "name" text NOT NULL,
     "content" text NOT NULL,
     "content_format" text NOT NULL,
     "last_change" timestamp with time zone NOT NULL,
-    UNIQUE (family, shortname)
+    "publish_from" timestamp with time zone,
+    "publish_until" timestamp with time zone,
+    "search" tsvector,
+    UNIQUE (family, shortname, locale)
+);
+CREATE UNIQUE INDEX public_documents_family_shortname_locale_index ON public.documents (family, shortname, locale);
+CREATE INDEX public_documents_search_index ON public.documents USING GIN (search);
+
+-- Document reads table (which users have fetched which documents)
+CREATE TABLE public.document_reads (
+    "family" text NOT NULL,
+    "shortname" text NOT NULL,
+    "user" text NOT NULL,
+    "first_read_time" timestamp with time zone NOT NULL,
+    "last_read_time" timestamp with time zone NOT NULL,
+    "read_count" integer NOT NULL DEFAULT 0,
+    UNIQUE (family, shortname, "user")
+);
+
+-- Attachments table
+CREATE TABLE public.attachments (
+    "id" text NOT NULL UNIQUE,
+    "document_family" text,
+    "document_shortname" text,
+    "task" text,
+    "filename" text NOT NULL,
+    "content_type" text NOT NULL,
+    "size" bigint NOT NULL,
+    "upload_time" timestamp with time zone NOT NULL
 );
-CREATE UNIQUE INDEX public_documents_family_shortname_index ON public.documents (family, shortname);
+CREATE UNIQUE INDEX public_attachments_id_index ON public.attachments (id);
 
 -- Tracks table
 CREATE TABLE public.tracks (
     "id" text NOT NULL UNIQUE,
+    "event" text NOT NULL DEFAULT '',
     "type" text NOT NULL,
-    "name" text
+    "name" text,
+    "max_duration_minutes" integer NOT NULL DEFAULT 0,
+    "no_show_minutes" integer NOT NULL DEFAULT 0,
+    "task_lock_mode" text NOT NULL DEFAULT '',
+    "status" text NOT NULL DEFAULT 'open',
+    "registration_open_time" timestamp with time zone,
+    "registration_close_time" timestamp with time zone,
+    "max_registrations" integer NOT NULL DEFAULT 0,
+    "registration_approval" boolean NOT NULL DEFAULT false,
+    "created_at" timestamp with time zone NOT NULL DEFAULT now(),
+    "updated_at" timestamp with time zone NOT NULL DEFAULT now(),
+    "search" tsvector
 );
 CREATE UNIQUE INDEX public_tracks_id_index ON public.tracks (id);
+CREATE INDEX public_tracks_search_index ON public.tracks USING GIN (search);
 
 -- Tasks table
 CREATE TABLE public.tasks (
@@ -70,9 +151,57 @@ CREATE TABLE public.tasks (
     "name" text NOT NULL,
     "description" text NOT NULL,
     "sequence" int,
+    "points" integer NOT NULL DEFAULT 0,
+    "created_at" timestamp with time zone NOT NULL DEFAULT now(),
+    "updated_at" timestamp with time zone NOT NULL DEFAULT now(),
+    "search" tsvector,
     UNIQUE (track, shortname)
 );
 CREATE UNIQUE INDEX public_tasks_id_index ON public.tasks (id);
+CREATE INDEX public_tasks_search_index ON public.tasks USING GIN (search);
+
+-- Task checks table (run by the backend, saved as tests)
+CREATE TABLE public.task_checks (
+    "id" text NOT NULL UNIQUE,
+    "task" text NOT NULL,
+    "shortname" text NOT NULL,
+    "name" text NOT NULL,
+    "sequence" integer,
+    "type" text NOT NULL,
+    "target" text NOT NULL,
+    "query" text NOT NULL DEFAULT '',
+    "expect" text NOT NULL DEFAULT '',
+    "script" text NOT NULL DEFAULT '',
+    "enabled" boolean NOT NULL DEFAULT true,
+    UNIQUE (task, shortname)
+);
+CREATE UNIQUE INDEX public_task_checks_id_index ON public.task_checks (id);
+
+-- Hints table
+CREATE TABLE public.hints (
+    "id" text NOT NULL UNIQUE,
+    "task" text NOT NULL,
+    "sequence" integer NOT NULL,
+    "content" text NOT NULL,
+    "penalty" integer NOT NULL DEFAULT 0,
+    "enabled" boolean NOT NULL DEFAULT false
+);
+CREATE UNIQUE INDEX public_hints_id_index ON public.hints (id);
+
+-- Hint releases table
+CREATE TABLE public.hint_releases (
+    "timeslot" text NOT NULL,
+    "hint" text NOT NULL,
+    "release_time" timestamp with time zone NOT NULL,
+    UNIQUE (timeslot, hint)
+);
+
+-- Task dependencies table
+CREATE TABLE public.task_dependencies (
+    "task" text NOT NULL,
+    "depends_on" text NOT NULL,
+    UNIQUE (task, depends_on)
+);
 
 -- Stations table
 CREATE TABLE public.stations (
@@ -84,22 +213,239 @@ CREATE TABLE public.stations (
     "status" text NOT NULL,
     "credentials" text NOT NULL,
     "notes" text NOT NULL,
-    "timeslot" text NOT NULL,
+    "timeslot" text,
+    "console_address" text NOT NULL DEFAULT '',
+    "credentials_rotate_time" timestamp with time zone,
+    "failure_reason" text NOT NULL DEFAULT '',
+    "provisioned_by" text,
+    "provision_time" timestamp with time zone,
+    "version" integer NOT NULL DEFAULT 0,
+    "created_at" timestamp with time zone NOT NULL DEFAULT now(),
+    "updated_at" timestamp with time zone NOT NULL DEFAULT now(),
     UNIQUE (track, shortname)
 );
 CREATE UNIQUE INDEX public_stations_id_index ON public.stations (id);
 
+-- Station quota overrides table (per-user limits for dynamic stations)
+CREATE TABLE public.station_quota_overrides (
+    "user" text NOT NULL UNIQUE,
+    "max_stations" integer NOT NULL DEFAULT 0,
+    "max_provisions_per_day" integer NOT NULL DEFAULT 0,
+    "comment" text NOT NULL DEFAULT ''
+);
+
+-- Track operators table (users restricted to operating these tracks)
+CREATE TABLE public.track_operators (
+    "track" text NOT NULL,
+    "user" text NOT NULL,
+    UNIQUE (track, "user")
+);
+
+-- Maintenance windows table
+CREATE TABLE public.maintenance_windows (
+    "id" text NOT NULL UNIQUE,
+    "station" text,
+    "track" text NOT NULL,
+    "begin_time" timestamp with time zone NOT NULL,
+    "end_time" timestamp with time zone NOT NULL,
+    "reason" text NOT NULL DEFAULT ''
+);
+CREATE UNIQUE INDEX public_maintenance_windows_id_index ON public.maintenance_windows (id);
+
+-- Maintenance flips table (stations set to maintenance by a window, with the status to restore)
+CREATE TABLE public.maintenance_flips (
+    "maintenance" text NOT NULL,
+    "station" text NOT NULL,
+    "previous_status" text NOT NULL,
+    UNIQUE (maintenance, station)
+);
+
+-- Webhooks table
+CREATE TABLE public.webhooks (
+    "id" text NOT NULL UNIQUE,
+    "url" text NOT NULL,
+    "events" text[] NOT NULL,
+    "secret" text NOT NULL DEFAULT '',
+    "enabled" boolean NOT NULL DEFAULT true,
+    "comment" text NOT NULL DEFAULT ''
+);
+CREATE UNIQUE INDEX public_webhooks_id_index ON public.webhooks (id);
+
+-- Webhook deliveries table (queued, delivered and dead events)
+CREATE TABLE public.webhook_deliveries (
+    "id" text NOT NULL UNIQUE,
+    "webhook" text,
+    "track" text NOT NULL DEFAULT '',
+    "event" text NOT NULL,
+    "payload" text NOT NULL,
+    "status" text NOT NULL,
+    "attempts" integer NOT NULL DEFAULT 0,
+    "last_error" text NOT NULL DEFAULT '',
+    "creation_time" timestamp with time zone NOT NULL,
+    "next_attempt_time" timestamp with time zone
+);
+CREATE INDEX public_webhook_deliveries_status_index ON public.webhook_deliveries (status, next_attempt_time);
+
+-- Request log table (access log, if using the DB sink)
+CREATE TABLE public.request_log (
+    "id" text NOT NULL UNIQUE,
+    "time" timestamp with time zone NOT NULL,
+    "request_id" text NOT NULL,
+    "method" text NOT NULL,
+    "path" text NOT NULL,
+    "token" text,
+    "role" text NOT NULL,
+    "status" integer NOT NULL,
+    "latency_ms" bigint NOT NULL,
+    "request_bytes" integer NOT NULL,
+    "response_bytes" integer NOT NULL
+);
+CREATE INDEX public_request_log_time_index ON public.request_log (time);
+
+-- Telemetry exports table (files exported to object storage)
+CREATE TABLE public.telemetry_exports (
+    "id" text NOT NULL UNIQUE,
+    "kind" text NOT NULL,
+    "from_time" timestamp with time zone NOT NULL,
+    "until_time" timestamp with time zone NOT NULL,
+    "object_key" text NOT NULL,
+    "row_count" integer NOT NULL,
+    "bytes" integer NOT NULL,
+    "creation_time" timestamp with time zone NOT NULL
+);
+CREATE INDEX public_telemetry_exports_kind_index ON public.telemetry_exports (kind, until_time);
+
+-- Console sessions table
+CREATE TABLE public.console_sessions (
+    "id" text NOT NULL UNIQUE,
+    "station" text NOT NULL,
+    "timeslot" text,
+    "user" text,
+    "client" text NOT NULL,
+    "begin_time" timestamp with time zone NOT NULL,
+    "end_time" timestamp with time zone,
+    "bytes_in" bigint NOT NULL DEFAULT 0,
+    "bytes_out" bigint NOT NULL DEFAULT 0,
+    "close_reason" text NOT NULL DEFAULT ''
+);
+CREATE UNIQUE INDEX public_console_sessions_id_index ON public.console_sessions (id);
+CREATE INDEX public_console_sessions_station_index ON public.console_sessions (station);
+
+-- Console tokens table (single-use keys for opening station consoles from browsers)
+CREATE TABLE public.console_tokens (
+    "key_hash" text NOT NULL UNIQUE,
+    "station" text NOT NULL,
+    "user" text,
+    "role" text NOT NULL,
+    "expiration_time" timestamp with time zone NOT NULL
+);
+
+-- Station history table
+CREATE TABLE public.station_history (
+    "id" text NOT NULL UNIQUE,
+    "station" text NOT NULL,
+    "track" text NOT NULL,
+    "timeslot" text NOT NULL,
+    "user" text,
+    "begin_time" timestamp with time zone NOT NULL,
+    "end_time" timestamp with time zone,
+    "outcome" text NOT NULL DEFAULT ''
+);
+CREATE UNIQUE INDEX public_station_history_id_index ON public.station_history (id);
+CREATE INDEX public_station_history_station_index ON public.station_history (station);
+
+-- Station notes table (append-only, the latest is also the station notes)
+CREATE TABLE public.station_notes (
+    "id" text NOT NULL UNIQUE,
+    "station" text NOT NULL,
+    "author_token" text,
+    "author_user" text,
+    "time" timestamp with time zone NOT NULL,
+    "text" text NOT NULL
+);
+CREATE UNIQUE INDEX public_station_notes_id_index ON public.station_notes (id);
+CREATE INDEX public_station_notes_station_index ON public.station_notes (station);
+
 -- Timeslots table
 CREATE TABLE public.timeslots (
     "id" text NOT NULL UNIQUE,
     "user" text NOT NULL,
+    "team" text,
     "track" text NOT NULL,
     "begin_time" timestamp with time zone,
     "end_time" timestamp with time zone,
-    "notes" text NOT NULL
+    "notes" text NOT NULL,
+    "cancel_time" timestamp with time zone,
+    "cancel_reason" text NOT NULL DEFAULT '',
+    "slot_template" text,
+    "status" text NOT NULL DEFAULT 'approved',
+    "version" integer NOT NULL DEFAULT 0,
+    "created_at" timestamp with time zone NOT NULL DEFAULT now(),
+    "updated_at" timestamp with time zone NOT NULL DEFAULT now()
 );
 CREATE UNIQUE INDEX public_timeslots_id_index ON public.timeslots (id);
 
+-- Teams table
+CREATE TABLE public.teams (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "name" text NOT NULL
+);
+CREATE UNIQUE INDEX public_teams_id_index ON public.teams (id);
+
+-- Team members table
+CREATE TABLE public.team_members (
+    "team" text NOT NULL,
+    "user" text NOT NULL,
+    UNIQUE (team, "user")
+);
+
+-- Team invites table (users invited by members, who become members when accepting)
+CREATE TABLE public.team_invites (
+    "team" text NOT NULL,
+    "user" text NOT NULL,
+    UNIQUE (team, "user")
+);
+
+-- Leaderboard freezes table
+CREATE TABLE public.leaderboard_freezes (
+    "track" text NOT NULL UNIQUE,
+    "freeze_time" timestamp with time zone NOT NULL
+);
+
+-- Leaderboard entries table (frozen snapshots)
+CREATE TABLE public.leaderboard_entries (
+    "track" text NOT NULL,
+    "rank" integer NOT NULL,
+    "user" text NOT NULL,
+    "display_name" text NOT NULL,
+    "timeslot" text NOT NULL,
+    "score" integer NOT NULL,
+    "completed_tasks" integer NOT NULL,
+    "completion_time" timestamp with time zone,
+    UNIQUE (track, "user")
+);
+
+-- Queue entries table
+CREATE TABLE public.queue_entries (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "timeslot" text NOT NULL UNIQUE,
+    "join_time" timestamp with time zone NOT NULL
+);
+CREATE UNIQUE INDEX public_queue_entries_id_index ON public.queue_entries (id);
+
+-- Slot templates table
+CREATE TABLE public.slot_templates (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "begin_time" timestamp with time zone NOT NULL,
+    "duration_minutes" integer NOT NULL,
+    "repetitions" integer NOT NULL,
+    "capacity" integer NOT NULL
+);
+CREATE UNIQUE INDEX public_slot_templates_id_index ON public.slot_templates (id);
+
 -- Tests table
 CREATE TABLE public.tests (
     "id" text NOT NULL UNIQUE,
@@ -113,7 +459,24 @@ CREATE TABLE public.tests (
     "sequence" int,
     "timestamp" timestamp with time zone NOT NULL,
     "status_success" boolean NOT NULL,
-    "status_description" text NOT NULL,
-    UNIQUE (track, task_shortname, shortname, station_shortname, timeslot)
+    "status_description" text NOT NULL
 );
 CREATE UNIQUE INDEX public_tests_id_index ON public.tests (id);
+CREATE UNIQUE INDEX public_tests_unique_index ON public.tests (track, task_shortname, shortname, station_shortname, COALESCE(timeslot, ''));
+
+-- Test history table
+CREATE TABLE public.test_history (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "task_shortname" text NOT NULL,
+    "shortname" text NOT NULL,
+    "station_shortname" text NOT NULL,
+    "timeslot" text,
+    "name" text NOT NULL,
+    "description" text NOT NULL,
+    "sequence" int,
+    "timestamp" timestamp with time zone NOT NULL,
+    "status_success" boolean NOT NULL,
+    "status_description" text NOT NULL
+);
+CREATE INDEX public_test_history_track_station_index ON public.test_history (track, station_shortname);
@@ -0,0 +1,111 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+/*
+Package worker runs periodic background tasks, like expiring stale data or
+assigning queued resources.
+
+Tasks are registered with AddTask(), typically from init(), and started
+together with Start() once the database is connected. Each task runs in its
+own goroutine, so a slow task doesn't delay the others. A task may also be
+triggered early using Trigger(), e.g. when a handler knows there's new work.
+*/
+package worker
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Task is a single periodic background task.
+type Task struct {
+	Name     string
+	Interval time.Duration
+	Run      func()
+	trigger  chan struct{}
+}
+
+var tasks = make(map[string]*Task)
+var started = false
+
+// AddTask registers a task to run periodically with the specified interval.
+// Must be called before Start().
+func AddTask(name string, interval time.Duration, run func()) {
+	if _, exists := tasks[name]; exists {
+		log.WithField("task", name).Fatal("Duplicate worker task")
+	}
+	tasks[name] = &Task{
+		Name:     name,
+		Interval: interval,
+		Run:      run,
+		trigger:  make(chan struct{}, 1),
+	}
+}
+
+// Start starts all registered tasks in the background.
+func Start() {
+	for _, task := range tasks {
+		log.WithFields(log.Fields{
+			"task":     task.Name,
+			"interval": task.Interval,
+		}).Info("Started worker task")
+		go task.loop()
+	}
+	started = true
+}
+
+// Trigger makes the task run as soon as possible instead of waiting for the next interval.
+// Does nothing if the task doesn't exist or workers haven't been started.
+func Trigger(name string) {
+	task, ok := tasks[name]
+	if !ok || !started {
+		return
+	}
+	select {
+	case task.trigger <- struct{}{}:
+	default:
+		// Already triggered
+	}
+}
+
+// loop runs the task periodically. Never returns.
+func (task *Task) loop() {
+	ticker := time.NewTicker(task.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-task.trigger:
+		}
+		task.run()
+	}
+}
+
+// run runs the task once, recovering from panics so a single failure doesn't kill the worker.
+func (task *Task) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			log.WithField("task", task.Name).Errorf("Worker task panicked: %v", err)
+		}
+	}()
+	log.WithField("task", task.Name).Trace("Running worker task")
+	task.Run()
+}
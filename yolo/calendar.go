@@ -0,0 +1,282 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// calendarDefaultDuration is the event duration used for active timeslots without a known end.
+const calendarDefaultDuration = 2 * time.Hour
+
+// calendarTimeFormat is the iCalendar UTC date-time format.
+const calendarTimeFormat = "20060102T150405Z"
+
+// calendarTokenQueryParam is the query param with the calendar feed token, for calendar apps unable to set headers.
+const calendarTokenQueryParam = "calendar_token"
+
+// calendarTokenLengthBytes is the amount of random bytes in calendar feed tokens.
+const calendarTokenLengthBytes = 32
+
+// UserTimeslotCalendar is an iCalendar feed of the planned and active timeslots for a user, including team timeslots.
+type UserTimeslotCalendar struct {
+	timeslots Timeslots
+	tracks    map[string]*Track
+}
+
+// UserCalendarToken is the calendar feed token for a user, only valid for the user's calendar feed.
+// Only the hash is stored, the key is only shown when created.
+type UserCalendarToken struct {
+	UserID       *uuid.UUID `column:"user" json:"user"`
+	KeyHash      string     `column:"key_hash" json:"-"`
+	Key          string     `column:"-" json:"key,omitempty"`
+	CreationTime time.Time  `column:"creation_time" json:"creation_time"`
+}
+
+func init() {
+	rest.AddHandler("/user/", "^(?P<id>[^/]+)/timeslots\\.ics/$", func() interface{} { return &UserTimeslotCalendar{} })
+	rest.AddHandler("/user/", "^(?P<id>[^/]+)/calendar-token/$", func() interface{} { return &UserCalendarToken{} })
+	rest.RedactQueryParam(calendarTokenQueryParam)
+}
+
+// Get gets the calendar for a user.
+// Since calendar apps generally can't set headers, the user's calendar feed token may be specified using the "calendar_token" query param instead.
+func (calendar *UserTimeslotCalendar) Get(request *rest.Request) rest.Result {
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.BadRequest("missing ID")
+	}
+	userID, uuidErr := uuid.Parse(rawID)
+	if uuidErr != nil {
+		return rest.BadRequest("invalid ID")
+	}
+
+	// Check perms
+	role := request.AccessToken.GetRole()
+	if role != rest.RoleOperator && role != rest.RoleAdmin {
+		if request.AccessToken.OwnerUserID == nil || *request.AccessToken.OwnerUserID != userID {
+			valid, err := checkCalendarToken(userID, request.QueryArgs[calendarTokenQueryParam])
+			if err != nil {
+				return rest.InternalError(err)
+			}
+			if !valid {
+				return rest.UnauthorizedResult(request.AccessToken)
+			}
+		}
+	}
+
+	// Get own and team timeslots
+	rows, rowsErr := db.DB.Query("SELECT id FROM timeslots WHERE \"user\" = $1 OR team IN (SELECT team FROM team_members WHERE \"user\" = $1)", userID)
+	if rowsErr != nil {
+		return rest.InternalError(rowsErr)
+	}
+	var timeslotIDs []string
+	for rows.Next() {
+		var timeslotID string
+		if err := rows.Scan(&timeslotID); err != nil {
+			rows.Close()
+			return rest.InternalError(err)
+		}
+		timeslotIDs = append(timeslotIDs, timeslotID)
+	}
+	rows.Close()
+
+	calendar.tracks = make(map[string]*Track)
+	for _, timeslotID := range timeslotIDs {
+		var timeslot Timeslot
+		timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", timeslotID)
+		if timeslotDBResult.IsFailed() {
+			return rest.InternalError(timeslotDBResult.Error)
+		}
+		// Only planned or active timeslots
+		if !timeslotDBResult.IsSuccess() || timeslot.BeginTime == nil {
+			continue
+		}
+		calendar.timeslots = append(calendar.timeslots, &timeslot)
+
+		if _, ok := calendar.tracks[timeslot.TrackID]; !ok {
+			var track Track
+			trackDBResult := db.Select(&track, "tracks", "id", "=", timeslot.TrackID)
+			if trackDBResult.IsFailed() {
+				return rest.InternalError(trackDBResult.Error)
+			}
+			calendar.tracks[timeslot.TrackID] = &track
+		}
+	}
+
+	return rest.Result{}
+}
+
+// checkCalendarToken checks if the key is the calendar feed token of the user.
+func checkCalendarToken(userID uuid.UUID, key string) (bool, error) {
+	if key == "" {
+		return false, nil
+	}
+	dbResult := db.Exists("calendar_tokens", "user", "=", userID, "key_hash", "=", hashCalendarTokenKey(key))
+	if dbResult.IsFailed() {
+		return false, dbResult.Error
+	}
+	return dbResult.IsSuccess(), nil
+}
+
+func hashCalendarTokenKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// Get gets when the calendar feed token of the user was created, without the key.
+func (token *UserCalendarToken) Get(request *rest.Request) rest.Result {
+	userID, result := parseCalendarTokenUserID(request)
+	if !result.IsOk() {
+		return result
+	}
+	dbResult := db.Select(token, "calendar_tokens", "user", "=", userID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("no calendar token")
+	}
+	return rest.Result{}
+}
+
+// Post creates a new calendar feed token for the user, replacing any existing one. The key is only shown now.
+func (token *UserCalendarToken) Post(request *rest.Request) rest.Result {
+	userID, result := parseCalendarTokenUserID(request)
+	if !result.IsOk() {
+		return result
+	}
+
+	buffer := make([]byte, calendarTokenLengthBytes)
+	if _, err := rand.Read(buffer); err != nil {
+		return rest.InternalError(err)
+	}
+	token.UserID = &userID
+	token.Key = base64.RawURLEncoding.EncodeToString(buffer)
+	token.KeyHash = hashCalendarTokenKey(token.Key)
+	token.CreationTime = time.Now()
+	if dbResult := db.Upsert("calendar_tokens", token, "user", "=", userID); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Delete revokes the calendar feed token of the user.
+func (token *UserCalendarToken) Delete(request *rest.Request) rest.Result {
+	userID, result := parseCalendarTokenUserID(request)
+	if !result.IsOk() {
+		return result
+	}
+	dbResult := db.Delete("calendar_tokens", "user", "=", userID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if dbResult.Affected == 0 {
+		return rest.NotFound("no calendar token")
+	}
+	return rest.Result{}
+}
+
+// parseCalendarTokenUserID gets the user ID from the path and checks that the requestor is the same user or an admin.
+func parseCalendarTokenUserID(request *rest.Request) (uuid.UUID, rest.Result) {
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return uuid.UUID{}, rest.BadRequest("missing ID")
+	}
+	userID, uuidErr := uuid.Parse(rawID)
+	if uuidErr != nil {
+		return uuid.UUID{}, rest.BadRequest("invalid ID")
+	}
+	isSelf := request.AccessToken.OwnerUserID != nil && *request.AccessToken.OwnerUserID == userID
+	if !isSelf && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return uuid.UUID{}, rest.UnauthorizedResult(request.AccessToken)
+	}
+	return userID, rest.Result{}
+}
+
+// RawResponse formats the calendar as iCalendar (RFC 5545).
+func (calendar *UserTimeslotCalendar) RawResponse() (string, []byte, error) {
+	now := time.Now()
+	var builder strings.Builder
+	writeLine := func(line string) {
+		builder.WriteString(line)
+		builder.WriteString("\r\n")
+	}
+
+	writeLine("BEGIN:VCALENDAR")
+	writeLine("VERSION:2.0")
+	writeLine("PRODID:-//The Gathering//Tech:Online//EN")
+	writeLine("CALSCALE:GREGORIAN")
+	writeLine("X-WR-CALNAME:Tech:Online")
+	for _, timeslot := range calendar.timeslots {
+		track := calendar.tracks[timeslot.TrackID]
+		trackName := timeslot.TrackID
+		if track != nil && track.Name != "" {
+			trackName = track.Name
+		}
+
+		// Active timeslots have a bogus end time far into the future, so guess something sensible
+		beginTime := *timeslot.BeginTime
+		endTime := beginTime.Add(calendarDefaultDuration)
+		if track != nil && track.MaxDurationMinutes > 0 {
+			endTime = beginTime.Add(time.Duration(track.MaxDurationMinutes) * time.Minute)
+		}
+		if timeslot.EndTime != nil && timeslot.EndTime.After(beginTime) && timeslot.EndTime.Before(now.AddDate(1, 0, 0)) {
+			endTime = *timeslot.EndTime
+		}
+
+		writeLine("BEGIN:VEVENT")
+		writeLine(fmt.Sprintf("UID:%v@tech-online", timeslot.ID))
+		writeLine("DTSTAMP:" + now.UTC().Format(calendarTimeFormat))
+		writeLine("DTSTART:" + beginTime.UTC().Format(calendarTimeFormat))
+		writeLine("DTEND:" + endTime.UTC().Format(calendarTimeFormat))
+		writeLine("SUMMARY:" + escapeCalendarText("Tech:Online: "+trackName))
+		if timeslot.Notes != "" {
+			writeLine("DESCRIPTION:" + escapeCalendarText(timeslot.Notes))
+		}
+		if timeslot.CancelTime != nil {
+			writeLine("STATUS:CANCELLED")
+		} else {
+			writeLine("STATUS:CONFIRMED")
+		}
+		writeLine("END:VEVENT")
+	}
+	writeLine("END:VCALENDAR")
+
+	return "text/calendar; charset=utf-8", []byte(builder.String()), nil
+}
+
+// escapeCalendarText escapes a TEXT value for iCalendar.
+func escapeCalendarText(text string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\r\n", "\\n", "\n", "\\n")
+	return replacer.Replace(text)
+}
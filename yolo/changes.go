@@ -0,0 +1,74 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"time"
+
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+// Changes is the combined change feed, for clients syncing incrementally instead of refetching all listings.
+// Each list contains the entities created or updated after the provided time, as visible to the requester
+// (like in the respective listings). Deleted entities are not included.
+type Changes struct {
+	Since     time.Time `json:"since"`
+	Until     time.Time `json:"until"` // The since time to use for the next request
+	Tracks    Tracks    `json:"tracks"`
+	Tasks     Tasks     `json:"tasks"`
+	Stations  Stations  `json:"stations"`
+	Timeslots Timeslots `json:"timeslots"`
+}
+
+func init() {
+	rest.AddHandler("/changes/", "^$", func() interface{} { return &Changes{} })
+}
+
+// Get gets the entities changed since the time in the "since" query arg.
+func (changes *Changes) Get(request *rest.Request) rest.Result {
+	sinceValue, ok := request.QueryArgs["since"]
+	if !ok {
+		return rest.BadRequest("missing since")
+	}
+	since, err := time.Parse(time.RFC3339, sinceValue)
+	if err != nil {
+		return rest.BadRequest("since must be an RFC 3339 time")
+	}
+	// Taken before fetching, so changes made while fetching are included in the next request
+	changes.Since = since
+	changes.Until = time.Now()
+
+	// Reuse the listings with only the modified-since filter, for the same visibility rules
+	listRequest := *request
+	listRequest.QueryArgs = make(map[string]string)
+	listRequest.ListFilterArgs = []interface{}{"updated_at", ">", since}
+	listRequest.ListOrderBy = "updated_at"
+	changes.Tracks = make(Tracks, 0)
+	changes.Tasks = make(Tasks, 0)
+	changes.Stations = make(Stations, 0)
+	changes.Timeslots = make(Timeslots, 0)
+	for _, getter := range []rest.Getter{&changes.Tracks, &changes.Tasks, &changes.Stations, &changes.Timeslots} {
+		if result := getter.Get(&listRequest); !result.IsOk() {
+			return result
+		}
+	}
+	return rest.Result{}
+}
@@ -0,0 +1,398 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+// consoleDialTimeout is how long to wait for the station to accept the connection.
+const consoleDialTimeout = 10 * time.Second
+
+// consoleAssignmentCheckInterval is how often participant sessions check that the station is still assigned to their timeslot.
+const consoleAssignmentCheckInterval = 30 * time.Second
+
+// consoleTokenQueryParam is the query param with the console token, since browsers can't set headers for WebSockets.
+const consoleTokenQueryParam = "console_token"
+
+// consoleTokenLifetime is how long console tokens are valid. They're meant to be used right away.
+const consoleTokenLifetime = 1 * time.Minute
+
+// consoleTokenLengthBytes is the amount of random bytes in console tokens.
+const consoleTokenLengthBytes = 32
+
+// ConsoleSession is a logged console proxy session to a station.
+type ConsoleSession struct {
+	ID          *uuid.UUID    `column:"id" json:"id"`             // Generated
+	StationID   *uuid.UUID    `column:"station" json:"station"`   // Required
+	TimeslotID  db.NullString `column:"timeslot" json:"timeslot"` // Timeslot assigned to the station when the session began, if any
+	UserID      *uuid.UUID    `column:"user" json:"user"`         // The connecting user, if any
+	Client      string        `column:"client" json:"client"`     // Client address
+	BeginTime   *time.Time    `column:"begin_time" json:"begin_time"`
+	EndTime     *time.Time    `column:"end_time" json:"end_time"`         // Empty while active
+	BytesIn     int64         `column:"bytes_in" json:"bytes_in"`         // From the client to the station
+	BytesOut    int64         `column:"bytes_out" json:"bytes_out"`       // From the station to the client
+	CloseReason string        `column:"close_reason" json:"close_reason"` // E.g. "client closed" or "timeslot ended"
+}
+
+// ConsoleSessions is a list of console sessions.
+type ConsoleSessions []*ConsoleSession
+
+// StationConsole is a WebSocket proxying a TCP (e.g. SSH) connection to the station's console address.
+type StationConsole struct{}
+
+// StationConsoleToken is a single-use, short-lived key for opening the station console, for browsers.
+// It's created with the access token of the requestor and has the same access to the console.
+// Only the hash is stored, the key is only shown when created.
+type StationConsoleToken struct {
+	KeyHash        string     `column:"key_hash" json:"-"`
+	Key            string     `column:"-" json:"key"`
+	StationID      *uuid.UUID `column:"station" json:"station"`
+	UserID         *uuid.UUID `column:"user" json:"user"` // The creating user, if any
+	Role           rest.Role  `column:"role" json:"-"`    // The role of the creating access token
+	ExpirationTime time.Time  `column:"expiration_time" json:"expiration_time"`
+}
+
+func init() {
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/console/$", func() interface{} { return &StationConsole{} })
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/console-token/$", func() interface{} { return &StationConsoleToken{} })
+	rest.RedactQueryParam(consoleTokenQueryParam)
+	rest.AddHandler("/console-sessions/", "^$", func() interface{} { return &ConsoleSessions{} })
+}
+
+// Get gets console sessions, for operators.
+func (sessions *ConsoleSessions) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if stationID, ok := request.QueryArgs["station"]; ok {
+		whereArgs = append(whereArgs, "station", "=", stationID)
+	}
+	if timeslotID, ok := request.QueryArgs["timeslot"]; ok {
+		whereArgs = append(whereArgs, "timeslot", "=", db.StringOrNull(timeslotID))
+	}
+
+	// Get
+	dbResult := db.SelectManyOrdered(sessions, "console_sessions", "begin_time DESC", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Upgrade connects to the station and proxies the connection over a WebSocket.
+// Only the user (or team) of the timeslot assigned to the station and operators may connect.
+// Since browsers can't set headers for WebSockets, a console token may be specified using the "console_token" query param instead.
+func (console *StationConsole) Upgrade(request *rest.Request, httpWriter http.ResponseWriter, httpRequest *http.Request) {
+	station, result := loadConsoleStation(request)
+	if !result.IsOk() {
+		rest.WriteResult(httpWriter, result)
+		return
+	}
+
+	// Check perms, as the creator of the console token if any
+	userID := request.AccessToken.OwnerUserID
+	role := request.AccessToken.GetRole()
+	if key, ok := request.QueryArgs[consoleTokenQueryParam]; ok {
+		consoleToken, err := useConsoleToken(key, station.ID)
+		if err != nil {
+			rest.WriteResult(httpWriter, rest.InternalError(err))
+			return
+		}
+		if consoleToken == nil {
+			rest.WriteResult(httpWriter, rest.Result{Code: 401, Message: "invalid or expired console token"})
+			return
+		}
+		userID = consoleToken.UserID
+		role = consoleToken.Role
+	}
+	isOperator := role == rest.RoleOperator || role == rest.RoleAdmin
+	if allowed, err := canOpenConsole(station, userID, isOperator); err != nil {
+		rest.WriteResult(httpWriter, rest.InternalError(err))
+		return
+	} else if !allowed {
+		rest.WriteResult(httpWriter, rest.UnauthorizedResult(request.AccessToken))
+		return
+	}
+	if station.ConsoleAddress == "" {
+		rest.WriteResult(httpWriter, rest.Conflict("station has no console"))
+		return
+	}
+
+	// Connect to the station before upgrading, so failures can be reported properly
+	conn, dialErr := net.DialTimeout("tcp", station.ConsoleAddress, consoleDialTimeout)
+	if dialErr != nil {
+		request.Log.WithError(dialErr).WithField("station", station.ID).Warn("Failed to connect to station console")
+		rest.WriteResult(httpWriter, rest.Result{Code: 502, Message: "failed to connect to station"})
+		return
+	}
+
+	// Log session
+	sessionID := uuid.New()
+	now := time.Now()
+	session := ConsoleSession{
+		ID:         &sessionID,
+		StationID:  station.ID,
+		TimeslotID: station.TimeslotID,
+		UserID:     userID,
+		Client:     httpRequest.RemoteAddr,
+		BeginTime:  &now,
+	}
+	if dbResult := db.Insert("console_sessions", &session); dbResult.IsFailed() {
+		conn.Close()
+		rest.WriteResult(httpWriter, rest.InternalError(dbResult.Error))
+		return
+	}
+
+	handled := false
+	server := websocket.Server{
+		Handshake: checkConsoleOrigin,
+		Handler: func(ws *websocket.Conn) {
+			handled = true
+			session.proxy(ws, conn, station, !isOperator, request.Log)
+		},
+	}
+	server.ServeHTTP(httpWriter, httpRequest)
+	// The handler isn't reached if the handshake failed
+	if !handled {
+		conn.Close()
+		session.finish("handshake failed", request.Log)
+	}
+}
+
+// Post creates a console token for the station, if the requestor may open its console. The key is only shown now.
+func (token *StationConsoleToken) Post(request *rest.Request) rest.Result {
+	station, result := loadConsoleStation(request)
+	if !result.IsOk() {
+		return result
+	}
+	role := request.AccessToken.GetRole()
+	isOperator := role == rest.RoleOperator || role == rest.RoleAdmin
+	if allowed, err := canOpenConsole(station, request.AccessToken.OwnerUserID, isOperator); err != nil {
+		return rest.InternalError(err)
+	} else if !allowed {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Clean up expired tokens while at it
+	now := time.Now()
+	if _, err := db.DB.Exec("DELETE FROM console_tokens WHERE expiration_time < $1", now); err != nil {
+		return rest.InternalError(err)
+	}
+
+	buffer := make([]byte, consoleTokenLengthBytes)
+	if _, err := rand.Read(buffer); err != nil {
+		return rest.InternalError(err)
+	}
+	token.Key = base64.RawURLEncoding.EncodeToString(buffer)
+	token.KeyHash = hashConsoleTokenKey(token.Key)
+	token.StationID = station.ID
+	token.UserID = request.AccessToken.OwnerUserID
+	token.Role = role
+	token.ExpirationTime = now.Add(consoleTokenLifetime)
+	if dbResult := db.Insert("console_tokens", token); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// loadConsoleStation gets the station from the path.
+func loadConsoleStation(request *rest.Request) (*Station, rest.Result) {
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return nil, rest.BadRequest("missing ID")
+	}
+	var station Station
+	dbResult := db.Select(&station, "stations", "id", "=", id)
+	if dbResult.IsFailed() {
+		return nil, rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return nil, rest.NotFound("not found")
+	}
+	return &station, rest.Result{}
+}
+
+// canOpenConsole checks if the user (or operator) may open the console of the station,
+// i.e. if it's an operator or the user (or team) of the timeslot assigned to the station.
+func canOpenConsole(station *Station, userID *uuid.UUID, isOperator bool) (bool, error) {
+	if isOperator {
+		return true, nil
+	}
+	if !station.TimeslotID.Valid {
+		return false, nil
+	}
+	timeslotID, err := uuid.Parse(station.TimeslotID.String)
+	if err != nil {
+		return false, err
+	}
+	timeslot := Timeslot{ID: &timeslotID}
+	return timeslot.isOwnedByID(userID)
+}
+
+// useConsoleToken gets and deletes the console token with the key, if it's valid for the station.
+// Returns nil if it isn't, e.g. if it has expired or has already been used.
+func useConsoleToken(key string, stationID *uuid.UUID) (*StationConsoleToken, error) {
+	if key == "" {
+		return nil, nil
+	}
+	keyHash := hashConsoleTokenKey(key)
+	var token StationConsoleToken
+	dbResult := db.Select(&token, "console_tokens", "key_hash", "=", keyHash)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	if !dbResult.IsSuccess() {
+		return nil, nil
+	}
+	// Only one of concurrent uses may delete it
+	deleteResult := db.Delete("console_tokens", "key_hash", "=", keyHash)
+	if deleteResult.IsFailed() {
+		return nil, deleteResult.Error
+	}
+	if deleteResult.Affected == 0 {
+		return nil, nil
+	}
+	if token.StationID == nil || stationID == nil || *token.StationID != *stationID || !time.Now().Before(token.ExpirationTime) {
+		return nil, nil
+	}
+	return &token, nil
+}
+
+func hashConsoleTokenKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// checkConsoleOrigin only allows WebSocket handshakes from the same host or the allowed CORS origins, so other sites
+// can't open consoles using the credentials of the visitor's browser. Clients without an origin aren't browsers.
+func checkConsoleOrigin(wsConfig *websocket.Config, httpRequest *http.Request) error {
+	origin := httpRequest.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	if originURL, err := url.Parse(origin); err == nil && strings.EqualFold(originURL.Host, httpRequest.Host) {
+		return nil
+	}
+	if rest.CORSOriginAllowed(origin) {
+		return nil
+	}
+	return fmt.Errorf("origin not allowed: %v", origin)
+}
+
+// proxy copies data both ways until either side closes or, for participants, the station gets unassigned.
+func (session *ConsoleSession) proxy(ws *websocket.Conn, conn net.Conn, station *Station, checkAssignment bool, requestLog *log.Entry) {
+	ws.PayloadType = websocket.BinaryFrame
+	// Clear the server read and write timeouts inherited from the upgrade request, sessions may last for hours
+	ws.SetDeadline(time.Time{})
+	requestLog.WithFields(log.Fields{
+		"session": session.ID,
+		"station": station.ID,
+	}).Info("Console session started")
+
+	closeReasons := make(chan string, 3)
+	var bytesIn, bytesOut int64
+	var copiers sync.WaitGroup
+	copiers.Add(2)
+	go func() {
+		defer copiers.Done()
+		bytesIn, _ = io.Copy(conn, ws)
+		closeReasons <- "client closed"
+	}()
+	go func() {
+		defer copiers.Done()
+		bytesOut, _ = io.Copy(ws, conn)
+		closeReasons <- "station closed"
+	}()
+	stopWatching := make(chan struct{})
+	if checkAssignment {
+		go session.watchAssignment(closeReasons, stopWatching)
+	}
+
+	reason := <-closeReasons
+	close(stopWatching)
+	ws.Close()
+	conn.Close()
+	copiers.Wait()
+
+	session.BytesIn = bytesIn
+	session.BytesOut = bytesOut
+	session.finish(reason, requestLog)
+}
+
+// finish saves the end of the session.
+func (session *ConsoleSession) finish(reason string, requestLog *log.Entry) {
+	now := time.Now()
+	session.EndTime = &now
+	session.CloseReason = reason
+	if dbResult := db.Update("console_sessions", session, "id", "=", session.ID); dbResult.IsFailed() {
+		requestLog.WithError(dbResult.Error).Error("Failed to save console session")
+	}
+	requestLog.WithFields(log.Fields{
+		"session":   session.ID,
+		"bytes_in":  session.BytesIn,
+		"bytes_out": session.BytesOut,
+		"reason":    reason,
+	}).Info("Console session ended")
+}
+
+// watchAssignment reports when the station is no longer assigned to the session's timeslot.
+func (session *ConsoleSession) watchAssignment(closeReasons chan<- string, stop <-chan struct{}) {
+	ticker := time.NewTicker(consoleAssignmentCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			var station Station
+			dbResult := db.Select(&station, "stations", "id", "=", session.StationID)
+			if dbResult.IsFailed() {
+				continue
+			}
+			if !dbResult.IsSuccess() || station.TimeslotID != session.TimeslotID {
+				closeReasons <- "timeslot ended"
+				return
+			}
+		}
+	}
+}
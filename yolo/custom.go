@@ -21,7 +21,8 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package yolo
 
 import (
-	"database/sql"
+	"sort"
+	"time"
 
 	"github.com/gathering/tech-online-backend/db"
 	"github.com/gathering/tech-online-backend/rest"
@@ -45,54 +46,111 @@ type StationTasksTests struct {
 	Tasks            []*stationTasksTestsTask `json:"tasks"`
 }
 
+// TrackSummary consists of counts for a track, for the dashboard.
+type TrackSummary struct {
+	ID                string                `json:"id"`
+	Type              TrackType             `json:"type"`
+	Name              string                `json:"name"`
+	StationsByStatus  map[StationStatus]int `json:"stations_by_status"`  // Excluding terminated stations
+	ActiveTimeslots   int                   `json:"active_timeslots"`    // Timeslots with a station
+	QueueLength       int                   `json:"queue_length"`        // Timeslots waiting for a station
+	LatestTests       int                   `json:"latest_tests"`        // The latest results for all stations
+	LatestTestsPassed int                   `json:"latest_tests_passed"` // The latest results which succeeded
+	PassRate          *float64              `json:"pass_rate"`           // Passed over total latest results, if any
+	Registrations     int                   `json:"registrations"`       // Non-cancelled timeslots, including pending ones
+	MaxRegistrations  int                   `json:"max_registrations"`   // From the track (0 if unlimited)
+	PendingTimeslots  int                   `json:"pending_timeslots"`   // Non-cancelled timeslots awaiting approval
+}
+
+// Cached shortly, since the dashboard polls it
+var trackSummaryCachePolicy = rest.CachePolicy{
+	TTL:    5 * time.Second,
+	Tables: []string{"tracks", "stations", "timeslots", "queue_entries", "tests"},
+}
+
+// MyStatus consists of the requester's active participation, for the participant landing page.
+type MyStatus struct {
+	UserID    *uuid.UUID          `json:"user"`
+	Timeslots []*myStatusTimeslot `json:"timeslots"` // Active timeslots (own or team) with a station, at most one per track
+}
+
+type myStatusTimeslot struct {
+	Timeslot         *Timeslot                `json:"timeslot"`
+	TrackName        string                   `json:"track_name"`
+	Station          *Station                 `json:"station"`           // With credentials, if the track allows it
+	Tasks            []*stationTasksTestsTask `json:"tasks"`             // With the latest tests for the station
+	Deadline         *time.Time               `json:"deadline"`          // When the timeslot ends (max duration of the track or the end time), if known
+	RemainingSeconds *int                     `json:"remaining_seconds"` // Until the deadline, if any
+}
+
 type stationTasksTestsTask struct {
 	ID          *uuid.UUID `json:"id"`
 	Shortname   string     `json:"shortname"`
 	Name        string     `json:"name"`
 	Description string     `json:"description"`
 	Sequence    *int       `json:"sequence"`
+	Locked      bool       `json:"locked"`
 	Tests       []Test     `json:"tests"`
 }
 
 func init() {
 	rest.AddHandler("/custom/track-stations/", "^(?P<track_id>[^/]+)/$", func() interface{} { return &TrackStations{} })
 	rest.AddHandler("/custom/station-tasks-tests/", "^(?P<track_id>[^/]+)/(?P<station_shortname>[^/]+)/$", func() interface{} { return &StationTasksTests{} })
+	rest.AddHandler("/custom/my-status/", "^$", func() interface{} { return &MyStatus{} })
+	rest.AddCachedHandler("/custom/track-summary/", "^(?P<track_id>[^/]+)/$", trackSummaryCachePolicy, func() interface{} { return &TrackSummary{} })
+}
+
+// trackStationRow is a track joined with one of its non-terminated stations, if any.
+type trackStationRow struct {
+	Track   *Track   `join:"tracks"`
+	Station *Station `join:"stations ON stations.track = tracks.id AND stations.status != 'terminated',left"`
+}
+
+// taskDependencyRow is a task joined with one of its dependencies, if any.
+type taskDependencyRow struct {
+	Task       *Task           `join:"tasks"`
+	Dependency *taskDependency `join:"task_dependencies ON task_dependencies.task = tasks.id,left"`
 }
 
 // Get creates a a big mess of data consisting of a track and all non-terminated stations for it.
 func (trackAndStations *TrackStations) Get(request *rest.Request) rest.Result {
 	trackID, trackIDExists := request.PathArgs["track_id"]
 	if !trackIDExists || trackID == "" {
-		return rest.Result{Code: 400, Message: "missing track ID"}
+		return rest.BadRequest("missing track ID")
 	}
 
-	// Scan track
-	var track Track
-	trackRow := db.DB.QueryRow("SELECT id,type,name FROM tracks WHERE id = $1", trackID)
-	trackErr := trackRow.Scan(&track.ID, &track.Type, &track.Name)
-	if trackErr == sql.ErrNoRows {
+	// Get track and stations
+	var rows []trackStationRow
+	dbResult := db.SelectJoined(&rows, "stations.shortname", "tracks.id", "=", trackID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if len(rows) == 0 {
+		return rest.Result{}
+	}
+	track := rows[0].Track
+	if !track.isVisible() && request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
 		return rest.Result{}
-	} else if trackErr != nil {
-		return rest.Result{Error: trackErr}
 	}
 	trackAndStations.ID = track.ID
 	trackAndStations.Type = track.Type
 	trackAndStations.Name = track.Name
-
-	// Scan stations
-	dbResult := db.SelectMany(&trackAndStations.Stations, "stations",
-		"track", "=", track.ID,
-		"status", "!=", StationStatusTerminated,
-	)
-	if dbResult.IsFailed() {
-		return rest.Result{Error: dbResult.Error}
+	trackAndStations.Stations = make(Stations, 0, len(rows))
+	for _, row := range rows {
+		if row.Station == nil {
+			continue
+		}
+		// Hide station credentials
+		row.Station.Credentials = ""
+		row.Station.ConsoleAddress = ""
+		trackAndStations.Stations = append(trackAndStations.Stations, row.Station)
 	}
 
-	// Hide station credentials
-	for _, station := range trackAndStations.Stations {
-		station.Credentials = ""
-	}
+	return rest.Result{}
+}
 
+// Head answers HEAD requests without loading anything, since Get never fails for missing or hidden tracks.
+func (trackAndStations *TrackStations) Head(request *rest.Request) rest.Result {
 	return rest.Result{}
 }
 
@@ -100,61 +158,78 @@ func (trackAndStations *TrackStations) Get(request *rest.Request) rest.Result {
 func (t4 *StationTasksTests) Get(request *rest.Request) rest.Result {
 	trackID, trackIDExists := request.PathArgs["track_id"]
 	if !trackIDExists || trackID == "" {
-		return rest.Result{Code: 400, Message: "missing track ID"}
+		return rest.BadRequest("missing track ID")
 	}
 	stationShortname, stationShortnameExists := request.PathArgs["station_shortname"]
 	if !stationShortnameExists || stationShortname == "" {
-		return rest.Result{Code: 400, Message: "missing station shortname"}
+		return rest.BadRequest("missing station shortname")
 	}
 
-	// Scan track
+	// Get track
 	var track Track
-	trackRow := db.DB.QueryRow("SELECT id,type,name FROM tracks WHERE id = $1", trackID)
-	trackErr := trackRow.Scan(&track.ID, &track.Type, &track.Name)
-	if trackErr == sql.ErrNoRows {
+	trackDBResult := db.Select(&track, "tracks", "id", "=", trackID)
+	if trackDBResult.IsFailed() {
+		return rest.InternalError(trackDBResult.Error)
+	}
+	if !trackDBResult.IsSuccess() {
 		return rest.Result{}
 	}
-	if trackErr != nil {
-		return rest.Result{Error: trackErr}
+
+	isOperator := request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin
+	if err := t4.load(&track, stationShortname, !isOperator); err != nil {
+		return rest.InternalError(err)
 	}
+	return rest.Result{}
+}
+
+// Head answers HEAD requests without loading anything, since Get never fails for missing tracks or stations.
+func (t4 *StationTasksTests) Head(request *rest.Request) rest.Result {
+	return rest.Result{}
+}
+
+// load loads the tasks for the track with the latest tests for the station, with task locks according to
+// the current timeslot for the station.
+func (t4 *StationTasksTests) load(track *Track, stationShortname string, hideLockedDescriptions bool) error {
+	trackID := track.ID
 
-	// Scan tasks
-	tasks := make([]Task, 0)
-	tasksRows, tasksQueryErr := db.DB.Query("SELECT id,track,shortname,name,description,sequence FROM tasks WHERE track = $1 ORDER BY sequence ASC", trackID)
-	if tasksQueryErr != nil {
-		return rest.Result{Error: tasksQueryErr}
+	// Get tasks with dependencies
+	var taskRows []taskDependencyRow
+	tasksDBResult := db.SelectJoined(&taskRows, "tasks.sequence ASC, tasks.id", "tasks.track", "=", trackID)
+	if tasksDBResult.IsFailed() {
+		return tasksDBResult.Error
 	}
-	defer func() {
-		tasksRows.Close()
-	}()
-	for tasksRows.Next() {
-		var task Task
-		rowErr := tasksRows.Scan(&task.ID, &task.TrackID, &task.Shortname, &task.Name, &task.Description, &task.Sequence)
-		if rowErr != nil {
-			return rest.Result{Error: rowErr}
+	tasks := make(Tasks, 0)
+	for _, row := range taskRows {
+		if len(tasks) == 0 || *tasks[len(tasks)-1].ID != *row.Task.ID {
+			row.Task.DependsOnIDs = make([]uuid.UUID, 0)
+			tasks = append(tasks, row.Task)
 		}
-		tasks = append(tasks, task)
-	}
-
-	// Scan tests
-	tests := make([]Test, 0)
-	testsRows, testsQueryErr := db.DB.Query("SELECT id,track,task_shortname,shortname,station_shortname,timeslot,name,description,sequence,timestamp,status_success,status_description FROM tests WHERE track = $1 AND station_shortname = $2 AND timeslot = '' ORDER BY sequence ASC",
-		trackID, stationShortname)
-	if testsQueryErr != nil {
-		return rest.Result{Error: testsQueryErr}
-	}
-	defer func() {
-		testsRows.Close()
-	}()
-	for testsRows.Next() {
-		var test Test
-		rowErr := testsRows.Scan(&test.ID, &test.TrackID, &test.TaskShortname, &test.Shortname, &test.StationShortname, &test.TimeslotID, &test.Name, &test.Description, &test.Sequence, &test.Timestamp, &test.StatusSuccess, &test.StatusDescription)
-		if rowErr != nil {
-			return rest.Result{Error: rowErr}
+		if row.Dependency != nil {
+			task := tasks[len(tasks)-1]
+			task.DependsOnIDs = append(task.DependsOnIDs, row.Dependency.DependsOnID)
 		}
-		tests = append(tests, test)
 	}
 
+	// Lock tasks according to the current timeslot for the station
+	var station Station
+	stationDBResult := db.Select(&station, "stations", "track", "=", trackID, "shortname", "=", stationShortname)
+	if stationDBResult.IsFailed() {
+		return stationDBResult.Error
+	}
+	if err := applyTaskLocks(track, tasks, station.TimeslotID.String, hideLockedDescriptions); err != nil {
+		return err
+	}
+
+	// Get latest tests for the station
+	var tests Tests
+	testsDBResult := db.SelectMany(&tests, "tests", "track", "=", trackID, "station_shortname", "=", stationShortname, "timeslot", "=", nil)
+	if testsDBResult.IsFailed() {
+		return testsDBResult.Error
+	}
+	sort.SliceStable(tests, func(i, j int) bool {
+		return tests[i].Sequence != nil && (tests[j].Sequence == nil || *tests[i].Sequence < *tests[j].Sequence)
+	})
+
 	// Build it
 	t4.ID = track.ID
 	t4.Type = track.Type
@@ -169,6 +244,7 @@ func (t4 *StationTasksTests) Get(request *rest.Request) rest.Result {
 		t4Task.Name = task.Name
 		t4Task.Description = task.Description
 		t4Task.Sequence = task.Sequence
+		t4Task.Locked = task.Locked
 		t4Task.Tests = make([]Test, 0)
 		t4.Tasks = append(t4.Tasks, &t4Task)
 		t4TaskMap[task.Shortname] = &t4Task
@@ -178,8 +254,187 @@ func (t4 *StationTasksTests) Get(request *rest.Request) rest.Result {
 		if !t4TaskOk {
 			continue
 		}
-		t4Task.Tests = append(t4Task.Tests, test)
+		t4Task.Tests = append(t4Task.Tests, *test)
+	}
+
+	return nil
+}
+
+// Get counts stations by status, active timeslots, the queue, latest test results and registrations for a track.
+func (summary *TrackSummary) Get(request *rest.Request) rest.Result {
+	// Get track
+	track, result := loadTrackSummaryTrack(request)
+	if !result.IsOk() {
+		return result
+	}
+	trackID := track.ID
+	summary.ID = track.ID
+	summary.Type = track.Type
+	summary.Name = track.Name
+
+	// Count stations by status and active timeslots
+	summary.StationsByStatus = make(map[StationStatus]int)
+	rows, rowsErr := db.ReadExecutor("stations").Query("SELECT status, COUNT(*), COUNT(timeslot) FROM stations WHERE track = $1 AND status != $2 GROUP BY status",
+		trackID, StationStatusTerminated)
+	if rowsErr != nil {
+		return rest.InternalError(rowsErr)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status StationStatus
+		var count, assignedCount int
+		if err := rows.Scan(&status, &count, &assignedCount); err != nil {
+			return rest.InternalError(err)
+		}
+		summary.StationsByStatus[status] = count
+		summary.ActiveTimeslots += assignedCount
+	}
+	if err := rows.Err(); err != nil {
+		return rest.InternalError(err)
+	}
+
+	// Count the queue and latest test results (the ones not archived to a timeslot)
+	queueRow := db.ReadExecutor("queue_entries").QueryRow("SELECT COUNT(*) FROM queue_entries WHERE track = $1", trackID)
+	if err := queueRow.Scan(&summary.QueueLength); err != nil {
+		return rest.InternalError(err)
+	}
+	testsRow := db.ReadExecutor("tests").QueryRow("SELECT COUNT(*), COUNT(*) FILTER (WHERE status_success) FROM tests WHERE track = $1 AND timeslot IS NULL", trackID)
+	if err := testsRow.Scan(&summary.LatestTests, &summary.LatestTestsPassed); err != nil {
+		return rest.InternalError(err)
+	}
+	if summary.LatestTests > 0 {
+		passRate := float64(summary.LatestTestsPassed) / float64(summary.LatestTests)
+		summary.PassRate = &passRate
+	}
+
+	// Count registrations
+	summary.MaxRegistrations = track.MaxRegistrations
+	registrationsRow := db.ReadExecutor("timeslots").QueryRow("SELECT COUNT(*), COUNT(*) FILTER (WHERE status = $2) FROM timeslots WHERE track = $1 AND cancel_time IS NULL",
+		trackID, TimeslotStatusPending)
+	if err := registrationsRow.Scan(&summary.Registrations, &summary.PendingTimeslots); err != nil {
+		return rest.InternalError(err)
+	}
+
+	return rest.Result{}
+}
+
+// Head checks that the track exists and is visible like Get, without counting anything.
+func (summary *TrackSummary) Head(request *rest.Request) rest.Result {
+	_, result := loadTrackSummaryTrack(request)
+	return result
+}
+
+// loadTrackSummaryTrack gets the track from the path, if visible to the requester.
+func loadTrackSummaryTrack(request *rest.Request) (*Track, rest.Result) {
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return nil, rest.BadRequest("missing track ID")
+	}
+	var track Track
+	trackDBResult := db.Select(&track, "tracks", "id", "=", trackID)
+	if trackDBResult.IsFailed() {
+		return nil, rest.InternalError(trackDBResult.Error)
+	}
+	isOperator := request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin
+	if !trackDBResult.IsSuccess() || (!track.isVisible() && !isOperator) {
+		return nil, rest.NotFound("not found")
+	}
+	return &track, rest.Result{}
+}
+
+// Get gets the requester's active timeslots with stations, tasks, latest tests and remaining time.
+func (status *MyStatus) Get(request *rest.Request) rest.Result {
+	userID := request.AccessToken.OwnerUserID
+	if userID == nil {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+	status.UserID = userID
+	status.Timeslots = make([]*myStatusTimeslot, 0)
+
+	// Find stations with active timeslots owned by the user or the user's teams
+	var stationIDs []string
+	rows, rowsErr := db.DB.Query("SELECT stations.id FROM stations JOIN timeslots ON stations.timeslot = timeslots.id WHERE timeslots.\"user\" = $1 OR timeslots.team IN (SELECT team FROM team_members WHERE \"user\" = $1) ORDER BY stations.track",
+		userID)
+	if rowsErr != nil {
+		return rest.InternalError(rowsErr)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var stationID string
+		if err := rows.Scan(&stationID); err != nil {
+			return rest.InternalError(err)
+		}
+		stationIDs = append(stationIDs, stationID)
+	}
+	if err := rows.Err(); err != nil {
+		return rest.InternalError(err)
+	}
+	if len(stationIDs) == 0 {
+		return rest.Result{}
+	}
+	var stations Stations
+	stationsDBResult := db.SelectManyOrdered(&stations, "stations", "track", "id", "IN", stationIDs)
+	if stationsDBResult.IsFailed() {
+		return rest.InternalError(stationsDBResult.Error)
+	}
+	if err := stations.markOwned(request.AccessToken); err != nil {
+		return rest.InternalError(err)
+	}
+
+	now := time.Now()
+	seenTrackIDs := make(map[string]bool)
+	for _, station := range stations {
+		if seenTrackIDs[station.TrackID] {
+			continue
+		}
+		seenTrackIDs[station.TrackID] = true
+
+		var track Track
+		trackDBResult := db.Select(&track, "tracks", "id", "=", station.TrackID)
+		if trackDBResult.IsFailed() {
+			return rest.InternalError(trackDBResult.Error)
+		}
+		var timeslot Timeslot
+		timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", station.TimeslotID)
+		if timeslotDBResult.IsFailed() {
+			return rest.InternalError(timeslotDBResult.Error)
+		}
+		if !trackDBResult.IsSuccess() || !timeslotDBResult.IsSuccess() {
+			continue
+		}
+		var t4 StationTasksTests
+		if err := t4.load(&track, station.Shortname, true); err != nil {
+			return rest.InternalError(err)
+		}
+
+		entry := myStatusTimeslot{
+			Timeslot:  &timeslot,
+			TrackName: track.Name,
+			Station:   station,
+			Tasks:     t4.Tasks,
+			Deadline:  timeslot.deadline(&track),
+		}
+		if entry.Deadline != nil {
+			remainingSeconds := int(entry.Deadline.Sub(now).Seconds())
+			if remainingSeconds < 0 {
+				remainingSeconds = 0
+			}
+			entry.RemainingSeconds = &remainingSeconds
+		}
+		status.Timeslots = append(status.Timeslots, &entry)
 	}
 
 	return rest.Result{}
 }
+
+// deadline finds when the active timeslot ends, i.e. when it's automatically finished due to the max duration
+// of the track or else the planned end time. Returns nil if neither is known.
+func (timeslot *Timeslot) deadline(track *Track) *time.Time {
+	if track.MaxDurationMinutes > 0 && timeslot.BeginTime != nil {
+		deadline := timeslot.BeginTime.Add(time.Duration(track.MaxDurationMinutes) * time.Minute)
+		if timeslot.EndTime == nil || deadline.Before(*timeslot.EndTime) {
+			return &deadline
+		}
+	}
+	return timeslot.EndTime
+}
@@ -0,0 +1,271 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+// EventStatus is the lifecycle state of an event.
+type EventStatus string
+
+const (
+	// EventStatusActive means the event is running or being prepared.
+	EventStatusActive EventStatus = "active"
+	// EventStatusArchived means the event is over and its tracks are archived.
+	EventStatusArchived EventStatus = "archived"
+)
+
+// Event is a separate Tech:Online event (e.g. a yearly event or a test event), scoping tracks and document families.
+// Stations, timeslots, tasks and documents belong to the event of their track or family.
+// Requests are scoped to the event from the "event" query param, the hostname or the default event (see the config).
+type Event struct {
+	ID     string      `column:"id" json:"id"`         // Required, unique, e.g. "tg23"
+	Name   string      `column:"name" json:"name"`     // Required
+	Status EventStatus `column:"status" json:"status"` // Optional, defaults to active
+}
+
+// Events is a list of events.
+type Events []*Event
+
+// EventArchiveRequest is for archiving an event and all its tracks.
+type EventArchiveRequest struct {
+	ArchivedTracks int `json:"archived_tracks"` // Output
+}
+
+func init() {
+	rest.AddHandler("/events/", "^$", func() interface{} { return &Events{} })
+	rest.AddHandler("/event/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Event{} })
+	rest.AddHandler("/event/", "^(?P<id>[^/]+)/archive/$", func() interface{} { return &EventArchiveRequest{} })
+}
+
+// Get gets all events.
+func (events *Events) Get(request *rest.Request) rest.Result {
+	dbResult := db.SelectManyOrdered(events, "events", "id")
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Get gets a single event.
+func (event *Event) Get(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	dbResult := db.Select(event, "events", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+	return rest.Result{}
+}
+
+// Post creates a new event.
+func (event *Event) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Validate
+	if result := event.validate(); !result.IsOk() {
+		return result
+	}
+	if exists, err := event.exists(); err != nil {
+		return rest.InternalError(err)
+	} else if exists {
+		return rest.Conflict("duplicate ID")
+	}
+
+	// Create and redirect
+	dbResult := db.Insert("events", event)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Created(fmt.Sprintf("%v/event/%v/", config.Get().SitePrefix, event.ID))
+}
+
+// Put updates an event.
+func (event *Event) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Validate
+	if event.ID != id {
+		return rest.BadRequest("mismatch between URL and JSON IDs")
+	}
+	if result := event.validate(); !result.IsOk() {
+		return result
+	}
+
+	dbResult := db.Upsert("events", event, "id", "=", event.ID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Delete deletes an event, if it has no tracks or document families.
+func (event *Event) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Check if in use
+	for _, table := range []string{"tracks", "document_families"} {
+		inUseResult := db.Exists(table, "event", "=", id)
+		if inUseResult.IsFailed() {
+			return rest.InternalError(inUseResult.Error)
+		}
+		if inUseResult.IsSuccess() {
+			return rest.Conflict(fmt.Sprintf("event still has %v", table))
+		}
+	}
+
+	dbResult := db.Delete("events", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if dbResult.Affected == 0 {
+		return rest.NotFound("not found")
+	}
+	return rest.Result{}
+}
+
+func (event *Event) exists() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM events WHERE id = $1", event.ID)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+func (event *Event) validate() rest.Result {
+	if event.Status == "" {
+		event.Status = EventStatusActive
+	}
+	switch {
+	case event.ID == "":
+		return rest.BadRequest("missing ID")
+	case event.Name == "":
+		return rest.BadRequest("missing name")
+	case event.Status != EventStatusActive && event.Status != EventStatusArchived:
+		return rest.BadRequest("invalid status")
+	}
+	return rest.Result{}
+}
+
+// Post archives the event and all its tracks, in a single transaction.
+func (archiveRequest *EventArchiveRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+	event := Event{ID: id}
+	if exists, err := event.exists(); err != nil {
+		return rest.InternalError(err)
+	} else if !exists {
+		return rest.NotFound("not found")
+	}
+
+	tx, txErr := db.DB.Begin()
+	if txErr != nil {
+		return rest.InternalError(txErr)
+	}
+	defer tx.Rollback()
+	tracksResult, tracksErr := tx.Exec("UPDATE tracks SET status = $1, updated_at = now() WHERE event = $2 AND status != $1", TrackStatusArchived, id)
+	if tracksErr != nil {
+		return rest.InternalError(tracksErr)
+	}
+	if _, err := tx.Exec("UPDATE events SET status = $1 WHERE id = $2", EventStatusArchived, id); err != nil {
+		return rest.InternalError(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return rest.InternalError(err)
+	}
+	db.NotifyWrite("tracks")
+	db.NotifyWrite("events")
+
+	if affected, err := tracksResult.RowsAffected(); err == nil {
+		archiveRequest.ArchivedTracks = int(affected)
+	}
+	request.Log.WithField("event", id).Infof("Archived event with %v tracks", archiveRequest.ArchivedTracks)
+	return rest.Result{}
+}
+
+// eventTrackIDs gets the IDs of the tracks in the event, for scoping entities belonging to tracks.
+func eventTrackIDs(eventID string) ([]string, error) {
+	var tracks Tracks
+	dbResult := db.SelectMany(&tracks, "tracks", "event", "=", eventID)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	trackIDs := make([]string, 0, len(tracks))
+	for _, track := range tracks {
+		trackIDs = append(trackIDs, track.ID)
+	}
+	return trackIDs, nil
+}
+
+// scopeToRequestEvent adds a filter on the track column for the tracks in the request event, if any.
+func scopeToRequestEvent(request *rest.Request, whereArgs []interface{}) ([]interface{}, error) {
+	if request.EventID == "" {
+		return whereArgs, nil
+	}
+	trackIDs, err := eventTrackIDs(request.EventID)
+	if err != nil {
+		return nil, err
+	}
+	return append(whereArgs, "track", "IN", trackIDs), nil
+}
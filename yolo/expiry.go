@@ -0,0 +1,122 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/worker"
+	log "github.com/sirupsen/logrus"
+)
+
+// timeslotExpiryInterval is how often active timeslots are checked for expiry.
+const timeslotExpiryInterval = 1 * time.Minute
+
+func init() {
+	worker.AddTask("timeslot-expiry", timeslotExpiryInterval, finishExpiredTimeslots)
+}
+
+// finishExpiredTimeslots finishes active timeslots which have exceeded the max duration of the track,
+// or which haven't gotten any tests within the no-show timeout of the track.
+func finishExpiredTimeslots() {
+	var tracks Tracks
+	tracksDBResult := db.SelectMany(&tracks, "tracks")
+	if tracksDBResult.IsFailed() {
+		log.WithError(tracksDBResult.Error).Error("Failed to load tracks for timeslot expiry")
+		return
+	}
+
+	for _, track := range tracks {
+		if track.MaxDurationMinutes <= 0 && track.NoShowMinutes <= 0 {
+			continue
+		}
+
+		var stations Stations
+		stationsDBResult := db.SelectMany(&stations, "stations",
+			"track", "=", track.ID,
+			"timeslot", "!=", nil,
+		)
+		if stationsDBResult.IsFailed() {
+			log.WithError(stationsDBResult.Error).WithField("track", track.ID).Error("Failed to load active stations for timeslot expiry")
+			continue
+		}
+
+		for _, station := range stations {
+			reason, err := finishExpiredTimeslot(track, station)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"track":    track.ID,
+					"station":  station.ID,
+					"timeslot": station.TimeslotID,
+				}).Error("Failed to finish expired timeslot")
+			} else if reason != "" {
+				log.WithFields(log.Fields{
+					"track":    track.ID,
+					"station":  station.ID,
+					"timeslot": station.TimeslotID,
+					"reason":   reason,
+				}).Info("Finished expired timeslot")
+			}
+		}
+	}
+}
+
+// finishExpiredTimeslot finishes the timeslot bound to the station if expired.
+// Returns the reason if finished, or an empty string if not expired.
+func finishExpiredTimeslot(track *Track, station *Station) (string, error) {
+	var timeslot Timeslot
+	timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", station.TimeslotID)
+	if timeslotDBResult.IsFailed() {
+		return "", timeslotDBResult.Error
+	}
+	if !timeslotDBResult.IsSuccess() || timeslot.BeginTime == nil {
+		// Not for us to clean up
+		return "", nil
+	}
+
+	now := time.Now()
+	activeDuration := now.Sub(*timeslot.BeginTime)
+	reason := ""
+	if track.MaxDurationMinutes > 0 && activeDuration > time.Duration(track.MaxDurationMinutes)*time.Minute {
+		reason = "max duration exceeded"
+	} else if track.NoShowMinutes > 0 && activeDuration > time.Duration(track.NoShowMinutes)*time.Minute {
+		testsDBResult := db.Exists("tests", "timeslot", "=", station.TimeslotID)
+		if testsDBResult.IsFailed() {
+			return "", testsDBResult.Error
+		}
+		if !testsDBResult.IsSuccess() {
+			reason = "no-show"
+		}
+	}
+	if reason == "" {
+		return "", nil
+	}
+
+	if result := timeslot.finish(track, station); !result.IsOk() {
+		if result.Error != nil {
+			return "", result.Error
+		}
+		return "", fmt.Errorf("failed to finish timeslot: %v", result.Message)
+	}
+	return reason, nil
+}
@@ -0,0 +1,405 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	content "github.com/gathering/tech-online-backend/doc"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// EventBundle is the complete configuration of an event, for bootstrapping another event from it.
+// Participant data like users, timeslots and tests is not included.
+type EventBundle struct {
+	ExportTime       *time.Time               `json:"export_time"`
+	DocumentFamilies content.DocumentFamilies `json:"document_families"`
+	Documents        content.Documents        `json:"documents"`
+	Tracks           Tracks                   `json:"tracks"`
+	Tasks            Tasks                    `json:"tasks"`
+	Hints            Hints                    `json:"hints"`
+	Stations         Stations                 `json:"stations"` // Without credentials, assigned timeslots and current status
+}
+
+// eventImportMaxBodyBytes is the max size of event bundles to import, which may be a lot larger than regular requests.
+const eventImportMaxBodyBytes = 64 * 1024 * 1024
+
+// EventImport is for importing an event bundle. Existing entities are updated, others are created, nothing is deleted.
+type EventImport struct {
+	EventBundle
+	Imported map[string]int `json:"imported"` // Output, the number of entities imported by kind
+}
+
+// stationImport contains the station fields updated when importing existing stations.
+type stationImport struct {
+	TrackID       string        `column:"track"`
+	Shortname     string        `column:"shortname"`
+	Name          string        `column:"name"`
+	DefaultStatus StationStatus `column:"default_status"`
+	Notes         string        `column:"notes"`
+	// Console address is kept, unlike the credentials
+	ConsoleAddress string `column:"console_address"`
+	// Left nil to bump the version without checking it
+	Version *int `column:"version"`
+}
+
+func init() {
+	rest.AddHandler("/admin/", "^export/$", func() interface{} { return &EventBundle{} })
+	rest.AddHandler("/admin/", "^import/$", func() interface{} { return &EventImport{} })
+}
+
+// Get exports the event configuration.
+func (bundle *EventBundle) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get everything, or only the request event
+	now := time.Now()
+	bundle.ExportTime = &now
+	if request.EventID != "" {
+		if err := bundle.loadEvent(request.EventID); err != nil {
+			return rest.InternalError(err)
+		}
+	} else {
+		for table, list := range map[string]interface{}{
+			"document_families": &bundle.DocumentFamilies,
+			"documents":         &bundle.Documents,
+			"tracks":            &bundle.Tracks,
+			"tasks":             &bundle.Tasks,
+			"hints":             &bundle.Hints,
+			"stations":          &bundle.Stations,
+		} {
+			dbResult := db.SelectMany(list, table)
+			if dbResult.IsFailed() {
+				return rest.InternalError(dbResult.Error)
+			}
+		}
+	}
+	for _, task := range bundle.Tasks {
+		if err := task.loadDependencies(db.DB); err != nil {
+			return rest.InternalError(err)
+		}
+	}
+	for _, station := range bundle.Stations {
+		station.Credentials = ""
+		station.TimeslotID = db.NullString{}
+		station.ProvisionedByUserID = nil
+		station.Status = station.DefaultStatus
+	}
+	return rest.Result{}
+}
+
+// loadEvent loads the tracks and document families of the event, with everything belonging to them.
+func (bundle *EventBundle) loadEvent(eventID string) error {
+	if dbResult := db.SelectMany(&bundle.DocumentFamilies, "document_families", "event", "=", eventID); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if dbResult := db.SelectMany(&bundle.Tracks, "tracks", "event", "=", eventID); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	familyIDs := make([]string, 0, len(bundle.DocumentFamilies))
+	for _, family := range bundle.DocumentFamilies {
+		familyIDs = append(familyIDs, family.ID)
+	}
+	trackIDs := make([]string, 0, len(bundle.Tracks))
+	for _, track := range bundle.Tracks {
+		trackIDs = append(trackIDs, track.ID)
+	}
+	if dbResult := db.SelectMany(&bundle.Documents, "documents", "family", "IN", familyIDs); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if dbResult := db.SelectMany(&bundle.Tasks, "tasks", "track", "IN", trackIDs); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if dbResult := db.SelectMany(&bundle.Stations, "stations", "track", "IN", trackIDs); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	taskIDs := make([]string, 0, len(bundle.Tasks))
+	for _, task := range bundle.Tasks {
+		taskIDs = append(taskIDs, task.ID.String())
+	}
+	if dbResult := db.SelectMany(&bundle.Hints, "hints", "task", "IN", taskIDs); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	return nil
+}
+
+// MaxBodyBytes allows large event bundles.
+func (eventImport *EventImport) MaxBodyBytes() int64 {
+	return eventImportMaxBodyBytes
+}
+
+// Post imports an event configuration, transactionally.
+func (eventImport *EventImport) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Validate everything before writing anything
+	bundle := &eventImport.EventBundle
+	if request.EventID != "" {
+		// Import into the request event, e.g. to bootstrap a new event from an old one
+		for _, family := range bundle.DocumentFamilies {
+			family.EventID = request.EventID
+		}
+		for _, track := range bundle.Tracks {
+			track.EventID = request.EventID
+		}
+	}
+	if result := bundle.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Import
+	tx, txErr := db.DB.Begin()
+	if txErr != nil {
+		return rest.InternalError(txErr)
+	}
+	defer tx.Rollback()
+	if err := bundle.save(tx); err != nil {
+		return rest.InternalError(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return rest.InternalError(err)
+	}
+
+	eventImport.Imported = map[string]int{
+		"document_families": len(bundle.DocumentFamilies),
+		"documents":         len(bundle.Documents),
+		"tracks":            len(bundle.Tracks),
+		"tasks":             len(bundle.Tasks),
+		"hints":             len(bundle.Hints),
+		"stations":          len(bundle.Stations),
+	}
+	return rest.Result{}
+}
+
+// validate validates the bundle. References must be to entities in the bundle or already existing.
+func (bundle *EventBundle) validate() rest.Result {
+	now := time.Now()
+	for _, family := range bundle.DocumentFamilies {
+		if family.ID == "" {
+			return rest.BadRequest("document family: missing ID")
+		}
+	}
+	for _, document := range bundle.Documents {
+		switch {
+		case document.FamilyID == "":
+			return rest.BadRequest("document: missing family ID")
+		case document.Shortname == "":
+			return rest.BadRequest("document: missing shortname")
+		case document.Locale == "":
+			return rest.BadRequest(fmt.Sprintf("document %v/%v: missing locale", document.FamilyID, document.Shortname))
+		}
+		// Imported content counts as changed, also to invalidate cached renderings
+		document.LastChange = &now
+	}
+
+	trackIDs := make(map[string]bool)
+	for _, track := range bundle.Tracks {
+		if track.Status == "" {
+			track.Status = TrackStatusOpen
+		}
+		if result := track.validate(); !result.IsOk() {
+			return rest.Result{Code: result.Code, Message: fmt.Sprintf("track %v: %v", track.ID, result.Message), Error: result.Error}
+		}
+		trackIDs[track.ID] = true
+	}
+	trackExists := func(trackID string) (bool, error) {
+		if trackIDs[trackID] {
+			return true, nil
+		}
+		track := Track{ID: trackID}
+		return track.exists()
+	}
+
+	tasks := make(map[uuid.UUID]*Task)
+	for _, task := range bundle.Tasks {
+		switch {
+		case task.ID == nil:
+			return rest.BadRequest("task: missing ID")
+		case task.TrackID == "" || task.Shortname == "" || task.Name == "":
+			return rest.BadRequest(fmt.Sprintf("task %v: missing track ID, shortname or name", task.ID))
+		}
+		if exists, err := trackExists(task.TrackID); err != nil {
+			return rest.InternalError(err)
+		} else if !exists {
+			return rest.BadRequest(fmt.Sprintf("task %v: referenced track does not exist", task.ID))
+		}
+		tasks[*task.ID] = task
+	}
+	if result := validateBundleTaskDependencies(tasks); !result.IsOk() {
+		return result
+	}
+
+	for _, hint := range bundle.Hints {
+		switch {
+		case hint.ID == nil:
+			return rest.BadRequest("hint: missing ID")
+		case hint.TaskID == nil || hint.Content == "" || hint.Penalty < 0:
+			return rest.BadRequest(fmt.Sprintf("hint %v: missing task ID or content, or negative penalty", hint.ID))
+		}
+		if _, ok := tasks[*hint.TaskID]; !ok {
+			task := Task{ID: hint.TaskID}
+			if exists, err := task.exists(db.DB); err != nil {
+				return rest.InternalError(err)
+			} else if !exists {
+				return rest.BadRequest(fmt.Sprintf("hint %v: referenced task does not exist", hint.ID))
+			}
+		}
+	}
+
+	for _, station := range bundle.Stations {
+		station.Credentials = ""
+		station.TimeslotID = db.NullString{}
+		station.ProvisionedByUserID = nil
+		station.Status = station.DefaultStatus
+		switch {
+		case station.ID == nil:
+			return rest.BadRequest("station: missing ID")
+		case station.TrackID == "" || station.Shortname == "":
+			return rest.BadRequest(fmt.Sprintf("station %v: missing track ID or shortname", station.ID))
+		case !station.validateStatus():
+			return rest.BadRequest(fmt.Sprintf("station %v: missing or invalid default status", station.ID))
+		}
+		if exists, err := trackExists(station.TrackID); err != nil {
+			return rest.InternalError(err)
+		} else if !exists {
+			return rest.BadRequest(fmt.Sprintf("station %v: referenced track does not exist", station.ID))
+		}
+	}
+
+	return rest.Result{}
+}
+
+// validateBundleTaskDependencies checks that task dependencies are tasks in the bundle for the same track, without cycles.
+func validateBundleTaskDependencies(tasks map[uuid.UUID]*Task) rest.Result {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	states := make(map[uuid.UUID]int)
+	var hasCycle func(taskID uuid.UUID) bool
+	hasCycle = func(taskID uuid.UUID) bool {
+		switch states[taskID] {
+		case visiting:
+			return true
+		case visited:
+			return false
+		}
+		states[taskID] = visiting
+		for _, dependsOnID := range tasks[taskID].DependsOnIDs {
+			if hasCycle(dependsOnID) {
+				return true
+			}
+		}
+		states[taskID] = visited
+		return false
+	}
+
+	for _, task := range tasks {
+		for _, dependsOnID := range task.DependsOnIDs {
+			dependsOn, ok := tasks[dependsOnID]
+			if !ok || dependsOn.TrackID != task.TrackID {
+				return rest.BadRequest(fmt.Sprintf("task %v: dependency is not a task in the bundle for the same track", task.ID))
+			}
+		}
+	}
+	for taskID := range tasks {
+		if hasCycle(taskID) {
+			return rest.BadRequest(fmt.Sprintf("task %v: dependencies contain a cycle", taskID))
+		}
+	}
+	return rest.Result{}
+}
+
+// save creates or updates everything in the bundle.
+func (bundle *EventBundle) save(executor db.Executor) error {
+	for _, family := range bundle.DocumentFamilies {
+		if dbResult := db.UpsertWith(executor, "document_families", family, "id", "=", family.ID); dbResult.IsFailed() {
+			return dbResult.Error
+		}
+	}
+	for _, document := range bundle.Documents {
+		if dbResult := db.UpsertWith(executor, "documents", document, "family", "=", document.FamilyID, "shortname", "=", document.Shortname, "locale", "=", document.Locale); dbResult.IsFailed() {
+			return dbResult.Error
+		}
+	}
+	for _, track := range bundle.Tracks {
+		if dbResult := db.UpsertWith(executor, "tracks", track, "id", "=", track.ID); dbResult.IsFailed() {
+			return dbResult.Error
+		}
+	}
+	for _, task := range bundle.Tasks {
+		if dbResult := db.UpsertWith(executor, "tasks", task, "id", "=", task.ID); dbResult.IsFailed() {
+			return dbResult.Error
+		}
+	}
+	// Dependencies after all tasks exist
+	for _, task := range bundle.Tasks {
+		if dbResult := db.DeleteWith(executor, "task_dependencies", "task", "=", task.ID); dbResult.IsFailed() {
+			return dbResult.Error
+		}
+		for _, dependsOnID := range task.DependsOnIDs {
+			dependency := taskDependency{TaskID: *task.ID, DependsOnID: dependsOnID}
+			if dbResult := db.InsertWith(executor, "task_dependencies", dependency); dbResult.IsFailed() {
+				return dbResult.Error
+			}
+		}
+	}
+	for _, hint := range bundle.Hints {
+		if dbResult := db.UpsertWith(executor, "hints", hint, "id", "=", hint.ID); dbResult.IsFailed() {
+			return dbResult.Error
+		}
+	}
+	// Existing stations keep their credentials, status and timeslot
+	for _, station := range bundle.Stations {
+		existsResult := db.ExistsWith(executor, "stations", "id", "=", station.ID)
+		if existsResult.IsFailed() {
+			return existsResult.Error
+		}
+		var dbResult db.Result
+		if existsResult.IsSuccess() {
+			update := stationImport{
+				TrackID:        station.TrackID,
+				Shortname:      station.Shortname,
+				Name:           station.Name,
+				DefaultStatus:  station.DefaultStatus,
+				Notes:          station.Notes,
+				ConsoleAddress: station.ConsoleAddress,
+			}
+			dbResult = db.UpdateWith(executor, "stations", update, "id", "=", station.ID)
+		} else {
+			dbResult = db.InsertWith(executor, "stations", station)
+		}
+		if dbResult.IsFailed() {
+			return dbResult.Error
+		}
+	}
+	return nil
+}
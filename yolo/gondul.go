@@ -0,0 +1,274 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/worker"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// gondulWorkerTaskName is the name of the worker task setting clean dirty net track stations ready.
+const gondulWorkerTaskName = "gondul-sync"
+
+// gondulWorkerInterval is how often Gondul is checked for clean stations.
+const gondulWorkerInterval = 1 * time.Minute
+
+// gondulTimeout is the timeout for Gondul API requests.
+const gondulTimeout = 10 * time.Second
+
+// StationNetworkState is the switch state for a net track station, from Gondul.
+type StationNetworkState struct {
+	StationID  *uuid.UUID     `json:"station"`
+	Switch     string         `json:"switch"`     // The Gondul switch name
+	Reachable  bool           `json:"reachable"`  // If Gondul gets ping replies from the switch
+	Latency4   *float64       `json:"latency4"`   // Milliseconds, if reachable over IPv4
+	Latency6   *float64       `json:"latency6"`   // Milliseconds, if reachable over IPv6
+	Ports      []*NetworkPort `json:"ports"`      // By name
+	Configured bool           `json:"configured"` // If any of the ports have a description (participant config)
+}
+
+// NetworkPort is the state of a single switch port.
+type NetworkPort struct {
+	Name        string `json:"name"`
+	Description string `json:"description"` // ifAlias
+	OperStatus  string `json:"oper_status"` // ifOperStatus, e.g. "up" or "down"
+}
+
+// gondulSNMPResponse is the relevant part of Gondul's /api/read/snmp response.
+type gondulSNMPResponse struct {
+	Switches map[string]struct {
+		Ports map[string]struct {
+			IfAlias      string `json:"ifAlias"`
+			IfOperStatus string `json:"ifOperStatus"`
+		} `json:"ports"`
+	} `json:"switches"`
+}
+
+// gondulPingResponse is the relevant part of Gondul's /api/public/ping response.
+type gondulPingResponse struct {
+	Switches map[string]struct {
+		Latency4 *float64 `json:"latency4"`
+		Latency6 *float64 `json:"latency6"`
+	} `json:"switches"`
+}
+
+func init() {
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/network-state/$", func() interface{} { return &StationNetworkState{} })
+	worker.AddTask(gondulWorkerTaskName, gondulWorkerInterval, readyCleanNetStations)
+}
+
+// Get gets the switch state for a net track station from Gondul, mapped by the station shortname.
+func (state *StationNetworkState) Get(request *rest.Request) rest.Result {
+	gondulConfig := config.Get().Gondul
+	if gondulConfig.BaseURL == "" {
+		return rest.NotFound("Gondul integration not configured")
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Get station and track
+	var station Station
+	stationDBResult := db.Select(&station, "stations", "id", "=", id)
+	if stationDBResult.IsFailed() {
+		return rest.InternalError(stationDBResult.Error)
+	}
+	if !stationDBResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+	var track Track
+	trackDBResult := db.Select(&track, "tracks", "id", "=", station.TrackID)
+	if trackDBResult.IsFailed() {
+		return rest.InternalError(trackDBResult.Error)
+	}
+	if trackDBResult.IsSuccess() && !track.isVisible() && request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.NotFound("not found")
+	}
+	if !trackDBResult.IsSuccess() || track.Type != trackTypeNet {
+		return rest.BadRequest("station is not in a net track")
+	}
+
+	// Get state
+	snmp, ping, gondulErr := fetchGondulState(gondulConfig)
+	if gondulErr != nil {
+		return rest.Result{Code: 502, Message: fmt.Sprintf("failed to get state from Gondul: %v", gondulErr)}
+	}
+	if !state.load(gondulConfig, &station, snmp, ping) {
+		return rest.NotFound(fmt.Sprintf("switch %v not found in Gondul", state.Switch))
+	}
+	return rest.Result{}
+}
+
+// load fills in the state for the station from the Gondul responses.
+// Returns false if Gondul doesn't know the switch.
+func (state *StationNetworkState) load(gondulConfig config.GondulConfig, station *Station, snmp gondulSNMPResponse, ping gondulPingResponse) bool {
+	state.StationID = station.ID
+	state.Switch = gondulConfig.SwitchPrefix + station.Shortname
+	switchSNMP, snmpOk := snmp.Switches[state.Switch]
+	switchPing, pingOk := ping.Switches[state.Switch]
+	if !snmpOk && !pingOk {
+		return false
+	}
+
+	state.Latency4 = switchPing.Latency4
+	state.Latency6 = switchPing.Latency6
+	state.Reachable = state.Latency4 != nil || state.Latency6 != nil
+	state.Ports = make([]*NetworkPort, 0, len(switchSNMP.Ports))
+	for name, port := range switchSNMP.Ports {
+		state.Ports = append(state.Ports, &NetworkPort{
+			Name:        name,
+			Description: port.IfAlias,
+			OperStatus:  port.IfOperStatus,
+		})
+		if strings.TrimSpace(port.IfAlias) != "" {
+			state.Configured = true
+		}
+	}
+	sort.Slice(state.Ports, func(i, j int) bool { return state.Ports[i].Name < state.Ports[j].Name })
+	return true
+}
+
+// fetchGondulState gets the SNMP and ping state for all switches from Gondul.
+func fetchGondulState(gondulConfig config.GondulConfig) (gondulSNMPResponse, gondulPingResponse, error) {
+	var snmp gondulSNMPResponse
+	var ping gondulPingResponse
+	if err := fetchGondul(gondulConfig, "/api/read/snmp", &snmp); err != nil {
+		return snmp, ping, err
+	}
+	if err := fetchGondul(gondulConfig, "/api/public/ping", &ping); err != nil {
+		return snmp, ping, err
+	}
+	return snmp, ping, nil
+}
+
+func fetchGondul(gondulConfig config.GondulConfig, path string, data interface{}) error {
+	gondulRequest, requestErr := http.NewRequest("GET", strings.TrimSuffix(gondulConfig.BaseURL, "/")+path, nil)
+	if requestErr != nil {
+		return requestErr
+	}
+	if gondulConfig.Username != "" {
+		gondulRequest.SetBasicAuth(gondulConfig.Username, gondulConfig.Password)
+	}
+	client := &http.Client{Timeout: gondulTimeout}
+	gondulResponse, responseErr := client.Do(gondulRequest)
+	if responseErr != nil {
+		return responseErr
+	}
+	defer gondulResponse.Body.Close()
+	if gondulResponse.StatusCode < 200 || gondulResponse.StatusCode > 299 {
+		return fmt.Errorf("response contained non-2XX status: %v", gondulResponse.Status)
+	}
+	return json.NewDecoder(gondulResponse.Body).Decode(data)
+}
+
+// readyCleanNetStations sets unassigned dirty net track stations ready when Gondul reports the switch
+// as reachable with no port descriptions left, i.e. the participant config has been wiped.
+func readyCleanNetStations() {
+	gondulConfig := config.Get().Gondul
+	if gondulConfig.BaseURL == "" || !gondulConfig.AutoReady {
+		return
+	}
+
+	var tracks Tracks
+	tracksDBResult := db.SelectMany(&tracks, "tracks", "type", "=", trackTypeNet)
+	if tracksDBResult.IsFailed() {
+		log.WithError(tracksDBResult.Error).Error("Failed to find net tracks")
+		return
+	}
+	var trackIDs []string
+	for _, track := range tracks {
+		trackIDs = append(trackIDs, track.ID)
+	}
+	if len(trackIDs) == 0 {
+		return
+	}
+	var stations Stations
+	dbResult := db.SelectMany(&stations, "stations", "track", "IN", trackIDs, "status", "=", StationStatusDirty, "timeslot", "=", nil)
+	if dbResult.IsFailed() {
+		log.WithError(dbResult.Error).Error("Failed to find dirty net stations")
+		return
+	}
+	if len(stations) == 0 {
+		return
+	}
+
+	snmp, ping, gondulErr := fetchGondulState(gondulConfig)
+	if gondulErr != nil {
+		log.WithError(gondulErr).Warn("Failed to get state from Gondul")
+		return
+	}
+	readied := false
+	for _, station := range stations {
+		var state StationNetworkState
+		if !state.load(gondulConfig, station, snmp, ping) || !state.Reachable || state.Configured {
+			continue
+		}
+		if err := station.setCleanReady(); err != nil {
+			log.WithError(err).WithField("station", station.ID).Error("Failed to set clean station ready")
+			continue
+		}
+		readied = true
+	}
+	if readied {
+		// Let the queue have them
+		worker.Trigger(queueWorkerTaskName)
+	}
+}
+
+// setCleanReady sets the station ready, unless it changed in the meantime.
+func (station *Station) setCleanReady() error {
+	tx, txErr := db.DB.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+	updateResult, updateErr := tx.Exec("UPDATE stations SET status = $1, version = version + 1, updated_at = now() WHERE id = $2 AND status = $3 AND timeslot IS NULL", StationStatusReady, station.ID, StationStatusDirty)
+	if updateErr != nil {
+		return updateErr
+	}
+	if affected, err := updateResult.RowsAffected(); err != nil || affected == 0 {
+		return err
+	}
+	station.Status = StationStatusReady
+	if err := queueStationStatusChanged(tx, station, StationStatusDirty); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	db.NotifyWrite("stations")
+	log.WithField("station", station.ID).Info("Gondul reports station clean, set it ready")
+	return nil
+}
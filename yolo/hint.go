@@ -0,0 +1,428 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// Hint is a hint for a task, which participants may request for their active timeslot.
+// Released hints may subtract a penalty from the timeslot score.
+type Hint struct {
+	ID       *uuid.UUID `column:"id" json:"id"`             // Generated, required, unique
+	TaskID   *uuid.UUID `column:"task" json:"task"`         // Required
+	Sequence int        `column:"sequence" json:"sequence"` // Required, hints are released in order
+	Content  string     `column:"content" json:"content"`   // Required, markdown
+	Penalty  int        `column:"penalty" json:"penalty"`   // Optional, points subtracted from the timeslot score when released
+	Enabled  bool       `column:"enabled" json:"enabled"`   // Optional, participants may only request enabled hints, operators may release any
+}
+
+// Hints is a list of hints.
+type Hints []*Hint
+
+// TimeslotHint is a hint released for a timeslot.
+type TimeslotHint struct {
+	Hint
+	ReleaseTime *time.Time `json:"release_time"`
+}
+
+// TimeslotHints is a list of hints released for a timeslot.
+type TimeslotHints []*TimeslotHint
+
+// TimeslotHintRequest is for releasing the next hint for a task to a timeslot.
+type TimeslotHintRequest struct {
+	TaskID *uuid.UUID    `json:"task"` // Required
+	Hint   *TimeslotHint `json:"hint"` // Output, the released hint
+}
+
+// hintRelease is a row in the hint releases table.
+type hintRelease struct {
+	TimeslotID  *uuid.UUID `column:"timeslot"`
+	HintID      *uuid.UUID `column:"hint"`
+	ReleaseTime *time.Time `column:"release_time"`
+}
+
+func init() {
+	rest.AddHandler("/hints/", "^$", func() interface{} { return &Hints{} })
+	rest.AddHandler("/hint/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Hint{} })
+	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/hints/$", func() interface{} { return &TimeslotHints{} })
+	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/hints/$", func() interface{} { return &TimeslotHintRequest{} })
+}
+
+// Get gets multiple hints.
+func (hints *Hints) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params and prep filtering
+	var whereArgs []interface{}
+	if taskID, ok := request.QueryArgs["task"]; ok {
+		whereArgs = append(whereArgs, "task", "=", taskID)
+	}
+
+	// Get
+	dbResult := db.SelectMany(hints, "hints", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	sort.SliceStable(*hints, func(i, j int) bool {
+		return (*hints)[i].Sequence < (*hints)[j].Sequence
+	})
+	return rest.Result{}
+}
+
+// Get gets a single hint.
+func (hint *Hint) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Get
+	dbResult := db.Select(hint, "hints", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+	return rest.Result{}
+}
+
+// Post creates a new hint.
+func (hint *Hint) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Prepare and validate
+	if hint.ID == nil {
+		newID := uuid.New()
+		hint.ID = &newID
+	}
+	if result := hint.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Create and redirect
+	result := hint.create()
+	if !result.IsOk() {
+		return result
+	}
+	result.Code = 201
+	result.Location = fmt.Sprintf("%v/hint/%v/", config.Get().SitePrefix, hint.ID)
+	return result
+}
+
+// Put updates a hint.
+func (hint *Hint) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Validate
+	if hint.ID == nil || (*hint.ID).String() != id {
+		return rest.BadRequest("mismatch between URL and JSON IDs")
+	}
+	if result := hint.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Create or update
+	return hint.createOrUpdate()
+}
+
+// Delete deletes a hint.
+func (hint *Hint) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.BadRequest("missing ID")
+	}
+	id, uuidErr := uuid.Parse(rawID)
+	if uuidErr != nil {
+		return rest.BadRequest("invalid ID")
+	}
+
+	// Check if it exists
+	hint.ID = &id
+	exists, err := hint.exists()
+	if err != nil {
+		return rest.InternalError(err)
+	}
+	if !exists {
+		return rest.NotFound("not found")
+	}
+
+	// Delete it and its releases
+	if dbResult := db.Delete("hint_releases", "hint", "=", hint.ID); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if dbResult := db.Delete("hints", "id", "=", hint.ID); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+func (hint *Hint) create() rest.Result {
+	if exists, err := hint.exists(); err != nil {
+		return rest.InternalError(err)
+	} else if exists {
+		return rest.Conflict("duplicate")
+	}
+
+	dbResult := db.Insert("hints", hint)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+func (hint *Hint) createOrUpdate() rest.Result {
+	exists, existsErr := hint.exists()
+	if existsErr != nil {
+		return rest.InternalError(existsErr)
+	}
+
+	var dbResult db.Result
+	if exists {
+		dbResult = db.Update("hints", hint, "id", "=", hint.ID)
+	} else {
+		dbResult = db.Insert("hints", hint)
+	}
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+func (hint *Hint) exists() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM hints WHERE id = $1", hint.ID)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+func (hint *Hint) validate() rest.Result {
+	switch {
+	case hint.ID == nil:
+		return rest.BadRequest("missing ID")
+	case hint.TaskID == nil:
+		return rest.BadRequest("missing task ID")
+	case hint.Content == "":
+		return rest.BadRequest("missing content")
+	case hint.Penalty < 0:
+		return rest.BadRequest("penalty can't be negative")
+	}
+
+	task := Task{ID: hint.TaskID}
+	if exists, err := task.exists(db.DB); err != nil {
+		return rest.InternalError(err)
+	} else if !exists {
+		return rest.BadRequest("referenced task does not exist")
+	}
+
+	return rest.Result{}
+}
+
+// Get gets the hints released for a timeslot, in release order.
+func (hints *TimeslotHints) Get(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Get timeslot and check perms
+	var timeslot Timeslot
+	if result := loadTimeslotForRequester(&timeslot, id, request.AccessToken); !result.IsOk() {
+		return result
+	}
+
+	// Get hints
+	var releases []*hintRelease
+	dbResult := db.SelectMany(&releases, "hint_releases", "timeslot", "=", timeslot.ID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	sort.SliceStable(releases, func(i, j int) bool {
+		return releases[i].ReleaseTime.Before(*releases[j].ReleaseTime)
+	})
+	*hints = make(TimeslotHints, 0, len(releases))
+	for _, release := range releases {
+		hint := TimeslotHint{ReleaseTime: release.ReleaseTime}
+		hintDBResult := db.Select(&hint.Hint, "hints", "id", "=", release.HintID)
+		if hintDBResult.IsFailed() {
+			return rest.InternalError(hintDBResult.Error)
+		}
+		if hintDBResult.IsSuccess() {
+			*hints = append(*hints, &hint)
+		}
+	}
+	return rest.Result{}
+}
+
+// Post releases the next hint for a task to a timeslot.
+// Participants may only request enabled hints for their active timeslot, while operators may release any hint to any timeslot.
+func (hintRequest *TimeslotHintRequest) Post(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+	if hintRequest.TaskID == nil {
+		return rest.BadRequest("missing task ID")
+	}
+
+	// Get timeslot and check perms
+	var timeslot Timeslot
+	if result := loadTimeslotForRequester(&timeslot, id, request.AccessToken); !result.IsOk() {
+		return result
+	}
+	isOperator := request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin
+	if !isOperator {
+		stationDBResult := db.Exists("stations", "timeslot", "=", timeslot.ID.String())
+		if stationDBResult.IsFailed() {
+			return rest.InternalError(stationDBResult.Error)
+		}
+		if !stationDBResult.IsSuccess() {
+			return rest.BadRequest("timeslot is not active")
+		}
+	}
+
+	// Check task
+	var task Task
+	taskDBResult := db.Select(&task, "tasks", "id", "=", hintRequest.TaskID)
+	if taskDBResult.IsFailed() {
+		return rest.InternalError(taskDBResult.Error)
+	}
+	if !taskDBResult.IsSuccess() || task.TrackID != timeslot.TrackID {
+		return rest.BadRequest("task not found for the timeslot track")
+	}
+
+	// Find next unreleased hint
+	var taskHints Hints
+	hintsDBResult := db.SelectMany(&taskHints, "hints", "task", "=", task.ID)
+	if hintsDBResult.IsFailed() {
+		return rest.InternalError(hintsDBResult.Error)
+	}
+	sort.SliceStable(taskHints, func(i, j int) bool {
+		return taskHints[i].Sequence < taskHints[j].Sequence
+	})
+	var nextHint *Hint
+	for _, hint := range taskHints {
+		if !hint.Enabled && !isOperator {
+			continue
+		}
+		releasedDBResult := db.Exists("hint_releases", "timeslot", "=", timeslot.ID, "hint", "=", hint.ID)
+		if releasedDBResult.IsFailed() {
+			return rest.InternalError(releasedDBResult.Error)
+		}
+		if !releasedDBResult.IsSuccess() {
+			nextHint = hint
+			break
+		}
+	}
+	if nextHint == nil {
+		return rest.NotFound("no more hints available for the task")
+	}
+
+	// Release it
+	now := time.Now()
+	release := hintRelease{TimeslotID: timeslot.ID, HintID: nextHint.ID, ReleaseTime: &now}
+	if dbResult := db.Insert("hint_releases", release); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	hintRequest.Hint = &TimeslotHint{Hint: *nextHint, ReleaseTime: &now}
+
+	return rest.Result{Code: 201}
+}
+
+// loadTimeslotForRequester loads the timeslot if it exists and is owned by the requester or the requester is an operator/admin.
+func loadTimeslotForRequester(timeslot *Timeslot, id string, token rest.AccessTokenEntry) rest.Result {
+	dbResult := db.Select(timeslot, "timeslots", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("timeslot not found")
+	}
+	if token.GetRole() != rest.RoleOperator && token.GetRole() != rest.RoleAdmin {
+		owned, err := timeslot.isOwnedBy(token.OwnerUserID)
+		if err != nil {
+			return rest.InternalError(err)
+		}
+		if !owned {
+			return rest.UnauthorizedResult(token)
+		}
+	}
+	return rest.Result{}
+}
+
+// loadHintPenalties loads the total penalty of released hints per timeslot in the track.
+func loadHintPenalties(trackID string) (map[string]int, error) {
+	rows, rowsErr := db.DB.Query("SELECT hint_releases.timeslot, SUM(hints.penalty) FROM hint_releases JOIN hints ON hint_releases.hint = hints.id JOIN tasks ON hints.task = tasks.id WHERE tasks.track = $1 GROUP BY hint_releases.timeslot", trackID)
+	if rowsErr != nil {
+		return nil, rowsErr
+	}
+	defer rows.Close()
+	penalties := make(map[string]int)
+	for rows.Next() {
+		var timeslotID string
+		var penalty int
+		if err := rows.Scan(&timeslotID, &penalty); err != nil {
+			return nil, err
+		}
+		penalties[timeslotID] = penalty
+	}
+	return penalties, rows.Err()
+}
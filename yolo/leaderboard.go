@@ -0,0 +1,369 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// Leaderboard is the ranking of users in a track, based on points for completed tasks.
+// A task is completed for a timeslot when all its tests for the timeslot are successful.
+// Each user is ranked by their best timeslot, with ties broken by the earliest completion time.
+type Leaderboard struct {
+	TrackID    string             `json:"track"`
+	FreezeTime *time.Time         `json:"freeze_time"` // Set if frozen, then entries are from the time of freezing
+	Entries    LeaderboardEntries `json:"entries"`
+}
+
+// LeaderboardEntry is a single ranked user in a leaderboard.
+// Also used for the frozen snapshot of a leaderboard.
+type LeaderboardEntry struct {
+	TrackID        string     `column:"track" json:"-"`
+	Rank           int        `column:"rank" json:"rank"` // 1-indexed, shared by ties
+	UserID         *uuid.UUID `column:"user" json:"user"`
+	DisplayName    string     `column:"display_name" json:"display_name"`
+	TimeslotID     *uuid.UUID `column:"timeslot" json:"timeslot"` // The best timeslot of the user
+	Score          int        `column:"score" json:"score"`
+	CompletedTasks int        `column:"completed_tasks" json:"completed_tasks"`
+	CompletionTime *time.Time `column:"completion_time" json:"completion_time"` // When the last completed task was completed
+}
+
+// LeaderboardEntries is a list of leaderboard entries.
+type LeaderboardEntries []*LeaderboardEntry
+
+// LeaderboardFreezeRequest freezes or unfreezes a leaderboard.
+type LeaderboardFreezeRequest struct {
+	Frozen bool `json:"frozen"`
+}
+
+// leaderboardFreeze is the freeze state of a track leaderboard.
+type leaderboardFreeze struct {
+	TrackID    string     `column:"track"`
+	FreezeTime *time.Time `column:"freeze_time"`
+}
+
+// TimeslotScore is the score for a single timeslot.
+type TimeslotScore struct {
+	TimeslotID     *uuid.UUID `json:"timeslot"`
+	Score          int        `json:"score"` // Points for completed tasks minus hint penalties, at least 0
+	MaxScore       int        `json:"max_score"`
+	HintPenalty    int        `json:"hint_penalty"`
+	CompletedTasks int        `json:"completed_tasks"`
+	CompletionTime *time.Time `json:"completion_time"`
+}
+
+func init() {
+	rest.AddHandler("/track/", "^(?P<track_id>[^/]+)/leaderboard/$", func() interface{} { return &Leaderboard{} })
+	rest.AddHandler("/track/", "^(?P<track_id>[^/]+)/leaderboard/freeze/$", func() interface{} { return &LeaderboardFreezeRequest{} })
+	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/score/$", func() interface{} { return &TimeslotScore{} })
+}
+
+// Get gets the leaderboard for a track.
+// If frozen, the frozen snapshot is shown, unless an operator/admin uses "?live".
+func (leaderboard *Leaderboard) Get(request *rest.Request) rest.Result {
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.BadRequest("missing track ID")
+	}
+	if result := checkTrackVisible(request, trackID); !result.IsOk() {
+		return result
+	}
+	leaderboard.TrackID = trackID
+
+	// Check if frozen
+	var freeze leaderboardFreeze
+	freezeDBResult := db.Select(&freeze, "leaderboard_freezes", "track", "=", trackID)
+	if freezeDBResult.IsFailed() {
+		return rest.InternalError(freezeDBResult.Error)
+	}
+	_, live := request.QueryArgs["live"]
+	isOperator := request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin
+	if freezeDBResult.IsSuccess() && !(live && isOperator) {
+		leaderboard.FreezeTime = freeze.FreezeTime
+		entriesDBResult := db.SelectMany(&leaderboard.Entries, "leaderboard_entries", "track", "=", trackID)
+		if entriesDBResult.IsFailed() {
+			return rest.InternalError(entriesDBResult.Error)
+		}
+		leaderboard.Entries.sort()
+		return rest.Result{}
+	}
+
+	entries, err := computeLeaderboard(trackID)
+	if err != nil {
+		return rest.InternalError(err)
+	}
+	leaderboard.Entries = entries
+	return rest.Result{}
+}
+
+// Post freezes or unfreezes the leaderboard for a track.
+// Freezing saves a snapshot of the current leaderboard, which is shown until unfrozen.
+func (freezeRequest *LeaderboardFreezeRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.BadRequest("missing track ID")
+	}
+	track := Track{ID: trackID}
+	if exists, err := track.exists(); err != nil {
+		return rest.InternalError(err)
+	} else if !exists {
+		return rest.NotFound("track not found")
+	}
+
+	// Remove any old snapshot
+	if dbResult := db.Delete("leaderboard_freezes", "track", "=", trackID); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if dbResult := db.Delete("leaderboard_entries", "track", "=", trackID); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !freezeRequest.Frozen {
+		return rest.Result{}
+	}
+
+	// Save new snapshot
+	entries, err := computeLeaderboard(trackID)
+	if err != nil {
+		return rest.InternalError(err)
+	}
+	for _, entry := range entries {
+		if dbResult := db.Insert("leaderboard_entries", entry); dbResult.IsFailed() {
+			return rest.InternalError(dbResult.Error)
+		}
+	}
+	now := time.Now()
+	freeze := leaderboardFreeze{TrackID: trackID, FreezeTime: &now}
+	if dbResult := db.Insert("leaderboard_freezes", freeze); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+
+	return rest.Result{}
+}
+
+// Get gets the score for a timeslot.
+func (score *TimeslotScore) Get(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Get timeslot
+	var timeslot Timeslot
+	timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", id)
+	if timeslotDBResult.IsFailed() {
+		return rest.InternalError(timeslotDBResult.Error)
+	}
+	if !timeslotDBResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		owned, err := timeslot.isOwnedBy(request.AccessToken.OwnerUserID)
+		if err != nil {
+			return rest.InternalError(err)
+		}
+		if !owned {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+	}
+
+	// Compute
+	scores, maxScore, err := computeTimeslotScores(timeslot.TrackID)
+	if err != nil {
+		return rest.InternalError(err)
+	}
+	score.TimeslotID = timeslot.ID
+	score.MaxScore = maxScore
+	if timeslotScore, ok := scores[timeslot.ID.String()]; ok {
+		*score = *timeslotScore
+		score.MaxScore = maxScore
+	}
+	return rest.Result{}
+}
+
+// computeTimeslotScores computes the score for all timeslots in the track with any completed tasks.
+// Also returns the max possible score for the track.
+func computeTimeslotScores(trackID string) (map[string]*TimeslotScore, int, error) {
+	// Get task points
+	var tasks Tasks
+	tasksDBResult := db.SelectMany(&tasks, "tasks", "track", "=", trackID)
+	if tasksDBResult.IsFailed() {
+		return nil, 0, tasksDBResult.Error
+	}
+	taskPoints := make(map[string]int)
+	maxScore := 0
+	for _, task := range tasks {
+		taskPoints[task.Shortname] = task.Points
+		maxScore += task.Points
+	}
+
+	// Find completed tasks per timeslot
+	rows, rowsErr := db.DB.Query("SELECT timeslot, task_shortname, BOOL_AND(status_success), MAX(timestamp) FROM tests WHERE track = $1 AND timeslot IS NOT NULL GROUP BY timeslot, task_shortname", trackID)
+	if rowsErr != nil {
+		return nil, 0, rowsErr
+	}
+	defer rows.Close()
+	scores := make(map[string]*TimeslotScore)
+	for rows.Next() {
+		var timeslotID string
+		var taskShortname string
+		var completed bool
+		var lastTimestamp time.Time
+		if err := rows.Scan(&timeslotID, &taskShortname, &completed, &lastTimestamp); err != nil {
+			return nil, 0, err
+		}
+		points, taskExists := taskPoints[taskShortname]
+		if !completed || !taskExists {
+			continue
+		}
+		parsedTimeslotID, uuidErr := uuid.Parse(timeslotID)
+		if uuidErr != nil {
+			continue
+		}
+
+		score, ok := scores[timeslotID]
+		if !ok {
+			score = &TimeslotScore{TimeslotID: &parsedTimeslotID}
+			scores[timeslotID] = score
+		}
+		score.Score += points
+		score.CompletedTasks++
+		if score.CompletionTime == nil || lastTimestamp.After(*score.CompletionTime) {
+			completionTime := lastTimestamp
+			score.CompletionTime = &completionTime
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// Subtract hint penalties
+	penalties, penaltiesErr := loadHintPenalties(trackID)
+	if penaltiesErr != nil {
+		return nil, 0, penaltiesErr
+	}
+	for timeslotID, score := range scores {
+		score.MaxScore = maxScore
+		score.HintPenalty = penalties[timeslotID]
+		score.Score -= score.HintPenalty
+		if score.Score < 0 {
+			score.Score = 0
+		}
+	}
+	return scores, maxScore, nil
+}
+
+// computeLeaderboard computes the current ranking for a track, using the best non-cancelled timeslot per user.
+func computeLeaderboard(trackID string) (LeaderboardEntries, error) {
+	scores, _, err := computeTimeslotScores(trackID)
+	if err != nil {
+		return nil, err
+	}
+
+	var timeslots Timeslots
+	timeslotsDBResult := db.SelectMany(&timeslots, "timeslots", "track", "=", trackID)
+	if timeslotsDBResult.IsFailed() {
+		return nil, timeslotsDBResult.Error
+	}
+
+	// Find best timeslot per user
+	bestPerUser := make(map[uuid.UUID]*LeaderboardEntry)
+	for _, timeslot := range timeslots {
+		if timeslot.UserID == nil || timeslot.CancelTime != nil {
+			continue
+		}
+		score, ok := scores[timeslot.ID.String()]
+		if !ok || score.Score <= 0 {
+			continue
+		}
+		entry := &LeaderboardEntry{
+			TrackID:        trackID,
+			UserID:         timeslot.UserID,
+			TimeslotID:     timeslot.ID,
+			Score:          score.Score,
+			CompletedTasks: score.CompletedTasks,
+			CompletionTime: score.CompletionTime,
+		}
+		if best, ok := bestPerUser[*timeslot.UserID]; !ok || entry.isBetterThan(best) {
+			bestPerUser[*timeslot.UserID] = entry
+		}
+	}
+
+	// Add names, rank and sort
+	entries := make(LeaderboardEntries, 0, len(bestPerUser))
+	for _, entry := range bestPerUser {
+		var user rest.User
+		userDBResult := db.Select(&user, "users", "id", "=", entry.UserID)
+		if userDBResult.IsFailed() {
+			return nil, userDBResult.Error
+		}
+		entry.DisplayName = user.DisplayName
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].isBetterThan(entries[j]) || entries[j].isBetterThan(entries[i]) {
+			return entries[i].isBetterThan(entries[j])
+		}
+		// Tied, keep it stable
+		return entries[i].UserID.String() < entries[j].UserID.String()
+	})
+	for i, entry := range entries {
+		if i > 0 && !entries[i-1].isBetterThan(entry) {
+			entry.Rank = entries[i-1].Rank
+		} else {
+			entry.Rank = i + 1
+		}
+	}
+
+	return entries, nil
+}
+
+// isBetterThan checks if the entry ranks strictly higher than the other one.
+// Higher score wins, then earlier completion time.
+func (entry *LeaderboardEntry) isBetterThan(other *LeaderboardEntry) bool {
+	if entry.Score != other.Score {
+		return entry.Score > other.Score
+	}
+	if entry.CompletionTime == nil || other.CompletionTime == nil {
+		return entry.CompletionTime != nil && other.CompletionTime == nil
+	}
+	return entry.CompletionTime.Before(*other.CompletionTime)
+}
+
+// sort sorts the entries by rank.
+func (entries LeaderboardEntries) sort() {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Rank < entries[j].Rank
+	})
+}
@@ -0,0 +1,431 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/worker"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// maintenanceWorkerTaskName is the name of the worker task flipping stations in and out of maintenance.
+const maintenanceWorkerTaskName = "station-maintenance"
+
+// maintenanceWorkerInterval is how often maintenance windows are checked.
+const maintenanceWorkerInterval = 1 * time.Minute
+
+// MaintenanceWindow is scheduled maintenance for a single station or all stations in a track.
+// Unassigned ready/available stations are set to maintenance while the window is active
+// and get their previous status back afterwards.
+type MaintenanceWindow struct {
+	ID        *uuid.UUID `column:"id" json:"id"`                 // Generated, required, unique
+	StationID *uuid.UUID `column:"station" json:"station"`       // Optional, the whole track if empty
+	TrackID   string     `column:"track" json:"track"`           // Required, set from the station if empty
+	BeginTime *time.Time `column:"begin_time" json:"begin_time"` // Required
+	EndTime   *time.Time `column:"end_time" json:"end_time"`     // Required
+	Reason    string     `column:"reason" json:"reason"`         // Optional, shown to participants
+}
+
+// MaintenanceWindows is a list of maintenance windows.
+type MaintenanceWindows []*MaintenanceWindow
+
+// maintenanceFlip is a station set to maintenance by a window, with the status to restore afterwards.
+type maintenanceFlip struct {
+	MaintenanceID  *uuid.UUID
+	StationID      *uuid.UUID
+	PreviousStatus StationStatus
+}
+
+func init() {
+	rest.AddHandler("/maintenance-windows/", "^$", func() interface{} { return &MaintenanceWindows{} })
+	rest.AddHandler("/maintenance-window/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &MaintenanceWindow{} })
+	worker.AddTask(maintenanceWorkerTaskName, maintenanceWorkerInterval, applyMaintenanceWindows)
+}
+
+// Get gets multiple maintenance windows, by begin time.
+func (windows *MaintenanceWindows) Get(request *rest.Request) rest.Result {
+	var whereArgs []interface{}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+	if stationID, ok := request.QueryArgs["station"]; ok {
+		whereArgs = append(whereArgs, "station", "=", stationID)
+	}
+	if _, ok := request.QueryArgs["upcoming"]; ok {
+		whereArgs = append(whereArgs, "end_time", ">", time.Now())
+	}
+
+	dbResult := db.SelectManyOrdered(windows, "maintenance_windows", "begin_time", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Get gets a single maintenance window.
+func (window *MaintenanceWindow) Get(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	dbResult := db.Select(window, "maintenance_windows", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+	return rest.Result{}
+}
+
+// Post creates a new maintenance window.
+func (window *MaintenanceWindow) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Make ID
+	if window.ID == nil {
+		newID := uuid.New()
+		window.ID = &newID
+	}
+
+	// Validate
+	if result := window.validate(); !result.IsOk() {
+		return result
+	}
+	if exists, err := window.exists(); err != nil {
+		return rest.InternalError(err)
+	} else if exists {
+		return rest.Conflict("duplicate")
+	}
+
+	// Create, apply and redirect
+	dbResult := db.Insert("maintenance_windows", window)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	worker.Trigger(maintenanceWorkerTaskName)
+	return rest.Created(fmt.Sprintf("%v/maintenance-window/%v/", config.Get().SitePrefix, window.ID))
+}
+
+// Put updates a maintenance window, e.g. to end it early.
+func (window *MaintenanceWindow) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.BadRequest("missing ID")
+	}
+	id, uuidErr := uuid.Parse(rawID)
+	if uuidErr != nil {
+		return rest.BadRequest("invalid ID")
+	}
+
+	// Validate
+	if window.ID == nil || *window.ID != id {
+		return rest.BadRequest("mismatch between URL and JSON IDs")
+	}
+	if result := window.validate(); !result.IsOk() {
+		return result
+	}
+	var existing MaintenanceWindow
+	existingDBResult := db.Select(&existing, "maintenance_windows", "id", "=", window.ID)
+	if existingDBResult.IsFailed() {
+		return rest.InternalError(existingDBResult.Error)
+	}
+	if existingDBResult.IsSuccess() && (existing.StationID == nil) != (window.StationID == nil) {
+		return rest.BadRequest("cannot change between station and track maintenance, create a new window instead")
+	}
+
+	// Update and apply
+	dbResult := db.Upsert("maintenance_windows", window, "id", "=", window.ID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	worker.Trigger(maintenanceWorkerTaskName)
+	return rest.Result{}
+}
+
+// Delete deletes a maintenance window. Stations it has set to maintenance get their previous status back.
+func (window *MaintenanceWindow) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	dbResult := db.Delete("maintenance_windows", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if dbResult.Affected == 0 {
+		return rest.NotFound("not found")
+	}
+	worker.Trigger(maintenanceWorkerTaskName)
+	return rest.Result{}
+}
+
+func (window *MaintenanceWindow) exists() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM maintenance_windows WHERE id = $1", window.ID)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+func (window *MaintenanceWindow) validate() rest.Result {
+	switch {
+	case window.ID == nil:
+		return rest.BadRequest("missing ID")
+	case window.StationID == nil && window.TrackID == "":
+		return rest.BadRequest("missing station or track ID")
+	case window.BeginTime == nil || window.EndTime == nil:
+		return rest.BadRequest("missing begin or end time")
+	case !window.EndTime.After(*window.BeginTime):
+		return rest.BadRequest("cannot end before it begins")
+	}
+
+	if window.StationID != nil {
+		var station Station
+		stationDBResult := db.Select(&station, "stations", "id", "=", window.StationID)
+		if stationDBResult.IsFailed() {
+			return rest.InternalError(stationDBResult.Error)
+		}
+		if !stationDBResult.IsSuccess() {
+			return rest.BadRequest("referenced station does not exist")
+		}
+		if window.TrackID != "" && window.TrackID != station.TrackID {
+			return rest.BadRequest("referenced station is not in the referenced track")
+		}
+		window.TrackID = station.TrackID
+	}
+
+	track := Track{ID: window.TrackID}
+	if exists, err := track.exists(); err != nil {
+		return rest.InternalError(err)
+	} else if !exists {
+		return rest.BadRequest("referenced track does not exist")
+	}
+	return rest.Result{}
+}
+
+// covers checks if the window applies to the station.
+func (window *MaintenanceWindow) covers(station *Station) bool {
+	if window.StationID != nil {
+		return station.ID != nil && *window.StationID == *station.ID
+	}
+	return window.TrackID == station.TrackID
+}
+
+// loadUpcomingMaintenance adds the active and future maintenance windows covering each of the stations.
+func (stations Stations) loadUpcomingMaintenance() error {
+	var windows MaintenanceWindows
+	dbResult := db.SelectManyOrdered(&windows, "maintenance_windows", "begin_time", "end_time", ">", time.Now())
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	for _, station := range stations {
+		station.UpcomingMaintenance = nil
+		for _, window := range windows {
+			if window.covers(station) {
+				station.UpcomingMaintenance = append(station.UpcomingMaintenance, window)
+			}
+		}
+	}
+	return nil
+}
+
+// withoutMaintenance returns the stations not covered by any active maintenance window,
+// so stations aren't assigned during maintenance before the worker gets to them.
+func (stations Stations) withoutMaintenance() (Stations, error) {
+	now := time.Now()
+	var windows MaintenanceWindows
+	dbResult := db.SelectMany(&windows, "maintenance_windows", "begin_time", "<=", now, "end_time", ">", now)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	var remaining Stations
+	for _, station := range stations {
+		covered := false
+		for _, window := range windows {
+			if window.covers(station) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			remaining = append(remaining, station)
+		}
+	}
+	return remaining, nil
+}
+
+// applyMaintenanceWindows sets unassigned ready/available stations covered by active windows to maintenance,
+// and restores the stations of windows which have ended (or were moved or deleted).
+// Stations which get ready again during a window (e.g. after a timeslot ends) are caught on the next run.
+func applyMaintenanceWindows() {
+	now := time.Now()
+
+	// Restore first, so overlapping windows may take over the stations
+	var flips []*maintenanceFlip
+	rows, rowsErr := db.DB.Query("SELECT maintenance_flips.maintenance, maintenance_flips.station, maintenance_flips.previous_status FROM maintenance_flips LEFT JOIN maintenance_windows ON maintenance_flips.maintenance = maintenance_windows.id WHERE maintenance_windows.id IS NULL OR maintenance_windows.begin_time > $1 OR maintenance_windows.end_time <= $1", now)
+	if rowsErr != nil {
+		log.WithError(rowsErr).Error("Failed to find ended maintenance windows")
+		return
+	}
+	for rows.Next() {
+		var flip maintenanceFlip
+		if err := rows.Scan(&flip.MaintenanceID, &flip.StationID, &flip.PreviousStatus); err != nil {
+			rows.Close()
+			log.WithError(err).Error("Failed to find ended maintenance windows")
+			return
+		}
+		flips = append(flips, &flip)
+	}
+	rows.Close()
+	for _, flip := range flips {
+		if err := flip.restore(); err != nil {
+			log.WithError(err).WithField("station", flip.StationID).Error("Failed to restore station after maintenance")
+		}
+	}
+
+	// Start active windows
+	var windows MaintenanceWindows
+	dbResult := db.SelectMany(&windows, "maintenance_windows", "begin_time", "<=", now, "end_time", ">", now)
+	if dbResult.IsFailed() {
+		log.WithError(dbResult.Error).Error("Failed to find active maintenance windows")
+		return
+	}
+	for _, window := range windows {
+		if err := window.start(); err != nil {
+			log.WithError(err).WithField("maintenance", window.ID).Error("Failed to start maintenance window")
+		}
+	}
+}
+
+// start sets the unassigned ready/available stations covered by the window to maintenance, remembering their status.
+func (window *MaintenanceWindow) start() error {
+	whereArgs := []interface{}{"track", "=", window.TrackID, "timeslot", "=", nil, "status", "IN", []string{string(StationStatusReady), string(StationStatusAvailable)}}
+	if window.StationID != nil {
+		whereArgs = append(whereArgs, "id", "=", window.StationID)
+	}
+	var stations Stations
+	dbResult := db.SelectMany(&stations, "stations", whereArgs...)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+
+	for _, station := range stations {
+		tx, txErr := db.DB.Begin()
+		if txErr != nil {
+			return txErr
+		}
+		// Only if still unassigned and not changed in the meantime
+		updateResult, updateErr := tx.Exec("UPDATE stations SET status = $1, version = version + 1, updated_at = now() WHERE id = $2 AND status = $3 AND timeslot IS NULL", StationStatusMaintenance, station.ID, station.Status)
+		if updateErr != nil {
+			tx.Rollback()
+			return updateErr
+		}
+		if affected, err := updateResult.RowsAffected(); err != nil || affected == 0 {
+			tx.Rollback()
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO maintenance_flips (maintenance, station, previous_status) VALUES ($1, $2, $3) ON CONFLICT (maintenance, station) DO UPDATE SET previous_status = EXCLUDED.previous_status",
+			window.ID, station.ID, station.Status); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		db.NotifyWrite("stations")
+		log.WithFields(log.Fields{
+			"maintenance": window.ID,
+			"station":     station.ID,
+		}).Info("Set station to maintenance")
+	}
+	return nil
+}
+
+// restore gives the station its previous status back, unless changed by someone else in the meantime.
+func (flip *maintenanceFlip) restore() error {
+	var station Station
+	stationDBResult := db.Select(&station, "stations", "id", "=", flip.StationID)
+	if stationDBResult.IsFailed() {
+		return stationDBResult.Error
+	}
+
+	tx, txErr := db.DB.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+	updateResult, updateErr := tx.Exec("UPDATE stations SET status = $1, version = version + 1, updated_at = now() WHERE id = $2 AND status = $3", flip.PreviousStatus, flip.StationID, StationStatusMaintenance)
+	if updateErr != nil {
+		return updateErr
+	}
+	if affected, err := updateResult.RowsAffected(); err != nil {
+		return err
+	} else if affected > 0 && stationDBResult.IsSuccess() {
+		station.Status = flip.PreviousStatus
+		if err := queueStationStatusChanged(tx, &station, StationStatusMaintenance); err != nil {
+			return err
+		}
+	}
+	if dbResult := db.DeleteWith(tx, "maintenance_flips", "maintenance", "=", flip.MaintenanceID, "station", "=", flip.StationID); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	db.NotifyWrite("stations")
+	log.WithFields(log.Fields{
+		"maintenance": flip.MaintenanceID,
+		"station":     flip.StationID,
+		"status":      flip.PreviousStatus,
+	}).Info("Restored station after maintenance")
+	if flip.PreviousStatus == StationStatusReady {
+		// Let the queue have it
+		worker.Trigger(queueWorkerTaskName)
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/worker"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// operatorAlert is a type of operational event operators may be alerted about.
+type operatorAlert string
+
+const (
+	operatorAlertProvisioningFailure operatorAlert = "provisioning-failure"
+	operatorAlertStationUnhealthy    operatorAlert = "station-unhealthy"
+	operatorAlertQueueLength         operatorAlert = "queue-length"
+	operatorAlertSoftLimitReached    operatorAlert = "soft-limit-reached"
+	operatorAlertAuthLockout         operatorAlert = "auth-lockout"
+)
+
+// alertWorkerTaskName is the name of the worker task checking for unhealthy stations and long queues.
+const alertWorkerTaskName = "operator-alerts"
+
+// alertWorkerInterval is how often the alert worker checks.
+const alertWorkerInterval = 1 * time.Minute
+
+// alertTimeout is the timeout for posting an alert.
+const alertTimeout = 10 * time.Second
+
+// alertState keeps track of when alerts were last sent and how long stations have been stuck.
+// It's in-memory only, so alerts may be repeated and stuck times reset after a restart.
+var alertState = struct {
+	sync.Mutex
+	lastSent    map[string]time.Time
+	stuckSince  map[uuid.UUID]time.Time
+	stuckStatus map[uuid.UUID]StationStatus
+}{
+	lastSent:    make(map[string]time.Time),
+	stuckSince:  make(map[uuid.UUID]time.Time),
+	stuckStatus: make(map[uuid.UUID]StationStatus),
+}
+
+func init() {
+	worker.AddTask(alertWorkerTaskName, alertWorkerInterval, checkOperatorAlerts)
+	rest.AddAuthLockoutListener(alertAuthLockout)
+}
+
+// alertAuthLockout alerts about clients locked out for presenting invalid access token keys, which may be brute force attempts.
+func alertAuthLockout(key string, failures int, until time.Time) {
+	alertOperators(operatorAlertAuthLockout, key, fmt.Sprintf("Locked out %v until %v after %v failed authentications (possible brute force attempt)",
+		key, until.Format(time.RFC3339), failures))
+}
+
+// alertOperators posts the message to the configured Discord/Slack webhook in the background,
+// if the alert type is enabled and the same alert (by type and key) wasn't sent within the cooldown.
+func alertOperators(alert operatorAlert, key string, message string) {
+	notifierConfig := config.Get().Notifier
+	if notifierConfig.WebhookURL == "" || !alertEnabled(notifierConfig, alert) {
+		return
+	}
+	cooldown := time.Duration(notifierConfig.CooldownMinutes) * time.Minute
+	if notifierConfig.CooldownMinutes == 0 {
+		cooldown = 15 * time.Minute
+	}
+
+	alertKey := string(alert) + "/" + key
+	now := time.Now()
+	alertState.Lock()
+	if lastSent, ok := alertState.lastSent[alertKey]; ok && now.Sub(lastSent) < cooldown {
+		alertState.Unlock()
+		return
+	}
+	alertState.lastSent[alertKey] = now
+	alertState.Unlock()
+
+	go func() {
+		if err := postOperatorAlert(notifierConfig, message); err != nil {
+			log.WithError(err).WithField("alert", alert).Warn("Failed to post operator alert")
+		}
+	}()
+}
+
+func alertEnabled(notifierConfig config.NotifierConfig, alert operatorAlert) bool {
+	switch alert {
+	case operatorAlertProvisioningFailure:
+		return notifierConfig.ProvisioningFailures
+	case operatorAlertStationUnhealthy:
+		return notifierConfig.StationsUnhealthy
+	case operatorAlertQueueLength:
+		return notifierConfig.QueueLength
+	case operatorAlertSoftLimitReached:
+		return notifierConfig.SoftLimitReached
+	case operatorAlertAuthLockout:
+		return notifierConfig.AuthLockouts
+	default:
+		return false
+	}
+}
+
+// postOperatorAlert posts the message in the Discord or Slack webhook format.
+func postOperatorAlert(notifierConfig config.NotifierConfig, message string) error {
+	format := notifierConfig.Format
+	if format == "" {
+		if strings.Contains(notifierConfig.WebhookURL, "hooks.slack.com") {
+			format = "slack"
+		} else {
+			format = "discord"
+		}
+	}
+	var payload interface{}
+	if format == "slack" {
+		payload = map[string]string{"text": message}
+	} else {
+		payload = map[string]string{"content": message}
+	}
+	body, bodyErr := json.Marshal(payload)
+	if bodyErr != nil {
+		return bodyErr
+	}
+
+	client := &http.Client{Timeout: alertTimeout}
+	response, responseErr := client.Post(notifierConfig.WebhookURL, "application/json", bytes.NewReader(body))
+	if responseErr != nil {
+		return responseErr
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("response contained non-2XX status: %v", response.Status)
+	}
+	return nil
+}
+
+// checkOperatorAlerts checks for unhealthy stations and long queues, if enabled.
+func checkOperatorAlerts() {
+	notifierConfig := config.Get().Notifier
+	if notifierConfig.WebhookURL == "" {
+		return
+	}
+	if notifierConfig.StationsUnhealthy {
+		if err := checkUnhealthyStations(notifierConfig); err != nil {
+			log.WithError(err).Error("Failed to check for unhealthy stations")
+		}
+	}
+	if notifierConfig.QueueLength {
+		if err := checkQueueLengths(notifierConfig); err != nil {
+			log.WithError(err).Error("Failed to check queue lengths")
+		}
+	}
+}
+
+// checkUnhealthyStations alerts about stations which have been dirty, provisioning or in maintenance for too long.
+// Stations set to maintenance by maintenance windows are expected to stay there and are ignored.
+func checkUnhealthyStations(notifierConfig config.NotifierConfig) error {
+	unhealthyAfter := time.Duration(notifierConfig.UnhealthyAfterMinutes) * time.Minute
+	if notifierConfig.UnhealthyAfterMinutes == 0 {
+		unhealthyAfter = 30 * time.Minute
+	}
+
+	var stations Stations
+	dbResult := db.SelectMany(&stations, "stations", "status", "IN", []string{string(StationStatusDirty), string(StationStatusProvisioning), string(StationStatusMaintenance)})
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	scheduled := make(map[uuid.UUID]bool)
+	rows, rowsErr := db.DB.Query("SELECT station FROM maintenance_flips")
+	if rowsErr != nil {
+		return rowsErr
+	}
+	for rows.Next() {
+		var stationID uuid.UUID
+		if err := rows.Scan(&stationID); err != nil {
+			rows.Close()
+			return err
+		}
+		scheduled[stationID] = true
+	}
+	rows.Close()
+
+	now := time.Now()
+	var unhealthy Stations
+	alertState.Lock()
+	stuck := make(map[uuid.UUID]bool)
+	for _, station := range stations {
+		if scheduled[*station.ID] {
+			continue
+		}
+		stuck[*station.ID] = true
+		if alertState.stuckStatus[*station.ID] != station.Status {
+			alertState.stuckStatus[*station.ID] = station.Status
+			alertState.stuckSince[*station.ID] = now
+		}
+		if now.Sub(alertState.stuckSince[*station.ID]) >= unhealthyAfter {
+			unhealthy = append(unhealthy, station)
+		}
+	}
+	for stationID := range alertState.stuckSince {
+		if !stuck[stationID] {
+			delete(alertState.stuckSince, stationID)
+			delete(alertState.stuckStatus, stationID)
+		}
+	}
+	alertState.Unlock()
+
+	for _, station := range unhealthy {
+		alertOperators(operatorAlertStationUnhealthy, station.ID.String(),
+			fmt.Sprintf("Station %v (%v) in track %v has been %v for more than %v.", station.Shortname, station.ID, station.TrackID, station.Status, unhealthyAfter))
+	}
+	return nil
+}
+
+// checkQueueLengths alerts about tracks with too many queued timeslots.
+func checkQueueLengths(notifierConfig config.NotifierConfig) error {
+	threshold := notifierConfig.QueueLengthThreshold
+	if threshold == 0 {
+		threshold = 10
+	}
+
+	rows, rowsErr := db.DB.Query("SELECT track, COUNT(*) FROM queue_entries GROUP BY track HAVING COUNT(*) >= $1", threshold)
+	if rowsErr != nil {
+		return rowsErr
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var trackID string
+		var length int
+		if err := rows.Scan(&trackID, &length); err != nil {
+			return err
+		}
+		alertOperators(operatorAlertQueueLength, trackID,
+			fmt.Sprintf("The queue for track %v has %v timeslots waiting for a station (threshold %v).", trackID, length, threshold))
+	}
+	return rows.Err()
+}
@@ -0,0 +1,320 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// provisioningCheckTimeout is the timeout for readiness checks of the station services.
+const provisioningCheckTimeout = 3 * time.Second
+
+// defaultProvisionAttempts is the number of attempts to create a VM, if not configured for the track.
+const defaultProvisionAttempts = 3
+
+// provisionInitialBackoff is the delay before the second attempt to create a VM, doubled for every following attempt.
+const provisionInitialBackoff = 1 * time.Second
+
+// provisionMaxBackoff caps the delay between attempts.
+const provisionMaxBackoff = 10 * time.Second
+
+// StationRetryProvisioningRequest is for retrying provisioning of a failed station.
+type StationRetryProvisioningRequest struct{}
+
+// serverStationError is a failed attempt to create a VM.
+type serverStationError struct {
+	err       error
+	retryable bool // Transient errors, like network errors and 5XX responses
+}
+
+func (err *serverStationError) Error() string {
+	return err.err.Error()
+}
+
+func init() {
+	rest.AddIdempotentHandler("/station/", "^(?P<id>[^/]+)/retry-provisioning/$", func() interface{} { return &StationRetryProvisioningRequest{} })
+	rest.AddReadinessCheck("provisioning", checkProvisioningBackends)
+}
+
+// checkProvisioningBackends checks that the station services for all configured server tracks respond.
+// Any HTTP response counts, since the services have no dedicated health endpoint.
+func checkProvisioningBackends() error {
+	var unreachable []string
+	client := &http.Client{Timeout: provisioningCheckTimeout}
+	for trackID, trackConfig := range config.Get().ServerTracks {
+		if trackConfig.BaseURL == "" {
+			continue
+		}
+		response, err := client.Get(trackConfig.BaseURL)
+		if err != nil {
+			unreachable = append(unreachable, fmt.Sprintf("%v (%v)", trackID, err))
+			continue
+		}
+		response.Body.Close()
+	}
+	if len(unreachable) > 0 {
+		return fmt.Errorf("unreachable station services for tracks: %v", strings.Join(unreachable, ", "))
+	}
+	return nil
+}
+
+// Post retries provisioning of a failed station, keeping its ID.
+func (retryRequest *StationRetryProvisioningRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Get station
+	var station Station
+	stationDBResult := db.Select(&station, "stations", "id", "=", id)
+	if stationDBResult.IsFailed() {
+		return rest.InternalError(stationDBResult.Error)
+	}
+	if !stationDBResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+	if result := checkTrackOperator(request.AccessToken, station.TrackID); !result.IsOk() {
+		return result
+	}
+	if station.Status != StationStatusFailed {
+		return rest.Conflict("station has not failed provisioning")
+	}
+	trackConfig, trackConfigOk := config.Get().ServerTracks[station.TrackID]
+	if !trackConfigOk || trackConfig.BaseURL == "" {
+		return rest.BadRequest("track is not configured for dynamic stations")
+	}
+	if result := checkServerStationLimit(station.TrackID, trackConfig); !result.IsOk() {
+		return result
+	}
+
+	// Call station service
+	responseData, serviceErr := requestServerStation(trackConfig)
+	if serviceErr != nil {
+		return station.saveProvisioningFailure(station.TrackID, serviceErr)
+	}
+
+	// Update station
+	previousNotes := station.Notes
+	station.applyServerStation(station.TrackID, responseData)
+	if result := station.validate(); !result.IsOk() {
+		return result
+	}
+	if result := station.createOrUpdate(); !result.IsOk() {
+		return result
+	}
+	if err := station.recordNotesChange(previousNotes, nil); err != nil {
+		return rest.InternalError(err)
+	}
+	if err := queueStationStatusChanged(db.DB, &station, StationStatusFailed); err != nil {
+		return rest.InternalError(err)
+	}
+	request.Log.WithField("station", station.ID).Info("Retried provisioning of failed station")
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/station/%v/", config.Get().SitePrefix, station.ID)}
+}
+
+// checkServerStationLimit checks that another VM may be created for the track, excluding terminated and failed stations.
+func checkServerStationLimit(trackID string, trackConfig config.ServerTrackConfig) rest.Result {
+	maxStations := trackConfig.MaxInstancesHard
+	if maxStations <= 0 {
+		return rest.Result{}
+	}
+	currentRow := db.DB.QueryRow("SELECT COUNT(*) FROM stations WHERE track = $1 AND status != $2 AND status != $3", trackID, StationStatusTerminated, StationStatusFailed)
+	var count int
+	currentRowErr := currentRow.Scan(&count)
+	if currentRowErr != nil {
+		return rest.InternalError(currentRowErr)
+	}
+	if count+1 > maxStations {
+		return rest.BadRequest("Too many active stations for dynamic track")
+	}
+	return rest.Result{}
+}
+
+// requestServerStation asks the station service to create a VM,
+// retrying transient failures with exponential backoff.
+func requestServerStation(trackConfig config.ServerTrackConfig) (serverCreateStationResponse, error) {
+	attempts := trackConfig.ProvisionAttempts
+	if attempts <= 0 {
+		attempts = defaultProvisionAttempts
+	}
+	backoff := provisionInitialBackoff
+	for attempt := 1; ; attempt++ {
+		responseData, err := createServerStation(trackConfig)
+		if err == nil {
+			return responseData, nil
+		}
+		if !err.retryable || attempt >= attempts {
+			return responseData, fmt.Errorf("attempt %v of %v: %v", attempt, attempts, err)
+		}
+		log.WithError(err).Warnf("Failed to create VM (attempt %v of %v), retrying in %v", attempt, attempts, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > provisionMaxBackoff {
+			backoff = provisionMaxBackoff
+		}
+	}
+}
+
+// createServerStation makes a single attempt to create a VM.
+func createServerStation(trackConfig config.ServerTrackConfig) (serverCreateStationResponse, *serverStationError) {
+	var responseData serverCreateStationResponse
+	serviceURL := trackConfig.BaseURL + "/api/entry/new"
+	serviceRequestData := serverCreateStationRequest{
+		Username: "tech",
+		UID:      "techo",
+		TaskType: trackConfig.TaskType,
+	}
+	requestJSON, requestJSONError := json.Marshal(serviceRequestData)
+	if requestJSONError != nil {
+		return responseData, &serverStationError{err: requestJSONError}
+	}
+	serviceRequest, serviceRequestErr := http.NewRequest("POST", serviceURL, bytes.NewBuffer(requestJSON))
+	if serviceRequestErr != nil {
+		return responseData, &serverStationError{err: serviceRequestErr}
+	}
+	serviceRequest.SetBasicAuth(trackConfig.AuthUsername, trackConfig.AuthPassword)
+	serviceRequest.Header.Set("Content-Type", "application/json")
+	serviceClient := &http.Client{}
+	serviceResponse, serviceResponseErr := serviceClient.Do(serviceRequest)
+	if serviceResponseErr != nil {
+		return responseData, &serverStationError{err: serviceResponseErr, retryable: true}
+	}
+	defer serviceResponse.Body.Close()
+	if serviceResponse.StatusCode < 200 || serviceResponse.StatusCode > 299 {
+		retryable := serviceResponse.StatusCode >= 500 || serviceResponse.StatusCode == http.StatusTooManyRequests
+		return responseData, &serverStationError{err: fmt.Errorf("response contained non-2XX status: %v", serviceResponse.Status), retryable: retryable}
+	}
+	serviceResponseBody, serviceResponseBodyErr := ioutil.ReadAll(serviceResponse.Body)
+	if serviceResponseBodyErr != nil {
+		return responseData, &serverStationError{err: serviceResponseBodyErr, retryable: true}
+	}
+	if err := json.Unmarshal(serviceResponseBody, &responseData); err != nil {
+		return responseData, &serverStationError{err: err}
+	}
+	log.Tracef("VM service created new instance: %v", responseData.ID)
+	return responseData, nil
+}
+
+// applyServerStation fills in the station from the created VM.
+func (station *Station) applyServerStation(trackID string, responseData serverCreateStationResponse) {
+	station.TrackID = trackID
+	station.Shortname = strconv.Itoa(responseData.ID)
+	station.Name = fmt.Sprintf("Station #%v", responseData.ID)
+	if station.DefaultStatus == StationStatusInvalid {
+		station.DefaultStatus = DefaultDefaultStationStatus
+	}
+	station.Status = StationStatusMaintenance
+	station.FailureReason = ""
+	provisionTime := time.Now()
+	station.ProvisionTime = &provisionTime
+	station.Credentials = responseData.credentials()
+	station.ConsoleAddress = net.JoinHostPort(responseData.IPv4Address, strconv.Itoa(responseData.SSHPort))
+	// Markdown
+	station.Notes = fmt.Sprintf("**FQDN**: %v\n\n**Zone**: %v\n\n**VLAN ID**: %v\n\n**VLAN Address (IPv4)**: %v\n\nNote that the station may take a few minutes to start before you can connect.",
+		responseData.FQDN, responseData.Zone, responseData.VLANID, responseData.VLANIPv4Address)
+}
+
+// saveProvisioningFailure saves the station as failed with the reason, creating it if new.
+func (station *Station) saveProvisioningFailure(trackID string, cause error) rest.Result {
+	if station.ID == nil {
+		newID := uuid.New()
+		station.ID = &newID
+		station.TrackID = trackID
+		station.Shortname = "failed-" + newID.String()[:8]
+		station.Name = "Failed station"
+		station.DefaultStatus = DefaultDefaultStationStatus
+	}
+	station.Status = StationStatusFailed
+	station.FailureReason = cause.Error()
+	log.WithError(cause).WithField("station", station.ID).Warn("Failed to provision station")
+	alertOperators(operatorAlertProvisioningFailure, station.ID.String(),
+		fmt.Sprintf("Failed to provision station %v in track %v: %v", station.ID, trackID, cause))
+	if result := station.createOrUpdate(); !result.IsOk() {
+		return result
+	}
+	return rest.Result{Code: 502, Message: fmt.Sprintf("failed to provision station (%v), an operator may retry it", cause)}
+}
+
+// deliverServerTrackEvent posts a queued event to the provisioning service of the server track,
+// e.g. so it can snapshot the VM for grading when all tests pass.
+func deliverServerTrackEvent(delivery *WebhookDelivery) error {
+	trackConfig, ok := config.Get().ServerTracks[delivery.TrackID]
+	if !ok || trackConfig.TestsPassedURL == "" {
+		return fmt.Errorf("no tests passed URL configured for track %v", delivery.TrackID)
+	}
+	var payload struct {
+		Data webhookStationTestsData `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(delivery.Payload), &payload); err != nil {
+		return err
+	}
+	stationID := ""
+	if payload.Data.ID != nil {
+		stationID = payload.Data.ID.String()
+	}
+	serviceURL := strings.NewReplacer(
+		"{station}", url.PathEscape(stationID),
+		"{shortname}", url.PathEscape(payload.Data.Shortname),
+		"{track}", url.PathEscape(payload.Data.TrackID),
+		"{timeslot}", url.PathEscape(payload.Data.TimeslotID.String),
+	).Replace(trackConfig.TestsPassedURL)
+
+	serviceRequest, serviceRequestErr := http.NewRequest("POST", serviceURL, strings.NewReader(delivery.Payload))
+	if serviceRequestErr != nil {
+		return serviceRequestErr
+	}
+	serviceRequest.SetBasicAuth(trackConfig.AuthUsername, trackConfig.AuthPassword)
+	serviceRequest.Header.Set("Content-Type", "application/json")
+	serviceRequest.Header.Set("X-Techo-Event", string(delivery.Event))
+	serviceRequest.Header.Set("X-Techo-Delivery", delivery.ID.String())
+	serviceClient := &http.Client{Timeout: webhookTimeout}
+	serviceResponse, serviceResponseErr := serviceClient.Do(serviceRequest)
+	if serviceResponseErr != nil {
+		return serviceResponseErr
+	}
+	defer serviceResponse.Body.Close()
+	if serviceResponse.StatusCode < 200 || serviceResponse.StatusCode > 299 {
+		return fmt.Errorf("response contained non-2XX status: %v", serviceResponse.Status)
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/worker"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// queueWorkerTaskName is the name of the worker task assigning stations to queued timeslots.
+const queueWorkerTaskName = "track-queue"
+
+// queueWorkerInterval is how often the queue worker checks for ready stations, if not triggered earlier.
+const queueWorkerInterval = 10 * time.Second
+
+// QueueEntry is a timeslot waiting for a ready station in a track.
+type QueueEntry struct {
+	ID         *uuid.UUID `column:"id" json:"id"`               // Generated, required, unique
+	TrackID    string     `column:"track" json:"track"`         // Required
+	TimeslotID *uuid.UUID `column:"timeslot" json:"timeslot"`   // Required, unique
+	JoinTime   *time.Time `column:"join_time" json:"join_time"` // Generated
+	Position   int        `column:"-" json:"position"`          // Generated, 1-indexed
+}
+
+// QueueEntries is a list of queue entries, ordered by position.
+type QueueEntries []*QueueEntry
+
+func init() {
+	rest.AddHandler("/track/", "^(?P<track_id>[^/]+)/queue/$", func() interface{} { return &QueueEntries{} })
+	rest.AddHandler("/track/", "^(?P<track_id>[^/]+)/queue/(?:(?P<timeslot_id>[^/]+)/)?$", func() interface{} { return &QueueEntry{} })
+	worker.AddTask(queueWorkerTaskName, queueWorkerInterval, assignQueuedTimeslots)
+}
+
+// Get gets the queue for a track.
+// Non-operators only see the entries for their own timeslots, but with the positions in the full queue.
+func (entries *QueueEntries) Get(request *rest.Request) rest.Result {
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.BadRequest("missing track ID")
+	}
+	if result := checkTrackVisible(request, trackID); !result.IsOk() {
+		return result
+	}
+
+	queue, queueErr := loadTrackQueue(trackID)
+	if queueErr != nil {
+		return rest.InternalError(queueErr)
+	}
+
+	if request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin {
+		*entries = queue
+		return rest.Result{}
+	}
+
+	*entries = make(QueueEntries, 0)
+	if request.AccessToken.OwnerUserID == nil {
+		return rest.Result{}
+	}
+	for _, entry := range queue {
+		timeslot := Timeslot{ID: entry.TimeslotID}
+		owned, err := timeslot.isOwnedByID(request.AccessToken.OwnerUserID)
+		if err != nil {
+			return rest.InternalError(err)
+		}
+		if owned {
+			*entries = append(*entries, entry)
+		}
+	}
+	return rest.Result{}
+}
+
+// Post adds a timeslot to the queue for a track.
+// The timeslot gets a station assigned automatically once one becomes ready.
+func (entry *QueueEntry) Post(request *rest.Request) rest.Result {
+	// Check params
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.BadRequest("missing track ID")
+	}
+	if entry.TimeslotID == nil {
+		return rest.BadRequest("missing timeslot ID")
+	}
+
+	// Get timeslot
+	var timeslot Timeslot
+	timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", entry.TimeslotID)
+	if timeslotDBResult.IsFailed() {
+		return rest.InternalError(timeslotDBResult.Error)
+	}
+	if !timeslotDBResult.IsSuccess() {
+		return rest.BadRequest("referenced timeslot does not exist")
+	}
+
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		owned, err := timeslot.isOwnedBy(request.AccessToken.OwnerUserID)
+		if err != nil {
+			return rest.InternalError(err)
+		}
+		if !owned {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+	}
+
+	// Validate
+	if timeslot.TrackID != trackID {
+		return rest.BadRequest("timeslot does not belong to this track")
+	}
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		var track Track
+		trackDBResult := db.Select(&track, "tracks", "id", "=", trackID)
+		if trackDBResult.IsFailed() {
+			return rest.InternalError(trackDBResult.Error)
+		}
+		if result := track.checkParticipationAllowed(); !result.IsOk() {
+			return result
+		}
+	}
+	if !timeslot.isQueueable() {
+		return rest.Conflict("timeslot is pending, cancelled or ended")
+	}
+	stationExistsDBResult := db.Exists("stations", "timeslot", "=", timeslot.ID.String())
+	if stationExistsDBResult.IsFailed() {
+		return rest.InternalError(stationExistsDBResult.Error)
+	}
+	if stationExistsDBResult.IsSuccess() {
+		return rest.Conflict("timeslot already has a station")
+	}
+	queuedDBResult := db.Exists("queue_entries", "timeslot", "=", timeslot.ID)
+	if queuedDBResult.IsFailed() {
+		return rest.InternalError(queuedDBResult.Error)
+	}
+	if queuedDBResult.IsSuccess() {
+		return rest.Conflict("timeslot is already queued")
+	}
+
+	// Add it
+	newID := uuid.New()
+	now := time.Now()
+	entry.ID = &newID
+	entry.TrackID = trackID
+	entry.JoinTime = &now
+	dbResult := db.Insert("queue_entries", entry)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+
+	// Find position
+	queue, queueErr := loadTrackQueue(trackID)
+	if queueErr != nil {
+		return rest.InternalError(queueErr)
+	}
+	for _, queuedEntry := range queue {
+		if *queuedEntry.ID == *entry.ID {
+			entry.Position = queuedEntry.Position
+		}
+	}
+
+	// A station might already be ready
+	worker.Trigger(queueWorkerTaskName)
+
+	return rest.Result{Code: 201}
+}
+
+// Delete removes a timeslot from the queue for a track.
+func (entry *QueueEntry) Delete(request *rest.Request) rest.Result {
+	// Check params
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.BadRequest("missing track ID")
+	}
+	timeslotID, timeslotIDExists := request.PathArgs["timeslot_id"]
+	if !timeslotIDExists || timeslotID == "" {
+		return rest.BadRequest("missing timeslot ID")
+	}
+
+	// Get entry
+	dbResult := db.Select(entry, "queue_entries", "track", "=", trackID, "timeslot", "=", timeslotID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		timeslot := Timeslot{ID: entry.TimeslotID}
+		owned, err := timeslot.isOwnedByID(request.AccessToken.OwnerUserID)
+		if err != nil {
+			return rest.InternalError(err)
+		}
+		if !owned {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+	}
+
+	// Delete it
+	deleteDBResult := db.Delete("queue_entries", "id", "=", entry.ID)
+	if deleteDBResult.IsFailed() {
+		return rest.InternalError(deleteDBResult.Error)
+	}
+	return rest.Result{}
+}
+
+// loadTrackQueue loads all queue entries for a track, ordered by join time and with positions set.
+func loadTrackQueue(trackID string) (QueueEntries, error) {
+	var entries QueueEntries
+	dbResult := db.SelectMany(&entries, "queue_entries", "track", "=", trackID)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].JoinTime.Before(*entries[j].JoinTime)
+	})
+	for i, entry := range entries {
+		entry.Position = i + 1
+	}
+	return entries, nil
+}
+
+// removeFromQueue removes the timeslot from any queue it's in.
+func removeFromQueue(timeslotID *uuid.UUID) error {
+	dbResult := db.Delete("queue_entries", "timeslot", "=", timeslotID)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	return nil
+}
+
+// isQueueable checks if the timeslot may wait for a station, i.e. it's approved and neither cancelled nor ended.
+func (timeslot *Timeslot) isQueueable() bool {
+	if timeslot.CancelTime != nil || timeslot.Status == TimeslotStatusPending {
+		return false
+	}
+	return timeslot.EndTime == nil || timeslot.EndTime.After(time.Now())
+}
+
+// isOwnedByID is like isOwnedBy, but loads the timeslot first using its ID.
+func (timeslot *Timeslot) isOwnedByID(userID *uuid.UUID) (bool, error) {
+	dbResult := db.Select(timeslot, "timeslots", "id", "=", timeslot.ID)
+	if dbResult.IsFailed() {
+		return false, dbResult.Error
+	}
+	if !dbResult.IsSuccess() {
+		return false, nil
+	}
+	return timeslot.isOwnedBy(userID)
+}
+
+// assignQueuedTimeslots binds ready stations to queued timeslots, first come first served.
+// Stale entries (cancelled/ended timeslots or timeslots which got a station some other way) are dropped.
+func assignQueuedTimeslots() {
+	rows, rowsErr := db.DB.Query("SELECT DISTINCT track FROM queue_entries")
+	if rowsErr != nil {
+		log.WithError(rowsErr).Error("Failed to find tracks with queued timeslots")
+		return
+	}
+	var trackIDs []string
+	for rows.Next() {
+		var trackID string
+		if err := rows.Scan(&trackID); err != nil {
+			rows.Close()
+			log.WithError(err).Error("Failed to find tracks with queued timeslots")
+			return
+		}
+		trackIDs = append(trackIDs, trackID)
+	}
+	rows.Close()
+
+	for _, trackID := range trackIDs {
+		if err := assignQueuedTimeslotsForTrack(trackID); err != nil {
+			log.WithError(err).WithField("track", trackID).Error("Failed to assign stations to queued timeslots")
+		}
+	}
+}
+
+func assignQueuedTimeslotsForTrack(trackID string) error {
+	queue, queueErr := loadTrackQueue(trackID)
+	if queueErr != nil {
+		return queueErr
+	}
+
+	// Find ready stations
+	var unboundStations Stations
+	stationsDBResult := db.SelectMany(&unboundStations, "stations",
+		"track", "=", trackID,
+		"timeslot", "=", nil,
+	)
+	if stationsDBResult.IsFailed() {
+		return stationsDBResult.Error
+	}
+	unboundStations, maintenanceErr := unboundStations.withoutMaintenance()
+	if maintenanceErr != nil {
+		return maintenanceErr
+	}
+	var readyStations Stations
+	for _, station := range unboundStations {
+		if station.Status == StationStatusReady {
+			readyStations = append(readyStations, station)
+		}
+	}
+
+	for _, entry := range queue {
+		if len(readyStations) == 0 {
+			break
+		}
+
+		// Check if still waiting
+		var timeslot Timeslot
+		timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", entry.TimeslotID)
+		if timeslotDBResult.IsFailed() {
+			return timeslotDBResult.Error
+		}
+		stationExistsDBResult := db.Exists("stations", "timeslot", "=", entry.TimeslotID.String())
+		if stationExistsDBResult.IsFailed() {
+			return stationExistsDBResult.Error
+		}
+		if !timeslotDBResult.IsSuccess() || !timeslot.isQueueable() || stationExistsDBResult.IsSuccess() {
+			if err := removeFromQueue(entry.TimeslotID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Let it wait while the user is busy on another track, if overlaps are checked
+		if config.Get().TimeslotOverlapCheck {
+			now := time.Now()
+			if other, err := timeslot.findOverlappingTimeslot(db.DB, now, now); err != nil {
+				return err
+			} else if other != nil {
+				continue
+			}
+		}
+
+		// Bind the first station still unbound
+		for len(readyStations) > 0 {
+			station := readyStations[0]
+			readyStations = readyStations[1:]
+			bound, bindErr := timeslot.bindStation(station)
+			if bindErr != nil {
+				return bindErr
+			}
+			if bound {
+				log.WithFields(log.Fields{
+					"track":    trackID,
+					"timeslot": timeslot.ID,
+					"station":  station.ID,
+				}).Info("Assigned station to queued timeslot")
+				if err := removeFromQueue(entry.TimeslotID); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,514 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// SlotTemplate defines one or more back-to-back bookable slots for a track.
+// Slot i begins at BeginTime + i * Duration, for i in [0, Repetitions).
+type SlotTemplate struct {
+	ID              *uuid.UUID `column:"id" json:"id"`                             // Generated, required, unique
+	TrackID         string     `column:"track" json:"track"`                       // Required
+	BeginTime       *time.Time `column:"begin_time" json:"begin_time"`             // Required, begin time of the first slot
+	DurationMinutes int        `column:"duration_minutes" json:"duration_minutes"` // Required, positive
+	Repetitions     int        `column:"repetitions" json:"repetitions"`           // Required, at least 1
+	Capacity        int        `column:"capacity" json:"capacity"`                 // Required, max number of timeslots per slot, at least 1
+}
+
+// SlotTemplates is a list of slot templates.
+type SlotTemplates []*SlotTemplate
+
+// TrackSlot is a concrete bookable slot generated from a slot template.
+type TrackSlot struct {
+	TemplateID *uuid.UUID `json:"template"`
+	TrackID    string     `json:"track"`
+	BeginTime  time.Time  `json:"begin_time"`
+	EndTime    time.Time  `json:"end_time"`
+	Capacity   int        `json:"capacity"`
+	Booked     int        `json:"booked"`
+	Available  int        `json:"available"`
+}
+
+// TrackSlots is a list of concrete bookable slots for a track.
+type TrackSlots []*TrackSlot
+
+// TrackSlotBooking is a request to book a concrete slot.
+// The user's current unstarted timeslot for the track is moved to the slot, or a new timeslot is created if none.
+type TrackSlotBooking struct {
+	TemplateID *uuid.UUID `json:"template"`   // Required
+	BeginTime  *time.Time `json:"begin_time"` // Required, must match one of the template slots
+	UserID     *uuid.UUID `json:"user"`       // Optional, defaults to self, only operators/admins may book for others
+	TimeslotID *uuid.UUID `json:"timeslot"`   // Output, the booked timeslot
+}
+
+func init() {
+	rest.AddHandler("/slot-templates/", "^$", func() interface{} { return &SlotTemplates{} })
+	rest.AddHandler("/slot-template/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &SlotTemplate{} })
+	rest.AddHandler("/track/", "^(?P<track_id>[^/]+)/slots/$", func() interface{} { return &TrackSlots{} })
+	rest.AddHandler("/track/", "^(?P<track_id>[^/]+)/slots/$", func() interface{} { return &TrackSlotBooking{} })
+}
+
+// Get gets multiple slot templates.
+func (templates *SlotTemplates) Get(request *rest.Request) rest.Result {
+	var whereArgs []interface{}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+
+	dbResult := db.SelectMany(templates, "slot_templates", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Get gets a single slot template.
+func (template *SlotTemplate) Get(request *rest.Request) rest.Result {
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	dbResult := db.Select(template, "slot_templates", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+	return rest.Result{}
+}
+
+// Post creates a new slot template.
+func (template *SlotTemplate) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Prepare and validate
+	if template.ID == nil {
+		newID := uuid.New()
+		template.ID = &newID
+	}
+	if result := template.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Create and redirect
+	result := template.create()
+	if !result.IsOk() {
+		return result
+	}
+	result.Code = 201
+	result.Location = fmt.Sprintf("%v/slot-template/%v/", config.Get().SitePrefix, template.ID)
+	return result
+}
+
+// Put updates a slot template.
+func (template *SlotTemplate) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Validate
+	if template.ID == nil || (*template.ID).String() != id {
+		return rest.BadRequest("mismatch between URL and JSON IDs")
+	}
+	if result := template.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Create or update
+	return template.createOrUpdate()
+}
+
+// Delete deletes a slot template.
+func (template *SlotTemplate) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.BadRequest("missing ID")
+	}
+	id, uuidErr := uuid.Parse(rawID)
+	if uuidErr != nil {
+		return rest.BadRequest("invalid ID")
+	}
+
+	// Check if it exists
+	template.ID = &id
+	exists, err := template.exists()
+	if err != nil {
+		return rest.InternalError(err)
+	}
+	if !exists {
+		return rest.NotFound("not found")
+	}
+
+	// Check if in use
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM timeslots WHERE slot_template = $1 AND cancel_time IS NULL", template.ID)
+	if err := row.Scan(&count); err != nil {
+		return rest.InternalError(err)
+	}
+	if count > 0 {
+		return rest.Conflict("slot template has booked timeslots")
+	}
+
+	// Delete it
+	dbResult := db.Delete("slot_templates", "id", "=", template.ID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+func (template *SlotTemplate) create() rest.Result {
+	if exists, err := template.exists(); err != nil {
+		return rest.InternalError(err)
+	} else if exists {
+		return rest.Conflict("duplicate")
+	}
+
+	dbResult := db.Insert("slot_templates", template)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+func (template *SlotTemplate) createOrUpdate() rest.Result {
+	exists, existsErr := template.exists()
+	if existsErr != nil {
+		return rest.InternalError(existsErr)
+	}
+
+	var dbResult db.Result
+	if exists {
+		dbResult = db.Update("slot_templates", template, "id", "=", template.ID)
+	} else {
+		dbResult = db.Insert("slot_templates", template)
+	}
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+func (template *SlotTemplate) exists() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM slot_templates WHERE id = $1", template.ID)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+func (template *SlotTemplate) validate() rest.Result {
+	switch {
+	case template.ID == nil:
+		return rest.BadRequest("missing ID")
+	case template.TrackID == "":
+		return rest.BadRequest("missing track ID")
+	case template.BeginTime == nil:
+		return rest.BadRequest("missing begin time")
+	case template.DurationMinutes <= 0:
+		return rest.BadRequest("duration must be positive")
+	case template.Repetitions < 1:
+		return rest.BadRequest("repetitions must be at least 1")
+	case template.Capacity < 1:
+		return rest.BadRequest("capacity must be at least 1")
+	}
+
+	track := Track{ID: template.TrackID}
+	if exists, err := track.exists(); err != nil {
+		return rest.InternalError(err)
+	} else if !exists {
+		return rest.BadRequest("referenced track does not exist")
+	}
+
+	return rest.Result{}
+}
+
+// duration returns the duration of each slot.
+func (template *SlotTemplate) duration() time.Duration {
+	return time.Duration(template.DurationMinutes) * time.Minute
+}
+
+// slotBeginTimes returns the begin times of all slots for the template.
+func (template *SlotTemplate) slotBeginTimes() []time.Time {
+	beginTimes := make([]time.Time, 0, template.Repetitions)
+	for i := 0; i < template.Repetitions; i++ {
+		beginTimes = append(beginTimes, template.BeginTime.Add(time.Duration(i)*template.duration()))
+	}
+	return beginTimes
+}
+
+// hasSlotBeginningAt checks if one of the template slots begins at the specified time.
+func (template *SlotTemplate) hasSlotBeginningAt(beginTime time.Time) bool {
+	for _, slotBeginTime := range template.slotBeginTimes() {
+		if slotBeginTime.Equal(beginTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get gets all concrete slots for a track, with the number of booked timeslots.
+// Use "?upcoming" to hide slots which have ended.
+func (slots *TrackSlots) Get(request *rest.Request) rest.Result {
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.BadRequest("missing track ID")
+	}
+	_, upcomingOnly := request.QueryArgs["upcoming"]
+	if result := checkTrackVisible(request, trackID); !result.IsOk() {
+		return result
+	}
+
+	// Get templates
+	var templates SlotTemplates
+	dbResult := db.SelectMany(&templates, "slot_templates", "track", "=", trackID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+
+	// Count bookings for all slots
+	bookedCounts := make(map[string]int)
+	rows, rowsErr := db.DB.Query("SELECT slot_template, begin_time, COUNT(*) FROM timeslots WHERE track = $1 AND slot_template IS NOT NULL AND cancel_time IS NULL GROUP BY slot_template, begin_time", trackID)
+	if rowsErr != nil {
+		return rest.InternalError(rowsErr)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var templateID string
+		var beginTime time.Time
+		var count int
+		if err := rows.Scan(&templateID, &beginTime, &count); err != nil {
+			return rest.InternalError(err)
+		}
+		bookedCounts[slotKey(templateID, beginTime)] = count
+	}
+
+	// Build slots
+	now := time.Now()
+	*slots = make(TrackSlots, 0)
+	for _, template := range templates {
+		for _, beginTime := range template.slotBeginTimes() {
+			endTime := beginTime.Add(template.duration())
+			if upcomingOnly && endTime.Before(now) {
+				continue
+			}
+			booked := bookedCounts[slotKey(template.ID.String(), beginTime)]
+			available := template.Capacity - booked
+			if available < 0 {
+				available = 0
+			}
+			*slots = append(*slots, &TrackSlot{
+				TemplateID: template.ID,
+				TrackID:    template.TrackID,
+				BeginTime:  beginTime,
+				EndTime:    endTime,
+				Capacity:   template.Capacity,
+				Booked:     booked,
+				Available:  available,
+			})
+		}
+	}
+	sort.SliceStable(*slots, func(i, j int) bool {
+		return (*slots)[i].BeginTime.Before((*slots)[j].BeginTime)
+	})
+
+	return rest.Result{}
+}
+
+// Post books a concrete slot.
+// The booking is done in a transaction which locks the template, so the capacity can't be exceeded by concurrent bookings.
+func (booking *TrackSlotBooking) Post(request *rest.Request) rest.Result {
+	// Check params
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.BadRequest("missing track ID")
+	}
+	if booking.TemplateID == nil {
+		return rest.BadRequest("missing template ID")
+	}
+	if booking.BeginTime == nil {
+		return rest.BadRequest("missing begin time")
+	}
+
+	// Check perms and find user
+	isOperator := request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin
+	if booking.UserID == nil {
+		booking.UserID = request.AccessToken.OwnerUserID
+	}
+	if booking.UserID == nil {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+	if !isOperator && *booking.UserID != *request.AccessToken.OwnerUserID {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+	user := rest.User{ID: booking.UserID}
+	if exists, err := user.ExistsWithID(); err != nil {
+		return rest.InternalError(err)
+	} else if !exists {
+		return rest.BadRequest("referenced user does not exist")
+	}
+
+	// Get template and check slot
+	var template SlotTemplate
+	dbResult := db.Select(&template, "slot_templates", "id", "=", booking.TemplateID, "track", "=", trackID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("slot template not found for track")
+	}
+	if !template.hasSlotBeginningAt(*booking.BeginTime) {
+		return rest.BadRequest("begin time does not match any slot for the template")
+	}
+	beginTime := *booking.BeginTime
+	endTime := beginTime.Add(template.duration())
+	if !isOperator && !beginTime.After(time.Now()) {
+		return rest.BadRequest("slot has already begun")
+	}
+	var track Track
+	trackDBResult := db.Select(&track, "tracks", "id", "=", trackID)
+	if trackDBResult.IsFailed() {
+		return rest.InternalError(trackDBResult.Error)
+	}
+	if !isOperator {
+		if result := track.checkParticipationAllowed(); !result.IsOk() {
+			return result
+		}
+	}
+
+	// Book it
+	tx, txErr := db.DB.Begin()
+	if txErr != nil {
+		return rest.InternalError(txErr)
+	}
+	defer tx.Rollback()
+
+	// Lock the template to serialize bookings for it
+	if _, err := tx.Exec("SELECT id FROM slot_templates WHERE id = $1 FOR UPDATE", template.ID); err != nil {
+		return rest.InternalError(err)
+	}
+
+	// Check capacity
+	var bookedCount int
+	bookedRow := tx.QueryRow("SELECT COUNT(*) FROM timeslots WHERE slot_template = $1 AND begin_time = $2 AND cancel_time IS NULL AND \"user\" != $3",
+		template.ID, beginTime, booking.UserID)
+	if err := bookedRow.Scan(&bookedCount); err != nil {
+		return rest.InternalError(err)
+	}
+	if bookedCount >= template.Capacity {
+		return rest.Conflict("slot is fully booked")
+	}
+
+	// Find the user's current unfinished timeslot for the track, if any
+	now := time.Now()
+	var existingID string
+	existingRow := tx.QueryRow("SELECT id FROM timeslots WHERE track = $1 AND \"user\" = $2 AND cancel_time IS NULL AND (end_time IS NULL OR end_time >= $3) LIMIT 1",
+		trackID, booking.UserID, now)
+	existingErr := existingRow.Scan(&existingID)
+	if existingErr != nil && existingErr != sql.ErrNoRows {
+		return rest.InternalError(existingErr)
+	}
+
+	if existingErr == sql.ErrNoRows {
+		// Create new timeslot, pending if registered by a participant for a track requiring approval
+		status := TimeslotStatusApproved
+		if !isOperator {
+			if result := track.checkRegistrationAllowed(); !result.IsOk() {
+				return result
+			}
+			if track.RegistrationApproval {
+				status = TimeslotStatusPending
+			}
+		}
+		newID := uuid.New()
+		booking.TimeslotID = &newID
+		_, err := tx.Exec("INSERT INTO timeslots (id, \"user\", track, begin_time, end_time, notes, slot_template, status) VALUES ($1, $2, $3, $4, $5, '', $6, $7)",
+			newID, booking.UserID, trackID, beginTime, endTime, template.ID, status)
+		if err != nil {
+			return rest.InternalError(err)
+		}
+	} else {
+		// Move existing timeslot, unless it's already in progress
+		existingTimeslotID, _ := uuid.Parse(existingID)
+		booking.TimeslotID = &existingTimeslotID
+		var stationCount int
+		stationRow := tx.QueryRow("SELECT COUNT(*) FROM stations WHERE timeslot = $1", existingID)
+		if err := stationRow.Scan(&stationCount); err != nil {
+			return rest.InternalError(err)
+		}
+		if stationCount > 0 {
+			return rest.Conflict("user has a timeslot in progress for this track")
+		}
+		_, err := tx.Exec("UPDATE timeslots SET begin_time = $2, end_time = $3, slot_template = $4, version = version + 1, updated_at = now() WHERE id = $1",
+			existingID, beginTime, endTime, template.ID)
+		if err != nil {
+			return rest.InternalError(err)
+		}
+	}
+
+	// Check the user isn't booked on another track at the same time
+	bookedTimeslot := Timeslot{ID: booking.TimeslotID, UserID: booking.UserID, TrackID: trackID}
+	if result := bookedTimeslot.checkOverlap(tx, beginTime, endTime); !result.IsOk() {
+		return result
+	}
+
+	if err := tx.Commit(); err != nil {
+		return rest.InternalError(err)
+	}
+	db.NotifyWrite("timeslots")
+
+	return rest.Created(fmt.Sprintf("%v/timeslot/%v/", config.Get().SitePrefix, booking.TimeslotID))
+}
+
+// slotKey makes a map key for a concrete slot.
+func slotKey(templateID string, beginTime time.Time) string {
+	return fmt.Sprintf("%v/%v", templateID, beginTime.Unix())
+}
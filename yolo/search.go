@@ -0,0 +1,176 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"github.com/gathering/tech-online-backend/db"
+	content "github.com/gathering/tech-online-backend/doc"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+const defaultSearchLimit = 50
+
+// SearchResult is a document, task or track matching a search.
+type SearchResult struct {
+	Type    string  `json:"type"`            // "document", "task" or "track"
+	ID      string  `json:"id"`              // "<family>/<shortname>/<locale>" for documents
+	TrackID *string `json:"track,omitempty"` // For tasks and tracks
+	Name    string  `json:"name"`
+	Snippet string  `json:"snippet"` // Excerpt of the content, with matches in markdown bold
+	Rank    float64 `json:"rank"`
+}
+
+// SearchResults is a list of search results, best match first.
+type SearchResults []*SearchResult
+
+func init() {
+	rest.AddHandler("/search/", "^$", func() interface{} { return &SearchResults{} })
+}
+
+// Get searches documents, tasks and tracks.
+func (results *SearchResults) Get(request *rest.Request) rest.Result {
+	// Check params
+	query, queryExists := request.QueryArgs["q"]
+	if !queryExists || query == "" {
+		return rest.BadRequest("missing query")
+	}
+	resultType := request.QueryArgs["type"]
+	switch resultType {
+	case "", "document", "task", "track":
+	default:
+		return rest.BadRequest("invalid type")
+	}
+	limit := request.ListLimit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+
+	// Search, with unpublished documents only for operators/admins
+	isOperator := request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin
+	const headlineOptions = "StartSel=**, StopSel=**, MaxFragments=2"
+	rows, rowsErr := db.DB.Query(`SELECT * FROM (
+		SELECT 'document' AS type, family || '/' || shortname || '/' || locale AS id, NULL AS track, name, ts_headline('simple', content, query, $3) AS snippet, ts_rank(search, query) AS rank
+			FROM documents, websearch_to_tsquery('simple', $1) query WHERE search @@ query
+				AND ($4 OR ((publish_from IS NULL OR publish_from <= now()) AND (publish_until IS NULL OR publish_until > now())))
+		UNION ALL
+		SELECT 'task', id, track, name, ts_headline('simple', description, query, $3), ts_rank(search, query)
+			FROM tasks, websearch_to_tsquery('simple', $1) query WHERE search @@ query
+		UNION ALL
+		SELECT 'track', id, id, name, '', ts_rank(search, query)
+			FROM tracks, websearch_to_tsquery('simple', $1) query WHERE search @@ query
+		) AS results WHERE $2 = '' OR type = $2 ORDER BY rank DESC`, query, resultType, headlineOptions, isOperator)
+	if rowsErr != nil {
+		return rest.InternalError(rowsErr)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var result SearchResult
+		if err := rows.Scan(&result.Type, &result.ID, &result.TrackID, &result.Name, &result.Snippet, &result.Rank); err != nil {
+			return rest.InternalError(err)
+		}
+		*results = append(*results, &result)
+	}
+	if err := rows.Err(); err != nil {
+		return rest.InternalError(err)
+	}
+
+	// Hide what participants may not see
+	if !isOperator {
+		if result := results.filterForParticipant(request); !result.IsOk() {
+			return result
+		}
+	}
+
+	if len(*results) > limit {
+		*results = (*results)[:limit]
+	}
+	return rest.Result{}
+}
+
+// filterForParticipant removes results for draft tracks, for tasks hidden by task locking and for documents
+// hidden from the document listing.
+func (results *SearchResults) filterForParticipant(request *rest.Request) rest.Result {
+	var tracks Tracks
+	tracksDBResult := db.SelectMany(&tracks, "tracks")
+	if tracksDBResult.IsFailed() {
+		return rest.InternalError(tracksDBResult.Error)
+	}
+	trackMap := make(map[string]*Track)
+	for _, track := range tracks {
+		trackMap[track.ID] = track
+	}
+
+	// Find locked tasks
+	var tasks Tasks
+	for _, result := range *results {
+		if result.Type != "task" {
+			continue
+		}
+		var task Task
+		taskDBResult := db.Select(&task, "tasks", "id", "=", result.ID)
+		if taskDBResult.IsFailed() {
+			return rest.InternalError(taskDBResult.Error)
+		}
+		if err := task.loadDependencies(db.DB); err != nil {
+			return rest.InternalError(err)
+		}
+		tasks = append(tasks, &task)
+	}
+	if err := applyTaskLocksForRequester(tasks, request.AccessToken); err != nil {
+		return rest.InternalError(err)
+	}
+
+	// Reuse the document listing for the same visibility rules (publishing windows and event scoping)
+	listRequest := *request
+	listRequest.QueryArgs = make(map[string]string)
+	var documents content.Documents
+	if result := documents.Get(&listRequest); !result.IsOk() {
+		return result
+	}
+	visibleDocumentIDs := make(map[string]bool, len(documents))
+	for _, document := range documents {
+		visibleDocumentIDs[document.FamilyID+"/"+document.Shortname+"/"+document.Locale] = true
+	}
+	hiddenTaskIDs := make(map[string]bool)
+	for _, task := range tasks {
+		if track, ok := trackMap[task.TrackID]; ok && task.Locked && track.TaskLockMode == TaskLockModeHide {
+			hiddenTaskIDs[task.ID.String()] = true
+		}
+	}
+
+	oldResults := *results
+	*results = make(SearchResults, 0, len(oldResults))
+	for _, result := range oldResults {
+		if result.TrackID != nil {
+			if track, ok := trackMap[*result.TrackID]; !ok || !track.isVisible() {
+				continue
+			}
+		}
+		if result.Type == "task" && hiddenTaskIDs[result.ID] {
+			continue
+		}
+		if result.Type == "document" && !visibleDocumentIDs[result.ID] {
+			continue
+		}
+		*results = append(*results, result)
+	}
+	return rest.Result{}
+}
@@ -0,0 +1,91 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+// SeedFixture is a declarative fixture for local development and staging environments,
+// containing an event bundle and test users.
+type SeedFixture struct {
+	EventBundle
+	Users rest.Users `json:"users"`
+}
+
+// Seed loads a JSON fixture file and creates or updates everything in it in a single transaction.
+func Seed(path string) error {
+	data, readErr := os.ReadFile(path)
+	if readErr != nil {
+		return readErr
+	}
+	var fixture SeedFixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return fmt.Errorf("malformed fixture: %v", err)
+	}
+
+	// Validate
+	if result := fixture.EventBundle.validate(); !result.IsOk() {
+		return resultError(result)
+	}
+	for _, user := range fixture.Users {
+		if user.Role == rest.RoleInvalid {
+			user.Role = rest.RoleParticipant
+		}
+		switch {
+		case user.ID == nil:
+			return fmt.Errorf("user: missing ID")
+		case user.Username == "" || user.DisplayName == "" || user.EmailAddress == "":
+			return fmt.Errorf("user %v: missing username, display name or email address", user.ID)
+		case user.Role != rest.RoleParticipant && user.Role != rest.RoleOperator && user.Role != rest.RoleAdmin:
+			return fmt.Errorf("user %v: invalid role", user.ID)
+		}
+	}
+
+	// Save
+	tx, txErr := db.DB.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+	if err := fixture.EventBundle.save(tx); err != nil {
+		return err
+	}
+	for _, user := range fixture.Users {
+		if dbResult := db.UpsertWith(tx, "users", user, "id", "=", user.ID); dbResult.IsFailed() {
+			return dbResult.Error
+		}
+	}
+	return tx.Commit()
+}
+
+// resultError converts a failed result to an error, for non-request contexts.
+func resultError(result rest.Result) error {
+	if result.Error != nil {
+		return result.Error
+	}
+	return fmt.Errorf("%v", result.Message)
+}
@@ -21,16 +21,15 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package yolo
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
-	"strconv"
+	"time"
 
 	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
 	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/worker"
 	"github.com/google/uuid"
 
 	log "github.com/sirupsen/logrus"
@@ -55,6 +54,8 @@ const (
 	StationStatusProvisioning StationStatus = "provisioning"
 	// StationStatusMaintenance means it should not be used by any participants.
 	StationStatusMaintenance StationStatus = "maintenance"
+	// StationStatusFailed means provisioning failed (see the failure reason) and may be retried by an operator.
+	StationStatusFailed StationStatus = "failed"
 )
 
 // DefaultDefaultStationStatus is the default value for the default state of station.
@@ -63,15 +64,32 @@ const DefaultDefaultStationStatus = StationStatusAvailable
 
 // Station is station.
 type Station struct {
-	ID            *uuid.UUID    `column:"id" json:"id"`               // Generated, required, unique
-	TrackID       string        `column:"track" json:"track"`         // Required
-	Shortname     string        `column:"shortname" json:"shortname"` // Required
-	Name          string        `column:"name" json:"name"`
-	DefaultStatus StationStatus `column:"default_status" json:"default_status"` // Required
-	Status        StationStatus `column:"status" json:"status"`                 // Required
-	Credentials   string        `column:"credentials" json:"credentials"`       // Host, port, password, etc. (typically hidden)
-	Notes         string        `column:"notes" json:"notes"`                   // Misc. notes
-	TimeslotID    string        `column:"timeslot" json:"timeslot"`             // Timeslot currently assigned to this station, if any
+	ID            *uuid.UUID         `column:"id" json:"id"`               // Generated, required, unique
+	TrackID       string             `column:"track" json:"track"`         // Required
+	Shortname     string             `column:"shortname" json:"shortname"` // Required
+	Name          string             `column:"name" json:"name"`
+	DefaultStatus StationStatus      `column:"default_status" json:"default_status"`              // Required
+	Status        StationStatus      `column:"status" json:"status"`                              // Required
+	Credentials   db.EncryptedString `column:"credentials" json:"credentials" visibility:"owner"` // Host, port, password, etc. (encrypted at rest if configured)
+	Notes         string             `column:"notes" json:"notes"`                                // Misc. notes
+	TimeslotID    db.NullString      `column:"timeslot" json:"timeslot"`                          // Timeslot currently assigned to this station, if any
+	// Optional host and port (e.g. SSH) for the console proxy
+	ConsoleAddress string `column:"console_address" json:"console_address" visibility:"owner"`
+	// Why provisioning failed, for failed stations
+	FailureReason string `column:"failure_reason" json:"failure_reason"`
+	// When the credentials were last rotated, if ever, so participants can be told to reconnect
+	CredentialsRotateTime *time.Time `column:"credentials_rotate_time" json:"credentials_rotate_time"`
+	// Who the (dynamic) station was provisioned for and when, for the per-user limits
+	ProvisionedByUserID *uuid.UUID `column:"provisioned_by" json:"provisioned_by"`
+	ProvisionTime       *time.Time `column:"provision_time" json:"provision_time"`
+	// Incremented on every update, updates with an outdated version are rejected (optional for clients)
+	Version *int `column:"version" json:"version"`
+	// Active and future maintenance windows for the station (not a DB column)
+	UpcomingMaintenance MaintenanceWindows `column:"-" json:"upcoming_maintenance"`
+	// Generated, when the station was created and last updated
+	db.Timestamps
+	// If assigned to the requester, so the credentials and console address are shown (see markOwned)
+	ownedByRequester bool
 }
 
 // Stations is a list of stations.
@@ -104,16 +122,32 @@ type serverCreateStationResponse struct {
 	VLANIPv4Address string `json:"vlan_ip"`
 }
 
+// credentials formats the credentials of the VM as Markdown.
+func (responseData *serverCreateStationResponse) credentials() db.EncryptedString {
+	return db.EncryptedString(fmt.Sprintf("**Username**: %v\n\n**Password**: %v\n\n**Public address (IPv4)**: %v\n\n**Public address (IPv6)**: %v\n\n**SSH port**: %v",
+		responseData.Username, responseData.Password, responseData.IPv4Address, responseData.IPv6Address, responseData.SSHPort))
+}
+
 func init() {
 	rest.AddHandler("/stations/", "^$", func() interface{} { return &Stations{} })
 	rest.AddHandler("/station/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Station{} })
-	rest.AddHandler("/track/", "^(?P<track_id>[^/]+)/provision-station/$", func() interface{} { return &StationProvisionRequest{} })
-	rest.AddHandler("/station/", "^(?P<id>[^/]+)/terminate/$", func() interface{} { return &StationTerminateRequest{} })
+	rest.AddIdempotentHandler("/track/", "^(?P<track_id>[^/]+)/provision-station/$", func() interface{} { return &StationProvisionRequest{} })
+	rest.AddIdempotentHandler("/station/", "^(?P<id>[^/]+)/terminate/$", func() interface{} { return &StationTerminateRequest{} })
+}
+
+// ListQueryFields returns the fields stations may be filtered and sorted on.
+func (stations *Stations) ListQueryFields() map[string]string {
+	return map[string]string{"id": "id", "track": "track", "shortname": "shortname", "name": "name", "status": "status", "default_status": "default_status", "timeslot": "timeslot", "created_at": "created_at", "updated_at": "updated_at"}
+}
+
+// CSVExport allows the stations to be listed as CSV.
+func (stations *Stations) CSVExport() bool {
+	return true
 }
 
 // Get gets multiple stations.
 func (stations *Stations) Get(request *rest.Request) rest.Result {
-	var whereArgs []interface{}
+	whereArgs := request.ListFilterArgs
 	if shortname, ok := request.QueryArgs["shortname"]; ok {
 		whereArgs = append(whereArgs, "shortname", "=", shortname)
 	}
@@ -127,43 +161,39 @@ func (stations *Stations) Get(request *rest.Request) rest.Result {
 		whereArgs = append(whereArgs, "default_status", "=", defaultStatus)
 	}
 	if timeslotID, ok := request.QueryArgs["timeslot"]; ok {
-		whereArgs = append(whereArgs, "timeslot", "=", timeslotID)
+		whereArgs = append(whereArgs, "timeslot", "=", db.StringOrNull(timeslotID))
+	}
+	whereArgs, scopeErr := scopeToRequestEvent(request, whereArgs)
+	if scopeErr != nil {
+		return rest.InternalError(scopeErr)
 	}
 
 	// Fetch stations to TMP list
-	tmpStations := make(Stations, 0)
-	dbResult := db.SelectMany(&tmpStations, "stations", whereArgs...)
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
-	}
-
-	// Allow all info if operator/admin
-	if request.AccessToken.GetRole() == rest.RoleOperator && request.AccessToken.GetRole() == rest.RoleAdmin {
-		*stations = tmpStations
-		return rest.Result{}
-	}
-
-	// Hide credentials and timeslot if not assigned to self through timeslot
-	for _, station := range tmpStations {
-		credentials := station.Credentials
-		station.Credentials = ""
-		requestUserID := request.AccessToken.OwnerUserID
-		if requestUserID != nil && station.TimeslotID != "" {
-			var timeslot Timeslot
-			timeslotDBResult := db.Select(&timeslot, "timeslots",
-				"id", "=", station.TimeslotID,
-				"user", "=", requestUserID,
-			)
-			if timeslotDBResult.IsFailed() {
-				return rest.Result{Code: 500, Error: timeslotDBResult.Error}
-			}
-			if timeslotDBResult.IsSuccess() {
-				station.Credentials = credentials
-			}
+	allStations, err := stores.Stations.List(request.ListOrderBy, whereArgs...)
+	if err != nil {
+		return rest.InternalError(err)
+	}
+
+	// Hide stations in draft tracks from non-operators
+	hiddenIDs, hiddenErr := hiddenTrackIDs(request)
+	if hiddenErr != nil {
+		return rest.InternalError(hiddenErr)
+	}
+	tmpStations := make(Stations, 0, len(allStations))
+	for _, station := range allStations {
+		if !hiddenIDs[station.TrackID] {
+			tmpStations = append(tmpStations, station)
 		}
+	}
 
-		*stations = append(*stations, station)
+	// Show credentials if assigned to self (or own team) through timeslot
+	if err := tmpStations.markOwned(request.AccessToken); err != nil {
+		return rest.InternalError(err)
 	}
+	if err := tmpStations.loadUpcomingMaintenance(); err != nil {
+		return rest.InternalError(err)
+	}
+	*stations = append(*stations, tmpStations...)
 	return rest.Result{}
 }
 
@@ -172,43 +202,111 @@ func (station *Station) Get(request *rest.Request) rest.Result {
 	// Check params
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 
 	// Fetch stations to TMP object
-	var tmpStation Station
-	dbResult := db.Select(&tmpStation, "stations", "id", "=", id)
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+	tmpStation, err := stores.Stations.Get(id)
+	if err != nil {
+		return rest.InternalError(err)
 	}
-	if !dbResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "not found"}
-	}
-
-	// Allow all info if operator/admin
-	if request.AccessToken.GetRole() == rest.RoleOperator && request.AccessToken.GetRole() == rest.RoleAdmin {
-		*station = tmpStation
-		return rest.Result{}
-	}
-
-	// Hide credentials if not the active user
-	credentials := station.Credentials
-	station.Credentials = ""
-	requestUserID := request.AccessToken.OwnerUserID
-	if requestUserID != nil && station.TimeslotID != "" {
-		var timeslot Timeslot
-		timeslotDBResult := db.Select(&timeslot, "timeslots",
-			"id", "=", station.TimeslotID,
-			"user", "=", requestUserID,
-		)
-		if timeslotDBResult.IsFailed() {
-			return rest.Result{Code: 500, Error: timeslotDBResult.Error}
+	if tmpStation == nil {
+		return rest.NotFound("not found")
+	}
+	if result := checkTrackVisible(request, tmpStation.TrackID); !result.IsOk() {
+		return rest.NotFound("not found")
+	}
+
+	// Show credentials if assigned to self (or own team) through timeslot
+	if err := (Stations{tmpStation}).markOwned(request.AccessToken); err != nil {
+		return rest.InternalError(err)
+	}
+	if err := (Stations{tmpStation}).loadUpcomingMaintenance(); err != nil {
+		return rest.InternalError(err)
+	}
+	*station = *tmpStation
+	return rest.Result{}
+}
+
+// markOwned marks the stations assigned to a timeslot owned by the user or the user's team (if allowed by the track type)
+// as owned by the requester, so the receiver shows them the credentials. Operators and admins see them regardless.
+// It uses a fixed number of queries, regardless of the number of stations.
+func (stations Stations) markOwned(token rest.AccessTokenEntry) error {
+	if token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin || token.OwnerUserID == nil {
+		return nil
+	}
+	ownedTimeslotIDs, err := stations.ownedTimeslotIDs(*token.OwnerUserID)
+	if err != nil {
+		return err
+	}
+	for _, station := range stations {
+		station.ownedByRequester = station.TimeslotID.Valid && ownedTimeslotIDs[station.TimeslotID.String]
+	}
+	return nil
+}
+
+// IsOwnedBy checks if the station was marked as owned by the requester (see markOwned), for the credentials visibility.
+func (station *Station) IsOwnedBy(token *rest.AccessTokenEntry) bool {
+	return station.ownedByRequester
+}
+
+// ownedTimeslotIDs finds which timeslots assigned to the stations are owned by the user or the user's team,
+// only for tracks which allow showing credentials to participants.
+func (stations Stations) ownedTimeslotIDs(userID uuid.UUID) (map[string]bool, error) {
+	ownedTimeslotIDs := make(map[string]bool)
+
+	// Find tracks which allow showing them to participants
+	var trackIDs []string
+	seenTrackIDs := make(map[string]bool)
+	for _, station := range stations {
+		if station.TimeslotID.Valid && !seenTrackIDs[station.TrackID] {
+			seenTrackIDs[station.TrackID] = true
+			trackIDs = append(trackIDs, station.TrackID)
 		}
-		if timeslotDBResult.IsSuccess() {
-			station.Credentials = credentials
+	}
+	if len(trackIDs) == 0 {
+		return ownedTimeslotIDs, nil
+	}
+	var tracks Tracks
+	trackDBResult := db.SelectMany(&tracks, "tracks", "id", "IN", trackIDs)
+	if trackDBResult.IsFailed() {
+		return nil, trackDBResult.Error
+	}
+	assignedPolicyTrackIDs := make(map[string]bool)
+	for _, track := range tracks {
+		if behavior, ok := track.behavior(); ok && behavior.CredentialPolicy == CredentialPolicyAssigned {
+			assignedPolicyTrackIDs[track.ID] = true
 		}
 	}
-	return rest.Result{}
+
+	// Load the assigned timeslots and the user's teams
+	var timeslotIDs []string
+	for _, station := range stations {
+		if station.TimeslotID.Valid && assignedPolicyTrackIDs[station.TrackID] {
+			timeslotIDs = append(timeslotIDs, station.TimeslotID.String)
+		}
+	}
+	if len(timeslotIDs) == 0 {
+		return ownedTimeslotIDs, nil
+	}
+	var timeslots Timeslots
+	timeslotDBResult := db.SelectMany(&timeslots, "timeslots", "id", "IN", timeslotIDs)
+	if timeslotDBResult.IsFailed() {
+		return nil, timeslotDBResult.Error
+	}
+	teamIDs, err := userTeamIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, timeslot := range timeslots {
+		ownedByUser := timeslot.UserID != nil && *timeslot.UserID == userID
+		ownedByTeam := timeslot.TeamID != nil && teamIDs[*timeslot.TeamID]
+		if ownedByUser || ownedByTeam {
+			ownedTimeslotIDs[timeslot.ID.String()] = true
+		}
+	}
+	return ownedTimeslotIDs, nil
 }
 
 // Post creates a new station.
@@ -234,11 +332,22 @@ func (station *Station) Post(request *rest.Request) rest.Result {
 	if !result.IsOk() {
 		return result
 	}
+	if err := station.recordAssignmentChange(""); err != nil {
+		return rest.InternalError(err)
+	}
+	if err := station.recordNotesChange("", &request.AccessToken); err != nil {
+		return rest.InternalError(err)
+	}
 	result.Code = 201
-	result.Location = fmt.Sprintf("%v/station/%v/", config.Config.SitePrefix, station.ID)
+	result.Location = fmt.Sprintf("%v/station/%v/", config.Get().SitePrefix, station.ID)
 	return result
 }
 
+// IfMatchRequired makes If-Match optional for PUTs, but honored if present.
+func (station *Station) IfMatchRequired() bool {
+	return false
+}
+
 // Put updates a station.
 func (station *Station) Put(request *rest.Request) rest.Result {
 	// Check perms
@@ -249,23 +358,54 @@ func (station *Station) Put(request *rest.Request) rest.Result {
 	// Check params
 	rawID, rawIDExists := request.PathArgs["id"]
 	if !rawIDExists || rawID == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 	id, uuidErr := uuid.Parse(rawID)
 	if uuidErr != nil {
-		return rest.Result{Code: 400, Message: "invalid ID"}
+		return rest.BadRequest("invalid ID")
 	}
 
 	// Validate
 	if *station.ID != id {
-		return rest.Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
+		return rest.BadRequest("mismatch between URL and JSON IDs")
 	}
 	if result := station.validate(); !result.IsOk() {
 		return result
 	}
 
+	// Get the previous assignment and notes, for the history
+	previous, previousErr := stores.Stations.Get(station.ID)
+	if previousErr != nil {
+		return rest.InternalError(previousErr)
+	}
+	previousTimeslotID := ""
+	previousNotes := ""
+	if previous != nil {
+		previousTimeslotID = previous.TimeslotID.String
+		previousNotes = previous.Notes
+	}
+
 	// Create or update
-	return station.createOrUpdate()
+	result := station.createOrUpdate()
+	if !result.IsOk() {
+		return result
+	}
+	if err := station.recordAssignmentChange(previousTimeslotID); err != nil {
+		return rest.InternalError(err)
+	}
+	if err := station.recordNotesChange(previousNotes, &request.AccessToken); err != nil {
+		return rest.InternalError(err)
+	}
+	if previous != nil {
+		if err := queueStationStatusChanged(db.DB, station, previous.Status); err != nil {
+			return rest.InternalError(err)
+		}
+	}
+	if station.Status == StationStatusReady && !station.TimeslotID.Valid {
+		// Let the queue have it
+		worker.Trigger(queueWorkerTaskName)
+	}
+	return result
 }
 
 // Delete deletes a station.
@@ -278,41 +418,82 @@ func (station *Station) Delete(request *rest.Request) rest.Result {
 	// Check params
 	rawID, rawIDExists := request.PathArgs["id"]
 	if !rawIDExists || rawID == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 	id, uuidErr := uuid.Parse(rawID)
 	if uuidErr != nil {
-		return rest.Result{Code: 400, Message: "invalid ID"}
+		return rest.BadRequest("invalid ID")
 	}
 
-	// Check if exists
+	// Delete, if it exists
 	station.ID = &id
-	exists, err := station.exists()
+	found, err := stores.Stations.Delete(station.ID)
 	if err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	}
-	if !exists {
-		return rest.Result{Code: 404, Message: "not found"}
+	if !found {
+		return rest.NotFound("not found")
 	}
+	return rest.Result{}
+}
 
-	// Delete
-	dbResult := db.Delete("stations", "id", "=", station.ID)
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+// PreviewDelete counts the rows referring to the station, which a delete would leave dangling.
+func (station *Station) PreviewDelete(request *rest.Request) (map[string]int, rest.Result) {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return nil, rest.UnauthorizedResult(request.AccessToken)
 	}
-	return rest.Result{}
+
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return nil, rest.BadRequest("missing ID")
+	}
+	id, uuidErr := uuid.Parse(rawID)
+	if uuidErr != nil {
+		return nil, rest.BadRequest("invalid ID")
+	}
+
+	// Get it, tests refer to it by track and shortname
+	existing, err := stores.Stations.Get(id)
+	if err != nil {
+		return nil, rest.InternalError(err)
+	}
+	if existing == nil {
+		return nil, rest.NotFound("not found")
+	}
+	affected, err := db.CountReferences(existing.ID,
+		db.Reference{Table: "stations", Column: "id"},
+		db.Reference{Table: "station_history", Column: "station"},
+		db.Reference{Table: "station_notes", Column: "station"},
+		db.Reference{Table: "console_sessions", Column: "station"},
+		db.Reference{Table: "maintenance_windows", Column: "station"},
+		db.Reference{Table: "maintenance_flips", Column: "station"},
+	)
+	if err != nil {
+		return nil, rest.InternalError(err)
+	}
+	for _, table := range []string{"tests", "test_history"} {
+		countResult := db.Count(table, "track", "=", existing.TrackID, "station_shortname", "=", existing.Shortname)
+		if countResult.IsFailed() {
+			return nil, rest.InternalError(countResult.Error)
+		}
+		if countResult.Ok > 0 {
+			affected[table] = countResult.Ok
+		}
+	}
+	return affected, rest.Result{}
 }
 
 func (station *Station) create() rest.Result {
 	if exists, err := station.exists(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if exists {
-		return rest.Result{Code: 409, Message: "duplicate"}
+		return rest.Conflict("duplicate")
 	}
 
-	dbResult := db.Insert("stations", station)
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+	if err := stores.Stations.Insert(station); err != nil {
+		return rest.InternalError(err)
 	}
 	return rest.Result{}
 }
@@ -320,29 +501,23 @@ func (station *Station) create() rest.Result {
 func (station *Station) createOrUpdate() rest.Result {
 	exists, existsErr := station.exists()
 	if existsErr != nil {
-		return rest.Result{Code: 500, Error: existsErr}
+		return rest.InternalError(existsErr)
 	}
 
-	var dbResult db.Result
+	var err error
 	if exists {
-		dbResult = db.Update("stations", station, "id", "=", station.ID)
+		err = stores.Stations.Update(station)
 	} else {
-		dbResult = db.Insert("stations", station)
+		err = stores.Stations.Insert(station)
 	}
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+	if err != nil {
+		return rest.InternalError(err)
 	}
 	return rest.Result{}
 }
 
 func (station *Station) exists() (bool, error) {
-	var count int
-	row := db.DB.QueryRow("SELECT COUNT(*) FROM stations WHERE id = $1", station.ID)
-	rowErr := row.Scan(&count)
-	if rowErr != nil {
-		return false, rowErr
-	}
-	return count > 0, nil
+	return stores.Stations.Exists(station.ID)
 }
 
 func (station *Station) existsShortname() (bool, error) {
@@ -358,44 +533,46 @@ func (station *Station) existsShortname() (bool, error) {
 func (station *Station) validate() rest.Result {
 	switch {
 	case station.ID == nil:
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	case station.TrackID == "":
-		return rest.Result{Code: 400, Message: "missing track ID"}
+		return rest.BadRequest("missing track ID")
 	case !station.validateStatus():
-		return rest.Result{Code: 400, Message: "missing or invalid default status or status"}
+		return rest.BadRequest("missing or invalid default status or status")
+	case !station.validateConsoleAddress():
+		return rest.BadRequest("invalid console address, must be host and port")
 	}
 
 	if exists, err := station.anotherExistsWithTrackShortname(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if exists {
-		return rest.Result{Code: 409, Message: "combination of track and shortname already exists"}
+		return rest.Conflict("combination of track and shortname already exists")
 	}
 
 	track := Track{ID: station.TrackID}
 	if exists, err := track.exists(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if !exists {
-		return rest.Result{Code: 400, Message: "referenced track does not exist"}
+		return rest.BadRequest("referenced track does not exist")
 	}
 
-	if station.TimeslotID != "" {
-		timeslotID, timeslotIDErr := uuid.Parse(station.TimeslotID)
+	if station.TimeslotID.Valid {
+		timeslotID, timeslotIDErr := uuid.Parse(station.TimeslotID.String)
 		if timeslotIDErr != nil {
-			return rest.Result{Code: 400, Message: "invalid timeslot ID"}
+			return rest.BadRequest("invalid timeslot ID")
 		}
 		timeslot := Timeslot{ID: &timeslotID}
 		if exists, err := timeslot.existsWithTrack(station.TrackID); err != nil {
-			return rest.Result{Code: 500, Error: err}
+			return rest.InternalError(err)
 		} else if !exists {
-			return rest.Result{Code: 400, Message: "referenced timeslot does not exist or has wrong track type"}
+			return rest.BadRequest("referenced timeslot does not exist or has wrong track type")
 		}
 	}
 
-	if station.TimeslotID != "" {
+	if station.TimeslotID.Valid {
 		if exists, err := station.anotherExistsWithTimeslot(); err != nil {
-			return rest.Result{Code: 500, Error: err}
+			return rest.InternalError(err)
 		} else if exists {
-			return rest.Result{Code: 400, Message: "another station is already bound to the referenced timeslot"}
+			return rest.BadRequest("another station is already bound to the referenced timeslot")
 		}
 	}
 
@@ -406,6 +583,14 @@ func (station *Station) validateStatus() bool {
 	return validateStationStatus(station.DefaultStatus) && validateStationStatus(station.Status)
 }
 
+func (station *Station) validateConsoleAddress() bool {
+	if station.ConsoleAddress == "" {
+		return true
+	}
+	_, port, err := net.SplitHostPort(station.ConsoleAddress)
+	return err == nil && port != ""
+}
+
 func validateStationStatus(status StationStatus) bool {
 	switch status {
 	case StationStatusAvailable:
@@ -419,6 +604,8 @@ func validateStationStatus(status StationStatus) bool {
 	case StationStatusProvisioning:
 		fallthrough
 	case StationStatusMaintenance:
+		fallthrough
+	case StationStatusFailed:
 		return true
 	default:
 		return false
@@ -449,100 +636,64 @@ func (station *Station) anotherExistsWithTimeslot() (bool, error) {
 func (createRequest *StationProvisionRequest) Post(request *rest.Request) rest.Result {
 	trackID, trackIDExists := request.PathArgs["track_id"]
 	if !trackIDExists || trackID == "" {
-		return rest.Result{Code: 400, Message: "missing track ID"}
+		return rest.BadRequest("missing track ID")
 	}
 
+	// Only participants are limited by the per-user quotas
+	isOperator := request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin
+	if result := checkTrackOperator(request.AccessToken, trackID); !result.IsOk() {
+		return result
+	}
 	var station Station
-	return station.Provision(trackID)
+	return station.Provision(trackID, request.AccessToken.OwnerUserID, !isOperator)
 }
 
 // Provision attempts to allocate a station, if the track supports it.
 // The receiver station will get overwritten with the created station,
 // plus the result will contain the location of the newly created station.
 // The status will be "maintenance".
-func (station *Station) Provision(trackID string) rest.Result {
+// The station is recorded as provisioned for the user (if any), checking the user's quotas first if enforceQuota.
+func (station *Station) Provision(trackID string, userID *uuid.UUID, enforceQuota bool) rest.Result {
 	// Load track
 	var track Track
 	dbResult := db.Select(&track, "tracks", "id", "=", trackID)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
 	if !dbResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "track not found"}
+		return rest.NotFound("track not found")
 	}
 
 	// Check if track type supports it and if the config is present
-	if track.Type != trackTypeServer {
-		return rest.Result{Code: 400, Message: "track type does not support dynamic stations"}
+	if behavior, ok := track.behavior(); !ok || behavior.ProvisioningMode != StationProvisioningModeDynamic {
+		return rest.BadRequest("track type does not support dynamic stations")
 	}
-	trackConfig, trackConfigOk := config.Config.ServerTracks[trackID]
+	trackConfig, trackConfigOk := config.Get().ServerTracks[trackID]
 	if !trackConfigOk || trackConfig.BaseURL == "" {
-		return rest.Result{Code: 400, Message: "track is not configured for dynamic stations"}
+		return rest.BadRequest("track is not configured for dynamic stations")
 	}
 
-	// Check limit, excluding terminated ones
-	maxStations := trackConfig.MaxInstancesHard
-	if maxStations > 0 {
-		currentRow := db.DB.QueryRow("SELECT COUNT(*) FROM stations WHERE track = $1 AND status != $2", track.ID, StationStatusTerminated)
-		var count int
-		currentRowErr := currentRow.Scan(&count)
-		if currentRowErr != nil {
-			return rest.Result{Code: 500, Error: currentRowErr}
-		}
-		if count+1 > maxStations {
-			return rest.Result{Code: 400, Message: "Too many active stations for dynamic track"}
+	// Check limit, excluding terminated and failed ones
+	if result := checkServerStationLimit(trackID, trackConfig); !result.IsOk() {
+		return result
+	}
+	if enforceQuota && userID != nil {
+		if result := checkUserStationQuota(trackID, trackConfig, *userID); !result.IsOk() {
+			return result
 		}
 	}
 
-	// Call station service
-	serviceURL := trackConfig.BaseURL + "/api/entry/new"
-	serviceRequestData := serverCreateStationRequest{
-		Username: "tech",
-		UID:      "techo",
-		TaskType: trackConfig.TaskType,
-	}
-	requestJSON, requestJSONError := json.Marshal(serviceRequestData)
-	if requestJSONError != nil {
-		return rest.Result{Code: 500, Error: requestJSONError}
-	}
-	serviceRequest, serviceRequestErr := http.NewRequest("POST", serviceURL, bytes.NewBuffer(requestJSON))
-	if serviceRequestErr != nil {
-		return rest.Result{Code: 500, Error: serviceRequestErr}
-	}
-	serviceRequest.SetBasicAuth(trackConfig.AuthUsername, trackConfig.AuthPassword)
-	serviceRequest.Header.Set("Content-Type", "application/json")
-	serviceClient := &http.Client{}
-	serviceResponse, serviceResponseErr := serviceClient.Do(serviceRequest)
-	if serviceResponseErr != nil {
-		return rest.Result{Code: 500, Error: serviceResponseErr}
-	}
-	defer serviceResponse.Body.Close()
-	if serviceResponse.StatusCode < 200 || serviceResponse.StatusCode > 299 {
-		return rest.Result{Code: 500, Error: fmt.Errorf("response contained non-2XX status: %v", serviceResponse.Status)}
-	}
-	serviceResponseBody, serviceResponseBodyErr := ioutil.ReadAll(serviceResponse.Body)
-	if serviceResponseBodyErr != nil {
-		return rest.Result{Code: 500, Error: serviceResponseBodyErr}
+	// Call station service, keeping a failed station for operators to retry if it keeps failing
+	station.ProvisionedByUserID = userID
+	responseData, serviceErr := requestServerStation(trackConfig)
+	if serviceErr != nil {
+		return station.saveProvisioningFailure(trackID, serviceErr)
 	}
-	var responseData serverCreateStationResponse
-	if err := json.Unmarshal(serviceResponseBody, &responseData); err != nil {
-		return rest.Result{Code: 500, Error: err}
-	}
-	log.Tracef("VM service created new instance: %v", responseData.ID)
 
 	// Create station
 	newID := uuid.New()
 	station.ID = &newID
-	station.TrackID = trackID
-	station.Shortname = strconv.Itoa(responseData.ID)
-	station.Name = fmt.Sprintf("Station #%v", responseData.ID)
-	station.Status = StationStatusMaintenance
-	// Markdown
-	station.Credentials = fmt.Sprintf("**Username**: %v\n\n**Password**: %v\n\n**Public address (IPv4)**: %v\n\n**Public address (IPv6)**: %v\n\n**SSH port**: %v",
-		responseData.Username, responseData.Password, responseData.IPv4Address, responseData.IPv6Address, responseData.SSHPort)
-	// Markdown
-	station.Notes = fmt.Sprintf("**FQDN**: %v\n\n**Zone**: %v\n\n**VLAN ID**: %v\n\n**VLAN Address (IPv4)**: %v\n\nNote that the station may take a few minutes to start before you can connect.",
-		responseData.FQDN, responseData.Zone, responseData.VLANID, responseData.VLANIPv4Address)
+	station.applyServerStation(trackID, responseData)
 	if result := station.validate(); !result.IsOk() {
 		return result
 	}
@@ -551,9 +702,12 @@ func (station *Station) Provision(trackID string) rest.Result {
 	if !result.IsOk() {
 		return result
 	}
+	if err := station.recordNotesChange("", nil); err != nil {
+		return rest.InternalError(err)
+	}
 
 	result.Code = 201
-	result.Location = fmt.Sprintf("%s/station/%s/", config.Config.SitePrefix, station.ID)
+	result.Location = fmt.Sprintf("%s/station/%s/", config.Get().SitePrefix, station.ID)
 	return result
 }
 
@@ -561,17 +715,20 @@ func (station *Station) Provision(trackID string) rest.Result {
 func (destroyRequest *StationTerminateRequest) Post(request *rest.Request) rest.Result {
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 
 	// Get station
 	var station Station
 	stationDBResult := db.Select(&station, "stations", "id", "=", id)
 	if stationDBResult.IsFailed() {
-		return rest.Result{Code: 500, Error: stationDBResult.Error}
+		return rest.InternalError(stationDBResult.Error)
 	}
 	if !stationDBResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "not found"}
+		return rest.NotFound("not found")
+	}
+	if result := checkTrackOperator(request.AccessToken, station.TrackID); !result.IsOk() {
+		return result
 	}
 
 	return station.Terminate()
@@ -580,55 +737,71 @@ func (destroyRequest *StationTerminateRequest) Post(request *rest.Request) rest.
 // Terminate attempts to destroy a station, if the track supports it.
 // The receiver station should already be loaded and exist in the database.
 func (station *Station) Terminate() rest.Result {
-	// Check if already terminated
-	if station.Status == StationStatusTerminated {
-		return rest.Result{Code: 400, Message: "station already terminated"}
-	}
-
-	// Get track
-	var track Track
-	trackDBResult := db.Select(&track, "tracks", "id", "=", station.TrackID)
-	if trackDBResult.IsFailed() {
-		return rest.Result{Code: 500, Error: trackDBResult.Error}
-	}
-	if !trackDBResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "track not found"}
-	}
-
-	// Check if track type supports it and if the config is present
-	if track.Type != trackTypeServer {
-		return rest.Result{Code: 400, Message: "track type does not support dynamic stations"}
-	}
-	trackConfig, trackConfigOk := config.Config.ServerTracks[track.ID]
-	if !trackConfigOk || trackConfig.BaseURL == "" {
-		return rest.Result{Code: 400, Message: "track type is not configured for dynamic stations"}
+	trackConfig, result := station.checkTerminable()
+	if !result.IsOk() {
+		return result
 	}
 
 	// Call station service
 	serviceURL := fmt.Sprintf("%v/api/entry/%v", trackConfig.BaseURL, station.Shortname)
 	serviceRequest, serviceRequestErr := http.NewRequest("DELETE", serviceURL, nil)
 	if serviceRequestErr != nil {
-		return rest.Result{Code: 500, Error: serviceRequestErr}
+		return rest.InternalError(serviceRequestErr)
 	}
 	serviceRequest.SetBasicAuth(trackConfig.AuthUsername, trackConfig.AuthPassword)
 	serviceClient := &http.Client{}
 	serviceResponse, serviceResponseErr := serviceClient.Do(serviceRequest)
 	if serviceResponseErr != nil {
-		return rest.Result{Code: 500, Error: serviceResponseErr}
+		return rest.InternalError(serviceResponseErr)
 	}
 	defer serviceResponse.Body.Close()
 	if serviceResponse.StatusCode < 200 || serviceResponse.StatusCode > 299 {
-		return rest.Result{Code: 500, Error: fmt.Errorf("response contained non-2XX status: %v", serviceResponse.Status)}
+		return rest.InternalError(fmt.Errorf("response contained non-2XX status: %v", serviceResponse.Status))
 	}
 	log.Tracef("VM service destroyed instance: %v", station.ID)
 
 	// Change state to terminated and remove any assigned timeslot
+	if err := endStationHistory(station.ID, StationHistoryOutcomeTerminated); err != nil {
+		return rest.InternalError(err)
+	}
+	previousStatus := station.Status
 	station.Status = StationStatusTerminated
-	station.TimeslotID = ""
+	station.TimeslotID = db.NullString{}
 
 	dbResult := db.Update("stations", station, "id", "=", station.ID)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
+	}
+	if err := queueStationStatusChanged(db.DB, station, previousStatus); err != nil {
+		return rest.InternalError(err)
 	}
 	return rest.Result{}
 }
+
+// checkTerminable checks that the station is not already terminated and that its track supports and is configured for dynamic stations.
+func (station *Station) checkTerminable() (config.ServerTrackConfig, rest.Result) {
+	// Check if already terminated
+	if station.Status == StationStatusTerminated {
+		return config.ServerTrackConfig{}, rest.BadRequest("station already terminated")
+	}
+
+	// Get track
+	var track Track
+	trackDBResult := db.Select(&track, "tracks", "id", "=", station.TrackID)
+	if trackDBResult.IsFailed() {
+		return config.ServerTrackConfig{}, rest.InternalError(trackDBResult.Error)
+	}
+	if !trackDBResult.IsSuccess() {
+		return config.ServerTrackConfig{}, rest.NotFound("track not found")
+	}
+
+	// Check if track type supports it and if the config is present
+	if behavior, ok := track.behavior(); !ok || behavior.ProvisioningMode != StationProvisioningModeDynamic {
+		return config.ServerTrackConfig{}, rest.BadRequest("track type does not support dynamic stations")
+	}
+	trackConfig, trackConfigOk := config.Get().ServerTracks[track.ID]
+	if !trackConfigOk || trackConfig.BaseURL == "" {
+		return config.ServerTrackConfig{}, rest.BadRequest("track type is not configured for dynamic stations")
+	}
+	return trackConfig, rest.Result{}
+}
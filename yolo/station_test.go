@@ -0,0 +1,84 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// BenchmarkStationsMarkOwned benchmarks finding the owned stations (for credentials) for a participant with ~80 assigned stations.
+// It requires a database with the schema, given by TECHO_DATABASE_STRING.
+func BenchmarkStationsMarkOwned(b *testing.B) {
+	config.Set(&config.Settings{DatabaseString: os.Getenv("TECHO_DATABASE_STRING")})
+	if err := db.Connect(); err != nil {
+		b.Skipf("no database: %v", err)
+	}
+
+	trackID := "benchmark-" + uuid.NewString()
+	track := Track{ID: trackID, Type: trackTypeNet, Name: "Benchmark", Status: TrackStatusOpen}
+	if result := track.create(); !result.IsOk() {
+		b.Fatalf("failed to create track: %v", result)
+	}
+	defer db.Delete("timeslots", "track", "=", trackID)
+	defer db.Delete("stations", "track", "=", trackID)
+	defer db.Delete("tracks", "id", "=", trackID)
+
+	userID := uuid.New()
+	otherUserID := uuid.New()
+	var stations Stations
+	for i := 0; i < 80; i++ {
+		timeslotID := uuid.New()
+		timeslotUserID := otherUserID
+		if i%10 == 0 {
+			timeslotUserID = userID
+		}
+		timeslot := Timeslot{ID: &timeslotID, UserID: &timeslotUserID, TrackID: trackID}
+		if dbResult := db.Insert("timeslots", &timeslot); dbResult.IsFailed() {
+			b.Fatalf("failed to create timeslot: %v", dbResult.Error)
+		}
+		stationID := uuid.New()
+		station := Station{ID: &stationID, TrackID: trackID, Shortname: fmt.Sprint(i), DefaultStatus: StationStatusReady, Status: StationStatusReady, Credentials: "secret", TimeslotID: db.StringOrNull(timeslotID.String())}
+		if dbResult := db.Insert("stations", &station); dbResult.IsFailed() {
+			b.Fatalf("failed to create station: %v", dbResult.Error)
+		}
+		stations = append(stations, &station)
+	}
+	token := rest.AccessTokenEntry{OwnerUserID: &userID}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stationsCopy := make(Stations, len(stations))
+		for j, station := range stations {
+			stationCopy := *station
+			stationsCopy[j] = &stationCopy
+		}
+		if err := stationsCopy.markOwned(token); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// StationAssignRequest is for forcibly binding a station to a timeslot, releasing whatever either was bound to.
+type StationAssignRequest struct {
+	TimeslotID *uuid.UUID `json:"timeslot"` // Required
+}
+
+func init() {
+	rest.AddHandler("/admin/", "^station/(?P<id>[^/]+)/assign/$", func() interface{} { return &StationAssignRequest{} })
+}
+
+// Post binds the station to the timeslot in a single transaction, unbinding the timeslot previously bound to the station
+// and the station previously bound to the timeslot (if any), keeping the station statuses as-is.
+// The override is recorded in the station history and as notes for the affected stations.
+func (assignRequest *StationAssignRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	stationID, uuidErr := uuid.Parse(request.PathArgs["id"])
+	if uuidErr != nil {
+		return rest.BadRequest("invalid ID")
+	}
+	if assignRequest.TimeslotID == nil {
+		return rest.BadRequest("missing timeslot ID")
+	}
+
+	var previousTimeslotID string
+	var previousStationIDs []*uuid.UUID
+	result := rest.InTransaction(request, func() rest.Result {
+		tx := request.Executor()
+
+		// Lock both sides, so concurrent begins and the queue worker see the result
+		if _, err := tx.Exec("SELECT id FROM stations WHERE id = $1 OR timeslot = $2 FOR UPDATE", stationID, assignRequest.TimeslotID.String()); err != nil {
+			return rest.InternalError(err)
+		}
+		if _, err := tx.Exec("SELECT id FROM timeslots WHERE id = $1 FOR UPDATE", assignRequest.TimeslotID); err != nil {
+			return rest.InternalError(err)
+		}
+
+		// Get and check the station and timeslot
+		var station Station
+		stationDBResult := db.SelectWith(tx, &station, "stations", "id", "=", stationID)
+		if stationDBResult.IsFailed() {
+			return rest.InternalError(stationDBResult.Error)
+		}
+		if !stationDBResult.IsSuccess() {
+			return rest.NotFound("station not found")
+		}
+		var timeslot Timeslot
+		timeslotDBResult := db.SelectWith(tx, &timeslot, "timeslots", "id", "=", assignRequest.TimeslotID)
+		if timeslotDBResult.IsFailed() {
+			return rest.InternalError(timeslotDBResult.Error)
+		}
+		if !timeslotDBResult.IsSuccess() {
+			return rest.BadRequest("referenced timeslot does not exist")
+		}
+		if result := checkTrackOperator(request.AccessToken, station.TrackID); !result.IsOk() {
+			return result
+		}
+		switch {
+		case timeslot.TrackID != station.TrackID:
+			return rest.BadRequest("timeslot belongs to another track")
+		case station.Status == StationStatusTerminated || station.Status == StationStatusFailed:
+			return rest.Conflict("station is terminated or failed")
+		case timeslot.CancelTime != nil:
+			return rest.Conflict("timeslot is cancelled")
+		case timeslot.EndTime != nil && timeslot.EndTime.Before(time.Now()):
+			return rest.Conflict("timeslot has ended")
+		case timeslot.Status == TimeslotStatusPending:
+			return rest.Conflict("timeslot is pending approval")
+		}
+		if station.TimeslotID.String == timeslot.ID.String() {
+			// Already bound
+			return rest.Result{}
+		}
+
+		// Release the station currently bound to the timeslot, if any
+		var previousStations Stations
+		previousDBResult := db.SelectManyWith(tx, &previousStations, "stations", "timeslot", "=", timeslot.ID.String())
+		if previousDBResult.IsFailed() {
+			return rest.InternalError(previousDBResult.Error)
+		}
+		for _, previousStation := range previousStations {
+			previousText := fmt.Sprintf("Released from timeslot %v, which was manually assigned to station %v", timeslot.ID, station.Shortname)
+			if _, err := tx.Exec("UPDATE stations SET timeslot = NULL, notes = $2, version = version + 1, updated_at = now() WHERE id = $1", previousStation.ID, previousText); err != nil {
+				return rest.InternalError(err)
+			}
+			if err := endStationHistoryWith(tx, previousStation.ID, StationHistoryOutcomeReleased); err != nil {
+				return rest.InternalError(err)
+			}
+			if err := recordStationNote(tx, *previousStation.ID, &request.AccessToken, previousText, nil); err != nil {
+				return rest.InternalError(err)
+			}
+			previousStationIDs = append(previousStationIDs, previousStation.ID)
+		}
+
+		// Release the timeslot currently bound to the station, if any
+		previousTimeslotID = station.TimeslotID.String
+		if previousTimeslotID != "" {
+			if err := endStationHistoryWith(tx, station.ID, StationHistoryOutcomeReleased); err != nil {
+				return rest.InternalError(err)
+			}
+		}
+
+		// Bind them (recording the override as the latest note) and start the timeslot, unless already started
+		text := fmt.Sprintf("Manually assigned to timeslot %v", timeslot.ID)
+		if previousTimeslotID != "" {
+			text += fmt.Sprintf(", replacing timeslot %v", previousTimeslotID)
+		}
+		station.TimeslotID = db.StringOrNull(timeslot.ID.String())
+		if _, err := tx.Exec("UPDATE stations SET timeslot = $1, notes = $2, version = version + 1, updated_at = now() WHERE id = $3", station.TimeslotID, text, station.ID); err != nil {
+			return rest.InternalError(err)
+		}
+		if err := recordStationNote(tx, stationID, &request.AccessToken, text, nil); err != nil {
+			return rest.InternalError(err)
+		}
+		if timeslot.BeginTime == nil || timeslot.EndTime == nil {
+			beginTime := time.Now()
+			endTime := beginTime.AddDate(1000, 0, 0) // +1000 years
+			timeslot.BeginTime = &beginTime
+			timeslot.EndTime = &endTime
+			if dbResult := db.UpdateWith(tx, "timeslots", &timeslot, "id", "=", timeslot.ID); dbResult.IsFailed() {
+				return rest.InternalError(dbResult.Error)
+			}
+		}
+		if err := beginStationHistoryWith(tx, &station, &timeslot); err != nil {
+			return rest.InternalError(err)
+		}
+		if dbResult := db.DeleteWith(tx, "queue_entries", "timeslot", "=", timeslot.ID); dbResult.IsFailed() {
+			return rest.InternalError(dbResult.Error)
+		}
+		return rest.Result{}
+	})
+	if !result.IsOk() {
+		return result
+	}
+	db.NotifyWrite("stations")
+	db.NotifyWrite("timeslots")
+
+	request.Log.WithFields(log.Fields{
+		"station":           stationID,
+		"timeslot":          assignRequest.TimeslotID,
+		"previous_timeslot": previousTimeslotID,
+		"previous_stations": previousStationIDs,
+		"token":             request.AccessToken.ID,
+	}).Info("Manually assigned station to timeslot")
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/station/%v/", config.Get().SitePrefix, stationID)}
+}
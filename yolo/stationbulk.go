@@ -0,0 +1,216 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/worker"
+	"github.com/google/uuid"
+)
+
+// StationBulkAction is an action for all stations matching a bulk request filter.
+type StationBulkAction string
+
+const (
+	// StationBulkActionTerminate terminates the (dynamic) stations, like /station/<id>/terminate/.
+	StationBulkActionTerminate StationBulkAction = "terminate"
+	// StationBulkActionSetStatus sets the status of the stations.
+	StationBulkActionSetStatus StationBulkAction = "set-status"
+	// StationBulkActionClearTimeslot unassigns the stations from their timeslots.
+	StationBulkActionClearTimeslot StationBulkAction = "clear-timeslot"
+)
+
+// StationBulkRequest applies an action to all stations matching the filter.
+// The request fields are posted and the same object is returned with the matched stations.
+type StationBulkRequest struct {
+	TrackID   string             `json:"track"`      // Filter, at least one of track and status is required
+	Status    StationStatus      `json:"status"`     // Filter
+	Action    StationBulkAction  `json:"action"`     // Required
+	NewStatus StationStatus      `json:"new_status"` // Required for set-status
+	DryRun    bool               `json:"dry_run"`    // Only list the matched stations, without changing anything
+	Stations  []*StationBulkItem `json:"stations"`   // Output
+	Ok        int                `json:"ok"`         // Output, changed stations
+	Failed    int                `json:"failed"`     // Output, stations which failed to terminate
+}
+
+// StationBulkItem is the outcome of the bulk action for a single station.
+type StationBulkItem struct {
+	ID        *uuid.UUID    `json:"id"`
+	TrackID   string        `json:"track"`
+	Shortname string        `json:"shortname"`
+	Status    StationStatus `json:"status"`          // Before the action
+	Error     string        `json:"error,omitempty"` // If it failed
+}
+
+func init() {
+	rest.AddHandler("/admin/", "^stations/bulk/$", func() interface{} { return &StationBulkRequest{} })
+}
+
+// Post applies the action to all matching stations.
+// Status and timeslot changes are applied in a single transaction. Terminations can't be rolled back
+// since they destroy VMs, so all matching stations are checked before terminating any of them,
+// and the rest are still terminated if one fails.
+func (bulkRequest *StationBulkRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Validate
+	if bulkRequest.TrackID == "" && bulkRequest.Status == StationStatusInvalid {
+		return rest.BadRequest("missing filter, at least one of track and status is required")
+	}
+	if bulkRequest.Status != StationStatusInvalid && !validateStationStatus(bulkRequest.Status) {
+		return rest.BadRequest("invalid status filter")
+	}
+	switch bulkRequest.Action {
+	case StationBulkActionTerminate, StationBulkActionClearTimeslot:
+	case StationBulkActionSetStatus:
+		if !validateStationStatus(bulkRequest.NewStatus) {
+			return rest.BadRequest("missing or invalid new status")
+		}
+	default:
+		return rest.BadRequest("missing or invalid action")
+	}
+
+	// Find matching stations
+	var whereArgs []interface{}
+	if bulkRequest.TrackID != "" {
+		whereArgs = append(whereArgs, "track", "=", bulkRequest.TrackID)
+	}
+	if bulkRequest.Status != StationStatusInvalid {
+		whereArgs = append(whereArgs, "status", "=", bulkRequest.Status)
+	}
+	var stations Stations
+	dbResult := db.SelectManyOrdered(&stations, "stations", "track, shortname", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	trackIDs := make([]string, 0)
+	for _, station := range stations {
+		trackIDs = append(trackIDs, station.TrackID)
+	}
+	if result := checkTrackOperator(request.AccessToken, trackIDs...); !result.IsOk() {
+		return result
+	}
+	bulkRequest.Stations = make([]*StationBulkItem, 0, len(stations))
+	for _, station := range stations {
+		bulkRequest.Stations = append(bulkRequest.Stations, &StationBulkItem{
+			ID:        station.ID,
+			TrackID:   station.TrackID,
+			Shortname: station.Shortname,
+			Status:    station.Status,
+		})
+	}
+
+	// Check that all can be terminated before terminating any
+	if bulkRequest.Action == StationBulkActionTerminate {
+		for _, station := range stations {
+			if _, result := station.checkTerminable(); !result.IsOk() {
+				if result.Error != nil {
+					return result
+				}
+				return rest.Result{Code: result.Code, Message: fmt.Sprintf("station %v: %v", station.ID, result.Message)}
+			}
+		}
+	}
+	if bulkRequest.DryRun {
+		return rest.Result{}
+	}
+
+	// Apply
+	var result rest.Result
+	if bulkRequest.Action == StationBulkActionTerminate {
+		result = bulkRequest.terminate(stations)
+	} else {
+		result = bulkRequest.update(stations)
+	}
+	if !result.IsOk() {
+		return result
+	}
+	request.Log.WithField("action", bulkRequest.Action).Infof("Applied bulk station action to %v stations (%v failed)", bulkRequest.Ok, bulkRequest.Failed)
+	return rest.Result{}
+}
+
+// terminate terminates the stations one by one, recording failures.
+func (bulkRequest *StationBulkRequest) terminate(stations Stations) rest.Result {
+	for i, station := range stations {
+		if result := station.Terminate(); !result.IsOk() {
+			bulkRequest.Failed++
+			if result.Error != nil {
+				bulkRequest.Stations[i].Error = result.Error.Error()
+			} else {
+				bulkRequest.Stations[i].Error = result.Message
+			}
+			continue
+		}
+		bulkRequest.Ok++
+	}
+	return rest.Result{}
+}
+
+// update sets the status or clears the timeslot of the stations, in a single transaction.
+func (bulkRequest *StationBulkRequest) update(stations Stations) rest.Result {
+	tx, txErr := db.DB.Begin()
+	if txErr != nil {
+		return rest.InternalError(txErr)
+	}
+	defer tx.Rollback()
+
+	readyForQueue := false
+	for _, station := range stations {
+		previousStatus := station.Status
+		switch bulkRequest.Action {
+		case StationBulkActionSetStatus:
+			station.Status = bulkRequest.NewStatus
+		case StationBulkActionClearTimeslot:
+			if !station.TimeslotID.Valid {
+				continue
+			}
+			if err := endStationHistoryWith(tx, station.ID, StationHistoryOutcomeReleased); err != nil {
+				return rest.InternalError(err)
+			}
+			station.TimeslotID = db.NullString{}
+		}
+		if dbResult := db.UpdateWith(tx, "stations", station, "id", "=", station.ID); dbResult.IsFailed() {
+			return rest.InternalError(dbResult.Error)
+		}
+		if err := queueStationStatusChanged(tx, station, previousStatus); err != nil {
+			return rest.InternalError(err)
+		}
+		if station.Status == StationStatusReady && !station.TimeslotID.Valid {
+			readyForQueue = true
+		}
+		bulkRequest.Ok++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return rest.InternalError(err)
+	}
+	if readyForQueue {
+		// Let the queue have them
+		worker.Trigger(queueWorkerTaskName)
+	}
+	return rest.Result{}
+}
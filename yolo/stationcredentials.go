@@ -0,0 +1,194 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// generatedPasswordLength is the length of passwords generated when rotating credentials.
+const generatedPasswordLength = 20
+
+// generatedPasswordAlphabet avoids characters which are easily confused or annoying to type.
+const generatedPasswordAlphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// StationRotateCredentialsRequest is for replacing the password of a dynamic station, e.g. after it got leaked on stream.
+type StationRotateCredentialsRequest struct{}
+
+type serverSetPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+func init() {
+	rest.AddIdempotentHandler("/station/", "^(?P<id>[^/]+)/rotate-credentials/$", func() interface{} { return &StationRotateCredentialsRequest{} })
+}
+
+// Post generates a new password, pushes it to the station service and updates the stored credentials.
+// May be called by the owners of the timeslot assigned to the station and by operators/admins.
+func (rotateRequest *StationRotateCredentialsRequest) Post(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Get station
+	var station Station
+	stationDBResult := db.Select(&station, "stations", "id", "=", id)
+	if stationDBResult.IsFailed() {
+		return rest.InternalError(stationDBResult.Error)
+	}
+	if !stationDBResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		owned := false
+		if station.TimeslotID.Valid {
+			timeslotID, err := uuid.Parse(station.TimeslotID.String)
+			if err != nil {
+				return rest.InternalError(err)
+			}
+			timeslot := Timeslot{ID: &timeslotID}
+			if owned, err = timeslot.isOwnedByID(request.AccessToken.OwnerUserID); err != nil {
+				return rest.InternalError(err)
+			}
+		}
+		if !owned {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+	} else if result := checkTrackOperator(request.AccessToken, station.TrackID); !result.IsOk() {
+		return result
+	}
+
+	if result := station.RotateCredentials(); !result.IsOk() {
+		return result
+	}
+	request.Log.WithFields(log.Fields{
+		"station":  station.ID,
+		"timeslot": station.TimeslotID,
+	}).Info("Rotated station credentials")
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/station/%v/", config.Get().SitePrefix, station.ID)}
+}
+
+// RotateCredentials sets a new generated password for the station through the station service, if the track supports it.
+// The service responds with the updated entry, which replaces the credentials.
+// The receiver station should already be loaded and exist in the database.
+func (station *Station) RotateCredentials() rest.Result {
+	if station.Status == StationStatusTerminated {
+		return rest.BadRequest("station is terminated")
+	}
+
+	// Get track
+	var track Track
+	trackDBResult := db.Select(&track, "tracks", "id", "=", station.TrackID)
+	if trackDBResult.IsFailed() {
+		return rest.InternalError(trackDBResult.Error)
+	}
+	if !trackDBResult.IsSuccess() {
+		return rest.NotFound("track not found")
+	}
+
+	// Check if track type supports it and if the config is present
+	if behavior, ok := track.behavior(); !ok || behavior.ProvisioningMode != StationProvisioningModeDynamic {
+		return rest.BadRequest("track type does not support rotating credentials")
+	}
+	trackConfig, trackConfigOk := config.Get().ServerTracks[track.ID]
+	if !trackConfigOk || trackConfig.BaseURL == "" {
+		return rest.BadRequest("track type is not configured for dynamic stations")
+	}
+
+	// Call station service
+	password, passwordErr := generatePassword()
+	if passwordErr != nil {
+		return rest.InternalError(passwordErr)
+	}
+	requestJSON, requestJSONError := json.Marshal(serverSetPasswordRequest{Password: password})
+	if requestJSONError != nil {
+		return rest.InternalError(requestJSONError)
+	}
+	serviceURL := fmt.Sprintf("%v/api/entry/%v/password", trackConfig.BaseURL, station.Shortname)
+	serviceRequest, serviceRequestErr := http.NewRequest("PUT", serviceURL, bytes.NewBuffer(requestJSON))
+	if serviceRequestErr != nil {
+		return rest.InternalError(serviceRequestErr)
+	}
+	serviceRequest.SetBasicAuth(trackConfig.AuthUsername, trackConfig.AuthPassword)
+	serviceRequest.Header.Set("Content-Type", "application/json")
+	serviceClient := &http.Client{}
+	serviceResponse, serviceResponseErr := serviceClient.Do(serviceRequest)
+	if serviceResponseErr != nil {
+		return rest.InternalError(serviceResponseErr)
+	}
+	defer serviceResponse.Body.Close()
+	if serviceResponse.StatusCode < 200 || serviceResponse.StatusCode > 299 {
+		return rest.InternalError(fmt.Errorf("response contained non-2XX status: %v", serviceResponse.Status))
+	}
+	serviceResponseBody, serviceResponseBodyErr := ioutil.ReadAll(serviceResponse.Body)
+	if serviceResponseBodyErr != nil {
+		return rest.InternalError(serviceResponseBodyErr)
+	}
+	var responseData serverCreateStationResponse
+	if err := json.Unmarshal(serviceResponseBody, &responseData); err != nil {
+		return rest.InternalError(err)
+	}
+	if responseData.Password == "" {
+		responseData.Password = password
+	}
+	log.Tracef("VM service set new password for instance: %v", station.ID)
+
+	// Save
+	now := time.Now()
+	station.Credentials = responseData.credentials()
+	station.CredentialsRotateTime = &now
+	dbResult := db.Update("stations", station, "id", "=", station.ID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// generatePassword generates a random password.
+func generatePassword() (string, error) {
+	password := make([]byte, generatedPasswordLength)
+	alphabetSize := big.NewInt(int64(len(generatedPasswordAlphabet)))
+	for i := range password {
+		index, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			return "", err
+		}
+		password[i] = generatedPasswordAlphabet[index.Int64()]
+	}
+	return string(password), nil
+}
@@ -0,0 +1,334 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// StationHistoryOutcome is how a station assignment period ended.
+type StationHistoryOutcome string
+
+const (
+	// StationHistoryOutcomeActive means the station is still assigned.
+	StationHistoryOutcomeActive StationHistoryOutcome = ""
+	// StationHistoryOutcomeFinished means the timeslot was finished, manually or automatically.
+	StationHistoryOutcomeFinished StationHistoryOutcome = "finished"
+	// StationHistoryOutcomeCancelled means the timeslot was cancelled.
+	StationHistoryOutcomeCancelled StationHistoryOutcome = "cancelled"
+	// StationHistoryOutcomeTerminated means the (dynamic) station was terminated.
+	StationHistoryOutcomeTerminated StationHistoryOutcome = "terminated"
+	// StationHistoryOutcomeReleased means the station was manually unassigned or reassigned.
+	StationHistoryOutcomeReleased StationHistoryOutcome = "released"
+)
+
+// StationHistoryEntry is a period where a station was assigned to a timeslot.
+type StationHistoryEntry struct {
+	ID         *uuid.UUID            `column:"id" json:"id"`
+	StationID  *uuid.UUID            `column:"station" json:"station"`
+	TrackID    string                `column:"track" json:"track"`
+	TimeslotID string                `column:"timeslot" json:"timeslot"`
+	UserID     *uuid.UUID            `column:"user" json:"user"`
+	BeginTime  *time.Time            `column:"begin_time" json:"begin_time"`
+	EndTime    *time.Time            `column:"end_time" json:"end_time"` // Empty while active
+	Outcome    StationHistoryOutcome `column:"outcome" json:"outcome"`   // Empty while active
+}
+
+// StationHistory is a list of station history entries.
+type StationHistory []*StationHistoryEntry
+
+// StationUtilizationReport summarizes station usage within a period.
+type StationUtilizationReport struct {
+	Since    *time.Time            `json:"since"`
+	Until    *time.Time            `json:"until"`
+	Stations []*StationUtilization `json:"stations"`
+	Tracks   []*TrackUtilization   `json:"tracks"`
+}
+
+// StationUtilization is the usage of a single station.
+type StationUtilization struct {
+	StationID        *uuid.UUID     `json:"station"`
+	StationShortname string         `json:"station_shortname"`
+	TrackID          string         `json:"track"`
+	Assignments      int            `json:"assignments"`
+	Users            int            `json:"users"`        // Distinct users
+	UsedSeconds      float64        `json:"used_seconds"` // Assigned time within the period
+	Utilization      float64        `json:"utilization"`  // Used time divided by the period
+	Outcomes         map[string]int `json:"outcomes"`     // Assignments by outcome ("active" while still assigned)
+}
+
+// TrackUtilization is the combined usage of all stations in a track.
+type TrackUtilization struct {
+	TrackID                  string         `json:"track"`
+	Stations                 int            `json:"stations"` // Stations used
+	Assignments              int            `json:"assignments"`
+	Users                    int            `json:"users"` // Distinct users
+	UsedSeconds              float64        `json:"used_seconds"`
+	AverageAssignmentSeconds *float64       `json:"average_assignment_seconds"`
+	Outcomes                 map[string]int `json:"outcomes"`
+}
+
+func init() {
+	rest.AddHandler("/admin/", "^station-history/$", func() interface{} { return &StationHistory{} })
+	rest.AddHandler("/admin/", "^reports/station-utilization/$", func() interface{} { return &StationUtilizationReport{} })
+}
+
+// Get gets station history, newest first.
+func (history *StationHistory) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if stationID, ok := request.QueryArgs["station"]; ok {
+		whereArgs = append(whereArgs, "station", "=", stationID)
+	}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+	if timeslotID, ok := request.QueryArgs["timeslot"]; ok {
+		whereArgs = append(whereArgs, "timeslot", "=", timeslotID)
+	}
+
+	// Get
+	dbResult := db.SelectManyOrdered(history, "station_history", "begin_time DESC", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Get summarizes station usage per station and per track.
+// The period defaults to from the first recorded assignment until now.
+func (report *StationUtilizationReport) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+	now := time.Now()
+	report.Until = &now
+	if rawUntil, ok := request.QueryArgs["until"]; ok {
+		until, err := time.Parse(time.RFC3339, rawUntil)
+		if err != nil {
+			return rest.BadRequest("invalid until time (expected RFC 3339)")
+		}
+		report.Until = &until
+	}
+	whereArgs = append(whereArgs, "begin_time", "<", *report.Until)
+	if rawSince, ok := request.QueryArgs["since"]; ok {
+		since, err := time.Parse(time.RFC3339, rawSince)
+		if err != nil {
+			return rest.BadRequest("invalid since time (expected RFC 3339)")
+		}
+		if !since.Before(*report.Until) {
+			return rest.BadRequest("since time must be before until time")
+		}
+		report.Since = &since
+	}
+
+	// Get history and stations
+	var history StationHistory
+	historyDBResult := db.SelectManyOrdered(&history, "station_history", "begin_time", whereArgs...)
+	if historyDBResult.IsFailed() {
+		return rest.InternalError(historyDBResult.Error)
+	}
+	var stations Stations
+	stationsDBResult := db.SelectMany(&stations, "stations")
+	if stationsDBResult.IsFailed() {
+		return rest.InternalError(stationsDBResult.Error)
+	}
+	stationShortnames := make(map[uuid.UUID]string, len(stations))
+	for _, station := range stations {
+		stationShortnames[*station.ID] = station.Shortname
+	}
+	if report.Since == nil {
+		report.Since = report.Until
+		if len(history) > 0 && history[0].BeginTime.Before(*report.Until) {
+			report.Since = history[0].BeginTime
+		}
+	}
+	periodSeconds := report.Until.Sub(*report.Since).Seconds()
+
+	// Aggregate per station and track
+	stationUtilizations := make(map[uuid.UUID]*StationUtilization)
+	trackUtilizations := make(map[string]*TrackUtilization)
+	stationUsers := make(map[uuid.UUID]map[uuid.UUID]bool)
+	trackUsers := make(map[string]map[uuid.UUID]bool)
+	trackStations := make(map[string]map[uuid.UUID]bool)
+	for _, entry := range history {
+		// Clip to the period, skipping entries ended before it
+		if entry.EndTime != nil && !entry.EndTime.After(*report.Since) {
+			continue
+		}
+		beginTime := *entry.BeginTime
+		if beginTime.Before(*report.Since) {
+			beginTime = *report.Since
+		}
+		endTime := *report.Until
+		if entry.EndTime != nil && entry.EndTime.Before(endTime) {
+			endTime = *entry.EndTime
+		}
+		usedSeconds := endTime.Sub(beginTime).Seconds()
+		outcome := string(entry.Outcome)
+		if entry.Outcome == StationHistoryOutcomeActive {
+			outcome = "active"
+		}
+
+		stationUtilization, ok := stationUtilizations[*entry.StationID]
+		if !ok {
+			stationUtilization = &StationUtilization{
+				StationID:        entry.StationID,
+				StationShortname: stationShortnames[*entry.StationID],
+				TrackID:          entry.TrackID,
+				Outcomes:         make(map[string]int),
+			}
+			stationUtilizations[*entry.StationID] = stationUtilization
+			stationUsers[*entry.StationID] = make(map[uuid.UUID]bool)
+		}
+		stationUtilization.Assignments++
+		stationUtilization.UsedSeconds += usedSeconds
+		stationUtilization.Outcomes[outcome]++
+
+		trackUtilization, ok := trackUtilizations[entry.TrackID]
+		if !ok {
+			trackUtilization = &TrackUtilization{
+				TrackID:  entry.TrackID,
+				Outcomes: make(map[string]int),
+			}
+			trackUtilizations[entry.TrackID] = trackUtilization
+			trackUsers[entry.TrackID] = make(map[uuid.UUID]bool)
+			trackStations[entry.TrackID] = make(map[uuid.UUID]bool)
+		}
+		trackUtilization.Assignments++
+		trackUtilization.UsedSeconds += usedSeconds
+		trackUtilization.Outcomes[outcome]++
+		trackStations[entry.TrackID][*entry.StationID] = true
+
+		if entry.UserID != nil {
+			stationUsers[*entry.StationID][*entry.UserID] = true
+			trackUsers[entry.TrackID][*entry.UserID] = true
+		}
+	}
+
+	// Finish and sort
+	report.Stations = make([]*StationUtilization, 0, len(stationUtilizations))
+	for stationID, stationUtilization := range stationUtilizations {
+		stationUtilization.Users = len(stationUsers[stationID])
+		if periodSeconds > 0 {
+			stationUtilization.Utilization = stationUtilization.UsedSeconds / periodSeconds
+		}
+		report.Stations = append(report.Stations, stationUtilization)
+	}
+	sort.Slice(report.Stations, func(i, j int) bool {
+		if report.Stations[i].TrackID != report.Stations[j].TrackID {
+			return report.Stations[i].TrackID < report.Stations[j].TrackID
+		}
+		return report.Stations[i].StationShortname < report.Stations[j].StationShortname
+	})
+	report.Tracks = make([]*TrackUtilization, 0, len(trackUtilizations))
+	for trackID, trackUtilization := range trackUtilizations {
+		trackUtilization.Users = len(trackUsers[trackID])
+		trackUtilization.Stations = len(trackStations[trackID])
+		average := trackUtilization.UsedSeconds / float64(trackUtilization.Assignments)
+		trackUtilization.AverageAssignmentSeconds = &average
+		report.Tracks = append(report.Tracks, trackUtilization)
+	}
+	sort.Slice(report.Tracks, func(i, j int) bool {
+		return report.Tracks[i].TrackID < report.Tracks[j].TrackID
+	})
+
+	return rest.Result{}
+}
+
+// beginStationHistory records that the station got assigned to the timeslot.
+func beginStationHistory(station *Station, timeslot *Timeslot) error {
+	return beginStationHistoryWith(db.DB, station, timeslot)
+}
+
+// beginStationHistoryWith is like beginStationHistory, but uses the provided executor, e.g. a transaction.
+func beginStationHistoryWith(executor db.Executor, station *Station, timeslot *Timeslot) error {
+	id := uuid.New()
+	now := time.Now()
+	entry := StationHistoryEntry{
+		ID:         &id,
+		StationID:  station.ID,
+		TrackID:    station.TrackID,
+		TimeslotID: timeslot.ID.String(),
+		UserID:     timeslot.UserID,
+		BeginTime:  &now,
+	}
+	if dbResult := db.InsertWith(executor, "station_history", &entry); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	return nil
+}
+
+// endStationHistory records that the station's active assignment (if any) ended.
+func endStationHistory(stationID *uuid.UUID, outcome StationHistoryOutcome) error {
+	return endStationHistoryWith(db.DB, stationID, outcome)
+}
+
+// endStationHistoryWith is like endStationHistory, but uses the provided executor, e.g. a transaction.
+func endStationHistoryWith(executor db.Executor, stationID *uuid.UUID, outcome StationHistoryOutcome) error {
+	_, err := executor.Exec("UPDATE station_history SET end_time = $1, outcome = $2 WHERE station = $3 AND end_time IS NULL", time.Now(), outcome, stationID)
+	if err != nil {
+		return err
+	}
+	db.NotifyWrite("station_history")
+	return nil
+}
+
+// recordAssignmentChange records manual (un)assignments, given the timeslot previously assigned to the station.
+func (station *Station) recordAssignmentChange(previousTimeslotID string) error {
+	if station.TimeslotID.String == previousTimeslotID {
+		return nil
+	}
+	if previousTimeslotID != "" {
+		if err := endStationHistory(station.ID, StationHistoryOutcomeReleased); err != nil {
+			return err
+		}
+	}
+	if !station.TimeslotID.Valid {
+		return nil
+	}
+	var timeslot Timeslot
+	dbResult := db.Select(&timeslot, "timeslots", "id", "=", station.TimeslotID)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if !dbResult.IsSuccess() {
+		return nil
+	}
+	return beginStationHistory(station, &timeslot)
+}
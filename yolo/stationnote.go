@@ -0,0 +1,148 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// StationNote is an entry in the append-only notes history of a station.
+// The notes field of the station shows the latest entry, for compatibility.
+type StationNote struct {
+	ID          *uuid.UUID `column:"id" json:"id"`
+	StationID   *uuid.UUID `column:"station" json:"station"`
+	AuthorToken *uuid.UUID `column:"author_token" json:"author_token"` // Empty if written by the backend itself (e.g. provisioning)
+	AuthorUser  *uuid.UUID `column:"author_user" json:"author_user"`   // Owner of the author token, if any
+	Time        *time.Time `column:"time" json:"time"`
+	Text        string     `column:"text" json:"text"`
+}
+
+// StationNotes is the notes history of a station, newest first.
+type StationNotes []*StationNote
+
+func init() {
+	// Same path, the first one implementing the method is used
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/notes/$", func() interface{} { return &StationNotes{} })
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/notes/$", func() interface{} { return &StationNote{} })
+}
+
+// Get gets the notes history of a station, newest first.
+func (notes *StationNotes) Get(request *rest.Request) rest.Result {
+	// Check perms
+	role := request.AccessToken.GetRole()
+	if role != rest.RoleOperator && role != rest.RoleAdmin && role != rest.RoleRunner {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, uuidErr := uuid.Parse(request.PathArgs["id"])
+	if uuidErr != nil {
+		return rest.BadRequest("invalid ID")
+	}
+	exists, err := stores.Stations.Exists(id)
+	if err != nil {
+		return rest.InternalError(err)
+	}
+	if !exists {
+		return rest.NotFound("not found")
+	}
+
+	// Get
+	dbResult := db.SelectManyOrdered(notes, "station_notes", "time DESC", "station", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Post appends a note to the history of a station, which also becomes the notes field of the station.
+// Only the text is used from the input.
+func (note *StationNote) Post(request *rest.Request) rest.Result {
+	// Check perms
+	role := request.AccessToken.GetRole()
+	if role != rest.RoleOperator && role != rest.RoleAdmin && role != rest.RoleRunner {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, uuidErr := uuid.Parse(request.PathArgs["id"])
+	if uuidErr != nil {
+		return rest.BadRequest("invalid ID")
+	}
+	if strings.TrimSpace(note.Text) == "" {
+		return rest.BadRequest("missing text")
+	}
+	exists, err := stores.Stations.Exists(id)
+	if err != nil {
+		return rest.InternalError(err)
+	}
+	if !exists {
+		return rest.NotFound("not found")
+	}
+
+	// Save it, both as an entry and as the station notes
+	result := rest.InTransaction(request, func() rest.Result {
+		if err := recordStationNote(request.Executor(), id, &request.AccessToken, note.Text, note); err != nil {
+			return rest.InternalError(err)
+		}
+		if _, err := request.Executor().Exec("UPDATE stations SET notes = $1, version = version + 1, updated_at = now() WHERE id = $2", note.Text, id); err != nil {
+			return rest.InternalError(err)
+		}
+		return rest.Result{}
+	})
+	if !result.IsOk() {
+		return result
+	}
+	db.NotifyWrite("stations")
+	return rest.Created(fmt.Sprintf("%v/station/%v/notes/", config.Get().SitePrefix, id))
+}
+
+// recordStationNote adds an entry to the notes history of the station, without changing the station itself.
+// The author token may be nil for changes by the backend itself. The entry is saved into note, if not nil.
+func recordStationNote(executor db.Executor, stationID uuid.UUID, author *rest.AccessTokenEntry, text string, note *StationNote) error {
+	if note == nil {
+		note = &StationNote{}
+	}
+	id := uuid.New()
+	now := time.Now()
+	*note = StationNote{ID: &id, StationID: &stationID, Time: &now, Text: text}
+	if author != nil {
+		authorToken := author.ID
+		note.AuthorToken = &authorToken
+		note.AuthorUser = author.OwnerUserID
+	}
+	return db.InsertWith(executor, "station_notes", note).Error
+}
+
+// recordNotesChange adds the notes of the station to the history if changed by a station create or update.
+func (station *Station) recordNotesChange(previousNotes string, author *rest.AccessTokenEntry) error {
+	if station.Notes == previousNotes {
+		return nil
+	}
+	return recordStationNote(db.DB, *station.ID, author, station.Notes, nil)
+}
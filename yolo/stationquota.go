@@ -0,0 +1,190 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// StationQuotaOverride replaces the per-user limits for dynamic stations from the track config for a single user.
+type StationQuotaOverride struct {
+	UserID              *uuid.UUID `column:"user" json:"user"`                                     // Required, unique
+	MaxStations         int        `column:"max_stations" json:"max_stations"`                     // Concurrent stations, 0 for unlimited
+	MaxProvisionsPerDay int        `column:"max_provisions_per_day" json:"max_provisions_per_day"` // Stations within the last 24 hours, 0 for unlimited
+	Comment             string     `column:"comment" json:"comment"`                               // Optional, e.g. why
+}
+
+// StationQuotaOverrides is a list of station quota overrides.
+type StationQuotaOverrides []*StationQuotaOverride
+
+func init() {
+	rest.AddHandler("/admin/", "^station-quotas/$", func() interface{} { return &StationQuotaOverrides{} })
+	rest.AddHandler("/admin/", "^station-quota/(?P<user_id>[^/]+)/$", func() interface{} { return &StationQuotaOverride{} })
+}
+
+// Get gets all station quota overrides.
+func (overrides *StationQuotaOverrides) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	dbResult := db.SelectMany(overrides, "station_quota_overrides")
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Get gets the station quota override for a user.
+func (override *StationQuotaOverride) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	userID, userIDExists := request.PathArgs["user_id"]
+	if !userIDExists || userID == "" {
+		return rest.BadRequest("missing user ID")
+	}
+
+	dbResult := db.Select(override, "station_quota_overrides", "\"user\"", "=", userID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+	return rest.Result{}
+}
+
+// Put creates or replaces the station quota override for a user.
+func (override *StationQuotaOverride) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	rawUserID, rawUserIDExists := request.PathArgs["user_id"]
+	if !rawUserIDExists || rawUserID == "" {
+		return rest.BadRequest("missing user ID")
+	}
+	userID, uuidErr := uuid.Parse(rawUserID)
+	if uuidErr != nil {
+		return rest.BadRequest("invalid user ID")
+	}
+
+	// Validate
+	if override.UserID == nil {
+		override.UserID = &userID
+	}
+	if *override.UserID != userID {
+		return rest.BadRequest("mismatch between URL and JSON user IDs")
+	}
+	if override.MaxStations < 0 || override.MaxProvisionsPerDay < 0 {
+		return rest.BadRequest("limits can't be negative")
+	}
+	user := rest.User{ID: override.UserID}
+	if exists, err := user.ExistsWithID(); err != nil {
+		return rest.InternalError(err)
+	} else if !exists {
+		return rest.BadRequest("referenced user does not exist")
+	}
+
+	dbResult := db.Upsert("station_quota_overrides", override, "\"user\"", "=", override.UserID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Delete deletes the station quota override for a user, so the track limits apply again.
+func (override *StationQuotaOverride) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	userID, userIDExists := request.PathArgs["user_id"]
+	if !userIDExists || userID == "" {
+		return rest.BadRequest("missing user ID")
+	}
+
+	dbResult := db.Delete("station_quota_overrides", "\"user\"", "=", userID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if dbResult.Affected == 0 {
+		return rest.NotFound("not found")
+	}
+	return rest.Result{}
+}
+
+// checkUserStationQuota checks that another station may be provisioned for the user in the track,
+// using the user's override (if any) instead of the per-user limits from the track config.
+func checkUserStationQuota(trackID string, trackConfig config.ServerTrackConfig, userID uuid.UUID) rest.Result {
+	maxStations := trackConfig.MaxUserStations
+	maxProvisionsPerDay := trackConfig.MaxUserProvisionsPerDay
+	var override StationQuotaOverride
+	overrideDBResult := db.Select(&override, "station_quota_overrides", "\"user\"", "=", userID)
+	if overrideDBResult.IsFailed() {
+		return rest.InternalError(overrideDBResult.Error)
+	}
+	if overrideDBResult.IsSuccess() {
+		maxStations = override.MaxStations
+		maxProvisionsPerDay = override.MaxProvisionsPerDay
+	}
+
+	if maxStations > 0 {
+		var count int
+		row := db.DB.QueryRow("SELECT COUNT(*) FROM stations WHERE track = $1 AND provisioned_by = $2 AND status != $3 AND status != $4",
+			trackID, userID, StationStatusTerminated, StationStatusFailed)
+		if err := row.Scan(&count); err != nil {
+			return rest.InternalError(err)
+		}
+		if count >= maxStations {
+			return rest.Result{Code: 429, Message: fmt.Sprintf("user already has %v active dynamic stations in the track (max %v)", count, maxStations)}
+		}
+	}
+
+	if maxProvisionsPerDay > 0 {
+		var count int
+		row := db.DB.QueryRow("SELECT COUNT(*) FROM stations WHERE track = $1 AND provisioned_by = $2 AND provision_time > $3",
+			trackID, userID, time.Now().Add(-24*time.Hour))
+		if err := row.Scan(&count); err != nil {
+			return rest.InternalError(err)
+		}
+		if count >= maxProvisionsPerDay {
+			return rest.Result{Code: 429, Message: fmt.Sprintf("user has provisioned %v dynamic stations in the track within the last 24 hours (max %v)", count, maxProvisionsPerDay)}
+		}
+	}
+
+	return rest.Result{}
+}
@@ -0,0 +1,220 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+// TrackTestStats contains aggregated test stats for all tasks in a track.
+type TrackTestStats struct {
+	TrackID string           `json:"track"`
+	Tasks   []*TaskTestStats `json:"tasks"`
+}
+
+// TaskTestStats contains aggregated test stats for a single task.
+// A task is green for a timeslot or station when all its tests are successful.
+type TaskTestStats struct {
+	TaskShortname             string   `json:"task_shortname"`
+	TaskName                  string   `json:"task_name"`
+	Timeslots                 int      `json:"timeslots"`                     // Timeslots with any tests for the task
+	CompletedTimeslots        int      `json:"completed_timeslots"`           // Timeslots where the task is green
+	PassRate                  float64  `json:"pass_rate"`                     // Completed timeslots divided by timeslots
+	AverageTimeToGreenSeconds *float64 `json:"average_time_to_green_seconds"` // From timeslot begin until the task turned green (and stayed green)
+	GreenStations             int      `json:"green_stations"`                // Stations where the task is currently green
+	RedStations               int      `json:"red_stations"`                  // Stations where the task is currently red
+}
+
+// testStatsKey identifies the state of a task in a timeslot or station.
+type testStatsKey struct {
+	scope         string // Timeslot ID or station shortname
+	taskShortname string
+}
+
+func init() {
+	rest.AddHandler("/track/", "^(?P<track_id>[^/]+)/test-stats/$", func() interface{} { return &TrackTestStats{} })
+}
+
+// Get gets the test stats for a track.
+func (stats *TrackTestStats) Get(request *rest.Request) rest.Result {
+	// Check perms, guests may see the stats in public mode
+	role := request.AccessToken.GetRole()
+	if role != rest.RoleOperator && role != rest.RoleAdmin && !(rest.IsPublicMode() && !request.AccessToken.IsAuthenticated()) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.BadRequest("missing track ID")
+	}
+	if result := checkTrackVisible(request, trackID); !result.IsOk() {
+		return result
+	}
+	stats.TrackID = trackID
+
+	// Get tasks
+	var tasks Tasks
+	tasksDBResult := db.SelectMany(&tasks, "tasks", "track", "=", trackID)
+	if tasksDBResult.IsFailed() {
+		return rest.InternalError(tasksDBResult.Error)
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		if tasks[i].Sequence == nil || tasks[j].Sequence == nil {
+			return tasks[i].Sequence != nil
+		}
+		return *tasks[i].Sequence < *tasks[j].Sequence
+	})
+
+	// Get current tests, both per timeslot and latest per station
+	var tests Tests
+	testsDBResult := db.SelectMany(&tests, "tests", "track", "=", trackID)
+	if testsDBResult.IsFailed() {
+		return rest.InternalError(testsDBResult.Error)
+	}
+	timeslotGreen := make(map[testStatsKey]bool)
+	stationGreen := make(map[testStatsKey]bool)
+	for _, test := range tests {
+		success := test.StatusSuccess != nil && *test.StatusSuccess
+		var states map[testStatsKey]bool
+		var key testStatsKey
+		if !test.TimeslotID.Valid {
+			states = stationGreen
+			key = testStatsKey{test.StationShortname, test.TaskShortname}
+		} else {
+			states = timeslotGreen
+			key = testStatsKey{test.TimeslotID.String, test.TaskShortname}
+		}
+		if green, ok := states[key]; ok {
+			states[key] = green && success
+		} else {
+			states[key] = success
+		}
+	}
+
+	// Find time-to-green using the history
+	greenSinces, greenSincesErr := findTaskGreenSinces(trackID)
+	if greenSincesErr != nil {
+		return rest.InternalError(greenSincesErr)
+	}
+	var timeslots Timeslots
+	timeslotsDBResult := db.SelectMany(&timeslots, "timeslots", "track", "=", trackID)
+	if timeslotsDBResult.IsFailed() {
+		return rest.InternalError(timeslotsDBResult.Error)
+	}
+	timeslotBeginTimes := make(map[string]time.Time)
+	for _, timeslot := range timeslots {
+		if timeslot.BeginTime != nil {
+			timeslotBeginTimes[timeslot.ID.String()] = *timeslot.BeginTime
+		}
+	}
+
+	// Aggregate per task
+	stats.Tasks = make([]*TaskTestStats, 0, len(tasks))
+	for _, task := range tasks {
+		taskStats := &TaskTestStats{
+			TaskShortname: task.Shortname,
+			TaskName:      task.Name,
+		}
+		var totalTimeToGreen time.Duration
+		timeToGreenCount := 0
+		for key, green := range timeslotGreen {
+			if key.taskShortname != task.Shortname {
+				continue
+			}
+			taskStats.Timeslots++
+			if !green {
+				continue
+			}
+			taskStats.CompletedTimeslots++
+			beginTime, beginTimeOk := timeslotBeginTimes[key.scope]
+			greenSince, greenSinceOk := greenSinces[key]
+			if beginTimeOk && greenSinceOk && greenSince.After(beginTime) {
+				totalTimeToGreen += greenSince.Sub(beginTime)
+				timeToGreenCount++
+			}
+		}
+		if taskStats.Timeslots > 0 {
+			taskStats.PassRate = float64(taskStats.CompletedTimeslots) / float64(taskStats.Timeslots)
+		}
+		if timeToGreenCount > 0 {
+			average := totalTimeToGreen.Seconds() / float64(timeToGreenCount)
+			taskStats.AverageTimeToGreenSeconds = &average
+		}
+		for key, green := range stationGreen {
+			if key.taskShortname != task.Shortname {
+				continue
+			}
+			if green {
+				taskStats.GreenStations++
+			} else {
+				taskStats.RedStations++
+			}
+		}
+		stats.Tasks = append(stats.Tasks, taskStats)
+	}
+
+	return rest.Result{}
+}
+
+// findTaskGreenSinces finds when each task turned green for each timeslot, without turning red again after.
+// A task turns green when its last test turns green.
+func findTaskGreenSinces(trackID string) (map[testStatsKey]time.Time, error) {
+	var history TestHistory
+	dbResult := db.SelectMany(&history, "test_history", "track", "=", trackID, "timeslot", "!=", nil)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Timestamp.Before(*history[j].Timestamp)
+	})
+
+	// Find when each test last turned green
+	type testKey struct {
+		testStatsKey
+		shortname string
+	}
+	testGreenSinces := make(map[testKey]*time.Time)
+	for _, test := range history {
+		key := testKey{testStatsKey{test.TimeslotID.String, test.TaskShortname}, test.Shortname}
+		if test.StatusSuccess == nil || !*test.StatusSuccess {
+			testGreenSinces[key] = nil
+		} else if testGreenSinces[key] == nil {
+			testGreenSinces[key] = test.Timestamp
+		}
+	}
+
+	// The task turned green when the last test did
+	taskGreenSinces := make(map[testStatsKey]time.Time)
+	for key, greenSince := range testGreenSinces {
+		if greenSince == nil {
+			continue
+		}
+		if current, ok := taskGreenSinces[key.testStatsKey]; !ok || greenSince.After(current) {
+			taskGreenSinces[key.testStatsKey] = *greenSince
+		}
+	}
+	return taskGreenSinces, nil
+}
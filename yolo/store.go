@@ -0,0 +1,139 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"github.com/gathering/tech-online-backend/db"
+)
+
+// StationStore loads and saves stations.
+// Where args and ordering use the same format as the db package (column, operator, value).
+type StationStore interface {
+	Get(id interface{}) (*Station, error) // Nil if not found
+	List(orderBy string, whereArgs ...interface{}) (Stations, error)
+	Exists(id interface{}) (bool, error)
+	Insert(station *Station) error
+	Update(station *Station) error
+	Delete(id interface{}) (bool, error) // False if not found
+}
+
+// TimeslotStore loads and saves timeslots.
+// Where args and ordering use the same format as the db package (column, operator, value).
+type TimeslotStore interface {
+	Get(id interface{}) (*Timeslot, error) // Nil if not found
+	List(orderBy string, whereArgs ...interface{}) (Timeslots, error)
+	Exists(id interface{}) (bool, error)
+	Insert(timeslot *Timeslot) error
+	Update(timeslot *Timeslot) error
+	Delete(id interface{}) (bool, error) // False if not found
+}
+
+// Stores contains the stores used by the handlers.
+type Stores struct {
+	Stations  StationStore
+	Timeslots TimeslotStore
+}
+
+// stores are the stores used by the handlers, backed by the database unless replaced with UseStores.
+var stores = NewSQLStores()
+
+// UseStores replaces the stores used by the handlers, e.g. with NewMemoryStores for tests without a database.
+func UseStores(newStores Stores) {
+	stores = newStores
+}
+
+// NewSQLStores creates stores backed by the database.
+func NewSQLStores() Stores {
+	return Stores{
+		Stations:  sqlStationStore{},
+		Timeslots: sqlTimeslotStore{},
+	}
+}
+
+type sqlStationStore struct{}
+
+func (sqlStationStore) Get(id interface{}) (*Station, error) {
+	station, _, err := db.SelectOne[*Station]("stations", "id", "=", id)
+	return station, err
+}
+
+func (sqlStationStore) List(orderBy string, whereArgs ...interface{}) (Stations, error) {
+	return db.SelectAllOrdered[*Station]("stations", orderBy, whereArgs...)
+}
+
+func (sqlStationStore) Exists(id interface{}) (bool, error) {
+	dbResult := db.Exists("stations", "id", "=", id)
+	if dbResult.IsFailed() {
+		return false, dbResult.Error
+	}
+	return dbResult.IsSuccess(), nil
+}
+
+func (sqlStationStore) Insert(station *Station) error {
+	return db.Insert("stations", station).Error
+}
+
+func (sqlStationStore) Update(station *Station) error {
+	return db.Update("stations", station, "id", "=", station.ID).Error
+}
+
+func (sqlStationStore) Delete(id interface{}) (bool, error) {
+	dbResult := db.Delete("stations", "id", "=", id)
+	if dbResult.IsFailed() {
+		return false, dbResult.Error
+	}
+	return dbResult.Affected > 0, nil
+}
+
+type sqlTimeslotStore struct{}
+
+func (sqlTimeslotStore) Get(id interface{}) (*Timeslot, error) {
+	timeslot, _, err := db.SelectOne[*Timeslot]("timeslots", "id", "=", id)
+	return timeslot, err
+}
+
+func (sqlTimeslotStore) List(orderBy string, whereArgs ...interface{}) (Timeslots, error) {
+	return db.SelectAllOrdered[*Timeslot]("timeslots", orderBy, whereArgs...)
+}
+
+func (sqlTimeslotStore) Exists(id interface{}) (bool, error) {
+	dbResult := db.Exists("timeslots", "id", "=", id)
+	if dbResult.IsFailed() {
+		return false, dbResult.Error
+	}
+	return dbResult.IsSuccess(), nil
+}
+
+func (sqlTimeslotStore) Insert(timeslot *Timeslot) error {
+	return db.Insert("timeslots", timeslot).Error
+}
+
+func (sqlTimeslotStore) Update(timeslot *Timeslot) error {
+	return db.Update("timeslots", timeslot, "id", "=", timeslot.ID).Error
+}
+
+func (sqlTimeslotStore) Delete(id interface{}) (bool, error) {
+	dbResult := db.Delete("timeslots", "id", "=", id)
+	if dbResult.IsFailed() {
+		return false, dbResult.Error
+	}
+	return dbResult.Affected > 0, nil
+}
@@ -0,0 +1,379 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+)
+
+// NewMemoryStores creates empty in-memory stores, for tests without a database.
+// Only the "=", "!=", "<", "<=", ">", ">=" and "IN" operators are supported for where args.
+func NewMemoryStores() Stores {
+	return Stores{
+		Stations:  &memoryStationStore{stations: make(map[string]Station)},
+		Timeslots: &memoryTimeslotStore{timeslots: make(map[string]Timeslot)},
+	}
+}
+
+type memoryStationStore struct {
+	sync.Mutex
+	stations map[string]Station // By ID
+}
+
+func (store *memoryStationStore) Get(id interface{}) (*Station, error) {
+	store.Lock()
+	defer store.Unlock()
+	station, ok := store.stations[memoryKey(id)]
+	if !ok {
+		return nil, nil
+	}
+	return &station, nil
+}
+
+func (store *memoryStationStore) List(orderBy string, whereArgs ...interface{}) (Stations, error) {
+	store.Lock()
+	defer store.Unlock()
+	stations := make(Stations, 0)
+	for _, station := range store.stations {
+		station := station
+		matches, err := memoryMatches(&station, whereArgs)
+		if err != nil {
+			return nil, err
+		}
+		if matches {
+			stations = append(stations, &station)
+		}
+	}
+	memorySort(stations, orderBy)
+	return stations, nil
+}
+
+func (store *memoryStationStore) Exists(id interface{}) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+	_, ok := store.stations[memoryKey(id)]
+	return ok, nil
+}
+
+func (store *memoryStationStore) Insert(station *Station) error {
+	store.Lock()
+	defer store.Unlock()
+	key := memoryKey(station.ID)
+	if _, ok := store.stations[key]; ok {
+		return fmt.Errorf("duplicate station ID: %v", key)
+	}
+	store.stations[key] = *station
+	return nil
+}
+
+func (store *memoryStationStore) Update(station *Station) error {
+	store.Lock()
+	defer store.Unlock()
+	key := memoryKey(station.ID)
+	if existing, ok := store.stations[key]; ok {
+		version, err := memoryNextVersion(existing.Version, station.Version)
+		if err != nil {
+			return err
+		}
+		station.Version = version
+		store.stations[key] = *station
+	}
+	return nil
+}
+
+func (store *memoryStationStore) Delete(id interface{}) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+	key := memoryKey(id)
+	_, ok := store.stations[key]
+	delete(store.stations, key)
+	return ok, nil
+}
+
+type memoryTimeslotStore struct {
+	sync.Mutex
+	timeslots map[string]Timeslot // By ID
+}
+
+func (store *memoryTimeslotStore) Get(id interface{}) (*Timeslot, error) {
+	store.Lock()
+	defer store.Unlock()
+	timeslot, ok := store.timeslots[memoryKey(id)]
+	if !ok {
+		return nil, nil
+	}
+	return &timeslot, nil
+}
+
+func (store *memoryTimeslotStore) List(orderBy string, whereArgs ...interface{}) (Timeslots, error) {
+	store.Lock()
+	defer store.Unlock()
+	timeslots := make(Timeslots, 0)
+	for _, timeslot := range store.timeslots {
+		timeslot := timeslot
+		matches, err := memoryMatches(&timeslot, whereArgs)
+		if err != nil {
+			return nil, err
+		}
+		if matches {
+			timeslots = append(timeslots, &timeslot)
+		}
+	}
+	memorySort(timeslots, orderBy)
+	return timeslots, nil
+}
+
+func (store *memoryTimeslotStore) Exists(id interface{}) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+	_, ok := store.timeslots[memoryKey(id)]
+	return ok, nil
+}
+
+func (store *memoryTimeslotStore) Insert(timeslot *Timeslot) error {
+	store.Lock()
+	defer store.Unlock()
+	key := memoryKey(timeslot.ID)
+	if _, ok := store.timeslots[key]; ok {
+		return fmt.Errorf("duplicate timeslot ID: %v", key)
+	}
+	store.timeslots[key] = *timeslot
+	return nil
+}
+
+func (store *memoryTimeslotStore) Update(timeslot *Timeslot) error {
+	store.Lock()
+	defer store.Unlock()
+	key := memoryKey(timeslot.ID)
+	if existing, ok := store.timeslots[key]; ok {
+		version, err := memoryNextVersion(existing.Version, timeslot.Version)
+		if err != nil {
+			return err
+		}
+		timeslot.Version = version
+		store.timeslots[key] = *timeslot
+	}
+	return nil
+}
+
+func (store *memoryTimeslotStore) Delete(id interface{}) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+	key := memoryKey(id)
+	_, ok := store.timeslots[key]
+	delete(store.timeslots, key)
+	return ok, nil
+}
+
+// memoryNextVersion checks the version like db.Update, returning the incremented version.
+// An updated version of nil skips the check.
+func memoryNextVersion(existing *int, updated *int) (*int, error) {
+	current := 0
+	if existing != nil {
+		current = *existing
+	}
+	if updated != nil && *updated != current {
+		return nil, db.ErrVersionConflict
+	}
+	next := current + 1
+	return &next, nil
+}
+
+// memoryKey formats the ID as a string, dereferencing pointers (e.g. *uuid.UUID). NULLs are empty.
+func memoryKey(id interface{}) string {
+	value := reflect.ValueOf(id)
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return ""
+		}
+		value = value.Elem()
+	}
+	if !value.IsValid() {
+		return ""
+	}
+	if nullable, ok := value.Interface().(db.Nullable); ok && nullable.IsNull() {
+		return ""
+	}
+	if nullString, ok := value.Interface().(db.NullString); ok {
+		return nullString.String
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+// memoryColumn finds the value of the field with the column name (from the "column" tag, quotes are ignored) in the struct.
+func memoryColumn(item interface{}, column string) (reflect.Value, bool) {
+	column = strings.Trim(column, "\"")
+	value := reflect.Indirect(reflect.ValueOf(item))
+	itemType := value.Type()
+	for i := 0; i < itemType.NumField(); i++ {
+		field := itemType.Field(i)
+		if name, ok := field.Tag.Lookup("column"); ok && name == column {
+			return value.Field(i), true
+		}
+		// Embedded structs like db.Timestamps
+		if _, tagged := field.Tag.Lookup("column"); field.Anonymous && !tagged && field.Type.Kind() == reflect.Struct {
+			if embedded, ok := memoryColumn(value.Field(i).Interface(), column); ok {
+				return embedded, true
+			}
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// memoryMatches checks if the struct matches all the where args (column, operator, value).
+func memoryMatches(item interface{}, whereArgs []interface{}) (bool, error) {
+	if len(whereArgs)%3 != 0 {
+		return false, fmt.Errorf("uneven where args")
+	}
+	for i := 0; i < len(whereArgs); i += 3 {
+		column, _ := whereArgs[i].(string)
+		operator, _ := whereArgs[i+1].(string)
+		field, ok := memoryColumn(item, column)
+		if !ok {
+			return false, fmt.Errorf("unknown column: %v", column)
+		}
+		fieldValue := field.Interface()
+		var matches bool
+		switch strings.ToUpper(operator) {
+		case "=":
+			matches = memoryCompare(fieldValue, whereArgs[i+2]) == 0
+		case "!=", "<>":
+			matches = memoryCompare(fieldValue, whereArgs[i+2]) != 0
+		case "<":
+			matches = memoryCompare(fieldValue, whereArgs[i+2]) < 0
+		case "<=":
+			matches = memoryCompare(fieldValue, whereArgs[i+2]) <= 0
+		case ">":
+			matches = memoryCompare(fieldValue, whereArgs[i+2]) > 0
+		case ">=":
+			matches = memoryCompare(fieldValue, whereArgs[i+2]) >= 0
+		case "IN":
+			values := reflect.ValueOf(whereArgs[i+2])
+			if values.Kind() != reflect.Slice {
+				return false, fmt.Errorf("IN requires a slice for column: %v", column)
+			}
+			for j := 0; j < values.Len() && !matches; j++ {
+				matches = memoryCompare(fieldValue, values.Index(j).Interface()) == 0
+			}
+		default:
+			return false, fmt.Errorf("unsupported operator for in-memory store: %v", operator)
+		}
+		if !matches {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// memoryCompare compares two values like the DB would, treating nil pointers as the empty value.
+// Times are compared chronologically and numbers numerically, everything else by the string form.
+func memoryCompare(a interface{}, b interface{}) int {
+	aTime, aIsTime := memoryTime(a)
+	bTime, bIsTime := memoryTime(b)
+	if aIsTime && bIsTime {
+		switch {
+		case aTime.Before(bTime):
+			return -1
+		case aTime.After(bTime):
+			return 1
+		}
+		return 0
+	}
+	aNumber, aIsNumber := memoryNumber(a)
+	bNumber, bIsNumber := memoryNumber(b)
+	if aIsNumber && bIsNumber {
+		switch {
+		case aNumber < bNumber:
+			return -1
+		case aNumber > bNumber:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(memoryKey(a), memoryKey(b))
+}
+
+func memoryTime(value interface{}) (time.Time, bool) {
+	switch typed := value.(type) {
+	case time.Time:
+		return typed, true
+	case *time.Time:
+		if typed == nil {
+			return time.Time{}, true
+		}
+		return *typed, true
+	}
+	return time.Time{}, false
+}
+
+func memoryNumber(value interface{}) (float64, bool) {
+	reflected := reflect.Indirect(reflect.ValueOf(value))
+	switch reflected.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(reflected.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(reflected.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return reflected.Float(), true
+	}
+	return 0, false
+}
+
+// memorySort sorts the slice of struct pointers by the order (e.g. "track, shortname DESC"), or by ID if empty.
+func memorySort(items interface{}, orderBy string) {
+	if orderBy == "" {
+		orderBy = "id"
+	}
+	type orderColumn struct {
+		column     string
+		descending bool
+	}
+	var order []orderColumn
+	for _, part := range strings.Split(orderBy, ",") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		order = append(order, orderColumn{column: fields[0], descending: len(fields) > 1 && strings.ToUpper(fields[1]) == "DESC"})
+	}
+
+	values := reflect.ValueOf(items)
+	sort.SliceStable(items, func(i, j int) bool {
+		for _, column := range order {
+			a, aOk := memoryColumn(values.Index(i).Interface(), column.column)
+			b, bOk := memoryColumn(values.Index(j).Interface(), column.column)
+			if !aOk || !bOk {
+				continue
+			}
+			if comparison := memoryCompare(a.Interface(), b.Interface()); comparison != 0 {
+				return (comparison < 0) != column.descending
+			}
+		}
+		return false
+	})
+}
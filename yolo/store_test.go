@@ -0,0 +1,118 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"testing"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+func TestMemoryStationStoreList(t *testing.T) {
+	store := NewMemoryStores().Stations
+	for i, shortname := range []string{"b", "a", "c"} {
+		id := uuid.New()
+		status := StationStatusReady
+		if i == 2 {
+			status = StationStatusDirty
+		}
+		if err := store.Insert(&Station{ID: &id, TrackID: "net", Shortname: shortname, Status: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stations, err := store.List("shortname DESC", "track", "=", "net", "status", "IN", []StationStatus{StationStatusReady})
+	if err != nil {
+		t.Fatal(err)
+	}
+	helper.CheckEqual(t, len(stations), 2)
+	helper.CheckEqual(t, stations[0].Shortname, "b")
+	helper.CheckEqual(t, stations[1].Shortname, "a")
+}
+
+func TestMemoryStationStoreNullTimeslot(t *testing.T) {
+	store := NewMemoryStores().Stations
+	for _, timeslotID := range []string{"", uuid.NewString()} {
+		id := uuid.New()
+		if err := store.Insert(&Station{ID: &id, TrackID: "net", Shortname: timeslotID, TimeslotID: db.StringOrNull(timeslotID)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stations, err := store.List("", "timeslot", "=", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helper.CheckEqual(t, len(stations), 1)
+	helper.CheckEqual(t, stations[0].TimeslotID.Valid, false)
+}
+
+func TestTimeslotHandlersWithMemoryStores(t *testing.T) {
+	previousStores := stores
+	UseStores(NewMemoryStores())
+	defer UseStores(previousStores)
+
+	id := uuid.New()
+	userID := uuid.New()
+	if err := stores.Timeslots.Insert(&Timeslot{ID: &id, UserID: &userID, TrackID: "net"}); err != nil {
+		t.Fatal(err)
+	}
+	role := rest.RoleOperator
+	request := rest.Request{
+		AccessToken: rest.AccessTokenEntry{NonUserRole: &role},
+		PathArgs:    map[string]string{"id": id.String()},
+	}
+
+	var timeslot Timeslot
+	result := timeslot.Get(&request)
+	helper.CheckEqual(t, result.IsOk(), true)
+	helper.CheckEqual(t, timeslot.TrackID, "net")
+
+	request.PathArgs["id"] = uuid.NewString()
+	result = (&Timeslot{}).Get(&request)
+	helper.CheckEqual(t, result.Code, 404)
+}
+
+func TestMemoryStationStoreVersion(t *testing.T) {
+	store := NewMemoryStores().Stations
+	id := uuid.New()
+	if err := store.Insert(&Station{ID: &id, TrackID: "net", Shortname: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := store.Get(id)
+	second, _ := store.Get(id)
+	first.Notes = "first"
+	if err := store.Update(first); err != nil {
+		t.Fatal(err)
+	}
+	helper.CheckEqual(t, *first.Version, 1)
+
+	// The second one was loaded before the first update, but nil versions are not checked
+	second.Notes = "second"
+	helper.CheckEqual(t, store.Update(second), nil)
+	version := 1
+	second.Version = &version
+	helper.CheckEqual(t, store.Update(second), db.ErrVersionConflict)
+}
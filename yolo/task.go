@@ -22,6 +22,7 @@ package yolo
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
@@ -31,28 +32,58 @@ import (
 
 // Task is the components of a track.
 type Task struct {
-	ID          *uuid.UUID `column:"id" json:"id"`               // Generated, required, unique
-	TrackID     string     `column:"track" json:"track"`         // Required
-	Shortname   string     `column:"shortname" json:"shortname"` // Required, unique together with track
-	Name        string     `column:"name" json:"name"`           // Required
+	ID          *uuid.UUID `column:"id" json:"id"`                                   // Generated, required, unique
+	TrackID     string     `column:"track" json:"track" validate:"required"`         // Required
+	Shortname   string     `column:"shortname" json:"shortname" validate:"required"` // Required, unique together with track
+	Name        string     `column:"name" json:"name" validate:"required"`           // Required
 	Description string     `column:"description" json:"description"`
-	Sequence    *int       `column:"sequence" json:"sequence,omitempty"`
+	Sequence    *int       `column:"sequence" json:"sequence,omitempty"` // Optional, appended to the end of the track if omitted when created
+	Points      int        `column:"points" json:"points"`               // Optional, awarded when all tests for the task succeed
+	// Optional, tasks which must be completed first, stored in a separate table
+	DependsOnIDs []uuid.UUID `column:"-" json:"depends_on"`
+	// Generated, if any dependencies aren't completed for the current timeslot (only if the track uses task locking)
+	Locked bool `column:"-" json:"locked"`
+	// Generated, when the task was created and last updated
+	db.Timestamps
 }
 
 // Tasks is a list of tasks.
 type Tasks []*Task
 
+// TaskReorderRequest is for rewriting the sequences of all tasks in a track, in the given order.
+type TaskReorderRequest struct {
+	TrackID string      `json:"track" validate:"required"` // Required
+	TaskIDs []uuid.UUID `json:"tasks"`                     // Required, all tasks in the track, in the new order
+}
+
+// Task locks depend on the requester's current timeslot and its test results
+var taskCachePolicy = rest.CachePolicy{
+	TTL:    30 * time.Second,
+	Tables: []string{"tasks", "task_dependencies", "tracks", "stations", "timeslots", "team_members", "tests"},
+}
+
+// taskDependency is a row in the task dependencies table.
+type taskDependency struct {
+	TaskID      uuid.UUID `column:"task"`
+	DependsOnID uuid.UUID `column:"depends_on"`
+}
+
 func init() {
-	rest.AddHandler("/tasks/", "^$", func() interface{} { return &Tasks{} })
-	rest.AddHandler("/task/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Task{} })
+	db.RegisterSearchVector("tasks", "search", "name", "description")
+	rest.AddCachedHandler("/tasks/", "^$", taskCachePolicy, func() interface{} { return &Tasks{} })
+	rest.AddCachedHandler("/task/", "^(?:(?P<id>[^/]+)/)?$", taskCachePolicy, func() interface{} { return &Task{} })
+	rest.AddHandler("/tasks/", "^reorder/$", func() interface{} { return &TaskReorderRequest{} })
+}
+
+// ListQueryFields returns the fields tasks may be filtered and sorted on.
+func (tasks *Tasks) ListQueryFields() map[string]string {
+	return map[string]string{"id": "id", "track": "track", "shortname": "shortname", "name": "name", "sequence": "sequence", "points": "points", "created_at": "created_at", "updated_at": "updated_at"}
 }
 
 // Get gets multiple tasks.
 func (tasks *Tasks) Get(request *rest.Request) rest.Result {
-	// TODO order by sequence
-
 	// Check params, prep filtering
-	var whereArgs []interface{}
+	whereArgs := request.ListFilterArgs
 	if trackID, ok := request.QueryArgs["track"]; ok {
 		whereArgs = append(whereArgs, "track", "=", trackID)
 	}
@@ -61,9 +92,37 @@ func (tasks *Tasks) Get(request *rest.Request) rest.Result {
 	}
 
 	// Get
-	dbResult := db.SelectMany(tasks, "tasks", whereArgs...)
+	orderBy := request.ListOrderBy
+	if orderBy == "" {
+		orderBy = "sequence"
+	}
+	var allTasks Tasks
+	dbResult := db.SelectManyOrdered(&allTasks, "tasks", orderBy, whereArgs...)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
+	}
+
+	// Hide tasks in draft tracks from non-operators
+	hiddenIDs, hiddenErr := hiddenTrackIDs(request)
+	if hiddenErr != nil {
+		return rest.InternalError(hiddenErr)
+	}
+	*tasks = make(Tasks, 0, len(allTasks))
+	for _, task := range allTasks {
+		if !hiddenIDs[task.TrackID] {
+			*tasks = append(*tasks, task)
+		}
+	}
+
+	for _, task := range *tasks {
+		if err := task.loadDependencies(db.DB); err != nil {
+			return rest.InternalError(err)
+		}
+	}
+
+	// Lock tasks for participants according to their current timeslots
+	if err := applyTaskLocksForRequester(*tasks, request.AccessToken); err != nil {
+		return rest.InternalError(err)
 	}
 	return rest.Result{}
 }
@@ -73,20 +132,36 @@ func (task *Task) Get(request *rest.Request) rest.Result {
 	// Check params
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 
 	// Get
 	dbResult := db.Select(task, "tasks", "id", "=", id)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
 	if !dbResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "not found"}
+		return rest.NotFound("not found")
+	}
+	if result := checkTrackVisible(request, task.TrackID); !result.IsOk() {
+		return rest.NotFound("not found")
+	}
+	if err := task.loadDependencies(db.DB); err != nil {
+		return rest.InternalError(err)
+	}
+
+	// Lock it for participants according to their current timeslot
+	if err := applyTaskLocksForRequester(Tasks{task}, request.AccessToken); err != nil {
+		return rest.InternalError(err)
 	}
 	return rest.Result{}
 }
 
+// Transactional allows tasks to be posted, put and deleted in batches in a single transaction.
+func (task *Task) Transactional() bool {
+	return true
+}
+
 // Post creates a new task.
 func (task *Task) Post(request *rest.Request) rest.Result {
 	// Check perms
@@ -99,17 +174,17 @@ func (task *Task) Post(request *rest.Request) rest.Result {
 		newID := uuid.New()
 		task.ID = &newID
 	}
-	if result := task.validate(); !result.IsOk() {
+	if result := task.validate(request.Executor()); !result.IsOk() {
 		return result
 	}
 
 	// Create and redirect
-	result := task.create()
+	result := task.create(request.Executor())
 	if !result.IsOk() {
 		return result
 	}
 	result.Code = 201
-	result.Location = fmt.Sprintf("%v/task/%v/", config.Config.SitePrefix, task.ID)
+	result.Location = fmt.Sprintf("%v/task/%v/", config.Get().SitePrefix, task.ID)
 	return result
 }
 
@@ -123,23 +198,82 @@ func (task *Task) Put(request *rest.Request) rest.Result {
 	// Check params
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 
 	// Validate
 	if task.ID != nil && (*task.ID).String() != id {
-		return rest.Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
+		return rest.BadRequest("mismatch between URL and JSON IDs")
 	}
-	if result := task.validate(); !result.IsOk() {
+	if result := task.validate(request.Executor()); !result.IsOk() {
 		return result
 	}
 
 	// Create or update
-	return task.createOrUpdate()
+	return task.createOrUpdate(request.Executor())
 }
 
 // Delete deletes a task.
 func (task *Task) Delete(request *rest.Request) rest.Result {
+	if result := task.checkDelete(request, request.Executor()); !result.IsOk() {
+		return result
+	}
+
+	// Delete it, its dependencies (both ways) and its checks
+	executor := request.Executor()
+	if dbResult := db.DeleteWith(executor, "task_dependencies", "task", "=", task.ID); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if dbResult := db.DeleteWith(executor, "task_dependencies", "depends_on", "=", task.ID); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if dbResult := db.DeleteWith(executor, "task_checks", "task", "=", task.ID); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	dbResult := db.DeleteWith(executor, "tasks", "id", "=", task.ID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// PreviewDelete counts the dependencies a delete would remove and the rows it would leave dangling.
+func (task *Task) PreviewDelete(request *rest.Request) (map[string]int, rest.Result) {
+	if result := task.checkDelete(request, db.DB); !result.IsOk() {
+		return nil, result
+	}
+	affected, err := db.CountReferences(task.ID,
+		db.Reference{Table: "tasks", Column: "id"},
+		db.Reference{Table: "task_dependencies", Column: "task"},
+		db.Reference{Table: "task_dependencies", Column: "depends_on"},
+		db.Reference{Table: "hints", Column: "task"},
+		db.Reference{Table: "task_checks", Column: "task"},
+		db.Reference{Table: "attachments", Column: "task"},
+	)
+	if err != nil {
+		return nil, rest.InternalError(err)
+	}
+
+	// Tests refer to it by track and shortname
+	var existing Task
+	selectResult := db.Select(&existing, "tasks", "id", "=", task.ID)
+	if selectResult.IsFailed() {
+		return nil, rest.InternalError(selectResult.Error)
+	}
+	for _, table := range []string{"tests", "test_history"} {
+		countResult := db.Count(table, "track", "=", existing.TrackID, "task_shortname", "=", existing.Shortname)
+		if countResult.IsFailed() {
+			return nil, rest.InternalError(countResult.Error)
+		}
+		if countResult.Ok > 0 {
+			affected[table] = countResult.Ok
+		}
+	}
+	return affected, rest.Result{}
+}
+
+// checkDelete checks the perms and that the task exists, for Delete and PreviewDelete.
+func (task *Task) checkDelete(request *rest.Request, executor db.Executor) rest.Result {
 	// Check perms
 	if request.AccessToken.GetRole() != rest.RoleAdmin {
 		return rest.UnauthorizedResult(request.AccessToken)
@@ -148,71 +282,169 @@ func (task *Task) Delete(request *rest.Request) rest.Result {
 	// Check params
 	rawID, rawIDExists := request.PathArgs["id"]
 	if !rawIDExists || rawID == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 	id, uuidError := uuid.Parse(rawID)
 	if uuidError != nil {
-		return rest.Result{Code: 400, Message: "invalid ID"}
+		return rest.BadRequest("invalid ID")
 	}
 
 	// Check if exists
 	task.ID = &id
-	exists, err := task.exists()
+	exists, err := task.exists(executor)
 	if err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	}
 	if !exists {
-		return rest.Result{Code: 404, Message: "not found"}
-	}
-
-	// Delete
-	dbResult := db.Delete("tasks", "id", "=", task.ID)
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.NotFound("not found")
 	}
 	return rest.Result{}
 }
 
-func (task *Task) create() rest.Result {
-	if exists, err := task.exists(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+func (task *Task) create(executor db.Executor) rest.Result {
+	if exists, err := task.exists(executor); err != nil {
+		return rest.InternalError(err)
 	} else if exists {
-		return rest.Result{Code: 409, Message: "duplicate"}
+		return rest.Conflict("duplicate")
 	}
 
-	dbResult := db.Insert("tasks", task)
+	if err := task.assignSequence(executor); err != nil {
+		return rest.InternalError(err)
+	}
+	dbResult := db.InsertWith(executor, "tasks", task)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
-	return rest.Result{}
+	return task.saveDependencies(executor)
 }
 
-func (task *Task) createOrUpdate() rest.Result {
-	exists, existsErr := task.exists()
+func (task *Task) createOrUpdate(executor db.Executor) rest.Result {
+	exists, existsErr := task.exists(executor)
 	if existsErr != nil {
-		return rest.Result{Code: 500, Error: existsErr}
+		return rest.InternalError(existsErr)
 	}
 
 	var dbResult db.Result
 	if exists {
-		dbResult = db.Update("tasks", task, "id", "=", task.ID)
+		if task.Sequence == nil {
+			// Keep the current position
+			var current Task
+			if currentResult := db.SelectWith(executor, &current, "tasks", "id", "=", task.ID); currentResult.IsFailed() {
+				return rest.InternalError(currentResult.Error)
+			}
+			task.Sequence = current.Sequence
+		}
+		dbResult = db.UpdateWith(executor, "tasks", task, "id", "=", task.ID)
 	} else {
-		if exists, err := task.existsTaskShortnameWithDifferentID(); err != nil {
-			return rest.Result{Code: 500, Error: err}
+		if exists, err := task.existsTaskShortnameWithDifferentID(executor); err != nil {
+			return rest.InternalError(err)
 		} else if exists {
-			return rest.Result{Code: 409, Message: "Shortname is already used with a different task"}
+			return rest.Conflict("Shortname is already used with a different task")
+		}
+		if err := task.assignSequence(executor); err != nil {
+			return rest.InternalError(err)
 		}
-		dbResult = db.Insert("tasks", task)
+		dbResult = db.InsertWith(executor, "tasks", task)
 	}
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
+	}
+	return task.saveDependencies(executor)
+}
+
+// assignSequence puts the task at the end of its track, if it has no sequence.
+func (task *Task) assignSequence(executor db.Executor) error {
+	if task.Sequence != nil {
+		return nil
+	}
+	var sequence int
+	row := executor.QueryRow("SELECT COALESCE(MAX(sequence), 0) + 1 FROM tasks WHERE track = $1", task.TrackID)
+	if err := row.Scan(&sequence); err != nil {
+		return err
+	}
+	task.Sequence = &sequence
+	return nil
+}
+
+// Post rewrites the sequences of the tasks in the track to match the given order, in a single transaction.
+func (reorderRequest *TaskReorderRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check that exactly all tasks in the track are listed
+	var trackTasks Tasks
+	dbResult := db.SelectMany(&trackTasks, "tasks", "track", "=", reorderRequest.TrackID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if len(trackTasks) == 0 {
+		return rest.NotFound("track not found or has no tasks")
+	}
+	remaining := make(map[uuid.UUID]bool, len(trackTasks))
+	for _, task := range trackTasks {
+		remaining[*task.ID] = true
+	}
+	for _, taskID := range reorderRequest.TaskIDs {
+		if !remaining[taskID] {
+			return rest.BadRequest(fmt.Sprintf("task %v is not in the track or listed multiple times", taskID))
+		}
+		delete(remaining, taskID)
+	}
+	if len(remaining) > 0 {
+		return rest.BadRequest(fmt.Sprintf("all %v tasks in the track must be listed", len(trackTasks)))
+	}
+
+	// Rewrite
+	tx, txErr := db.DB.Begin()
+	if txErr != nil {
+		return rest.InternalError(txErr)
+	}
+	defer tx.Rollback()
+	for i, taskID := range reorderRequest.TaskIDs {
+		if _, err := tx.Exec("UPDATE tasks SET sequence = $1, updated_at = now() WHERE id = $2", i+1, taskID); err != nil {
+			return rest.InternalError(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return rest.InternalError(err)
+	}
+	db.NotifyWrite("tasks")
+	return rest.Result{}
+}
+
+// saveDependencies replaces the saved dependencies of the task with the current dependencies.
+func (task *Task) saveDependencies(executor db.Executor) rest.Result {
+	if dbResult := db.DeleteWith(executor, "task_dependencies", "task", "=", task.ID); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	for _, dependsOnID := range task.DependsOnIDs {
+		dependency := taskDependency{TaskID: *task.ID, DependsOnID: dependsOnID}
+		if dbResult := db.InsertWith(executor, "task_dependencies", dependency); dbResult.IsFailed() {
+			return rest.InternalError(dbResult.Error)
+		}
 	}
 	return rest.Result{}
 }
 
-func (task *Task) exists() (bool, error) {
+// loadDependencies loads the dependency IDs for the task.
+func (task *Task) loadDependencies(executor db.Executor) error {
+	var dependencies []taskDependency
+	dbResult := db.SelectManyWith(executor, &dependencies, "task_dependencies", "task", "=", task.ID)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	task.DependsOnIDs = make([]uuid.UUID, 0, len(dependencies))
+	for _, dependency := range dependencies {
+		task.DependsOnIDs = append(task.DependsOnIDs, dependency.DependsOnID)
+	}
+	return nil
+}
+
+func (task *Task) exists(executor db.Executor) (bool, error) {
 	var count int
-	row := db.DB.QueryRow("SELECT COUNT(*) FROM tasks WHERE id = $1", task.ID)
+	row := executor.QueryRow("SELECT COUNT(*) FROM tasks WHERE id = $1", task.ID)
 	rowErr := row.Scan(&count)
 	if rowErr != nil {
 		return false, rowErr
@@ -230,31 +462,83 @@ func (task *Task) existsShortname() (bool, error) {
 	return count > 0, nil
 }
 
-func (task *Task) validate() rest.Result {
-	switch {
-	case task.ID == nil:
-		return rest.Result{Code: 400, Message: "missing ID"}
-	case task.TrackID == "":
-		return rest.Result{Code: 400, Message: "missing track ID"}
-	case task.Shortname == "":
-		return rest.Result{Code: 400, Message: "missing shortname"}
-	case task.Name == "":
-		return rest.Result{Code: 400, Message: "missing name"}
+func (task *Task) validate(executor db.Executor) rest.Result {
+	if task.ID == nil {
+		return rest.BadRequest("missing ID")
+	}
+	if problems := rest.Validate(task); len(problems) > 0 {
+		return rest.ValidationFailedResult(problems)
 	}
 
 	track := Track{ID: task.TrackID}
 	if exists, err := track.exists(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if !exists {
-		return rest.Result{Code: 400, Message: "referenced track does not exist"}
+		return rest.BadRequest("referenced track does not exist")
+	}
+
+	return task.validateDependencies(executor)
+}
+
+// validateDependencies checks that all dependencies are other tasks in the same track and that there are no cycles.
+func (task *Task) validateDependencies(executor db.Executor) rest.Result {
+	if len(task.DependsOnIDs) == 0 {
+		return rest.Result{}
+	}
+
+	// Load the dependency graph for the track, with this task's new dependencies
+	var trackTasks Tasks
+	dbResult := db.SelectManyWith(executor, &trackTasks, "tasks", "track", "=", task.TrackID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	graph := make(map[uuid.UUID][]uuid.UUID)
+	for _, trackTask := range trackTasks {
+		if *trackTask.ID == *task.ID {
+			continue
+		}
+		if err := trackTask.loadDependencies(executor); err != nil {
+			return rest.InternalError(err)
+		}
+		graph[*trackTask.ID] = trackTask.DependsOnIDs
+	}
+	for _, dependsOnID := range task.DependsOnIDs {
+		if dependsOnID == *task.ID {
+			return rest.BadRequest("task can't depend on itself")
+		}
+		if _, ok := graph[dependsOnID]; !ok {
+			return rest.BadRequest("dependency is not a task in the same track")
+		}
+	}
+	graph[*task.ID] = task.DependsOnIDs
+
+	// Check for cycles through this task
+	visited := make(map[uuid.UUID]bool)
+	var reaches func(from uuid.UUID) bool
+	reaches = func(from uuid.UUID) bool {
+		for _, next := range graph[from] {
+			if next == *task.ID {
+				return true
+			}
+			if !visited[next] {
+				visited[next] = true
+				if reaches(next) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if reaches(*task.ID) {
+		return rest.BadRequest("dependencies contain a cycle")
 	}
 
 	return rest.Result{}
 }
 
-func (task *Task) existsTaskShortnameWithDifferentID() (bool, error) {
+func (task *Task) existsTaskShortnameWithDifferentID(executor db.Executor) (bool, error) {
 	var count int
-	row := db.DB.QueryRow("SELECT COUNT(*) FROM tasks WHERE id != $1 AND track = $2 AND shortname = $3", task.ID, task.TrackID, task.Shortname)
+	row := executor.QueryRow("SELECT COUNT(*) FROM tasks WHERE id != $1 AND track = $2 AND shortname = $3", task.ID, task.TrackID, task.Shortname)
 	rowErr := row.Scan(&count)
 	if rowErr != nil {
 		return false, rowErr
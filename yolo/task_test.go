@@ -0,0 +1,60 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/rest/resttest"
+	"github.com/google/uuid"
+)
+
+func TestTaskBatch(t *testing.T) {
+	harness := resttest.New(t)
+	adminKey := harness.Token(rest.RoleAdmin)
+	track := Track{ID: "net", Type: trackTypeNet, Name: "Net", Status: TrackStatusOpen}
+	helper.CheckEqual(t, harness.Do("POST", "/api/track/", adminKey, track).Code, 201)
+
+	taskOperation := func(shortname string, trackID string) *rest.BatchOperation {
+		id := uuid.New()
+		body, _ := json.Marshal(Task{ID: &id, TrackID: trackID, Shortname: shortname, Name: shortname})
+		return &rest.BatchOperation{Method: "PUT", Path: "/task/" + id.String() + "/", Body: body}
+	}
+
+	// The second task references a missing track, so the first one is rolled back too
+	var batch rest.Batch
+	request := rest.Batch{Transaction: true, Operations: []*rest.BatchOperation{taskOperation("a", "net"), taskOperation("b", "missing")}}
+	resttest.DecodeJSON(t, harness.Do("POST", "/api/batch/", adminKey, request), 200, &batch)
+	helper.CheckEqual(t, batch.RolledBack, true)
+	helper.CheckEqual(t, batch.Operations[1].Status, 400)
+	var tasks Tasks
+	resttest.DecodeJSON(t, harness.Do("GET", "/api/tasks/", "", nil), 200, &tasks)
+	helper.CheckEqual(t, len(tasks), 0)
+
+	request = rest.Batch{Transaction: true, Operations: []*rest.BatchOperation{taskOperation("a", "net"), taskOperation("b", "net")}}
+	resttest.DecodeJSON(t, harness.Do("POST", "/api/batch/", adminKey, request), 200, &batch)
+	helper.CheckEqual(t, batch.RolledBack, false)
+	resttest.DecodeJSON(t, harness.Do("GET", "/api/tasks/", "", nil), 200, &tasks)
+	helper.CheckEqual(t, len(tasks), 2)
+}
@@ -0,0 +1,483 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/worker"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// TaskCheckType is what a task check does.
+type TaskCheckType string
+
+const (
+	// TaskCheckTypeHTTP gets the target URL, passing for 2XX responses (containing the expected text, if any).
+	TaskCheckTypeHTTP TaskCheckType = "http"
+	// TaskCheckTypeTCP connects to the target host and port.
+	TaskCheckTypeTCP TaskCheckType = "tcp"
+	// TaskCheckTypeDNS looks up the query name using the target as DNS server (resolving to the expected address, if any).
+	TaskCheckTypeDNS TaskCheckType = "dns"
+	// TaskCheckTypePing pings the target host (using the ping command).
+	TaskCheckTypePing TaskCheckType = "ping"
+	// TaskCheckTypeScript runs the script in the configured sandbox, passing if it exits with 0.
+	TaskCheckTypeScript TaskCheckType = "script"
+)
+
+// taskCheckWorkerTaskName is the name of the worker task running the task checks.
+const taskCheckWorkerTaskName = "task-checks"
+
+// taskCheckWorkerInterval is how often the task checks are run for stations with active timeslots.
+const taskCheckWorkerInterval = 1 * time.Minute
+
+// taskCheckTimeout is the timeout for a single check.
+const taskCheckTimeout = 5 * time.Second
+
+// taskCheckConcurrency is the max number of checks running at the same time.
+const taskCheckConcurrency = 16
+
+// taskCheckMaxBodyBytes is how much of HTTP responses is searched for the expected text.
+const taskCheckMaxBodyBytes = 64 * 1024
+
+// TaskCheck is a check run by the backend against stations with active timeslots, saved as a test for the task.
+// It's an alternative to external status scripts for simple checks.
+type TaskCheck struct {
+	ID        *uuid.UUID    `column:"id" json:"id"`               // Generated, required, unique
+	TaskID    *uuid.UUID    `column:"task" json:"task"`           // Required
+	Shortname string        `column:"shortname" json:"shortname"` // Required, the test shortname, unique for the task
+	Name      string        `column:"name" json:"name"`           // Required, the test name
+	Sequence  *int          `column:"sequence" json:"sequence"`   // Optional, the test sequence
+	Type      TaskCheckType `column:"type" json:"type"`           // Required
+	// Required, the URL (HTTP), host and port (TCP and DNS) or host (ping), optional for scripts.
+	// "{host}" (the host of the station console address), "{shortname}" and "{track}" are replaced by the station's values.
+	Target  string `column:"target" json:"target"`
+	Query   string `column:"query" json:"query"`     // The name to look up (DNS only)
+	Expect  string `column:"expect" json:"expect"`   // Optional, text the body must contain (HTTP) or an address the name must resolve to (DNS)
+	Script  string `column:"script" json:"script"`   // The script to run (script only), see runScript
+	Enabled bool   `column:"enabled" json:"enabled"` // Only enabled checks are run
+}
+
+// TaskChecks is a list of task checks.
+type TaskChecks []*TaskCheck
+
+func init() {
+	rest.AddHandler("/task-checks/", "^$", func() interface{} { return &TaskChecks{} })
+	rest.AddHandler("/task-check/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &TaskCheck{} })
+	worker.AddTask(taskCheckWorkerTaskName, taskCheckWorkerInterval, runTaskChecks)
+}
+
+// Get gets multiple task checks.
+func (checks *TaskChecks) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params and prep filtering
+	var whereArgs []interface{}
+	if taskID, ok := request.QueryArgs["task"]; ok {
+		whereArgs = append(whereArgs, "task", "=", taskID)
+	}
+
+	// Get
+	dbResult := db.SelectManyOrdered(checks, "task_checks", "task, sequence, shortname", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Get gets a single task check.
+func (check *TaskCheck) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Get
+	dbResult := db.Select(check, "task_checks", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+	return rest.Result{}
+}
+
+// Post creates a new task check.
+func (check *TaskCheck) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Prepare and validate
+	if check.ID == nil {
+		newID := uuid.New()
+		check.ID = &newID
+	}
+	if result := check.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Create and redirect
+	if exists, err := check.exists(); err != nil {
+		return rest.InternalError(err)
+	} else if exists {
+		return rest.Conflict("duplicate")
+	}
+	if dbResult := db.Insert("task_checks", check); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	worker.Trigger(taskCheckWorkerTaskName)
+	return rest.Created(fmt.Sprintf("%v/task-check/%v/", config.Get().SitePrefix, check.ID))
+}
+
+// Put updates a task check.
+func (check *TaskCheck) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Validate
+	if check.ID == nil || (*check.ID).String() != id {
+		return rest.BadRequest("mismatch between URL and JSON IDs")
+	}
+	if result := check.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Create or update
+	if dbResult := db.Upsert("task_checks", check, "id", "=", check.ID); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	worker.Trigger(taskCheckWorkerTaskName)
+	return rest.Result{}
+}
+
+// Delete deletes a task check. Tests already saved by it are kept.
+func (check *TaskCheck) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	dbResult := db.Delete("task_checks", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if dbResult.Affected == 0 {
+		return rest.NotFound("not found")
+	}
+	return rest.Result{}
+}
+
+func (check *TaskCheck) exists() (bool, error) {
+	dbResult := db.Exists("task_checks", "id", "=", check.ID)
+	return dbResult.IsSuccess(), dbResult.Error
+}
+
+func (check *TaskCheck) validate() rest.Result {
+	switch {
+	case check.ID == nil:
+		return rest.BadRequest("missing ID")
+	case check.TaskID == nil:
+		return rest.BadRequest("missing task ID")
+	case check.Shortname == "":
+		return rest.BadRequest("missing shortname")
+	case check.Name == "":
+		return rest.BadRequest("missing name")
+	case check.Target == "" && check.Type != TaskCheckTypeScript:
+		return rest.BadRequest("missing target")
+	}
+	switch check.Type {
+	case TaskCheckTypeHTTP:
+		if !strings.HasPrefix(check.Target, "http://") && !strings.HasPrefix(check.Target, "https://") {
+			return rest.BadRequest("target must be an HTTP(S) URL")
+		}
+	case TaskCheckTypeDNS:
+		if check.Query == "" {
+			return rest.BadRequest("missing query")
+		}
+	case TaskCheckTypeScript:
+		if strings.TrimSpace(check.Script) == "" {
+			return rest.BadRequest("missing script")
+		}
+	case TaskCheckTypeTCP, TaskCheckTypePing:
+	default:
+		return rest.BadRequest("invalid type")
+	}
+
+	task := Task{ID: check.TaskID}
+	if exists, err := task.exists(db.DB); err != nil {
+		return rest.InternalError(err)
+	} else if !exists {
+		return rest.BadRequest("referenced task does not exist")
+	}
+	duplicateDBResult := db.Exists("task_checks", "task", "=", check.TaskID, "shortname", "=", check.Shortname, "id", "!=", check.ID)
+	if duplicateDBResult.IsFailed() {
+		return rest.InternalError(duplicateDBResult.Error)
+	}
+	if duplicateDBResult.IsSuccess() {
+		return rest.Conflict("another check for the task has the same shortname")
+	}
+
+	return rest.Result{}
+}
+
+// taskCheckRun is a check to run for a station, and the resulting test.
+type taskCheckRun struct {
+	check   *TaskCheck
+	task    *Task
+	station *Station
+	test    *Test
+}
+
+// runTaskChecks runs the enabled checks against all stations with active timeslots in the tracks of the checks,
+// saving the results as tests. Tests are only saved when the result changed, to not flood the history.
+func runTaskChecks() {
+	var checks TaskChecks
+	checkDBResult := db.SelectMany(&checks, "task_checks", "enabled", "=", true)
+	if checkDBResult.IsFailed() {
+		log.WithError(checkDBResult.Error).Error("Failed to load task checks")
+		return
+	}
+	if len(checks) == 0 {
+		return
+	}
+
+	// Load the tasks, stations and current tests
+	var taskIDs []uuid.UUID
+	for _, check := range checks {
+		taskIDs = append(taskIDs, *check.TaskID)
+	}
+	var tasks Tasks
+	if dbResult := db.SelectMany(&tasks, "tasks", "id", "IN", taskIDs); dbResult.IsFailed() {
+		log.WithError(dbResult.Error).Error("Failed to load tasks for task checks")
+		return
+	}
+	tasksByID := make(map[uuid.UUID]*Task)
+	var trackIDs []string
+	for _, task := range tasks {
+		tasksByID[*task.ID] = task
+		trackIDs = append(trackIDs, task.TrackID)
+	}
+	stations, err := stores.Stations.List("", "track", "IN", trackIDs)
+	if err != nil {
+		log.WithError(err).Error("Failed to load stations for task checks")
+		return
+	}
+	var currentTests Tests
+	if dbResult := db.SelectMany(&currentTests, "tests", "track", "IN", trackIDs); dbResult.IsFailed() {
+		log.WithError(dbResult.Error).Error("Failed to load tests for task checks")
+		return
+	}
+	currentTestsByKey := make(map[string]*Test)
+	for _, test := range currentTests {
+		currentTestsByKey[test.key()] = test
+	}
+
+	// Run them concurrently
+	var runs []*taskCheckRun
+	for _, station := range stations {
+		if !station.TimeslotID.Valid {
+			continue
+		}
+		for _, check := range checks {
+			if task, ok := tasksByID[*check.TaskID]; ok && task.TrackID == station.TrackID {
+				runs = append(runs, &taskCheckRun{check: check, task: task, station: station})
+			}
+		}
+	}
+	var waitGroup sync.WaitGroup
+	semaphore := make(chan struct{}, taskCheckConcurrency)
+	for _, run := range runs {
+		waitGroup.Add(1)
+		semaphore <- struct{}{}
+		go func(run *taskCheckRun) {
+			defer waitGroup.Done()
+			defer func() { <-semaphore }()
+			run.run()
+		}(run)
+	}
+	waitGroup.Wait()
+
+	// Save changed results
+	for _, run := range runs {
+		current, ok := currentTestsByKey[run.test.key()]
+		if ok && current.StatusSuccess != nil && *current.StatusSuccess == *run.test.StatusSuccess && current.StatusDescription == run.test.StatusDescription {
+			continue
+		}
+		if err := run.test.save(db.DB); err != nil {
+			log.WithError(err).WithField("check", run.check.ID).Error("Failed to save task check result")
+			return
+		}
+	}
+}
+
+// key identifies equivalent tests, which replace each other.
+func (test *Test) key() string {
+	return strings.Join([]string{test.TrackID, test.TaskShortname, test.Shortname, test.StationShortname, test.TimeslotID.String}, "/")
+}
+
+// run runs the check and creates the test for the result.
+func (run *taskCheckRun) run() {
+	success, description := run.check.run(run.station)
+	id := uuid.New()
+	now := time.Now()
+	run.test = &Test{
+		ID:                &id,
+		TrackID:           run.task.TrackID,
+		TaskShortname:     run.task.Shortname,
+		Shortname:         run.check.Shortname,
+		StationShortname:  run.station.Shortname,
+		TimeslotID:        run.station.TimeslotID,
+		Name:              run.check.Name,
+		Description:       fmt.Sprintf("Automatic %v check", run.check.Type),
+		Sequence:          run.check.Sequence,
+		Timestamp:         &now,
+		StatusSuccess:     &success,
+		StatusDescription: description,
+	}
+}
+
+// run runs the check against the station, returning if it passed and a description of the result.
+func (check *TaskCheck) run(station *Station) (bool, string) {
+	host := station.ConsoleAddress
+	if splitHost, _, err := net.SplitHostPort(host); err == nil {
+		host = splitHost
+	}
+	if host == "" && strings.Contains(check.Target, "{host}") {
+		return false, "the station has no address"
+	}
+	target := strings.NewReplacer("{host}", host, "{shortname}", station.Shortname, "{track}", station.TrackID).Replace(check.Target)
+	if check.Type == TaskCheckTypeScript {
+		return check.runScript(station, host, target)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), taskCheckTimeout)
+	defer cancel()
+	switch check.Type {
+	case TaskCheckTypeHTTP:
+		return checkHTTP(ctx, target, check.Expect)
+	case TaskCheckTypeTCP:
+		var dialer net.Dialer
+		connection, err := dialer.DialContext(ctx, "tcp", target)
+		if err != nil {
+			return false, err.Error()
+		}
+		connection.Close()
+		return true, fmt.Sprintf("connected to %v", target)
+	case TaskCheckTypeDNS:
+		return checkDNS(ctx, target, check.Query, check.Expect)
+	case TaskCheckTypePing:
+		if output, err := exec.CommandContext(ctx, "ping", "-c", "1", "-W", "2", target).CombinedOutput(); err != nil {
+			return false, fmt.Sprintf("no reply from %v: %v", target, strings.TrimSpace(string(output)))
+		}
+		return true, fmt.Sprintf("reply from %v", target)
+	}
+	return false, fmt.Sprintf("unknown check type: %v", check.Type)
+}
+
+func checkHTTP(ctx context.Context, target string, expect string) (bool, string) {
+	httpRequest, requestErr := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if requestErr != nil {
+		return false, requestErr.Error()
+	}
+	httpResponse, responseErr := http.DefaultClient.Do(httpRequest)
+	if responseErr != nil {
+		return false, responseErr.Error()
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		return false, fmt.Sprintf("got %v", httpResponse.Status)
+	}
+	if expect != "" {
+		body, err := io.ReadAll(io.LimitReader(httpResponse.Body, taskCheckMaxBodyBytes))
+		if err != nil {
+			return false, err.Error()
+		}
+		if !strings.Contains(string(body), expect) {
+			return false, fmt.Sprintf("got %v, but without the expected content", httpResponse.Status)
+		}
+	}
+	return true, fmt.Sprintf("got %v", httpResponse.Status)
+}
+
+func checkDNS(ctx context.Context, server string, query string, expect string) (bool, string) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	resolver := net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+	addresses, err := resolver.LookupHost(ctx, query)
+	if err != nil {
+		return false, err.Error()
+	}
+	description := fmt.Sprintf("%v resolved to %v", query, strings.Join(addresses, ", "))
+	if expect == "" {
+		return true, description
+	}
+	for _, address := range addresses {
+		if address == expect {
+			return true, description
+		}
+	}
+	return false, description + fmt.Sprintf(", expected %v", expect)
+}
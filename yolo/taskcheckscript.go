@@ -0,0 +1,153 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+// defaultCheckScriptTimeout is the timeout for a check script run, if not configured.
+const defaultCheckScriptTimeout = 10 * time.Second
+
+// checkScriptMaxOutputBytes is how much of the script output is kept (the end of it).
+const checkScriptMaxOutputBytes = 64 * 1024
+
+// checkScriptOutputGrace is how long to wait for the rest of the output after the script exits, in case processes
+// left behind by the script still hold the output open.
+const checkScriptOutputGrace = 1 * time.Second
+
+// checkScriptMaxDescriptionLength limits the test status description from the script output.
+const checkScriptMaxDescriptionLength = 500
+
+// runScript runs the script with the sandbox command from the config, giving it the script on stdin and the station
+// in the TECHO_HOST, TECHO_TARGET, TECHO_TRACK, TECHO_STATION and TECHO_TIMESLOT environment variables.
+// It runs in an empty temporary directory without the environment of the backend.
+// The check passes if the script exits with 0, and the last line of output (stdout and stderr) is the description.
+func (check *TaskCheck) runScript(station *Station, host string, target string) (bool, string) {
+	scriptsConfig := config.Get().CheckScripts
+	if !scriptsConfig.Enabled {
+		return false, "check scripts are not enabled"
+	}
+	command := scriptsConfig.Command
+	if len(command) == 0 {
+		return false, "check scripts have no sandbox command"
+	}
+	timeout := defaultCheckScriptTimeout
+	if scriptsConfig.TimeoutSeconds > 0 {
+		timeout = time.Duration(scriptsConfig.TimeoutSeconds) * time.Second
+	}
+
+	workDir, err := os.MkdirTemp("", "techo-check-")
+	if err != nil {
+		return false, fmt.Sprintf("failed to prepare the script: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+	// Read the output through our own pipe instead of letting exec wait for it, so processes left behind by the
+	// script can't block the run, and only keep the end of it, so the script can't use unbounded memory or disk
+	outputReader, outputWriter, err := os.Pipe()
+	if err != nil {
+		return false, fmt.Sprintf("failed to prepare the script: %v", err)
+	}
+	output := &checkScriptOutput{}
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		defer outputReader.Close()
+		io.Copy(output, outputReader)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"PATH=/usr/local/bin:/usr/bin:/bin",
+		"HOME=" + workDir,
+		"TECHO_HOST=" + host,
+		"TECHO_TARGET=" + target,
+		"TECHO_TRACK=" + station.TrackID,
+		"TECHO_STATION=" + station.Shortname,
+		"TECHO_TIMESLOT=" + station.TimeslotID.String,
+	}
+	cmd.Stdin = strings.NewReader(check.Script)
+	cmd.Stdout = outputWriter
+	cmd.Stderr = outputWriter
+	runErr := cmd.Run()
+	outputWriter.Close()
+	select {
+	case <-outputDone:
+	case <-time.After(checkScriptOutputGrace):
+	}
+
+	description := output.description()
+	if ctx.Err() == context.DeadlineExceeded {
+		return false, fmt.Sprintf("timed out after %v", timeout)
+	}
+	if runErr != nil {
+		if description == "" {
+			description = runErr.Error()
+		}
+		return false, description
+	}
+	return true, description
+}
+
+// checkScriptOutput keeps the last checkScriptMaxOutputBytes of the script output, discarding the rest.
+type checkScriptOutput struct {
+	sync.Mutex
+	data []byte
+}
+
+func (output *checkScriptOutput) Write(p []byte) (int, error) {
+	output.Lock()
+	defer output.Unlock()
+	written := len(p)
+	if len(p) > checkScriptMaxOutputBytes {
+		p = p[len(p)-checkScriptMaxOutputBytes:]
+	}
+	if overflow := len(output.data) + len(p) - checkScriptMaxOutputBytes; overflow > 0 {
+		output.data = append(output.data[:0], output.data[overflow:]...)
+	}
+	output.data = append(output.data, p...)
+	return written, nil
+}
+
+// description gets the last non-empty line of the output.
+func (output *checkScriptOutput) description() string {
+	output.Lock()
+	data := string(output.data)
+	output.Unlock()
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	description := strings.TrimSpace(lines[len(lines)-1])
+	if len(description) > checkScriptMaxDescriptionLength {
+		description = description[:checkScriptMaxDescriptionLength]
+	}
+	return description
+}
@@ -0,0 +1,146 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"database/sql"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// TaskLockMode is how a track shows tasks with uncompleted dependencies to participants.
+type TaskLockMode string
+
+const (
+	// TaskLockModeNone ignores dependencies.
+	TaskLockModeNone TaskLockMode = ""
+	// TaskLockModeFlag marks tasks with uncompleted dependencies as locked.
+	TaskLockModeFlag TaskLockMode = "flag"
+	// TaskLockModeHide marks tasks with uncompleted dependencies as locked and hides their descriptions.
+	TaskLockModeHide TaskLockMode = "hide"
+)
+
+func validateTaskLockMode(mode TaskLockMode) bool {
+	switch mode {
+	case TaskLockModeNone:
+		fallthrough
+	case TaskLockModeFlag:
+		fallthrough
+	case TaskLockModeHide:
+		return true
+	default:
+		return false
+	}
+}
+
+// applyTaskLocks marks tasks as locked if any dependencies aren't completed for the timeslot, according to the track lock mode.
+// All tasks must belong to the track and have their dependencies loaded. An empty timeslot ID means nothing is completed.
+// Descriptions are only hidden if hideDescriptions is set, so operators may still see them.
+func applyTaskLocks(track *Track, tasks Tasks, timeslotID string, hideDescriptions bool) error {
+	if track.TaskLockMode == TaskLockModeNone {
+		return nil
+	}
+
+	// Find completed tasks
+	completedTaskIDs := make(map[uuid.UUID]bool)
+	if timeslotID != "" {
+		rows, rowsErr := db.DB.Query("SELECT tasks.id FROM tests JOIN tasks ON tests.track = tasks.track AND tests.task_shortname = tasks.shortname WHERE tests.track = $1 AND tests.timeslot = $2 GROUP BY tasks.id HAVING BOOL_AND(tests.status_success)",
+			track.ID, timeslotID)
+		if rowsErr != nil {
+			return rowsErr
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var taskID uuid.UUID
+			if err := rows.Scan(&taskID); err != nil {
+				return err
+			}
+			completedTaskIDs[taskID] = true
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	// Lock it
+	for _, task := range tasks {
+		task.Locked = false
+		for _, dependsOnID := range task.DependsOnIDs {
+			if !completedTaskIDs[dependsOnID] {
+				task.Locked = true
+				break
+			}
+		}
+		if task.Locked && hideDescriptions && track.TaskLockMode == TaskLockModeHide {
+			task.Description = ""
+		}
+	}
+	return nil
+}
+
+// applyTaskLocksForRequester applies task locks based on the requester's active timeslot for each track.
+// Operators/admins see all descriptions, but locks are still reflected based on their own active timeslots.
+func applyTaskLocksForRequester(tasks Tasks, token rest.AccessTokenEntry) error {
+	isOperator := token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin
+
+	// Group by track
+	trackTasks := make(map[string]Tasks)
+	for _, task := range tasks {
+		trackTasks[task.TrackID] = append(trackTasks[task.TrackID], task)
+	}
+
+	for trackID, tasks := range trackTasks {
+		var track Track
+		trackDBResult := db.Select(&track, "tracks", "id", "=", trackID)
+		if trackDBResult.IsFailed() {
+			return trackDBResult.Error
+		}
+		if !trackDBResult.IsSuccess() {
+			continue
+		}
+		timeslotID, err := findActiveTimeslotID(trackID, token.OwnerUserID)
+		if err != nil {
+			return err
+		}
+		if err := applyTaskLocks(&track, tasks, timeslotID, !isOperator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findActiveTimeslotID finds the ID of the user's timeslot (own or team) which currently has a station in the track.
+// Returns an empty string if none or if no user.
+func findActiveTimeslotID(trackID string, userID *uuid.UUID) (string, error) {
+	if userID == nil {
+		return "", nil
+	}
+	var timeslotID string
+	row := db.DB.QueryRow("SELECT stations.timeslot FROM stations JOIN timeslots ON stations.timeslot = timeslots.id WHERE stations.track = $1 AND (timeslots.\"user\" = $2 OR timeslots.team IN (SELECT team FROM team_members WHERE \"user\" = $2)) LIMIT 1",
+		trackID, userID)
+	err := row.Scan(&timeslotID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return timeslotID, err
+}
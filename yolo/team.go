@@ -0,0 +1,572 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// Team is a group of users participating together in a track, e.g. pairs in the net track.
+type Team struct {
+	ID        *uuid.UUID  `column:"id" json:"id"`       // Generated, required, unique
+	TrackID   string      `column:"track" json:"track"` // Required
+	Name      string      `column:"name" json:"name"`   // Required
+	MemberIDs []uuid.UUID `column:"-" json:"members"`   // Required, at least one, stored in a separate table
+	// Optional, users invited by members, who become members when accepting (see TeamJoinRequest), stored in a separate table
+	InvitedIDs []uuid.UUID `column:"-" json:"invited"`
+}
+
+// Teams is a list of teams.
+type Teams []*Team
+
+// teamMember is a row in the team members and team invites tables.
+type teamMember struct {
+	TeamID uuid.UUID `column:"team"`
+	UserID uuid.UUID `column:"user"`
+}
+
+// TeamJoinRequest is for accepting an invite to a team, by the invited user.
+type TeamJoinRequest struct{}
+
+// TeamDeclineRequest is for declining an invite to a team, by the invited user.
+type TeamDeclineRequest struct{}
+
+func init() {
+	rest.AddHandler("/teams/", "^$", func() interface{} { return &Teams{} })
+	rest.AddHandler("/team/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Team{} })
+	rest.AddHandler("/team/", "^(?P<id>[^/]+)/join/$", func() interface{} { return &TeamJoinRequest{} })
+	rest.AddHandler("/team/", "^(?P<id>[^/]+)/decline/$", func() interface{} { return &TeamDeclineRequest{} })
+}
+
+// Get gets multiple teams.
+func (teams *Teams) Get(request *rest.Request) rest.Result {
+	// Check params and prep filtering
+	var whereArgs []interface{}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+
+	// Find
+	tmpTeams := make(Teams, 0)
+	dbResult := db.SelectMany(&tmpTeams, "teams", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+
+	// Load members and filter
+	if err := tmpTeams.loadMembers(); err != nil {
+		return rest.InternalError(err)
+	}
+	isOperator := request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin
+	rawUserID, filterByUser := request.QueryArgs["user"]
+	for _, team := range tmpTeams {
+		// If not operator/admin, hide all teams the user is not a member of or invited to
+		if !isOperator && !team.isVisibleTo(request.AccessToken) {
+			continue
+		}
+		if filterByUser {
+			userID, userIDErr := uuid.Parse(rawUserID)
+			if userIDErr != nil || !team.hasMember(userID) {
+				continue
+			}
+		}
+		*teams = append(*teams, team)
+	}
+
+	return rest.Result{}
+}
+
+// Get gets a single team.
+func (team *Team) Get(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Get
+	dbResult := db.Select(team, "teams", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+	if err := team.loadMembers(); err != nil {
+		return rest.InternalError(err)
+	}
+
+	// Only show if operator/admin, member or invited
+	if !team.isVisibleTo(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	return rest.Result{}
+}
+
+// Post creates a new team.
+// Participants may create teams with only themselves as member, other users must be invited.
+func (team *Team) Post(request *rest.Request) rest.Result {
+	// Check params
+	if team.ID == nil {
+		newID := uuid.New()
+		team.ID = &newID
+	}
+
+	// Check perms
+	if !team.isAccessibleBy(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+	if result := team.checkAddedMembers(request.AccessToken, nil); !result.IsOk() {
+		return result
+	}
+
+	// Validate
+	if result := team.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Create and redirect
+	result := team.create()
+	if !result.IsOk() {
+		return result
+	}
+	result.Code = 201
+	result.Location = fmt.Sprintf("%v/team/%v/", config.Get().SitePrefix, team.ID)
+	return result
+}
+
+// Put updates a team.
+// Participants may only update teams they are members of and must remain a member. They may not add other members,
+// only invite them.
+func (team *Team) Put(request *rest.Request) rest.Result {
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.BadRequest("missing ID")
+	}
+	id, uuidErr := uuid.Parse(rawID)
+	if uuidErr != nil {
+		return rest.BadRequest("invalid ID")
+	}
+	if team.ID == nil || *team.ID != id {
+		return rest.BadRequest("mismatch between URL and JSON IDs")
+	}
+
+	// Check perms, both for the old and new version
+	var oldTeam Team
+	var oldMemberIDs []uuid.UUID
+	oldDBResult := db.Select(&oldTeam, "teams", "id", "=", id)
+	if oldDBResult.IsFailed() {
+		return rest.InternalError(oldDBResult.Error)
+	}
+	if oldDBResult.IsSuccess() {
+		if err := oldTeam.loadMembers(); err != nil {
+			return rest.InternalError(err)
+		}
+		if !oldTeam.isAccessibleBy(request.AccessToken) {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+		oldMemberIDs = oldTeam.MemberIDs
+	}
+	if !team.isAccessibleBy(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+	if result := team.checkAddedMembers(request.AccessToken, oldMemberIDs); !result.IsOk() {
+		return result
+	}
+
+	// Validate
+	if result := team.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Create or update
+	return team.createOrUpdate()
+}
+
+// Delete deletes a team.
+func (team *Team) Delete(request *rest.Request) rest.Result {
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.BadRequest("missing ID")
+	}
+	id, uuidErr := uuid.Parse(rawID)
+	if uuidErr != nil {
+		return rest.BadRequest("invalid ID")
+	}
+
+	// Get it
+	dbResult := db.Select(team, "teams", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+	if err := team.loadMembers(); err != nil {
+		return rest.InternalError(err)
+	}
+
+	// Check perms
+	if !team.isAccessibleBy(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check if in use
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM timeslots WHERE team = $1", team.ID)
+	if err := row.Scan(&count); err != nil {
+		return rest.InternalError(err)
+	}
+	if count > 0 {
+		return rest.Conflict("team is referenced by timeslots")
+	}
+
+	// Delete it, its members and its invites
+	if dbResult := db.Delete("team_members", "team", "=", team.ID); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if dbResult := db.Delete("team_invites", "team", "=", team.ID); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if dbResult := db.Delete("teams", "id", "=", team.ID); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+func (team *Team) create() rest.Result {
+	if exists, err := team.exists(); err != nil {
+		return rest.InternalError(err)
+	} else if exists {
+		return rest.Conflict("duplicate")
+	}
+
+	dbResult := db.Insert("teams", team)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return team.saveMembers()
+}
+
+func (team *Team) createOrUpdate() rest.Result {
+	exists, existsErr := team.exists()
+	if existsErr != nil {
+		return rest.InternalError(existsErr)
+	}
+
+	var dbResult db.Result
+	if exists {
+		dbResult = db.Update("teams", team, "id", "=", team.ID)
+	} else {
+		dbResult = db.Insert("teams", team)
+	}
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return team.saveMembers()
+}
+
+// saveMembers replaces the saved members and invites of the team with the current ones.
+func (team *Team) saveMembers() rest.Result {
+	for table, userIDs := range map[string][]uuid.UUID{"team_members": team.MemberIDs, "team_invites": team.InvitedIDs} {
+		if dbResult := db.Delete(table, "team", "=", team.ID); dbResult.IsFailed() {
+			return rest.InternalError(dbResult.Error)
+		}
+		for _, userID := range userIDs {
+			member := teamMember{TeamID: *team.ID, UserID: userID}
+			if dbResult := db.Insert(table, member); dbResult.IsFailed() {
+				return rest.InternalError(dbResult.Error)
+			}
+		}
+	}
+	return rest.Result{}
+}
+
+// loadMembers loads the member and invited user IDs for the team.
+func (team *Team) loadMembers() error {
+	var err error
+	if team.MemberIDs, err = loadTeamUserIDs("team_members", *team.ID); err != nil {
+		return err
+	}
+	team.InvitedIDs, err = loadTeamUserIDs("team_invites", *team.ID)
+	return err
+}
+
+// loadMembers loads the members and invited users of all the teams, with one query per table.
+func (teams Teams) loadMembers() error {
+	if len(teams) == 0 {
+		return nil
+	}
+	teamIDs := make([]string, 0, len(teams))
+	membersByTeam := make(map[uuid.UUID][]uuid.UUID, len(teams))
+	invitedByTeam := make(map[uuid.UUID][]uuid.UUID, len(teams))
+	for _, team := range teams {
+		teamIDs = append(teamIDs, team.ID.String())
+	}
+	for table, userIDsByTeam := range map[string]map[uuid.UUID][]uuid.UUID{"team_members": membersByTeam, "team_invites": invitedByTeam} {
+		var members []teamMember
+		dbResult := db.SelectMany(&members, table, "team", "IN", teamIDs)
+		if dbResult.IsFailed() {
+			return dbResult.Error
+		}
+		for _, member := range members {
+			userIDsByTeam[member.TeamID] = append(userIDsByTeam[member.TeamID], member.UserID)
+		}
+	}
+	for _, team := range teams {
+		team.MemberIDs = append(make([]uuid.UUID, 0), membersByTeam[*team.ID]...)
+		team.InvitedIDs = append(make([]uuid.UUID, 0), invitedByTeam[*team.ID]...)
+	}
+	return nil
+}
+
+func loadTeamUserIDs(table string, teamID uuid.UUID) ([]uuid.UUID, error) {
+	var members []teamMember
+	dbResult := db.SelectMany(&members, table, "team", "=", teamID)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	userIDs := make([]uuid.UUID, 0, len(members))
+	for _, member := range members {
+		userIDs = append(userIDs, member.UserID)
+	}
+	return userIDs, nil
+}
+
+func (team *Team) hasMember(userID uuid.UUID) bool {
+	for _, memberID := range team.MemberIDs {
+		if memberID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// isAccessibleBy checks if the token is for an operator/admin or for a member of the team.
+func (team *Team) isAccessibleBy(token rest.AccessTokenEntry) bool {
+	if token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin {
+		return true
+	}
+	return token.OwnerUserID != nil && team.hasMember(*token.OwnerUserID)
+}
+
+func (team *Team) isInvited(userID uuid.UUID) bool {
+	for _, invitedID := range team.InvitedIDs {
+		if invitedID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// isVisibleTo checks if the token is for an operator/admin or for a member of or user invited to the team.
+func (team *Team) isVisibleTo(token rest.AccessTokenEntry) bool {
+	return team.isAccessibleBy(token) || (token.OwnerUserID != nil && team.isInvited(*token.OwnerUserID))
+}
+
+// checkAddedMembers checks that participants only add themselves as members (to new teams), so nobody can be put
+// in a team (and blocked from other teams in the track) without accepting. Other users must be invited instead.
+func (team *Team) checkAddedMembers(token rest.AccessTokenEntry, oldMemberIDs []uuid.UUID) rest.Result {
+	if token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin {
+		return rest.Result{}
+	}
+	oldMembers := make(map[uuid.UUID]bool, len(oldMemberIDs))
+	for _, userID := range oldMemberIDs {
+		oldMembers[userID] = true
+	}
+	for _, userID := range team.MemberIDs {
+		isSelf := token.OwnerUserID != nil && *token.OwnerUserID == userID
+		if !oldMembers[userID] && !(isSelf && len(oldMemberIDs) == 0) {
+			return rest.Forbidden("participants may not add other users as members, invite them instead")
+		}
+	}
+	return rest.Result{}
+}
+
+func (team *Team) exists() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM teams WHERE id = $1", team.ID)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+func (team *Team) validate() rest.Result {
+	switch {
+	case team.ID == nil:
+		return rest.BadRequest("missing ID")
+	case team.TrackID == "":
+		return rest.BadRequest("missing track ID")
+	case team.Name == "":
+		return rest.BadRequest("missing name")
+	case len(team.MemberIDs) == 0:
+		return rest.BadRequest("missing members")
+	}
+
+	track := Track{ID: team.TrackID}
+	if exists, err := track.exists(); err != nil {
+		return rest.InternalError(err)
+	} else if !exists {
+		return rest.BadRequest("referenced track does not exist")
+	}
+
+	seenMembers := make(map[uuid.UUID]bool)
+	for _, userID := range team.MemberIDs {
+		if seenMembers[userID] {
+			return rest.BadRequest("duplicate member")
+		}
+		seenMembers[userID] = true
+
+		memberID := userID
+		user := rest.User{ID: &memberID}
+		if exists, err := user.ExistsWithID(); err != nil {
+			return rest.InternalError(err)
+		} else if !exists {
+			return rest.BadRequest("referenced member user does not exist")
+		}
+
+		// Users may only be in one team per track
+		var count int
+		row := db.DB.QueryRow("SELECT COUNT(*) FROM team_members AS m JOIN teams AS t ON m.team = t.id WHERE t.id != $1 AND t.track = $2 AND m.\"user\" = $3",
+			team.ID, team.TrackID, userID)
+		if err := row.Scan(&count); err != nil {
+			return rest.InternalError(err)
+		}
+		if count > 0 {
+			return rest.Conflict("member is already in another team for this track")
+		}
+	}
+	for _, userID := range team.InvitedIDs {
+		if seenMembers[userID] {
+			return rest.BadRequest("duplicate member or invited user")
+		}
+		seenMembers[userID] = true
+
+		invitedID := userID
+		user := rest.User{ID: &invitedID}
+		if exists, err := user.ExistsWithID(); err != nil {
+			return rest.InternalError(err)
+		} else if !exists {
+			return rest.BadRequest("referenced invited user does not exist")
+		}
+	}
+
+	return rest.Result{}
+}
+
+// Post makes the requester a member of the team, if invited.
+func (joinRequest *TeamJoinRequest) Post(request *rest.Request) rest.Result {
+	team, userID, result := loadTeamInvite(request)
+	if !result.IsOk() {
+		return result
+	}
+	var invitedIDs []uuid.UUID
+	for _, invitedID := range team.InvitedIDs {
+		if invitedID != userID {
+			invitedIDs = append(invitedIDs, invitedID)
+		}
+	}
+	team.InvitedIDs = invitedIDs
+	team.MemberIDs = append(team.MemberIDs, userID)
+	if result := team.validate(); !result.IsOk() {
+		return result
+	}
+	return team.saveMembers()
+}
+
+// Post removes the invite of the requester to the team.
+func (declineRequest *TeamDeclineRequest) Post(request *rest.Request) rest.Result {
+	team, userID, result := loadTeamInvite(request)
+	if !result.IsOk() {
+		return result
+	}
+	if dbResult := db.Delete("team_invites", "team", "=", team.ID, "user", "=", userID); dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// loadTeamInvite loads the team from the path, requiring the requester to be invited to it.
+func loadTeamInvite(request *rest.Request) (*Team, uuid.UUID, rest.Result) {
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return nil, uuid.UUID{}, rest.BadRequest("missing ID")
+	}
+	id, uuidErr := uuid.Parse(rawID)
+	if uuidErr != nil {
+		return nil, uuid.UUID{}, rest.BadRequest("invalid ID")
+	}
+	if request.AccessToken.OwnerUserID == nil {
+		return nil, uuid.UUID{}, rest.UnauthorizedResult(request.AccessToken)
+	}
+	userID := *request.AccessToken.OwnerUserID
+
+	var team Team
+	dbResult := db.Select(&team, "teams", "id", "=", id)
+	if dbResult.IsFailed() {
+		return nil, uuid.UUID{}, rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return nil, uuid.UUID{}, rest.NotFound("not found")
+	}
+	if err := team.loadMembers(); err != nil {
+		return nil, uuid.UUID{}, rest.InternalError(err)
+	}
+	if !team.isInvited(userID) {
+		return nil, uuid.UUID{}, rest.NotFound("not invited to the team")
+	}
+	return &team, userID, rest.Result{}
+}
+
+// isTeamMember checks if the user is a member of the team.
+func isTeamMember(teamID uuid.UUID, userID uuid.UUID) (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM team_members WHERE team = $1 AND \"user\" = $2", teamID, userID)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+// userTeamIDs gets the IDs of all teams the user is a member of.
+func userTeamIDs(userID uuid.UUID) (map[uuid.UUID]bool, error) {
+	var members []*teamMember
+	dbResult := db.SelectMany(&members, "team_members", "\"user\"", "=", userID)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	teamIDs := make(map[uuid.UUID]bool, len(members))
+	for _, member := range members {
+		teamIDs[member.TeamID] = true
+	}
+	return teamIDs, nil
+}
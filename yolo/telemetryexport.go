@@ -0,0 +1,255 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	content "github.com/gathering/tech-online-backend/doc"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/worker"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// telemetryExportInterval is how often it's checked if the nightly export is due.
+const telemetryExportInterval = 10 * time.Minute
+
+// telemetryExportGrace is how far behind the current time exports end, so rows committed a bit after their
+// time (e.g. buffered request log entries or long transactions) aren't skipped by the next export.
+const telemetryExportGrace = 10 * time.Minute
+
+// telemetryExportPageDuration is the period of rows loaded at a time, to avoid loading everything at once.
+const telemetryExportPageDuration = 1 * time.Hour
+
+// TelemetryExport is a single exported file of raw event telemetry, as gzipped JSONL (one row per line).
+// Each kind is exported in consecutive periods, so every row is exported exactly once.
+type TelemetryExport struct {
+	ID           *uuid.UUID `column:"id" json:"id"`
+	Kind         string     `column:"kind" json:"kind"`             // E.g. "tests", see telemetryExportSources
+	FromTime     time.Time  `column:"from_time" json:"from_time"`   // Inclusive
+	UntilTime    time.Time  `column:"until_time" json:"until_time"` // Exclusive
+	ObjectKey    string     `column:"object_key" json:"object_key"` // Within the bucket and path prefix, empty if there were no rows
+	RowCount     int        `column:"row_count" json:"row_count"`
+	Bytes        int        `column:"bytes" json:"bytes"` // Compressed
+	CreationTime time.Time  `column:"creation_time" json:"creation_time"`
+}
+
+// TelemetryExports is a list of exports, newest first.
+type TelemetryExports []*TelemetryExport
+
+// telemetryExportSource is a kind of telemetry to export, from the table with the time column.
+type telemetryExportSource struct {
+	kind       string
+	table      string
+	timeColumn string
+	load       func(table string, timeColumn string, from time.Time, until time.Time) ([]interface{}, error)
+}
+
+// telemetryExportSources are the exported kinds. Station history is exported when ended, since it's updated until then.
+var telemetryExportSources = []telemetryExportSource{
+	{kind: "tests", table: "test_history", timeColumn: "timestamp", load: loadTelemetryRows[*Test]},
+	{kind: "station-history", table: "station_history", timeColumn: "end_time", load: loadTelemetryRows[*StationHistoryEntry]},
+	{kind: "request-log", table: "request_log", timeColumn: "time", load: loadTelemetryRows[*rest.RequestLogEntry]},
+}
+
+// telemetryExportLock prevents the nightly and manual exports from exporting the same period twice.
+var telemetryExportLock sync.Mutex
+
+func init() {
+	rest.AddHandler("/admin/", "^exports/$", func() interface{} { return &TelemetryExports{} })
+	worker.AddTask("telemetry-export", telemetryExportInterval, runNightlyTelemetryExport)
+}
+
+// Get gets the exports, newest first.
+func (exports *TelemetryExports) Get(request *rest.Request) rest.Result {
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	var whereArgs []interface{}
+	if kind, ok := request.QueryArgs["kind"]; ok {
+		whereArgs = append(whereArgs, "kind", "=", kind)
+	}
+	dbResult := db.SelectManyOrdered(exports, "telemetry_exports", "creation_time DESC, kind", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Post exports everything not yet exported, e.g. before wiping the database.
+func (exports *TelemetryExports) Post(request *rest.Request) rest.Result {
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+	if !config.Get().Exports.Enabled {
+		return rest.Conflict("exports are not enabled")
+	}
+
+	created, err := exportTelemetry(time.Now())
+	if err != nil {
+		return rest.InternalError(err)
+	}
+	return rest.Result{Message: fmt.Sprintf("exported %v kinds", len(created))}
+}
+
+// runNightlyTelemetryExport exports up to the start of the day once the configured hour has passed.
+func runNightlyTelemetryExport() {
+	exportsConfig := config.Get().Exports
+	if !exportsConfig.Enabled {
+		return
+	}
+	now := time.Now()
+	if now.Hour() < exportsConfig.Hour {
+		return
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	created, err := exportTelemetry(midnight)
+	if err != nil {
+		log.WithError(err).Error("Failed to export telemetry")
+		return
+	}
+	for _, export := range created {
+		log.WithFields(log.Fields{
+			"kind": export.Kind,
+			"key":  export.ObjectKey,
+			"rows": export.RowCount,
+		}).Info("Exported telemetry")
+	}
+}
+
+// exportTelemetry exports the rows of all kinds from the end of their previous export until the time,
+// or until telemetryExportGrace ago if that's earlier. Kinds already exported until then are skipped.
+// Returns the new exports.
+func exportTelemetry(until time.Time) (TelemetryExports, error) {
+	telemetryExportLock.Lock()
+	defer telemetryExportLock.Unlock()
+
+	if graceUntil := time.Now().Add(-telemetryExportGrace); until.After(graceUntil) {
+		until = graceUntil
+	}
+
+	storage := content.NewObjectStorage(config.Get().Exports.S3)
+	created := make(TelemetryExports, 0)
+	for _, source := range telemetryExportSources {
+		var lastUntil sql.NullTime
+		row := db.DB.QueryRow("SELECT MAX(until_time) FROM telemetry_exports WHERE kind = $1", source.kind)
+		if err := row.Scan(&lastUntil); err != nil {
+			return created, err
+		}
+		from := time.Unix(0, 0)
+		if lastUntil.Valid {
+			from = lastUntil.Time
+		}
+		if !from.Before(until) {
+			continue
+		}
+
+		compressed, rowCount, encodeErr := source.encode(from, until)
+		if encodeErr != nil {
+			return created, fmt.Errorf("failed to export %v: %w", source.kind, encodeErr)
+		}
+		exportID := uuid.New()
+		export := TelemetryExport{
+			ID:           &exportID,
+			Kind:         source.kind,
+			FromTime:     from,
+			UntilTime:    until,
+			RowCount:     rowCount,
+			CreationTime: time.Now(),
+		}
+		if rowCount > 0 {
+			export.ObjectKey = fmt.Sprintf("%v/%v_%v.jsonl.gz", source.kind, from.UTC().Format("20060102T150405Z"), until.UTC().Format("20060102T150405Z"))
+			export.Bytes = len(compressed)
+			if err := storage.Store(export.ObjectKey, compressed, "application/gzip"); err != nil {
+				return created, fmt.Errorf("failed to store %v: %w", export.ObjectKey, err)
+			}
+		}
+		if dbResult := db.Insert("telemetry_exports", &export); dbResult.IsFailed() {
+			return created, dbResult.Error
+		}
+		created = append(created, &export)
+	}
+	return created, nil
+}
+
+// loadTelemetryRows loads the rows of the table with the time column within the period, oldest first.
+func loadTelemetryRows[T any](table string, timeColumn string, from time.Time, until time.Time) ([]interface{}, error) {
+	rows, err := db.SelectAllOrdered[T](table, timeColumn, timeColumn, ">=", from, timeColumn, "<", until)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]interface{}, len(rows))
+	for i, row := range rows {
+		result[i] = row
+	}
+	return result, nil
+}
+
+// encode loads the rows within the period one page at a time, oldest first, and encodes them as gzipped JSONL.
+// Empty periods between rows are skipped. Returns the encoded rows and the number of rows.
+func (source telemetryExportSource) encode(from time.Time, until time.Time) ([]byte, int, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	encoder := json.NewEncoder(writer)
+	firstQuery := fmt.Sprintf("SELECT MIN(\"%v\") FROM \"%v\" WHERE \"%v\" >= $1 AND \"%v\" < $2",
+		source.timeColumn, source.table, source.timeColumn, source.timeColumn)
+	rowCount := 0
+	for pageFrom := from; pageFrom.Before(until); {
+		var first sql.NullTime
+		if err := db.DB.QueryRow(firstQuery, pageFrom, until).Scan(&first); err != nil {
+			return nil, 0, err
+		}
+		if !first.Valid {
+			break
+		}
+		pageFrom = first.Time
+		pageUntil := pageFrom.Add(telemetryExportPageDuration)
+		if pageUntil.After(until) {
+			pageUntil = until
+		}
+
+		rows, err := source.load(source.table, source.timeColumn, pageFrom, pageUntil)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, row := range rows {
+			if err := encoder.Encode(row); err != nil {
+				return nil, 0, err
+			}
+		}
+		rowCount += len(rows)
+		pageFrom = pageUntil
+	}
+	if err := writer.Close(); err != nil {
+		return nil, 0, err
+	}
+	return buffer.Bytes(), rowCount, nil
+}
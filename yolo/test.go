@@ -22,6 +22,7 @@ package yolo
 
 import (
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/gathering/tech-online-backend/config"
@@ -33,26 +34,36 @@ import (
 // Test is a test of a task.
 // Track ID, task shortname and station shortname are used because clients aren't expected to know the task or station UUIDs.
 type Test struct {
-	ID                *uuid.UUID `column:"id" json:"id"`                               // Generated, required, unique
-	TrackID           string     `column:"track" json:"track"`                         // Required
-	TaskShortname     string     `column:"task_shortname" json:"task_shortname"`       // Required
-	Shortname         string     `column:"shortname" json:"shortname"`                 // Required
-	StationShortname  string     `column:"station_shortname" json:"station_shortname"` // Required
-	TimeslotID        string     `column:"timeslot" json:"timeslot"`                   // Automatic, NULL if no current timeslot
-	Name              string     `column:"name" json:"name"`                           // Required
-	Description       string     `column:"description" json:"description"`
-	Sequence          *int       `column:"sequence" json:"sequence"`
-	Timestamp         *time.Time `column:"timestamp" json:"timestamp"`           // Generated, required
-	StatusSuccess     *bool      `column:"status_success" json:"status_success"` // Required
-	StatusDescription string     `column:"status_description" json:"status_description"`
+	ID                *uuid.UUID    `column:"id" json:"id"`                               // Generated, required, unique
+	TrackID           string        `column:"track" json:"track"`                         // Required
+	TaskShortname     string        `column:"task_shortname" json:"task_shortname"`       // Required
+	Shortname         string        `column:"shortname" json:"shortname"`                 // Required
+	StationShortname  string        `column:"station_shortname" json:"station_shortname"` // Required
+	TimeslotID        db.NullString `column:"timeslot" json:"timeslot"`                   // Automatic, NULL if no current timeslot
+	Name              string        `column:"name" json:"name"`                           // Required
+	Description       string        `column:"description" json:"description"`
+	Sequence          *int          `column:"sequence" json:"sequence"`
+	Timestamp         *time.Time    `column:"timestamp" json:"timestamp"`           // Generated, required
+	StatusSuccess     *bool         `column:"status_success" json:"status_success"` // Required
+	StatusDescription string        `column:"status_description" json:"status_description"`
 }
 
 // Tests is a list of tests.
 type Tests []*Test
 
+// TestHistory is a list of all received test results, ordered by time.
+// Unlike tests, which only keep the latest result, results in the history are never overwritten.
+type TestHistory []*Test
+
 func init() {
 	rest.AddHandler("/tests/", "^$", func() interface{} { return &Tests{} })
 	rest.AddHandler("/test/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Test{} })
+	rest.AddHandler("/test-history/", "^$", func() interface{} { return &TestHistory{} })
+}
+
+// CSVExport allows the tests to be listed as CSV.
+func (tests *Tests) CSVExport() bool {
+	return true
 }
 
 // Get gets multiple tests.
@@ -74,16 +85,16 @@ func (tests *Tests) Get(request *rest.Request) rest.Result {
 		whereArgs = append(whereArgs, "station_shortname", "=", stationShortname)
 	}
 	if timeslot, ok := request.QueryArgs["timeslot"]; ok {
-		whereArgs = append(whereArgs, "timeslot", "=", timeslot)
+		whereArgs = append(whereArgs, "timeslot", "=", db.StringOrNull(timeslot))
 	}
 	if _, ok := request.QueryArgs["latest"]; ok {
-		whereArgs = append(whereArgs, "timeslot", "=", "")
+		whereArgs = append(whereArgs, "timeslot", "=", nil)
 	}
 
 	// Get
 	dbResult := db.SelectMany(tests, "tests", whereArgs...)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
 	return rest.Result{}
 }
@@ -95,16 +106,16 @@ func (tests *Tests) Post(request *rest.Request) rest.Result {
 		return rest.UnauthorizedResult(request.AccessToken)
 	}
 
-	// Feed individual tests to the individual post endpoint, stop on first error
-	totalResult := rest.Result{}
-	for _, test := range *tests {
-		result := test.Post(request)
-		if !result.IsOk() {
-			return result
+	// Feed individual tests to the individual post endpoint in a single transaction, all or nothing
+	return rest.InTransaction(request, func() rest.Result {
+		for i, test := range *tests {
+			result := test.Post(request)
+			if !result.IsOk() {
+				return rest.ElementFailedResult(result, fmt.Sprintf("test %v (%v/%v/%v)", i, test.TaskShortname, test.Shortname, test.StationShortname))
+			}
 		}
-	}
-
-	return totalResult
+		return rest.Result{}
+	})
 }
 
 // Delete delete multiple tests.
@@ -129,44 +140,84 @@ func (tests *Tests) Delete(request *rest.Request) rest.Result {
 		whereArgs = append(whereArgs, "station_shortname", "=", stationShortname)
 	}
 	if timeslot, ok := request.QueryArgs["timeslot"]; ok {
-		whereArgs = append(whereArgs, "timeslot", "=", timeslot)
+		whereArgs = append(whereArgs, "timeslot", "=", db.StringOrNull(timeslot))
 	}
 	if _, ok := request.QueryArgs["latest"]; ok {
-		whereArgs = append(whereArgs, "timeslot", "=", "")
+		whereArgs = append(whereArgs, "timeslot", "=", nil)
 	}
 
 	// Find all to delete
 	dbResult := db.SelectMany(tests, "tests", whereArgs...)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
+	}
+
+	// Check all tracks are operated by the requester before deleting anything
+	trackIDs := make([]string, 0, len(*tests))
+	for _, test := range *tests {
+		trackIDs = append(trackIDs, test.TrackID)
+	}
+	if result := checkTrackOperator(request.AccessToken, trackIDs...); !result.IsOk() {
+		return result
 	}
 
 	// Delete one by one, exit on first error
 	for _, test := range *tests {
 		dbResult := db.Delete("tests", "id", "=", test.ID)
 		if dbResult.IsFailed() {
-			return rest.Result{Code: 500, Error: dbResult.Error}
+			return rest.InternalError(dbResult.Error)
 		}
 	}
 
 	return rest.Result{}
 }
 
+// Get gets the pass/fail timeline of tests.
+func (history *TestHistory) Get(request *rest.Request) rest.Result {
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+	if taskShortname, ok := request.QueryArgs["task-shortname"]; ok {
+		whereArgs = append(whereArgs, "task_shortname", "=", taskShortname)
+	}
+	if shortname, ok := request.QueryArgs["shortname"]; ok {
+		whereArgs = append(whereArgs, "shortname", "=", shortname)
+	}
+	if stationShortname, ok := request.QueryArgs["station-shortname"]; ok {
+		whereArgs = append(whereArgs, "station_shortname", "=", stationShortname)
+	}
+	if timeslot, ok := request.QueryArgs["timeslot"]; ok {
+		whereArgs = append(whereArgs, "timeslot", "=", db.StringOrNull(timeslot))
+	}
+
+	// Get
+	dbResult := db.SelectMany(history, "test_history", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	sort.SliceStable(*history, func(i, j int) bool {
+		return (*history)[i].Timestamp.Before(*(*history)[j].Timestamp)
+	})
+	return rest.Result{}
+}
+
 // Get gets a single test.
 func (test *Test) Get(request *rest.Request) rest.Result {
 	// Check params
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 
 	// Get
 	dbResult := db.Select(test, "tests", "id", "=", id)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
 	if !dbResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "not found"}
+		return rest.NotFound("not found")
 	}
 	return rest.Result{}
 }
@@ -181,7 +232,7 @@ func (test *Test) Post(request *rest.Request) rest.Result {
 	// Overwrite certain fields
 	newID := uuid.New()
 	test.ID = &newID
-	test.TimeslotID = ""
+	test.TimeslotID = db.NullString{}
 	now := time.Now()
 	test.Timestamp = &now
 
@@ -189,48 +240,100 @@ func (test *Test) Post(request *rest.Request) rest.Result {
 	if result := test.validate(); !result.IsOk() {
 		return result
 	}
+	if result := checkTrackOperator(request.AccessToken, test.TrackID); !result.IsOk() {
+		return result
+	}
 
 	// Bind to the active timeslot, if any
 	var station Station
-	stationDBResult := db.Select(&station, "stations",
+	stationDBResult := db.SelectWith(request.Executor(), &station, "stations",
 		"track", "=", test.TrackID,
 		"shortname", "=", test.StationShortname,
 	)
 	if stationDBResult.IsFailed() {
-		return rest.Result{Code: 500, Error: stationDBResult.Error}
+		return rest.InternalError(stationDBResult.Error)
 	}
 	if !stationDBResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "station not found"}
+		return rest.NotFound("station not found")
 	}
 	test.TimeslotID = station.TimeslotID
 
+	// Save it
+	if err := test.save(request.Executor()); err != nil {
+		return rest.InternalError(err)
+	}
+	return rest.Created(fmt.Sprintf("%v/test/%v", config.Get().SitePrefix, test.ID))
+}
+
+// save saves the test, overwriting old equivalent tests, and adds it to the history.
+// If bound to a timeslot, a clone without the timeslot is saved too, as the latest result for the station.
+// The executor may be the DB or a transaction.
+func (test *Test) save(executor db.Executor) error {
 	// Delete old equivalent tests, both without timeslot and with the current timeslot
-	_, deleteErr := db.DB.Exec("DELETE FROM tests WHERE track = $1 AND task_shortname = $2 AND shortname = $3 AND station_shortname = $4 AND (timeslot = $5 OR timeslot = '')",
+	rows, deleteErr := executor.Query("DELETE FROM tests WHERE track = $1 AND task_shortname = $2 AND shortname = $3 AND station_shortname = $4 AND (timeslot = $5 OR timeslot IS NULL) RETURNING status_success",
 		test.TrackID, test.TaskShortname, test.Shortname, test.StationShortname, test.TimeslotID)
 	if deleteErr != nil {
-		return rest.Result{Code: 500, Error: deleteErr}
+		return deleteErr
+	}
+	previouslyFailed := false
+	previouslyPassed := false
+	for rows.Next() {
+		var previousSuccess *bool
+		if err := rows.Scan(&previousSuccess); err != nil {
+			rows.Close()
+			return err
+		}
+		previouslyFailed = previouslyFailed || (previousSuccess != nil && !*previousSuccess)
+		previouslyPassed = previouslyPassed || (previousSuccess != nil && *previousSuccess)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	db.NotifyWrite("tests")
+
+	// Notify webhooks if it started failing
+	if test.StatusSuccess != nil && !*test.StatusSuccess && !previouslyFailed {
+		if err := queueWebhookEvent(executor, WebhookEventTestFailed, test); err != nil {
+			return err
+		}
 	}
 
 	// Save clone without timeslot
-	if test.TimeslotID != "" {
+	if test.TimeslotID.Valid {
 		cloneTest := *test
-		cloneTest.TimeslotID = ""
+		cloneTest.TimeslotID = db.NullString{}
 		newCloneID := uuid.New()
 		cloneTest.ID = &newCloneID
-		result := cloneTest.create()
-		if !result.IsOk() {
-			return result
+		if err := cloneTest.insert(executor, "tests"); err != nil {
+			return err
 		}
 	}
 
-	// Save original with timeslot
-	result := test.create()
-	if !result.IsOk() {
-		return result
+	// Save original with timeslot and add it to the history
+	if err := test.insert(executor, "tests"); err != nil {
+		return err
+	}
+	if err := test.insert(executor, "test_history"); err != nil {
+		return err
 	}
-	result.Code = 201
-	result.Location = fmt.Sprintf("%v/test/%v", config.Config.SitePrefix, test.ID)
-	return result
+
+	// Notify webhooks and the provisioning service if it was the last one to pass
+	if test.StatusSuccess != nil && *test.StatusSuccess && (previouslyFailed || !previouslyPassed) {
+		return queueStationTestsPassed(executor, test)
+	}
+	return nil
+}
+
+// insert inserts the test into the table, which must have the same columns as the tests table.
+func (test *Test) insert(executor db.Executor, table string) error {
+	_, err := executor.Exec("INSERT INTO "+table+" (id, track, task_shortname, shortname, station_shortname, timeslot, name, description, sequence, timestamp, status_success, status_description) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)",
+		test.ID, test.TrackID, test.TaskShortname, test.Shortname, test.StationShortname, test.TimeslotID, test.Name, test.Description, test.Sequence, test.Timestamp, test.StatusSuccess, test.StatusDescription)
+	if err != nil {
+		return err
+	}
+	db.NotifyWrite(table)
+	return nil
 }
 
 // Delete deletes a test.
@@ -243,105 +346,91 @@ func (test *Test) Delete(request *rest.Request) rest.Result {
 	// Check params
 	rawID, rawIDExists := request.PathArgs["id"]
 	if !rawIDExists || rawID == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 	id, uuidError := uuid.Parse(rawID)
 	if uuidError != nil {
-		return rest.Result{Code: 400, Message: "invalid ID"}
+		return rest.BadRequest("invalid ID")
 	}
 
 	// Check if it exists
-	test.ID = &id
-	exists, err := test.exists()
-	if err != nil {
-		return rest.Result{Code: 500, Error: err}
-	}
-	if !exists {
-		return rest.Result{Code: 404, Message: "not found"}
-	}
-
-	// Delete it
-	dbResult := db.Delete("tests", "id", "=", test.ID)
+	dbResult := db.Select(test, "tests", "id", "=", id)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
-	return rest.Result{}
-}
-
-func (test *Test) create() rest.Result {
-	if exists, err := test.exists(); err != nil {
-		return rest.Result{Code: 500, Error: err}
-	} else if exists {
-		return rest.Result{Code: 409, Message: "duplicate"}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+	if result := checkTrackOperator(request.AccessToken, test.TrackID); !result.IsOk() {
+		return result
 	}
 
-	dbResult := db.Insert("tests", test)
+	// Delete it
+	dbResult = db.Delete("tests", "id", "=", test.ID)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
 	return rest.Result{}
 }
 
-func (test *Test) exists() (bool, error) {
-	var count int
-	row := db.DB.QueryRow("SELECT COUNT(*) FROM tests WHERE id = $1", test.ID)
-	rowErr := row.Scan(&count)
-	if rowErr != nil {
-		return false, rowErr
-	}
-	return count > 0, nil
-}
-
 func (test *Test) validate() rest.Result {
-	switch {
-	case test.ID == nil:
-		return rest.Result{Code: 400, Message: "missing ID"}
-	case test.TrackID == "":
-		return rest.Result{Code: 400, Message: "missing track ID"}
-	case test.TaskShortname == "":
-		return rest.Result{Code: 400, Message: "missing task shortname"}
-	case test.Shortname == "":
-		return rest.Result{Code: 400, Message: "missing shortname"}
-	case test.StationShortname == "":
-		return rest.Result{Code: 400, Message: "missing station shortname"}
-	case test.Name == "":
-		return rest.Result{Code: 400, Message: "missing name"}
-	case test.StatusSuccess == nil:
-		return rest.Result{Code: 400, Message: "missing success status"}
-	case test.Timestamp == nil:
-		return rest.Result{Code: 400, Message: "missing timestamp"}
+	if result := test.validateFields(); !result.IsOk() {
+		return result
 	}
 
 	track := Track{ID: test.TrackID}
 	if exists, err := track.exists(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if !exists {
-		return rest.Result{Code: 400, Message: "referenced track does not exist"}
+		return rest.BadRequest("referenced track does not exist")
 	}
 	task := Task{TrackID: test.TrackID, Shortname: test.TaskShortname}
 	if exists, err := task.existsShortname(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if !exists {
-		return rest.Result{Code: 400, Message: "referenced task does not exist"}
+		return rest.BadRequest("referenced task does not exist")
 	}
 	station := Station{TrackID: test.TrackID, Shortname: test.StationShortname}
 	if exists, err := station.existsShortname(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if !exists {
-		return rest.Result{Code: 400, Message: "referenced station does not exist"}
+		return rest.BadRequest("referenced station does not exist")
 	}
-	if test.TimeslotID != "" {
-		timeslotID, timeslotIDErr := uuid.Parse(test.TimeslotID)
+	if test.TimeslotID.Valid {
+		timeslotID, timeslotIDErr := uuid.Parse(test.TimeslotID.String)
 		if timeslotIDErr != nil {
-			return rest.Result{Code: 400, Message: "invalid timeslot ID"}
+			return rest.BadRequest("invalid timeslot ID")
 		}
 		timeslot := Timeslot{ID: &timeslotID}
 		if exists, err := timeslot.exists(); err != nil {
-			return rest.Result{Code: 500, Error: err}
+			return rest.InternalError(err)
 		} else if !exists {
-			return rest.Result{Code: 400, Message: "referenced timeslot does not exist"}
+			return rest.BadRequest("referenced timeslot does not exist")
 		}
 	}
 
 	return rest.Result{}
 }
+
+// validateFields validates the test fields without checking referenced objects.
+func (test *Test) validateFields() rest.Result {
+	switch {
+	case test.ID == nil:
+		return rest.BadRequest("missing ID")
+	case test.TrackID == "":
+		return rest.BadRequest("missing track ID")
+	case test.TaskShortname == "":
+		return rest.BadRequest("missing task shortname")
+	case test.Shortname == "":
+		return rest.BadRequest("missing shortname")
+	case test.StationShortname == "":
+		return rest.BadRequest("missing station shortname")
+	case test.Name == "":
+		return rest.BadRequest("missing name")
+	case test.StatusSuccess == nil:
+		return rest.BadRequest("missing success status")
+	case test.Timestamp == nil:
+		return rest.BadRequest("missing timestamp")
+	}
+	return rest.Result{}
+}
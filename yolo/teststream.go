@@ -0,0 +1,275 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// testStreamBatchSize is how many tests are saved per transaction when streaming.
+const testStreamBatchSize = 200
+
+// testStreamMaxLineBytes is the max size of a single line (or MessagePack value) when streaming.
+const testStreamMaxLineBytes = 1024 * 1024
+
+// TestStream is for posting tests as newline-delimited JSON (one test per line), for large amounts of tests.
+// Concatenated MessagePack values are also accepted, with each value counted as a line.
+// The tests are decoded and saved incrementally in batches, each in a single transaction.
+type TestStream struct {
+	Accepted int                     `json:"accepted"`
+	Rejected int                     `json:"rejected"`
+	Results  []*TestStreamLineResult `json:"results"`
+}
+
+// TestStreamLineResult is the result for a single line of a test stream.
+type TestStreamLineResult struct {
+	Line    int        `json:"line"` // 1-indexed
+	Code    int        `json:"code"` // HTTP-like status
+	ID      *uuid.UUID `json:"id,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+// testStreamLookups caches references looked up while streaming, as the same ones are typically repeated a lot.
+type testStreamLookups struct {
+	tasks    map[string]bool
+	stations map[string]*Station
+}
+
+func init() {
+	rest.AddHandler("/tests/", "^stream/$", func() interface{} { return &TestStream{} })
+}
+
+// MaxBodyBytes disables the request body limit, since the stream is processed incrementally with limited lines.
+func (stream *TestStream) MaxBodyBytes() int64 {
+	return -1
+}
+
+// PostStream posts tests from a stream of newline-delimited JSON, which may overwrite old ones like single posts.
+// Invalid lines are rejected and reported without stopping the stream.
+func (stream *TestStream) PostStream(request *rest.Request, body io.Reader) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleTester && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	lookups := testStreamLookups{
+		tasks:    make(map[string]bool),
+		stations: make(map[string]*Station),
+	}
+	stream.Results = make([]*TestStreamLineResult, 0)
+	operatorResults := make(map[string]rest.Result) // By track ID
+	var batch Tests
+	nextLine := testStreamLines(request.ContentType, body)
+	lineNumber := 0
+	var readErr error
+	for {
+		line, err := nextLine()
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		lineNumber++
+		if len(line) == 0 {
+			continue
+		}
+
+		test, lineResult := lookups.parseLine(line)
+		lineResult.Line = lineNumber
+		if lineResult.Code == 500 {
+			return rest.InternalError(lineResult.err)
+		}
+		if test != nil {
+			operatorResult, checked := operatorResults[test.TrackID]
+			if !checked {
+				operatorResult = checkTrackOperator(request.AccessToken, test.TrackID)
+				operatorResults[test.TrackID] = operatorResult
+			}
+			if operatorResult.Error != nil {
+				return operatorResult
+			}
+			if !operatorResult.IsOk() {
+				test = nil
+				lineResult.TestStreamLineResult = TestStreamLineResult{Line: lineNumber, Code: operatorResult.Code, Message: operatorResult.Message}
+			}
+		}
+		stream.Results = append(stream.Results, &lineResult.TestStreamLineResult)
+		if test == nil {
+			stream.Rejected++
+			continue
+		}
+
+		batch = append(batch, test)
+		if len(batch) >= testStreamBatchSize {
+			if err := saveTestBatch(batch); err != nil {
+				return rest.InternalError(err)
+			}
+			stream.Accepted += len(batch)
+			batch = nil
+		}
+	}
+	if readErr != nil {
+		// Typically too long lines, malformed MessagePack or a broken connection
+		if len(batch) > 0 {
+			if err := saveTestBatch(batch); err != nil {
+				return rest.InternalError(err)
+			}
+			stream.Accepted += len(batch)
+		}
+		return rest.BadRequest(fmt.Sprintf("failed to read stream after line %v: %v", lineNumber, readErr))
+	}
+	if len(batch) > 0 {
+		if err := saveTestBatch(batch); err != nil {
+			return rest.InternalError(err)
+		}
+		stream.Accepted += len(batch)
+	}
+
+	return rest.Result{}
+}
+
+// testStreamLines returns a function reading the next line from the stream, returning io.EOF at the end.
+// MessagePack streams (concatenated values) are read one value at a time, converted to JSON.
+func testStreamLines(contentType string, body io.Reader) func() ([]byte, error) {
+	if rest.IsMessagePack(contentType) {
+		decoder := rest.NewMessagePackDecoder(body, testStreamMaxLineBytes)
+		return decoder.NextJSON
+	}
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), testStreamMaxLineBytes)
+	return func() ([]byte, error) {
+		if scanner.Scan() {
+			return scanner.Bytes(), nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+// testStreamParseResult is the line result with the internal error, if any.
+type testStreamParseResult struct {
+	TestStreamLineResult
+	err error
+}
+
+// parseLine parses and validates a single test line.
+// Returns nil and the reason if rejected, or code 500 with the error if something internal failed.
+func (lookups *testStreamLookups) parseLine(line []byte) (*Test, testStreamParseResult) {
+	var test Test
+	if err := json.Unmarshal(line, &test); err != nil {
+		return nil, testStreamParseResult{TestStreamLineResult: TestStreamLineResult{Code: 400, Message: "malformed JSON"}}
+	}
+
+	// Overwrite certain fields, like single posts
+	newID := uuid.New()
+	test.ID = &newID
+	now := time.Now()
+	test.Timestamp = &now
+
+	// Validate
+	if result := test.validateFields(); !result.IsOk() {
+		return nil, testStreamParseResult{TestStreamLineResult: TestStreamLineResult{Code: result.Code, Message: result.Message}}
+	}
+	taskExists, taskErr := lookups.taskExists(test.TrackID, test.TaskShortname)
+	if taskErr != nil {
+		return nil, testStreamParseResult{TestStreamLineResult: TestStreamLineResult{Code: 500}, err: taskErr}
+	}
+	if !taskExists {
+		return nil, testStreamParseResult{TestStreamLineResult: TestStreamLineResult{Code: 400, Message: "referenced task does not exist"}}
+	}
+	station, stationErr := lookups.station(test.TrackID, test.StationShortname)
+	if stationErr != nil {
+		return nil, testStreamParseResult{TestStreamLineResult: TestStreamLineResult{Code: 500}, err: stationErr}
+	}
+	if station == nil {
+		return nil, testStreamParseResult{TestStreamLineResult: TestStreamLineResult{Code: 400, Message: "station not found"}}
+	}
+
+	// Bind to the active timeslot, if any
+	test.TimeslotID = station.TimeslotID
+
+	return &test, testStreamParseResult{TestStreamLineResult: TestStreamLineResult{Code: 201, ID: test.ID}}
+}
+
+// taskExists checks if the task exists, which also implies the track exists.
+func (lookups *testStreamLookups) taskExists(trackID string, shortname string) (bool, error) {
+	key := trackID + "/" + shortname
+	if exists, ok := lookups.tasks[key]; ok {
+		return exists, nil
+	}
+	task := Task{TrackID: trackID, Shortname: shortname}
+	exists, err := task.existsShortname()
+	if err != nil {
+		return false, err
+	}
+	lookups.tasks[key] = exists
+	return exists, nil
+}
+
+// station finds the station by track and shortname, or nil if not found.
+func (lookups *testStreamLookups) station(trackID string, shortname string) (*Station, error) {
+	key := trackID + "/" + shortname
+	if station, ok := lookups.stations[key]; ok {
+		return station, nil
+	}
+	var station Station
+	dbResult := db.Select(&station, "stations",
+		"track", "=", trackID,
+		"shortname", "=", shortname,
+	)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	if !dbResult.IsSuccess() {
+		lookups.stations[key] = nil
+		return nil, nil
+	}
+	lookups.stations[key] = &station
+	return &station, nil
+}
+
+// saveTestBatch saves the tests in a single transaction.
+func saveTestBatch(tests Tests) error {
+	tx, txErr := db.DB.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+
+	for _, test := range tests {
+		if err := test.save(tx); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -21,25 +21,49 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package yolo
 
 import (
+	"database/sql"
 	"fmt"
 	"time"
 
 	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
 	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/worker"
 	"github.com/google/uuid"
 )
 
 // Timeslot is a participation object used both for registration (without time and station), planning (with time) and station binding (station with this timeslot).
 type Timeslot struct {
 	ID        *uuid.UUID `column:"id" json:"id"`                 // Generated, required, unique
-	UserID    *uuid.UUID `column:"user" json:"user"`             // Required
+	UserID    *uuid.UUID `column:"user" json:"user"`             // Required, the registering user
+	TeamID    *uuid.UUID `column:"team" json:"team"`             // Optional, gives all team members the same access as the user
 	TrackID   string     `column:"track" json:"track"`           // Required
 	BeginTime *time.Time `column:"begin_time" json:"begin_time"` // Empty upon registration, used strictly for manual purposes
 	EndTime   *time.Time `column:"end_time" json:"end_time"`     // Empty upon registration, used strictly for manual purposes
 	Notes     string     `column:"notes" json:"notes"`           // Optional
+	// Set when booked through the schedule
+	SlotTemplateID *uuid.UUID `column:"slot_template" json:"slot_template"`
+	// Set when cancelled before finishing
+	CancelTime   *time.Time `column:"cancel_time" json:"cancel_time"`
+	CancelReason string     `column:"cancel_reason" json:"cancel_reason"`
+	// Optional, defaults to approved (or pending when registered by a participant for a track requiring approval)
+	Status TimeslotStatus `column:"status" json:"status"`
+	// Incremented on every update, updates with an outdated version are rejected (optional for clients)
+	Version *int `column:"version" json:"version"`
+	// Generated, when the timeslot was created and last updated
+	db.Timestamps
 }
 
+// TimeslotStatus is the approval state of a timeslot.
+type TimeslotStatus string
+
+const (
+	// TimeslotStatusApproved means the timeslot may be used.
+	TimeslotStatusApproved TimeslotStatus = "approved"
+	// TimeslotStatusPending means the timeslot awaits approval by an operator, and may not begin or be queued yet.
+	TimeslotStatusPending TimeslotStatus = "pending"
+)
+
 // Timeslots is a list of timeslots.
 type Timeslots []*Timeslot
 
@@ -49,32 +73,60 @@ type TimeslotBeginRequest struct{}
 // TimeslotEndRequest is for requesting a timeslot to finish.
 type TimeslotEndRequest struct{}
 
+// TimeslotCancelRequest is for cancelling a timeslot, e.g. if the participant can't make it.
+type TimeslotCancelRequest struct {
+	Reason string `json:"reason"` // Optional
+}
+
+// TimeslotApproveRequest is for approving a pending timeslot.
+type TimeslotApproveRequest struct{}
+
 func init() {
 	rest.AddHandler("/timeslots/", "^$", func() interface{} { return &Timeslots{} })
 	rest.AddHandler("/timeslot/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Timeslot{} })
-	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/begin/$", func() interface{} { return &TimeslotBeginRequest{} })
+	rest.AddIdempotentHandler("/timeslot/", "^(?P<id>[^/]+)/begin/$", func() interface{} { return &TimeslotBeginRequest{} })
 	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/end/$", func() interface{} { return &TimeslotEndRequest{} })
+	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/cancel/$", func() interface{} { return &TimeslotCancelRequest{} })
+	rest.AddHandler("/admin/", "^timeslot/(?P<id>[^/]+)/approve/$", func() interface{} { return &TimeslotApproveRequest{} })
+}
+
+// ListQueryFields returns the fields timeslots may be filtered and sorted on.
+func (timeslots *Timeslots) ListQueryFields() map[string]string {
+	return map[string]string{"id": "id", "user": "user", "team": "team", "track": "track", "status": "status", "begin_time": "begin_time", "end_time": "end_time", "created_at": "created_at", "updated_at": "updated_at"}
+}
+
+// CSVExport allows the timeslots to be listed as CSV.
+func (timeslots *Timeslots) CSVExport() bool {
+	return true
 }
 
 // Get gets multiple timeslots.
 func (timeslots *Timeslots) Get(request *rest.Request) rest.Result {
 	// Check params and prep filtering
 	now := time.Now()
-	var whereArgs []interface{}
+	whereArgs := request.ListFilterArgs
 	if userID, ok := request.QueryArgs["user"]; ok {
 		whereArgs = append(whereArgs, "user", "=", userID)
 	}
 	if trackID, ok := request.QueryArgs["track"]; ok {
 		whereArgs = append(whereArgs, "track", "=", trackID)
 	}
+	if status, ok := request.QueryArgs["status"]; ok {
+		whereArgs = append(whereArgs, "status", "=", status)
+	}
+	whereArgs, scopeErr := scopeToRequestEvent(request, whereArgs)
+	if scopeErr != nil {
+		return rest.InternalError(scopeErr)
+	}
 
 	// Find
-	dbResult := db.SelectMany(timeslots, "timeslots", whereArgs...)
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+	foundTimeslots, findErr := stores.Timeslots.List(request.ListOrderBy, whereArgs...)
+	if findErr != nil {
+		return rest.InternalError(findErr)
 	}
+	*timeslots = foundTimeslots
 
-	// If not operator/admin, hide all non-self-assigned
+	// If not operator/admin, hide all not owned by self or own team
 	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
 		oldTimeslots := *timeslots
 		*timeslots = make(Timeslots, 0)
@@ -84,7 +136,11 @@ func (timeslots *Timeslots) Get(request *rest.Request) rest.Result {
 			return rest.Result{}
 		}
 		for _, timeslot := range oldTimeslots {
-			if timeslot.UserID == requestUserID {
+			owned, err := timeslot.isOwnedBy(requestUserID)
+			if err != nil {
+				return rest.InternalError(err)
+			}
+			if owned {
 				*timeslots = append(*timeslots, timeslot)
 			}
 		}
@@ -101,7 +157,7 @@ func (timeslots *Timeslots) Get(request *rest.Request) rest.Result {
 			// TODO optimize
 			stationsExist, err := timeslot.isActiveWithStation()
 			if err != nil {
-				return rest.Result{Code: 500, Error: err}
+				return rest.InternalError(err)
 			}
 			if assignedStation && !stationsExist {
 				continue
@@ -124,21 +180,26 @@ func (timeslot *Timeslot) Get(request *rest.Request) rest.Result {
 	// Check params
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 
 	// Get
-	dbResult := db.Select(timeslot, "timeslots", "id", "=", id)
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+	foundTimeslot, findErr := stores.Timeslots.Get(id)
+	if findErr != nil {
+		return rest.InternalError(findErr)
 	}
-	if !dbResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "not found"}
+	if foundTimeslot == nil {
+		return rest.NotFound("not found")
 	}
+	*timeslot = *foundTimeslot
 
-	// Only show if operator/admin or if self-assigned
+	// Only show if operator/admin or if owned by self or own team
 	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
-		if *request.AccessToken.OwnerUserID != *timeslot.UserID {
+		owned, err := timeslot.isOwnedBy(request.AccessToken.OwnerUserID)
+		if err != nil {
+			return rest.InternalError(err)
+		}
+		if !owned {
 			return rest.UnauthorizedResult(request.AccessToken)
 		}
 	}
@@ -154,20 +215,46 @@ func (timeslot *Timeslot) Post(request *rest.Request) rest.Result {
 		timeslot.ID = &newID
 	}
 
+	// Limit access to certain fields if not operator/admin, before validating (e.g. overlap checking) them
+	isOperator := request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin
+	if !isOperator {
+		timeslot.BeginTime = nil
+		timeslot.EndTime = nil
+		timeslot.CancelTime = nil
+		timeslot.CancelReason = ""
+		timeslot.SlotTemplateID = nil
+	}
+
 	// Validate
+	if timeslot.Status == "" {
+		timeslot.Status = TimeslotStatusApproved
+	}
 	if result := timeslot.validate(); !result.IsOk() {
 		return result
 	}
 
 	// Only allow if operator/admin or if self-assigned
-	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
-		if *request.AccessToken.OwnerUserID == *timeslot.UserID {
-			// Limit access to certain fields if self-assigned and not operator/admin
-			timeslot.BeginTime = nil
-			timeslot.EndTime = nil
-		} else {
+	if !isOperator {
+		if request.AccessToken.OwnerUserID == nil || *request.AccessToken.OwnerUserID != *timeslot.UserID {
 			return rest.UnauthorizedResult(request.AccessToken)
 		}
+
+		// Check if the track accepts registrations
+		var track Track
+		trackDBResult := db.Select(&track, "tracks", "id", "=", timeslot.TrackID)
+		if trackDBResult.IsFailed() {
+			return rest.InternalError(trackDBResult.Error)
+		}
+		if result := track.checkRegistrationAllowed(); !result.IsOk() {
+			return result
+		}
+		if track.RegistrationApproval {
+			timeslot.Status = TimeslotStatusPending
+		} else {
+			timeslot.Status = TimeslotStatusApproved
+		}
+	} else if result := checkTrackOperator(request.AccessToken, timeslot.TrackID); !result.IsOk() {
+		return result
 	}
 
 	// Create and redirect
@@ -176,7 +263,7 @@ func (timeslot *Timeslot) Post(request *rest.Request) rest.Result {
 		return result
 	}
 	result.Code = 201
-	result.Location = fmt.Sprintf("%v/timeslot/%v/", config.Config.SitePrefix, timeslot.ID)
+	result.Location = fmt.Sprintf("%v/timeslot/%v/", config.Get().SitePrefix, timeslot.ID)
 	return result
 }
 
@@ -190,17 +277,33 @@ func (timeslot *Timeslot) Put(request *rest.Request) rest.Result {
 	// Check params
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 
 	// Validate
 	if timeslot.ID != nil && (*timeslot.ID).String() != id {
-		return rest.Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
+		return rest.BadRequest("mismatch between URL and JSON IDs")
+	}
+	if timeslot.Status == "" {
+		timeslot.Status = TimeslotStatusApproved
 	}
 	if result := timeslot.validate(); !result.IsOk() {
 		return result
 	}
 
+	// Check the track (and the current track when moving it) is operated by the requester
+	trackIDs := []string{timeslot.TrackID}
+	existing, err := stores.Timeslots.Get(id)
+	if err != nil {
+		return rest.InternalError(err)
+	}
+	if existing != nil {
+		trackIDs = append(trackIDs, existing.TrackID)
+	}
+	if result := checkTrackOperator(request.AccessToken, trackIDs...); !result.IsOk() {
+		return result
+	}
+
 	// Update or create
 	return timeslot.createOrUpdate()
 }
@@ -215,41 +318,46 @@ func (timeslot *Timeslot) Delete(request *rest.Request) rest.Result {
 	// Check params
 	rawID, rawIDExists := request.PathArgs["id"]
 	if !rawIDExists || rawID == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 	id, uuidError := uuid.Parse(rawID)
 	if uuidError != nil {
-		return rest.Result{Code: 400, Message: "invalid ID"}
+		return rest.BadRequest("invalid ID")
 	}
 
-	// Check if it exists
-	timeslot.ID = &id
-	exists, existsErr := timeslot.exists()
-	if existsErr != nil {
-		return rest.Result{Code: 500, Error: existsErr}
+	// Check the track is operated by the requester
+	existing, err := stores.Timeslots.Get(id)
+	if err != nil {
+		return rest.InternalError(err)
+	}
+	if existing == nil {
+		return rest.NotFound("not found")
 	}
-	if !exists {
-		return rest.Result{Code: 404, Message: "not found"}
+	if result := checkTrackOperator(request.AccessToken, existing.TrackID); !result.IsOk() {
+		return result
 	}
 
-	// Delete it
-	dbResult := db.Delete("timeslots", "id", "=", timeslot.ID)
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+	// Delete it, if it exists
+	timeslot.ID = &id
+	found, err := stores.Timeslots.Delete(timeslot.ID)
+	if err != nil {
+		return rest.InternalError(err)
+	}
+	if !found {
+		return rest.NotFound("not found")
 	}
 	return rest.Result{}
 }
 
 func (timeslot *Timeslot) create() rest.Result {
 	if exists, err := timeslot.exists(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if exists {
-		return rest.Result{Code: 409, Message: "duplicate"}
+		return rest.Conflict("duplicate")
 	}
 
-	dbResult := db.Insert("timeslots", timeslot)
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+	if err := stores.Timeslots.Insert(timeslot); err != nil {
+		return rest.InternalError(err)
 	}
 	return rest.Result{}
 }
@@ -257,29 +365,23 @@ func (timeslot *Timeslot) create() rest.Result {
 func (timeslot *Timeslot) createOrUpdate() rest.Result {
 	exists, existsErr := timeslot.exists()
 	if existsErr != nil {
-		return rest.Result{Code: 500, Error: existsErr}
+		return rest.InternalError(existsErr)
 	}
 
-	var dbResult db.Result
+	var err error
 	if exists {
-		dbResult = db.Update("timeslots", timeslot, "id", "=", timeslot.ID)
+		err = stores.Timeslots.Update(timeslot)
 	} else {
-		dbResult = db.Insert("timeslots", timeslot)
+		err = stores.Timeslots.Insert(timeslot)
 	}
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+	if err != nil {
+		return rest.InternalError(err)
 	}
 	return rest.Result{}
 }
 
 func (timeslot *Timeslot) exists() (bool, error) {
-	var count int
-	row := db.DB.QueryRow("SELECT COUNT(*) FROM timeslots WHERE id = $1", timeslot.ID)
-	rowErr := row.Scan(&count)
-	if rowErr != nil {
-		return false, rowErr
-	}
-	return count > 0, nil
+	return stores.Timeslots.Exists(timeslot.ID)
 }
 
 func (timeslot *Timeslot) existsWithTrack(trackID string) (bool, error) {
@@ -292,6 +394,20 @@ func (timeslot *Timeslot) existsWithTrack(trackID string) (bool, error) {
 	return count > 0, nil
 }
 
+// isOwnedBy checks if the user registered the timeslot or is a member of the team assigned to it.
+func (timeslot *Timeslot) isOwnedBy(userID *uuid.UUID) (bool, error) {
+	if userID == nil || timeslot.UserID == nil {
+		return false, nil
+	}
+	if *timeslot.UserID == *userID {
+		return true, nil
+	}
+	if timeslot.TeamID != nil {
+		return isTeamMember(*timeslot.TeamID, *userID)
+	}
+	return false, nil
+}
+
 func (timeslot *Timeslot) isActiveWithStation() (bool, error) {
 	var count int
 	row := db.DB.QueryRow("SELECT COUNT(*) FROM stations WHERE track = $1 AND timeslot = $2", timeslot.TrackID, timeslot.ID)
@@ -305,45 +421,103 @@ func (timeslot *Timeslot) isActiveWithStation() (bool, error) {
 func (timeslot *Timeslot) validate() rest.Result {
 	switch {
 	case timeslot.ID == nil:
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	case timeslot.UserID == nil:
-		return rest.Result{Code: 400, Message: "missing user ID"}
+		return rest.BadRequest("missing user ID")
 	case timeslot.TrackID == "":
-		return rest.Result{Code: 400, Message: "missing track ID"}
+		return rest.BadRequest("missing track ID")
 	case (timeslot.BeginTime == nil) != (timeslot.EndTime == nil):
-		return rest.Result{Code: 400, Message: "only begin or end time set"}
+		return rest.BadRequest("only begin or end time set")
 	case timeslot.BeginTime != nil && timeslot.EndTime != nil && timeslot.EndTime.Before(*timeslot.BeginTime):
-		return rest.Result{Code: 400, Message: "cannot end before it begins"}
+		return rest.BadRequest("cannot end before it begins")
+	case timeslot.Status != TimeslotStatusApproved && timeslot.Status != TimeslotStatusPending:
+		return rest.BadRequest("invalid status")
 	}
 
 	user := rest.User{ID: timeslot.UserID}
 	if exists, err := user.ExistsWithID(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if !exists {
-		return rest.Result{Code: 400, Message: "referenced user does not exist"}
+		return rest.BadRequest("referenced user does not exist")
 	}
 	track := Track{ID: timeslot.TrackID}
 	if exists, err := track.exists(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if !exists {
-		return rest.Result{Code: 400, Message: "referenced track does not exist"}
+		return rest.BadRequest("referenced track does not exist")
+	}
+	if timeslot.TeamID != nil {
+		var team Team
+		teamDBResult := db.Select(&team, "teams", "id", "=", timeslot.TeamID)
+		if teamDBResult.IsFailed() {
+			return rest.InternalError(teamDBResult.Error)
+		}
+		if !teamDBResult.IsSuccess() {
+			return rest.BadRequest("referenced team does not exist")
+		}
+		if team.TrackID != timeslot.TrackID {
+			return rest.BadRequest("referenced team belongs to another track")
+		}
+		if isMember, err := isTeamMember(*timeslot.TeamID, *timeslot.UserID); err != nil {
+			return rest.InternalError(err)
+		} else if !isMember {
+			return rest.BadRequest("user is not a member of the referenced team")
+		}
 	}
 
 	// Check if the user has a timeslot for the current track which hasn't ended yet
 	if has, err := timeslot.userHasAnotherUnfinishedTimeslot(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if has {
-		return rest.Result{Code: 409, Message: "user currently has timeslot for this track"}
+		return rest.Conflict("user currently has timeslot for this track")
+	}
+	if timeslot.BeginTime != nil && timeslot.EndTime != nil && timeslot.CancelTime == nil {
+		if result := timeslot.checkOverlap(db.DB, *timeslot.BeginTime, *timeslot.EndTime); !result.IsOk() {
+			return result
+		}
 	}
 
 	return rest.Result{}
 }
 
+// checkOverlap rejects the time range for the timeslot if it overlaps another of the user's timeslots on another track,
+// if enabled in the config. Unscheduled timeslots (without times) never overlap, while begun ones last until they finish.
+func (timeslot *Timeslot) checkOverlap(executor db.Executor, beginTime time.Time, endTime time.Time) rest.Result {
+	if !config.Get().TimeslotOverlapCheck {
+		return rest.Result{}
+	}
+	other, err := timeslot.findOverlappingTimeslot(executor, beginTime, endTime)
+	if err != nil {
+		return rest.InternalError(err)
+	}
+	if other == nil {
+		return rest.Result{}
+	}
+	return rest.Conflict(fmt.Sprintf("overlaps timeslot %v on track %v (from %v to %v)",
+		other.ID, other.TrackID, other.BeginTime.Format(time.RFC3339), other.EndTime.Format(time.RFC3339)))
+}
+
+// findOverlappingTimeslot finds the first non-cancelled timeslot of the same user on another track overlapping the time range, if any.
+func (timeslot *Timeslot) findOverlappingTimeslot(executor db.Executor, beginTime time.Time, endTime time.Time) (*Timeslot, error) {
+	var other Timeslot
+	row := executor.QueryRow("SELECT id, track, begin_time, end_time FROM timeslots WHERE \"user\" = $1 AND id != $2 AND track != $3 "+
+		"AND cancel_time IS NULL AND begin_time < $5 AND end_time > $4 ORDER BY begin_time LIMIT 1",
+		timeslot.UserID, timeslot.ID, timeslot.TrackID, beginTime, endTime)
+	switch err := row.Scan(&other.ID, &other.TrackID, &other.BeginTime, &other.EndTime); err {
+	case nil:
+		return &other, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
 // Check if the user has another non-ended timeslot for the current track.
 func (timeslot *Timeslot) userHasAnotherUnfinishedTimeslot() (bool, error) {
 	now := time.Now()
 	var count int
-	row := db.DB.QueryRow("SELECT COUNT(*) FROM timeslots WHERE id != $1 AND track = $2 AND user = $3 AND (end_time IS NULL OR end_time >= $4)", timeslot.ID, timeslot.TrackID, timeslot.UserID, now)
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM timeslots WHERE id != $1 AND track = $2 AND \"user\" = $3 AND (end_time IS NULL OR end_time >= $4)", timeslot.ID, timeslot.TrackID, timeslot.UserID, now)
 	rowErr := row.Scan(&count)
 	if rowErr != nil {
 		return false, rowErr
@@ -354,44 +528,82 @@ func (timeslot *Timeslot) userHasAnotherUnfinishedTimeslot() (bool, error) {
 // Post attempts to find an available station to bind to the timeslot.
 // It allows users to automatically get assigned to a "ready" net-track station,
 // or a server-track station if below the soft limit.
+// A specific station may be requested using the "station" query param (ID or shortname).
 func (beginRequest *TimeslotBeginRequest) Post(request *rest.Request) rest.Result {
 	// Check params
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "Missing ID"}
+		return rest.BadRequest("Missing ID")
 	}
 
 	// Get timeslot and track
 	var timeslot Timeslot
 	timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", id)
 	if timeslotDBResult.IsFailed() {
-		return rest.Result{Code: 500, Error: timeslotDBResult.Error}
+		return rest.InternalError(timeslotDBResult.Error)
 	}
 	if !timeslotDBResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "Not found"}
+		return rest.NotFound("Not found")
 	}
 	var track Track
 	trackDBResult := db.Select(&track, "tracks", "id", "=", timeslot.TrackID)
 	if trackDBResult.IsFailed() {
-		return rest.Result{Code: 500, Error: trackDBResult.Error}
+		return rest.InternalError(trackDBResult.Error)
 	}
 	if !trackDBResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "Track not found"}
+		return rest.NotFound("Track not found")
 	}
 
 	// Check perms
-	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin && *request.AccessToken.OwnerUserID != *timeslot.UserID {
-		return rest.UnauthorizedResult(request.AccessToken)
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		owned, err := timeslot.isOwnedBy(request.AccessToken.OwnerUserID)
+		if err != nil {
+			return rest.InternalError(err)
+		}
+		if !owned {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+		if result := track.checkParticipationAllowed(); !result.IsOk() {
+			return result
+		}
+	} else if result := checkTrackOperator(request.AccessToken, timeslot.TrackID); !result.IsOk() {
+		return result
+	}
+	if timeslot.Status == TimeslotStatusPending {
+		return rest.Conflict("timeslot is pending approval")
+	}
+
+	// Check if cancelled, already ended or already begun, since binding would restart it
+	now := time.Now()
+	if timeslot.CancelTime != nil {
+		return rest.Conflict("timeslot already cancelled")
+	}
+	if timeslot.EndTime != nil && timeslot.EndTime.Before(now) {
+		return rest.Conflict("timeslot already ended")
+	}
+	boundDBResult := db.Exists("stations", "timeslot", "=", timeslot.ID.String())
+	if boundDBResult.IsFailed() {
+		return rest.InternalError(boundDBResult.Error)
+	}
+	if boundDBResult.IsSuccess() {
+		return rest.Conflict("timeslot already has a station")
+	}
+	if result := timeslot.checkOverlap(db.DB, now, now); !result.IsOk() {
+		return result
 	}
 
 	// Find all ready/available stations
 	var unboundStations Stations
 	unboundStationsDBResult := db.SelectMany(&unboundStations, "stations",
 		"track", "=", timeslot.TrackID,
-		"timeslot", "=", "",
+		"timeslot", "=", nil,
 	)
 	if unboundStationsDBResult.IsFailed() {
-		return rest.Result{Code: 500, Error: unboundStationsDBResult.Error}
+		return rest.InternalError(unboundStationsDBResult.Error)
+	}
+	unboundStations, maintenanceErr := unboundStations.withoutMaintenance()
+	if maintenanceErr != nil {
+		return rest.InternalError(maintenanceErr)
 	}
 	var choosableStations Stations
 	for _, station := range unboundStations {
@@ -402,69 +614,112 @@ func (beginRequest *TimeslotBeginRequest) Post(request *rest.Request) rest.Resul
 		}
 	}
 
-	// Pick a station if any ready/available
+	// Pick the requested station (by ID or shortname) or the first one, if any ready/available
 	var chosenStation *Station
-	if len(choosableStations) > 0 {
-		// TODO allow choosing using query param
+	if requestedStation, ok := request.QueryArgs["station"]; ok && requestedStation != "" {
+		for _, station := range choosableStations {
+			if station.ID.String() == requestedStation || station.Shortname == requestedStation {
+				chosenStation = station
+				break
+			}
+		}
+		if chosenStation == nil {
+			return rest.Conflict("requested station is not on the track or not available to choose")
+		}
+	} else if len(choosableStations) > 0 {
 		chosenStation = choosableStations[0]
 	}
 
-	// If server and no available, try to allocate one
-	if track.Type == trackTypeServer && chosenStation == nil {
+	// If dynamic and no available, try to allocate one
+	behavior, behaviorOk := track.behavior()
+	if !behaviorOk {
+		return rest.BadRequest("unknown track type (contact support)")
+	}
+	if behavior.ProvisioningMode == StationProvisioningModeDynamic && chosenStation == nil {
 		// Check if dynamic provisioning enabled
-		trackConfig, trackConfigOk := config.Config.ServerTracks[track.ID]
+		trackConfig, trackConfigOk := config.Get().ServerTracks[track.ID]
 		if !trackConfigOk || trackConfig.BaseURL == "" {
-			return rest.Result{Code: 404, Message: "no available stations and track not configured for dynamic stations"}
+			return rest.NotFound("no available stations and track not configured for dynamic stations")
 		}
 
 		// Check current count
-		currentRow := db.DB.QueryRow("SELECT COUNT(*) FROM stations WHERE track = $1 AND status != $2", track.ID, StationStatusTerminated)
+		currentRow := db.DB.QueryRow("SELECT COUNT(*) FROM stations WHERE track = $1 AND status != $2 AND status != $3", track.ID, StationStatusTerminated, StationStatusFailed)
 		var count int
 		currentRowErr := currentRow.Scan(&count)
 		if currentRowErr != nil {
-			return rest.Result{Code: 500, Error: currentRowErr}
+			return rest.InternalError(currentRowErr)
 		}
 
 		// Check if allowed
 		if request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin {
 			if count >= trackConfig.MaxInstancesHard {
-				return rest.Result{Code: 404, Message: "no available stations and hard limit for dynamic stations reached"}
+				return rest.NotFound("no available stations and hard limit for dynamic stations reached")
 			}
 		} else {
 			if count >= trackConfig.MaxInstancesSoft {
-				return rest.Result{Code: 404, Message: "no available stations and soft limit for dynamic stations reached"}
+				alertOperators(operatorAlertSoftLimitReached, track.ID,
+					fmt.Sprintf("Participants are being denied dynamic stations in track %v, the soft limit (%v) has been reached.", track.ID, trackConfig.MaxInstancesSoft))
+				return rest.NotFound("no available stations and soft limit for dynamic stations reached")
 			}
 		}
 
-		// Allocate one
+		// Allocate one for the timeslot owner, within their quotas unless operator/admin
+		isOperator := request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin
 		chosenStation = &Station{}
-		if result := chosenStation.Provision(track.ID); !result.IsOk() {
+		if result := chosenStation.Provision(track.ID, timeslot.UserID, !isOperator); !result.IsOk() {
 			return result
 		}
 	}
 
 	// Check if an available station was found or created
 	if chosenStation == nil {
-		return rest.Result{Code: 404, Message: "no available stations"}
+		return rest.NotFound("no available stations")
 	}
 
-	// Update station, but keep the station status as-is
-	chosenStation.TimeslotID = timeslot.ID.String()
-	if result := chosenStation.createOrUpdate(); !result.IsOk() {
-		return result
+	// Bind station and start timeslot
+	bound, bindErr := timeslot.bindStation(chosenStation)
+	if bindErr != nil {
+		return rest.InternalError(bindErr)
+	}
+	if !bound {
+		return rest.Conflict("station was taken by someone else, please try again")
+	}
+
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/station/%v/", config.Get().SitePrefix, chosenStation.ID)}
+}
+
+// bindStation binds the unbound station to the timeslot and starts the timeslot, keeping the station status as-is.
+// Returns false if the station got bound to another timeslot in the meantime.
+func (timeslot *Timeslot) bindStation(station *Station) (bool, error) {
+	// Only bind if still unbound, in case of concurrent begin requests or the queue worker
+	bindResult, bindErr := db.DB.Exec("UPDATE stations SET timeslot = $1, version = version + 1, updated_at = now() WHERE id = $2 AND timeslot IS NULL", timeslot.ID.String(), station.ID)
+	if bindErr != nil {
+		return false, bindErr
+	}
+	db.NotifyWrite("stations")
+	if affected, err := bindResult.RowsAffected(); err != nil {
+		return false, err
+	} else if affected == 0 {
+		return false, nil
+	}
+	station.TimeslotID = db.StringOrNull(timeslot.ID.String())
+	if err := beginStationHistory(station, timeslot); err != nil {
+		return false, err
 	}
 
 	// Update timeslot
-	// Warning: Potential race condition, but people are slow.
 	beginTime := time.Now()
 	timeslot.BeginTime = &beginTime
 	endTime := time.Now().AddDate(1000, 0, 0) // +1000 years
 	timeslot.EndTime = &endTime
 	if result := timeslot.createOrUpdate(); !result.IsOk() {
-		return result
+		if result.Error != nil {
+			return false, result.Error
+		}
+		return false, fmt.Errorf("failed to update timeslot: %v", result.Message)
 	}
 
-	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/station/%v/", config.Config.SitePrefix, chosenStation.ID)}
+	return true, nil
 }
 
 // Post ends a timeslot.
@@ -473,43 +728,57 @@ func (endRequest *TimeslotEndRequest) Post(request *rest.Request) rest.Result {
 	// Check params
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 
 	// Get the things
 	var timeslot Timeslot
 	timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", id)
 	if timeslotDBResult.IsFailed() {
-		return rest.Result{Code: 500, Error: timeslotDBResult.Error}
+		return rest.InternalError(timeslotDBResult.Error)
 	}
 	if !timeslotDBResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "not found"}
+		return rest.NotFound("not found")
 	}
 	var track Track
 	trackDBResult := db.Select(&track, "tracks", "id", "=", timeslot.TrackID)
 	if trackDBResult.IsFailed() {
-		return rest.Result{Code: 500, Error: trackDBResult.Error}
+		return rest.InternalError(trackDBResult.Error)
 	}
 	if !trackDBResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "track not found"}
+		return rest.NotFound("track not found")
 	}
 	var station Station
 	stationDBResult := db.Select(&station, "stations", "timeslot", "=", id)
 	if stationDBResult.IsFailed() {
-		return rest.Result{Code: 500, Error: stationDBResult.Error}
+		return rest.InternalError(stationDBResult.Error)
 	}
 	if !stationDBResult.IsSuccess() {
-		return rest.Result{Code: 400, Message: "no station assigned to this timeslot"}
+		return rest.BadRequest("no station assigned to this timeslot")
 	}
 
 	// Check perms
-	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin && *request.AccessToken.OwnerUserID != *timeslot.UserID {
-		return rest.UnauthorizedResult(request.AccessToken)
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		owned, err := timeslot.isOwnedBy(request.AccessToken.OwnerUserID)
+		if err != nil {
+			return rest.InternalError(err)
+		}
+		if !owned {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+	} else if result := checkTrackOperator(request.AccessToken, timeslot.TrackID); !result.IsOk() {
+		return result
 	}
 
+	return timeslot.finish(&track, &station)
+}
+
+// finish ends the active timeslot and releases the station according to the track type.
+// Used both when ended manually and when ended automatically.
+func (timeslot *Timeslot) finish(track *Track, station *Station) rest.Result {
 	// Validate stuff
 	if station.TrackID != track.ID {
-		return rest.Result{Code: 400, Message: "inconsistency between timeslot track and assigned station track (contact support)"}
+		return rest.BadRequest("inconsistency between timeslot track and assigned station track (contact support)")
 	}
 
 	// Update end time (and begin time if invalid)
@@ -520,15 +789,24 @@ func (endRequest *TimeslotEndRequest) Post(request *rest.Request) rest.Result {
 	}
 
 	// Handle station according to track type
-	station.TimeslotID = ""
-	if track.Type == trackTypeNet {
+	behavior, behaviorOk := track.behavior()
+	if !behaviorOk {
+		return rest.BadRequest("unknown track type (contact support)")
+	}
+	if err := endStationHistory(station.ID, StationHistoryOutcomeFinished); err != nil {
+		return rest.InternalError(err)
+	}
+	previousStatus := station.Status
+	station.TimeslotID = db.NullString{}
+	switch behavior.CleanupMode {
+	case StationCleanupModeDirty:
 		station.Status = StationStatusDirty
-	} else if track.Type == trackTypeServer {
+	case StationCleanupModeTerminate:
 		if result := station.Terminate(); !result.IsOk() {
 			return result
 		}
-	} else {
-		return rest.Result{Code: 400, Message: "unknown track type (contact support)"}
+	case StationCleanupModeDefaultStatus:
+		station.Status = station.DefaultStatus
 	}
 
 	// Save timeslot and station
@@ -539,5 +817,140 @@ func (endRequest *TimeslotEndRequest) Post(request *rest.Request) rest.Result {
 		return result
 	}
 
+	// Notify webhooks (terminated stations are handled by the termination)
+	if behavior.CleanupMode != StationCleanupModeTerminate {
+		if err := queueStationStatusChanged(db.DB, station, previousStatus); err != nil {
+			return rest.InternalError(err)
+		}
+	}
+	if err := queueWebhookEvent(db.DB, WebhookEventTimeslotFinished, webhookTimeslotData{Timeslot: timeslot, StationID: station.ID}); err != nil {
+		return rest.InternalError(err)
+	}
+
+	return rest.Result{}
+}
+
+// Post cancels a timeslot.
+// May be called by users owning the slot or by operators/admins.
+// Any assigned station is unbound and set back to its default status.
+func (cancelRequest *TimeslotCancelRequest) Post(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Get timeslot
+	var timeslot Timeslot
+	timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", id)
+	if timeslotDBResult.IsFailed() {
+		return rest.InternalError(timeslotDBResult.Error)
+	}
+	if !timeslotDBResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		owned, err := timeslot.isOwnedBy(request.AccessToken.OwnerUserID)
+		if err != nil {
+			return rest.InternalError(err)
+		}
+		if !owned {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+	} else if result := checkTrackOperator(request.AccessToken, timeslot.TrackID); !result.IsOk() {
+		return result
+	}
+
+	// Check if already ended or cancelled
+	now := time.Now()
+	if timeslot.CancelTime != nil {
+		return rest.Conflict("timeslot already cancelled")
+	}
+	if timeslot.EndTime != nil && timeslot.EndTime.Before(now) {
+		return rest.Conflict("timeslot already ended")
+	}
+
+	// Release the assigned station, if any
+	var station Station
+	stationDBResult := db.Select(&station, "stations", "timeslot", "=", id)
+	if stationDBResult.IsFailed() {
+		return rest.InternalError(stationDBResult.Error)
+	}
+	if stationDBResult.IsSuccess() {
+		if err := endStationHistory(station.ID, StationHistoryOutcomeCancelled); err != nil {
+			return rest.InternalError(err)
+		}
+		previousStatus := station.Status
+		station.TimeslotID = db.NullString{}
+		station.Status = station.DefaultStatus
+		if result := station.createOrUpdate(); !result.IsOk() {
+			return result
+		}
+		if err := queueStationStatusChanged(db.DB, &station, previousStatus); err != nil {
+			return rest.InternalError(err)
+		}
+	}
+
+	// End it (and set begin time if invalid)
+	timeslot.EndTime = &now
+	if timeslot.BeginTime == nil || timeslot.BeginTime.After(*timeslot.EndTime) {
+		timeslot.BeginTime = &now
+	}
+	timeslot.CancelTime = &now
+	timeslot.CancelReason = cancelRequest.Reason
+	if result := timeslot.createOrUpdate(); !result.IsOk() {
+		return result
+	}
+
+	// Leave the queue and let it have the released station
+	if err := removeFromQueue(timeslot.ID); err != nil {
+		return rest.InternalError(err)
+	}
+	if stationDBResult.IsSuccess() {
+		worker.Trigger(queueWorkerTaskName)
+	}
+
+	return rest.Result{}
+}
+
+// Post approves a pending timeslot, so it may begin or be queued.
+// Timeslots are rejected by cancelling them instead.
+func (approveRequest *TimeslotApproveRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Get timeslot
+	timeslot, findErr := stores.Timeslots.Get(id)
+	if findErr != nil {
+		return rest.InternalError(findErr)
+	}
+	if timeslot == nil {
+		return rest.NotFound("not found")
+	}
+	if result := checkTrackOperator(request.AccessToken, timeslot.TrackID); !result.IsOk() {
+		return result
+	}
+
+	// Approve it, if pending and not cancelled
+	if timeslot.CancelTime != nil {
+		return rest.Conflict("timeslot is cancelled")
+	}
+	if timeslot.Status != TimeslotStatusPending {
+		return rest.Conflict("timeslot is not pending")
+	}
+	timeslot.Status = TimeslotStatusApproved
+	if err := stores.Timeslots.Update(timeslot); err != nil {
+		return rest.InternalError(err)
+	}
 	return rest.Result{}
 }
@@ -22,6 +22,7 @@ package yolo
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
@@ -36,33 +37,83 @@ const (
 	trackTypeServer TrackType = "server"
 )
 
+// TrackStatus is the lifecycle state of a track.
+type TrackStatus string
+
+const (
+	// TrackStatusDraft means the track is hidden from participants.
+	TrackStatusDraft TrackStatus = "draft"
+	// TrackStatusOpen means participants may register (within the registration window, if any) and participate.
+	TrackStatusOpen TrackStatus = "open"
+	// TrackStatusClosed means the track is visible, but doesn't accept new registrations or participation.
+	TrackStatusClosed TrackStatus = "closed"
+	// TrackStatusArchived means the track is visible for reference after the event.
+	TrackStatusArchived TrackStatus = "archived"
+)
+
 // Track is a track.
 type Track struct {
-	ID   string    `column:"id" json:"id"`     // Generated, required, unique
-	Type TrackType `column:"type" json:"type"` // Required
-	Name string    `column:"name" json:"name"` // Required
+	ID                 string       `column:"id" json:"id" validate:"required"`                                  // Generated, required, unique
+	EventID            string       `column:"event" json:"event"`                                                // Optional, defaults to the request event
+	Type               TrackType    `column:"type" json:"type"`                                                  // Required
+	Name               string       `column:"name" json:"name" validate:"required"`                              // Required
+	MaxDurationMinutes int          `column:"max_duration_minutes" json:"max_duration_minutes" validate:"min=0"` // Optional, active timeslots are automatically finished after this (0 to disable)
+	NoShowMinutes      int          `column:"no_show_minutes" json:"no_show_minutes" validate:"min=0"`           // Optional, active timeslots without any tests are automatically finished after this (0 to disable)
+	TaskLockMode       TaskLockMode `column:"task_lock_mode" json:"task_lock_mode"`                              // Optional, how tasks with uncompleted dependencies are shown to participants
+	Status             TrackStatus  `column:"status" json:"status"`                                              // Optional, defaults to open
+	// Optional, participants may only register within the window (either end may be omitted)
+	RegistrationOpenTime  *time.Time `column:"registration_open_time" json:"registration_open_time"`
+	RegistrationCloseTime *time.Time `column:"registration_close_time" json:"registration_close_time"`
+	// Optional, participants may not register when the track has this many non-cancelled timeslots (0 to disable)
+	MaxRegistrations int `column:"max_registrations" json:"max_registrations" validate:"min=0"`
+	// Optional, new timeslots registered by participants are pending until approved by an operator
+	RegistrationApproval bool `column:"registration_approval" json:"registration_approval"`
+	// Generated, when the track was created and last updated
+	db.Timestamps
 }
 
 // Tracks is a list of tracks.
 type Tracks []*Track
 
+var trackCachePolicy = rest.CachePolicy{TTL: 30 * time.Second, Tables: []string{"tracks"}}
+
 func init() {
-	rest.AddHandler("/tracks/", "^$", func() interface{} { return &Tracks{} })
-	rest.AddHandler("/track/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Track{} })
+	db.RegisterSearchVector("tracks", "search", "name")
+	rest.AddCachedHandler("/tracks/", "^$", trackCachePolicy, func() interface{} { return &Tracks{} })
+	rest.AddCachedHandler("/track/", "^(?:(?P<id>[^/]+)/)?$", trackCachePolicy, func() interface{} { return &Track{} })
+}
+
+// ListQueryFields returns the fields tracks may be filtered and sorted on.
+func (tracks *Tracks) ListQueryFields() map[string]string {
+	return map[string]string{"id": "id", "event": "event", "type": "type", "name": "name", "status": "status", "created_at": "created_at", "updated_at": "updated_at"}
 }
 
 // Get gets multiple tracks.
 func (tracks *Tracks) Get(request *rest.Request) rest.Result {
 	// Check params, prep filtering
-	var whereArgs []interface{}
+	whereArgs := request.ListFilterArgs
 	if trackType, ok := request.QueryArgs["type"]; ok {
 		whereArgs = append(whereArgs, "type", "=", trackType)
 	}
+	if request.EventID != "" {
+		whereArgs = append(whereArgs, "event", "=", request.EventID)
+	}
 
 	// Get
-	dbResult := db.SelectMany(tracks, "tracks", whereArgs...)
+	dbResult := db.SelectManyOrdered(tracks, "tracks", request.ListOrderBy, whereArgs...)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
+	}
+
+	// Hide drafts from non-operators
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		oldTracks := *tracks
+		*tracks = make(Tracks, 0, len(oldTracks))
+		for _, track := range oldTracks {
+			if track.isVisible() {
+				*tracks = append(*tracks, track)
+			}
+		}
 	}
 	return rest.Result{}
 }
@@ -72,16 +123,19 @@ func (track *Track) Get(request *rest.Request) rest.Result {
 	// Check params
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 
 	// Get
 	dbResult := db.Select(track, "tracks", "id", "=", id)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
 	if !dbResult.IsSuccess() {
-		return rest.Result{Code: 404, Message: "not found"}
+		return rest.NotFound("not found")
+	}
+	if !track.isVisible() && request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.NotFound("not found")
 	}
 	return rest.Result{}
 }
@@ -94,15 +148,21 @@ func (track *Track) Post(request *rest.Request) rest.Result {
 	}
 
 	// Validate
+	if track.Status == "" {
+		track.Status = TrackStatusOpen
+	}
+	if track.EventID == "" {
+		track.EventID = request.EventID
+	}
 	if result := track.validate(); !result.IsOk() {
 		return result
 	}
 
 	// Check if duplicate
 	if exists, err := track.exists(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if exists {
-		return rest.Result{Code: 409, Message: "duplicate ID"}
+		return rest.Conflict("duplicate ID")
 	}
 
 	// Create and redirect
@@ -111,7 +171,7 @@ func (track *Track) Post(request *rest.Request) rest.Result {
 		return result
 	}
 	result.Code = 201
-	result.Location = fmt.Sprintf("%v/track/%v/", config.Config.SitePrefix, track.ID)
+	result.Location = fmt.Sprintf("%v/track/%v/", config.Get().SitePrefix, track.ID)
 	return result
 }
 
@@ -125,12 +185,18 @@ func (track *Track) Put(request *rest.Request) rest.Result {
 	// Check params
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 
 	// Validate
 	if track.ID != id {
-		return rest.Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
+		return rest.BadRequest("mismatch between URL and JSON IDs")
+	}
+	if track.Status == "" {
+		track.Status = TrackStatusOpen
+	}
+	if track.EventID == "" {
+		track.EventID = request.EventID
 	}
 	if result := track.validate(); !result.IsOk() {
 		return result
@@ -142,6 +208,37 @@ func (track *Track) Put(request *rest.Request) rest.Result {
 
 // Delete deletes a track.
 func (track *Track) Delete(request *rest.Request) rest.Result {
+	if result := track.checkDelete(request); !result.IsOk() {
+		return result
+	}
+
+	// Delete
+	dbResult := db.Delete("tracks", "id", "=", track.ID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// PreviewDelete counts the rows referring to the track, which a delete would leave dangling.
+func (track *Track) PreviewDelete(request *rest.Request) (map[string]int, rest.Result) {
+	if result := track.checkDelete(request); !result.IsOk() {
+		return nil, result
+	}
+	references := []db.Reference{{Table: "tracks", Column: "id"}}
+	for _, table := range []string{"tasks", "stations", "timeslots", "teams", "tests", "test_history", "station_history",
+		"track_operators", "maintenance_windows", "queue_entries", "slot_templates", "leaderboard_freezes", "leaderboard_entries"} {
+		references = append(references, db.Reference{Table: table, Column: "track"})
+	}
+	affected, err := db.CountReferences(track.ID, references...)
+	if err != nil {
+		return nil, rest.InternalError(err)
+	}
+	return affected, rest.Result{}
+}
+
+// checkDelete checks the perms and that the track exists, for Delete and PreviewDelete.
+func (track *Track) checkDelete(request *rest.Request) rest.Result {
 	// Check perms
 	if request.AccessToken.GetRole() != rest.RoleAdmin {
 		return rest.UnauthorizedResult(request.AccessToken)
@@ -150,37 +247,31 @@ func (track *Track) Delete(request *rest.Request) rest.Result {
 	// Check params
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+		return rest.BadRequest("missing ID")
 	}
 
 	// Check if it exists
 	track.ID = id
 	exists, err := track.exists()
 	if err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	}
 	if !exists {
-		return rest.Result{Code: 404, Message: "not found"}
-	}
-
-	// Delete
-	dbResult := db.Delete("tracks", "id", "=", track.ID)
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.NotFound("not found")
 	}
 	return rest.Result{}
 }
 
 func (track *Track) create() rest.Result {
 	if exists, err := track.exists(); err != nil {
-		return rest.Result{Code: 500, Error: err}
+		return rest.InternalError(err)
 	} else if exists {
-		return rest.Result{Code: 409, Message: "duplicate"}
+		return rest.Conflict("duplicate")
 	}
 
 	dbResult := db.Insert("tracks", track)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
 	return rest.Result{}
 }
@@ -188,7 +279,7 @@ func (track *Track) create() rest.Result {
 func (track *Track) createOrUpdate() rest.Result {
 	exists, existsErr := track.exists()
 	if existsErr != nil {
-		return rest.Result{Code: 500, Error: existsErr}
+		return rest.InternalError(existsErr)
 	}
 
 	var dbResult db.Result
@@ -198,7 +289,7 @@ func (track *Track) createOrUpdate() rest.Result {
 		dbResult = db.Insert("tracks", track)
 	}
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return rest.InternalError(dbResult.Error)
 	}
 	return rest.Result{}
 }
@@ -214,23 +305,127 @@ func (track *Track) exists() (bool, error) {
 }
 
 func (track *Track) validate() rest.Result {
+	if problems := rest.Validate(track); len(problems) > 0 {
+		return rest.ValidationFailedResult(problems)
+	}
+
 	switch {
-	case track.ID == "":
-		return rest.Result{Code: 400, Message: "missing ID"}
 	case !track.validateType():
-		return rest.Result{Code: 400, Message: "missing or invalid type"}
+		return rest.BadRequest("missing or invalid type")
+	case !validateTaskLockMode(track.TaskLockMode):
+		return rest.BadRequest("invalid task lock mode")
+	case !track.validateStatus():
+		return rest.BadRequest("invalid status")
+	case track.RegistrationOpenTime != nil && track.RegistrationCloseTime != nil && track.RegistrationCloseTime.Before(*track.RegistrationOpenTime):
+		return rest.BadRequest("registration closes before it opens")
+	}
+	if track.EventID != "" {
+		event := Event{ID: track.EventID}
+		if exists, err := event.exists(); err != nil {
+			return rest.InternalError(err)
+		} else if !exists {
+			return rest.BadRequest("referenced event does not exist")
+		}
 	}
 
 	return rest.Result{}
 }
 
 func (track *Track) validateType() bool {
-	switch track.Type {
-	case trackTypeNet:
+	_, ok := track.behavior()
+	return ok
+}
+
+func (track *Track) validateStatus() bool {
+	switch track.Status {
+	case TrackStatusDraft:
+		fallthrough
+	case TrackStatusOpen:
 		fallthrough
-	case trackTypeServer:
+	case TrackStatusClosed:
+		fallthrough
+	case TrackStatusArchived:
 		return true
 	default:
 		return false
 	}
 }
+
+// isVisible checks if participants may see the track.
+func (track *Track) isVisible() bool {
+	return track.Status != TrackStatusDraft
+}
+
+// hiddenTrackIDs gets the IDs of the tracks hidden from the requester, i.e. drafts for non-operators (see isVisible).
+// For filtering listings of things belonging to tracks.
+func hiddenTrackIDs(request *rest.Request) (map[string]bool, error) {
+	hiddenIDs := make(map[string]bool)
+	if request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin {
+		return hiddenIDs, nil
+	}
+	var drafts Tracks
+	dbResult := db.SelectMany(&drafts, "tracks", "status", "=", TrackStatusDraft)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	for _, track := range drafts {
+		hiddenIDs[track.ID] = true
+	}
+	return hiddenIDs, nil
+}
+
+// checkTrackVisible gets a not found result if the track doesn't exist or is hidden from the requester (see isVisible).
+func checkTrackVisible(request *rest.Request, trackID string) rest.Result {
+	var track Track
+	dbResult := db.Select(&track, "tracks", "id", "=", trackID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("track not found")
+	}
+	if !track.isVisible() && request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.NotFound("track not found")
+	}
+	return rest.Result{}
+}
+
+// checkRegistrationAllowed checks if participants may register new timeslots for the track now.
+func (track *Track) checkRegistrationAllowed() rest.Result {
+	if result := track.checkParticipationAllowed(); !result.IsOk() {
+		return result
+	}
+	now := time.Now()
+	if track.RegistrationOpenTime != nil && now.Before(*track.RegistrationOpenTime) {
+		return rest.Forbidden("registration for the track has not opened yet")
+	}
+	if track.RegistrationCloseTime != nil && now.After(*track.RegistrationCloseTime) {
+		return rest.Forbidden("registration for the track has closed")
+	}
+	if track.MaxRegistrations > 0 {
+		count, err := track.countRegistrations()
+		if err != nil {
+			return rest.InternalError(err)
+		}
+		if count >= track.MaxRegistrations {
+			return rest.Conflict("the track is full")
+		}
+	}
+	return rest.Result{}
+}
+
+// countRegistrations counts the non-cancelled timeslots for the track, including pending ones.
+func (track *Track) countRegistrations() (int, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM timeslots WHERE track = $1 AND cancel_time IS NULL", track.ID)
+	err := row.Scan(&count)
+	return count, err
+}
+
+// checkParticipationAllowed checks if participants may use the track now, e.g. begin timeslots.
+func (track *Track) checkParticipationAllowed() rest.Result {
+	if track.Status != TrackStatusOpen {
+		return rest.Forbidden("track is not open")
+	}
+	return rest.Result{}
+}
@@ -0,0 +1,70 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/rest/resttest"
+)
+
+func TestMain(m *testing.M) {
+	resttest.Main(m)
+}
+
+func TestTrackHandlers(t *testing.T) {
+	harness := resttest.New(t)
+	track := Track{ID: "net", Type: trackTypeNet, Name: "Net", Status: TrackStatusOpen}
+
+	_, participantKey := harness.User(rest.RoleParticipant)
+	response := harness.Do("POST", "/api/track/", participantKey, track)
+	helper.CheckEqual(t, response.Code, 403)
+
+	response = harness.Do("POST", "/api/track/", harness.Token(rest.RoleAdmin), track)
+	helper.CheckEqual(t, response.Code, 201)
+	helper.CheckEqual(t, response.Header().Get("Location"), "/api/track/net/")
+
+	var tracks Tracks
+	resttest.DecodeJSON(t, harness.Do("GET", "/api/v1/tracks/", "", nil), 200, &tracks)
+	helper.CheckEqual(t, len(tracks), 1)
+	helper.CheckEqual(t, tracks[0].Name, "Net")
+}
+
+func TestTrackSummaryHead(t *testing.T) {
+	harness := resttest.New(t)
+	adminKey := harness.Token(rest.RoleAdmin)
+	track := Track{ID: "net", Type: trackTypeNet, Name: "Net", Status: TrackStatusOpen}
+	helper.CheckEqual(t, harness.Do("POST", "/api/track/", adminKey, track).Code, 201)
+
+	// Answered from the change counter, with the same ETag as GET but without a length (before GET fills the cache)
+	headResponse := harness.Do("HEAD", "/api/custom/track-summary/net/", adminKey, nil)
+	helper.CheckEqual(t, headResponse.Code, 200)
+	helper.CheckEqual(t, headResponse.Header().Get("Content-Length"), "")
+	helper.CheckEqual(t, headResponse.Body.Len(), 0)
+	getResponse := harness.Do("GET", "/api/custom/track-summary/net/", adminKey, nil)
+	helper.CheckEqual(t, getResponse.Code, 200)
+	helper.CheckEqual(t, headResponse.Header().Get("ETag"), getResponse.Header().Get("ETag"))
+
+	headResponse = harness.Do("HEAD", "/api/custom/track-summary/missing/", adminKey, nil)
+	helper.CheckEqual(t, headResponse.Code, 404)
+}
@@ -0,0 +1,129 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"github.com/gathering/tech-online-backend/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// StationCleanupMode is what happens to a station when its timeslot ends.
+type StationCleanupMode string
+
+const (
+	// StationCleanupModeDirty marks the station as dirty, for reprovisioning.
+	StationCleanupModeDirty StationCleanupMode = "dirty"
+	// StationCleanupModeTerminate terminates the station (requires dynamic provisioning).
+	StationCleanupModeTerminate StationCleanupMode = "terminate"
+	// StationCleanupModeDefaultStatus sets the station back to its default status, for stations which need no cleanup.
+	StationCleanupModeDefaultStatus StationCleanupMode = "default-status"
+)
+
+// StationProvisioningMode is how stations are created for a track.
+type StationProvisioningMode string
+
+const (
+	// StationProvisioningModeStatic means stations are created manually.
+	StationProvisioningModeStatic StationProvisioningMode = "static"
+	// StationProvisioningModeDynamic means stations may be provisioned on demand, through the configured server track service.
+	StationProvisioningModeDynamic StationProvisioningMode = "dynamic"
+)
+
+// CredentialPolicy is who may see station credentials, besides operators/admins.
+type CredentialPolicy string
+
+const (
+	// CredentialPolicyAssigned shows the credentials to the owners of the timeslot assigned to the station.
+	CredentialPolicyAssigned CredentialPolicy = "assigned"
+	// CredentialPolicyOperators shows the credentials to operators/admins only.
+	CredentialPolicyOperators CredentialPolicy = "operators"
+)
+
+// TrackBehavior is how the stations for a track type are handled.
+type TrackBehavior struct {
+	CleanupMode      StationCleanupMode
+	ProvisioningMode StationProvisioningMode
+	CredentialPolicy CredentialPolicy
+}
+
+// builtinTrackBehaviors contains the behavior for the built-in track types, which may be overridden in the config.
+var builtinTrackBehaviors = map[TrackType]TrackBehavior{
+	trackTypeNet: {
+		CleanupMode:      StationCleanupModeDirty,
+		ProvisioningMode: StationProvisioningModeStatic,
+		CredentialPolicy: CredentialPolicyAssigned,
+	},
+	trackTypeServer: {
+		CleanupMode:      StationCleanupModeTerminate,
+		ProvisioningMode: StationProvisioningModeDynamic,
+		CredentialPolicy: CredentialPolicyAssigned,
+	},
+}
+
+// trackBehaviorForType gets the behavior for a track type, from the config or the built-in ones.
+// Returns false if the type is unknown or invalidly configured.
+func trackBehaviorForType(trackType TrackType) (TrackBehavior, bool) {
+	typeConfig, configured := config.Get().TrackTypes[string(trackType)]
+	if !configured {
+		behavior, ok := builtinTrackBehaviors[trackType]
+		return behavior, ok
+	}
+
+	behavior := TrackBehavior{
+		CleanupMode:      StationCleanupMode(typeConfig.CleanupMode),
+		ProvisioningMode: StationProvisioningMode(typeConfig.ProvisioningMode),
+		CredentialPolicy: CredentialPolicy(typeConfig.CredentialPolicy),
+	}
+	if !behavior.isValid() {
+		log.WithField("track_type", trackType).Warn("Invalid track type config")
+		return TrackBehavior{}, false
+	}
+	return behavior, true
+}
+
+// behavior gets the behavior for the track type.
+func (track *Track) behavior() (TrackBehavior, bool) {
+	return trackBehaviorForType(track.Type)
+}
+
+func (behavior *TrackBehavior) isValid() bool {
+	switch behavior.CleanupMode {
+	case StationCleanupModeDirty, StationCleanupModeDefaultStatus:
+	case StationCleanupModeTerminate:
+		// Terminating requires the provisioning service
+		if behavior.ProvisioningMode != StationProvisioningModeDynamic {
+			return false
+		}
+	default:
+		return false
+	}
+	switch behavior.ProvisioningMode {
+	case StationProvisioningModeStatic, StationProvisioningModeDynamic:
+	default:
+		return false
+	}
+	switch behavior.CredentialPolicy {
+	case CredentialPolicyAssigned, CredentialPolicyOperators:
+	default:
+		return false
+	}
+	return true
+}
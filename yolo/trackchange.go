@@ -0,0 +1,104 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// trackChangeColumns maps the tables track composites are built from to the column containing the track ID.
+var trackChangeColumns = map[string]string{
+	"tracks":            "id",
+	"stations":          "track",
+	"tasks":             "track",
+	"task_dependencies": "",
+	"tests":             "track",
+	"timeslots":         "track",
+	"queue_entries":     "track",
+}
+
+// trackChanges counts writes per track, as a cheap ETag source for the track composites.
+// Writes where the track isn't known (e.g. deletes by ID) bump the generation instead, changing the tags for all tracks.
+// The instance ID keeps tags from different instances and restarts from colliding.
+var trackChanges = struct {
+	sync.Mutex
+	instance   string
+	generation uint64
+	counters   map[string]uint64
+}{
+	instance: uuid.NewString(),
+	counters: make(map[string]uint64),
+}
+
+func init() {
+	db.AddChangeListener(trackChangeListener)
+}
+
+func trackChangeListener(change db.Change) {
+	column, ok := trackChangeColumns[change.Table]
+	if !ok {
+		return
+	}
+	trackChanges.Lock()
+	defer trackChanges.Unlock()
+	trackID, ok := change.Columns[column].(string)
+	if column == "" || !ok || trackID == "" {
+		trackChanges.generation++
+		return
+	}
+	trackChanges.counters[trackID]++
+}
+
+// trackChangeTag gets a tag which changes whenever anything belonging to the track may have changed.
+func trackChangeTag(trackID string) string {
+	trackChanges.Lock()
+	defer trackChanges.Unlock()
+	return fmt.Sprintf("%v/%v/%v", trackChanges.instance, trackChanges.generation, trackChanges.counters[trackID])
+}
+
+// trackChangeETag implements rest.ETagger for composites identified by the "track_id" path arg.
+func trackChangeETag(request *rest.Request) (string, bool) {
+	trackID := request.PathArgs["track_id"]
+	if trackID == "" {
+		return "", false
+	}
+	return trackChangeTag(trackID), true
+}
+
+// ETag changes when the track or its stations change.
+func (trackAndStations *TrackStations) ETag(request *rest.Request) (string, bool) {
+	return trackChangeETag(request)
+}
+
+// ETag changes when the track or its tasks, stations, timeslots or tests change.
+func (t4 *StationTasksTests) ETag(request *rest.Request) (string, bool) {
+	return trackChangeETag(request)
+}
+
+// ETag changes when the track or its stations, timeslots, queue or tests change.
+func (summary *TrackSummary) ETag(request *rest.Request) (string, bool) {
+	return trackChangeETag(request)
+}
@@ -0,0 +1,155 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// TrackOperator assigns a user to operate a track. Users assigned to any tracks may only change stations,
+// timeslots and tests for those tracks, while users without assignments may still operate all tracks.
+type TrackOperator struct {
+	TrackID string     `column:"track" json:"track"` // Required
+	UserID  *uuid.UUID `column:"user" json:"user"`   // Required
+}
+
+// TrackOperators is a list of track operator assignments.
+type TrackOperators []*TrackOperator
+
+func init() {
+	rest.AddHandler("/admin/", "^track/(?P<track_id>[^/]+)/operators/$", func() interface{} { return &TrackOperators{} })
+	rest.AddHandler("/admin/", "^track/(?P<track_id>[^/]+)/operators/(?P<user_id>[^/]+)/$", func() interface{} { return &TrackOperator{} })
+}
+
+// Get gets the operators assigned to a track.
+func (operators *TrackOperators) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.BadRequest("missing track ID")
+	}
+
+	dbResult := db.SelectMany(operators, "track_operators", "track", "=", trackID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Put assigns a user to operate a track.
+func (operator *TrackOperator) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.BadRequest("missing track ID")
+	}
+	userID, uuidErr := uuid.Parse(request.PathArgs["user_id"])
+	if uuidErr != nil {
+		return rest.BadRequest("invalid user ID")
+	}
+
+	// Validate
+	operator.TrackID = trackID
+	operator.UserID = &userID
+	track := Track{ID: trackID}
+	if exists, err := track.exists(); err != nil {
+		return rest.InternalError(err)
+	} else if !exists {
+		return rest.NotFound("track not found")
+	}
+	user := rest.User{ID: operator.UserID}
+	if exists, err := user.ExistsWithID(); err != nil {
+		return rest.InternalError(err)
+	} else if !exists {
+		return rest.BadRequest("referenced user does not exist")
+	}
+
+	dbResult := db.Upsert("track_operators", operator, "track", "=", operator.TrackID, "\"user\"", "=", operator.UserID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Delete unassigns a user from operating a track.
+func (operator *TrackOperator) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	userID, userIDExists := request.PathArgs["user_id"]
+	if !trackIDExists || trackID == "" || !userIDExists || userID == "" {
+		return rest.BadRequest("missing track or user ID")
+	}
+
+	dbResult := db.Delete("track_operators", "track", "=", trackID, "\"user\"", "=", userID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if dbResult.Affected == 0 {
+		return rest.NotFound("not found")
+	}
+	return rest.Result{}
+}
+
+// checkTrackOperator checks that the requester may change things belonging to all the tracks.
+// Admins and tokens without users (e.g. scripts) may change any track, and so may users not assigned to any tracks.
+// The role itself must be checked separately.
+func checkTrackOperator(token rest.AccessTokenEntry, trackIDs ...string) rest.Result {
+	if token.GetRole() == rest.RoleAdmin || token.OwnerUserID == nil {
+		return rest.Result{}
+	}
+	var operators TrackOperators
+	dbResult := db.SelectMany(&operators, "track_operators", "\"user\"", "=", token.OwnerUserID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if len(operators) == 0 {
+		return rest.Result{}
+	}
+	assignedTrackIDs := make(map[string]bool, len(operators))
+	for _, operator := range operators {
+		assignedTrackIDs[operator.TrackID] = true
+	}
+	for _, trackID := range trackIDs {
+		if !assignedTrackIDs[trackID] {
+			return rest.Forbidden(fmt.Sprintf("not an operator for track %v", trackID))
+		}
+	}
+	return rest.Result{}
+}
@@ -0,0 +1,599 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/worker"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// WebhookEvent is a type of entity change which webhooks may subscribe to.
+type WebhookEvent string
+
+const (
+	// WebhookEventStationStatusChanged is sent when the status of an existing station changes.
+	WebhookEventStationStatusChanged WebhookEvent = "station.status_changed"
+	// WebhookEventTimeslotFinished is sent when a timeslot is finished, manually or automatically.
+	WebhookEventTimeslotFinished WebhookEvent = "timeslot.finished"
+	// WebhookEventTestFailed is sent when a test starts failing for a station.
+	WebhookEventTestFailed WebhookEvent = "test.failed"
+	// WebhookEventStationTestsPassed is sent when all tests for a station (in the current timeslot, if any) pass,
+	// after any of them failed. It's also sent to the provisioning service of server tracks, if configured.
+	WebhookEventStationTestsPassed WebhookEvent = "station.tests_passed"
+)
+
+// WebhookDeliveryStatus is the delivery status of a webhook event.
+type WebhookDeliveryStatus string
+
+const (
+	// WebhookDeliveryStatusPending means it's waiting for the first or next attempt.
+	WebhookDeliveryStatusPending WebhookDeliveryStatus = "pending"
+	// WebhookDeliveryStatusDelivered means it got a 2XX response.
+	WebhookDeliveryStatusDelivered WebhookDeliveryStatus = "delivered"
+	// WebhookDeliveryStatusDead means all attempts failed. It's kept (the dead-letter list) until retried or the webhook is deleted.
+	WebhookDeliveryStatusDead WebhookDeliveryStatus = "dead"
+)
+
+// webhookWorkerTaskName is the name of the worker task delivering webhook events.
+const webhookWorkerTaskName = "webhook-delivery"
+
+// webhookWorkerInterval is how often pending deliveries are attempted.
+const webhookWorkerInterval = 10 * time.Second
+
+// webhookMaxAttempts is the number of attempts before a delivery is dead.
+const webhookMaxAttempts = 6
+
+// webhookInitialBackoff is the delay before the second attempt, doubled for every following attempt.
+const webhookInitialBackoff = 30 * time.Second
+
+// webhookDeliveredRetention is how long delivered events are kept.
+const webhookDeliveredRetention = 7 * 24 * time.Hour
+
+// webhookTimeout is the timeout for each delivery attempt.
+const webhookTimeout = 10 * time.Second
+
+// webhookSignatureHeader contains the HMAC-SHA256 of the body using the webhook secret, as "sha256=<hex>".
+const webhookSignatureHeader = "X-Techo-Signature"
+
+// Webhook is a subscription to entity changes, delivered as signed JSON POSTs to the URL.
+type Webhook struct {
+	ID      *uuid.UUID         `column:"id" json:"id"`           // Generated, required, unique
+	URL     string             `column:"url" json:"url"`         // Required, HTTP(S)
+	Events  pq.StringArray     `column:"events" json:"events"`   // Required, the event types to deliver
+	Secret  db.EncryptedString `column:"secret" json:"secret"`   // Optional, for signing payloads (encrypted at rest if configured)
+	Enabled bool               `column:"enabled" json:"enabled"` // Events aren't queued for disabled webhooks
+	Comment string             `column:"comment" json:"comment"` // Optional, e.g. what it's for
+}
+
+// Webhooks is a list of webhooks.
+type Webhooks []*Webhook
+
+// WebhookDelivery is a single event queued for a webhook.
+type WebhookDelivery struct {
+	ID              *uuid.UUID            `column:"id" json:"id"`
+	WebhookID       *uuid.UUID            `column:"webhook" json:"webhook"` // Empty for deliveries to a provisioning service
+	TrackID         string                `column:"track" json:"track"`     // Server track whose provisioning service gets it, if not for a webhook
+	Event           WebhookEvent          `column:"event" json:"event"`
+	Payload         string                `column:"payload" json:"payload"` // The JSON body
+	Status          WebhookDeliveryStatus `column:"status" json:"status"`
+	Attempts        int                   `column:"attempts" json:"attempts"`
+	LastError       string                `column:"last_error" json:"last_error"`
+	CreationTime    *time.Time            `column:"creation_time" json:"creation_time"`
+	NextAttemptTime *time.Time            `column:"next_attempt_time" json:"next_attempt_time"`
+}
+
+// WebhookDeliveries is a list of webhook deliveries.
+type WebhookDeliveries []*WebhookDelivery
+
+// WebhookDeliveryRetryRequest is for retrying a dead delivery.
+type WebhookDeliveryRetryRequest struct{}
+
+// webhookPayload is the JSON body posted to webhooks.
+type webhookPayload struct {
+	ID    *uuid.UUID   `json:"id"` // The delivery ID, for deduplication by receivers
+	Event WebhookEvent `json:"event"`
+	Time  time.Time    `json:"time"`
+	Data  interface{}  `json:"data"`
+}
+
+// webhookStationData is the data for station events, without credentials.
+type webhookStationData struct {
+	ID             *uuid.UUID    `json:"id"`
+	TrackID        string        `json:"track"`
+	Shortname      string        `json:"shortname"`
+	Name           string        `json:"name"`
+	Status         StationStatus `json:"status"`
+	PreviousStatus StationStatus `json:"previous_status"`
+	TimeslotID     db.NullString `json:"timeslot"`
+}
+
+// webhookStationTestsData is the data for station test events.
+type webhookStationTestsData struct {
+	ID         *uuid.UUID    `json:"id"`
+	TrackID    string        `json:"track"`
+	Shortname  string        `json:"shortname"`
+	TimeslotID db.NullString `json:"timeslot"`
+	Tests      int           `json:"tests"` // Number of tests (all passing)
+}
+
+// webhookTimeslotData is the data for timeslot events.
+type webhookTimeslotData struct {
+	Timeslot  *Timeslot  `json:"timeslot"`
+	StationID *uuid.UUID `json:"station"`
+}
+
+func init() {
+	rest.AddHandler("/webhooks/", "^$", func() interface{} { return &Webhooks{} })
+	rest.AddHandler("/webhook/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Webhook{} })
+	rest.AddHandler("/webhook/", "^(?P<id>[^/]+)/deliveries/$", func() interface{} { return &WebhookDeliveries{} })
+	rest.AddHandler("/webhook-delivery/", "^(?P<id>[^/]+)/retry/$", func() interface{} { return &WebhookDeliveryRetryRequest{} })
+	worker.AddTask(webhookWorkerTaskName, webhookWorkerInterval, deliverWebhookEvents)
+}
+
+// Get gets all webhooks.
+func (webhooks *Webhooks) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	dbResult := db.SelectMany(webhooks, "webhooks")
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Get gets a single webhook.
+func (webhook *Webhook) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	dbResult := db.Select(webhook, "webhooks", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+	return rest.Result{}
+}
+
+// Post creates a new webhook.
+func (webhook *Webhook) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Make ID
+	if webhook.ID == nil {
+		newID := uuid.New()
+		webhook.ID = &newID
+	}
+
+	// Validate
+	if result := webhook.validate(); !result.IsOk() {
+		return result
+	}
+	if exists, err := webhook.exists(); err != nil {
+		return rest.InternalError(err)
+	} else if exists {
+		return rest.Conflict("duplicate")
+	}
+
+	// Create and redirect
+	dbResult := db.Insert("webhooks", webhook)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Created(fmt.Sprintf("%v/webhook/%v/", config.Get().SitePrefix, webhook.ID))
+}
+
+// Put updates a webhook.
+func (webhook *Webhook) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.BadRequest("missing ID")
+	}
+	id, uuidErr := uuid.Parse(rawID)
+	if uuidErr != nil {
+		return rest.BadRequest("invalid ID")
+	}
+
+	// Validate
+	if webhook.ID == nil || *webhook.ID != id {
+		return rest.BadRequest("mismatch between URL and JSON IDs")
+	}
+	if result := webhook.validate(); !result.IsOk() {
+		return result
+	}
+
+	dbResult := db.Upsert("webhooks", webhook, "id", "=", webhook.ID)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Delete deletes a webhook and its queued and dead deliveries.
+func (webhook *Webhook) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	dbResult := db.Delete("webhooks", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if dbResult.Affected == 0 {
+		return rest.NotFound("not found")
+	}
+	if deliveriesDBResult := db.Delete("webhook_deliveries", "webhook", "=", id); deliveriesDBResult.IsFailed() {
+		return rest.InternalError(deliveriesDBResult.Error)
+	}
+	return rest.Result{}
+}
+
+func (webhook *Webhook) exists() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM webhooks WHERE id = $1", webhook.ID)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+func (webhook *Webhook) validate() rest.Result {
+	if webhook.ID == nil {
+		return rest.BadRequest("missing ID")
+	}
+	webhookURL, urlErr := url.Parse(webhook.URL)
+	if urlErr != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+		return rest.BadRequest("missing or invalid URL, must be HTTP(S)")
+	}
+	if len(webhook.Events) == 0 {
+		return rest.BadRequest("missing events")
+	}
+	for _, event := range webhook.Events {
+		if !validateWebhookEvent(WebhookEvent(event)) {
+			return rest.BadRequest(fmt.Sprintf("invalid event: %v", event))
+		}
+	}
+	return rest.Result{}
+}
+
+func validateWebhookEvent(event WebhookEvent) bool {
+	switch event {
+	case WebhookEventStationStatusChanged:
+		fallthrough
+	case WebhookEventTimeslotFinished:
+		fallthrough
+	case WebhookEventTestFailed:
+		fallthrough
+	case WebhookEventStationTestsPassed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Get gets the deliveries for a webhook, newest first. Use "?status=dead" for the dead-letter list.
+func (deliveries *WebhookDeliveries) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+	whereArgs := []interface{}{"webhook", "=", id}
+	if status, ok := request.QueryArgs["status"]; ok {
+		whereArgs = append(whereArgs, "status", "=", status)
+	}
+
+	dbResult := db.SelectManyOrdered(deliveries, "webhook_deliveries", "creation_time DESC", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	return rest.Result{}
+}
+
+// Post queues a dead delivery again, with a fresh set of attempts.
+func (retryRequest *WebhookDeliveryRetryRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.BadRequest("missing ID")
+	}
+
+	// Get delivery
+	var delivery WebhookDelivery
+	dbResult := db.Select(&delivery, "webhook_deliveries", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.InternalError(dbResult.Error)
+	}
+	if !dbResult.IsSuccess() {
+		return rest.NotFound("not found")
+	}
+	if delivery.Status != WebhookDeliveryStatusDead {
+		return rest.Conflict("delivery is not dead")
+	}
+
+	// Queue it
+	now := time.Now()
+	delivery.Status = WebhookDeliveryStatusPending
+	delivery.Attempts = 0
+	delivery.NextAttemptTime = &now
+	if updateDBResult := db.Update("webhook_deliveries", &delivery, "id", "=", delivery.ID); updateDBResult.IsFailed() {
+		return rest.InternalError(updateDBResult.Error)
+	}
+	worker.Trigger(webhookWorkerTaskName)
+	return rest.Result{}
+}
+
+// queueWebhookEvent queues the event for all enabled webhooks subscribing to it.
+// The executor may be the DB or a transaction, so events for rolled back changes are never sent.
+func queueWebhookEvent(executor db.Executor, event WebhookEvent, data interface{}) error {
+	rows, rowsErr := executor.Query("SELECT id FROM webhooks WHERE enabled AND $1 = ANY(events)", event)
+	if rowsErr != nil {
+		return rowsErr
+	}
+	var webhookIDs []uuid.UUID
+	for rows.Next() {
+		var webhookID uuid.UUID
+		if err := rows.Scan(&webhookID); err != nil {
+			rows.Close()
+			return err
+		}
+		webhookIDs = append(webhookIDs, webhookID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range webhookIDs {
+		if err := insertWebhookDelivery(executor, event, data, &webhookIDs[i], ""); err != nil {
+			return err
+		}
+	}
+	if len(webhookIDs) > 0 {
+		worker.Trigger(webhookWorkerTaskName)
+	}
+	return nil
+}
+
+// insertWebhookDelivery queues the event for either a webhook or the provisioning service of a server track.
+func insertWebhookDelivery(executor db.Executor, event WebhookEvent, data interface{}, webhookID *uuid.UUID, trackID string) error {
+	now := time.Now()
+	deliveryID := uuid.New()
+	payload, payloadErr := json.Marshal(webhookPayload{ID: &deliveryID, Event: event, Time: now, Data: data})
+	if payloadErr != nil {
+		return payloadErr
+	}
+	delivery := WebhookDelivery{
+		ID:              &deliveryID,
+		WebhookID:       webhookID,
+		TrackID:         trackID,
+		Event:           event,
+		Payload:         string(payload),
+		Status:          WebhookDeliveryStatusPending,
+		CreationTime:    &now,
+		NextAttemptTime: &now,
+	}
+	return db.InsertWith(executor, "webhook_deliveries", &delivery).Error
+}
+
+// queueStationStatusChanged queues a station.status_changed event if the status changed.
+func queueStationStatusChanged(executor db.Executor, station *Station, previousStatus StationStatus) error {
+	if station.Status == previousStatus {
+		return nil
+	}
+	return queueWebhookEvent(executor, WebhookEventStationStatusChanged, webhookStationData{
+		ID:             station.ID,
+		TrackID:        station.TrackID,
+		Shortname:      station.Shortname,
+		Name:           station.Name,
+		Status:         station.Status,
+		PreviousStatus: previousStatus,
+		TimeslotID:     station.TimeslotID,
+	})
+}
+
+// queueStationTestsPassed queues a station.tests_passed event if all tests for the station of the test pass,
+// for webhooks and the provisioning service (if a server track). Call it when the test started passing.
+func queueStationTestsPassed(executor db.Executor, test *Test) error {
+	var total, failing int
+	row := executor.QueryRow("SELECT COUNT(*), COUNT(*) FILTER (WHERE status_success IS NOT TRUE) FROM tests WHERE track = $1 AND station_shortname = $2 AND timeslot = $3",
+		test.TrackID, test.StationShortname, test.TimeslotID)
+	if err := row.Scan(&total, &failing); err != nil {
+		return err
+	}
+	if total == 0 || failing > 0 {
+		return nil
+	}
+	var station Station
+	stationDBResult := db.SelectWith(executor, &station, "stations", "track", "=", test.TrackID, "shortname", "=", test.StationShortname)
+	if stationDBResult.IsFailed() {
+		return stationDBResult.Error
+	}
+	if !stationDBResult.IsSuccess() {
+		return nil
+	}
+
+	data := webhookStationTestsData{
+		ID:         station.ID,
+		TrackID:    station.TrackID,
+		Shortname:  station.Shortname,
+		TimeslotID: test.TimeslotID,
+		Tests:      total,
+	}
+	if err := queueWebhookEvent(executor, WebhookEventStationTestsPassed, data); err != nil {
+		return err
+	}
+	if trackConfig, ok := config.Get().ServerTracks[test.TrackID]; ok && trackConfig.TestsPassedURL != "" {
+		if err := insertWebhookDelivery(executor, WebhookEventStationTestsPassed, data, nil, test.TrackID); err != nil {
+			return err
+		}
+		worker.Trigger(webhookWorkerTaskName)
+	}
+	return nil
+}
+
+// deliverWebhookEvents attempts pending deliveries which are due and purges old delivered ones.
+func deliverWebhookEvents() {
+	now := time.Now()
+	if _, err := db.DB.Exec("DELETE FROM webhook_deliveries WHERE status = $1 AND creation_time < $2", WebhookDeliveryStatusDelivered, now.Add(-webhookDeliveredRetention)); err != nil {
+		log.WithError(err).Error("Failed to purge delivered webhook events")
+	}
+
+	var deliveries WebhookDeliveries
+	dbResult := db.SelectManyOrdered(&deliveries, "webhook_deliveries", "creation_time",
+		"status", "=", WebhookDeliveryStatusPending,
+		"next_attempt_time", "<=", now,
+	)
+	if dbResult.IsFailed() {
+		log.WithError(dbResult.Error).Error("Failed to load pending webhook deliveries")
+		return
+	}
+
+	webhooks := make(map[uuid.UUID]*Webhook)
+	for _, delivery := range deliveries {
+		if delivery.WebhookID == nil {
+			delivery.finish(deliverServerTrackEvent(delivery))
+			continue
+		}
+		webhook, ok := webhooks[*delivery.WebhookID]
+		if !ok {
+			webhook = &Webhook{}
+			webhookDBResult := db.Select(webhook, "webhooks", "id", "=", delivery.WebhookID)
+			if webhookDBResult.IsFailed() {
+				log.WithError(webhookDBResult.Error).Error("Failed to load webhook for delivery")
+				return
+			}
+			if !webhookDBResult.IsSuccess() {
+				webhook = nil
+			}
+			webhooks[*delivery.WebhookID] = webhook
+		}
+
+		if webhook == nil {
+			delivery.Attempts = webhookMaxAttempts - 1
+			delivery.finish(fmt.Errorf("webhook no longer exists"))
+		} else {
+			delivery.finish(webhook.deliver(delivery))
+		}
+	}
+}
+
+// finish counts the delivery attempt and saves the outcome, scheduling the next attempt if it failed.
+func (delivery *WebhookDelivery) finish(deliveryErr error) {
+	delivery.Attempts++
+	if deliveryErr == nil {
+		delivery.Status = WebhookDeliveryStatusDelivered
+		delivery.LastError = ""
+	} else {
+		delivery.LastError = deliveryErr.Error()
+		if delivery.Attempts >= webhookMaxAttempts {
+			delivery.Status = WebhookDeliveryStatusDead
+			log.WithError(deliveryErr).WithField("delivery", delivery.ID).Warn("Webhook delivery failed permanently")
+		} else {
+			nextAttemptTime := time.Now().Add(webhookInitialBackoff << (delivery.Attempts - 1))
+			delivery.NextAttemptTime = &nextAttemptTime
+		}
+	}
+	if updateDBResult := db.Update("webhook_deliveries", delivery, "id", "=", delivery.ID); updateDBResult.IsFailed() {
+		log.WithError(updateDBResult.Error).Error("Failed to save webhook delivery")
+	}
+}
+
+// deliver posts the delivery payload to the webhook, signed using the secret (if any).
+func (webhook *Webhook) deliver(delivery *WebhookDelivery) error {
+	body := []byte(delivery.Payload)
+	httpRequest, requestErr := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if requestErr != nil {
+		return requestErr
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("X-Techo-Event", string(delivery.Event))
+	httpRequest.Header.Set("X-Techo-Delivery", delivery.ID.String())
+	if webhook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write(body)
+		httpRequest.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	httpResponse, responseErr := client.Do(httpRequest)
+	if responseErr != nil {
+		return responseErr
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		return fmt.Errorf("response contained non-2XX status: %v", httpResponse.Status)
+	}
+	return nil
+}